@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+	"github.com/essajiwa/tunnelab/pkg/server"
+	"github.com/essajiwa/tunnelab/pkg/server/config"
+)
+
+// clientsFileVersion is the format version of client export files.
+const clientsFileVersion = 1
+
+// clientsFile is the JSON document written by -export-clients and read by
+// -import-clients.
+type clientsFile struct {
+	Version    int              `json:"version"`
+	ExportedAt time.Time        `json:"exported_at"`
+	Clients    []exportedClient `json:"clients"`
+}
+
+// exportedClient is a client as stored in the database. The API token is
+// copied as stored, so a hashed token stays hashed and a plain one plain.
+type exportedClient struct {
+	ID                string    `json:"id"`
+	Name              string    `json:"name"`
+	APIToken          string    `json:"api_token"`
+	MaxTunnels        int       `json:"max_tunnels"`
+	AllowedSubdomains string    `json:"allowed_subdomains,omitempty"`
+	Status            string    `json:"status"`
+	MonthlyByteQuota  int64     `json:"monthly_byte_quota"`
+	Scopes            string    `json:"scopes,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// exportClients writes every client of repo to w as JSON.
+//
+// Returns:
+//   - int: Number of clients written
+//   - error: Error if the clients cannot be read or written
+func exportClients(repo *database.Repository, w io.Writer) (int, error) {
+	clients, err := repo.ListClients()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list clients: %w", err)
+	}
+	file := clientsFile{Version: clientsFileVersion, ExportedAt: time.Now().UTC(), Clients: []exportedClient{}}
+	for _, c := range clients {
+		file.Clients = append(file.Clients, exportedClient{
+			ID:                c.ID,
+			Name:              c.Name,
+			APIToken:          c.APIToken,
+			MaxTunnels:        c.MaxTunnels,
+			AllowedSubdomains: c.AllowedSubdomains,
+			Status:            c.Status,
+			MonthlyByteQuota:  c.MonthlyByteQuota,
+			Scopes:            c.Scopes,
+			CreatedAt:         c.CreatedAt,
+			UpdatedAt:         c.UpdatedAt,
+		})
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(file); err != nil {
+		return 0, fmt.Errorf("failed to write clients: %w", err)
+	}
+	return len(file.Clients), nil
+}
+
+// importClients reads clients written by exportClients from r and inserts
+// them into repo. Clients whose ID or token already exists are skipped.
+//
+// Returns:
+//   - int: Number of clients imported
+//   - int: Number of clients skipped as duplicates
+//   - error: Error if the file is invalid or the import fails, in which case
+//     nothing is imported
+func importClients(repo *database.Repository, r io.Reader) (int, int, error) {
+	var file clientsFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return 0, 0, fmt.Errorf("failed to read clients: %w", err)
+	}
+	if file.Version != clientsFileVersion {
+		return 0, 0, fmt.Errorf("unsupported clients file version %d (want %d)", file.Version, clientsFileVersion)
+	}
+	clients := make([]*database.Client, 0, len(file.Clients))
+	for i, c := range file.Clients {
+		if c.ID == "" || c.APIToken == "" {
+			return 0, 0, fmt.Errorf("client %d has no id or api_token", i+1)
+		}
+		if err := auth.ValidateScopes(c.Scopes); err != nil {
+			return 0, 0, fmt.Errorf("client %s: %w", c.ID, err)
+		}
+		status := c.Status
+		if status == "" {
+			status = "active"
+		}
+		clients = append(clients, &database.Client{
+			ID:                c.ID,
+			Name:              c.Name,
+			APIToken:          c.APIToken,
+			MaxTunnels:        c.MaxTunnels,
+			AllowedSubdomains: c.AllowedSubdomains,
+			Status:            status,
+			MonthlyByteQuota:  c.MonthlyByteQuota,
+			Scopes:            c.Scopes,
+			CreatedAt:         c.CreatedAt,
+			UpdatedAt:         c.UpdatedAt,
+		})
+	}
+	imported, err := repo.ImportClients(clients)
+	if err != nil {
+		return 0, 0, err
+	}
+	return imported, len(clients) - imported, nil
+}
+
+// exportClientsTo writes every client of repo to the file at path, or to
+// stdout for "-". Only a file opened here is synced and closed; stdout may be
+// a pipe or terminal, which cannot be synced.
+//
+// Returns:
+//   - int: Number of clients written
+//   - error: Error if the clients cannot be read or the file written
+func exportClientsTo(repo *database.Repository, path string) (int, error) {
+	if path == "-" {
+		return exportClients(repo, os.Stdout)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := exportClients(repo, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// runClientsTransfer runs -export-clients or -import-clients against the
+// database of cfg. A path of "-" means stdout or stdin.
+func runClientsTransfer(cfg *config.Config, exportPath, importPath string) error {
+	repo, err := server.OpenRepository(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer repo.Close()
+
+	if exportPath != "" {
+		n, err := exportClientsTo(repo, exportPath)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d clients\n", n)
+		return nil
+	}
+
+	r := os.Stdin
+	if importPath != "-" {
+		if r, err = os.Open(importPath); err != nil {
+			return err
+		}
+		defer r.Close()
+	}
+	imported, skipped, err := importClients(repo, r)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d clients, skipped %d already present\n", imported, skipped)
+	return nil
+}
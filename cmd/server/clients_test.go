@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+)
+
+func newTestRepository(t *testing.T) *database.Repository {
+	t.Helper()
+	repo, err := database.NewRepository(filepath.Join(t.TempDir(), "tunnelab.db"))
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestExportImportClientsRoundTrip(t *testing.T) {
+	source := newTestRepository(t)
+	clients := []*database.Client{
+		{ID: "alice", Name: "Alice", APIToken: "tok-alice", MaxTunnels: 3, AllowedSubdomains: "app,api", Status: "active", MonthlyByteQuota: 1 << 30, Scopes: "http,custom-domain"},
+		{ID: "bob", Name: "Bob", APIToken: "tok-bob", MaxTunnels: 5, Status: "inactive", MonthlyByteQuota: -1},
+	}
+	for _, c := range clients {
+		if err := source.CreateClient(c); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if n, err := exportClients(source, &buf); err != nil || n != 2 {
+		t.Fatalf("expected 2 exported clients, got %d (%v)", n, err)
+	}
+	exported := buf.String()
+
+	target := newTestRepository(t)
+	// A client already present in the target is kept as it is.
+	if err := target.CreateClient(&database.Client{ID: "bob", Name: "Bob (new server)", APIToken: "tok-other", Status: "active"}); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	imported, skipped, err := importClients(target, strings.NewReader(exported))
+	if err != nil || imported != 1 || skipped != 1 {
+		t.Fatalf("expected 1 imported and 1 skipped, got %d and %d (%v)", imported, skipped, err)
+	}
+
+	alice, err := target.GetClientByToken("tok-alice")
+	if err != nil || alice == nil {
+		t.Fatalf("expected the imported token to authenticate, got %v (%v)", alice, err)
+	}
+	want, _ := source.GetClientByToken("tok-alice")
+	if alice.Name != want.Name || alice.MaxTunnels != want.MaxTunnels || alice.AllowedSubdomains != want.AllowedSubdomains ||
+		alice.MonthlyByteQuota != want.MonthlyByteQuota || alice.Scopes != want.Scopes || !alice.CreatedAt.Equal(want.CreatedAt) {
+		t.Fatalf("expected %+v, got %+v", want, alice)
+	}
+	if bob, _ := target.GetClientByToken("tok-other"); bob == nil || bob.Name != "Bob (new server)" {
+		t.Fatalf("expected the existing client to be kept, got %+v", bob)
+	}
+
+	if imported, skipped, err := importClients(target, strings.NewReader(exported)); err != nil || imported != 0 || skipped != 2 {
+		t.Fatalf("expected a second import to skip everything, got %d and %d (%v)", imported, skipped, err)
+	}
+}
+
+func TestImportClientsRejectsInvalidFiles(t *testing.T) {
+	tests := map[string]struct {
+		file          string
+		wantSubstring string
+	}{
+		"not json":        {file: "clients", wantSubstring: "failed to read clients"},
+		"unknown version": {file: `{"version": 2, "clients": []}`, wantSubstring: "unsupported clients file version"},
+		"missing token":   {file: `{"version": 1, "clients": [{"id": "alice"}]}`, wantSubstring: "has no id or api_token"},
+		"unknown scope":   {file: `{"version": 1, "clients": [{"id": "alice", "api_token": "tok", "scopes": "http,ftp"}]}`, wantSubstring: "unknown scope"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			repo := newTestRepository(t)
+			if _, _, err := importClients(repo, strings.NewReader(tt.file)); err == nil || !strings.Contains(err.Error(), tt.wantSubstring) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantSubstring, err)
+			}
+		})
+	}
+}
+
+func TestExportClientsToStdoutAndFile(t *testing.T) {
+	repo := newTestRepository(t)
+	if err := repo.CreateClient(&database.Client{ID: "alice", Name: "Alice", APIToken: "tok-alice", Status: "active"}); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	// Stdout is a pipe here, which cannot be synced.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	n, err := exportClientsTo(repo, "-")
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+	if err != nil || n != 1 || !strings.Contains(string(out), "tok-alice") {
+		t.Fatalf("expected one client on stdout, got %d (%v): %s", n, err, out)
+	}
+
+	path := filepath.Join(t.TempDir(), "clients.json")
+	if n, err := exportClientsTo(repo, path); err != nil || n != 1 {
+		t.Fatalf("expected one client in the file, got %d (%v)", n, err)
+	}
+	if data, err := os.ReadFile(path); err != nil || !strings.Contains(string(data), "tok-alice") {
+		t.Fatalf("expected the file to hold the export, got %s (%v)", data, err)
+	}
+	if _, err := exportClientsTo(repo, filepath.Join(t.TempDir(), "missing", "clients.json")); err == nil {
+		t.Fatal("expected an unwritable path to fail")
+	}
+}
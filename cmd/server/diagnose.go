@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/essajiwa/tunnelab/pkg/server"
+	"github.com/essajiwa/tunnelab/pkg/server/config"
+)
+
+// diagnoseTimeout bounds the database check of the diagnose command.
+const diagnoseTimeout = 5 * time.Second
+
+// diagnosis is the outcome of one check of the diagnose command.
+type diagnosis struct {
+	name    string // What was checked, e.g. "database"
+	skipped bool   // Not run because the configuration is invalid
+	err     error  // Why the check failed, nil if it passed
+	detail  string // What was found when the check passed
+}
+
+// runDiagnostics checks the configuration at path, then the database, the
+// certificates and the ports it names, as for the diagnose command. Nothing
+// is served; the database is opened and migrated as at startup.
+//
+// Returns:
+//   - []diagnosis: One result per check, in order
+func runDiagnostics(path string) []diagnosis {
+	cfg, err := config.Load(path)
+	if err != nil {
+		results := []diagnosis{{name: "config", err: err}}
+		for _, name := range []string{"database", "certificates", "ports"} {
+			results = append(results, diagnosis{name: name, skipped: true})
+		}
+		return results
+	}
+	return []diagnosis{
+		{name: "config", detail: path + " is valid"},
+		diagnoseDatabase(cfg),
+		diagnoseCertificates(cfg, time.Now()),
+		diagnosePorts(cfg),
+	}
+}
+
+// diagnoseDatabase opens the database, which applies pending migrations,
+// and checks that it answers queries.
+func diagnoseDatabase(cfg *config.Config) diagnosis {
+	d := diagnosis{name: "database"}
+	repo, err := server.OpenRepository(cfg)
+	if err != nil {
+		d.err = err
+		return d
+	}
+	defer repo.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), diagnoseTimeout)
+	defer cancel()
+	if err := repo.PingContext(ctx); err != nil {
+		d.err = fmt.Errorf("failed to ping database: %w", err)
+		return d
+	}
+	clients, err := repo.ListClientsContext(ctx)
+	if err != nil {
+		d.err = fmt.Errorf("failed to query clients: %w", err)
+		return d
+	}
+	d.detail = fmt.Sprintf("%s is reachable and migrated (%d clients)", cfg.Database.Path, len(clients))
+	return d
+}
+
+// diagnoseCertificates checks the certificate of the manual TLS mode, or the
+// certificate cache of the auto mode.
+func diagnoseCertificates(cfg *config.Config, now time.Time) diagnosis {
+	d := diagnosis{name: "certificates"}
+	switch cfg.TLS.Mode {
+	case "manual":
+		d.detail, d.err = checkManualCertificate(cfg.TLS.CertPath, cfg.TLS.KeyPath, now)
+	case "auto":
+		d.detail, d.err = checkCertCache(cfg.TLS.CacheDir, now)
+	default:
+		d.detail = "TLS is disabled"
+	}
+	return d
+}
+
+// checkManualCertificate loads a certificate/key pair and checks that the
+// certificate is currently valid.
+func checkManualCertificate(certPath, keyPath string, now time.Time) (string, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to load %s and %s: %w", certPath, keyPath, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %s: %w", certPath, err)
+	}
+	if now.Before(leaf.NotBefore) {
+		return "", fmt.Errorf("%s is not valid before %s", certPath, leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return "", fmt.Errorf("%s expired on %s", certPath, leaf.NotAfter.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s is valid until %s", certPath, leaf.NotAfter.Format(time.RFC3339)), nil
+}
+
+// checkCertCache checks that the autocert cache directory is writable and
+// private, since it holds private keys, and that the certificates cached
+// there can be parsed. Expired certificates are only counted: they are
+// renewed on demand.
+func checkCertCache(dir string, now time.Time) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect cache directory: %w", err)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return "", fmt.Errorf("cache directory %s is accessible to other users (mode %04o, want 0700)", dir, perm)
+	}
+	probe, err := os.CreateTemp(dir, ".diagnose-*")
+	if err != nil {
+		return "", fmt.Errorf("cache directory %s is not writable: %w", dir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read cache directory: %w", err)
+	}
+	var cached, expired int
+	var invalid []string
+	for _, entry := range entries {
+		// autocert also keeps its account key and challenge tokens here.
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "acme_account") || strings.HasSuffix(name, "+token") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			invalid = append(invalid, name)
+			continue
+		}
+		leaf, err := cachedLeaf(data)
+		if err != nil {
+			invalid = append(invalid, name)
+			continue
+		}
+		cached++
+		if now.After(leaf.NotAfter) {
+			expired++
+		}
+	}
+	if len(invalid) > 0 {
+		return "", fmt.Errorf("cache directory %s holds unreadable certificates: %s", dir, strings.Join(invalid, ", "))
+	}
+	return fmt.Sprintf("%s is writable, %d cached certificates (%d expired)", dir, cached, expired), nil
+}
+
+// cachedLeaf returns the first certificate of an autocert cache entry, which
+// holds the private key followed by the certificate chain in PEM.
+func cachedLeaf(data []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// diagnosePorts checks that every configured port can be bound.
+func diagnosePorts(cfg *config.Config) diagnosis {
+	d := diagnosis{name: "ports"}
+	ports, err := configuredPorts(cfg)
+	if err != nil {
+		d.err = err
+		return d
+	}
+	if conflicts := checkPorts(ports); len(conflicts) > 0 {
+		d.err = fmt.Errorf("%d port conflict(s):\n      %s", len(conflicts), strings.Join(conflicts, "\n      "))
+		return d
+	}
+	d.detail = fmt.Sprintf("%d ports available", len(ports))
+	return d
+}
+
+// diagnosticsReport formats results as a pass/fail report.
+//
+// Returns:
+//   - string: The report to print
+//   - bool: Whether every check passed
+func diagnosticsReport(path string, results []diagnosis) (string, bool) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Diagnostics for %s\n", path)
+	passed, failed, skipped := 0, 0, 0
+	for _, d := range results {
+		status, text := "PASS", d.detail
+		switch {
+		case d.skipped:
+			status, text = "SKIP", "configuration is invalid"
+			skipped++
+		case d.err != nil:
+			status, text = "FAIL", d.err.Error()
+			failed++
+		default:
+			passed++
+		}
+		fmt.Fprintf(&b, "  %s  %-13s %s\n", status, d.name, text)
+	}
+	fmt.Fprintf(&b, "%d passed, %d failed, %d skipped\n", passed, failed, skipped)
+	return b.String(), failed == 0 && skipped == 0
+}
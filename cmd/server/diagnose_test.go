@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/pkg/server/config"
+)
+
+// writeTestCertificate writes a self-signed certificate valid from notBefore
+// to notAfter and its key to dir.
+//
+// Returns:
+//   - string: The certificate file
+//   - string: The key file
+func writeTestCertificate(t *testing.T, dir string, notBefore, notAfter time.Time) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tunnel.example.com"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certPath, keyPath
+}
+
+func TestCheckManualCertificate(t *testing.T) {
+	now := time.Now()
+	tests := map[string]struct {
+		notBefore, notAfter time.Time
+		wantErr             string
+	}{
+		"valid":         {notBefore: now.Add(-time.Hour), notAfter: now.Add(24 * time.Hour)},
+		"expired":       {notBefore: now.Add(-48 * time.Hour), notAfter: now.Add(-time.Hour), wantErr: "expired"},
+		"not yet valid": {notBefore: now.Add(time.Hour), notAfter: now.Add(48 * time.Hour), wantErr: "not valid before"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			certPath, keyPath := writeTestCertificate(t, t.TempDir(), tt.notBefore, tt.notAfter)
+			_, err := checkManualCertificate(certPath, keyPath, now)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("expected the certificate to pass, got %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	if _, err := checkManualCertificate(filepath.Join(t.TempDir(), "missing.pem"), "missing.key", now); err == nil {
+		t.Fatal("expected a missing certificate to fail")
+	}
+}
+
+func TestCheckCertCache(t *testing.T) {
+	now := time.Now()
+	dir := filepath.Join(t.TempDir(), "certs")
+
+	detail, err := checkCertCache(dir, now)
+	if err != nil {
+		t.Fatalf("expected a new cache directory to pass, got %v", err)
+	}
+	if !strings.Contains(detail, "0 cached certificates") {
+		t.Fatalf("unexpected detail %q", detail)
+	}
+
+	// Cache entries hold the key followed by the chain, as autocert writes them.
+	certPath, keyPath := writeTestCertificate(t, t.TempDir(), now.Add(-48*time.Hour), now.Add(-time.Hour))
+	certPEM, _ := os.ReadFile(certPath)
+	keyPEM, _ := os.ReadFile(keyPath)
+	if err := os.WriteFile(filepath.Join(dir, "app.tunnel.example.com"), append(keyPEM, certPEM...), 0600); err != nil {
+		t.Fatalf("failed to write cache entry: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "acme_account+key"), keyPEM, 0600); err != nil {
+		t.Fatalf("failed to write account key: %v", err)
+	}
+	detail, err = checkCertCache(dir, now)
+	if err != nil || !strings.Contains(detail, "1 cached certificates (1 expired)") {
+		t.Fatalf("expected one expired certificate to be counted, got %q (%v)", detail, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "broken.example.com"), []byte("garbage"), 0600); err != nil {
+		t.Fatalf("failed to write cache entry: %v", err)
+	}
+	if _, err := checkCertCache(dir, now); err == nil || !strings.Contains(err.Error(), "broken.example.com") {
+		t.Fatalf("expected the unreadable entry to be reported, got %v", err)
+	}
+	os.Remove(filepath.Join(dir, "broken.example.com"))
+
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatalf("failed to change permissions: %v", err)
+	}
+	if _, err := checkCertCache(dir, now); err == nil || !strings.Contains(err.Error(), "accessible to other users") {
+		t.Fatalf("expected a world-readable cache to fail, got %v", err)
+	}
+}
+
+func TestDiagnoseDatabase(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Database.Path = filepath.Join(t.TempDir(), "tunnelab.db")
+	if d := diagnoseDatabase(cfg); d.err != nil || !strings.Contains(d.detail, "0 clients") {
+		t.Fatalf("expected a new database to pass, got %+v", d)
+	}
+
+	cfg.Database.Path = filepath.Join(t.TempDir(), "missing", "tunnelab.db")
+	if d := diagnoseDatabase(cfg); d.err == nil {
+		t.Fatalf("expected a database in a missing directory to fail, got %+v", d)
+	}
+}
+
+func TestDiagnosePorts(t *testing.T) {
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to occupy a port: %v", err)
+	}
+	defer busy.Close()
+
+	cfg := &config.Config{}
+	cfg.TLS.Mode = "disabled"
+	cfg.Server.ControlPort = freePort(t)
+	cfg.Server.HTTPPort = freePort(t)
+	if d := diagnosePorts(cfg); d.err != nil || d.detail != "2 ports available" {
+		t.Fatalf("expected free ports to pass, got %+v", d)
+	}
+
+	cfg.Server.HTTPPort = busy.Addr().(*net.TCPAddr).Port
+	if d := diagnosePorts(cfg); d.err == nil || !strings.Contains(d.err.Error(), "server.http_port") {
+		t.Fatalf("expected the busy port to fail, got %+v", d)
+	}
+}
+
+func TestRunDiagnostics(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.yaml")
+	// A one-port range keeps the port check fast.
+	tcpPort := freePort(t)
+	yaml := fmt.Sprintf("server:\n  domain: tunnel.example.com\n  control_port: %d\n  http_port: %d\ntls:\n  mode: disabled\ndatabase:\n  path: %s\ntunnels:\n  tcp_port_range: \"%d-%d\"\n",
+		freePort(t), freePort(t), filepath.Join(dir, "tunnelab.db"), tcpPort, tcpPort)
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	report, healthy := diagnosticsReport(path, runDiagnostics(path))
+	if !healthy || !strings.Contains(report, "4 passed, 0 failed, 0 skipped") {
+		t.Fatalf("expected every check to pass, got:\n%s", report)
+	}
+
+	if err := os.WriteFile(path, []byte("server:\n  domain: \"\"\n"), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	report, healthy = diagnosticsReport(path, runDiagnostics(path))
+	if healthy || !strings.Contains(report, "FAIL  config") || !strings.Contains(report, "SKIP  database") {
+		t.Fatalf("expected an invalid config to fail and skip the other checks, got:\n%s", report)
+	}
+}
@@ -10,11 +10,20 @@
 // Usage:
 //
 //	./tunnelab-server -config configs/server.yaml
+//	./tunnelab-server diagnose -config configs/server.yaml
+//
+// Commands:
+//
+//	diagnose: Check the configuration, database, certificates and ports, print a pass/fail report and exit (1 on failure)
 //
 // Flags:
 //
 //	-config: Path to configuration file (default: configs/server.yaml)
 //	-version: Show version information
+//	-close-tunnel: Force-close the tunnel with this subdomain on the running server and exit
+//	-validate: Check the configuration, print a report and exit (1 if invalid)
+//	-export-clients: Write every client of the database to this JSON file ("-" for stdout) and exit
+//	-import-clients: Add the clients of this JSON file ("-" for stdin) to the database and exit
 //
 // Configuration:
 //
@@ -23,141 +32,105 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
-	"github.com/essajiwa/tunnelab/internal/database"
-	"github.com/essajiwa/tunnelab/internal/server/config"
-	"github.com/essajiwa/tunnelab/internal/server/control"
-	"github.com/essajiwa/tunnelab/internal/server/proxy"
-	"github.com/essajiwa/tunnelab/internal/server/registry"
-	tlsmanager "github.com/essajiwa/tunnelab/internal/server/tls"
+	"github.com/essajiwa/tunnelab/pkg/server"
+	"github.com/essajiwa/tunnelab/pkg/server/config"
 )
 
 var (
 	version = "dev" // Server version, set during build
 )
 
+// shutdownTimeout bounds how long in-flight requests may take to finish on shutdown.
+const shutdownTimeout = 10 * time.Second
+
 // main is the entry point for TunneLab server.
 func main() {
 	configPath := flag.String("config", "configs/server.yaml", "Path to configuration file")
 	showVersion := flag.Bool("version", false, "Show version information")
-	flag.Parse()
+	closeTunnel := flag.String("close-tunnel", "", "Force-close the tunnel with this subdomain on the running server and exit")
+	validateOnly := flag.Bool("validate", false, "Check the configuration, print a report and exit without starting")
+	exportPath := flag.String("export-clients", "", "Write every client to this JSON file (- for stdout) and exit")
+	importPath := flag.String("import-clients", "", "Add the clients of this JSON file (- for stdin) to the database and exit")
+	args := os.Args[1:]
+	diagnose := len(args) > 0 && args[0] == "diagnose"
+	if diagnose {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
 
 	if *showVersion {
 		fmt.Printf("TunneLab Server Build Ver. %s\n", version)
 		os.Exit(0)
 	}
 
-	log.Printf("TunneLab Server Build Ver. %s started", version)
-
-	cfg, err := config.Load(*configPath)
-	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+	if diagnose {
+		report, healthy := diagnosticsReport(*configPath, runDiagnostics(*configPath))
+		fmt.Print(report)
+		if !healthy {
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	repo, err := database.NewRepository(cfg.Database.Path)
-	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+	if *validateOnly {
+		report, valid := validateConfig(*configPath)
+		if !valid {
+			fmt.Fprint(os.Stderr, report)
+			os.Exit(1)
+		}
+		fmt.Print(report)
+		os.Exit(0)
 	}
-	defer repo.Close()
 
-	reg := registry.NewRegistry()
+	log.Printf("TunneLab Server Build Ver. %s started", version)
 
-	controlHandler := control.NewHandler(reg, repo, cfg.Server.Domain)
-	if err := controlHandler.ConfigurePortAllocator(cfg.Tunnels.TCPPortRange); err != nil {
-		log.Fatalf("Invalid TCP port range %q: %v", cfg.Tunnels.TCPPortRange, err)
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	var tcpProxy *proxy.TCPProxy
-	if cfg.Tunnels.TCPPortRange != "" {
-		tcpProxy = proxy.NewTCPProxy(reg)
-		if err := tcpProxy.StartTCPServer(cfg.Tunnels.TCPPortRange); err != nil {
-			log.Fatalf("Failed to start TCP proxy: %v", err)
+	if *exportPath != "" || *importPath != "" {
+		if *exportPath != "" && *importPath != "" {
+			log.Fatalf("Use either -export-clients or -import-clients")
 		}
-		log.Printf("TCP tunneling enabled on ports %s", cfg.Tunnels.TCPPortRange)
+		if err := runClientsTransfer(cfg, *exportPath, *importPath); err != nil {
+			log.Fatalf("Failed to transfer clients: %v", err)
+		}
+		os.Exit(0)
 	}
 
-	httpProxy := proxy.NewHTTPProxy(reg, cfg.Server.Domain)
-
-	controlMux := http.NewServeMux()
-	controlMux.HandleFunc("/", controlHandler.HandleWebSocket)
-
-	proxyMux := http.NewServeMux()
-	proxyMux.Handle("/", httpProxy)
-	proxyMux.HandleFunc("/health", httpProxy.HandleHealthCheck)
-
-	var certManager *tlsmanager.CertManager
-	if cfg.TLS.Mode == "auto" {
-		var err error
-		certManager, err = tlsmanager.NewCertManager(&tlsmanager.Config{
-			Domain:   cfg.Server.Domain,
-			Email:    cfg.TLS.Email,
-			CacheDir: cfg.TLS.CacheDir,
-			Staging:  cfg.TLS.Staging,
-		})
-		if err != nil {
-			log.Fatalf("Failed to create certificate manager: %v", err)
+	if *closeTunnel != "" {
+		if err := requestCloseTunnel(cfg, *closeTunnel); err != nil {
+			log.Fatalf("Failed to close tunnel: %v", err)
 		}
-		log.Printf("Let's Encrypt autocert enabled for domain: %s", cfg.Server.Domain)
-		if cfg.TLS.Staging {
-			log.Printf("WARNING: Using Let's Encrypt STAGING environment")
-		}
-
-		proxyMux.Handle("/.well-known/acme-challenge/", certManager.HTTPHandler())
+		fmt.Printf("Tunnel %s closed\n", *closeTunnel)
+		os.Exit(0)
 	}
 
-	go func() {
-		addr := fmt.Sprintf(":%d", cfg.Server.ControlPort)
-		log.Printf("Starting control server on %s", addr)
-		if err := http.ListenAndServe(addr, controlMux); err != nil {
-			log.Fatalf("Control server failed: %v", err)
-		}
-	}()
+	if err := preflightPorts(cfg); err != nil {
+		log.Fatalf("Startup check failed: %v", err)
+	}
 
-	go func() {
-		addr := fmt.Sprintf(":%d", cfg.Server.HTTPPort)
-		log.Printf("Starting HTTP proxy on %s", addr)
-		if err := http.ListenAndServe(addr, proxyMux); err != nil {
-			log.Fatalf("HTTP proxy failed: %v", err)
-		}
-	}()
-
-	if cfg.TLS.Mode == "auto" {
-		go func() {
-			addr := fmt.Sprintf(":%d", cfg.Server.HTTPSPort)
-			log.Printf("Starting HTTPS proxy on %s (Let's Encrypt)", addr)
-			server := &http.Server{
-				Addr:      addr,
-				Handler:   proxyMux,
-				TLSConfig: certManager.TLSConfig(),
-			}
-			if err := server.ListenAndServeTLS("", ""); err != nil {
-				log.Fatalf("HTTPS proxy failed: %v", err)
-			}
-		}()
-	} else if cfg.TLS.Mode == "manual" {
-		tlsConfig, err := tlsmanager.LoadManualCerts(cfg.TLS.CertPath, cfg.TLS.KeyPath)
-		if err != nil {
-			log.Fatalf("Failed to load manual certificates: %v", err)
-		}
-		go func() {
-			addr := fmt.Sprintf(":%d", cfg.Server.HTTPSPort)
-			log.Printf("Starting HTTPS proxy on %s (manual certs)", addr)
-			server := &http.Server{
-				Addr:      addr,
-				Handler:   proxyMux,
-				TLSConfig: tlsConfig,
-			}
-			if err := server.ListenAndServeTLS(cfg.TLS.CertPath, cfg.TLS.KeyPath); err != nil {
-				log.Fatalf("HTTPS proxy failed: %v", err)
-			}
-		}()
+	server.Version = version
+	srv, err := server.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
 	}
 
 	sigChan := make(chan os.Signal, 1)
@@ -165,4 +138,51 @@ func main() {
 	<-sigChan
 
 	log.Println("Shutting down gracefully...")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown finished with errors: %v", err)
+	}
+}
+
+// adminAPIAddress returns the local address serving the admin API of cfg:
+// the admin listener when admin.port is set, the control port otherwise. A
+// listener bound to every interface is reached on the loopback address.
+func adminAPIAddress(cfg *config.Config) string {
+	if cfg.Admin.Port == 0 {
+		return net.JoinHostPort("127.0.0.1", strconv.Itoa(cfg.Server.ControlPort))
+	}
+	host := cfg.Admin.BindAddress
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(cfg.Admin.Port))
+}
+
+// requestCloseTunnel asks the running server's admin API to close a tunnel.
+func requestCloseTunnel(cfg *config.Config, subdomain string) error {
+	if cfg.Admin.Token == "" {
+		return fmt.Errorf("admin.token is not configured")
+	}
+	endpoint := fmt.Sprintf("http://%s/api/tunnels/%s/close", adminAPIAddress(cfg), url.PathEscape(subdomain))
+	req, err := http.NewRequest(http.MethodPost, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.Admin.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("admin API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("no active tunnel for subdomain %s", subdomain)
+	default:
+		return fmt.Errorf("admin API returned status %d", resp.StatusCode)
+	}
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/pkg/server/config"
+)
+
+func TestAdminAPIAddress(t *testing.T) {
+	tests := map[string]struct {
+		port        int
+		bindAddress string
+		want        string
+	}{
+		"control port":        {want: "127.0.0.1:4443"},
+		"admin port":          {port: 9090, bindAddress: "127.0.0.1", want: "127.0.0.1:9090"},
+		"admin on private ip": {port: 9090, bindAddress: "10.0.0.5", want: "10.0.0.5:9090"},
+		"admin on every ipv4": {port: 9090, bindAddress: "0.0.0.0", want: "127.0.0.1:9090"},
+		"admin on every ipv6": {port: 9090, bindAddress: "::", want: "127.0.0.1:9090"},
+		"admin without bind":  {port: 9090, want: "127.0.0.1:9090"},
+	}
+	for name, tt := range tests {
+		cfg := &config.Config{}
+		cfg.Server.ControlPort = 4443
+		cfg.Admin.Port = tt.port
+		cfg.Admin.BindAddress = tt.bindAddress
+		if got := adminAPIAddress(cfg); got != tt.want {
+			t.Fatalf("%s: expected %s, got %s", name, tt.want, got)
+		}
+	}
+}
+
+func TestRequestCloseTunnelUsesAdminPort(t *testing.T) {
+	var closed string
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		closed = r.URL.Path
+	}))
+	defer admin.Close()
+	host, port, _ := net.SplitHostPort(admin.Listener.Addr().String())
+
+	cfg := &config.Config{}
+	cfg.Server.ControlPort = freePort(t) // Nothing listens there
+	cfg.Admin.Token = "secret"
+	cfg.Admin.Port, _ = strconv.Atoi(port)
+	cfg.Admin.BindAddress = host
+
+	if err := requestCloseTunnel(cfg, "app"); err != nil {
+		t.Fatalf("expected the tunnel to be closed through the admin port, got %v", err)
+	}
+	if closed != "/api/tunnels/app/close" {
+		t.Fatalf("unexpected request path %q", closed)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/essajiwa/tunnelab/pkg/server/config"
+)
+
+// listenPort is a port the server is configured to listen on.
+type listenPort struct {
+	name string // Config key, for error messages
+	port int
+}
+
+// configuredPorts lists every port the server will bind for cfg.
+func configuredPorts(cfg *config.Config) ([]listenPort, error) {
+	ports := []listenPort{
+		{"server.control_port", cfg.Server.ControlPort},
+		{"server.http_port", cfg.Server.HTTPPort},
+	}
+	if cfg.TLS.Mode == "auto" || cfg.TLS.Mode == "manual" {
+		ports = append(ports, listenPort{"server.https_port", cfg.Server.HTTPSPort})
+	}
+	if cfg.Tunnels.SNIPort > 0 {
+		ports = append(ports, listenPort{"tunnels.sni_port", cfg.Tunnels.SNIPort})
+	}
+	if cfg.Tunnels.TCPPortRange != "" {
+		start, end, err := cfg.Tunnels.PortRange()
+		if err != nil {
+			return nil, err
+		}
+		for port := start; port <= end; port++ {
+			ports = append(ports, listenPort{"tunnels.tcp_port_range", port})
+		}
+	}
+	return ports, nil
+}
+
+// checkPorts attempts to bind every port and returns one message per
+// conflict: ports configured twice, and ports that cannot be bound.
+func checkPorts(ports []listenPort) []string {
+	var conflicts []string
+	seen := make(map[int]string)
+	for _, p := range ports {
+		if other, dup := seen[p.port]; dup {
+			conflicts = append(conflicts, fmt.Sprintf("port %d (%s) is also used by %s", p.port, p.name, other))
+			continue
+		}
+		seen[p.port] = p.name
+
+		listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(p.port)))
+		if err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("port %d (%s): %v", p.port, p.name, err))
+			continue
+		}
+		listener.Close()
+	}
+	return conflicts
+}
+
+// preflightPorts fails fast, before any listener starts, when a configured
+// port is unavailable.
+func preflightPorts(cfg *config.Config) error {
+	ports, err := configuredPorts(cfg)
+	if err != nil {
+		return err
+	}
+	conflicts := checkPorts(ports)
+	if len(conflicts) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d port conflict(s):\n  %s", len(conflicts), strings.Join(conflicts, "\n  "))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/pkg/server/config"
+)
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestCheckPortsReportsConflicts(t *testing.T) {
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to occupy a port: %v", err)
+	}
+	defer busy.Close()
+	busyPort := busy.Addr().(*net.TCPAddr).Port
+	free := freePort(t)
+
+	conflicts := checkPorts([]listenPort{
+		{"server.control_port", free},
+		{"server.http_port", busyPort},
+		{"server.https_port", free},
+	})
+
+	if len(conflicts) != 2 {
+		t.Fatalf("expected 2 conflicts, got %v", conflicts)
+	}
+	if !strings.Contains(conflicts[0], "server.http_port") {
+		t.Fatalf("expected the busy port to be reported, got %q", conflicts[0])
+	}
+	if !strings.Contains(conflicts[1], "also used by server.control_port") {
+		t.Fatalf("expected the duplicate port to be reported, got %q", conflicts[1])
+	}
+}
+
+func TestCheckPortsNoConflicts(t *testing.T) {
+	if conflicts := checkPorts([]listenPort{{"server.http_port", freePort(t)}}); len(conflicts) != 0 {
+		t.Fatalf("expected no conflicts, got %v", conflicts)
+	}
+}
+
+func TestConfiguredPorts(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.ControlPort = 4443
+	cfg.Server.HTTPPort = 80
+	cfg.Server.HTTPSPort = 443
+	cfg.TLS.Mode = "auto"
+	cfg.Tunnels.SNIPort = 8443
+	cfg.Tunnels.TCPPortRange = "30000-30002"
+
+	ports, err := configuredPorts(cfg)
+	if err != nil {
+		t.Fatalf("configuredPorts failed: %v", err)
+	}
+	if len(ports) != 7 {
+		t.Fatalf("expected 7 ports, got %v", ports)
+	}
+
+	cfg.TLS.Mode = "disabled"
+	cfg.Tunnels.TCPPortRange = ""
+	ports, _ = configuredPorts(cfg)
+	if len(ports) != 3 {
+		t.Fatalf("expected HTTPS and TCP ports to be skipped, got %v", ports)
+	}
+}
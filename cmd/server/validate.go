@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/essajiwa/tunnelab/pkg/server/config"
+)
+
+// validateConfig loads and validates the configuration at path without
+// binding any port or opening the database, as for the -validate flag.
+//
+// Returns:
+//   - string: The report to print
+//   - bool: Whether the configuration is valid
+func validateConfig(path string) (string, bool) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return fmt.Sprintf("Configuration %s is invalid: %v\n", path, err), false
+	}
+	return configReport(path, cfg), true
+}
+
+// configReport summarizes the effective settings of a valid configuration,
+// after defaults have been applied.
+func configReport(path string, cfg *config.Config) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Configuration %s is valid\n", path)
+	row := func(name, format string, args ...interface{}) {
+		fmt.Fprintf(&b, "  %-14s %s\n", name+":", fmt.Sprintf(format, args...))
+	}
+
+	row("domain", "%s", cfg.Server.Domain)
+	row("control port", "%d", cfg.Server.ControlPort)
+	row("http port", "%d", cfg.Server.HTTPPort)
+	if cfg.TLS.Mode == "disabled" {
+		row("https", "disabled")
+	} else {
+		row("https", "port %d (tls %s)", cfg.Server.HTTPSPort, cfg.TLS.Mode)
+	}
+	row("tcp ports", "%s", cfg.Tunnels.TCPPortRange)
+	if cfg.Tunnels.SNIPort > 0 {
+		row("sni port", "%d", cfg.Tunnels.SNIPort)
+	}
+	row("database", "%s %s", cfg.Database.Type, cfg.Database.Path)
+	row("auth", "%s", cfg.Auth.Mode)
+	if cfg.Admin.Token != "" {
+		row("admin api", "enabled")
+	}
+	if cfg.Quota.Enabled {
+		row("quota", "%d bytes/month", cfg.Quota.MonthlyBytes)
+	}
+	if cfg.Cluster.Store == "" {
+		row("cluster", "single node")
+	} else {
+		row("cluster", "%s at %s, node %s", cfg.Cluster.Store, cfg.Cluster.RedisAddr, cfg.Cluster.NodeAddress)
+	}
+	return b.String()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+	"github.com/essajiwa/tunnelab/pkg/client"
+	"github.com/essajiwa/tunnelab/pkg/server"
+	"github.com/essajiwa/tunnelab/pkg/server/config"
+)
+
+const (
+	e2eDomain = "tunnel.example.com"
+	e2eToken  = "e2e-test-token"
+)
+
+// startE2EServer starts a server on ephemeral ports with one client whose
+// token is e2eToken. TCP tunnels get a single free public port.
+//
+// Returns:
+//   - *server.Server: The started server, shut down when the test ends
+//   - int: The public port of TCP tunnels
+func startE2EServer(t *testing.T) (*server.Server, int) {
+	t.Helper()
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "tunnelab.db")
+
+	repo, err := database.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	err = repo.CreateClient(&database.Client{
+		ID:         "e2e-client",
+		Name:       "e2e",
+		APIToken:   e2eToken,
+		MaxTunnels: 5,
+		Status:     "active",
+	})
+	repo.Close()
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	path := filepath.Join(dir, "server.yaml")
+	content := fmt.Sprintf("server:\n  domain: %s\ndatabase:\n  path: %s\n", e2eDomain, dbPath)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	tcpPort := freePort(t)
+	cfg.Server.ControlPort = 0
+	cfg.Server.HTTPPort = 0
+	cfg.Tunnels.TCPPortRange = fmt.Sprintf("%d-%d", tcpPort, tcpPort)
+
+	srv, err := server.New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	return srv, tcpPort
+}
+
+// freePort returns a port that was free a moment ago.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// openTunnel runs the client against srv: it authenticates, requests a
+// tunnel to the local origin at originAddr and serves its streams until the
+// test ends.
+func openTunnel(t *testing.T, srv *server.Server, cfg *Config, originAddr net.Addr) *client.Tunnel {
+	t.Helper()
+	cfg.LocalHost = "127.0.0.1"
+	cfg.LocalPort = originAddr.(*net.TCPAddr).Port
+
+	url := fmt.Sprintf("ws://127.0.0.1:%d/", srv.ControlAddr().(*net.TCPAddr).Port)
+	c := client.New(client.Config{ServerURL: url, Token: e2eToken})
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("failed to connect to control server: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	tunnel, err := requestTunnel(c, cfg)
+	if err != nil {
+		t.Fatalf("tunnel request failed: %v", err)
+	}
+	t.Cleanup(func() { tunnel.Close() })
+	dialer, err := newLocalDialer(cfg.LocalHost, cfg.LocalPort, cfg.LocalScheme, false, cfg.Protocol)
+	if err != nil {
+		t.Fatalf("failed to create local dialer: %v", err)
+	}
+	router, err := newRouter(cfg, dialer)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+
+	go runTunnelLoop(tunnel, router)
+	return tunnel
+}
+
+// eventually retries op until it succeeds or a few seconds passed, since the
+// server attaches the mux session shortly after the client opened it.
+func eventually(t *testing.T, what string, op func() error) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := op()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %v", what, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestEndToEndHTTPTunnel(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Origin", "local")
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+	defer origin.Close()
+
+	srv, _ := startE2EServer(t)
+	info := openTunnel(t, srv, &Config{Subdomain: "app", Protocol: "http"}, origin.Listener.Addr())
+	if info.PublicURL == "" {
+		t.Fatal("expected a public URL for the HTTP tunnel")
+	}
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/hello", srv.HTTPAddr().(*net.TCPAddr).Port)
+	eventually(t, "request through the tunnel failed", func() error {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		req.Host = "app." + e2eDomain
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("expected 200, got %d: %s", resp.StatusCode, body)
+		}
+		if string(body) != "GET /hello" || resp.Header.Get("X-Origin") != "local" {
+			return fmt.Errorf("unexpected response from origin: %q", body)
+		}
+		return nil
+	})
+}
+
+func TestEndToEndTCPTunnel(t *testing.T) {
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start origin: %v", err)
+	}
+	defer origin.Close()
+	go func() {
+		for {
+			conn, err := origin.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	srv, tcpPort := startE2EServer(t)
+	info := openTunnel(t, srv, &Config{Subdomain: "db", Protocol: "tcp"}, origin.Addr())
+	if info.PublicPort != tcpPort {
+		t.Fatalf("expected public port %d, got %d", tcpPort, info.PublicPort)
+	}
+
+	eventually(t, "echo through the tunnel failed", func() error {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", tcpPort), time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		reply := make([]byte, 4)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if string(reply) != "ping" {
+			return fmt.Errorf("expected echo %q, got %q", "ping", reply)
+		}
+		return nil
+	})
+}
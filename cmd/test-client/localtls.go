@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// localDialer opens connections to the local server, wrapping them in TLS
+// when the local origin only speaks HTTPS.
+type localDialer struct {
+	addr      string
+	tlsConfig *tls.Config // nil dials plaintext TCP
+}
+
+// newLocalDialer creates a dialer for the local server.
+//
+// Parameters:
+//   - host: Local host to forward to
+//   - port: Local port to forward to
+//   - scheme: "http" for plaintext or "https" for TLS
+//   - insecure: Skip certificate verification, for self-signed local certificates
+//   - protocol: Tunnel protocol; gRPC origins are offered HTTP/2 via ALPN
+//
+// Returns:
+//   - *localDialer: The dialer
+//   - error: Error if the scheme is not supported
+func newLocalDialer(host string, port int, scheme string, insecure bool, protocol string) (*localDialer, error) {
+	d := &localDialer{addr: localAddr(host, port)}
+	switch scheme {
+	case "", "http":
+		return d, nil
+	case "https":
+	default:
+		return nil, fmt.Errorf("unsupported local scheme %q (use http or https)", scheme)
+	}
+
+	d.tlsConfig = &tls.Config{
+		ServerName:         strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"),
+		InsecureSkipVerify: insecure,
+	}
+	if protocol == "grpc" {
+		d.tlsConfig.NextProtos = []string{"h2"}
+	}
+	return d, nil
+}
+
+// Dial connects to the local server and, for HTTPS origins, completes the
+// TLS handshake before returning.
+func (d *localDialer) Dial() (net.Conn, error) {
+	if d.tlsConfig == nil {
+		return net.DialTimeout("tcp", d.addr, localDialTimeout)
+	}
+	dialer := &net.Dialer{Timeout: localDialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", d.addr, d.tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("TLS connection to %s failed: %w", d.addr, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLocalDialerSpeaksTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secure hello")
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	dialer, err := newLocalDialer("127.0.0.1", addr.Port, "https", true, "http")
+	if err != nil {
+		t.Fatalf("failed to create dialer: %v", err)
+	}
+	conn, err := dialer.Dial()
+	if err != nil {
+		t.Fatalf("expected TLS dial to succeed: %v", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 over TLS, got %d", resp.StatusCode)
+	}
+}
+
+func TestLocalDialerVerifiesCertificates(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	dialer, err := newLocalDialer("127.0.0.1", addr.Port, "https", false, "http")
+	if err != nil {
+		t.Fatalf("failed to create dialer: %v", err)
+	}
+	if _, err := dialer.Dial(); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("expected a self-signed certificate to be rejected, got %v", err)
+	}
+}
+
+func TestLocalDialerPlaintext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	dialer, err := newLocalDialer("127.0.0.1", listener.Addr().(*net.TCPAddr).Port, "http", false, "http")
+	if err != nil || dialer.tlsConfig != nil {
+		t.Fatalf("expected a plaintext dialer, got %+v %v", dialer, err)
+	}
+	conn, err := dialer.Dial()
+	if err != nil {
+		t.Fatalf("expected plaintext dial to succeed: %v", err)
+	}
+	conn.Close()
+
+	if _, err := newLocalDialer("127.0.0.1", 80, "ftp", false, "http"); err == nil {
+		t.Fatal("expected an unsupported scheme to be rejected")
+	}
+}
+
+func TestValidateConfigLocalTLS(t *testing.T) {
+	base := Config{Token: "token", Protocol: "http", LocalScheme: "http"}
+
+	insecure := base
+	insecure.LocalInsecure = true
+	if err := validateConfig(&insecure); err == nil {
+		t.Fatal("expected -local-insecure without -local-tls to be rejected")
+	}
+
+	tlsConfig := insecure
+	tlsConfig.LocalScheme = "https"
+	if err := validateConfig(&tlsConfig); err != nil {
+		t.Fatalf("expected -local-tls -local-insecure to be valid: %v", err)
+	}
+}
@@ -3,35 +3,55 @@
 // This client simulates client behavior for testing purposes, similar to how
 // hooklab (an open-source project) leverages TunneLab for tunneling services.
 // It connects to the control server, authenticates, creates a tunnel,
-// and forwards HTTP requests to a local server.
+// and forwards HTTP requests to a local server, using the pkg/client SDK.
 //
 // Usage:
 //
-//	./test-client -server ws://localhost:4443 -token TOKEN -subdomain test -port 8000
+//	./test-client -server ws://localhost:4443/tunnel -token TOKEN -subdomain test -port 8000
 //
 // Flags:
 //
-//	-server: Control server WebSocket URL (default: ws://localhost:4443)
+//	-server: Control server WebSocket URL (default: ws://localhost:4443/tunnel)
 //	-token: Authentication token (required)
 //	-subdomain: Subdomain for the tunnel (default: test)
 //	-port: Local port to forward traffic to (default: 8000)
+//	-sni: Route a TCP tunnel by TLS server name on the shared SNI port
+//	-require-local: Exit if nothing is listening on the local port (default: warn and keep waiting)
+//	-compress: Ask the server to DEFLATE-compress tunnel data streams
+//	-sign: Sign every control message with an HMAC derived from the token
+//	-local-tls: Connect to the local server over TLS (for origins that only speak HTTPS)
+//	-local-insecure: Skip certificate verification of the local server (self-signed certs)
+//	-max-retries: Retries of a request the server rejected as rate limited or temporarily unavailable (default: 5)
+//	-route: Send HTTP requests under a path prefix to another local port, e.g. -route /api=8080 (repeatable)
+//	-max-concurrent-streams: Streams forwarded to the local server at once; further streams wait (default: 256, 0 means no limit)
+//	-output: "text" (default), or "json" to print one JSON line with the public URL, tunnel ID and port to stdout once the tunnel is ready
+//	-stdin: Read the tunnel as a JSON spec from stdin (fields override flags); implies -output json
+//
+// For automation, pipe the spec in and read the public URL from stdout; logs
+// go to stderr:
+//
+//	echo '{"token": "TOKEN", "subdomain": "ci-42", "local_port": 3000}' | ./test-client -stdin
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
 	"strings"
 	"time"
 
+	"github.com/essajiwa/tunnelab/pkg/client"
 	"github.com/essajiwa/tunnelab/pkg/protocol"
-	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
-	"github.com/hashicorp/yamux"
 )
 
+// defaultMaxConcurrentStreams bounds the streams forwarded at once; streams
+// past it wait in the accept backlog of the yamux session.
+const defaultMaxConcurrentStreams = 256
+
 // main is the entry point for the test client.
 func main() {
 	config := parseFlags()
@@ -40,55 +60,141 @@ func main() {
 		log.Fatal(err)
 	}
 
-	conn := connectToServer(config.ServerURL)
-	defer conn.Close()
+	if err := checkLocalServer(config.LocalHost, config.LocalPort, localDialTimeout); err != nil {
+		if config.RequireLocal {
+			log.Fatal(err)
+		}
+		log.Printf("⚠ %v; requests will fail with 502 until it is started", err)
+		go waitForLocalServer(config.LocalHost, config.LocalPort, 5*time.Second, nil)
+	}
 
-	if err := authenticate(conn, config.Token); err != nil {
+	dialer, err := newLocalDialer(config.LocalHost, config.LocalPort, config.LocalScheme, config.LocalInsecure, config.Protocol)
+	if err != nil {
+		log.Fatal(err)
+	}
+	router, err := newRouter(config, dialer)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	tunnelInfo := createTunnel(conn, config)
+	c := client.New(client.Config{
+		ServerURL:            config.ServerURL,
+		Token:                config.Token,
+		Sign:                 config.Sign,
+		MaxConcurrentStreams: config.MaxConcurrentStreams,
+	})
+	defer c.Close()
+
+	log.Printf("Connecting to %s", config.ServerURL)
+	err = withRetries("Authentication", config.MaxRetries, time.Sleep, func() error {
+		return c.Connect(context.Background())
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("✓ Authenticated successfully")
 
-	muxSession := establishMuxSession(conn)
-	defer muxSession.Close()
+	tunnel := createTunnel(c, config)
+	defer tunnel.Close()
 
-	if tunnelInfo.PublicURL != "" {
-		log.Printf("\n🎉 Tunnel is ready! Access your local server at: %s\n", tunnelInfo.PublicURL)
+	if tunnel.PublicURL != "" {
+		log.Printf("\n🎉 Tunnel is ready! Access your local server at: %s\n", tunnel.PublicURL)
+	} else if tunnel.PublicEndpoint != "" {
+		log.Printf("\n🎉 Tunnel is ready! Connect to: %s\n", tunnel.PublicEndpoint)
 	} else {
-		log.Printf("\n🎉 Tunnel is ready! Public port: %d\n", tunnelInfo.PublicPort)
+		log.Printf("\n🎉 Tunnel is ready! Public port: %d\n", tunnel.PublicPort)
 	}
 	log.Printf("Press Ctrl+C to stop\n")
+	if config.Output == outputJSON {
+		if err := writeResult(os.Stdout, tunnel); err != nil {
+			log.Fatalf("Failed to write tunnel: %v", err)
+		}
+	}
 
-	go handleHeartbeat(conn)
-	runTunnelLoop(muxSession, config.LocalHost, config.LocalPort)
+	go handleHeartbeat(c)
+	runTunnelLoop(tunnel, router)
 }
 
 type Config struct {
-	ServerURL string
-	Token     string
-	Subdomain string
-	LocalPort int
-	LocalHost string
-	Protocol  string
+	ServerURL    string
+	Token        string
+	Subdomain    string
+	LocalPort    int
+	LocalHost    string
+	Protocol     string
+	SNI          bool
+	RequireLocal bool
+	Compress     bool
+	Sign         bool
+
+	LocalScheme   string // "http" or "https" for origins that only speak TLS
+	LocalInsecure bool   // Skip verification of the local server certificate
+	MaxRetries    int    // Retries of rate-limited or temporarily rejected requests
+	// MaxConcurrentStreams caps the streams forwarded to the local server at
+	// once (0 means no limit), so a flood of connections cannot exhaust memory.
+	MaxConcurrentStreams int
+
+	// Routes send HTTP requests under a path prefix to other local ports
+	// than LocalPort; the longest matching prefix wins.
+	Routes []route
+	// Output is outputText, or outputJSON to also print the created tunnel
+	// as one JSON line to stdout for scripts.
+	Output string
 }
 
 func parseFlags() *Config {
-	serverURL := flag.String("server", "ws://localhost:4443", "Control server URL")
+	serverURL := flag.String("server", "ws://localhost:4443/tunnel", "Control server URL")
 	token := flag.String("token", "", "Authentication token")
 	subdomain := flag.String("subdomain", "test", "Subdomain to use")
 	localPort := flag.Int("port", 8000, "Local port to forward")
 	localHost := flag.String("local-host", "localhost", "Local host to forward (default: localhost)")
 	protocol := flag.String("protocol", "http", "Protocol to tunnel (http|tcp|grpc)")
+	sni := flag.Bool("sni", false, "Route a TCP tunnel by TLS server name on the server's shared SNI port")
+	requireLocal := flag.Bool("require-local", false, "Exit if the local server is not reachable")
+	compress := flag.Bool("compress", false, "Request compressed tunnel data streams")
+	sign := flag.Bool("sign", false, "Sign control messages with an HMAC derived from the token")
+	localTLS := flag.Bool("local-tls", false, "Connect to the local server over TLS")
+	localInsecure := flag.Bool("local-insecure", false, "Skip certificate verification of the local server")
+	maxRetries := flag.Int("max-retries", defaultMaxRetries, "Retries of requests rejected as rate limited or temporarily unavailable")
+	var routes routeFlag
+	maxConcurrentStreams := flag.Int("max-concurrent-streams", defaultMaxConcurrentStreams, "Streams forwarded to the local server at once; further streams wait (0 means no limit)")
+	flag.Var(&routes, "route", "Send HTTP requests under a path prefix to another local port, e.g. /api=8080 (repeatable)")
+	fromStdin := flag.Bool("stdin", false, "Read the tunnel as a JSON spec from stdin (implies -output json)")
+	output := flag.String("output", outputText, "Output format: text, or json to print the ready tunnel as one JSON line to stdout")
 	flag.Parse()
 
-	return &Config{
-		ServerURL: *serverURL,
-		Token:     *token,
-		Subdomain: *subdomain,
-		LocalPort: *localPort,
-		LocalHost: *localHost,
-		Protocol:  strings.ToLower(*protocol),
+	localScheme := "http"
+	if *localTLS {
+		localScheme = "https"
 	}
+
+	cfg := &Config{
+		ServerURL:    *serverURL,
+		Token:        *token,
+		Subdomain:    *subdomain,
+		LocalPort:    *localPort,
+		LocalHost:    *localHost,
+		Protocol:     strings.ToLower(*protocol),
+		SNI:          *sni,
+		RequireLocal: *requireLocal,
+		Compress:     *compress,
+		Sign:         *sign,
+
+		LocalScheme:   localScheme,
+		LocalInsecure: *localInsecure,
+		MaxRetries:    *maxRetries,
+		Routes:        routes,
+
+		MaxConcurrentStreams: *maxConcurrentStreams,
+		Output:               strings.ToLower(*output),
+	}
+	if *fromStdin {
+		cfg.Output = outputJSON
+		if err := readSpec(os.Stdin, cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return cfg
 }
 
 func validateConfig(config *Config) error {
@@ -100,179 +206,103 @@ func validateConfig(config *Config) error {
 	default:
 		return fmt.Errorf("unsupported protocol %q (use http, tcp, or grpc)", config.Protocol)
 	}
-	return nil
-}
-
-func connectToServer(serverURL string) *websocket.Conn {
-	log.Printf("Connecting to %s", serverURL)
-	conn, _, err := websocket.DefaultDialer.Dial(serverURL, nil)
-	if err != nil {
-		log.Fatalf("Failed to connect: %v", err)
+	if config.SNI && config.Protocol != "tcp" {
+		return fmt.Errorf("-sni is only supported for tcp tunnels")
 	}
-	return conn
-}
-
-func authenticate(conn *websocket.Conn, token string) error {
-	log.Println("Authenticating...")
-	authMsg := protocol.NewControlMessage(
-		protocol.MsgTypeAuth,
-		uuid.New().String(),
-		map[string]interface{}{
-			"token": token,
-		},
-	)
-
-	if err := conn.WriteJSON(authMsg); err != nil {
-		return fmt.Errorf("failed to send auth: %v", err)
-	}
-
-	var authResp protocol.ControlMessage
-	if err := conn.ReadJSON(&authResp); err != nil {
-		return fmt.Errorf("failed to read auth response: %v", err)
-	}
-
-	if authResp.Type == protocol.MsgTypeError {
-		msg, _ := authResp.Payload["message"].(string)
-		if msg == "" {
-			msg = "authentication rejected"
+	switch config.LocalScheme {
+	case "", "http":
+		if config.LocalInsecure {
+			return fmt.Errorf("-local-insecure requires -local-tls")
 		}
-		return fmt.Errorf("auth failed: %s", msg)
+	case "https":
+	default:
+		return fmt.Errorf("unsupported local scheme %q (use http or https)", config.LocalScheme)
 	}
-	if authResp.Type != protocol.MsgTypeAuthResponse {
-		return fmt.Errorf("unexpected response: %s", authResp.Type)
+	if err := validateOutput(config.Output); err != nil {
+		return err
 	}
-
-	success, _ := authResp.Payload["success"].(bool)
-	if !success {
-		msg, _ := authResp.Payload["message"].(string)
-		return fmt.Errorf("auth failed: %s", msg)
+	if config.MaxConcurrentStreams < 0 {
+		return fmt.Errorf("-max-concurrent-streams must not be negative")
 	}
-
-	log.Println("✓ Authenticated successfully")
-	return nil
+	return validateRoutes(config.Routes, config.Protocol)
 }
 
-type TunnelInfo struct {
-	PublicURL  string
-	PublicPort int
-	TunnelID   string
-	Protocol   string
+// createTunnel requests the tunnel, retrying while the server asks the client
+// to back off, and exits if the tunnel cannot be created.
+func createTunnel(c *client.Client, cfg *Config) *client.Tunnel {
+	var tunnel *client.Tunnel
+	err := withRetries("Tunnel request", cfg.MaxRetries, time.Sleep, func() error {
+		var err error
+		tunnel, err = requestTunnel(c, cfg)
+		return err
+	})
+	if err != nil {
+		log.Fatalf("Tunnel creation failed: %v", err)
+	}
+	return tunnel
 }
 
-func createTunnel(conn *websocket.Conn, cfg *Config) *TunnelInfo {
+// requestTunnel creates the tunnel described by cfg and connects its mux session.
+func requestTunnel(c *client.Client, cfg *Config) (*client.Tunnel, error) {
 	log.Printf("Requesting %s tunnel for subdomain: %s", strings.ToUpper(cfg.Protocol), cfg.Subdomain)
-	msgType := protocol.MsgTypeTunnelReq
-	switch cfg.Protocol {
-	case "tcp":
-		msgType = protocol.MsgTypeTCPReq
-	case "grpc":
-		msgType = protocol.MsgTypeGRPCReq
-	}
-	payload := map[string]interface{}{
-		"subdomain":  cfg.Subdomain,
-		"protocol":   cfg.Protocol,
-		"local_port": cfg.LocalPort,
-		"local_host": cfg.LocalHost,
+	req := client.TunnelRequest{
+		Subdomain: cfg.Subdomain,
+		Protocol:  cfg.Protocol,
+		LocalHost: cfg.LocalHost,
+		LocalPort: cfg.LocalPort,
+		SNI:       cfg.SNI,
+
+		LocalScheme: cfg.LocalScheme,
 	}
-
-	tunnelMsg := protocol.NewControlMessage(
-		msgType,
-		uuid.New().String(),
-		payload,
-	)
-
-	if err := conn.WriteJSON(tunnelMsg); err != nil {
-		log.Fatalf("Failed to send tunnel request: %v", err)
-	}
-
-	var tunnelResp protocol.ControlMessage
-	if err := conn.ReadJSON(&tunnelResp); err != nil {
-		log.Fatalf("Failed to read tunnel response: %v", err)
+	if cfg.Compress {
+		req.StreamCompression = []string{protocol.StreamCompressionDeflate}
 	}
 
-	if tunnelResp.Type == protocol.MsgTypeError {
-		msg, _ := tunnelResp.Payload["message"].(string)
-		log.Fatalf("Tunnel creation failed: %s", msg)
-	}
-
-	expectedType := protocol.MsgTypeTunnelResp
-	switch cfg.Protocol {
-	case "tcp":
-		expectedType = protocol.MsgTypeTCPResp
-	case "grpc":
-		expectedType = protocol.MsgTypeGRPCResp
-	}
-	if tunnelResp.Type != expectedType {
-		log.Fatalf("Unexpected response type: %s", tunnelResp.Type)
-	}
-
-	publicURL, _ := tunnelResp.Payload["public_url"].(string)
-	var publicPort int
-	if v, ok := tunnelResp.Payload["public_port"].(float64); ok {
-		publicPort = int(v)
+	tunnel, err := c.CreateTunnel(context.Background(), req)
+	if err != nil {
+		return nil, err
 	}
-	tunnelID, _ := tunnelResp.Payload["tunnel_id"].(string)
 
 	log.Printf("✓ Tunnel created!")
-	log.Printf("  Tunnel ID: %s", tunnelID)
-	if publicURL != "" {
-		log.Printf("  Public URL: %s", publicURL)
+	log.Printf("  Tunnel ID: %s", tunnel.ID)
+	if tunnel.PublicURL != "" {
+		log.Printf("  Public URL: %s", tunnel.PublicURL)
+	} else if tunnel.PublicEndpoint != "" {
+		log.Printf("  Public Endpoint: %s", tunnel.PublicEndpoint)
 	} else {
-		log.Printf("  Public Port: %d", publicPort)
-	}
-	log.Printf("  Forwarding to: %s:%d", cfg.LocalHost, cfg.LocalPort)
-
-	return &TunnelInfo{
-		PublicURL:  publicURL,
-		PublicPort: publicPort,
-		TunnelID:   tunnelID,
-		Protocol:   cfg.Protocol,
+		log.Printf("  Public Port: %d", tunnel.PublicPort)
 	}
-}
-
-func establishMuxSession(conn *websocket.Conn) *yamux.Session {
-	var muxMsg protocol.ControlMessage
-	if err := conn.ReadJSON(&muxMsg); err != nil {
-		log.Fatalf("Failed to read mux message: %v", err)
+	if cfg.LocalScheme == "https" {
+		log.Printf("  Forwarding to: %s:%d (TLS)", cfg.LocalHost, cfg.LocalPort)
+	} else {
+		log.Printf("  Forwarding to: %s:%d", cfg.LocalHost, cfg.LocalPort)
 	}
-
-	if muxMsg.Type != protocol.MsgTypeNewConn {
-		log.Fatalf("Expected mux establishment message, got: %s", muxMsg.Type)
+	for _, r := range cfg.Routes {
+		log.Printf("  Routing %s to: %s:%d", r.Prefix, cfg.LocalHost, r.Port)
 	}
-
-	muxAddr, _ := muxMsg.Payload["mux_addr"].(string)
-	log.Printf("Establishing yamux connection to %s", muxAddr)
-
-	muxConn, err := net.Dial("tcp", muxAddr)
-	if err != nil {
-		log.Fatalf("Failed to connect to mux: %v", err)
+	if tunnel.StreamCompression != "" {
+		log.Printf("  Stream compression: %s", tunnel.StreamCompression)
+	} else if cfg.Compress {
+		log.Printf("  Stream compression: not supported by server")
 	}
-
-	session, err := yamux.Client(muxConn, nil)
-	if err != nil {
-		log.Fatalf("Failed to create yamux session: %v", err)
-	}
-
 	log.Println("✓ Yamux session established")
-	return session
+	return tunnel, nil
 }
 
-func runTunnelLoop(session *yamux.Session, localHost string, localPort int) {
-	for {
-		stream, err := session.AcceptStream()
-		if err != nil {
-			log.Printf("Failed to accept stream: %v", err)
-			continue
-		}
-
-		go handleStream(stream, localHost, localPort)
-	}
+// runTunnelLoop forwards every stream of tunnel to the local server router
+// picks for it, until the session closes.
+func runTunnelLoop(tunnel *client.Tunnel, router *router) {
+	err := tunnel.Serve(func(stream net.Conn) {
+		handleStream(stream, router)
+	})
+	log.Printf("Tunnel session closed: %v", err)
 }
 
-func handleStream(stream net.Conn, localHost string, localPort int) {
+func handleStream(stream net.Conn, router *router) {
 	defer stream.Close()
 
-	localConn, err := net.Dial("tcp", net.JoinHostPort(localHost, fmt.Sprintf("%d", localPort)))
+	dialer, reader := router.route(stream)
+	localConn, err := dialer.Dial()
 	if err != nil {
 		log.Printf("Failed to connect to local server: %v", err)
 		return
@@ -287,7 +317,7 @@ func handleStream(stream net.Conn, localHost string, localPort int) {
 	}()
 
 	go func() {
-		io.Copy(localConn, stream)
+		io.Copy(localConn, reader)
 		done <- struct{}{}
 	}()
 
@@ -295,17 +325,12 @@ func handleStream(stream net.Conn, localHost string, localPort int) {
 	log.Println("Request handled")
 }
 
-func handleHeartbeat(conn *websocket.Conn) {
+func handleHeartbeat(c *client.Client) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		msg := protocol.NewControlMessage(
-			protocol.MsgTypeHeartbeat,
-			uuid.New().String(),
-			map[string]interface{}{},
-		)
-		if err := conn.WriteJSON(msg); err != nil {
+		if err := c.Heartbeat(); err != nil {
 			log.Printf("Heartbeat failed: %v", err)
 			return
 		}
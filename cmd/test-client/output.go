@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/essajiwa/tunnelab/pkg/client"
+)
+
+// Formats of -output.
+const (
+	outputText = "text" // Human-readable log lines only
+	outputJSON = "json" // Also one JSON line on stdout once the tunnel is ready
+)
+
+// validateOutput checks the -output format ("" means text).
+func validateOutput(format string) error {
+	switch format {
+	case "", outputText, outputJSON:
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format %q (use text or json)", format)
+	}
+}
+
+// tunnelResult is the JSON line printed to stdout once the tunnel is ready
+// with -output json.
+type tunnelResult struct {
+	TunnelID       string `json:"tunnel_id"`
+	Subdomain      string `json:"subdomain"`
+	Protocol       string `json:"protocol"`
+	PublicURL      string `json:"public_url,omitempty"`
+	PublicEndpoint string `json:"public_endpoint,omitempty"`
+	PublicPort     int    `json:"public_port,omitempty"`
+}
+
+// writeResult prints tunnel to w as a single JSON line.
+func writeResult(w io.Writer, tunnel *client.Tunnel) error {
+	return json.NewEncoder(w).Encode(tunnelResult{
+		TunnelID:       tunnel.ID,
+		Subdomain:      tunnel.Subdomain,
+		Protocol:       tunnel.Protocol,
+		PublicURL:      tunnel.PublicURL,
+		PublicEndpoint: tunnel.PublicEndpoint,
+		PublicPort:     tunnel.PublicPort,
+	})
+}
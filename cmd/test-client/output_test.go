@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/pkg/client"
+)
+
+func TestWriteResult(t *testing.T) {
+	tests := map[string]struct {
+		tunnel *client.Tunnel
+		want   string
+	}{
+		"http tunnel": {
+			tunnel: &client.Tunnel{ID: "tunnel-1", Subdomain: "ci-42", Protocol: "http", PublicURL: "https://ci-42.tunnel.example.com"},
+			want:   `{"tunnel_id":"tunnel-1","subdomain":"ci-42","protocol":"http","public_url":"https://ci-42.tunnel.example.com"}`,
+		},
+		"tcp tunnel": {
+			tunnel: &client.Tunnel{ID: "tunnel-2", Subdomain: "db", Protocol: "tcp", PublicEndpoint: "tunnel.example.com:30000", PublicPort: 30000},
+			want:   `{"tunnel_id":"tunnel-2","subdomain":"db","protocol":"tcp","public_endpoint":"tunnel.example.com:30000","public_port":30000}`,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeResult(&buf, tt.tunnel); err != nil {
+				t.Fatalf("failed to write result: %v", err)
+			}
+			if buf.String() != tt.want+"\n" {
+				t.Fatalf("expected a single line %s, got %q", tt.want, buf.String())
+			}
+		})
+	}
+}
+
+func TestValidateOutput(t *testing.T) {
+	for _, format := range []string{"", outputText, outputJSON} {
+		if err := validateOutput(format); err != nil {
+			t.Fatalf("expected %q to be accepted: %v", format, err)
+		}
+	}
+	if err := validateOutput("yaml"); err == nil {
+		t.Fatal("expected an unknown output format to be rejected")
+	}
+}
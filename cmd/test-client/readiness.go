@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// localDialTimeout bounds each readiness probe of the local server.
+const localDialTimeout = 2 * time.Second
+
+// localAddr joins the local host and port into a dialable address. IPv6
+// hosts may be given with or without brackets.
+func localAddr(localHost string, localPort int) string {
+	host := strings.TrimSuffix(strings.TrimPrefix(localHost, "["), "]")
+	return net.JoinHostPort(host, strconv.Itoa(localPort))
+}
+
+// checkLocalServer reports whether something accepts connections on localHost:localPort.
+//
+// Returns:
+//   - error: Error if the local server cannot be reached
+func checkLocalServer(localHost string, localPort int, timeout time.Duration) error {
+	addr := localAddr(localHost, localPort)
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return fmt.Errorf("local server %s is not reachable: %w", addr, err)
+	}
+	conn.Close()
+	return nil
+}
+
+// waitForLocalServer polls the local server every interval until it accepts
+// connections, then logs that it is up. It returns the number of probes made.
+func waitForLocalServer(localHost string, localPort int, interval time.Duration, stop <-chan struct{}) int {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	probes := 0
+	for {
+		select {
+		case <-stop:
+			return probes
+		case <-ticker.C:
+		}
+		probes++
+		if checkLocalServer(localHost, localPort, localDialTimeout) == nil {
+			log.Printf("✓ Local server %s:%d is now reachable", localHost, localPort)
+			return probes
+		}
+	}
+}
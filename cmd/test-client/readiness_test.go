@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckLocalServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if err := checkLocalServer("127.0.0.1", port, time.Second); err != nil {
+		t.Fatalf("expected listening server to be reachable: %v", err)
+	}
+
+	listener.Close()
+	if err := checkLocalServer("127.0.0.1", port, time.Second); err == nil {
+		t.Fatal("expected closed port to be unreachable")
+	}
+}
+
+func TestCheckLocalServerIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %v", err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	for _, host := range []string{"::1", "[::1]"} {
+		if err := checkLocalServer(host, port, time.Second); err != nil {
+			t.Fatalf("expected %s to be reachable: %v", host, err)
+		}
+	}
+}
+
+func TestWaitForLocalServerDetectsStartup(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	done := make(chan int, 1)
+	go func() { done <- waitForLocalServer("127.0.0.1", port, 10*time.Millisecond, nil) }()
+
+	time.Sleep(50 * time.Millisecond)
+	listener, err = net.Listen("tcp", listener.Addr().String())
+	if err != nil {
+		t.Skipf("port was reused before the server came back: %v", err)
+	}
+	defer listener.Close()
+
+	select {
+	case probes := <-done:
+		if probes < 2 {
+			t.Fatalf("expected at least one failed probe before success, got %d probes", probes)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("local server startup was not detected")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/essajiwa/tunnelab/pkg/client"
+)
+
+const (
+	// defaultMaxRetries is how often a rejected request is retried by default.
+	defaultMaxRetries = 5
+	// maxBackoff caps the exponential backoff used when the server gives no retry hint.
+	maxBackoff = time.Minute
+)
+
+// retryDelay reports whether the request that failed with e should be
+// retried, and after how long.
+//
+// Rate limiting and temporary unavailability are always retried, honoring
+// the server's retry hint or backing off exponentially. A tunnel limit is
+// only retried when the server says when a slot frees up.
+//
+// Parameters:
+//   - e: The rejection
+//   - attempt: Number of retries made so far
+//
+// Returns:
+//   - time.Duration: How long to wait before retrying
+//   - bool: Whether the request should be retried
+func retryDelay(e *client.ServerError, attempt int) (time.Duration, bool) {
+	switch e.Code {
+	case "RATE_LIMITED", "SERVICE_UNAVAILABLE":
+		if e.RetryAfter > 0 {
+			return e.RetryAfter, true
+		}
+		return backoff(attempt), true
+	case "TUNNEL_LIMIT_REACHED":
+		return e.RetryAfter, e.RetryAfter > 0
+	default:
+		return 0, false
+	}
+}
+
+// backoff returns 1s doubled for every attempt, capped at maxBackoff.
+func backoff(attempt int) time.Duration {
+	delay := time.Second
+	for i := 0; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
+
+// withRetries runs op until it succeeds, fails with an error that should
+// not be retried, or maxRetries retries have been made.
+//
+// Parameters:
+//   - what: Description of the request for log messages
+//   - maxRetries: Maximum number of retries
+//   - sleep: Waits between attempts (time.Sleep outside tests)
+//   - op: The request; a *client.ServerError marks a rejection by the server
+//
+// Returns:
+//   - error: nil, or the last error of op
+func withRetries(what string, maxRetries int, sleep func(time.Duration), op func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := op()
+		var serverErr *client.ServerError
+		if err == nil || !errors.As(err, &serverErr) || attempt >= maxRetries {
+			return err
+		}
+		delay, retry := retryDelay(serverErr, attempt)
+		if !retry {
+			return err
+		}
+		log.Printf("⏳ %s rejected: %v; retrying in %v (%d/%d)", what, err, delay, attempt+1, maxRetries)
+		sleep(delay)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/pkg/client"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+)
+
+// decodeServerMessage round-trips msg through JSON as the client receives it.
+func decodeServerMessage(t *testing.T, msg *protocol.ControlMessage) *protocol.ControlMessage {
+	t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("failed to encode message: %v", err)
+	}
+	var decoded protocol.ControlMessage
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to decode message: %v", err)
+	}
+	return &decoded
+}
+
+func TestRateLimitErrorIsRetriedAfterHint(t *testing.T) {
+	msg := decodeServerMessage(t, protocol.NewErrorMessageWithDetails("req", "RATE_LIMITED", "Too many requests",
+		map[string]interface{}{protocol.DetailRetryAfter: 3}))
+
+	serverErr := client.ParseServerError(msg)
+	if serverErr.Code != "RATE_LIMITED" || serverErr.RetryAfter != 3*time.Second {
+		t.Fatalf("unexpected parsed error: %+v", serverErr)
+	}
+
+	var sleeps []time.Duration
+	attempts := 0
+	err := withRetries("Tunnel request", 5, func(d time.Duration) { sleeps = append(sleeps, d) }, func() error {
+		attempts++
+		if attempts < 3 {
+			return serverErr
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected the request to succeed after retrying: %v", err)
+	}
+	if attempts != 3 || len(sleeps) != 2 || sleeps[0] != 3*time.Second || sleeps[1] != 3*time.Second {
+		t.Fatalf("expected two 3s waits before the third attempt, got %d attempts and waits %v", attempts, sleeps)
+	}
+}
+
+func TestRetryDecisions(t *testing.T) {
+	cases := []struct {
+		name    string
+		err     *client.ServerError
+		attempt int
+		delay   time.Duration
+		retry   bool
+	}{
+		{"rate limited without hint backs off", &client.ServerError{Code: "RATE_LIMITED"}, 2, 4 * time.Second, true},
+		{"backoff is capped", &client.ServerError{Code: "SERVICE_UNAVAILABLE"}, 20, maxBackoff, true},
+		{"tunnel limit with hint", &client.ServerError{Code: "TUNNEL_LIMIT_REACHED", RetryAfter: 30 * time.Second}, 0, 30 * time.Second, true},
+		{"tunnel limit without hint", &client.ServerError{Code: "TUNNEL_LIMIT_REACHED"}, 0, 0, false},
+		{"permanent error", &client.ServerError{Code: "SUBDOMAIN_TAKEN", RetryAfter: time.Second}, 0, 0, false},
+	}
+	for _, tc := range cases {
+		delay, retry := retryDelay(tc.err, tc.attempt)
+		if delay != tc.delay || retry != tc.retry {
+			t.Fatalf("%s: expected %v/%v, got %v/%v", tc.name, tc.delay, tc.retry, delay, retry)
+		}
+	}
+}
+
+func TestWithRetriesGivesUp(t *testing.T) {
+	limited := &client.ServerError{Code: "RATE_LIMITED", RetryAfter: time.Millisecond}
+	attempts := 0
+	err := withRetries("Authentication", 2, func(time.Duration) {}, func() error {
+		attempts++
+		return limited
+	})
+	if !errors.Is(err, limited) || attempts != 3 {
+		t.Fatalf("expected to give up after 2 retries, got %d attempts and %v", attempts, err)
+	}
+
+	attempts = 0
+	transport := errors.New("connection reset")
+	err = withRetries("Authentication", 2, func(time.Duration) {}, func() error {
+		attempts++
+		return transport
+	})
+	if !errors.Is(err, transport) || attempts != 1 {
+		t.Fatalf("expected transport errors not to be retried, got %d attempts", attempts)
+	}
+}
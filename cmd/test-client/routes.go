@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxRequestLine bounds the request line peeked to route a stream; longer
+// lines go to the default local port.
+const maxRequestLine = 8 * 1024
+
+// route sends HTTP requests whose path is under prefix to a local port.
+type route struct {
+	Prefix string
+	Port   int
+}
+
+// routeFlag collects repeated -route flags.
+type routeFlag []route
+
+func (f *routeFlag) String() string {
+	parts := make([]string, len(*f))
+	for i, r := range *f {
+		parts[i] = fmt.Sprintf("%s=%d", r.Prefix, r.Port)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *routeFlag) Set(value string) error {
+	r, err := parseRoute(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, r)
+	return nil
+}
+
+// parseRoute parses a route in the form "/prefix=port". A trailing slash of
+// the prefix is ignored, so "/api/" and "/api" are the same route.
+//
+// Returns:
+//   - route: The parsed route
+//   - error: Error if the prefix is not an absolute path or the port is invalid
+func parseRoute(value string) (route, error) {
+	prefix, rawPort, ok := strings.Cut(value, "=")
+	if !ok {
+		return route{}, fmt.Errorf("route %q must have the form /prefix=port", value)
+	}
+	if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "?# ") {
+		return route{}, fmt.Errorf("route prefix %q must be an absolute path", prefix)
+	}
+	if prefix != "/" {
+		prefix = strings.TrimSuffix(prefix, "/")
+	}
+	if path.Clean(prefix) != prefix {
+		return route{}, fmt.Errorf("route prefix %q must be a clean path", prefix)
+	}
+	port, err := strconv.Atoi(rawPort)
+	if err != nil || port < 1 || port > 65535 {
+		return route{}, fmt.Errorf("route %q has an invalid port %q", value, rawPort)
+	}
+	return route{Prefix: prefix, Port: port}, nil
+}
+
+// validateRoutes checks that routes are only used for HTTP tunnels and that
+// no prefix is routed twice.
+func validateRoutes(routes []route, protocol string) error {
+	if len(routes) == 0 {
+		return nil
+	}
+	if protocol != "http" {
+		return fmt.Errorf("-route is only supported for http tunnels")
+	}
+	seen := make(map[string]bool, len(routes))
+	for _, r := range routes {
+		if seen[r.Prefix] {
+			return fmt.Errorf("route prefix %s is configured twice", r.Prefix)
+		}
+		seen[r.Prefix] = true
+	}
+	return nil
+}
+
+// routeTarget is a route with the dialer of its local port.
+type routeTarget struct {
+	prefix string
+	dialer *localDialer
+}
+
+// router picks the local server of each stream. Every tunnel stream carries
+// a single HTTP request, so its request line decides the target.
+type router struct {
+	targets  []routeTarget // Longest prefix first
+	fallback *localDialer  // Used when no route matches, or for non-HTTP streams
+}
+
+// newRouter creates a router that sends requests matching a route to its
+// port on the local host, and others to fallback.
+//
+// Parameters:
+//   - cfg: Local host, scheme and routes of the tunnel
+//   - fallback: Dialer of the default local port
+//
+// Returns:
+//   - *router: The router
+//   - error: Error if a dialer cannot be created
+func newRouter(cfg *Config, fallback *localDialer) (*router, error) {
+	r := &router{fallback: fallback}
+	for _, rt := range cfg.Routes {
+		dialer, err := newLocalDialer(cfg.LocalHost, rt.Port, cfg.LocalScheme, cfg.LocalInsecure, cfg.Protocol)
+		if err != nil {
+			return nil, err
+		}
+		r.targets = append(r.targets, routeTarget{prefix: rt.Prefix, dialer: dialer})
+	}
+	// The most specific route wins: "/api/v2" is tried before "/api" and "/".
+	sort.SliceStable(r.targets, func(i, j int) bool {
+		return len(r.targets[i].prefix) > len(r.targets[j].prefix)
+	})
+	return r, nil
+}
+
+// match returns the dialer for a request path. A prefix matches itself and
+// the paths below it ("/api" matches "/api" and "/api/users", not "/apiary").
+func (r *router) match(requestPath string) *localDialer {
+	for _, target := range r.targets {
+		if target.prefix == "/" || requestPath == target.prefix || strings.HasPrefix(requestPath, target.prefix+"/") {
+			return target.dialer
+		}
+	}
+	return r.fallback
+}
+
+// route peeks the request line of stream to pick its local server.
+//
+// Returns:
+//   - *localDialer: Dialer of the local server
+//   - io.Reader: Reads the stream, including the peeked bytes
+func (r *router) route(stream net.Conn) (*localDialer, io.Reader) {
+	if len(r.targets) == 0 {
+		return r.fallback, stream
+	}
+	reader := bufio.NewReaderSize(stream, maxRequestLine)
+	var line []byte
+	_, err := reader.Peek(1)
+	for err == nil {
+		line, _ = reader.Peek(reader.Buffered())
+		if bytes.IndexByte(line, '\n') >= 0 || len(line) >= maxRequestLine {
+			break
+		}
+		_, err = reader.Peek(len(line) + 1)
+	}
+	requestPath, ok := requestLinePath(line)
+	if !ok {
+		return r.fallback, reader
+	}
+	return r.match(requestPath), reader
+}
+
+// requestLinePath returns the cleaned path of an HTTP request line such as
+// "GET /api/users?page=2 HTTP/1.1".
+func requestLinePath(line []byte) (string, bool) {
+	end := bytes.IndexByte(line, '\n')
+	if end < 0 {
+		return "", false
+	}
+	fields := strings.Fields(string(line[:end]))
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/") {
+		return "", false
+	}
+	u, err := url.ParseRequestURI(fields[1])
+	if err != nil || u.Path == "" {
+		return "", false
+	}
+	return path.Clean(u.Path), true
+}
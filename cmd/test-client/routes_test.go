@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+	tests := map[string]struct {
+		value   string
+		want    route
+		wantErr bool
+	}{
+		"prefix":          {value: "/api=8080", want: route{Prefix: "/api", Port: 8080}},
+		"trailing slash":  {value: "/api/=8080", want: route{Prefix: "/api", Port: 8080}},
+		"root":            {value: "/=3000", want: route{Prefix: "/", Port: 3000}},
+		"nested":          {value: "/api/v2=9000", want: route{Prefix: "/api/v2", Port: 9000}},
+		"missing port":    {value: "/api", wantErr: true},
+		"relative prefix": {value: "api=8080", wantErr: true},
+		"query":           {value: "/api?x=8080", wantErr: true},
+		"unclean prefix":  {value: "/api/../admin=8080", wantErr: true},
+		"invalid port":    {value: "/api=http", wantErr: true},
+		"port too large":  {value: "/api=70000", wantErr: true},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseRoute(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected %q to be rejected, got %+v", tt.value, got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("expected %+v, got %+v (%v)", tt.want, got, err)
+			}
+		})
+	}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	routes := []route{{Prefix: "/api", Port: 8080}}
+	if err := validateRoutes(routes, "http"); err != nil {
+		t.Fatalf("expected routes of an HTTP tunnel to be valid: %v", err)
+	}
+	if err := validateRoutes(routes, "tcp"); err == nil {
+		t.Fatal("expected routes of a TCP tunnel to be rejected")
+	}
+	if err := validateRoutes(append(routes, route{Prefix: "/api", Port: 9090}), "http"); err == nil {
+		t.Fatal("expected a prefix routed twice to be rejected")
+	}
+}
+
+// newTestRouter routes the prefixes of routes to their ports and everything
+// else to port 3000 on localhost.
+func newTestRouter(t *testing.T, routes ...route) *router {
+	t.Helper()
+	cfg := &Config{LocalHost: "127.0.0.1", LocalPort: 3000, Protocol: "http", Routes: routes}
+	fallback, err := newLocalDialer(cfg.LocalHost, cfg.LocalPort, "http", false, "http")
+	if err != nil {
+		t.Fatalf("failed to create dialer: %v", err)
+	}
+	r, err := newRouter(cfg, fallback)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	return r
+}
+
+func TestRouteMatchingPrecedence(t *testing.T) {
+	r := newTestRouter(t,
+		route{Prefix: "/api", Port: 8080},
+		route{Prefix: "/api/v2", Port: 8082},
+		route{Prefix: "/static", Port: 8090},
+	)
+
+	tests := map[string]struct {
+		path string
+		want string
+	}{
+		"prefix itself":         {path: "/api", want: "127.0.0.1:8080"},
+		"below prefix":          {path: "/api/users", want: "127.0.0.1:8080"},
+		"longest prefix wins":   {path: "/api/v2/users", want: "127.0.0.1:8082"},
+		"segment boundary":      {path: "/apiary", want: "127.0.0.1:3000"},
+		"similar nested prefix": {path: "/api/v20", want: "127.0.0.1:8080"},
+		"unmatched":             {path: "/", want: "127.0.0.1:3000"},
+		"other prefix":          {path: "/static/app.js", want: "127.0.0.1:8090"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := r.match(tt.path).addr; got != tt.want {
+				t.Fatalf("expected %s to go to %s, got %s", tt.path, tt.want, got)
+			}
+		})
+	}
+
+	withRoot := newTestRouter(t, route{Prefix: "/", Port: 4000}, route{Prefix: "/api", Port: 8080})
+	if got := withRoot.match("/other").addr; got != "127.0.0.1:4000" {
+		t.Fatalf("expected a / route to replace the default port, got %s", got)
+	}
+	if got := withRoot.match("/api/users").addr; got != "127.0.0.1:8080" {
+		t.Fatalf("expected /api to take precedence over /, got %s", got)
+	}
+}
+
+func TestRouterPeeksRequestLine(t *testing.T) {
+	r := newTestRouter(t, route{Prefix: "/api", Port: 8080})
+
+	tests := map[string]struct {
+		request string
+		want    string
+	}{
+		"routed request":   {request: "GET /api/users?page=2 HTTP/1.1\r\nHost: app\r\n\r\n", want: "127.0.0.1:8080"},
+		"dot segments":     {request: "GET /api/../admin HTTP/1.1\r\nHost: app\r\n\r\n", want: "127.0.0.1:3000"},
+		"default request":  {request: "POST /login HTTP/1.1\r\nHost: app\r\n\r\n", want: "127.0.0.1:3000"},
+		"not http":         {request: "\x16\x03\x01 binary\n", want: "127.0.0.1:3000"},
+		"no complete line": {request: "GET /api", want: "127.0.0.1:3000"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			go func() {
+				io.WriteString(client, tt.request)
+				client.Close()
+			}()
+
+			dialer, reader := r.route(server)
+			if dialer.addr != tt.want {
+				t.Fatalf("expected the request to go to %s, got %s", tt.want, dialer.addr)
+			}
+			forwarded, err := io.ReadAll(reader)
+			if err != nil || string(forwarded) != tt.request {
+				t.Fatalf("expected the peeked bytes to be forwarded, got %q (%v)", forwarded, err)
+			}
+		})
+	}
+}
+
+func TestRouterWithoutRoutesLeavesStreamUntouched(t *testing.T) {
+	r := newTestRouter(t)
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	dialer, reader := r.route(server)
+	if dialer != r.fallback || reader != io.Reader(server) {
+		t.Fatal("expected streams to go to the default port unread")
+	}
+	if !strings.HasSuffix(dialer.addr, ":3000") {
+		t.Fatalf("expected the default port, got %s", dialer.addr)
+	}
+}
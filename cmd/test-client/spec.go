@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// tunnelSpec is the JSON tunnel definition read from stdin with -stdin. Each
+// field overrides the flag of the same name; absent fields keep the flag's
+// value.
+type tunnelSpec struct {
+	Server        *string  `json:"server"`
+	Token         *string  `json:"token"`
+	Subdomain     *string  `json:"subdomain"`
+	Protocol      *string  `json:"protocol"`
+	LocalHost     *string  `json:"local_host"`
+	LocalPort     *int     `json:"local_port"`
+	SNI           *bool    `json:"sni"`
+	Compress      *bool    `json:"compress"`
+	Sign          *bool    `json:"sign"`
+	LocalTLS      *bool    `json:"local_tls"`
+	LocalInsecure *bool    `json:"local_insecure"`
+	Routes        []string `json:"routes"` // In the form of -route, e.g. "/api=8080"
+
+	MaxConcurrentStreams *int `json:"max_concurrent_streams"`
+}
+
+// readSpec reads a tunnel spec from r and applies it to cfg. Unknown fields
+// are rejected, so a misspelled field fails instead of being ignored.
+//
+// Parameters:
+//   - r: Reads the JSON document
+//   - cfg: Configuration from the flags, updated in place
+//
+// Returns:
+//   - error: Error if the document is invalid
+func readSpec(r io.Reader, cfg *Config) error {
+	var spec tunnelSpec
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return fmt.Errorf("invalid tunnel spec: %w", err)
+	}
+
+	setString := func(dst *string, value *string) {
+		if value != nil {
+			*dst = *value
+		}
+	}
+	setBool := func(dst *bool, value *bool) {
+		if value != nil {
+			*dst = *value
+		}
+	}
+	setString(&cfg.ServerURL, spec.Server)
+	setString(&cfg.Token, spec.Token)
+	setString(&cfg.Subdomain, spec.Subdomain)
+	setString(&cfg.LocalHost, spec.LocalHost)
+	if spec.Protocol != nil {
+		cfg.Protocol = strings.ToLower(*spec.Protocol)
+	}
+	if spec.LocalPort != nil {
+		if *spec.LocalPort < 1 || *spec.LocalPort > 65535 {
+			return fmt.Errorf("invalid tunnel spec: local_port %d is out of range", *spec.LocalPort)
+		}
+		cfg.LocalPort = *spec.LocalPort
+	}
+	setBool(&cfg.SNI, spec.SNI)
+	setBool(&cfg.Compress, spec.Compress)
+	setBool(&cfg.Sign, spec.Sign)
+	setBool(&cfg.LocalInsecure, spec.LocalInsecure)
+	if spec.LocalTLS != nil {
+		cfg.LocalScheme = "http"
+		if *spec.LocalTLS {
+			cfg.LocalScheme = "https"
+		}
+	}
+	if spec.MaxConcurrentStreams != nil {
+		cfg.MaxConcurrentStreams = *spec.MaxConcurrentStreams
+	}
+	if spec.Routes != nil {
+		cfg.Routes = nil
+		for _, value := range spec.Routes {
+			r, err := parseRoute(value)
+			if err != nil {
+				return fmt.Errorf("invalid tunnel spec: %w", err)
+			}
+			cfg.Routes = append(cfg.Routes, r)
+		}
+	}
+	return nil
+}
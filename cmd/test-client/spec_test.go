@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadSpecOverridesFlags(t *testing.T) {
+	cfg := &Config{
+		ServerURL: "ws://localhost:4443/tunnel", Token: "flag-token", Subdomain: "test",
+		LocalHost: "localhost", LocalPort: 8000, Protocol: "http", LocalScheme: "http",
+		MaxConcurrentStreams: defaultMaxConcurrentStreams,
+	}
+	spec := `{
+		"server": "wss://tunnel.example.com/tunnel",
+		"token": "ci-token",
+		"subdomain": "ci-42",
+		"protocol": "HTTP",
+		"local_port": 3000,
+		"local_tls": true,
+		"local_insecure": true,
+		"routes": ["/api=8080"]
+	}`
+	if err := readSpec(strings.NewReader(spec), cfg); err != nil {
+		t.Fatalf("failed to read spec: %v", err)
+	}
+
+	want := &Config{
+		ServerURL: "wss://tunnel.example.com/tunnel", Token: "ci-token", Subdomain: "ci-42",
+		LocalHost: "localhost", LocalPort: 3000, Protocol: "http", LocalScheme: "https", LocalInsecure: true,
+		MaxConcurrentStreams: defaultMaxConcurrentStreams,
+		Routes:               []route{{Prefix: "/api", Port: 8080}},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("expected %+v, got %+v", want, cfg)
+	}
+	if err := validateConfig(cfg); err != nil {
+		t.Fatalf("expected the spec to be valid: %v", err)
+	}
+}
+
+func TestReadSpecRejectsInvalidSpecs(t *testing.T) {
+	tests := map[string]struct {
+		spec          string
+		wantSubstring string
+	}{
+		"not json":      {spec: "subdomain=ci", wantSubstring: "invalid tunnel spec"},
+		"unknown field": {spec: `{"subdomian": "ci"}`, wantSubstring: "unknown field"},
+		"wrong type":    {spec: `{"local_port": "3000"}`, wantSubstring: "invalid tunnel spec"},
+		"port range":    {spec: `{"local_port": 70000}`, wantSubstring: "out of range"},
+		"invalid route": {spec: `{"routes": ["api=8080"]}`, wantSubstring: "must be an absolute path"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := readSpec(strings.NewReader(tt.spec), &Config{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantSubstring) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantSubstring, err)
+			}
+		})
+	}
+}
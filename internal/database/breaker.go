@@ -0,0 +1,141 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrUnavailable is returned instead of blocking when the database keeps
+// failing or timing out and the circuit breaker is open.
+var ErrUnavailable = errors.New("database unavailable")
+
+// BreakerConfig controls retries and circuit breaking around database calls.
+type BreakerConfig struct {
+	Timeout          time.Duration // Deadline for a single attempt
+	Retries          int           // Extra attempts after a transient failure
+	RetryDelay       time.Duration // Pause between attempts
+	FailureThreshold int           // Consecutive failed calls that open the circuit
+	Cooldown         time.Duration // How long the circuit stays open before a trial call
+}
+
+// Breaker retries transient database failures and, after repeated failures,
+// fails fast with ErrUnavailable until the cooldown has passed.
+type Breaker struct {
+	cfg BreakerConfig
+
+	mu        sync.Mutex
+	failures  int       // Consecutive failed calls
+	openUntil time.Time // Calls fail fast until this time
+	now       func() time.Time
+}
+
+// NewBreaker creates a Breaker. Zero fields get conservative defaults: a 2s
+// attempt timeout, 2 retries 50ms apart, and a 10s cooldown after 5 failures.
+//
+// Parameters:
+//   - cfg: Retry and circuit breaker settings
+//
+// Returns:
+//   - *Breaker: A closed circuit breaker
+func NewBreaker(cfg BreakerConfig) *Breaker {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = 50 * time.Millisecond
+	}
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 5
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = 10 * time.Second
+	}
+	return &Breaker{cfg: cfg, now: time.Now}
+}
+
+// Do runs op with a per-attempt deadline, retrying transient failures such as
+// a busy or locked database. Errors that show the database is responsive
+// (e.g. a constraint violation) are returned as-is without a retry.
+//
+// Parameters:
+//   - ctx: Context of the caller; cancelling it stops further attempts
+//   - op: The database operation, which must honor the context it is given
+//
+// Returns:
+//   - error: nil, the operation's error, or an error wrapping ErrUnavailable
+func (b *Breaker) Do(ctx context.Context, op func(ctx context.Context) error) error {
+	if !b.allow() {
+		return fmt.Errorf("%w: circuit open after repeated failures", ErrUnavailable)
+	}
+
+	var err error
+	for attempt := 0; attempt <= b.cfg.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				b.record(false)
+				return ctx.Err()
+			case <-time.After(b.cfg.RetryDelay):
+			}
+		}
+
+		attemptCtx, cancel := context.WithTimeout(ctx, b.cfg.Timeout)
+		err = op(attemptCtx)
+		cancel()
+
+		if err == nil || !isTransient(err) {
+			b.record(true)
+			return err
+		}
+		if ctx.Err() != nil {
+			b.record(false)
+			return ctx.Err()
+		}
+	}
+
+	b.record(false)
+	return fmt.Errorf("%w: %v", ErrUnavailable, err)
+}
+
+// allow reports whether a call may reach the database.
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.now().Before(b.openUntil)
+}
+
+// record updates the failure count, opening the circuit at the threshold.
+func (b *Breaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.cfg.FailureThreshold {
+		b.openUntil = b.now().Add(b.cfg.Cooldown)
+	}
+}
+
+// isTransient reports whether err may succeed on retry.
+func isTransient(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked || sqliteErr.Code == sqlite3.ErrInterrupt
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var errBusy = sqlite3.Error{Code: sqlite3.ErrBusy}
+
+func TestBreakerRetriesTransientErrors(t *testing.T) {
+	b := NewBreaker(BreakerConfig{Retries: 2, RetryDelay: time.Millisecond})
+
+	calls := 0
+	err := b.Do(context.Background(), func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errBusy
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expected success on the third attempt, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	constraint := errors.New("UNIQUE constraint failed: tunnels.subdomain")
+	if err := b.Do(context.Background(), func(ctx context.Context) error {
+		calls++
+		return constraint
+	}); err != constraint || calls != 1 {
+		t.Fatalf("expected a permanent error to be returned without retry, got %v after %d calls", err, calls)
+	}
+}
+
+func TestBreakerTimesOutHungQueries(t *testing.T) {
+	b := NewBreaker(BreakerConfig{Timeout: 20 * time.Millisecond, Retries: 1, RetryDelay: time.Millisecond})
+
+	start := time.Now()
+	err := b.Do(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected ErrUnavailable, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("hung query was not abandoned in time (%v)", elapsed)
+	}
+}
+
+func TestBreakerOpensAndRecovers(t *testing.T) {
+	now := time.Now()
+	b := NewBreaker(BreakerConfig{Retries: -1, FailureThreshold: 2, Cooldown: time.Minute})
+	b.now = func() time.Time { return now }
+
+	failing := func(ctx context.Context) error { return errBusy }
+	for i := 0; i < 2; i++ {
+		if err := b.Do(context.Background(), failing); !errors.Is(err, ErrUnavailable) {
+			t.Fatalf("attempt %d: expected ErrUnavailable, got %v", i, err)
+		}
+	}
+
+	called := false
+	err := b.Do(context.Background(), func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, ErrUnavailable) || called {
+		t.Fatalf("expected the open circuit to fail fast, got %v (called=%v)", err, called)
+	}
+
+	now = now.Add(time.Minute)
+	if err := b.Do(context.Background(), func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatalf("expected a trial call after the cooldown to succeed, got %v", err)
+	}
+	if err := b.Do(context.Background(), failing); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected ErrUnavailable, got %v", err)
+	}
+	if err := b.Do(context.Background(), func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatalf("a single failure after recovery should not open the circuit, got %v", err)
+	}
+}
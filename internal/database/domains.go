@@ -0,0 +1,160 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// CreateCustomDomain adds an unverified custom domain.
+//
+// Parameters:
+//   - domain: Hostname, client, subdomain and verification token; Verified is ignored
+//
+// Returns:
+//   - error: Database error if any, including a hostname that already exists
+func (r *Repository) CreateCustomDomain(domain *CustomDomain) error {
+	return r.CreateCustomDomainContext(context.Background(), domain)
+}
+
+// CreateCustomDomainContext is CreateCustomDomain with a context that bounds the insert.
+func (r *Repository) CreateCustomDomainContext(ctx context.Context, domain *CustomDomain) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO custom_domains (hostname, client_id, subdomain, verification_token) VALUES (?, ?, ?, ?)
+	`, domain.Hostname, domain.ClientID, domain.Subdomain, domain.VerificationToken)
+	return err
+}
+
+// GetCustomDomain retrieves a custom domain by hostname.
+//
+// Returns:
+//   - *CustomDomain: The domain, verified or not
+//   - error: Database error if any
+//   - nil, nil: If the hostname is not registered
+func (r *Repository) GetCustomDomain(hostname string) (*CustomDomain, error) {
+	return r.GetCustomDomainContext(context.Background(), hostname)
+}
+
+// GetCustomDomainContext is GetCustomDomain with a context that bounds the query.
+func (r *Repository) GetCustomDomainContext(ctx context.Context, hostname string) (*CustomDomain, error) {
+	var domain *CustomDomain
+	err := r.guarded(ctx, func(ctx context.Context) error {
+		rows, err := r.db.QueryContext(ctx, `
+			SELECT hostname, client_id, subdomain, verified, created_at, verified_at, verification_token
+			FROM custom_domains WHERE hostname = ?
+		`, hostname)
+		if err != nil {
+			return err
+		}
+		domains, err := scanCustomDomains(rows)
+		if err == nil && len(domains) > 0 {
+			domain = domains[0]
+		}
+		return err
+	})
+	return domain, err
+}
+
+// ListCustomDomains returns every custom domain, ordered by hostname.
+//
+// Returns:
+//   - []*CustomDomain: The domains
+//   - error: Database error if any
+func (r *Repository) ListCustomDomains() ([]*CustomDomain, error) {
+	return r.ListCustomDomainsContext(context.Background())
+}
+
+// ListCustomDomainsContext is ListCustomDomains with a context that bounds the query.
+func (r *Repository) ListCustomDomainsContext(ctx context.Context) ([]*CustomDomain, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT hostname, client_id, subdomain, verified, created_at, verified_at, verification_token
+		FROM custom_domains ORDER BY hostname
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return scanCustomDomains(rows)
+}
+
+// ListPendingCustomDomains returns the custom domains still awaiting ownership
+// verification, ordered by hostname.
+//
+// Returns:
+//   - []*CustomDomain: The unverified domains
+//   - error: Database error if any
+func (r *Repository) ListPendingCustomDomains() ([]*CustomDomain, error) {
+	return r.ListPendingCustomDomainsContext(context.Background())
+}
+
+// ListPendingCustomDomainsContext is ListPendingCustomDomains with a context that bounds the query.
+func (r *Repository) ListPendingCustomDomainsContext(ctx context.Context) ([]*CustomDomain, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT hostname, client_id, subdomain, verified, created_at, verified_at, verification_token
+		FROM custom_domains WHERE verified = 0 ORDER BY hostname
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return scanCustomDomains(rows)
+}
+
+// VerifyCustomDomain marks a custom domain as verified, so it is routed and
+// may get a certificate.
+//
+// Returns:
+//   - bool: Whether the hostname exists
+//   - error: Database error if any
+func (r *Repository) VerifyCustomDomain(hostname string) (bool, error) {
+	return r.VerifyCustomDomainContext(context.Background(), hostname)
+}
+
+// VerifyCustomDomainContext is VerifyCustomDomain with a context that bounds the update.
+func (r *Repository) VerifyCustomDomainContext(ctx context.Context, hostname string) (bool, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE custom_domains SET verified = 1, verified_at = ? WHERE hostname = ?
+	`, time.Now().UTC().Format(sqliteTimeFormat), hostname)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteCustomDomain removes a custom domain.
+//
+// Returns:
+//   - bool: Whether the hostname existed
+//   - error: Database error if any
+func (r *Repository) DeleteCustomDomain(hostname string) (bool, error) {
+	return r.DeleteCustomDomainContext(context.Background(), hostname)
+}
+
+// DeleteCustomDomainContext is DeleteCustomDomain with a context that bounds the delete.
+func (r *Repository) DeleteCustomDomainContext(ctx context.Context, hostname string) (bool, error) {
+	result, err := r.db.ExecContext(ctx, `DELETE FROM custom_domains WHERE hostname = ?`, hostname)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// scanCustomDomains reads every row of a custom_domains query and closes rows.
+func scanCustomDomains(rows *sql.Rows) ([]*CustomDomain, error) {
+	defer rows.Close()
+
+	var domains []*CustomDomain
+	for rows.Next() {
+		var domain CustomDomain
+		var verifiedAt sql.NullTime
+		if err := rows.Scan(&domain.Hostname, &domain.ClientID, &domain.Subdomain, &domain.Verified,
+			&domain.CreatedAt, &verifiedAt, &domain.VerificationToken); err != nil {
+			return nil, err
+		}
+		if verifiedAt.Valid {
+			domain.VerifiedAt = &verifiedAt.Time
+		}
+		domains = append(domains, &domain)
+	}
+	return domains, rows.Err()
+}
@@ -32,6 +32,20 @@ type Client struct {
 	CreatedAt         time.Time `db:"created_at"`         // Creation timestamp
 	UpdatedAt         time.Time `db:"updated_at"`         // Last update timestamp
 	Status            string    `db:"status"`             // Client status (active, inactive, etc.)
+	// MonthlyByteQuota caps the bytes proxied per calendar month (0 means the server default, negative means unlimited).
+	MonthlyByteQuota int64 `db:"monthly_byte_quota"`
+	// Scopes lists, comma-separated, the protocols and features the client may use, such as "http,tcp" ("" means all).
+	Scopes string `db:"scopes"`
+}
+
+// ClientUpdate lists the client fields UpdateClient changes; nil fields are
+// left as they are.
+type ClientUpdate struct {
+	MaxTunnels        *int
+	AllowedSubdomains *string // Comma-separated; "" allows any subdomain
+	Status            *string
+	MonthlyByteQuota  *int64
+	Scopes            *string // Comma-separated; "" allows every scope
 }
 
 // Tunnel represents a tunnel configuration created by a client.
@@ -48,16 +62,54 @@ type Tunnel struct {
 	Status     string     `db:"status"`      // Tunnel status (active, inactive, etc.)
 }
 
+// TunnelFilter selects tunnels for Repository.ListTunnels. Zero fields match everything.
+type TunnelFilter struct {
+	ClientID      string    // Only tunnels of this client
+	Status        string    // Only tunnels in this status ("active", "closed")
+	Protocol      string    // Only tunnels of this protocol
+	CreatedAfter  time.Time // Only tunnels created at or after this time
+	CreatedBefore time.Time // Only tunnels created before this time
+	Limit         int       // Page size (0 means no limit)
+	Offset        int       // Number of matching tunnels to skip
+	Ascending     bool      // Oldest first instead of newest first
+}
+
 // ConnectionLog represents a log entry for tunnel connections and requests.
 type ConnectionLog struct {
 	ID             int64     `db:"id"`              // Unique log entry identifier
 	TunnelID       string    `db:"tunnel_id"`       // ID of the tunnel
 	ClientIP       string    `db:"client_ip"`       // Client IP address
-	RequestMethod  string    `db:"request_method"`  // HTTP method
-	RequestPath    string    `db:"request_path"`    // Request path
-	ResponseStatus int       `db:"response_status"` // HTTP response status code
+	RequestMethod  string    `db:"request_method"`  // HTTP method (empty for TCP connections)
+	RequestPath    string    `db:"request_path"`    // Request path (empty for TCP connections)
+	ResponseStatus int       `db:"response_status"` // HTTP response status code (0 for TCP connections)
+	PublicPort     int       `db:"public_port"`     // Public port a TCP connection arrived on (0 for HTTP requests)
 	BytesSent      int64     `db:"bytes_sent"`      // Bytes sent
 	BytesReceived  int64     `db:"bytes_received"`  // Bytes received
 	DurationMs     int       `db:"duration_ms"`     // Request duration in milliseconds
 	CreatedAt      time.Time `db:"created_at"`      // Timestamp of the request
 }
+
+// CustomDomain maps a hostname outside the server domain, such as
+// app.example.org with a CNAME to the tunnel, to a subdomain of a client.
+type CustomDomain struct {
+	Hostname   string     `json:"hostname"`              // Fully-qualified hostname, lowercase without a trailing dot
+	ClientID   string     `json:"client_id"`             // Client whose tunnel the hostname serves
+	Subdomain  string     `json:"subdomain"`             // Subdomain of that tunnel
+	Verified   bool       `json:"verified"`              // Whether DNS was checked; only verified hostnames are routed
+	CreatedAt  time.Time  `json:"created_at"`            // Creation timestamp
+	VerifiedAt *time.Time `json:"verified_at,omitempty"` // When the hostname was verified
+
+	// VerificationToken is the value the owner of the hostname publishes in a
+	// DNS TXT record to prove ownership.
+	VerificationToken string `json:"verification_token"`
+}
+
+// ClientUsage aggregates a client's connection logs over a time window.
+type ClientUsage struct {
+	ClientID      string    `json:"client_id"`       // Client the usage belongs to
+	Since         time.Time `json:"since"`           // Start of the window (zero means all time)
+	Requests      int64     `json:"requests"`        // Logged requests
+	BytesSent     int64     `json:"bytes_sent"`      // Bytes sent to public clients
+	BytesReceived int64     `json:"bytes_received"`  // Bytes received from public clients
+	AvgDurationMs float64   `json:"avg_duration_ms"` // Mean request duration in milliseconds
+}
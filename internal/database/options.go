@@ -0,0 +1,119 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options are the SQLite pragmas applied to every pooled connection, and the
+// limits of the pool.
+type Options struct {
+	JournalMode string        // journal_mode: "wal" (default), "delete", "truncate", "persist", "memory" or "off"
+	BusyTimeout time.Duration // busy_timeout: how long a query waits on a lock before "database is locked"
+	ForeignKeys bool          // foreign_keys: enforce REFERENCES constraints
+	Synchronous string        // synchronous: "normal" (default), "full", "extra" or "off"
+
+	MaxOpenConns    int           // Open connections at most (0 means 1, the single writer SQLite handles best; -1 means no limit)
+	MaxIdleConns    int           // Idle connections kept (0 means MaxOpenConns; -1 means none)
+	ConnMaxLifetime time.Duration // Connections are reopened after this long (0 means never)
+}
+
+// sqliteMaxOpenConns is the default pool size. SQLite allows one writer at a
+// time, so a single connection queues writes in the pool instead of having
+// them fail with "database is locked" after busy_timeout.
+const sqliteMaxOpenConns = 1
+
+// DefaultOptions returns pragmas suited to a busy control plane: WAL so
+// readers never block the writer, a 5s busy timeout, enforced foreign keys
+// and NORMAL synchronous (safe with WAL), over a single connection.
+func DefaultOptions() Options {
+	return Options{
+		JournalMode: "wal",
+		BusyTimeout: 5 * time.Second,
+		ForeignKeys: true,
+		Synchronous: "normal",
+	}
+}
+
+var (
+	journalModes     = []string{"delete", "truncate", "persist", "memory", "wal", "off"}
+	synchronousModes = []string{"off", "normal", "full", "extra"}
+)
+
+// dsn appends the pragmas to dbPath as go-sqlite3 connection parameters, so
+// they apply to every connection the pool opens, not just the first.
+func (o Options) dsn(dbPath string) (string, error) {
+	journalMode := strings.ToLower(o.JournalMode)
+	if journalMode == "" {
+		journalMode = "wal"
+	}
+	if !contains(journalModes, journalMode) {
+		return "", fmt.Errorf("invalid journal_mode %q (use one of %s)", o.JournalMode, strings.Join(journalModes, ", "))
+	}
+	synchronous := strings.ToLower(o.Synchronous)
+	if synchronous == "" {
+		synchronous = "normal"
+	}
+	if !contains(synchronousModes, synchronous) {
+		return "", fmt.Errorf("invalid synchronous %q (use one of %s)", o.Synchronous, strings.Join(synchronousModes, ", "))
+	}
+	if o.BusyTimeout < 0 {
+		return "", fmt.Errorf("busy_timeout must not be negative, got %v", o.BusyTimeout)
+	}
+
+	params := url.Values{}
+	params.Set("_journal_mode", strings.ToUpper(journalMode))
+	params.Set("_busy_timeout", strconv.FormatInt(o.BusyTimeout.Milliseconds(), 10))
+	params.Set("_foreign_keys", strconv.FormatBool(o.ForeignKeys))
+	params.Set("_synchronous", strings.ToUpper(synchronous))
+
+	separator := "?"
+	if strings.Contains(dbPath, "?") {
+		separator = "&"
+	}
+	return dbPath + separator + params.Encode(), nil
+}
+
+// applyPool sets the connection pool limits of db.
+func (o Options) applyPool(db *sql.DB) error {
+	if o.MaxOpenConns < -1 || o.MaxIdleConns < -1 {
+		return fmt.Errorf("max_open_conns and max_idle_conns must be -1 or more, got %d and %d", o.MaxOpenConns, o.MaxIdleConns)
+	}
+	if o.ConnMaxLifetime < 0 {
+		return fmt.Errorf("conn_max_lifetime must not be negative, got %v", o.ConnMaxLifetime)
+	}
+	maxOpen := o.MaxOpenConns
+	switch maxOpen {
+	case 0:
+		maxOpen = sqliteMaxOpenConns
+	case -1:
+		maxOpen = 0 // database/sql: no limit
+	}
+	maxIdle := o.MaxIdleConns
+	switch maxIdle {
+	case 0:
+		maxIdle = maxOpen
+		if maxIdle == 0 {
+			maxIdle = 2 // database/sql's default
+		}
+	case -1:
+		maxIdle = 0
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(o.ConnMaxLifetime)
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRepositoryAppliesPragmas(t *testing.T) {
+	repo, err := NewRepositoryWithOptions(filepath.Join(t.TempDir(), "tunnelab.db"), Options{
+		JournalMode: "wal",
+		BusyTimeout: 1500 * time.Millisecond,
+		ForeignKeys: true,
+		Synchronous: "full",
+
+		MaxOpenConns: 2,
+	})
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	// Hold one connection so the queries below run on a second one: the
+	// pragmas must apply to every pooled connection.
+	held, err := repo.db.Conn(t.Context())
+	if err != nil {
+		t.Fatalf("failed to reserve a connection: %v", err)
+	}
+	defer held.Close()
+
+	var journalMode string
+	var busyTimeout, foreignKeys, synchronous int
+	for pragma, dest := range map[string]interface{}{
+		"journal_mode": &journalMode,
+		"busy_timeout": &busyTimeout,
+		"foreign_keys": &foreignKeys,
+		"synchronous":  &synchronous,
+	} {
+		if err := repo.db.QueryRow("PRAGMA " + pragma).Scan(dest); err != nil {
+			t.Fatalf("failed to read %s: %v", pragma, err)
+		}
+	}
+	if journalMode != "wal" || busyTimeout != 1500 || foreignKeys != 1 || synchronous != 2 {
+		t.Fatalf("unexpected pragmas: journal_mode=%s busy_timeout=%d foreign_keys=%d synchronous=%d",
+			journalMode, busyTimeout, foreignKeys, synchronous)
+	}
+
+	if err := repo.CreateTunnel(&Tunnel{ID: "t", ClientID: "missing", Subdomain: "app", Protocol: "http", LocalPort: 3000, Status: "active"}); err == nil {
+		t.Fatal("expected the foreign key on tunnels.client_id to be enforced")
+	}
+}
+
+func TestRepositoryAppliesPoolLimits(t *testing.T) {
+	tests := map[string]struct {
+		opts     Options
+		wantOpen int
+	}{
+		"sqlite default": {opts: DefaultOptions(), wantOpen: 1},
+		"configured":     {opts: Options{MaxOpenConns: 4, MaxIdleConns: 2, ConnMaxLifetime: time.Minute}, wantOpen: 4},
+		"no limit":       {opts: Options{MaxOpenConns: -1}, wantOpen: 0},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			repo, err := NewRepositoryWithOptions(filepath.Join(t.TempDir(), "tunnelab.db"), tt.opts)
+			if err != nil {
+				t.Fatalf("failed to create repository: %v", err)
+			}
+			defer repo.Close()
+			if got := repo.db.Stats().MaxOpenConnections; got != tt.wantOpen {
+				t.Fatalf("expected at most %d open connections, got %d", tt.wantOpen, got)
+			}
+		})
+	}
+
+	// The idle limit and lifetime are not exposed by sql.DB: hold more
+	// connections than may idle and check how many are closed on release.
+	repo, err := NewRepositoryWithOptions(filepath.Join(t.TempDir(), "tunnelab.db"), Options{MaxOpenConns: 3, MaxIdleConns: 1})
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+	var conns []*sql.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := repo.db.Conn(t.Context())
+		if err != nil {
+			t.Fatalf("failed to open connection %d: %v", i, err)
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if stats := repo.db.Stats(); stats.Idle != 1 || stats.MaxIdleClosed != 2 {
+		t.Fatalf("expected 1 idle connection and 2 closed, got %+v", stats)
+	}
+}
+
+func TestOptionsRejectInvalidPragmas(t *testing.T) {
+	invalid := []Options{
+		{JournalMode: "fast"},
+		{Synchronous: "sometimes"},
+		{BusyTimeout: -time.Second},
+		{MaxOpenConns: -2},
+		{ConnMaxLifetime: -time.Second},
+	}
+	for _, opts := range invalid {
+		if _, err := NewRepositoryWithOptions(filepath.Join(t.TempDir(), "tunnelab.db"), opts); err == nil {
+			t.Fatalf("expected options %+v to be rejected", opts)
+		}
+	}
+}
+
+func TestOptionsDSNKeepsExistingParameters(t *testing.T) {
+	dsn, err := DefaultOptions().dsn("file:tunnelab.db?cache=shared")
+	if err != nil {
+		t.Fatalf("dsn failed: %v", err)
+	}
+	want := "file:tunnelab.db?cache=shared&_busy_timeout=5000&_foreign_keys=true&_journal_mode=WAL&_synchronous=NORMAL"
+	if dsn != want {
+		t.Fatalf("expected %q, got %q", want, dsn)
+	}
+}
@@ -15,11 +15,16 @@
 //	if err != nil {
 //	    log.Fatal(err)
 //	}
+//
+// Every query method has a ...Context variant that accepts a context.Context, so
+// queries can be cancelled or time-limited by the caller.
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -27,12 +32,14 @@ import (
 
 // Repository provides database operations for TunneLab data.
 type Repository struct {
-	db *sql.DB // SQLite database connection
+	db      *sql.DB  // SQLite database connection
+	breaker *Breaker // Optional retry and circuit breaker for critical calls
 }
 
 // NewRepository creates a new Repository instance with the specified database path.
 //
-// It opens the database, verifies connectivity, and runs migrations if needed.
+// It opens the database with DefaultOptions, verifies connectivity, and runs
+// migrations if needed.
 //
 // Parameters:
 //   - dbPath: Path to the SQLite database file
@@ -41,10 +48,32 @@ type Repository struct {
 //   - *Repository: Repository instance
 //   - error: Error if database cannot be opened or migrated
 func NewRepository(dbPath string) (*Repository, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	return NewRepositoryWithOptions(dbPath, DefaultOptions())
+}
+
+// NewRepositoryWithOptions is NewRepository with explicit SQLite pragmas.
+//
+// Parameters:
+//   - dbPath: Path to the SQLite database file
+//   - opts: Pragmas applied to every connection, and pool limits
+//
+// Returns:
+//   - *Repository: Repository instance
+//   - error: Error if the options are invalid or the database cannot be opened or migrated
+func NewRepositoryWithOptions(dbPath string, opts Options) (*Repository, error) {
+	dsn, err := opts.dsn(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
+	if err := opts.applyPool(db); err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	if err := db.Ping(); err != nil {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
@@ -58,6 +87,21 @@ func NewRepository(dbPath string) (*Repository, error) {
 	return repo, nil
 }
 
+// SetBreaker guards the calls on the control plane's critical path (token
+// lookup and tunnel bookkeeping) with retries and a circuit breaker, so a
+// locked or unreachable database yields ErrUnavailable instead of a stall.
+func (r *Repository) SetBreaker(breaker *Breaker) {
+	r.breaker = breaker
+}
+
+// guarded runs op through the breaker when one is set.
+func (r *Repository) guarded(ctx context.Context, op func(ctx context.Context) error) error {
+	if r.breaker == nil {
+		return op(ctx)
+	}
+	return r.breaker.Do(ctx, op)
+}
+
 func (r *Repository) migrate() error {
 	schema := `
 	CREATE TABLE IF NOT EXISTS clients (
@@ -68,7 +112,9 @@ func (r *Repository) migrate() error {
 		allowed_subdomains TEXT,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		status TEXT DEFAULT 'active'
+		status TEXT DEFAULT 'active',
+		monthly_byte_quota INTEGER DEFAULT 0,
+		scopes TEXT NOT NULL DEFAULT ''
 	);
 
 	CREATE TABLE IF NOT EXISTS tunnels (
@@ -99,15 +145,69 @@ func (r *Repository) migrate() error {
 		bytes_sent INTEGER,
 		bytes_received INTEGER,
 		duration_ms INTEGER,
+		public_port INTEGER DEFAULT 0,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (tunnel_id) REFERENCES tunnels(id)
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_connection_logs_tunnel_id ON connection_logs(tunnel_id);
 	CREATE INDEX IF NOT EXISTS idx_connection_logs_created_at ON connection_logs(created_at);
+
+	CREATE TABLE IF NOT EXISTS custom_domains (
+		hostname TEXT PRIMARY KEY,
+		client_id TEXT NOT NULL,
+		subdomain TEXT NOT NULL,
+		verified INTEGER DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		verified_at TIMESTAMP,
+		verification_token TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (client_id) REFERENCES clients(id)
+	);
 	`
 
-	_, err := r.db.Exec(schema)
+	if _, err := r.db.Exec(schema); err != nil {
+		return err
+	}
+	if err := r.addColumn("clients", "monthly_byte_quota", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := r.addColumn("connection_logs", "public_port", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := r.addColumn("custom_domains", "verification_token", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	return r.addColumn("clients", "scopes", "TEXT NOT NULL DEFAULT ''")
+}
+
+// addColumn adds a column to a table created by an older version of the schema.
+func (r *Repository) addColumn(table, column, definition string) error {
+	rows, err := r.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid          int
+			name, ctype  string
+			notNull, pk  int
+			defaultValue sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = r.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 	return err
 }
 
@@ -121,15 +221,22 @@ func (r *Repository) migrate() error {
 //   - error: Database error if any
 //   - nil, nil: If token not found (not an error)
 func (r *Repository) GetClientByToken(token string) (*Client, error) {
+	return r.GetClientByTokenContext(context.Background(), token)
+}
+
+// GetClientByTokenContext is GetClientByToken with a context that bounds the query.
+func (r *Repository) GetClientByTokenContext(ctx context.Context, token string) (*Client, error) {
 	var client Client
 	var allowedSubdomains sql.NullString
-	err := r.db.QueryRow(`
-		SELECT id, name, api_token, max_tunnels, allowed_subdomains, created_at, updated_at, status
-		FROM clients WHERE api_token = ? AND status = 'active'
-	`, token).Scan(
-		&client.ID, &client.Name, &client.APIToken, &client.MaxTunnels,
-		&allowedSubdomains, &client.CreatedAt, &client.UpdatedAt, &client.Status,
-	)
+	err := r.guarded(ctx, func(ctx context.Context) error {
+		return r.db.QueryRowContext(ctx, `
+			SELECT id, name, api_token, max_tunnels, allowed_subdomains, created_at, updated_at, status, monthly_byte_quota, scopes
+			FROM clients WHERE api_token = ? AND status = 'active'
+		`, token).Scan(
+			&client.ID, &client.Name, &client.APIToken, &client.MaxTunnels,
+			&allowedSubdomains, &client.CreatedAt, &client.UpdatedAt, &client.Status, &client.MonthlyByteQuota, &client.Scopes,
+		)
+	})
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -142,6 +249,92 @@ func (r *Repository) GetClientByToken(token string) (*Client, error) {
 	return &client, nil
 }
 
+// GetClient retrieves a client by ID, whatever its status.
+//
+// Parameters:
+//   - id: The client ID to look up
+//
+// Returns:
+//   - *Client: The client if found
+//   - error: Database error if any
+//   - nil, nil: If the client does not exist
+func (r *Repository) GetClient(id string) (*Client, error) {
+	return r.GetClientContext(context.Background(), id)
+}
+
+// GetClientContext is GetClient with a context that bounds the query.
+func (r *Repository) GetClientContext(ctx context.Context, id string) (*Client, error) {
+	var client Client
+	var allowedSubdomains sql.NullString
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id, name, api_token, max_tunnels, allowed_subdomains, created_at, updated_at, status, monthly_byte_quota, scopes
+		FROM clients WHERE id = ?
+	`, id).Scan(
+		&client.ID, &client.Name, &client.APIToken, &client.MaxTunnels,
+		&allowedSubdomains, &client.CreatedAt, &client.UpdatedAt, &client.Status, &client.MonthlyByteQuota, &client.Scopes,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	client.AllowedSubdomains = allowedSubdomains.String
+	return &client, nil
+}
+
+// UpdateClient changes the fields of a client set in update and bumps its
+// updated_at, even when update sets no field. A client made inactive can no
+// longer authenticate; its open tunnels are not closed.
+//
+// Parameters:
+//   - id: The client to update
+//   - update: The fields to change
+//
+// Returns:
+//   - *Client: The client as updated
+//   - error: Database error if any
+//   - nil, nil: If the client does not exist
+func (r *Repository) UpdateClient(id string, update ClientUpdate) (*Client, error) {
+	return r.UpdateClientContext(context.Background(), id, update)
+}
+
+// UpdateClientContext is UpdateClient with a context that bounds the update.
+func (r *Repository) UpdateClientContext(ctx context.Context, id string, update ClientUpdate) (*Client, error) {
+	sets := []string{"updated_at = ?"}
+	args := []interface{}{time.Now().UTC().Format(sqliteTimeFormat)}
+	if update.MaxTunnels != nil {
+		sets = append(sets, "max_tunnels = ?")
+		args = append(args, *update.MaxTunnels)
+	}
+	if update.AllowedSubdomains != nil {
+		sets = append(sets, "allowed_subdomains = ?")
+		args = append(args, *update.AllowedSubdomains)
+	}
+	if update.Status != nil {
+		sets = append(sets, "status = ?")
+		args = append(args, *update.Status)
+	}
+	if update.MonthlyByteQuota != nil {
+		sets = append(sets, "monthly_byte_quota = ?")
+		args = append(args, *update.MonthlyByteQuota)
+	}
+	if update.Scopes != nil {
+		sets = append(sets, "scopes = ?")
+		args = append(args, *update.Scopes)
+	}
+	args = append(args, id)
+
+	result, err := r.db.ExecContext(ctx, "UPDATE clients SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+	return r.GetClientContext(ctx, id)
+}
+
 // CreateClient creates a new client in the database.
 //
 // Parameters:
@@ -150,32 +343,138 @@ func (r *Repository) GetClientByToken(token string) (*Client, error) {
 // Returns:
 //   - error: Database error if any
 func (r *Repository) CreateClient(client *Client) error {
-	_, err := r.db.Exec(`
-		INSERT INTO clients (id, name, api_token, max_tunnels, allowed_subdomains, status)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, client.ID, client.Name, client.APIToken, client.MaxTunnels, client.AllowedSubdomains, client.Status)
-	return err
+	return r.CreateClientContext(context.Background(), client)
 }
 
-func (r *Repository) CreateTunnel(tunnel *Tunnel) error {
-	_, err := r.db.Exec(`
-		INSERT INTO tunnels (id, client_id, subdomain, protocol, local_port, public_port, public_url, status)
+// CreateClientContext is CreateClient with a context that bounds the insert.
+func (r *Repository) CreateClientContext(ctx context.Context, client *Client) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO clients (id, name, api_token, max_tunnels, allowed_subdomains, status, monthly_byte_quota, scopes)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, tunnel.ID, tunnel.ClientID, tunnel.Subdomain, tunnel.Protocol, tunnel.LocalPort, tunnel.PublicPort, tunnel.PublicURL, tunnel.Status)
+	`, client.ID, client.Name, client.APIToken, client.MaxTunnels, client.AllowedSubdomains, client.Status, client.MonthlyByteQuota, client.Scopes)
 	return err
 }
 
+// ListClients returns every client in any status, oldest first.
+//
+// Returns:
+//   - []*Client: The clients
+//   - error: Database error if any
+func (r *Repository) ListClients() ([]*Client, error) {
+	return r.ListClientsContext(context.Background())
+}
+
+// ListClientsContext is ListClients with a context that bounds the query.
+func (r *Repository) ListClientsContext(ctx context.Context) ([]*Client, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, name, api_token, max_tunnels, allowed_subdomains, created_at, updated_at, status, monthly_byte_quota, scopes
+		FROM clients ORDER BY created_at ASC, rowid ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []*Client
+	for rows.Next() {
+		var client Client
+		var allowedSubdomains sql.NullString
+		if err := rows.Scan(
+			&client.ID, &client.Name, &client.APIToken, &client.MaxTunnels,
+			&allowedSubdomains, &client.CreatedAt, &client.UpdatedAt, &client.Status, &client.MonthlyByteQuota, &client.Scopes,
+		); err != nil {
+			return nil, err
+		}
+		client.AllowedSubdomains = allowedSubdomains.String
+		clients = append(clients, &client)
+	}
+	return clients, rows.Err()
+}
+
+// ImportClients inserts clients exported from another database as they are,
+// timestamps included, in one transaction. API tokens are stored unchanged,
+// so they authenticate exactly as they did in the source database. Clients
+// whose ID or token already exists are skipped.
+//
+// Parameters:
+//   - clients: The clients to insert
+//
+// Returns:
+//   - int: Number of clients inserted
+//   - error: Database error if any; nothing is inserted then
+func (r *Repository) ImportClients(clients []*Client) (int, error) {
+	return r.ImportClientsContext(context.Background(), clients)
+}
+
+// ImportClientsContext is ImportClients with a context that bounds the transaction.
+func (r *Repository) ImportClientsContext(ctx context.Context, clients []*Client) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Timestamps are stored in the format of CURRENT_TIMESTAMP.
+	timestamp := func(t time.Time) string {
+		if t.IsZero() {
+			t = time.Now()
+		}
+		return t.UTC().Format(sqliteTimeFormat)
+	}
+	imported := 0
+	for _, client := range clients {
+		result, err := tx.ExecContext(ctx, `
+			INSERT OR IGNORE INTO clients (id, name, api_token, max_tunnels, allowed_subdomains,
+				created_at, updated_at, status, monthly_byte_quota, scopes)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, client.ID, client.Name, client.APIToken, client.MaxTunnels, client.AllowedSubdomains,
+			timestamp(client.CreatedAt), timestamp(client.UpdatedAt), client.Status, client.MonthlyByteQuota, client.Scopes)
+		if err != nil {
+			return 0, fmt.Errorf("failed to import client %s: %w", client.ID, err)
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			imported++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return imported, nil
+}
+
+func (r *Repository) CreateTunnel(tunnel *Tunnel) error {
+	return r.CreateTunnelContext(context.Background(), tunnel)
+}
+
+// CreateTunnelContext is CreateTunnel with a context that bounds the insert.
+func (r *Repository) CreateTunnelContext(ctx context.Context, tunnel *Tunnel) error {
+	return r.guarded(ctx, func(ctx context.Context) error {
+		_, err := r.db.ExecContext(ctx, `
+			INSERT INTO tunnels (id, client_id, subdomain, protocol, local_port, public_port, public_url, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, tunnel.ID, tunnel.ClientID, tunnel.Subdomain, tunnel.Protocol, tunnel.LocalPort, tunnel.PublicPort, tunnel.PublicURL, tunnel.Status)
+		return err
+	})
+}
+
 func (r *Repository) GetTunnelBySubdomain(subdomain string) (*Tunnel, error) {
+	return r.GetTunnelBySubdomainContext(context.Background(), subdomain)
+}
+
+// GetTunnelBySubdomainContext is GetTunnelBySubdomain with a context that bounds the query.
+func (r *Repository) GetTunnelBySubdomainContext(ctx context.Context, subdomain string) (*Tunnel, error) {
 	var tunnel Tunnel
 	var closedAt sql.NullTime
-	err := r.db.QueryRow(`
-		SELECT id, client_id, subdomain, protocol, local_port, public_port, public_url, created_at, closed_at, status
-		FROM tunnels WHERE subdomain = ? AND status = 'active'
-	`, subdomain).Scan(
-		&tunnel.ID, &tunnel.ClientID, &tunnel.Subdomain, &tunnel.Protocol,
-		&tunnel.LocalPort, &tunnel.PublicPort, &tunnel.PublicURL,
-		&tunnel.CreatedAt, &closedAt, &tunnel.Status,
-	)
+	err := r.guarded(ctx, func(ctx context.Context) error {
+		return r.db.QueryRowContext(ctx, `
+			SELECT id, client_id, subdomain, protocol, local_port, public_port, public_url, created_at, closed_at, status
+			FROM tunnels WHERE subdomain = ? AND status = 'active'
+		`, subdomain).Scan(
+			&tunnel.ID, &tunnel.ClientID, &tunnel.Subdomain, &tunnel.Protocol,
+			&tunnel.LocalPort, &tunnel.PublicPort, &tunnel.PublicURL,
+			&tunnel.CreatedAt, &closedAt, &tunnel.Status,
+		)
+	})
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -189,21 +488,198 @@ func (r *Repository) GetTunnelBySubdomain(subdomain string) (*Tunnel, error) {
 }
 
 func (r *Repository) CloseTunnel(tunnelID string) error {
+	return r.CloseTunnelContext(context.Background(), tunnelID)
+}
+
+// CloseTunnelContext is CloseTunnel with a context that bounds the update.
+func (r *Repository) CloseTunnelContext(ctx context.Context, tunnelID string) error {
 	now := time.Now()
-	_, err := r.db.Exec(`
-		UPDATE tunnels SET status = 'closed', closed_at = ? WHERE id = ?
-	`, now, tunnelID)
-	return err
+	return r.guarded(ctx, func(ctx context.Context) error {
+		_, err := r.db.ExecContext(ctx, `
+			UPDATE tunnels SET status = 'closed', closed_at = ? WHERE id = ?
+		`, now, tunnelID)
+		return err
+	})
+}
+
+// GetLastPublicPort returns the public port of the most recent TCP or gRPC
+// tunnel a client opened for a subdomain, active or closed, so a reconnecting
+// client can get the same port back.
+//
+// Parameters:
+//   - clientID: Owner of the tunnel
+//   - subdomain: Subdomain of the tunnel
+//
+// Returns:
+//   - int: The port, or 0 if the client had no port for the subdomain
+//   - error: Database error if any
+func (r *Repository) GetLastPublicPort(clientID, subdomain string) (int, error) {
+	return r.GetLastPublicPortContext(context.Background(), clientID, subdomain)
+}
+
+// GetLastPublicPortContext is GetLastPublicPort with a context that bounds the query.
+func (r *Repository) GetLastPublicPortContext(ctx context.Context, clientID, subdomain string) (int, error) {
+	var port int
+	err := r.guarded(ctx, func(ctx context.Context) error {
+		return r.db.QueryRowContext(ctx, `
+			SELECT public_port FROM tunnels
+			WHERE client_id = ? AND subdomain = ? AND public_port > 0
+			ORDER BY created_at DESC, rowid DESC LIMIT 1
+		`, clientID, subdomain).Scan(&port)
+	})
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return port, err
 }
 
 func (r *Repository) GetActiveTunnelsByClient(clientID string) ([]*Tunnel, error) {
-	rows, err := r.db.Query(`
+	return r.GetActiveTunnelsByClientContext(context.Background(), clientID)
+}
+
+// GetActiveTunnelsByClientContext is GetActiveTunnelsByClient with a context that bounds the query.
+func (r *Repository) GetActiveTunnelsByClientContext(ctx context.Context, clientID string) ([]*Tunnel, error) {
+	rows, err := r.db.QueryContext(ctx, `
 		SELECT id, client_id, subdomain, protocol, local_port, public_port, public_url, created_at, closed_at, status
 		FROM tunnels WHERE client_id = ? AND status = 'active'
 	`, clientID)
 	if err != nil {
 		return nil, err
 	}
+	return scanTunnels(rows)
+}
+
+// ListTunnels returns tunnels in any state that match filter, newest first
+// unless filter.Ascending is set.
+//
+// Parameters:
+//   - filter: Optional client, status, protocol and creation-time filters plus pagination
+//
+// Returns:
+//   - []*Tunnel: The matching page of tunnels
+//   - error: Database error if any
+func (r *Repository) ListTunnels(filter TunnelFilter) ([]*Tunnel, error) {
+	return r.ListTunnelsContext(context.Background(), filter)
+}
+
+// ListTunnelsContext is ListTunnels with a context that bounds the query.
+func (r *Repository) ListTunnelsContext(ctx context.Context, filter TunnelFilter) ([]*Tunnel, error) {
+	query := `
+		SELECT id, client_id, subdomain, protocol, local_port, public_port, public_url, created_at, closed_at, status
+		FROM tunnels WHERE 1 = 1`
+	var args []interface{}
+	if filter.ClientID != "" {
+		query += " AND client_id = ?"
+		args = append(args, filter.ClientID)
+	}
+	if filter.Status != "" {
+		query += " AND status = ?"
+		args = append(args, filter.Status)
+	}
+	if filter.Protocol != "" {
+		query += " AND protocol = ?"
+		args = append(args, filter.Protocol)
+	}
+	// created_at is stored by SQLite as UTC "YYYY-MM-DD HH:MM:SS" text.
+	if !filter.CreatedAfter.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, filter.CreatedAfter.UTC().Format(sqliteTimeFormat))
+	}
+	if !filter.CreatedBefore.IsZero() {
+		query += " AND created_at < ?"
+		args = append(args, filter.CreatedBefore.UTC().Format(sqliteTimeFormat))
+	}
+
+	if filter.Ascending {
+		query += " ORDER BY created_at ASC, rowid ASC"
+	} else {
+		query += " ORDER BY created_at DESC, rowid DESC"
+	}
+	if filter.Limit > 0 || filter.Offset > 0 {
+		limit := filter.Limit
+		if limit <= 0 {
+			limit = -1 // SQLite: no limit
+		}
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, filter.Offset)
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanTunnels(rows)
+}
+
+// LogConnection records a request served through an HTTP tunnel, or a
+// connection to a TCP tunnel.
+//
+// Parameters:
+//   - entry: The request or connection to record; a zero CreatedAt means now
+//
+// Returns:
+//   - error: Database error if any
+func (r *Repository) LogConnection(entry *ConnectionLog) error {
+	return r.LogConnectionContext(context.Background(), entry)
+}
+
+// LogConnectionContext is LogConnection with a context that bounds the insert.
+func (r *Repository) LogConnectionContext(ctx context.Context, entry *ConnectionLog) error {
+	createdAt := entry.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO connection_logs (tunnel_id, client_ip, request_method, request_path, response_status,
+			bytes_sent, bytes_received, duration_ms, public_port, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, entry.TunnelID, entry.ClientIP, entry.RequestMethod, entry.RequestPath, entry.ResponseStatus,
+		entry.BytesSent, entry.BytesReceived, entry.DurationMs, entry.PublicPort, createdAt.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return err
+	}
+	entry.ID, _ = result.LastInsertId()
+	return nil
+}
+
+// GetClientUsage totals the connection logs of every tunnel a client has
+// owned since the given time, for billing and quotas.
+//
+// Parameters:
+//   - clientID: The client to aggregate
+//   - since: Start of the window (zero means all time)
+//
+// Returns:
+//   - *ClientUsage: Request count, byte totals and mean duration (zeros when nothing was logged)
+//   - error: Database error if any
+func (r *Repository) GetClientUsage(clientID string, since time.Time) (*ClientUsage, error) {
+	return r.GetClientUsageContext(context.Background(), clientID, since)
+}
+
+// GetClientUsageContext is GetClientUsage with a context that bounds the query.
+func (r *Repository) GetClientUsageContext(ctx context.Context, clientID string, since time.Time) (*ClientUsage, error) {
+	usage := &ClientUsage{ClientID: clientID, Since: since}
+	err := r.guarded(ctx, func(ctx context.Context) error {
+		return r.db.QueryRowContext(ctx, `
+			SELECT COUNT(l.id), COALESCE(SUM(l.bytes_sent), 0), COALESCE(SUM(l.bytes_received), 0),
+				COALESCE(AVG(l.duration_ms), 0)
+			FROM connection_logs l JOIN tunnels t ON t.id = l.tunnel_id
+			WHERE t.client_id = ? AND l.created_at >= ?
+		`, clientID, since.UTC().Format(sqliteTimeFormat)).Scan(
+			&usage.Requests, &usage.BytesSent, &usage.BytesReceived, &usage.AvgDurationMs,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// sqliteTimeFormat matches the text SQLite's CURRENT_TIMESTAMP produces.
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// scanTunnels reads every row of a tunnels query and closes rows.
+func scanTunnels(rows *sql.Rows) ([]*Tunnel, error) {
 	defer rows.Close()
 
 	var tunnels []*Tunnel
@@ -225,6 +701,17 @@ func (r *Repository) GetActiveTunnelsByClient(clientID string) ([]*Tunnel, error
 	return tunnels, rows.Err()
 }
 
+// PingContext checks that the database is reachable, for readiness probes.
+//
+// Parameters:
+//   - ctx: Context bounding the check
+//
+// Returns:
+//   - error: Error if the database cannot be reached
+func (r *Repository) PingContext(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
 func (r *Repository) Close() error {
 	return r.db.Close()
 }
@@ -0,0 +1,341 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRepository(t *testing.T) *Repository {
+	t.Helper()
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "tunnelab.db"))
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestCancelledContextAbortsQueries(t *testing.T) {
+	repo := newTestRepository(t)
+	client := &Client{ID: "client", Name: "demo", APIToken: "token", MaxTunnels: 5, Status: "active"}
+	if err := repo.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := repo.GetClientByTokenContext(ctx, "token"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetClientByTokenContext: expected context.Canceled, got %v", err)
+	}
+	if _, err := repo.GetTunnelBySubdomainContext(ctx, "app"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetTunnelBySubdomainContext: expected context.Canceled, got %v", err)
+	}
+	if _, err := repo.GetActiveTunnelsByClientContext(ctx, "client"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetActiveTunnelsByClientContext: expected context.Canceled, got %v", err)
+	}
+	tunnel := &Tunnel{ID: "tunnel", ClientID: "client", Subdomain: "app", Protocol: "http", LocalPort: 3000, Status: "active"}
+	if err := repo.CreateTunnelContext(ctx, tunnel); !errors.Is(err, context.Canceled) {
+		t.Fatalf("CreateTunnelContext: expected context.Canceled, got %v", err)
+	}
+	if err := repo.CreateClientContext(ctx, &Client{ID: "other", Name: "other", APIToken: "other", Status: "active"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("CreateClientContext: expected context.Canceled, got %v", err)
+	}
+
+	// Nothing was written, and the wrappers still work with no context.
+	if found, err := repo.GetTunnelBySubdomain("app"); err != nil || found != nil {
+		t.Fatalf("expected no tunnel after the cancelled insert, got %v, %v", found, err)
+	}
+	if found, err := repo.GetClientByToken("token"); err != nil || found == nil || found.ID != "client" {
+		t.Fatalf("expected the client to be found, got %v, %v", found, err)
+	}
+}
+
+func TestCancelledContextIsNotRetried(t *testing.T) {
+	repo := newTestRepository(t)
+	repo.SetBreaker(NewBreaker(BreakerConfig{FailureThreshold: 1}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := repo.GetClientByTokenContext(ctx, "token"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	// A caller giving up says nothing about the database, so the circuit stays closed.
+	if _, err := repo.GetClientByToken("token"); err != nil {
+		t.Fatalf("expected the circuit to stay closed, got %v", err)
+	}
+}
+
+func TestListTunnelsFiltersAndPaginates(t *testing.T) {
+	repo := newTestRepository(t)
+	for _, id := range []string{"alice", "bob"} {
+		if err := repo.CreateClient(&Client{ID: id, Name: id, APIToken: id + "-token", Status: "active"}); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	seed := []struct {
+		id, client, protocol string
+		closed               bool
+	}{
+		{"t1", "alice", "http", true},
+		{"t2", "alice", "tcp", false},
+		{"t3", "bob", "http", false},
+		{"t4", "alice", "http", false},
+		{"t5", "bob", "grpc", true},
+	}
+	for i, s := range seed {
+		tunnel := &Tunnel{ID: s.id, ClientID: s.client, Subdomain: s.id, Protocol: s.protocol, LocalPort: 3000, Status: "active"}
+		if err := repo.CreateTunnel(tunnel); err != nil {
+			t.Fatalf("failed to create tunnel: %v", err)
+		}
+		if s.closed {
+			if err := repo.CloseTunnel(s.id); err != nil {
+				t.Fatalf("failed to close tunnel: %v", err)
+			}
+		}
+		createdAt := base.Add(time.Duration(i) * time.Hour).Format(sqliteTimeFormat)
+		if _, err := repo.db.Exec(`UPDATE tunnels SET created_at = ? WHERE id = ?`, createdAt, s.id); err != nil {
+			t.Fatalf("failed to backdate tunnel: %v", err)
+		}
+	}
+
+	cases := []struct {
+		name   string
+		filter TunnelFilter
+		want   []string
+	}{
+		{"all, newest first", TunnelFilter{}, []string{"t5", "t4", "t3", "t2", "t1"}},
+		{"ascending", TunnelFilter{Ascending: true}, []string{"t1", "t2", "t3", "t4", "t5"}},
+		{"client", TunnelFilter{ClientID: "alice"}, []string{"t4", "t2", "t1"}},
+		{"closed", TunnelFilter{Status: "closed"}, []string{"t5", "t1"}},
+		{"protocol and status", TunnelFilter{Protocol: "http", Status: "active"}, []string{"t4", "t3"}},
+		{"time range", TunnelFilter{CreatedAfter: base.Add(time.Hour), CreatedBefore: base.Add(3 * time.Hour)}, []string{"t3", "t2"}},
+		{"first page", TunnelFilter{Limit: 2}, []string{"t5", "t4"}},
+		{"second page", TunnelFilter{Limit: 2, Offset: 2}, []string{"t3", "t2"}},
+		{"offset only", TunnelFilter{Offset: 3}, []string{"t2", "t1"}},
+		{"no match", TunnelFilter{ClientID: "carol"}, nil},
+	}
+	for _, tc := range cases {
+		tunnels, err := repo.ListTunnels(tc.filter)
+		if err != nil {
+			t.Fatalf("%s: ListTunnels failed: %v", tc.name, err)
+		}
+		var got []string
+		for _, tunnel := range tunnels {
+			got = append(got, tunnel.ID)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+
+	closed, err := repo.ListTunnels(TunnelFilter{ClientID: "alice", Status: "closed"})
+	if err != nil || len(closed) != 1 || closed[0].ClosedAt == nil {
+		t.Fatalf("expected closed tunnel with closed_at, got %v, %v", closed, err)
+	}
+}
+
+func TestGetClientUsageAggregatesConnectionLogs(t *testing.T) {
+	repo := newTestRepository(t)
+	for _, id := range []string{"alice", "bob"} {
+		if err := repo.CreateClient(&Client{ID: id, Name: id, APIToken: id + "-token", Status: "active"}); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+	for _, tunnel := range []*Tunnel{
+		{ID: "a1", ClientID: "alice", Subdomain: "a1", Protocol: "http", LocalPort: 3000, Status: "active"},
+		{ID: "a2", ClientID: "alice", Subdomain: "a2", Protocol: "http", LocalPort: 3001, Status: "active"},
+		{ID: "b1", ClientID: "bob", Subdomain: "b1", Protocol: "http", LocalPort: 3000, Status: "active"},
+	} {
+		if err := repo.CreateTunnel(tunnel); err != nil {
+			t.Fatalf("failed to create tunnel: %v", err)
+		}
+	}
+
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, entry := range []*ConnectionLog{
+		{TunnelID: "a1", BytesSent: 100, BytesReceived: 10, DurationMs: 20, CreatedAt: base},
+		{TunnelID: "a1", BytesSent: 200, BytesReceived: 20, DurationMs: 40, CreatedAt: base.Add(2 * time.Hour)},
+		{TunnelID: "a2", BytesSent: 300, BytesReceived: 30, DurationMs: 60, CreatedAt: base.Add(3 * time.Hour)},
+		{TunnelID: "b1", BytesSent: 999, BytesReceived: 99, DurationMs: 500, CreatedAt: base.Add(3 * time.Hour)},
+	} {
+		if err := repo.LogConnection(entry); err != nil {
+			t.Fatalf("failed to log connection: %v", err)
+		}
+	}
+
+	usage, err := repo.GetClientUsage("alice", time.Time{})
+	if err != nil {
+		t.Fatalf("failed to get usage: %v", err)
+	}
+	if usage.Requests != 3 || usage.BytesSent != 600 || usage.BytesReceived != 60 || usage.AvgDurationMs != 40 {
+		t.Fatalf("unexpected all-time usage: %+v", usage)
+	}
+
+	usage, err = repo.GetClientUsage("alice", base.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to get usage: %v", err)
+	}
+	if usage.Requests != 2 || usage.BytesSent != 500 || usage.BytesReceived != 50 || usage.AvgDurationMs != 50 {
+		t.Fatalf("unexpected windowed usage: %+v", usage)
+	}
+
+	usage, err = repo.GetClientUsage("carol", time.Time{})
+	if err != nil {
+		t.Fatalf("failed to get usage: %v", err)
+	}
+	if usage.Requests != 0 || usage.BytesSent != 0 || usage.AvgDurationMs != 0 {
+		t.Fatalf("expected empty usage for a client without logs, got %+v", usage)
+	}
+}
+
+func TestMigrateAddsMonthlyByteQuotaColumn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnelab.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE clients (id TEXT PRIMARY KEY, name TEXT NOT NULL, api_token TEXT NOT NULL UNIQUE,
+		max_tunnels INTEGER DEFAULT 5, allowed_subdomains TEXT, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, status TEXT DEFAULT 'active')`); err != nil {
+		t.Fatalf("failed to create old schema: %v", err)
+	}
+	db.Close()
+
+	repo, err := NewRepository(path)
+	if err != nil {
+		t.Fatalf("failed to migrate old schema: %v", err)
+	}
+	defer repo.Close()
+
+	if err := repo.CreateClient(&Client{ID: "client", Name: "demo", APIToken: "token", Status: "active", MonthlyByteQuota: 1 << 30}); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client, err := repo.GetClientByToken("token")
+	if err != nil || client == nil || client.MonthlyByteQuota != 1<<30 {
+		t.Fatalf("expected quota to round-trip, got %+v %v", client, err)
+	}
+	if client.Scopes != "" {
+		t.Fatalf("expected a migrated client to have every scope, got %q", client.Scopes)
+	}
+}
+
+func TestUpdateClientChangesOnlyGivenFields(t *testing.T) {
+	intPtr := func(v int) *int { return &v }
+	stringPtr := func(v string) *string { return &v }
+	int64Ptr := func(v int64) *int64 { return &v }
+
+	tests := map[string]struct {
+		update ClientUpdate
+		check  func(c *Client) bool
+	}{
+		"max_tunnels":        {ClientUpdate{MaxTunnels: intPtr(10)}, func(c *Client) bool { return c.MaxTunnels == 10 }},
+		"allowed_subdomains": {ClientUpdate{AllowedSubdomains: stringPtr("web,api")}, func(c *Client) bool { return c.AllowedSubdomains == "web,api" }},
+		"clear allowed":      {ClientUpdate{AllowedSubdomains: stringPtr("")}, func(c *Client) bool { return c.AllowedSubdomains == "" }},
+		"status":             {ClientUpdate{Status: stringPtr("inactive")}, func(c *Client) bool { return c.Status == "inactive" }},
+		"monthly_byte_quota": {ClientUpdate{MonthlyByteQuota: int64Ptr(-1)}, func(c *Client) bool { return c.MonthlyByteQuota == -1 }},
+		"scopes":             {ClientUpdate{Scopes: stringPtr("http,tcp")}, func(c *Client) bool { return c.Scopes == "http,tcp" }},
+		"nothing":            {ClientUpdate{}, func(c *Client) bool { return true }},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			repo := newTestRepository(t)
+			original := &Client{ID: "client", Name: "demo", APIToken: "token", MaxTunnels: 3, AllowedSubdomains: "app", Status: "active", MonthlyByteQuota: 1 << 20, Scopes: "http"}
+			if err := repo.CreateClient(original); err != nil {
+				t.Fatalf("failed to create client: %v", err)
+			}
+			if _, err := repo.db.Exec(`UPDATE clients SET updated_at = '2020-01-01 00:00:00'`); err != nil {
+				t.Fatalf("failed to age client: %v", err)
+			}
+
+			updated, err := repo.UpdateClient("client", tt.update)
+			if err != nil || updated == nil {
+				t.Fatalf("failed to update client: %v", err)
+			}
+			if !tt.check(updated) {
+				t.Fatalf("expected the update to apply, got %+v", updated)
+			}
+			if !updated.UpdatedAt.After(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+				t.Fatalf("expected updated_at to be bumped, got %v", updated.UpdatedAt)
+			}
+
+			// Fields not in the update keep their value.
+			if tt.update.MaxTunnels == nil && updated.MaxTunnels != original.MaxTunnels ||
+				tt.update.AllowedSubdomains == nil && updated.AllowedSubdomains != original.AllowedSubdomains ||
+				tt.update.Status == nil && updated.Status != original.Status ||
+				tt.update.MonthlyByteQuota == nil && updated.MonthlyByteQuota != original.MonthlyByteQuota ||
+				tt.update.Scopes == nil && updated.Scopes != original.Scopes ||
+				updated.Name != original.Name || updated.APIToken != original.APIToken {
+				t.Fatalf("expected other fields to be kept, got %+v", updated)
+			}
+			if stored, err := repo.GetClient("client"); err != nil || stored == nil || *stored != *updated {
+				t.Fatalf("expected the update to be stored, got %+v (%v)", stored, err)
+			}
+		})
+	}
+}
+
+func TestUpdateClientDeactivatesToken(t *testing.T) {
+	repo := newTestRepository(t)
+	if err := repo.CreateClient(&Client{ID: "client", Name: "demo", APIToken: "token", Status: "active"}); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	inactive := "inactive"
+	if _, err := repo.UpdateClient("client", ClientUpdate{Status: &inactive}); err != nil {
+		t.Fatalf("failed to update client: %v", err)
+	}
+	if client, err := repo.GetClientByToken("token"); err != nil || client != nil {
+		t.Fatalf("expected an inactive client not to authenticate, got %+v (%v)", client, err)
+	}
+}
+
+func TestUpdateClientMissing(t *testing.T) {
+	repo := newTestRepository(t)
+	maxTunnels := 10
+	client, err := repo.UpdateClient("missing", ClientUpdate{MaxTunnels: &maxTunnels})
+	if err != nil || client != nil {
+		t.Fatalf("expected nil, nil for a missing client, got %+v (%v)", client, err)
+	}
+	if client, err := repo.GetClient("missing"); err != nil || client != nil {
+		t.Fatalf("expected no client to be created, got %+v (%v)", client, err)
+	}
+}
+
+func TestLogConnectionRecordsTCPConnection(t *testing.T) {
+	repo := newTestRepository(t)
+	if err := repo.CreateClient(&Client{ID: "alice", Name: "alice", APIToken: "alice-token", Status: "active"}); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if err := repo.CreateTunnel(&Tunnel{ID: "db", ClientID: "alice", Subdomain: "db", Protocol: "tcp", LocalPort: 5432, Status: "active"}); err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	if err := repo.LogConnection(&ConnectionLog{
+		TunnelID: "db", ClientIP: "198.51.100.7", PublicPort: 30001,
+		BytesSent: 4096, BytesReceived: 120, DurationMs: 1500,
+	}); err != nil {
+		t.Fatalf("failed to log connection: %v", err)
+	}
+
+	var method, path, ip string
+	var status, port, duration int
+	var sent, received int64
+	err := repo.db.QueryRow(`SELECT client_ip, request_method, request_path, response_status, public_port,
+		bytes_sent, bytes_received, duration_ms FROM connection_logs WHERE tunnel_id = 'db'`).
+		Scan(&ip, &method, &path, &status, &port, &sent, &received, &duration)
+	if err != nil {
+		t.Fatalf("failed to read the log: %v", err)
+	}
+	if ip != "198.51.100.7" || method != "" || path != "" || status != 0 || port != 30001 {
+		t.Fatalf("unexpected log record: ip=%q method=%q path=%q status=%d port=%d", ip, method, path, status, port)
+	}
+	if sent != 4096 || received != 120 || duration != 1500 {
+		t.Fatalf("unexpected log counters: sent=%d received=%d duration=%d", sent, received, duration)
+	}
+}
@@ -0,0 +1,505 @@
+// Package admin provides the operator HTTP API of the TunneLab server.
+//
+// All endpoints require the admin token configured under admin.token, sent as
+// "Authorization: Bearer <token>".
+//
+// Endpoints:
+//   - POST /api/tunnels/{subdomain}/close: Force-close a tunnel
+//   - GET /api/tunnels/{subdomain}/members: Members of a tunnel's pool and their health
+//   - GET /api/clients: Tunnels and open streams of every client connected right now
+//   - GET /api/clients/{client_id}/usage: Aggregated request and byte usage of a client
+//   - PATCH /api/clients/{client_id}: Change a client's limits, scopes or status
+//   - GET /api/maintenance: Maintenance state of the proxy
+//   - PUT /api/maintenance: Turn maintenance of every tunnel on or off
+//   - PUT /api/tunnels/{subdomain}/maintenance: Turn maintenance of one tunnel on or off
+//   - GET /api/custom-domains: Registered custom domains
+//   - POST /api/custom-domains: Register a custom domain for a client's tunnel
+//   - GET /api/custom-domains/{hostname}: A custom domain and the TXT record proving its ownership
+//   - POST /api/custom-domains/{hostname}/verify: Check a custom domain's TXT record and start routing it
+//   - DELETE /api/custom-domains/{hostname}: Unregister a custom domain
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+	"github.com/essajiwa/tunnelab/internal/server/domains"
+	"github.com/essajiwa/tunnelab/internal/server/proxy"
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// TunnelCloser closes active tunnels on behalf of an operator.
+type TunnelCloser interface {
+	// ForceClose closes the tunnel for subdomain and notifies its client.
+	// It reports false when no such tunnel is active.
+	ForceClose(subdomain string) bool
+}
+
+// UsageSource aggregates per-client usage from the connection logs.
+type UsageSource interface {
+	GetClientUsage(clientID string, since time.Time) (*database.ClientUsage, error)
+}
+
+// ClientUpdater changes the limits and status of clients.
+type ClientUpdater interface {
+	// UpdateClientContext returns nil, nil when the client does not exist.
+	UpdateClientContext(ctx context.Context, id string, update database.ClientUpdate) (*database.Client, error)
+}
+
+// PoolHealthSource reports the members of a tunnel's pool and their health.
+type PoolHealthSource interface {
+	// PoolHealth returns nil when no tunnel is active for subdomain.
+	PoolHealth(subdomain string) []registry.MemberHealth
+}
+
+// ClientActivitySource reports the tunnels and streams clients have open.
+type ClientActivitySource interface {
+	ClientActivity() []registry.ClientActivity
+}
+
+// MaintenanceController turns the maintenance mode of the proxy on and off.
+type MaintenanceController interface {
+	SetGlobalMaintenance(enabled bool)
+	SetTunnelMaintenance(subdomain string, enabled bool)
+	Maintenance() proxy.MaintenanceStatus
+}
+
+// CustomDomainController registers and verifies custom domains.
+type CustomDomainController interface {
+	Add(ctx context.Context, hostname, clientID, subdomain string) (*database.CustomDomain, error)
+	Get(ctx context.Context, hostname string) (*database.CustomDomain, error)
+	Verify(ctx context.Context, hostname string) (*database.CustomDomain, error)
+	Remove(ctx context.Context, hostname string) error
+	List(ctx context.Context) ([]*database.CustomDomain, error)
+}
+
+// Handler serves the admin API.
+type Handler struct {
+	closer        TunnelCloser
+	usage         UsageSource
+	clients       ClientUpdater
+	pools         PoolHealthSource
+	activity      ClientActivitySource
+	maintenance   MaintenanceController
+	customDomains CustomDomainController
+	token         string
+	mux           *http.ServeMux
+}
+
+// NewHandler creates an admin API handler.
+//
+// Parameters:
+//   - closer: Used to close tunnels
+//   - token: Admin token required on every request; an empty token rejects all requests
+//
+// Returns:
+//   - *Handler: The admin API handler
+func NewHandler(closer TunnelCloser, token string) *Handler {
+	h := &Handler{
+		closer: closer,
+		token:  token,
+		mux:    http.NewServeMux(),
+	}
+	h.mux.HandleFunc("POST /api/tunnels/{subdomain}/close", h.handleCloseTunnel)
+	h.mux.HandleFunc("GET /api/tunnels/{subdomain}/members", h.handleTunnelMembers)
+	h.mux.HandleFunc("GET /api/clients", h.handleClients)
+	h.mux.HandleFunc("GET /api/clients/{client_id}/usage", h.handleClientUsage)
+	h.mux.HandleFunc("PATCH /api/clients/{client_id}", h.handleUpdateClient)
+	h.mux.HandleFunc("GET /api/maintenance", h.handleGetMaintenance)
+	h.mux.HandleFunc("PUT /api/maintenance", h.handleSetMaintenance)
+	h.mux.HandleFunc("PUT /api/tunnels/{subdomain}/maintenance", h.handleSetMaintenance)
+	h.mux.HandleFunc("GET /api/custom-domains", h.handleListCustomDomains)
+	h.mux.HandleFunc("POST /api/custom-domains", h.handleAddCustomDomain)
+	h.mux.HandleFunc("GET /api/custom-domains/{hostname}", h.handleGetCustomDomain)
+	h.mux.HandleFunc("POST /api/custom-domains/{hostname}/verify", h.handleVerifyCustomDomain)
+	h.mux.HandleFunc("DELETE /api/custom-domains/{hostname}", h.handleRemoveCustomDomain)
+	return h
+}
+
+// SetUsageSource enables the client usage endpoint.
+//
+// Parameters:
+//   - src: Source of aggregated usage, typically the database repository
+func (h *Handler) SetUsageSource(src UsageSource) {
+	h.usage = src
+}
+
+// SetClientUpdater enables the client update endpoint.
+//
+// Parameters:
+//   - updater: Where clients are stored, typically the database repository
+func (h *Handler) SetClientUpdater(updater ClientUpdater) {
+	h.clients = updater
+}
+
+// SetPoolHealthSource enables the tunnel members endpoint.
+//
+// Parameters:
+//   - src: Source of pool member health, typically the tunnel registry
+func (h *Handler) SetPoolHealthSource(src PoolHealthSource) {
+	h.pools = src
+}
+
+// SetClientActivitySource enables the client list endpoint.
+//
+// Parameters:
+//   - src: Source of per-client activity, typically the tunnel registry
+func (h *Handler) SetClientActivitySource(src ClientActivitySource) {
+	h.activity = src
+}
+
+// SetMaintenanceController enables the maintenance endpoints.
+//
+// Parameters:
+//   - ctrl: Maintenance mode to control, typically the HTTP proxy
+func (h *Handler) SetMaintenanceController(ctrl MaintenanceController) {
+	h.maintenance = ctrl
+}
+
+// SetCustomDomainController enables the custom domain endpoints.
+//
+// Parameters:
+//   - ctrl: Custom domains to manage, typically a domains.Manager
+func (h *Handler) SetCustomDomainController(ctrl CustomDomainController) {
+	h.customDomains = ctrl
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": "unauthorized"})
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	if h.token == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *Handler) handleCloseTunnel(w http.ResponseWriter, r *http.Request) {
+	subdomain := r.PathValue("subdomain")
+	if !h.closer.ForceClose(subdomain) {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "tunnel not found"})
+		return
+	}
+	log.Printf("Admin: closed tunnel %s", subdomain)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"subdomain": subdomain,
+		"status":    "closed",
+	})
+}
+
+// handleTunnelMembers lists the tunnels serving a subdomain with their
+// health; a tunnel that is not pooled is its only member.
+func (h *Handler) handleTunnelMembers(w http.ResponseWriter, r *http.Request) {
+	if h.pools == nil {
+		writeJSON(w, http.StatusNotImplemented, map[string]interface{}{"error": "pool health is not available"})
+		return
+	}
+	subdomain := r.PathValue("subdomain")
+	members := h.pools.PoolHealth(subdomain)
+	if members == nil {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "tunnel not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"subdomain": subdomain,
+		"members":   members,
+	})
+}
+
+// handleClients lists the clients with a tunnel on this node and what they
+// have open right now.
+func (h *Handler) handleClients(w http.ResponseWriter, r *http.Request) {
+	if h.activity == nil {
+		writeJSON(w, http.StatusNotImplemented, map[string]interface{}{"error": "client activity is not available"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"clients": h.activity.ClientActivity()})
+}
+
+// handleClientUsage reports a client's usage since the optional "since" query
+// parameter, given as an RFC 3339 time or a duration such as "24h".
+func (h *Handler) handleClientUsage(w http.ResponseWriter, r *http.Request) {
+	if h.usage == nil {
+		writeJSON(w, http.StatusNotImplemented, map[string]interface{}{"error": "usage reporting is not enabled"})
+		return
+	}
+
+	since, err := parseSince(r.URL.Query().Get("since"), time.Now())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	usage, err := h.usage.GetClientUsage(r.PathValue("client_id"), since)
+	if err != nil {
+		log.Printf("Admin: failed to get usage for client %s: %v", r.PathValue("client_id"), err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "failed to get usage"})
+		return
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// handleUpdateClient changes the fields of a client given in the body, any of
+// {"max_tunnels", "allowed_subdomains", "status", "monthly_byte_quota", "scopes"}, and
+// answers with the client as updated. The API token is never returned.
+func (h *Handler) handleUpdateClient(w http.ResponseWriter, r *http.Request) {
+	if h.clients == nil {
+		writeJSON(w, http.StatusNotImplemented, map[string]interface{}{"error": "client updates are not available"})
+		return
+	}
+	var body struct {
+		MaxTunnels        *int    `json:"max_tunnels"`
+		AllowedSubdomains *string `json:"allowed_subdomains"`
+		Status            *string `json:"status"`
+		MonthlyByteQuota  *int64  `json:"monthly_byte_quota"`
+		Scopes            *string `json:"scopes"`
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid body: " + err.Error()})
+		return
+	}
+	if body.MaxTunnels != nil && *body.MaxTunnels < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "max_tunnels must not be negative (0 means unlimited)"})
+		return
+	}
+	if body.Status != nil && *body.Status != "active" && *body.Status != "inactive" {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": `status must be "active" or "inactive"`})
+		return
+	}
+	if body.Scopes != nil {
+		if err := auth.ValidateScopes(*body.Scopes); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+			return
+		}
+	}
+
+	clientID := r.PathValue("client_id")
+	client, err := h.clients.UpdateClientContext(r.Context(), clientID, database.ClientUpdate{
+		MaxTunnels:        body.MaxTunnels,
+		AllowedSubdomains: body.AllowedSubdomains,
+		Status:            body.Status,
+		MonthlyByteQuota:  body.MonthlyByteQuota,
+		Scopes:            body.Scopes,
+	})
+	if err != nil {
+		log.Printf("Admin: failed to update client %s: %v", clientID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "failed to update client"})
+		return
+	}
+	if client == nil {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "client not found"})
+		return
+	}
+	log.Printf("Admin: updated client %s", clientID)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"client_id":          client.ID,
+		"name":               client.Name,
+		"max_tunnels":        client.MaxTunnels,
+		"allowed_subdomains": client.AllowedSubdomains,
+		"status":             client.Status,
+		"monthly_byte_quota": client.MonthlyByteQuota,
+		"scopes":             client.Scopes,
+		"updated_at":         client.UpdatedAt,
+	})
+}
+
+func (h *Handler) handleGetMaintenance(w http.ResponseWriter, r *http.Request) {
+	if h.maintenance == nil {
+		writeJSON(w, http.StatusNotImplemented, map[string]interface{}{"error": "maintenance mode is not available"})
+		return
+	}
+	writeJSON(w, http.StatusOK, h.maintenance.Maintenance())
+}
+
+// handleSetMaintenance turns maintenance on or off as given by the
+// {"enabled": bool} body, for one tunnel when the path names a subdomain and
+// for every tunnel otherwise. It answers with the resulting state.
+func (h *Handler) handleSetMaintenance(w http.ResponseWriter, r *http.Request) {
+	if h.maintenance == nil {
+		writeJSON(w, http.StatusNotImplemented, map[string]interface{}{"error": "maintenance mode is not available"})
+		return
+	}
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&body); err != nil || body.Enabled == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": `expected a body of {"enabled": true|false}`})
+		return
+	}
+
+	if subdomain := r.PathValue("subdomain"); subdomain != "" {
+		h.maintenance.SetTunnelMaintenance(subdomain, *body.Enabled)
+		log.Printf("Admin: maintenance of tunnel %s set to %t", subdomain, *body.Enabled)
+	} else {
+		h.maintenance.SetGlobalMaintenance(*body.Enabled)
+		log.Printf("Admin: global maintenance set to %t", *body.Enabled)
+	}
+	writeJSON(w, http.StatusOK, h.maintenance.Maintenance())
+}
+
+// customDomainResponse is a custom domain as the API returns it: pending
+// domains carry the TXT record their owner must publish.
+type customDomainResponse struct {
+	*database.CustomDomain
+	TXTRecord *domains.TXTRecord `json:"txt_record,omitempty"`
+}
+
+func newCustomDomainResponse(domain *database.CustomDomain) customDomainResponse {
+	resp := customDomainResponse{CustomDomain: domain}
+	if !domain.Verified {
+		record := domains.Challenge(domain)
+		resp.TXTRecord = &record
+	}
+	return resp
+}
+
+func (h *Handler) handleListCustomDomains(w http.ResponseWriter, r *http.Request) {
+	if h.customDomains == nil {
+		writeCustomDomainsDisabled(w)
+		return
+	}
+	list, err := h.customDomains.List(r.Context())
+	if err != nil {
+		writeCustomDomainError(w, "list custom domains", err)
+		return
+	}
+	resp := make([]customDomainResponse, 0, len(list))
+	for _, domain := range list {
+		resp = append(resp, newCustomDomainResponse(domain))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"custom_domains": resp})
+}
+
+func (h *Handler) handleGetCustomDomain(w http.ResponseWriter, r *http.Request) {
+	if h.customDomains == nil {
+		writeCustomDomainsDisabled(w)
+		return
+	}
+	domain, err := h.customDomains.Get(r.Context(), r.PathValue("hostname"))
+	if err != nil {
+		writeCustomDomainError(w, "get custom domain "+r.PathValue("hostname"), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newCustomDomainResponse(domain))
+}
+
+// handleAddCustomDomain registers the pending custom domain given by the
+// {"hostname", "client_id", "subdomain"} body and answers with the TXT record
+// that will verify it.
+func (h *Handler) handleAddCustomDomain(w http.ResponseWriter, r *http.Request) {
+	if h.customDomains == nil {
+		writeCustomDomainsDisabled(w)
+		return
+	}
+	var body struct {
+		Hostname  string `json:"hostname"`
+		ClientID  string `json:"client_id"`
+		Subdomain string `json:"subdomain"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": `expected a body of {"hostname", "client_id", "subdomain"}`})
+		return
+	}
+	domain, err := h.customDomains.Add(r.Context(), body.Hostname, body.ClientID, body.Subdomain)
+	if err != nil {
+		writeCustomDomainError(w, "add custom domain "+body.Hostname, err)
+		return
+	}
+	log.Printf("Admin: added custom domain %s for %s of client %s", domain.Hostname, domain.Subdomain, domain.ClientID)
+	writeJSON(w, http.StatusCreated, newCustomDomainResponse(domain))
+}
+
+// handleVerifyCustomDomain checks the TXT record of a custom domain and, when
+// it holds the domain's verification token, starts routing it.
+func (h *Handler) handleVerifyCustomDomain(w http.ResponseWriter, r *http.Request) {
+	if h.customDomains == nil {
+		writeCustomDomainsDisabled(w)
+		return
+	}
+	domain, err := h.customDomains.Verify(r.Context(), r.PathValue("hostname"))
+	if err != nil {
+		writeCustomDomainError(w, "verify custom domain "+r.PathValue("hostname"), err)
+		return
+	}
+	log.Printf("Admin: verified custom domain %s", domain.Hostname)
+	writeJSON(w, http.StatusOK, newCustomDomainResponse(domain))
+}
+
+func (h *Handler) handleRemoveCustomDomain(w http.ResponseWriter, r *http.Request) {
+	if h.customDomains == nil {
+		writeCustomDomainsDisabled(w)
+		return
+	}
+	hostname := r.PathValue("hostname")
+	if err := h.customDomains.Remove(r.Context(), hostname); err != nil {
+		writeCustomDomainError(w, "remove custom domain "+hostname, err)
+		return
+	}
+	log.Printf("Admin: removed custom domain %s", hostname)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"hostname": hostname,
+		"status":   "removed",
+	})
+}
+
+func writeCustomDomainsDisabled(w http.ResponseWriter) {
+	writeJSON(w, http.StatusNotImplemented, map[string]interface{}{"error": "custom domains are not enabled"})
+}
+
+// writeCustomDomainError answers with the status matching err; errors other
+// than the domains sentinels are logged and hidden from the caller.
+func writeCustomDomainError(w http.ResponseWriter, action string, err error) {
+	switch {
+	case errors.Is(err, domains.ErrInvalidHostname):
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+	case errors.Is(err, domains.ErrExists):
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"error": err.Error()})
+	case errors.Is(err, domains.ErrNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": err.Error()})
+	case errors.Is(err, domains.ErrNotVerified):
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{"error": err.Error()})
+	case errors.Is(err, domains.ErrScopeDenied):
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"error": err.Error()})
+	default:
+		log.Printf("Admin: failed to %s: %v", action, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "failed to " + action})
+	}
+}
+
+// parseSince parses a "since" value relative to now. An empty value means all time.
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid since %q: expected an RFC 3339 time or a positive duration", value)
+	}
+	return now.Add(-d), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
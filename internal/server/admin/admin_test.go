@@ -0,0 +1,482 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+	"github.com/essajiwa/tunnelab/internal/server/domains"
+	"github.com/essajiwa/tunnelab/internal/server/proxy"
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+type fakeCloser struct {
+	active map[string]bool
+	closed []string
+}
+
+func (f *fakeCloser) ForceClose(subdomain string) bool {
+	if !f.active[subdomain] {
+		return false
+	}
+	delete(f.active, subdomain)
+	f.closed = append(f.closed, subdomain)
+	return true
+}
+
+func doClose(h http.Handler, subdomain, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/tunnels/"+subdomain+"/close", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCloseTunnel(t *testing.T) {
+	closer := &fakeCloser{active: map[string]bool{"demo": true}}
+	h := NewHandler(closer, "secret")
+
+	rec := doClose(h, "demo", "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(closer.closed) != 1 || closer.closed[0] != "demo" {
+		t.Fatalf("expected demo to be closed, got %v", closer.closed)
+	}
+
+	if rec := doClose(h, "demo", "secret"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a closed tunnel, got %d", rec.Code)
+	}
+}
+
+func TestCloseTunnelRequiresAdminToken(t *testing.T) {
+	closer := &fakeCloser{active: map[string]bool{"demo": true}}
+
+	for _, tc := range []struct {
+		configured string
+		sent       string
+	}{
+		{"secret", ""},
+		{"secret", "wrong"},
+		{"", ""},
+	} {
+		h := NewHandler(closer, tc.configured)
+		if rec := doClose(h, "demo", tc.sent); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("token %q/%q: expected 401, got %d", tc.configured, tc.sent, rec.Code)
+		}
+	}
+	if len(closer.closed) != 0 {
+		t.Fatalf("unauthorized requests must not close tunnels, closed %v", closer.closed)
+	}
+}
+
+func TestCloseTunnelRequiresPost(t *testing.T) {
+	h := NewHandler(&fakeCloser{}, "secret")
+	req := httptest.NewRequest(http.MethodGet, "/api/tunnels/demo/close", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", rec.Code)
+	}
+}
+
+type fakeUsage struct {
+	clientID string
+	since    time.Time
+}
+
+func (f *fakeUsage) GetClientUsage(clientID string, since time.Time) (*database.ClientUsage, error) {
+	f.clientID, f.since = clientID, since
+	return &database.ClientUsage{ClientID: clientID, Since: since, Requests: 7, BytesSent: 700}, nil
+}
+
+func TestClientUsage(t *testing.T) {
+	usage := &fakeUsage{}
+	h := NewHandler(&fakeCloser{}, "secret")
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/clients/alice/usage"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get(""); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501 without a usage source, got %d", rec.Code)
+	}
+
+	h.SetUsageSource(usage)
+	rec := get("?since=2026-01-01T00:00:00Z")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var body database.ClientUsage
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode usage: %v", err)
+	}
+	if body.ClientID != "alice" || body.Requests != 7 || body.BytesSent != 700 {
+		t.Fatalf("unexpected usage body: %+v", body)
+	}
+	if !usage.since.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected since to be passed through, got %v", usage.since)
+	}
+
+	if rec := get("?since=24h"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a duration, got %d", rec.Code)
+	}
+	if age := time.Since(usage.since); age < 24*time.Hour || age > 25*time.Hour {
+		t.Fatalf("expected since to be 24h ago, got %v", usage.since)
+	}
+
+	if rec := get("?since=yesterday"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid since, got %d", rec.Code)
+	}
+}
+
+func TestUpdateClient(t *testing.T) {
+	repo, err := database.NewRepository(filepath.Join(t.TempDir(), "tunnelab.db"))
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+	if err := repo.CreateClient(&database.Client{ID: "alice", Name: "Alice", APIToken: "tok-alice", MaxTunnels: 3, Status: "active"}); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	h := NewHandler(&fakeCloser{}, "secret")
+
+	patch := func(clientID, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/clients/"+clientID, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := patch("alice", `{"max_tunnels": 10}`); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501 without a client updater, got %d", rec.Code)
+	}
+	h.SetClientUpdater(repo)
+
+	rec := patch("alice", `{"max_tunnels": 10, "status": "inactive"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "tok-alice") {
+		t.Fatalf("expected the API token not to be returned, got %s", rec.Body.String())
+	}
+	client, _ := repo.GetClient("alice")
+	if client.MaxTunnels != 10 || client.Status != "inactive" || client.Name != "Alice" {
+		t.Fatalf("expected the update to be stored, got %+v", client)
+	}
+
+	tests := map[string]struct {
+		clientID, body string
+		wantStatus     int
+	}{
+		"missing client":   {"bob", `{"max_tunnels": 10}`, http.StatusNotFound},
+		"unknown field":    {"alice", `{"max_tunels": 10}`, http.StatusBadRequest},
+		"negative limit":   {"alice", `{"max_tunnels": -1}`, http.StatusBadRequest},
+		"unknown status":   {"alice", `{"status": "suspended"}`, http.StatusBadRequest},
+		"not json":         {"alice", `max_tunnels=10`, http.StatusBadRequest},
+		"clear subdomains": {"alice", `{"allowed_subdomains": ""}`, http.StatusOK},
+		"unknown scope":    {"alice", `{"scopes": "http,admin"}`, http.StatusBadRequest},
+		"set scopes":       {"alice", `{"scopes": "http,tcp"}`, http.StatusOK},
+	}
+	for name, tt := range tests {
+		if rec := patch(tt.clientID, tt.body); rec.Code != tt.wantStatus {
+			t.Fatalf("%s: expected %d, got %d: %s", name, tt.wantStatus, rec.Code, rec.Body.String())
+		}
+	}
+	if client, _ := repo.GetClient("alice"); client.Scopes != "http,tcp" {
+		t.Fatalf("expected the scopes to be stored, got %q", client.Scopes)
+	}
+}
+
+type fakePools map[string][]registry.MemberHealth
+
+func (f fakePools) PoolHealth(subdomain string) []registry.MemberHealth {
+	return f[subdomain]
+}
+
+func TestTunnelMembers(t *testing.T) {
+	h := NewHandler(&fakeCloser{}, "secret")
+	get := func(subdomain string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/tunnels/"+subdomain+"/members", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("app"); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501 without a pool health source, got %d", rec.Code)
+	}
+
+	h.SetPoolHealthSource(fakePools{"app": {
+		{LocalPort: 3000, Weight: 1, Connected: true, Healthy: true},
+		{LocalPort: 3001, Weight: 2, Connected: true, Failures: 3, LastError: "probe returned status 503"},
+	}})
+	rec := get("app")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Subdomain string                  `json:"subdomain"`
+		Members   []registry.MemberHealth `json:"members"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode members: %v", err)
+	}
+	if body.Subdomain != "app" || len(body.Members) != 2 || !body.Members[0].Healthy || body.Members[1].Healthy || body.Members[1].Failures != 3 {
+		t.Fatalf("unexpected members body: %+v", body)
+	}
+
+	if rec := get("missing"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown tunnel, got %d", rec.Code)
+	}
+}
+
+func TestClients(t *testing.T) {
+	h := NewHandler(&fakeCloser{}, "secret")
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/clients", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get(); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501 without a client activity source, got %d", rec.Code)
+	}
+
+	reg := registry.NewRegistry()
+	for _, tunnel := range []*registry.TunnelInfo{
+		{ID: "t1", ClientID: "alice", Subdomain: "web", Protocol: "http"},
+		{ID: "t2", ClientID: "alice", Subdomain: "api", Protocol: "http"},
+		{ID: "t3", ClientID: "bob", Subdomain: "app", Protocol: "http"},
+	} {
+		if err := reg.Register(tunnel); err != nil {
+			t.Fatalf("failed to register tunnel: %v", err)
+		}
+	}
+	h.SetClientActivitySource(reg)
+
+	rec := get()
+	var body struct {
+		Clients []registry.ClientActivity `json:"clients"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("expected the client list, got %d (%v)", rec.Code, err)
+	}
+	if len(body.Clients) != 2 || body.Clients[0].ClientID != "alice" || body.Clients[0].Tunnels != 2 || body.Clients[1].Tunnels != 1 {
+		t.Fatalf("unexpected clients body: %+v", body)
+	}
+}
+
+type fakeMaintenance struct {
+	global  bool
+	tunnels map[string]bool
+}
+
+func (f *fakeMaintenance) SetGlobalMaintenance(enabled bool) { f.global = enabled }
+
+func (f *fakeMaintenance) SetTunnelMaintenance(subdomain string, enabled bool) {
+	f.tunnels[subdomain] = enabled
+}
+
+func (f *fakeMaintenance) Maintenance() proxy.MaintenanceStatus {
+	status := proxy.MaintenanceStatus{Global: f.global, Tunnels: []string{}}
+	for subdomain, enabled := range f.tunnels {
+		if enabled {
+			status.Tunnels = append(status.Tunnels, subdomain)
+		}
+	}
+	return status
+}
+
+func TestMaintenanceEndpoints(t *testing.T) {
+	maint := &fakeMaintenance{tunnels: map[string]bool{}}
+	h := NewHandler(&fakeCloser{}, "secret")
+	h.SetMaintenanceController(maint)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPut, "/api/tunnels/demo/maintenance", `{"enabled": true}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !maint.tunnels["demo"] || maint.global {
+		t.Fatalf("expected only demo to be in maintenance, got %+v", maint)
+	}
+	if rec := do(http.MethodPut, "/api/maintenance", `{"enabled": true}`); rec.Code != http.StatusOK || !maint.global {
+		t.Fatalf("expected global maintenance to be enabled, got %d", rec.Code)
+	}
+
+	rec := do(http.MethodGet, "/api/maintenance", "")
+	var status proxy.MaintenanceStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("expected the maintenance status, got %d %q", rec.Code, rec.Body.String())
+	}
+	if !status.Global || len(status.Tunnels) != 1 || status.Tunnels[0] != "demo" {
+		t.Fatalf("unexpected maintenance status: %+v", status)
+	}
+
+	for _, body := range []string{"", "{}", `{"enabled": "yes"}`} {
+		if rec := do(http.MethodPut, "/api/maintenance", body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("body %q: expected 400, got %d", body, rec.Code)
+		}
+	}
+	if !maint.global {
+		t.Fatal("expected invalid requests to leave maintenance unchanged")
+	}
+}
+
+func TestMaintenanceEndpointsWithoutController(t *testing.T) {
+	h := NewHandler(&fakeCloser{}, "secret")
+	req := httptest.NewRequest(http.MethodGet, "/api/maintenance", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501, got %d", rec.Code)
+	}
+}
+
+// fakeCustomDomains verifies the hostnames of its published set.
+type fakeCustomDomains struct {
+	domains   map[string]*database.CustomDomain
+	published map[string]bool
+}
+
+func (f *fakeCustomDomains) Add(ctx context.Context, hostname, clientID, subdomain string) (*database.CustomDomain, error) {
+	if !strings.Contains(hostname, ".") {
+		return nil, domains.ErrInvalidHostname
+	}
+	if f.domains[hostname] != nil {
+		return nil, domains.ErrExists
+	}
+	f.domains[hostname] = &database.CustomDomain{Hostname: hostname, ClientID: clientID, Subdomain: subdomain, VerificationToken: "token"}
+	return f.domains[hostname], nil
+}
+
+func (f *fakeCustomDomains) Get(ctx context.Context, hostname string) (*database.CustomDomain, error) {
+	if f.domains[hostname] == nil {
+		return nil, domains.ErrNotFound
+	}
+	return f.domains[hostname], nil
+}
+
+func (f *fakeCustomDomains) Verify(ctx context.Context, hostname string) (*database.CustomDomain, error) {
+	domain := f.domains[hostname]
+	if domain == nil {
+		return nil, domains.ErrNotFound
+	}
+	if !f.published[hostname] {
+		return nil, domains.ErrNotVerified
+	}
+	domain.Verified = true
+	return domain, nil
+}
+
+func (f *fakeCustomDomains) Remove(ctx context.Context, hostname string) error {
+	if f.domains[hostname] == nil {
+		return domains.ErrNotFound
+	}
+	delete(f.domains, hostname)
+	return nil
+}
+
+func (f *fakeCustomDomains) List(ctx context.Context) ([]*database.CustomDomain, error) {
+	var list []*database.CustomDomain
+	for _, domain := range f.domains {
+		list = append(list, domain)
+	}
+	return list, nil
+}
+
+func TestCustomDomainEndpoints(t *testing.T) {
+	ctrl := &fakeCustomDomains{domains: map[string]*database.CustomDomain{}, published: map[string]bool{"app.example.org": true}}
+	h := NewHandler(&fakeCloser{}, "secret")
+	h.SetCustomDomainController(ctrl)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		method, path, body string
+		wantStatus         int
+	}{
+		{http.MethodPost, "/api/custom-domains", `{"hostname": "app.example.org", "client_id": "alice", "subdomain": "app"}`, http.StatusCreated},
+		{http.MethodPost, "/api/custom-domains", `{"hostname": "app.example.org", "client_id": "bob", "subdomain": "app"}`, http.StatusConflict},
+		{http.MethodPost, "/api/custom-domains", `{"hostname": "localhost", "client_id": "alice", "subdomain": "app"}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/custom-domains", `not json`, http.StatusBadRequest},
+		{http.MethodPost, "/api/custom-domains", `{"hostname": "wrong.example.org", "client_id": "alice", "subdomain": "app"}`, http.StatusCreated},
+		{http.MethodPost, "/api/custom-domains/wrong.example.org/verify", "", http.StatusUnprocessableEntity},
+		{http.MethodPost, "/api/custom-domains/missing.example.org/verify", "", http.StatusNotFound},
+		{http.MethodPost, "/api/custom-domains/app.example.org/verify", "", http.StatusOK},
+		{http.MethodDelete, "/api/custom-domains/wrong.example.org", "", http.StatusOK},
+		{http.MethodDelete, "/api/custom-domains/wrong.example.org", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := do(tt.method, tt.path, tt.body); rec.Code != tt.wantStatus {
+			t.Fatalf("%s %s %s: expected %d, got %d: %s", tt.method, tt.path, tt.body, tt.wantStatus, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := do(http.MethodPost, "/api/custom-domains", `{"hostname": "pending.example.org", "client_id": "alice", "subdomain": "app"}`)
+	var pending struct {
+		Hostname  string            `json:"hostname"`
+		TXTRecord domains.TXTRecord `json:"txt_record"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &pending); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("expected the pending domain, got %d %q", rec.Code, rec.Body.String())
+	}
+	want := domains.TXTRecord{Name: "_tunnelab-challenge.pending.example.org", Value: "tunnelab-verification=token"}
+	if pending.Hostname != "pending.example.org" || pending.TXTRecord != want {
+		t.Fatalf("expected the TXT record %+v, got %+v", want, pending)
+	}
+	if rec := do(http.MethodGet, "/api/custom-domains/pending.example.org", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), want.Value) {
+		t.Fatalf("expected the TXT record of the pending domain, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodGet, "/api/custom-domains/app.example.org", ""); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "txt_record") {
+		t.Fatalf("expected no TXT record for a verified domain, got %d %q", rec.Code, rec.Body.String())
+	}
+	do(http.MethodDelete, "/api/custom-domains/pending.example.org", "")
+
+	rec = do(http.MethodGet, "/api/custom-domains", "")
+	var body struct {
+		CustomDomains []database.CustomDomain `json:"custom_domains"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("expected the custom domain list, got %d %q", rec.Code, rec.Body.String())
+	}
+	if len(body.CustomDomains) != 1 || body.CustomDomains[0].Hostname != "app.example.org" || !body.CustomDomains[0].Verified {
+		t.Fatalf("expected app.example.org to be verified, got %+v", body.CustomDomains)
+	}
+
+	h = NewHandler(&fakeCloser{}, "secret")
+	if rec := do(http.MethodGet, "/api/custom-domains", ""); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501 without a controller, got %d", rec.Code)
+	}
+}
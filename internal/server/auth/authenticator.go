@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+)
+
+// ErrInvalidToken is returned by an Authenticator when a token is unknown,
+// malformed, expired or otherwise rejected.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Identity describes an authenticated client and the limits that apply to it.
+type Identity struct {
+	ClientID          string   // Unique client identifier
+	MaxTunnels        int      // Maximum concurrent tunnels (0 means unlimited)
+	AllowedSubdomains []string // Allowed subdomain patterns (empty means any)
+	MonthlyByteQuota  int64    // Monthly byte quota (0 means the server default, negative means unlimited)
+	Scopes            []string // Protocols and features the client may use (empty means all)
+}
+
+// AllowsSubdomain reports whether the identity may claim the given subdomain.
+//
+// Entries in AllowedSubdomains are matched with path.Match, so patterns such
+// as "dev-*" are supported. An empty list or a "*" entry allows any subdomain.
+func (i *Identity) AllowsSubdomain(subdomain string) bool {
+	if len(i.AllowedSubdomains) == 0 {
+		return true
+	}
+	for _, pattern := range i.AllowedSubdomains {
+		if pattern == "*" || pattern == subdomain {
+			return true
+		}
+		if ok, err := path.Match(pattern, subdomain); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator validates client tokens and resolves them to an Identity.
+type Authenticator interface {
+	Authenticate(token string) (*Identity, error)
+}
+
+// ContextAuthenticator is implemented by authenticators whose lookups can be
+// cancelled or time-limited, such as database-backed ones.
+type ContextAuthenticator interface {
+	AuthenticateContext(ctx context.Context, token string) (*Identity, error)
+}
+
+// AuthenticateContext authenticates token with ctx when a supports it, and
+// falls back to the plain Authenticate otherwise.
+//
+// Parameters:
+//   - ctx: Context bounding the lookup
+//   - a: The authenticator to use
+//   - token: The token presented by the client
+//
+// Returns:
+//   - *Identity: The client identity
+//   - error: ErrInvalidToken, a lookup error, or the context's error
+func AuthenticateContext(ctx context.Context, a Authenticator, token string) (*Identity, error) {
+	if ca, ok := a.(ContextAuthenticator); ok {
+		return ca.AuthenticateContext(ctx, token)
+	}
+	return a.Authenticate(token)
+}
+
+// RepositoryAuthenticator authenticates opaque tokens stored in the database.
+type RepositoryAuthenticator struct {
+	repo *database.Repository
+}
+
+// NewRepositoryAuthenticator creates an Authenticator backed by the clients table.
+func NewRepositoryAuthenticator(repo *database.Repository) *RepositoryAuthenticator {
+	return &RepositoryAuthenticator{repo: repo}
+}
+
+// Authenticate looks the token up in the database.
+//
+// Returns:
+//   - *Identity: The client identity if the token belongs to an active client
+//   - error: ErrInvalidToken if the token is unknown, or a database error
+func (a *RepositoryAuthenticator) Authenticate(token string) (*Identity, error) {
+	return a.AuthenticateContext(context.Background(), token)
+}
+
+// AuthenticateContext is Authenticate with a context that bounds the lookup.
+func (a *RepositoryAuthenticator) AuthenticateContext(ctx context.Context, token string) (*Identity, error) {
+	client, err := a.repo.GetClientByTokenContext(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, ErrInvalidToken
+	}
+	return &Identity{
+		ClientID:          client.ID,
+		MaxTunnels:        client.MaxTunnels,
+		AllowedSubdomains: splitList(client.AllowedSubdomains),
+		MonthlyByteQuota:  client.MonthlyByteQuota,
+		Scopes:            ParseScopes(client.Scopes),
+	}, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,394 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// JWTConfig contains configuration for the JWT authenticator.
+type JWTConfig struct {
+	Secret   string        // Shared secret for HS256/HS384/HS512 tokens
+	JWKS     string        // Path or URL of a JWKS document for RS*/ES* tokens
+	Issuer   string        // Expected "iss" claim (optional)
+	Audience string        // Expected "aud" claim (optional)
+	Leeway   time.Duration // Allowed clock skew when checking exp/nbf
+}
+
+// JWTAuthenticator validates signed JWTs and derives the client identity from
+// their claims, without a database lookup.
+//
+// Supported claims:
+//   - sub or client_id: Client identifier (required)
+//   - exp: Expiry time (required)
+//   - nbf: Not-before time (optional)
+//   - iss, aud: Checked against the configured issuer/audience when set
+//   - max_tunnels: Maximum concurrent tunnels
+//   - allowed_subdomains: Array or comma-separated list of subdomain patterns
+//   - scopes: Array or comma-separated list of scopes (all when absent)
+type JWTAuthenticator struct {
+	secret   []byte
+	keys     map[string]crypto.PublicKey
+	issuer   string
+	audience string
+	leeway   time.Duration
+	now      func() time.Time
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject           string     `json:"sub"`
+	ClientID          string     `json:"client_id"`
+	Issuer            string     `json:"iss"`
+	Audience          stringList `json:"aud"`
+	ExpiresAt         *float64   `json:"exp"`
+	NotBefore         *float64   `json:"nbf"`
+	MaxTunnels        int        `json:"max_tunnels"`
+	AllowedSubdomains stringList `json:"allowed_subdomains"`
+	Scopes            stringList `json:"scopes"`
+}
+
+// stringList accepts either a JSON array of strings or a single string
+// (comma-separated for allowed_subdomains and scopes).
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = splitList(single)
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*l = many
+	return nil
+}
+
+// NewJWTAuthenticator creates a JWT authenticator.
+//
+// At least one of Secret or JWKS must be set. A JWKS given as an http(s) URL
+// is fetched once at startup.
+//
+// Parameters:
+//   - cfg: JWT authenticator configuration
+//
+// Returns:
+//   - *JWTAuthenticator: Authenticator ready to validate tokens
+//   - error: Error if no key material is configured or the JWKS cannot be loaded
+func NewJWTAuthenticator(cfg JWTConfig) (*JWTAuthenticator, error) {
+	if cfg.Secret == "" && cfg.JWKS == "" {
+		return nil, fmt.Errorf("jwt authentication requires a secret or a JWKS")
+	}
+
+	a := &JWTAuthenticator{
+		secret:   []byte(cfg.Secret),
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+		leeway:   cfg.Leeway,
+		now:      time.Now,
+	}
+
+	if cfg.JWKS != "" {
+		keys, err := loadJWKS(cfg.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		a.keys = keys
+	}
+
+	return a, nil
+}
+
+// Authenticate validates the token signature and registered claims and returns
+// the identity encoded in it.
+//
+// Returns:
+//   - *Identity: The client identity derived from the claims
+//   - error: ErrInvalidToken (wrapped with the reason) if validation fails
+func (a *JWTAuthenticator) Authenticate(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed jwt", ErrInvalidToken)
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: bad header: %v", ErrInvalidToken, err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature encoding", ErrInvalidToken)
+	}
+	if err := a.verify(header, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: bad claims: %v", ErrInvalidToken, err)
+	}
+	if err := a.validateClaims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	clientID := claims.ClientID
+	if clientID == "" {
+		clientID = claims.Subject
+	}
+
+	return &Identity{
+		ClientID:          clientID,
+		MaxTunnels:        claims.MaxTunnels,
+		AllowedSubdomains: claims.AllowedSubdomains,
+		Scopes:            ParseScopes(strings.Join(claims.Scopes, ",")),
+	}, nil
+}
+
+func (a *JWTAuthenticator) validateClaims(claims *jwtClaims) error {
+	now := a.now()
+
+	if claims.ClientID == "" && claims.Subject == "" {
+		return fmt.Errorf("missing sub claim")
+	}
+	if claims.ExpiresAt == nil {
+		return fmt.Errorf("missing exp claim")
+	}
+	if now.After(unixTime(*claims.ExpiresAt).Add(a.leeway)) {
+		return fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(a.leeway).Before(unixTime(*claims.NotBefore)) {
+		return fmt.Errorf("token not yet valid")
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if a.audience != "" {
+		found := false
+		for _, aud := range claims.Audience {
+			if aud == a.audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("token not issued for audience %q", a.audience)
+		}
+	}
+	return nil
+}
+
+func (a *JWTAuthenticator) verify(header jwtHeader, signingInput string, signature []byte) error {
+	hash, family, err := algorithm(header.Alg)
+	if err != nil {
+		return err
+	}
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	switch family {
+	case "HS":
+		if len(a.secret) == 0 {
+			return fmt.Errorf("no secret configured for %s", header.Alg)
+		}
+		mac := hmac.New(hash.New, a.secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("signature mismatch")
+		}
+		return nil
+	case "RS":
+		pub, ok := a.lookupKey(header.Kid).(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("no RSA key for kid %q", header.Kid)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, hash, digest, signature); err != nil {
+			return fmt.Errorf("signature mismatch")
+		}
+		return nil
+	case "ES":
+		pub, ok := a.lookupKey(header.Kid).(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("no EC key for kid %q", header.Kid)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("signature mismatch")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("signature mismatch")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported alg %q", header.Alg)
+}
+
+func (a *JWTAuthenticator) lookupKey(kid string) crypto.PublicKey {
+	if key, ok := a.keys[kid]; ok {
+		return key
+	}
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key
+		}
+	}
+	return nil
+}
+
+func algorithm(alg string) (crypto.Hash, string, error) {
+	if len(alg) != 5 {
+		return 0, "", fmt.Errorf("unsupported alg %q", alg)
+	}
+	family := alg[:2]
+	if family != "HS" && family != "RS" && family != "ES" {
+		return 0, "", fmt.Errorf("unsupported alg %q", alg)
+	}
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, family, nil
+	case "384":
+		return crypto.SHA384, family, nil
+	case "512":
+		return crypto.SHA512, family, nil
+	}
+	return 0, "", fmt.Errorf("unsupported alg %q", alg)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(int64(seconds), 0)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// loadJWKS reads a JWKS document from a file path or an http(s) URL.
+func loadJWKS(source string) (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		data, err = fetchJWKS(source)
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load JWKS: %w", err)
+	}
+	return parseJWKS(data)
+}
+
+func fetchJWKS(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS contains no keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func signHS256(t *testing.T, secret string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to marshal claims: %v", err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newTestJWTAuthenticator(t *testing.T) *JWTAuthenticator {
+	t.Helper()
+	a, err := NewJWTAuthenticator(JWTConfig{
+		Secret:   "test-secret",
+		Issuer:   "https://issuer.example.com",
+		Audience: "tunnelab",
+	})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+	return a
+}
+
+func TestJWTAuthenticatorValidToken(t *testing.T) {
+	a := newTestJWTAuthenticator(t)
+	token := signHS256(t, "test-secret", map[string]interface{}{
+		"sub":                "client-42",
+		"iss":                "https://issuer.example.com",
+		"aud":                []string{"other", "tunnelab"},
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"max_tunnels":        3,
+		"allowed_subdomains": "demo,dev-*",
+	})
+
+	identity, err := a.Authenticate(token)
+	if err != nil {
+		t.Fatalf("expected token to be accepted: %v", err)
+	}
+	if identity.ClientID != "client-42" {
+		t.Fatalf("unexpected client id %q", identity.ClientID)
+	}
+	if identity.MaxTunnels != 3 {
+		t.Fatalf("unexpected max tunnels %d", identity.MaxTunnels)
+	}
+	if !identity.AllowsSubdomain("demo") || !identity.AllowsSubdomain("dev-api") {
+		t.Fatalf("expected allowed subdomains to match, got %v", identity.AllowedSubdomains)
+	}
+	if identity.AllowsSubdomain("prod") {
+		t.Fatal("expected subdomain outside the allow list to be rejected")
+	}
+}
+
+func TestJWTAuthenticatorExpiredToken(t *testing.T) {
+	a := newTestJWTAuthenticator(t)
+	token := signHS256(t, "test-secret", map[string]interface{}{
+		"sub": "client-42",
+		"iss": "https://issuer.example.com",
+		"aud": "tunnelab",
+		"exp": time.Now().Add(-time.Minute).Unix(),
+	})
+
+	if _, err := a.Authenticate(token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected expired token to be rejected, got %v", err)
+	}
+}
+
+func TestJWTAuthenticatorWrongSignature(t *testing.T) {
+	a := newTestJWTAuthenticator(t)
+	token := signHS256(t, "another-secret", map[string]interface{}{
+		"sub": "client-42",
+		"iss": "https://issuer.example.com",
+		"aud": "tunnelab",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	if _, err := a.Authenticate(token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected wrong signature to be rejected, got %v", err)
+	}
+}
+
+func TestJWTAuthenticatorIssuerAndAudience(t *testing.T) {
+	a := newTestJWTAuthenticator(t)
+
+	wrongIssuer := signHS256(t, "test-secret", map[string]interface{}{
+		"sub": "client-42",
+		"iss": "https://evil.example.com",
+		"aud": "tunnelab",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	if _, err := a.Authenticate(wrongIssuer); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected wrong issuer to be rejected, got %v", err)
+	}
+
+	wrongAudience := signHS256(t, "test-secret", map[string]interface{}{
+		"sub": "client-42",
+		"iss": "https://issuer.example.com",
+		"aud": "someone-else",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	if _, err := a.Authenticate(wrongAudience); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected wrong audience to be rejected, got %v", err)
+	}
+}
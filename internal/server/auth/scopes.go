@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scopes a client may be granted. A client without scopes may use them all,
+// so clients created before scopes existed keep their access.
+const (
+	ScopeHTTP         = "http"          // HTTP tunnels
+	ScopeTCP          = "tcp"           // TCP tunnels
+	ScopeGRPC         = "grpc"          // gRPC tunnels, gRPC-Web included
+	ScopeCustomDomain = "custom-domain" // Custom domains routed to the client's tunnels
+)
+
+// knownScopes lists every scope, in the order they are documented.
+var knownScopes = []string{ScopeHTTP, ScopeTCP, ScopeGRPC, ScopeCustomDomain}
+
+// ParseScopes splits a comma-separated scope list, as stored in the clients
+// table. Entries are trimmed and lowercased.
+func ParseScopes(value string) []string {
+	scopes := splitList(value)
+	for i, scope := range scopes {
+		scopes[i] = strings.ToLower(scope)
+	}
+	return scopes
+}
+
+// ValidateScopes checks that every entry of a comma-separated scope list is
+// a known scope.
+//
+// Returns:
+//   - error: Names the first unknown scope, nil if all are known
+func ValidateScopes(value string) error {
+	for _, scope := range ParseScopes(value) {
+		if !hasScope(knownScopes, scope) {
+			return fmt.Errorf("unknown scope %q (use %s)", scope, strings.Join(knownScopes, ", "))
+		}
+	}
+	return nil
+}
+
+// ScopesAllow reports whether scopes grant scope. An empty list grants every
+// scope.
+func ScopesAllow(scopes []string, scope string) bool {
+	return len(scopes) == 0 || hasScope(scopes, strings.ToLower(scope))
+}
+
+// AllowsScope reports whether the identity may use a protocol or feature,
+// one of the Scope constants.
+func (i *Identity) AllowsScope(scope string) bool {
+	return ScopesAllow(i.Scopes, scope)
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllowsScope(t *testing.T) {
+	tests := map[string]struct {
+		scopes string
+		scope  string
+		want   bool
+	}{
+		"no scopes allow all": {scopes: "", scope: ScopeTCP, want: true},
+		"granted":             {scopes: "http, tcp", scope: ScopeTCP, want: true},
+		"case insensitive":    {scopes: "HTTP", scope: "Http", want: true},
+		"denied":              {scopes: "http", scope: ScopeGRPC, want: false},
+		"feature denied":      {scopes: "http,tcp,grpc", scope: ScopeCustomDomain, want: false},
+	}
+	for name, tt := range tests {
+		identity := &Identity{Scopes: ParseScopes(tt.scopes)}
+		if got := identity.AllowsScope(tt.scope); got != tt.want {
+			t.Fatalf("%s: AllowsScope(%q) with %q: expected %v, got %v", name, tt.scope, tt.scopes, tt.want, got)
+		}
+	}
+}
+
+func TestValidateScopes(t *testing.T) {
+	for _, value := range []string{"", "http", "http,tcp,grpc,custom-domain", " TCP "} {
+		if err := ValidateScopes(value); err != nil {
+			t.Fatalf("expected %q to be valid, got %v", value, err)
+		}
+	}
+	for _, value := range []string{"https", "http,admin"} {
+		if err := ValidateScopes(value); err == nil {
+			t.Fatalf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestJWTAuthenticatorScopes(t *testing.T) {
+	a := newTestJWTAuthenticator(t)
+	claims := map[string]interface{}{
+		"sub": "client-42",
+		"iss": "https://issuer.example.com",
+		"aud": "tunnelab",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	identity, err := a.Authenticate(signHS256(t, "test-secret", claims))
+	if err != nil {
+		t.Fatalf("expected token to be accepted: %v", err)
+	}
+	if !identity.AllowsScope(ScopeGRPC) {
+		t.Fatal("expected a token without scopes to allow every scope")
+	}
+
+	claims["scopes"] = []string{"HTTP", "tcp"}
+	identity, err = a.Authenticate(signHS256(t, "test-secret", claims))
+	if err != nil {
+		t.Fatalf("expected token to be accepted: %v", err)
+	}
+	if !identity.AllowsScope(ScopeHTTP) || identity.AllowsScope(ScopeGRPC) {
+		t.Fatalf("expected only http and tcp, got %v", identity.Scopes)
+	}
+}
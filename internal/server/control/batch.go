@@ -0,0 +1,95 @@
+package control
+
+import (
+	"context"
+	"log"
+
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+	"github.com/essajiwa/tunnelab/internal/server/webhook"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+)
+
+// maxBatchTunnels bounds the number of tunnels in a single batch request.
+const maxBatchTunnels = 100
+
+// handleBatchTunnelRequest creates every tunnel listed in the "tunnels" array
+// of a tunnel request. Each entry is created independently, so some may
+// succeed while others fail; the response lists one result per entry, in
+// request order:
+//
+//	{"results": [
+//	    {"subdomain": "api", "success": true, "tunnel_id": "...", "public_url": "..."},
+//	    {"subdomain": "db", "success": false, "error": {"code": "...", "message": "..."}}
+//	]}
+//
+// Entries without a "protocol" inherit the protocol of the request itself.
+func (h *Handler) handleBatchTunnelRequest(ctx context.Context, conn registry.ControlConn, identity *auth.Identity, msg *protocol.ControlMessage) {
+	entries, ok := msg.Payload["tunnels"].([]interface{})
+	if !ok || len(entries) == 0 {
+		h.sendError(conn, msg.RequestID, "INVALID_REQUEST", "tunnels must be a non-empty array")
+		return
+	}
+	if len(entries) > maxBatchTunnels {
+		h.sendError(conn, msg.RequestID, "INVALID_REQUEST", "Too many tunnels in one request")
+		return
+	}
+	defaultProtocol, _ := msg.Payload["protocol"].(string)
+
+	results := make([]map[string]interface{}, 0, len(entries))
+	var created []*registry.TunnelInfo
+	for _, entry := range entries {
+		payload, ok := entry.(map[string]interface{})
+		if !ok {
+			results = append(results, batchFailure("", &tunnelError{"INVALID_REQUEST", "Tunnel entry must be an object"}))
+			continue
+		}
+		if _, hasProtocol := payload["protocol"]; !hasProtocol && defaultProtocol != "" {
+			payload["protocol"] = defaultProtocol
+		}
+		subdomain, _ := payload["subdomain"].(string)
+
+		tunnel, tunnelErr := h.createTunnel(ctx, conn, identity, payload)
+		if tunnelErr != nil {
+			results = append(results, batchFailure(subdomain, tunnelErr))
+			continue
+		}
+		created = append(created, tunnel)
+
+		result := h.tunnelResponsePayload(tunnel)
+		result["success"] = true
+		results = append(results, result)
+	}
+
+	response := protocol.NewControlMessage(
+		protocol.MsgTypeTunnelResp,
+		msg.RequestID,
+		map[string]interface{}{"results": results},
+	)
+	cancelMux := make([]context.CancelFunc, 0, len(created))
+	for _, tunnel := range created {
+		cancelMux = append(cancelMux, h.startMuxWait(ctx, tunnel))
+	}
+	if err := conn.WriteJSON(response); err != nil {
+		log.Printf("Failed to send batch tunnel response: %v", err)
+		for i, tunnel := range created {
+			cancelMux[i]()
+			unregistered := h.registry.UnregisterTunnel(tunnel)
+			h.closeRecord(tunnel)
+			if unregistered {
+				h.notifyTunnelEvent(webhook.EventTunnelClosed, tunnel, "client_unreachable")
+			}
+		}
+	}
+}
+
+func batchFailure(subdomain string, tunnelErr *tunnelError) map[string]interface{} {
+	return map[string]interface{}{
+		"subdomain": subdomain,
+		"success":   false,
+		"error": map[string]interface{}{
+			"code":    tunnelErr.Code,
+			"message": tunnelErr.Message,
+		},
+	}
+}
@@ -0,0 +1,83 @@
+package control
+
+import (
+	"context"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+)
+
+func TestBatchTunnelRequestPartialSuccess(t *testing.T) {
+	h := newTestHandler(t)
+	conn := newRecordingConn()
+	identity := &auth.Identity{ClientID: "client"}
+
+	msg := protocol.NewControlMessage(protocol.MsgTypeTunnelReq, "batch-1", map[string]interface{}{
+		"protocol": "http",
+		"tunnels": []interface{}{
+			map[string]interface{}{"subdomain": "api", "local_port": float64(3000)},
+			map[string]interface{}{"subdomain": "broken", "local_port": float64(0)},
+			map[string]interface{}{"subdomain": "api", "local_port": float64(3001)},
+			map[string]interface{}{"subdomain": "db", "protocol": "tcp", "local_port": float64(5432)},
+			"not-an-object",
+			map[string]interface{}{"subdomain": "web", "local_port": float64(8080)},
+		},
+	})
+	h.handleTunnelRequest(context.Background(), conn, identity, msg)
+
+	resp := conn.find(protocol.MsgTypeTunnelResp)
+	if resp == nil || resp.RequestID != "batch-1" {
+		t.Fatalf("expected a batch tunnel response, got %+v", resp)
+	}
+	results, ok := resp.Payload["results"].([]map[string]interface{})
+	if !ok || len(results) != 6 {
+		t.Fatalf("expected 6 results, got %#v", resp.Payload["results"])
+	}
+
+	wantCodes := []string{"", "INVALID_LOCAL_PORT", "SUBDOMAIN_TAKEN", "PORT_ALLOCATION_FAILED", "INVALID_REQUEST", ""}
+	for i, want := range wantCodes {
+		success, _ := results[i]["success"].(bool)
+		if want == "" {
+			if !success || results[i]["tunnel_id"] == nil {
+				t.Fatalf("result %d: expected success, got %v", i, results[i])
+			}
+			continue
+		}
+		errInfo, _ := results[i]["error"].(map[string]interface{})
+		if success || errInfo["code"] != want {
+			t.Fatalf("result %d: expected %s, got %v", i, want, results[i])
+		}
+	}
+
+	for _, subdomain := range []string{"api", "web"} {
+		if _, exists := h.registry.GetBySubdomain(subdomain); !exists {
+			t.Fatalf("expected %s to be registered", subdomain)
+		}
+		if tunnel, _ := h.repo.GetTunnelBySubdomain(subdomain); tunnel == nil {
+			t.Fatalf("expected %s to be stored in the database", subdomain)
+		}
+	}
+	for _, subdomain := range []string{"broken", "db"} {
+		if _, exists := h.registry.GetBySubdomain(subdomain); exists {
+			t.Fatalf("failed entry %s must not be registered", subdomain)
+		}
+		if tunnel, _ := h.repo.GetTunnelBySubdomain(subdomain); tunnel != nil {
+			t.Fatalf("failed entry %s must not be stored in the database", subdomain)
+		}
+	}
+}
+
+func TestBatchTunnelRequestRejectsEmptyBatch(t *testing.T) {
+	h := newTestHandler(t)
+	conn := newRecordingConn()
+
+	msg := protocol.NewControlMessage(protocol.MsgTypeTunnelReq, "batch-2", map[string]interface{}{
+		"tunnels": []interface{}{},
+	})
+	h.handleTunnelRequest(context.Background(), conn, &auth.Identity{ClientID: "client"}, msg)
+
+	if conn.find(protocol.MsgTypeError) == nil {
+		t.Fatal("expected an error for an empty batch")
+	}
+}
@@ -0,0 +1,35 @@
+package control
+
+import (
+	"sync"
+
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// clientConn wraps a client's WebSocket control connection so that messages
+// can be written from several goroutines (request handling, mux setup, stats).
+type clientConn struct {
+	*websocket.Conn
+	writeMu sync.Mutex
+	// signingKey is set once the client has agreed to message signing; from
+	// then on every message in either direction carries an HMAC.
+	signingKey []byte
+}
+
+func newClientConn(conn *websocket.Conn) *clientConn {
+	return &clientConn{Conn: conn}
+}
+
+// WriteJSON serializes concurrent writers on the underlying connection and
+// signs control messages when signing is enabled.
+func (c *clientConn) WriteJSON(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if msg, ok := v.(*protocol.ControlMessage); ok && c.signingKey != nil {
+		if err := msg.Sign(c.signingKey); err != nil {
+			return err
+		}
+	}
+	return c.Conn.WriteJSON(v)
+}
@@ -0,0 +1,43 @@
+package control
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func TestOversizedControlMessageClosesConnection(t *testing.T) {
+	h := newTestHandler(t)
+	h.SetMaxMessageSize(1024)
+
+	server := httptest.NewServer(http.HandlerFunc(h.HandleWebSocket))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to dial control server: %v", err)
+	}
+	defer ws.Close()
+	// The server hangs up right after its close frame, so don't echo it.
+	ws.SetCloseHandler(func(code int, text string) error { return nil })
+
+	msg := protocol.NewControlMessage(protocol.MsgTypeAuth, "big", map[string]interface{}{
+		"token": strings.Repeat("x", 4096),
+	})
+	if err := ws.WriteJSON(msg); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = ws.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseMessageTooBig {
+		t.Fatalf("expected close code %d, got %v", websocket.CloseMessageTooBig, err)
+	}
+}
@@ -0,0 +1,51 @@
+package control
+
+import (
+	"context"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+)
+
+// countingAuthenticator records how often it is consulted.
+type countingAuthenticator struct {
+	calls int
+}
+
+func (a *countingAuthenticator) Authenticate(token string) (*auth.Identity, error) {
+	a.calls++
+	return &auth.Identity{ClientID: "other"}, nil
+}
+
+func TestDuplicateAuthIsRejected(t *testing.T) {
+	h := newTestHandler(t)
+	authenticator := &countingAuthenticator{}
+	h.SetAuthenticator(authenticator)
+	conn := newRecordingConn()
+	identity := &auth.Identity{ClientID: "client"}
+
+	for i := 0; i < 2; i++ {
+		msg := protocol.NewControlMessage(protocol.MsgTypeAuth, "auth-again", map[string]interface{}{
+			"token": "another-token",
+		})
+		h.handleMessage(context.Background(), conn, identity, msg)
+	}
+
+	if authenticator.calls != 0 {
+		t.Fatalf("redundant auth must not re-authenticate, got %d calls", authenticator.calls)
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if len(conn.messages) != 2 {
+		t.Fatalf("expected one reply per redundant auth, got %d", len(conn.messages))
+	}
+	for _, msg := range conn.messages {
+		if msg.Type != protocol.MsgTypeError || msg.RequestID != "auth-again" {
+			t.Fatalf("unexpected reply %+v", msg)
+		}
+		if code := msg.Payload["code"]; code != "ALREADY_AUTHENTICATED" {
+			t.Fatalf("expected ALREADY_AUTHENTICATED, got %v", code)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package control
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"strconv"
@@ -12,14 +15,35 @@ import (
 	"time"
 
 	"github.com/essajiwa/tunnelab/internal/database"
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+	"github.com/essajiwa/tunnelab/internal/server/iplimit"
+	"github.com/essajiwa/tunnelab/internal/server/quota"
 	"github.com/essajiwa/tunnelab/internal/server/registry"
+	"github.com/essajiwa/tunnelab/internal/server/webhook"
 	"github.com/essajiwa/tunnelab/pkg/protocol"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/hashicorp/yamux"
 )
 
+// defaultMaxMessageSize is the control message size limit used when none is configured.
+const defaultMaxMessageSize = 1 << 20
+
+// defaultHandshakeTimeout bounds authentication and mux establishment when no
+// timeout is configured.
+const defaultHandshakeTimeout = 30 * time.Second
+
+// defaultMuxBindHost keeps mux listeners off public interfaces unless the
+// operator configures another address.
+const defaultMuxBindHost = "127.0.0.1"
+
+// upgradeTimeout bounds writing the WebSocket upgrade response, so a client
+// that stops reading cannot hold the upgrade open. Reading the upgrade request
+// is bounded by the control server's header timeout.
+const upgradeTimeout = 10 * time.Second
+
 var upgrader = websocket.Upgrader{
+	HandshakeTimeout: upgradeTimeout,
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
@@ -32,27 +56,213 @@ func ensureProtocolType(msg *protocol.ControlMessage, proto string) {
 	msg.Payload["protocol"] = proto
 }
 
-func (h *Handler) assignPublicPort(payload map[string]interface{}) (int, error) {
+// assignPublicPort returns the requested public_port of a TCP or gRPC tunnel,
+// if the port policy allows requesting one, or else the port the client last
+// had for the subdomain if it is free, or else allocates a port. Only ports
+// inside the TCP port range are served, so requests for other ports are
+// rejected.
+//
+// The port stays pending until the caller calls h.portAllocator.settle once
+// the tunnel is registered or its creation failed, so concurrent requests
+// never get the same port.
+func (h *Handler) assignPublicPort(ctx context.Context, clientID, subdomain string, payload map[string]interface{}) (int, *tunnelError) {
+	if h.portAllocator == nil {
+		return 0, &tunnelError{"PORT_ALLOCATION_FAILED", "tcp tunneling not enabled"}
+	}
 	if value, ok := payload["public_port"].(float64); ok && value > 0 {
+		if h.portPolicy == PortAuto {
+			return 0, &tunnelError{"PORT_NOT_ALLOWED", "This server assigns public ports; omit public_port"}
+		}
 		port := int(value)
-		if _, exists := h.registry.GetByPort(port); exists {
-			return 0, fmt.Errorf("port %d already in use", port)
+		if !h.portAllocator.contains(port) {
+			return 0, &tunnelError{"PORT_NOT_ALLOWED", fmt.Sprintf("Port %d is outside the public port range %d-%d", port, h.portAllocator.start, h.portAllocator.end)}
+		}
+		if !h.portAllocator.take(h.registry, port) {
+			return 0, &tunnelError{"PORT_ALLOCATION_FAILED", fmt.Sprintf("port %d already in use", port)}
 		}
 		return port, nil
 	}
-	if h.portAllocator == nil {
-		return 0, fmt.Errorf("tcp tunneling not enabled")
+	if port, ok := h.previousPort(ctx, clientID, subdomain); ok {
+		return port, nil
+	}
+	port, err := h.portAllocator.allocate(h.registry)
+	if err != nil {
+		return 0, &tunnelError{"PORT_ALLOCATION_FAILED", err.Error()}
+	}
+	return port, nil
+}
+
+// previousPort claims the public port the client last had for subdomain, as
+// recorded in the database, if it is still free.
+func (h *Handler) previousPort(ctx context.Context, clientID, subdomain string) (int, bool) {
+	port, err := h.repo.GetLastPublicPortContext(ctx, clientID, subdomain)
+	if err != nil {
+		log.Printf("Failed to look up the previous port of %s: %v", subdomain, err)
+		return 0, false
+	}
+	if port == 0 || !h.portAllocator.claim(h.registry, port, portOwner(clientID, subdomain)) {
+		return 0, false
 	}
-	return h.portAllocator.allocate(h.registry)
+	return port, true
 }
 
+// portOwner identifies the tunnel a port is reserved for.
+func portOwner(clientID, subdomain string) string {
+	return clientID + "/" + subdomain
+}
+
+// Port allocation strategies of ConfigurePortAllocator.
+const (
+	// PortAllocationSequential assigns the lowest free port, so assignments
+	// are stable across restarts.
+	PortAllocationSequential = "sequential"
+	// PortAllocationRoundRobin reuses released ports first, oldest first, and
+	// otherwise assigns the first free port after the last assigned one.
+	PortAllocationRoundRobin = "round-robin"
+	// PortAllocationRandom assigns the first free port after a random one.
+	PortAllocationRandom = "random"
+)
+
 type portAllocator struct {
-	start int
-	end   int
-	next  int
-	mu    sync.Mutex
+	start    int
+	end      int
+	next     int
+	strategy string
+	randIntN func(n int) int // Picks the random starting offset (rand.IntN outside tests)
+	mu       sync.Mutex
+
+	// released holds ports given back by unregistered tunnels, oldest first.
+	// Round-robin allocation reuses them before scanning the range.
+	released   []int
+	isReleased map[int]bool
+
+	// reserved holds the ports of tunnels that were active before a restart,
+	// by portOwner, until their client claims them back. Allocation skips
+	// them while other ports are free.
+	reserved map[int]string
+
+	// pending holds the ports handed out by allocate, claim or take whose
+	// tunnel may not be registered yet. They count as taken until settle or
+	// release, so two concurrent requests never get the same port.
+	pending map[int]bool
+}
+
+// contains reports whether port is inside the allocator's range.
+func (a *portAllocator) contains(port int) bool {
+	return port >= a.start && port <= a.end
+}
+
+// inUse reports whether port is registered or pending. a.mu must be held.
+func (a *portAllocator) inUse(reg *registry.Registry, port int) bool {
+	if a.pending[port] {
+		return true
+	}
+	_, exists := reg.GetByPort(port)
+	return exists
+}
+
+// hold marks port as pending and returns it. a.mu must be held.
+func (a *portAllocator) hold(port int) int {
+	if a.pending == nil {
+		a.pending = make(map[int]bool)
+	}
+	a.pending[port] = true
+	return port
 }
 
+// settle ends the pending state of a port handed out for a tunnel, once the
+// tunnel is registered, and so holds the port itself, or failed to be created.
+func (a *portAllocator) settle(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.pending, port)
+}
+
+// take reports whether port, requested explicitly, is free, and holds it if
+// so. The caller checks that port is in the range.
+func (a *portAllocator) take(reg *registry.Registry, port int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.inUse(reg, port) {
+		return false
+	}
+	a.hold(port)
+	return true
+}
+
+// release queues a port of an unregistered tunnel for reuse. Ports outside
+// the range and ports already queued are ignored.
+func (a *portAllocator) release(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// The tunnel was registered, so its port is no longer pending.
+	delete(a.pending, port)
+	if !a.contains(port) || a.isReleased[port] {
+		return
+	}
+	if a.isReleased == nil {
+		a.isReleased = make(map[int]bool)
+	}
+	a.isReleased[port] = true
+	a.released = append(a.released, port)
+}
+
+// reserve keeps port for owner until it is claimed. Ports outside the range
+// are ignored.
+func (a *portAllocator) reserve(port int, owner string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.contains(port) {
+		return
+	}
+	if a.reserved == nil {
+		a.reserved = make(map[int]string)
+	}
+	a.reserved[port] = owner
+}
+
+// claim reports whether owner may take port: it must be in the range, not
+// reserved for another owner, not pending, and free or held by owner's own
+// tunnel, which is then taken over. A reservation of the port ends and the
+// port is held.
+func (a *portAllocator) claim(reg *registry.Registry, port int, owner string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.contains(port) || a.pending[port] {
+		return false
+	}
+	if reservedFor, ok := a.reserved[port]; ok && reservedFor != owner {
+		return false
+	}
+	if current, exists := reg.GetByPort(port); exists && portOwner(current.ClientID, current.Subdomain) != owner {
+		return false
+	}
+	delete(a.reserved, port)
+	a.hold(port)
+	return true
+}
+
+// reuse returns the oldest released port that is still free. Released ports
+// that were taken again in the meantime are dropped. a.mu must be held.
+func (a *portAllocator) reuse(reg *registry.Registry) (int, bool) {
+	for len(a.released) > 0 {
+		port := a.released[0]
+		a.released = a.released[1:]
+		delete(a.isReleased, port)
+		if !a.inUse(reg, port) {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// allocate picks a free port by the allocator's strategy and holds it until
+// settle or release, so the check and the reservation are one step.
 func (a *portAllocator) allocate(reg *registry.Registry) (int, error) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -62,15 +272,42 @@ func (a *portAllocator) allocate(reg *registry.Registry) (int, error) {
 		return 0, fmt.Errorf("invalid port range")
 	}
 
+	if a.strategy == "" || a.strategy == PortAllocationRoundRobin {
+		if port, ok := a.reuse(reg); ok {
+			return a.hold(port), nil
+		}
+	}
+
+	first := a.next
+	switch a.strategy {
+	case PortAllocationSequential:
+		first = a.start
+	case PortAllocationRandom:
+		first = a.start + a.randIntN(rangeSize)
+	}
+
+	// Reserved ports are handed out only once every other port is taken.
+	fallback := 0
 	for i := 0; i < rangeSize; i++ {
-		candidate := a.start + ((a.next - a.start + i + rangeSize) % rangeSize)
-		if _, exists := reg.GetByPort(candidate); !exists {
-			a.next = candidate + 1
-			if a.next > a.end {
-				a.next = a.start
+		candidate := a.start + ((first - a.start + i + rangeSize) % rangeSize)
+		if a.inUse(reg, candidate) {
+			continue
+		}
+		if _, reserved := a.reserved[candidate]; reserved {
+			if fallback == 0 {
+				fallback = candidate
 			}
-			return candidate, nil
+			continue
 		}
+		a.next = candidate + 1
+		if a.next > a.end {
+			a.next = a.start
+		}
+		return a.hold(candidate), nil
+	}
+	if fallback != 0 {
+		delete(a.reserved, fallback)
+		return a.hold(fallback), nil
 	}
 
 	return 0, fmt.Errorf("no available ports in range %d-%d", a.start, a.end)
@@ -96,22 +333,171 @@ func parsePortRange(r string) (int, int, error) {
 }
 
 type Handler struct {
-	registry      *registry.Registry
-	repo          *database.Repository
-	domain        string
-	portAllocator *portAllocator
+	registry       *registry.Registry
+	repo           *database.Repository
+	authenticator  auth.Authenticator
+	domain         string
+	portAllocator  *portAllocator
+	statsInterval  time.Duration
+	sniPort        int
+	maxTTL         time.Duration
+	maxMessageSize int64
+	grpcMaxStreams int
+	authTimeout    time.Duration // How long a new connection has to send its auth message
+	muxTimeout     time.Duration // How long a client has to connect the mux session of a tunnel
+	muxBindHost    string        // Interface the ephemeral mux listeners bind to
+	publicHost     string        // Host clients connect to for port-based tunnels (defaults to domain)
+	// streamCompression enables negotiation of compressed tunnel data streams.
+	streamCompression bool
+	// requireSignatures rejects clients that do not sign their control messages.
+	requireSignatures bool
+	// enforceMaxTunnels rejects tunnels beyond the MaxTunnels of a client.
+	enforceMaxTunnels bool
+	// quotas rejects new tunnels of clients over their monthly byte quota (nil disables it).
+	quotas *quota.Enforcer
+	// ipLimits caps the control connections per source IP (nil disables it).
+	ipLimits *iplimit.Limiter
+	// webhooks receives tunnel lifecycle events (nil disables them).
+	webhooks *webhook.Notifier
+	// subdomainPolicy and portPolicy decide which subdomains and public ports
+	// clients may request; see SetSubdomainPolicy and SetPortPolicy.
+	subdomainPolicy string
+	portPolicy      string
+
+	// conns holds the open control connections. They are hijacked from the
+	// HTTP server, so CloseConnections closes them on shutdown.
+	connsMu sync.Mutex
+	conns   map[*clientConn]struct{}
+	closing bool // Set by CloseConnections; new connections are refused
 }
 
 func NewHandler(registry *registry.Registry, repo *database.Repository, domain string) *Handler {
 	return &Handler{
-		registry: registry,
-		repo:     repo,
-		domain:   domain,
+		registry:       registry,
+		repo:           repo,
+		authenticator:  auth.NewRepositoryAuthenticator(repo),
+		domain:         domain,
+		maxMessageSize: defaultMaxMessageSize,
+		authTimeout:    defaultHandshakeTimeout,
+		muxTimeout:     defaultHandshakeTimeout,
+		muxBindHost:    defaultMuxBindHost,
+
+		subdomainPolicy: SubdomainRequired,
+		portPolicy:      PortRequest,
 	}
 }
 
+// SetIPLimiter caps the simultaneous control connections from one source IP.
+// Connections past the limit are answered with 429 Too Many Requests before
+// the WebSocket upgrade.
+//
+// Parameters:
+//   - limiter: Counts connections per IP (nil disables the limit)
+func (h *Handler) SetIPLimiter(limiter *iplimit.Limiter) {
+	h.ipLimits = limiter
+}
+
+// SetQuotaEnforcer rejects tunnel requests from clients that have used up
+// their monthly byte quota.
+//
+// Parameters:
+//   - enforcer: The quota enforcer shared with the proxy
+func (h *Handler) SetQuotaEnforcer(enforcer *quota.Enforcer) {
+	h.quotas = enforcer
+}
+
+// SetPublicHost sets the hostname advertised in the public_endpoint of
+// port-based tunnels, e.g. "tcp.example.com". Empty means the server domain.
+func (h *Handler) SetPublicHost(host string) {
+	h.publicHost = host
+}
+
+// publicEndpoint returns the host:port users connect to for a public port.
+func (h *Handler) publicEndpoint(port int) string {
+	host := h.publicHost
+	if host == "" {
+		host = h.domain
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// SetGRPCMaxStreams sets the ceiling for the max_streams of gRPC tunnels. Zero means no ceiling.
+func (h *Handler) SetGRPCMaxStreams(ceiling int) {
+	h.grpcMaxStreams = ceiling
+}
+
+// RequireSignedMessages rejects control messages without a valid HMAC
+// signature. Clients that sign their auth message are verified either way.
+func (h *Handler) RequireSignedMessages() {
+	h.requireSignatures = true
+}
+
+// EnforceMaxTunnels rejects tunnel requests of clients that already hold
+// their MaxTunnels tunnels with TUNNEL_LIMIT_REACHED. The count is checked
+// by the registry as the tunnel is registered.
+func (h *Handler) EnforceMaxTunnels() {
+	h.enforceMaxTunnels = true
+}
+
+// EnableStreamCompression lets clients request compressed tunnel data streams.
+func (h *Handler) EnableStreamCompression() {
+	h.streamCompression = true
+}
+
+// SetAuthTimeout sets how long a new connection has to send its auth message.
+// Zero restores the 30s default.
+func (h *Handler) SetAuthTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	h.authTimeout = timeout
+}
+
+// SetMuxTimeout sets how long a client has to connect the mux session of a
+// new tunnel. Zero restores the 30s default.
+func (h *Handler) SetMuxTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	h.muxTimeout = timeout
+}
+
+// SetMuxBindHost sets the interface the ephemeral mux listeners of new
+// tunnels bind to, e.g. "127.0.0.1" when clients run on the server host or a
+// private address when they reach it over a private network. "0.0.0.0" or
+// "::" exposes the mux ports on every interface. Empty restores the loopback
+// default.
+func (h *Handler) SetMuxBindHost(host string) {
+	if host == "" {
+		host = defaultMuxBindHost
+	}
+	h.muxBindHost = host
+}
+
+// SetMaxMessageSize caps the size of control messages read from clients.
+// Oversized messages close the connection with code 1009 (message too big).
+func (h *Handler) SetMaxMessageSize(size int64) {
+	if size <= 0 {
+		size = defaultMaxMessageSize
+	}
+	h.maxMessageSize = size
+}
+
+// SetAuthenticator replaces the default database token authenticator.
+func (h *Handler) SetAuthenticator(authenticator auth.Authenticator) {
+	h.authenticator = authenticator
+}
+
 // ConfigurePortAllocator enables automatic public-port assignment for TCP/gRPC tunnels.
-func (h *Handler) ConfigurePortAllocator(portRange string) error {
+//
+// Parameters:
+//   - portRange: Range of public ports ("start-end"); empty disables assignment
+//   - strategy: PortAllocationSequential, PortAllocationRoundRobin or
+//     PortAllocationRandom; empty means round-robin
+//
+// Returns:
+//   - error: If the range or strategy is invalid
+func (h *Handler) ConfigurePortAllocator(portRange, strategy string) error {
 	if portRange == "" {
 		h.portAllocator = nil
 		return nil
@@ -120,58 +506,202 @@ func (h *Handler) ConfigurePortAllocator(portRange string) error {
 	if err != nil {
 		return err
 	}
-	h.portAllocator = &portAllocator{start: start, end: end, next: start}
+	switch strategy {
+	case "":
+		strategy = PortAllocationRoundRobin
+	case PortAllocationSequential, PortAllocationRoundRobin, PortAllocationRandom:
+	default:
+		return fmt.Errorf("unknown port allocation strategy %q", strategy)
+	}
+	h.portAllocator = &portAllocator{start: start, end: end, next: start, strategy: strategy, randIntN: rand.IntN}
 	return nil
 }
 
+// RestorePortAssignments reserves the public ports of the tunnels recorded as
+// active in the database, which were open before the server restarted, so
+// that each port goes back to its client when it reconnects rather than to
+// another tunnel. Call it after ConfigurePortAllocator.
+//
+// Parameters:
+//   - ctx: Bounds the database query
+//
+// Returns:
+//   - int: Number of ports reserved
+//   - error: Database error if any
+func (h *Handler) RestorePortAssignments(ctx context.Context) (int, error) {
+	if h.portAllocator == nil {
+		return 0, nil
+	}
+	tunnels, err := h.repo.ListTunnelsContext(ctx, database.TunnelFilter{Status: "active"})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list active tunnels: %w", err)
+	}
+	reserved := 0
+	for _, tunnel := range tunnels {
+		if tunnel.PublicPort <= 0 || !h.portAllocator.contains(tunnel.PublicPort) {
+			continue
+		}
+		h.portAllocator.reserve(tunnel.PublicPort, portOwner(tunnel.ClientID, tunnel.Subdomain))
+		reserved++
+	}
+	return reserved, nil
+}
+
+// ReleasePort gives the public port of an unregistered tunnel back to the
+// port allocator for reuse. Install it as the registry's UnregisterHook.
+//
+// Parameters:
+//   - tunnel: The tunnel that was unregistered
+func (h *Handler) ReleasePort(tunnel *registry.TunnelInfo) {
+	if h.portAllocator == nil || tunnel.PublicPort <= 0 {
+		return
+	}
+	h.portAllocator.release(tunnel.PublicPort)
+}
+
+// SetSNIPort enables SNI-routed TLS passthrough tunnels on the shared port. Zero disables them.
+func (h *Handler) SetSNIPort(port int) {
+	h.sniPort = port
+}
+
+// SetMaxTTL caps the TTL clients may request for a tunnel. Zero means no cap.
+func (h *Handler) SetMaxTTL(maxTTL time.Duration) {
+	h.maxTTL = maxTTL
+}
+
+// SetStatsInterval enables periodic stats messages to clients. Zero disables them.
+func (h *Handler) SetStatsInterval(interval time.Duration) {
+	h.statsInterval = interval
+}
+
 func (h *Handler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !h.ipLimits.Acquire(ip) {
+		log.Printf("Rejected control connection from %s: too many connections from this address", ip)
+		http.Error(w, "Too many connections from your address", http.StatusTooManyRequests)
+		return
+	}
+	defer h.ipLimits.Release(ip)
+
+	wsConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade connection: %v", err)
 		return
 	}
-	defer conn.Close()
+	defer wsConn.Close()
+	wsConn.SetReadLimit(h.maxMessageSize)
+	conn := newClientConn(wsConn)
+	if !h.trackConn(conn) {
+		return
+	}
+	defer h.untrackConn(conn)
 
-	clientID, authenticated := h.authenticate(conn)
+	// Database work and pending mux waits for this client are cancelled once
+	// it disconnects.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	identity, authenticated := h.authenticate(ctx, conn)
 	if !authenticated {
 		return
 	}
 
-	log.Printf("Client %s authenticated successfully", clientID)
+	log.Printf("Client %s authenticated successfully", identity.ClientID)
+
+	h.handleClient(ctx, conn, identity)
+}
+
+// trackConn records an open control connection. It reports false once
+// CloseConnections has been called.
+func (h *Handler) trackConn(conn *clientConn) bool {
+	h.connsMu.Lock()
+	defer h.connsMu.Unlock()
+	if h.closing {
+		return false
+	}
+	if h.conns == nil {
+		h.conns = make(map[*clientConn]struct{})
+	}
+	h.conns[conn] = struct{}{}
+	return true
+}
+
+func (h *Handler) untrackConn(conn *clientConn) {
+	h.connsMu.Lock()
+	defer h.connsMu.Unlock()
+	delete(h.conns, conn)
+}
+
+// CloseConnections closes every open control connection with a going-away
+// close message and refuses new ones. Each client's tunnels are then cleaned
+// up as on a disconnect. http.Server.Shutdown does not close these
+// connections, because they are hijacked.
+func (h *Handler) CloseConnections() {
+	h.connsMu.Lock()
+	h.closing = true
+	conns := make([]*clientConn, 0, len(h.conns))
+	for conn := range h.conns {
+		conns = append(conns, conn)
+	}
+	h.connsMu.Unlock()
 
-	h.handleClient(conn, clientID)
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for _, conn := range conns {
+		conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+		conn.Close()
+	}
 }
 
-func (h *Handler) authenticate(conn *websocket.Conn) (string, bool) {
-	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+func (h *Handler) authenticate(ctx context.Context, conn *clientConn) (*auth.Identity, bool) {
+	conn.SetReadDeadline(time.Now().Add(h.authTimeout))
 
 	var msg protocol.ControlMessage
 	if err := conn.ReadJSON(&msg); err != nil {
 		log.Printf("Failed to read auth message: %v", err)
-		return "", false
+		return nil, false
 	}
 
 	if msg.Type != protocol.MsgTypeAuth {
 		h.sendError(conn, msg.RequestID, "INVALID_MESSAGE", "Expected auth message")
-		return "", false
+		return nil, false
 	}
 
 	token, ok := msg.Payload["token"].(string)
 	if !ok || token == "" {
+		h.notifyAuthFailed(conn, "missing_token")
 		h.sendError(conn, msg.RequestID, "INVALID_TOKEN", "Token is required")
-		return "", false
+		return nil, false
 	}
 
-	client, err := h.repo.GetClientByToken(token)
-	if err != nil {
-		log.Printf("Database error: %v", err)
-		h.sendError(conn, msg.RequestID, "AUTH_FAILED", "Authentication failed")
-		return "", false
+	if h.requireSignatures || msg.Signature != "" {
+		key := protocol.DeriveSigningKey(token)
+		if err := msg.Verify(key); err != nil {
+			h.notifyAuthFailed(conn, "invalid_signature")
+			h.sendError(conn, msg.RequestID, "INVALID_SIGNATURE", err.Error())
+			return nil, false
+		}
+		conn.signingKey = key
 	}
 
-	if client == nil {
+	identity, err := auth.AuthenticateContext(ctx, h.authenticator, token)
+	if errors.Is(err, auth.ErrInvalidToken) {
+		log.Printf("Authentication rejected: %v", err)
+		h.notifyAuthFailed(conn, "invalid_token")
 		h.sendError(conn, msg.RequestID, "AUTH_FAILED", "Invalid token")
-		return "", false
+		return nil, false
+	}
+	if errors.Is(err, database.ErrUnavailable) {
+		log.Printf("Authentication unavailable: %v", err)
+		h.sendError(conn, msg.RequestID, "SERVICE_UNAVAILABLE", "Authentication is temporarily unavailable, try again later")
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Authentication error: %v", err)
+		h.sendError(conn, msg.RequestID, "AUTH_FAILED", "Authentication failed")
+		return nil, false
 	}
 
 	response := protocol.NewControlMessage(
@@ -179,64 +709,262 @@ func (h *Handler) authenticate(conn *websocket.Conn) (string, bool) {
 		msg.RequestID,
 		map[string]interface{}{
 			"success":   true,
-			"client_id": client.ID,
+			"client_id": identity.ClientID,
 		},
 	)
 
 	if err := conn.WriteJSON(response); err != nil {
 		log.Printf("Failed to send auth response: %v", err)
-		return "", false
+		return nil, false
 	}
 
 	conn.SetReadDeadline(time.Time{})
-	return client.ID, true
+	return identity, true
 }
 
-func (h *Handler) handleClient(conn *websocket.Conn, clientID string) {
+func (h *Handler) handleClient(ctx context.Context, conn *clientConn, identity *auth.Identity) {
+	clientID := identity.ClientID
+
+	done := make(chan struct{})
+	defer close(done)
+	if h.statsInterval > 0 {
+		go h.sendStats(conn, clientID, done)
+	}
+
 	for {
 		var msg protocol.ControlMessage
 		if err := conn.ReadJSON(&msg); err != nil {
 			log.Printf("Client %s disconnected: %v", clientID, err)
-			h.cleanupClient(clientID)
+			h.cleanupClient(clientID, conn)
 			return
 		}
 
-		switch msg.Type {
-		case protocol.MsgTypeTunnelReq:
-			h.handleTunnelRequest(conn, clientID, &msg)
-		case protocol.MsgTypeTCPReq:
-			ensureProtocolType(&msg, "tcp")
-			h.handleTunnelRequest(conn, clientID, &msg)
-		case protocol.MsgTypeGRPCReq:
-			ensureProtocolType(&msg, "grpc")
-			h.handleTunnelRequest(conn, clientID, &msg)
-		case protocol.MsgTypeHeartbeat:
-			h.handleHeartbeat(conn, &msg)
-		default:
-			log.Printf("Unknown message type: %s", msg.Type)
+		if conn.signingKey != nil {
+			if err := msg.Verify(conn.signingKey); err != nil {
+				log.Printf("Rejected %s message from client %s: %v", msg.Type, clientID, err)
+				h.sendError(conn, msg.RequestID, "INVALID_SIGNATURE", err.Error())
+				continue
+			}
 		}
+
+		h.handleMessage(ctx, conn, identity, &msg)
 	}
 }
 
-func (h *Handler) handleTunnelRequest(conn *websocket.Conn, clientID string, msg *protocol.ControlMessage) {
-	subdomain, _ := msg.Payload["subdomain"].(string)
-	protocolType, _ := msg.Payload["protocol"].(string)
+// handleMessage dispatches a control message from an authenticated client.
+func (h *Handler) handleMessage(ctx context.Context, conn registry.ControlConn, identity *auth.Identity, msg *protocol.ControlMessage) {
+	switch msg.Type {
+	case protocol.MsgTypeTunnelReq:
+		h.handleTunnelRequest(ctx, conn, identity, msg)
+	case protocol.MsgTypeTCPReq:
+		ensureProtocolType(msg, "tcp")
+		h.handleTunnelRequest(ctx, conn, identity, msg)
+	case protocol.MsgTypeGRPCReq:
+		ensureProtocolType(msg, "grpc")
+		h.handleTunnelRequest(ctx, conn, identity, msg)
+	case protocol.MsgTypeHeartbeat:
+		h.handleHeartbeat(conn, msg)
+	case protocol.MsgTypeListTunnels:
+		h.handleListTunnels(ctx, conn, identity.ClientID, msg)
+	case protocol.MsgTypeAuth:
+		// The connection is already authenticated; the token is not checked
+		// again, so a redundant auth never reaches the database.
+		h.sendError(conn, msg.RequestID, "ALREADY_AUTHENTICATED",
+			fmt.Sprintf("Connection is already authenticated as %s", identity.ClientID))
+	default:
+		log.Printf("Unknown message type: %s", msg.Type)
+	}
+}
+
+func (h *Handler) handleTunnelRequest(ctx context.Context, conn registry.ControlConn, identity *auth.Identity, msg *protocol.ControlMessage) {
+	if _, isBatch := msg.Payload["tunnels"]; isBatch {
+		h.handleBatchTunnelRequest(ctx, conn, identity, msg)
+		return
+	}
+
+	tunnelInfo, tunnelErr := h.createTunnel(ctx, conn, identity, msg.Payload)
+	if tunnelErr != nil {
+		h.sendError(conn, msg.RequestID, tunnelErr.Code, tunnelErr.Message)
+		return
+	}
+
+	responseType := protocol.MsgTypeTunnelResp
+	switch tunnelInfo.Protocol {
+	case "tcp":
+		responseType = protocol.MsgTypeTCPResp
+	case "grpc":
+		responseType = protocol.MsgTypeGRPCResp
+	}
+
+	response := protocol.NewControlMessage(
+		responseType,
+		msg.RequestID,
+		h.tunnelResponsePayload(tunnelInfo),
+	)
+
+	cancelMux := h.startMuxWait(ctx, tunnelInfo)
+	if err := conn.WriteJSON(response); err != nil {
+		log.Printf("Failed to send tunnel response: %v", err)
+		cancelMux()
+		unregistered := h.registry.UnregisterTunnel(tunnelInfo)
+		h.closeRecord(tunnelInfo)
+		if unregistered {
+			h.notifyTunnelEvent(webhook.EventTunnelClosed, tunnelInfo, "client_unreachable")
+		}
+	}
+}
+
+// tunnelError is a tunnel creation failure reported to the client.
+type tunnelError struct {
+	Code    string
+	Message string
+}
+
+// errServiceUnavailable reports that the database is down or overloaded.
+var errServiceUnavailable = &tunnelError{"SERVICE_UNAVAILABLE", "Tunnel creation is temporarily unavailable, try again later"}
+
+// tunnelLimitError reports that a client already holds limit tunnels.
+func tunnelLimitError(limit int) *tunnelError {
+	return &tunnelError{"TUNNEL_LIMIT_REACHED", fmt.Sprintf("Maximum of %d tunnels reached", limit)}
+}
+
+// createTunnel validates a tunnel request payload, records the tunnel in the
+// database and registers it. Either both the database row and the registry
+// entry exist afterwards, or neither does.
+//
+// Returns:
+//   - *registry.TunnelInfo: The registered tunnel
+//   - *tunnelError: Error to report to the client, if creation failed
+func (h *Handler) createTunnel(ctx context.Context, conn registry.ControlConn, identity *auth.Identity, payload map[string]interface{}) (*registry.TunnelInfo, *tunnelError) {
+	clientID := identity.ClientID
+	subdomain, _ := payload["subdomain"].(string)
+	protocolType, _ := payload["protocol"].(string)
 	protocolType = strings.ToLower(protocolType)
-	localPort, _ := msg.Payload["local_port"].(float64)
-	localHost, _ := msg.Payload["local_host"].(string)
+	rawLocalPort, hasLocalPort := payload["local_port"]
+	localHost, _ := payload["local_host"].(string)
 	if localHost == "" {
 		localHost = "localhost"
 	}
+	routing, _ := payload["routing"].(string)
+	sniRouting := routing == "sni"
 
-	if subdomain == "" || protocolType == "" || localPort == 0 {
-		h.sendError(conn, msg.RequestID, "INVALID_REQUEST", "Missing required fields")
-		return
+	if protocolType == "" || !hasLocalPort {
+		return nil, &tunnelError{"INVALID_REQUEST", "Missing required fields"}
+	}
+	if !identity.AllowsScope(protocolType) {
+		return nil, &tunnelError{"SCOPE_DENIED", fmt.Sprintf("This client may not open %s tunnels", protocolType)}
+	}
+	subdomain, tunnelErr := h.resolveSubdomain(ctx, protocolType, subdomain)
+	if tunnelErr != nil {
+		return nil, tunnelErr
+	}
+	if subdomain == "" {
+		return nil, &tunnelError{"INVALID_REQUEST", "Missing required fields"}
 	}
 
-	existing, _ := h.repo.GetTunnelBySubdomain(subdomain)
-	if existing != nil {
-		h.sendError(conn, msg.RequestID, "SUBDOMAIN_TAKEN", fmt.Sprintf("Subdomain %s is already in use", subdomain))
-		return
+	localPort, err := parseLocalPort(rawLocalPort)
+	if err != nil {
+		return nil, &tunnelError{"INVALID_LOCAL_PORT", err.Error()}
+	}
+	if err := validateLocalHost(localHost); err != nil {
+		return nil, &tunnelError{"INVALID_LOCAL_HOST", err.Error()}
+	}
+	localScheme, err := parseLocalScheme(payload)
+	if err != nil {
+		return nil, &tunnelError{"INVALID_REQUEST", err.Error()}
+	}
+	ttl, err := h.parseTTL(payload)
+	if err != nil {
+		return nil, &tunnelError{"INVALID_TTL", err.Error()}
+	}
+
+	var maxStreams int
+	var compression string
+	if protocolType == "grpc" {
+		maxStreams, compression, err = parseGRPCOptions(payload, h.grpcMaxStreams)
+		if err != nil {
+			return nil, &tunnelError{"INVALID_GRPC_OPTIONS", err.Error()}
+		}
+	}
+	pooled, weight, err := parsePoolOptions(payload, protocolType)
+	if err != nil {
+		return nil, &tunnelError{"INVALID_POOL_OPTIONS", err.Error()}
+	}
+	stripPrefix, addPrefix, err := parsePathPrefixes(payload, protocolType)
+	if err != nil {
+		return nil, &tunnelError{"INVALID_PATH_PREFIX", err.Error()}
+	}
+	rewriteLocation := true
+	if raw, ok := payload["rewrite_location"]; ok {
+		if rewriteLocation, ok = raw.(bool); !ok {
+			return nil, &tunnelError{"INVALID_REQUEST", "rewrite_location must be a boolean"}
+		}
+	}
+	rewriteCookies := false
+	if raw, ok := payload["rewrite_cookies"]; ok {
+		if rewriteCookies, ok = raw.(bool); !ok {
+			return nil, &tunnelError{"INVALID_REQUEST", "rewrite_cookies must be a boolean"}
+		}
+	}
+	grpcWeb := false
+	if raw, ok := payload["grpc_web"]; ok {
+		if grpcWeb, ok = raw.(bool); !ok {
+			return nil, &tunnelError{"INVALID_GRPC_OPTIONS", "grpc_web must be a boolean"}
+		}
+		if grpcWeb && protocolType != "grpc" {
+			return nil, &tunnelError{"INVALID_GRPC_OPTIONS", "grpc_web is only supported for grpc tunnels"}
+		}
+	}
+
+	if !identity.AllowsSubdomain(subdomain) {
+		return nil, &tunnelError{"SUBDOMAIN_NOT_ALLOWED", fmt.Sprintf("Subdomain %s is not allowed for this client", subdomain)}
+	}
+
+	clientLimit := 0
+	if h.enforceMaxTunnels {
+		clientLimit = identity.MaxTunnels
+	}
+
+	if h.quotas != nil {
+		exceeded, err := h.quotas.Check(ctx, clientID, identity.MonthlyByteQuota)
+		if errors.Is(err, database.ErrUnavailable) {
+			return nil, errServiceUnavailable
+		}
+		if err != nil {
+			log.Printf("Failed to check quota of client %s: %v", clientID, err)
+		}
+		if exceeded {
+			return nil, &tunnelError{"QUOTA_EXCEEDED", "Monthly byte quota exceeded"}
+		}
+	}
+
+	if primary, exists := h.registry.GetBySubdomain(subdomain); exists && primary.Pooled {
+		return h.joinPool(conn, primary, &registry.TunnelInfo{
+			ClientID:  clientID,
+			Subdomain: subdomain,
+			Protocol:  protocolType,
+			LocalPort: localPort,
+			LocalHost: localHost,
+			Pooled:    pooled,
+			Weight:    weight,
+
+			LocalScheme: localScheme,
+			ClientLimit: clientLimit,
+
+			StripPathPrefix:  stripPrefix,
+			AddPathPrefix:    addPrefix,
+			PreserveLocation: !rewriteLocation,
+			RewriteCookies:   rewriteCookies,
+		}, payload, ttl)
+	}
+
+	existing, err := h.repo.GetTunnelBySubdomainContext(ctx, subdomain)
+	if errors.Is(err, database.ErrUnavailable) {
+		return nil, errServiceUnavailable
+	}
+	takeover := h.isTakeover(conn, clientID, subdomain, existing)
+	if existing != nil && !takeover {
+		return nil, &tunnelError{"SUBDOMAIN_TAKEN", fmt.Sprintf("Subdomain %s is already in use", subdomain)}
 	}
 
 	tunnelID := uuid.New().String()
@@ -245,13 +973,22 @@ func (h *Handler) handleTunnelRequest(conn *websocket.Conn, clientID string, msg
 	switch protocolType {
 	case "http", "https":
 		publicURL = fmt.Sprintf("https://%s.%s", subdomain, h.domain)
+	case "tcp":
+		if sniRouting {
+			if h.sniPort == 0 {
+				return nil, &tunnelError{"SNI_ROUTING_DISABLED", "SNI routing is not enabled on this server"}
+			}
+			publicURL = fmt.Sprintf("tls://%s.%s:%d", subdomain, h.domain, h.sniPort)
+			break
+		}
+		fallthrough
 	default:
-		var err error
-		publicPort, err = h.assignPublicPort(msg.Payload)
-		if err != nil {
-			h.sendError(conn, msg.RequestID, "PORT_ALLOCATION_FAILED", err.Error())
-			return
+		var portErr *tunnelError
+		if publicPort, portErr = h.assignPublicPort(ctx, clientID, subdomain, payload); portErr != nil {
+			return nil, portErr
 		}
+		// Once registered the tunnel holds the port; on failure it is free.
+		defer h.portAllocator.settle(publicPort)
 	}
 
 	tunnel := &database.Tunnel{
@@ -259,16 +996,28 @@ func (h *Handler) handleTunnelRequest(conn *websocket.Conn, clientID string, msg
 		ClientID:   clientID,
 		Subdomain:  subdomain,
 		Protocol:   protocolType,
-		LocalPort:  int(localPort),
+		LocalPort:  localPort,
 		PublicURL:  publicURL,
 		PublicPort: publicPort,
 		Status:     "active",
 	}
 
-	if err := h.repo.CreateTunnel(tunnel); err != nil {
+	if existing != nil {
+		// Only one active row may exist per subdomain.
+		if err := h.repo.CloseTunnelContext(ctx, existing.ID); err != nil {
+			log.Printf("Failed to close replaced tunnel %s in database: %v", existing.ID, err)
+			if errors.Is(err, database.ErrUnavailable) {
+				return nil, errServiceUnavailable
+			}
+			return nil, &tunnelError{"INTERNAL_ERROR", "Failed to create tunnel"}
+		}
+	}
+	if err := h.repo.CreateTunnelContext(ctx, tunnel); err != nil {
 		log.Printf("Failed to create tunnel in database: %v", err)
-		h.sendError(conn, msg.RequestID, "INTERNAL_ERROR", "Failed to create tunnel")
-		return
+		if errors.Is(err, database.ErrUnavailable) {
+			return nil, errServiceUnavailable
+		}
+		return nil, &tunnelError{"INTERNAL_ERROR", "Failed to create tunnel"}
 	}
 
 	tunnelInfo := &registry.TunnelInfo{
@@ -276,66 +1025,225 @@ func (h *Handler) handleTunnelRequest(conn *websocket.Conn, clientID string, msg
 		ClientID:    clientID,
 		Subdomain:   subdomain,
 		Protocol:    protocolType,
-		LocalPort:   int(localPort),
+		LocalPort:   localPort,
 		LocalHost:   localHost,
+		LocalScheme: localScheme,
 		PublicURL:   publicURL,
 		PublicPort:  publicPort,
+		MaxStreams:  maxStreams,
+		Compression: compression,
+		SNIRouting:  sniRouting,
 		ControlConn: conn,
+		Pooled:      pooled,
+		Weight:      weight,
+		ClientLimit: clientLimit,
+
+		StripPathPrefix:  stripPrefix,
+		AddPathPrefix:    addPrefix,
+		PreserveLocation: !rewriteLocation,
+		RewriteCookies:   rewriteCookies,
+		GRPCWeb:          grpcWeb,
 	}
+	h.applyConnOptions(tunnelInfo, payload, ttl)
 
-	if err := h.registry.Register(tunnelInfo); err != nil {
+	var replaced *registry.TunnelInfo
+	if takeover {
+		replaced, err = h.registry.Takeover(tunnelInfo)
+	} else {
+		err = h.registry.Register(tunnelInfo)
+	}
+	if err != nil {
 		h.repo.CloseTunnel(tunnelID)
-		h.sendError(conn, msg.RequestID, "REGISTRATION_FAILED", err.Error())
-		return
+		if errors.Is(err, registry.ErrClaimed) {
+			return nil, &tunnelError{"SUBDOMAIN_TAKEN", fmt.Sprintf("Subdomain %s is already in use", subdomain)}
+		}
+		if errors.Is(err, registry.ErrTunnelLimit) {
+			return nil, tunnelLimitError(clientLimit)
+		}
+		return nil, &tunnelError{"REGISTRATION_FAILED", err.Error()}
+	}
+	if replaced != nil {
+		if existing == nil || replaced.ID != existing.ID {
+			h.repo.CloseTunnel(replaced.ID)
+		}
+		h.notifyClosed(replaced, "replaced")
+		h.notifyTunnelEvent(webhook.EventTunnelClosed, replaced, "replaced")
+		log.Printf("Tunnel %s taken over by a new connection of client %s", subdomain, clientID)
 	}
 
-	go h.waitForMuxConnection(tunnelInfo)
+	if ttl > 0 {
+		h.scheduleExpiry(tunnelInfo, ttl)
+	}
 
-	respPayload := map[string]interface{}{
-		"tunnel_id": tunnelID,
-		"status":    "active",
+	if publicPort > 0 {
+		log.Printf("Tunnel created: port %d -> %s (client: %s)", publicPort, subdomain, clientID)
+	} else {
+		log.Printf("Tunnel created: %s -> %s (client: %s)", publicURL, subdomain, clientID)
 	}
-	if publicURL != "" {
-		respPayload["public_url"] = publicURL
+	h.notifyTunnelEvent(webhook.EventTunnelCreated, tunnelInfo, "")
+	return tunnelInfo, nil
+}
+
+// joinPool adds member to the pool served by primary. The member shares the
+// ID, database row and public URL of the pool; only a pooled request of the
+// same client and protocol, over a connection that is not a member yet, may
+// join.
+//
+// Returns:
+//   - *registry.TunnelInfo: The registered member
+//   - *tunnelError: Error to report to the client, if it may not join
+func (h *Handler) joinPool(conn registry.ControlConn, primary, member *registry.TunnelInfo, payload map[string]interface{}, ttl time.Duration) (*registry.TunnelInfo, *tunnelError) {
+	taken := &tunnelError{"SUBDOMAIN_TAKEN", fmt.Sprintf("Subdomain %s is already in use", member.Subdomain)}
+	if !member.Pooled || member.ClientID != primary.ClientID || member.Protocol != primary.Protocol {
+		return nil, taken
 	}
-	if publicPort > 0 {
-		respPayload["public_port"] = publicPort
+	for _, existing := range h.registry.PoolMembers(member.Subdomain) {
+		if existing.ControlConn == conn {
+			return nil, taken
+		}
+	}
+	if member.StripPathPrefix != primary.StripPathPrefix || member.AddPathPrefix != primary.AddPathPrefix {
+		return nil, &tunnelError{"INVALID_POOL_OPTIONS", "strip_path_prefix and add_path_prefix must match the other members of the pool"}
 	}
 
-	responseType := protocol.MsgTypeTunnelResp
-	switch protocolType {
-	case "tcp":
-		responseType = protocol.MsgTypeTCPResp
-	case "grpc":
-		responseType = protocol.MsgTypeGRPCResp
+	member.ID = primary.ID
+	member.PublicURL = primary.PublicURL
+	member.ControlConn = conn
+	h.applyConnOptions(member, payload, ttl)
+	if err := h.registry.JoinPool(member); err != nil {
+		if errors.Is(err, registry.ErrTunnelLimit) {
+			return nil, tunnelLimitError(member.ClientLimit)
+		}
+		return nil, taken
+	}
+	if ttl > 0 {
+		h.scheduleExpiry(member, ttl)
 	}
 
-	response := protocol.NewControlMessage(
-		responseType,
-		msg.RequestID,
-		respPayload,
-	)
+	log.Printf("Tunnel joined pool: %s -> %s (client: %s, weight: %d)", member.PublicURL, member.Subdomain, member.ClientID, member.Weight)
+	h.notifyTunnelEvent(webhook.EventTunnelCreated, member, "")
+	return member, nil
+}
 
-	if err := conn.WriteJSON(response); err != nil {
-		log.Printf("Failed to send tunnel response: %v", err)
-		h.registry.Unregister(subdomain)
-		h.repo.CloseTunnel(tunnelID)
+// applyConnOptions sets the options of tunnel that are negotiated per
+// connection: stream compression and expiry.
+func (h *Handler) applyConnOptions(tunnel *registry.TunnelInfo, payload map[string]interface{}, ttl time.Duration) {
+	if h.streamCompression {
+		tunnel.StreamCompression = protocol.NegotiateStreamCompression(stringList(payload["stream_compression"]))
 	}
+	if ttl > 0 {
+		tunnel.ExpiresAt = time.Now().Add(ttl)
+	}
+}
 
-	if publicPort > 0 {
-		log.Printf("Tunnel created: port %d -> %s (client: %s)", publicPort, subdomain, clientID)
-	} else {
-		log.Printf("Tunnel created: %s -> %s (client: %s)", publicURL, subdomain, clientID)
+// isTakeover reports whether a request for subdomain comes from a client that
+// reconnected while its previous tunnel for the subdomain is still registered
+// on an older control connection, here or on another node, or still recorded
+// as active in the database.
+func (h *Handler) isTakeover(conn registry.ControlConn, clientID, subdomain string, existing *database.Tunnel) bool {
+	if local, exists := h.registry.GetBySubdomain(subdomain); exists {
+		return local.ClientID == clientID && local.ControlConn != conn
+	}
+	if existing != nil {
+		return existing.ClientID == clientID
+	}
+	owner, remote := h.registry.RemoteOwner(subdomain)
+	return remote && owner.ClientID == clientID
+}
+
+// tunnelResponsePayload describes a created tunnel to its client.
+func (h *Handler) tunnelResponsePayload(tunnel *registry.TunnelInfo) map[string]interface{} {
+	payload := map[string]interface{}{
+		"tunnel_id": tunnel.ID,
+		"subdomain": tunnel.Subdomain,
+		"status":    "active",
+	}
+	if tunnel.PublicURL != "" {
+		payload["public_url"] = tunnel.PublicURL
+	}
+	if tunnel.PublicPort > 0 {
+		payload["public_port"] = tunnel.PublicPort
+		payload["public_endpoint"] = h.publicEndpoint(tunnel.PublicPort)
+	}
+	if tunnel.SNIRouting {
+		payload["routing"] = "sni"
+	}
+	if !tunnel.ExpiresAt.IsZero() {
+		payload["expires_at"] = tunnel.ExpiresAt.Unix()
+	}
+	if tunnel.StreamCompression != "" {
+		payload["stream_compression"] = tunnel.StreamCompression
+	}
+	if tunnel.Protocol == "grpc" {
+		payload["max_streams"] = tunnel.MaxStreams
+		payload["compression"] = tunnel.Compression
+		if tunnel.GRPCWeb {
+			payload["grpc_web_url"] = fmt.Sprintf("https://%s.%s", tunnel.Subdomain, h.domain)
+		}
+	}
+	return payload
+}
+
+// startMuxWait waits in the background for the client to connect the mux
+// session of tunnel, then watches the session. The wait ends early when ctx
+// is done or the returned function is called, as when the tunnel response
+// could not be delivered.
+//
+// Returns:
+//   - context.CancelFunc: Cancels the wait
+func (h *Handler) startMuxWait(ctx context.Context, tunnel *registry.TunnelInfo) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		h.superviseMux(ctx, tunnel)
+	}()
+	return cancel
+}
+
+// superviseMux connects the mux session of tunnel and, whenever the session
+// closes while the control connection is still up, detaches it and asks the
+// client to connect a new one. Until then requests are answered with 503 as
+// for a connecting tunnel instead of failing with 502. A tunnel whose client
+// does not reconnect within the mux timeout is closed.
+func (h *Handler) superviseMux(ctx context.Context, tunnel *registry.TunnelInfo) {
+	reconnecting := false
+	for {
+		session := h.waitForMuxConnection(ctx, tunnel)
+		if session == nil {
+			if reconnecting && ctx.Err() == nil {
+				log.Printf("Closing tunnel %s: its mux session was not reconnected", tunnel.Subdomain)
+				h.closeTunnel(tunnel, "mux_session_closed")
+			}
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-session.CloseChan():
+		}
+		if ctx.Err() != nil || !h.registry.DetachMuxSession(tunnel, session) {
+			return
+		}
+		log.Printf("Mux session of tunnel %s closed, asking the client to reconnect it", tunnel.Subdomain)
+		reconnecting = true
 	}
 }
 
-func (h *Handler) waitForMuxConnection(tunnel *registry.TunnelInfo) {
-	listener, err := net.Listen("tcp", ":0")
+// waitForMuxConnection asks the client to connect the mux session of tunnel
+// to a new listener and attaches the session it connects, which it returns
+// (nil if none was attached). The listener is
+// closed when ctx is done, so the wait ends as soon as the control
+// connection goes away instead of after the mux timeout.
+func (h *Handler) waitForMuxConnection(ctx context.Context, tunnel *registry.TunnelInfo) *yamux.Session {
+	listener, err := net.Listen("tcp", net.JoinHostPort(h.muxBindHost, "0"))
 	if err != nil {
-		log.Printf("Failed to create listener for mux: %v", err)
-		return
+		log.Printf("Failed to create listener for mux on %s: %v", h.muxBindHost, err)
+		return nil
 	}
 	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
 
 	port := listener.Addr().(*net.TCPAddr).Port
 
@@ -346,40 +1254,48 @@ func (h *Handler) waitForMuxConnection(tunnel *registry.TunnelInfo) {
 			"action":    "establish_mux",
 			"tunnel_id": tunnel.ID,
 			"mux_port":  port,
-			"mux_addr":  fmt.Sprintf(":%d", port),
+			"mux_addr":  net.JoinHostPort(h.muxBindHost, strconv.Itoa(port)),
 		},
 	)
 
+	if ctx.Err() != nil {
+		return nil
+	}
 	if err := tunnel.ControlConn.WriteJSON(msg); err != nil {
 		log.Printf("Failed to send mux establishment message: %v", err)
-		return
+		return nil
 	}
 
-	listener.(*net.TCPListener).SetDeadline(time.Now().Add(30 * time.Second))
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(h.muxTimeout))
 
 	conn, err := listener.Accept()
 	if err != nil {
+		if ctx.Err() != nil {
+			log.Printf("Stopped waiting for the mux connection of tunnel %s", tunnel.Subdomain)
+			return nil
+		}
 		log.Printf("Failed to accept mux connection: %v", err)
-		return
+		return nil
 	}
 
 	session, err := yamux.Server(conn, nil)
 	if err != nil {
 		log.Printf("Failed to create yamux session: %v", err)
 		conn.Close()
-		return
+		return nil
 	}
 
-	if err := h.registry.SetMuxSession(tunnel.Subdomain, session); err != nil {
+	if err := h.registry.AttachMuxSession(tunnel, session); err != nil {
 		log.Printf("Failed to set mux session: %v", err)
 		session.Close()
-		return
+		return nil
 	}
 
 	log.Printf("Mux session established for tunnel: %s", tunnel.Subdomain)
+	return session
 }
 
-func (h *Handler) handleHeartbeat(conn *websocket.Conn, msg *protocol.ControlMessage) {
+func (h *Handler) handleHeartbeat(conn registry.ControlConn, msg *protocol.ControlMessage) {
 	response := protocol.NewControlMessage(
 		protocol.MsgTypeHeartbeat,
 		msg.RequestID,
@@ -390,18 +1306,23 @@ func (h *Handler) handleHeartbeat(conn *websocket.Conn, msg *protocol.ControlMes
 	conn.WriteJSON(response)
 }
 
-func (h *Handler) sendError(conn *websocket.Conn, requestID, code, message string) {
+func (h *Handler) sendError(conn registry.ControlConn, requestID, code, message string) {
 	errMsg := protocol.NewErrorMessage(requestID, code, message)
 	if err := conn.WriteJSON(errMsg); err != nil {
 		log.Printf("Failed to send error message: %v", err)
 	}
 }
 
-func (h *Handler) cleanupClient(clientID string) {
+// cleanupClient closes the tunnels created over conn. Tunnels the client has
+// already taken over from a newer connection are left alone.
+func (h *Handler) cleanupClient(clientID string, conn registry.ControlConn) {
 	tunnels := h.registry.GetByClient(clientID)
 	for _, tunnel := range tunnels {
-		h.registry.Unregister(tunnel.Subdomain)
-		h.repo.CloseTunnel(tunnel.ID)
+		if tunnel.ControlConn != conn || !h.registry.UnregisterTunnel(tunnel) {
+			continue
+		}
+		h.closeRecord(tunnel)
+		h.notifyTunnelEvent(webhook.EventTunnelClosed, tunnel, "client_disconnected")
 		log.Printf("Cleaned up tunnel: %s", tunnel.Subdomain)
 	}
 }
@@ -1,10 +1,14 @@
 package control
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"testing"
 
+	"github.com/essajiwa/tunnelab/internal/server/auth"
 	"github.com/essajiwa/tunnelab/internal/server/registry"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
 )
 
 func TestPortAllocatorAllocateSkipsUsedPorts(t *testing.T) {
@@ -66,3 +70,433 @@ func TestPortAllocatorAllocateExhaustedRange(t *testing.T) {
 		t.Fatal("expected allocation to fail when range is exhausted")
 	}
 }
+
+func TestPortAllocatorStrategies(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     []int
+	}{
+		// The second assigned port is freed after the first three allocations.
+		{PortAllocationSequential, []int{50000, 50001, 50002, 50001, 50003}},
+		{PortAllocationRoundRobin, []int{50000, 50001, 50002, 50003, 50001}},
+		// The random offsets are 2, 0, 2, 1 and 3; taken ports are skipped.
+		{PortAllocationRandom, []int{50002, 50000, 50003, 50001, 50000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			h := NewHandler(registry.NewRegistry(), nil, "tunnel.example.com")
+			if err := h.ConfigurePortAllocator("50000-50003", tt.strategy); err != nil {
+				t.Fatalf("failed to configure allocator: %v", err)
+			}
+			offsets := []int{2, 0, 2, 1, 3}
+			h.portAllocator.randIntN = func(n int) int {
+				offset := offsets[0]
+				offsets = offsets[1:]
+				return offset
+			}
+
+			var got []int
+			for i := range tt.want {
+				if i == 3 {
+					h.registry.Unregister("sub-1")
+				}
+				port, err := h.portAllocator.allocate(h.registry)
+				if err != nil {
+					t.Fatalf("allocation %d failed: %v", i, err)
+				}
+				got = append(got, port)
+				if err := h.registry.Register(&registry.TunnelInfo{
+					ID:         fmt.Sprintf("tunnel-%d", i),
+					ClientID:   "client",
+					Subdomain:  fmt.Sprintf("sub-%d", i),
+					PublicPort: port,
+				}); err != nil {
+					t.Fatalf("failed to register allocated port: %v", err)
+				}
+				h.portAllocator.settle(port)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("expected ports %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReleasedPortIsReusedOnNextAllocation(t *testing.T) {
+	h := newTestHandler(t)
+	if err := h.ConfigurePortAllocator("50000-50009", PortAllocationRoundRobin); err != nil {
+		t.Fatalf("failed to configure allocator: %v", err)
+	}
+	h.registry.UnregisterHook = h.ReleasePort
+
+	allocate := func(i int) int {
+		t.Helper()
+		port, err := h.assignPublicPort(context.Background(), "client", fmt.Sprintf("sub-%d", i), map[string]interface{}{})
+		if err != nil {
+			t.Fatalf("allocation %d failed: %v", i, err)
+		}
+		if err := h.registry.Register(&registry.TunnelInfo{
+			ID:         fmt.Sprintf("tunnel-%d", i),
+			ClientID:   "client",
+			Subdomain:  fmt.Sprintf("sub-%d", i),
+			PublicPort: port,
+		}); err != nil {
+			t.Fatalf("failed to register allocated port: %v", err)
+		}
+		return port
+	}
+	for i := 0; i < 3; i++ {
+		allocate(i)
+	}
+
+	h.registry.Unregister("sub-1")
+	if port := allocate(3); port != 50001 {
+		t.Fatalf("expected released port 50001 to be reused, got %d", port)
+	}
+	if port := allocate(4); port != 50003 {
+		t.Fatalf("expected allocation to continue at 50003 once no port is released, got %d", port)
+	}
+}
+
+func TestConcurrentPortAssignmentsNeverCollide(t *testing.T) {
+	for _, strategy := range []string{PortAllocationSequential, PortAllocationRoundRobin, PortAllocationRandom} {
+		t.Run(strategy, func(t *testing.T) {
+			h := newTestHandler(t)
+			if err := h.ConfigurePortAllocator("51000-51049", strategy); err != nil {
+				t.Fatalf("failed to configure port allocator: %v", err)
+			}
+
+			// None of the ports is registered, so only the pending state
+			// keeps them apart.
+			const workers = 50
+			ports := make([]int, workers)
+			errs := make([]*tunnelError, workers)
+			var wg sync.WaitGroup
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					ports[i], errs[i] = h.assignPublicPort(context.Background(), "client", fmt.Sprintf("sub-%d", i), map[string]interface{}{})
+				}(i)
+			}
+			wg.Wait()
+
+			seen := make(map[int]int)
+			for i, port := range ports {
+				if errs[i] != nil {
+					t.Fatalf("assignment %d failed: %+v", i, errs[i])
+				}
+				if other, dup := seen[port]; dup {
+					t.Fatalf("port %d assigned to both sub-%d and sub-%d", port, other, i)
+				}
+				seen[port] = i
+			}
+
+			if _, err := h.assignPublicPort(context.Background(), "client", "extra", map[string]interface{}{}); err == nil {
+				t.Fatal("expected the range to be exhausted while every port is pending")
+			}
+			h.portAllocator.settle(ports[7])
+			if port, err := h.assignPublicPort(context.Background(), "client", "extra", map[string]interface{}{}); err != nil || port != ports[7] {
+				t.Fatalf("expected the settled port %d to be assigned again, got %d (%+v)", ports[7], port, err)
+			}
+		})
+	}
+}
+
+func TestConcurrentTCPTunnelsGetDistinctPorts(t *testing.T) {
+	h := newTestHandler(t)
+	if err := h.ConfigurePortAllocator("52000-52019", PortAllocationSequential); err != nil {
+		t.Fatalf("failed to configure port allocator: %v", err)
+	}
+	identity := &auth.Identity{ClientID: "client"}
+
+	const workers = 20
+	tunnels := make([]*registry.TunnelInfo, workers)
+	errs := make([]*tunnelError, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := map[string]interface{}{"subdomain": fmt.Sprintf("db-%d", i), "protocol": "tcp", "local_port": float64(5432)}
+			tunnels[i], errs[i] = h.createTunnel(context.Background(), newRecordingConn(), identity, payload)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, tunnel := range tunnels {
+		if errs[i] != nil {
+			t.Fatalf("tunnel %d failed: %+v", i, errs[i])
+		}
+		registered, exists := h.registry.GetByPort(tunnel.PublicPort)
+		if !exists || registered.Subdomain != tunnel.Subdomain {
+			t.Fatalf("expected port %d to serve %s, got %+v", tunnel.PublicPort, tunnel.Subdomain, registered)
+		}
+	}
+	if n := len(h.portAllocator.pending); n != 0 {
+		t.Fatalf("expected no pending ports once the tunnels are registered, got %d", n)
+	}
+}
+
+func TestRequestedPortIsTakenOnce(t *testing.T) {
+	reg := registry.NewRegistry()
+	allocator := &portAllocator{start: 30000, end: 30001, next: 30000}
+
+	if !allocator.take(reg, 30000) {
+		t.Fatal("expected a free port to be taken")
+	}
+	if allocator.take(reg, 30000) {
+		t.Fatal("expected a pending port not to be taken twice")
+	}
+	if port, err := allocator.allocate(reg); err != nil || port != 30001 {
+		t.Fatalf("expected allocation to skip the pending port, got %d (%v)", port, err)
+	}
+	allocator.settle(30000)
+	if !allocator.take(reg, 30000) {
+		t.Fatal("expected a settled port that was never registered to be free again")
+	}
+}
+
+func TestConfigurePortAllocatorRejectsUnknownStrategy(t *testing.T) {
+	h := NewHandler(registry.NewRegistry(), nil, "tunnel.example.com")
+	if err := h.ConfigurePortAllocator("50000-50003", "lowest"); err == nil {
+		t.Fatal("expected an unknown strategy to be rejected")
+	}
+}
+
+func TestStreamCompressionNegotiation(t *testing.T) {
+	identity := &auth.Identity{ClientID: "client"}
+	payload := func(subdomain string) map[string]interface{} {
+		return map[string]interface{}{
+			"subdomain":          subdomain,
+			"protocol":           "http",
+			"local_port":         float64(3000),
+			"stream_compression": []interface{}{"zstd", "deflate"},
+		}
+	}
+
+	h := newTestHandler(t)
+	tunnel, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), identity, payload("plain"))
+	if tunnelErr != nil {
+		t.Fatalf("failed to create tunnel: %v", tunnelErr.Message)
+	}
+	if tunnel.StreamCompression != "" {
+		t.Fatalf("expected no compression while disabled, got %q", tunnel.StreamCompression)
+	}
+	if _, ok := h.tunnelResponsePayload(tunnel)["stream_compression"]; ok {
+		t.Fatal("response should omit stream_compression while disabled")
+	}
+
+	h.EnableStreamCompression()
+	tunnel, tunnelErr = h.createTunnel(context.Background(), newRecordingConn(), identity, payload("packed"))
+	if tunnelErr != nil {
+		t.Fatalf("failed to create tunnel: %v", tunnelErr.Message)
+	}
+	if tunnel.StreamCompression != protocol.StreamCompressionDeflate {
+		t.Fatalf("expected deflate, got %q", tunnel.StreamCompression)
+	}
+	if got := h.tunnelResponsePayload(tunnel)["stream_compression"]; got != protocol.StreamCompressionDeflate {
+		t.Fatalf("expected deflate in response, got %v", got)
+	}
+}
+
+func TestPublicEndpoint(t *testing.T) {
+	h := newTestHandler(t)
+	if got := h.publicEndpoint(32001); got != "tunnel.example.com:32001" {
+		t.Fatalf("expected the server domain by default, got %q", got)
+	}
+
+	h.SetPublicHost("tcp.example.com")
+	if got := h.publicEndpoint(32001); got != "tcp.example.com:32001" {
+		t.Fatalf("expected the configured public host, got %q", got)
+	}
+	h.SetPublicHost("2001:db8::1")
+	if got := h.publicEndpoint(32001); got != "[2001:db8::1]:32001" {
+		t.Fatalf("expected a bracketed IPv6 endpoint, got %q", got)
+	}
+
+	payload := h.tunnelResponsePayload(&registry.TunnelInfo{ID: "t-1", Protocol: "tcp", PublicPort: 32001})
+	if payload["public_endpoint"] != "[2001:db8::1]:32001" {
+		t.Fatalf("expected public_endpoint in the response, got %v", payload)
+	}
+	payload = h.tunnelResponsePayload(&registry.TunnelInfo{ID: "t-2", Protocol: "http", PublicURL: "https://app.tunnel.example.com"})
+	if _, ok := payload["public_endpoint"]; ok {
+		t.Fatalf("HTTP tunnels should not have a public_endpoint, got %v", payload)
+	}
+}
+
+func TestCreateTunnelRewriteLocationOption(t *testing.T) {
+	h := newTestHandler(t)
+	identity := &auth.Identity{ClientID: "client"}
+	payload := func(subdomain string, rewrite interface{}) map[string]interface{} {
+		p := map[string]interface{}{"subdomain": subdomain, "protocol": "http", "local_port": float64(3000)}
+		if rewrite != nil {
+			p["rewrite_location"] = rewrite
+		}
+		return p
+	}
+
+	tunnel, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), identity, payload("default", nil))
+	if tunnelErr != nil || tunnel.PreserveLocation {
+		t.Fatalf("expected Location rewriting by default, got %+v %+v", tunnel, tunnelErr)
+	}
+	tunnel, tunnelErr = h.createTunnel(context.Background(), newRecordingConn(), identity, payload("kept", false))
+	if tunnelErr != nil || !tunnel.PreserveLocation {
+		t.Fatalf("expected rewrite_location false to preserve Location, got %+v %+v", tunnel, tunnelErr)
+	}
+	if _, tunnelErr = h.createTunnel(context.Background(), newRecordingConn(), identity, payload("invalid", "no")); tunnelErr == nil || tunnelErr.Code != "INVALID_REQUEST" {
+		t.Fatalf("expected a non-boolean rewrite_location to be rejected, got %+v", tunnelErr)
+	}
+}
+
+func TestCreateTunnelEnforcesScopes(t *testing.T) {
+	h := newTestHandler(t)
+	if err := h.ConfigurePortAllocator("50000-50009", PortAllocationRoundRobin); err != nil {
+		t.Fatalf("failed to configure port allocator: %v", err)
+	}
+	identity := &auth.Identity{ClientID: "client", Scopes: auth.ParseScopes("http,grpc")}
+
+	tests := map[string]struct {
+		subdomain string
+		protocol  string
+		allowed   bool
+	}{
+		"http allowed": {subdomain: "web", protocol: "http", allowed: true},
+		"grpc allowed": {subdomain: "api", protocol: "GRPC", allowed: true},
+		"tcp denied":   {subdomain: "db", protocol: "tcp", allowed: false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			tunnel, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), identity, map[string]interface{}{
+				"subdomain": tt.subdomain, "protocol": tt.protocol, "local_port": float64(3000),
+			})
+			if tt.allowed && (tunnelErr != nil || tunnel == nil) {
+				t.Fatalf("expected the tunnel to be created, got %+v", tunnelErr)
+			}
+			if !tt.allowed && (tunnelErr == nil || tunnelErr.Code != "SCOPE_DENIED") {
+				t.Fatalf("expected SCOPE_DENIED, got %+v %+v", tunnel, tunnelErr)
+			}
+		})
+	}
+
+	// A client without scopes may open every protocol.
+	unscoped := &auth.Identity{ClientID: "client"}
+	if _, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), unscoped, map[string]interface{}{
+		"subdomain": "ssh", "protocol": "tcp", "local_port": float64(22),
+	}); tunnelErr != nil {
+		t.Fatalf("expected an unscoped client to open a tcp tunnel, got %+v", tunnelErr)
+	}
+}
+
+func TestCreateTunnelGRPCWebOption(t *testing.T) {
+	h := newTestHandler(t)
+	if err := h.ConfigurePortAllocator("50000-50009", PortAllocationRoundRobin); err != nil {
+		t.Fatalf("failed to configure port allocator: %v", err)
+	}
+	identity := &auth.Identity{ClientID: "client"}
+
+	tunnel, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), identity, map[string]interface{}{
+		"subdomain": "api", "protocol": "grpc", "local_port": float64(50051), "grpc_web": true,
+	})
+	if tunnelErr != nil || !tunnel.GRPCWeb {
+		t.Fatalf("expected a gRPC-Web tunnel, got %+v %+v", tunnel, tunnelErr)
+	}
+	if got := h.tunnelResponsePayload(tunnel)["grpc_web_url"]; got != "https://api."+h.domain {
+		t.Fatalf("expected the gRPC-Web URL in the response, got %v", got)
+	}
+
+	tests := map[string]map[string]interface{}{
+		"http tunnel": {"subdomain": "web", "protocol": "http", "local_port": float64(3000), "grpc_web": true},
+		"not boolean": {"subdomain": "bad", "protocol": "grpc", "local_port": float64(50051), "grpc_web": "yes"},
+	}
+	for name, payload := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), identity, payload); tunnelErr == nil || tunnelErr.Code != "INVALID_GRPC_OPTIONS" {
+				t.Fatalf("expected INVALID_GRPC_OPTIONS, got %+v", tunnelErr)
+			}
+		})
+	}
+}
+
+func TestPublicPortSticksToClientAcrossRestarts(t *testing.T) {
+	h := newTestHandler(t)
+	if err := h.ConfigurePortAllocator("50000-50002", PortAllocationSequential); err != nil {
+		t.Fatalf("failed to configure port allocator: %v", err)
+	}
+	tcp := func(subdomain string) map[string]interface{} {
+		return map[string]interface{}{"subdomain": subdomain, "protocol": "tcp", "local_port": float64(5432)}
+	}
+	alice := &auth.Identity{ClientID: "alice"}
+	bob := &auth.Identity{ClientID: "bob"}
+
+	first, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), alice, tcp("first"))
+	if tunnelErr != nil {
+		t.Fatalf("failed to create tunnel: %+v", tunnelErr)
+	}
+	db, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), alice, tcp("db"))
+	if tunnelErr != nil || db.PublicPort != 50001 {
+		t.Fatalf("expected db on port 50001, got %+v %+v", db, tunnelErr)
+	}
+
+	// Closing "first" frees 50000, the lowest port, yet db keeps 50001.
+	h.registry.Unregister("first")
+	h.repo.CloseTunnel(first.ID)
+	h.registry.Unregister("db")
+	h.repo.CloseTunnel(db.ID)
+	again, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), alice, tcp("db"))
+	if tunnelErr != nil || again.PublicPort != 50001 {
+		t.Fatalf("expected db to get port 50001 back, got %+v %+v", again, tunnelErr)
+	}
+
+	// After a restart, db is still active in the database but not registered.
+	restarted := NewHandler(registry.NewRegistry(), h.repo, h.domain)
+	if err := restarted.ConfigurePortAllocator("50000-50002", PortAllocationSequential); err != nil {
+		t.Fatalf("failed to configure port allocator: %v", err)
+	}
+	if reserved, err := restarted.RestorePortAssignments(context.Background()); err != nil || reserved != 1 {
+		t.Fatalf("expected 1 reserved port, got %d (%v)", reserved, err)
+	}
+	for _, subdomain := range []string{"cache", "queue"} {
+		tunnel, tunnelErr := restarted.createTunnel(context.Background(), newRecordingConn(), bob, tcp(subdomain))
+		if tunnelErr != nil || tunnel.PublicPort == 50001 {
+			t.Fatalf("expected %s not to get the reserved port, got %+v %+v", subdomain, tunnel, tunnelErr)
+		}
+	}
+	back, tunnelErr := restarted.createTunnel(context.Background(), newRecordingConn(), alice, tcp("db"))
+	if tunnelErr != nil || back.PublicPort != 50001 {
+		t.Fatalf("expected db to get port 50001 back after the restart, got %+v %+v", back, tunnelErr)
+	}
+}
+
+func TestPortAllocatorHandsOutReservedPortsLast(t *testing.T) {
+	reg := registry.NewRegistry()
+	allocator := &portAllocator{start: 30000, end: 30001, next: 30000, strategy: PortAllocationSequential}
+	allocator.reserve(30000, portOwner("alice", "db"))
+
+	tests := map[string]struct {
+		owner string
+		want  bool
+	}{
+		"other owner": {owner: portOwner("bob", "db"), want: false},
+		"same client": {owner: portOwner("alice", "web"), want: false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := allocator.claim(reg, 30000, tt.owner); got != tt.want {
+				t.Fatalf("expected claim %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	port, err := allocator.allocate(reg)
+	if err != nil || port != 30001 {
+		t.Fatalf("expected the unreserved port first, got %d (%v)", port, err)
+	}
+	reg.Register(&registry.TunnelInfo{ID: "t1", ClientID: "bob", Subdomain: "cache", PublicPort: port})
+	if port, err = allocator.allocate(reg); err != nil || port != 30000 {
+		t.Fatalf("expected the reserved port once the range is full, got %d (%v)", port, err)
+	}
+	if _, reserved := allocator.reserved[30000]; reserved {
+		t.Fatal("expected a handed out reservation to be dropped")
+	}
+}
@@ -0,0 +1,109 @@
+package control
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// newTestHandler returns a Handler backed by a fresh SQLite database.
+func newTestHandler(t *testing.T) *Handler {
+	t.Helper()
+
+	// Tests create tunnels for identities that have no row in the clients
+	// table, as in JWT mode, so foreign keys are not enforced.
+	opts := database.DefaultOptions()
+	opts.ForeignKeys = false
+	repo, err := database.NewRepositoryWithOptions(filepath.Join(t.TempDir(), "tunnelab.db"), opts)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return NewHandler(registry.NewRegistry(), repo, "tunnel.example.com")
+}
+
+// recordingConn is a registry.ControlConn that keeps every message written to it.
+type recordingConn struct {
+	mu       sync.Mutex
+	messages []*protocol.ControlMessage
+	notify   chan struct{}
+}
+
+func newRecordingConn() *recordingConn {
+	return &recordingConn{notify: make(chan struct{}, 16)}
+}
+
+func (c *recordingConn) WriteJSON(v interface{}) error {
+	c.mu.Lock()
+	if msg, ok := v.(*protocol.ControlMessage); ok {
+		c.messages = append(c.messages, msg)
+	}
+	c.mu.Unlock()
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// find returns the first recorded message of the given type.
+func (c *recordingConn) find(msgType protocol.MessageType) *protocol.ControlMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, msg := range c.messages {
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+	return nil
+}
+
+// staticAuthenticator accepts a single token.
+type staticAuthenticator struct {
+	token string
+}
+
+func (a staticAuthenticator) Authenticate(token string) (*auth.Identity, error) {
+	if token != a.token {
+		return nil, auth.ErrInvalidToken
+	}
+	return &auth.Identity{ClientID: "client"}, nil
+}
+
+// dialControlServer serves h over WebSocket and connects a client to it.
+func dialControlServer(t *testing.T, h *Handler) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(h.HandleWebSocket))
+	t.Cleanup(server.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to dial control server: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// roundTrip sends msg and returns the next message from the server.
+func roundTrip(t *testing.T, ws *websocket.Conn, msg *protocol.ControlMessage) *protocol.ControlMessage {
+	t.Helper()
+	if err := ws.WriteJSON(msg); err != nil {
+		t.Fatalf("failed to send %s: %v", msg.Type, err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var resp protocol.ControlMessage
+	if err := ws.ReadJSON(&resp); err != nil {
+		t.Fatalf("failed to read reply to %s: %v", msg.Type, err)
+	}
+	return &resp
+}
@@ -0,0 +1,37 @@
+package control
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/iplimit"
+)
+
+func TestControlConnectionsAreLimitedPerIP(t *testing.T) {
+	h := newTestHandler(t)
+	limiter := iplimit.NewLimiter(1)
+	h.SetIPLimiter(limiter)
+
+	// An open control connection from the IP holds its only slot.
+	limiter.Acquire("192.0.2.1")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	h.HandleWebSocket(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 past the per-IP limit, got %d", rec.Code)
+	}
+
+	// Once it closes, a new connection gets as far as the upgrade, which
+	// fails here because the request is not a WebSocket handshake.
+	limiter.Release("192.0.2.1")
+	rec = httptest.NewRecorder()
+	h.HandleWebSocket(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected the connection to reach the upgrade, got %d", rec.Code)
+	}
+	if limiter.Count("192.0.2.1") != 0 {
+		t.Fatalf("expected the slot to be released, got %d", limiter.Count("192.0.2.1"))
+	}
+}
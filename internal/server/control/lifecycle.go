@@ -0,0 +1,101 @@
+package control
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+	"github.com/essajiwa/tunnelab/internal/server/webhook"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+)
+
+// parseTTL reads the optional ttl_seconds of a tunnel request.
+//
+// Returns:
+//   - time.Duration: The requested TTL, or zero when none was requested
+//   - error: Error if the TTL is not positive or exceeds the server maximum
+func (h *Handler) parseTTL(payload map[string]interface{}) (time.Duration, error) {
+	raw, ok := payload["ttl_seconds"]
+	if !ok {
+		return 0, nil
+	}
+	seconds, ok := raw.(float64)
+	if !ok || seconds <= 0 {
+		return 0, fmt.Errorf("ttl_seconds must be a positive number")
+	}
+	ttl := time.Duration(seconds * float64(time.Second))
+	if h.maxTTL > 0 && ttl > h.maxTTL {
+		return 0, fmt.Errorf("ttl_seconds must not exceed %d", int(h.maxTTL.Seconds()))
+	}
+	return ttl, nil
+}
+
+// scheduleExpiry closes tunnel once ttl has elapsed. Tunnels that were
+// already closed, or whose subdomain was reused, are left untouched.
+func (h *Handler) scheduleExpiry(tunnel *registry.TunnelInfo, ttl time.Duration) {
+	time.AfterFunc(ttl, func() {
+		if h.closeTunnel(tunnel, "expired") {
+			log.Printf("Tunnel expired: %s (client: %s)", tunnel.Subdomain, tunnel.ClientID)
+		}
+	})
+}
+
+// closeTunnel unregisters tunnel, closes its mux session, marks it closed in
+// the database and notifies the owning client.
+//
+// Returns:
+//   - bool: Whether the tunnel was still active and has been closed
+func (h *Handler) closeTunnel(tunnel *registry.TunnelInfo, reason string) bool {
+	if !h.registry.UnregisterTunnel(tunnel) {
+		return false
+	}
+	h.closeRecord(tunnel)
+	h.notifyClosed(tunnel, reason)
+	h.notifyTunnelEvent(webhook.EventTunnelClosed, tunnel, reason)
+	return true
+}
+
+// closeRecord marks the database row of an unregistered tunnel closed,
+// unless other members of its pool still serve the subdomain.
+func (h *Handler) closeRecord(tunnel *registry.TunnelInfo) {
+	if current, exists := h.registry.GetBySubdomain(tunnel.Subdomain); exists && current.ID == tunnel.ID {
+		return
+	}
+	if err := h.repo.CloseTunnel(tunnel.ID); err != nil {
+		log.Printf("Failed to close tunnel %s in database: %v", tunnel.ID, err)
+	}
+}
+
+// notifyClosed sends the owning client of tunnel a tunnel_closed message.
+func (h *Handler) notifyClosed(tunnel *registry.TunnelInfo, reason string) {
+	if tunnel.ControlConn != nil {
+		msg := protocol.NewControlMessage(
+			protocol.MsgTypeTunnelClosed,
+			tunnel.ID,
+			map[string]interface{}{
+				"tunnel_id": tunnel.ID,
+				"subdomain": tunnel.Subdomain,
+				"reason":    reason,
+			},
+		)
+		if err := tunnel.ControlConn.WriteJSON(msg); err != nil {
+			log.Printf("Failed to notify client %s of closed tunnel: %v", tunnel.ClientID, err)
+		}
+	}
+}
+
+// ForceClose closes the active tunnel for subdomain, or every member of its
+// pool, on behalf of an operator.
+//
+// Returns:
+//   - bool: Whether an active tunnel was found and closed
+func (h *Handler) ForceClose(subdomain string) bool {
+	closed := false
+	for _, tunnel := range h.registry.PoolMembers(subdomain) {
+		if h.closeTunnel(tunnel, "closed_by_admin") {
+			closed = true
+		}
+	}
+	return closed
+}
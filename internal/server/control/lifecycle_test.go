@@ -0,0 +1,238 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+)
+
+func TestTunnelIsReapedAtTTL(t *testing.T) {
+	h := newTestHandler(t)
+	conn := newRecordingConn()
+
+	if err := h.repo.CreateTunnel(&database.Tunnel{
+		ID: "tunnel-demo", ClientID: "client", Subdomain: "demo", Protocol: "http", LocalPort: 3000, Status: "active",
+	}); err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	tunnel := &registry.TunnelInfo{ID: "tunnel-demo", ClientID: "client", Subdomain: "demo", ControlConn: conn}
+	if err := h.registry.Register(tunnel); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+
+	h.scheduleExpiry(tunnel, 50*time.Millisecond)
+
+	if _, exists := h.registry.GetBySubdomain("demo"); !exists {
+		t.Fatal("tunnel was removed before its TTL")
+	}
+
+	deadline := time.After(2 * time.Second)
+	for conn.find(protocol.MsgTypeTunnelClosed) == nil {
+		select {
+		case <-conn.notify:
+		case <-deadline:
+			t.Fatal("client was not notified of the expired tunnel")
+		}
+	}
+
+	msg := conn.find(protocol.MsgTypeTunnelClosed)
+	if msg.Payload["tunnel_id"] != "tunnel-demo" || msg.Payload["reason"] != "expired" {
+		t.Fatalf("unexpected tunnel_closed payload: %v", msg.Payload)
+	}
+	if _, exists := h.registry.GetBySubdomain("demo"); exists {
+		t.Fatal("expected tunnel to be unregistered")
+	}
+	if active, _ := h.repo.GetTunnelBySubdomain("demo"); active != nil {
+		t.Fatal("expected tunnel to be closed in the database")
+	}
+}
+
+func TestExpiryIgnoresReusedSubdomain(t *testing.T) {
+	h := newTestHandler(t)
+	old := &registry.TunnelInfo{ID: "old", ClientID: "client", Subdomain: "demo"}
+	if err := h.registry.Register(old); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+	h.registry.Unregister("demo")
+
+	replacement := &registry.TunnelInfo{ID: "new", ClientID: "client", Subdomain: "demo"}
+	if err := h.registry.Register(replacement); err != nil {
+		t.Fatalf("failed to register replacement: %v", err)
+	}
+
+	if h.closeTunnel(old, "expired") {
+		t.Fatal("expected stale tunnel close to be a no-op")
+	}
+	if current, exists := h.registry.GetBySubdomain("demo"); !exists || current.ID != "new" {
+		t.Fatal("replacement tunnel must not be removed")
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	h := newTestHandler(t)
+	h.SetMaxTTL(time.Hour)
+
+	if ttl, err := h.parseTTL(map[string]interface{}{}); err != nil || ttl != 0 {
+		t.Fatalf("expected no TTL, got %v, %v", ttl, err)
+	}
+	if ttl, err := h.parseTTL(map[string]interface{}{"ttl_seconds": float64(60)}); err != nil || ttl != time.Minute {
+		t.Fatalf("expected 1m TTL, got %v, %v", ttl, err)
+	}
+	for _, value := range []interface{}{float64(0), float64(-5), float64(7200), "60"} {
+		if _, err := h.parseTTL(map[string]interface{}{"ttl_seconds": value}); err == nil {
+			t.Fatalf("expected ttl_seconds=%v to be rejected", value)
+		}
+	}
+}
+
+func TestForceClose(t *testing.T) {
+	h := newTestHandler(t)
+	conn := newRecordingConn()
+	if err := h.registry.Register(&registry.TunnelInfo{ID: "t1", ClientID: "client", Subdomain: "demo", ControlConn: conn}); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+
+	if !h.ForceClose("demo") {
+		t.Fatal("expected active tunnel to be closed")
+	}
+	if msg := conn.find(protocol.MsgTypeTunnelClosed); msg == nil || msg.Payload["reason"] != "closed_by_admin" {
+		t.Fatalf("expected client to be notified, got %+v", msg)
+	}
+	if h.ForceClose("demo") {
+		t.Fatal("expected closing a missing tunnel to report false")
+	}
+}
+
+// unreachableConn records messages like recordingConn, but fails to deliver
+// tunnel responses once the mux establishment message has been written.
+type unreachableConn struct {
+	*recordingConn
+}
+
+func (c unreachableConn) WriteJSON(v interface{}) error {
+	if msg, ok := v.(*protocol.ControlMessage); ok && msg.Type == protocol.MsgTypeTunnelResp {
+		deadline := time.After(2 * time.Second)
+		for c.find(protocol.MsgTypeNewConn) == nil {
+			select {
+			case <-c.notify:
+			case <-deadline:
+			}
+		}
+		return errors.New("connection reset by peer")
+	}
+	return c.recordingConn.WriteJSON(v)
+}
+
+func TestFailedTunnelResponseCancelsMuxWait(t *testing.T) {
+	h := newTestHandler(t)
+	conn := unreachableConn{newRecordingConn()}
+	msg := protocol.NewControlMessage(protocol.MsgTypeTunnelReq, "req-1", map[string]interface{}{
+		"subdomain":  "demo",
+		"protocol":   "http",
+		"local_port": float64(3000),
+	})
+
+	h.handleTunnelRequest(context.Background(), conn, &auth.Identity{ClientID: "client"}, msg)
+
+	if _, exists := h.registry.GetBySubdomain("demo"); exists {
+		t.Fatal("expected the tunnel to be unregistered after the response failed")
+	}
+	muxMsg := conn.find(protocol.MsgTypeNewConn)
+	if muxMsg == nil {
+		t.Fatal("expected the mux wait to have started")
+	}
+	port, _ := muxMsg.Payload["mux_port"].(int)
+
+	waitForPortReleased(t, port)
+}
+
+func TestDisconnectCancelsMuxWait(t *testing.T) {
+	h := newTestHandler(t)
+	h.SetAuthenticator(staticAuthenticator{token: "secret"})
+	ws := dialControlServer(t, h)
+
+	if resp := roundTrip(t, ws, protocol.NewControlMessage(protocol.MsgTypeAuth, "auth", map[string]interface{}{"token": "secret"})); resp.Type != protocol.MsgTypeAuthResponse {
+		t.Fatalf("expected auth response, got %s", resp.Type)
+	}
+	if err := ws.WriteJSON(protocol.NewControlMessage(protocol.MsgTypeTunnelReq, "req-1", map[string]interface{}{
+		"subdomain":  "demo",
+		"protocol":   "http",
+		"local_port": 3000,
+	})); err != nil {
+		t.Fatalf("failed to request tunnel: %v", err)
+	}
+
+	// The tunnel response and the mux establishment message may arrive in either order.
+	var port int
+	for i := 0; i < 2 && port == 0; i++ {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg protocol.ControlMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatalf("failed to read message: %v", err)
+		}
+		if msg.Type == protocol.MsgTypeNewConn {
+			value, _ := msg.Payload["mux_port"].(float64)
+			port = int(value)
+		}
+	}
+	if port == 0 {
+		t.Fatal("expected a mux establishment message")
+	}
+
+	ws.Close()
+	waitForPortReleased(t, port)
+}
+
+func TestMuxTimeoutAppliesToListenerDeadline(t *testing.T) {
+	h := newTestHandler(t)
+	h.SetMuxTimeout(100 * time.Millisecond)
+	conn := newRecordingConn()
+	tunnel := &registry.TunnelInfo{ID: "tunnel-demo", ClientID: "client", Subdomain: "demo", ControlConn: conn}
+	if err := h.registry.Register(tunnel); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.waitForMuxConnection(context.Background(), tunnel)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the mux wait to give up after the configured timeout")
+	}
+	muxMsg := conn.find(protocol.MsgTypeNewConn)
+	if muxMsg == nil {
+		t.Fatal("expected a mux establishment message")
+	}
+	port, _ := muxMsg.Payload["mux_port"].(int)
+	waitForPortReleased(t, port)
+}
+
+// waitForPortReleased fails the test unless the listener on port is closed
+// within a short time; the port can be bound again once it is.
+func waitForPortReleased(t *testing.T, port int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err == nil {
+			listener.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the mux listener on port %d to be closed", port)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,70 @@
+package control
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+)
+
+// handleListTunnels replies to list_tunnels with the active tunnels of the
+// client: those registered on this node and those recorded as active in the
+// database, which include tunnels served by other nodes of a cluster.
+func (h *Handler) handleListTunnels(ctx context.Context, conn registry.ControlConn, clientID string, msg *protocol.ControlMessage) {
+	summaries := make(map[string]protocol.TunnelSummary)
+	for _, tunnel := range h.registry.GetByClient(clientID) {
+		// Members of a pool share one ID; the pool is active if any member is.
+		if summary, listed := summaries[tunnel.ID]; listed && summary.Status == "active" {
+			continue
+		}
+		status := "connecting"
+		if h.registry.IsConnected(tunnel) {
+			status = "active"
+		}
+		summaries[tunnel.ID] = protocol.TunnelSummary{
+			TunnelID:   tunnel.ID,
+			Subdomain:  tunnel.Subdomain,
+			Protocol:   tunnel.Protocol,
+			PublicURL:  tunnel.PublicURL,
+			PublicPort: tunnel.PublicPort,
+			Status:     status,
+		}
+	}
+
+	records, err := h.repo.GetActiveTunnelsByClientContext(ctx, clientID)
+	if err != nil {
+		// The registry alone still describes the tunnels of this node.
+		log.Printf("Failed to list tunnels of client %s from database: %v", clientID, err)
+	}
+	for _, record := range records {
+		if _, listed := summaries[record.ID]; listed {
+			continue
+		}
+		summaries[record.ID] = protocol.TunnelSummary{
+			TunnelID:   record.ID,
+			Subdomain:  record.Subdomain,
+			Protocol:   record.Protocol,
+			PublicURL:  record.PublicURL,
+			PublicPort: record.PublicPort,
+			Status:     "active",
+		}
+	}
+
+	tunnels := make([]protocol.TunnelSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		tunnels = append(tunnels, summary)
+	}
+	slices.SortFunc(tunnels, func(a, b protocol.TunnelSummary) int {
+		return strings.Compare(a.Subdomain, b.Subdomain)
+	})
+
+	response := protocol.NewControlMessage(protocol.MsgTypeTunnelList, msg.RequestID, map[string]interface{}{
+		"tunnels": tunnels,
+	})
+	if err := conn.WriteJSON(response); err != nil {
+		log.Printf("Failed to send tunnel list to client %s: %v", clientID, err)
+	}
+}
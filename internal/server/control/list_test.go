@@ -0,0 +1,66 @@
+package control
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+	"github.com/hashicorp/yamux"
+)
+
+func TestListTunnelsReturnsOnlyCallersTunnels(t *testing.T) {
+	h := newTestHandler(t)
+	identity := &auth.Identity{ClientID: "client"}
+	conn := newRecordingConn()
+	for _, subdomain := range []string{"web", "api"} {
+		payload := map[string]interface{}{"subdomain": subdomain, "protocol": "http", "local_port": float64(3000)}
+		if _, tunnelErr := h.createTunnel(context.Background(), conn, identity, payload); tunnelErr != nil {
+			t.Fatalf("failed to create tunnel %s: %v", subdomain, tunnelErr)
+		}
+	}
+	other := map[string]interface{}{"subdomain": "other", "protocol": "http", "local_port": float64(3000)}
+	if _, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), &auth.Identity{ClientID: "someone-else"}, other); tunnelErr != nil {
+		t.Fatalf("failed to create tunnel of another client: %v", tunnelErr)
+	}
+	// A tunnel of the client served by another node is only in the database.
+	if err := h.repo.CreateTunnel(&database.Tunnel{ID: "remote-id", ClientID: "client", Subdomain: "db", Protocol: "tcp", LocalPort: 5432, PublicPort: 30001, Status: "active"}); err != nil {
+		t.Fatalf("failed to record remote tunnel: %v", err)
+	}
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	session, err := yamux.Server(serverSide, nil)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	defer session.Close()
+	web, _ := h.registry.GetBySubdomain("web")
+	api, _ := h.registry.GetBySubdomain("api")
+	if err := h.registry.AttachMuxSession(web, session); err != nil {
+		t.Fatalf("failed to attach session: %v", err)
+	}
+
+	h.handleMessage(context.Background(), conn, identity, protocol.NewControlMessage(protocol.MsgTypeListTunnels, "list-1", nil))
+
+	reply := conn.find(protocol.MsgTypeTunnelList)
+	if reply == nil || reply.RequestID != "list-1" {
+		t.Fatalf("expected a tunnel_list reply to list-1, got %+v", reply)
+	}
+	tunnels, _ := reply.Payload["tunnels"].([]protocol.TunnelSummary)
+	want := []protocol.TunnelSummary{
+		{TunnelID: api.ID, Subdomain: "api", Protocol: "http", PublicURL: "https://api.tunnel.example.com", Status: "connecting"},
+		{TunnelID: "remote-id", Subdomain: "db", Protocol: "tcp", PublicPort: 30001, Status: "active"},
+		{TunnelID: web.ID, Subdomain: "web", Protocol: "http", PublicURL: "https://web.tunnel.example.com", Status: "active"},
+	}
+	if len(tunnels) != len(want) {
+		t.Fatalf("expected %d tunnels, got %+v", len(want), tunnels)
+	}
+	for i, tunnel := range tunnels {
+		if tunnel != want[i] {
+			t.Fatalf("tunnel %d: expected %+v, got %+v", i, want[i], tunnel)
+		}
+	}
+}
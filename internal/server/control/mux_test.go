@@ -0,0 +1,135 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+	"github.com/hashicorp/yamux"
+)
+
+// muxRequests returns the mux establishment messages sent over conn.
+func muxRequests(conn *recordingConn) []*protocol.ControlMessage {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	var requests []*protocol.ControlMessage
+	for _, msg := range conn.messages {
+		if msg.Type == protocol.MsgTypeNewConn {
+			requests = append(requests, msg)
+		}
+	}
+	return requests
+}
+
+// waitFor fails the test unless cond holds within a short time.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClosedMuxSessionIsDetachedAndTunnelClosed(t *testing.T) {
+	h := newTestHandler(t)
+	h.SetMuxTimeout(300 * time.Millisecond)
+	conn := newRecordingConn()
+	tunnel := &registry.TunnelInfo{ID: "tunnel-demo", ClientID: "client", Subdomain: "demo", ControlConn: conn}
+	if err := h.registry.Register(tunnel); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.superviseMux(context.Background(), tunnel)
+		close(done)
+	}()
+
+	// The client connects the mux session it is asked for.
+	waitFor(t, "the mux establishment message", func() bool { return len(muxRequests(conn)) == 1 })
+	port, _ := muxRequests(conn)[0].Payload["mux_port"].(int)
+	muxConn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("failed to connect mux: %v", err)
+	}
+	client, err := yamux.Client(muxConn, nil)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	waitFor(t, "the session to be attached", func() bool { return h.registry.IsConnected(tunnel) })
+
+	// Its session dies while the control connection stays up.
+	client.Close()
+	waitFor(t, "the closed session to be detached", func() bool { return !h.registry.IsConnected(tunnel) })
+	if _, exists := h.registry.GetBySubdomain("demo"); !exists {
+		t.Fatal("expected the tunnel to stay registered while the client may reconnect")
+	}
+	if _, err := h.registry.OpenTunnelStream(tunnel); !errors.Is(err, registry.ErrMuxNotReady) {
+		t.Fatalf("expected requests to see a connecting tunnel, got %v", err)
+	}
+	waitFor(t, "a new mux establishment message", func() bool { return len(muxRequests(conn)) == 2 })
+
+	// The client never reconnects, so the tunnel is closed.
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected supervision to end once the reconnect timed out")
+	}
+	if _, exists := h.registry.GetBySubdomain("demo"); exists {
+		t.Fatal("expected the tunnel to be unregistered")
+	}
+	closed := conn.find(protocol.MsgTypeTunnelClosed)
+	if closed == nil || closed.Payload["reason"] != "mux_session_closed" {
+		t.Fatalf("expected the client to be told the tunnel closed, got %+v", closed)
+	}
+}
+
+func TestMuxListenerBindsConfiguredHost(t *testing.T) {
+	h := newTestHandler(t)
+	h.SetMuxBindHost("127.0.0.2")
+	conn := newRecordingConn()
+	tunnel := &registry.TunnelInfo{ID: "tunnel-demo", ClientID: "client", Subdomain: "demo", ControlConn: conn}
+	if err := h.registry.Register(tunnel); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.waitForMuxConnection(ctx, tunnel)
+	waitFor(t, "the mux establishment message", func() bool { return len(muxRequests(conn)) == 1 })
+
+	muxMsg := muxRequests(conn)[0]
+	port, _ := muxMsg.Payload["mux_port"].(int)
+	if want := net.JoinHostPort("127.0.0.2", strconv.Itoa(port)); muxMsg.Payload["mux_addr"] != want {
+		t.Fatalf("expected mux_addr %s, got %v", want, muxMsg.Payload["mux_addr"])
+	}
+	if other, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		other.Close()
+		t.Fatal("expected the mux port to be closed on other interfaces")
+	}
+	muxConn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.2", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("failed to dial the mux listener on the configured host: %v", err)
+	}
+	defer muxConn.Close()
+}
+
+func TestMuxListenerDefaultsToLoopback(t *testing.T) {
+	h := newTestHandler(t)
+	if h.muxBindHost != "127.0.0.1" {
+		t.Fatalf("expected the mux listener to bind to loopback by default, got %q", h.muxBindHost)
+	}
+	h.SetMuxBindHost("10.0.0.5")
+	h.SetMuxBindHost("")
+	if h.muxBindHost != "127.0.0.1" {
+		t.Fatalf("expected an empty host to restore loopback, got %q", h.muxBindHost)
+	}
+}
@@ -0,0 +1,130 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+)
+
+// Subdomain policies of SetSubdomainPolicy for HTTP(S) tunnels.
+const (
+	// SubdomainRequired rejects HTTP tunnel requests without a subdomain.
+	SubdomainRequired = "required"
+	// SubdomainOptional assigns a random subdomain when none is requested.
+	SubdomainOptional = "optional"
+	// SubdomainRandom always assigns a random subdomain; requesting one is an error.
+	SubdomainRandom = "random"
+)
+
+// Public port policies of SetPortPolicy for TCP and gRPC tunnels.
+const (
+	// PortRequest lets clients request a public_port inside the TCP port
+	// range. It is the default.
+	PortRequest = "request"
+	// PortAuto always allocates the public port; requesting one is an error,
+	// so clients cannot pick well-known ports from the range.
+	PortAuto = "auto"
+)
+
+// randomSubdomainLength is the length of assigned random subdomains, and
+// randomSubdomainAttempts how many are tried before giving up.
+const (
+	randomSubdomainLength   = 8
+	randomSubdomainAttempts = 10
+)
+
+// SetSubdomainPolicy decides whether HTTP(S) tunnels must request a
+// subdomain or get a random one.
+//
+// Parameters:
+//   - policy: SubdomainRequired, SubdomainOptional or SubdomainRandom; empty means required
+//
+// Returns:
+//   - error: If the policy is unknown
+func (h *Handler) SetSubdomainPolicy(policy string) error {
+	switch policy {
+	case "":
+		policy = SubdomainRequired
+	case SubdomainRequired, SubdomainOptional, SubdomainRandom:
+	default:
+		return fmt.Errorf("unknown subdomain policy %q", policy)
+	}
+	h.subdomainPolicy = policy
+	return nil
+}
+
+// SetPortPolicy decides whether TCP and gRPC tunnels may request a specific
+// public port or always get one from the port allocator.
+//
+// Parameters:
+//   - policy: PortRequest or PortAuto; empty means request
+//
+// Returns:
+//   - error: If the policy is unknown
+func (h *Handler) SetPortPolicy(policy string) error {
+	switch policy {
+	case "":
+		policy = PortRequest
+	case PortRequest, PortAuto:
+	default:
+		return fmt.Errorf("unknown port policy %q", policy)
+	}
+	h.portPolicy = policy
+	return nil
+}
+
+// resolveSubdomain applies the subdomain policy to the subdomain requested
+// for a tunnel of protocolType. Only HTTP(S) tunnels can get random
+// subdomains; other protocols always require one.
+//
+// Returns:
+//   - string: The subdomain to use ("" if none was requested and none is assigned)
+//   - *tunnelError: Error to report to the client
+func (h *Handler) resolveSubdomain(ctx context.Context, protocolType, requested string) (string, *tunnelError) {
+	if protocolType != "http" && protocolType != "https" {
+		return requested, nil
+	}
+	switch h.subdomainPolicy {
+	case SubdomainRandom:
+		if requested != "" {
+			return "", &tunnelError{"SUBDOMAIN_NOT_ALLOWED", "This server assigns random subdomains; omit subdomain"}
+		}
+	case SubdomainOptional:
+		if requested != "" {
+			return requested, nil
+		}
+	default:
+		return requested, nil
+	}
+
+	for i := 0; i < randomSubdomainAttempts; i++ {
+		candidate := randomSubdomain()
+		if _, exists := h.registry.GetBySubdomain(candidate); exists {
+			continue
+		}
+		existing, err := h.repo.GetTunnelBySubdomainContext(ctx, candidate)
+		if errors.Is(err, database.ErrUnavailable) {
+			return "", errServiceUnavailable
+		}
+		if existing == nil {
+			return candidate, nil
+		}
+	}
+	return "", &tunnelError{"INTERNAL_ERROR", "Failed to assign a subdomain"}
+}
+
+// randomSubdomain returns a random DNS label of lowercase letters and digits
+// that starts with a letter.
+func randomSubdomain() string {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	const alphanumeric = letters + "0123456789"
+	b := make([]byte, randomSubdomainLength)
+	b[0] = letters[rand.IntN(len(letters))]
+	for i := 1; i < len(b); i++ {
+		b[i] = alphanumeric[rand.IntN(len(alphanumeric))]
+	}
+	return string(b)
+}
@@ -0,0 +1,152 @@
+package control
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+)
+
+func TestSubdomainPolicy(t *testing.T) {
+	randomName := regexp.MustCompile(`^[a-z][a-z0-9]{7}$`)
+
+	tests := map[string]struct {
+		policy    string
+		protocol  string
+		subdomain string
+		want      string // "" expects a random subdomain
+		wantCode  string
+	}{
+		"required with subdomain":    {policy: SubdomainRequired, protocol: "http", subdomain: "app", want: "app"},
+		"required without subdomain": {policy: SubdomainRequired, protocol: "http", wantCode: "INVALID_REQUEST"},
+		"optional with subdomain":    {policy: SubdomainOptional, protocol: "http", subdomain: "app", want: "app"},
+		"optional without subdomain": {policy: SubdomainOptional, protocol: "https"},
+		"random without subdomain":   {policy: SubdomainRandom, protocol: "http"},
+		"random with subdomain":      {policy: SubdomainRandom, protocol: "http", subdomain: "app", wantCode: "SUBDOMAIN_NOT_ALLOWED"},
+		"random ignores tcp":         {policy: SubdomainRandom, protocol: "tcp", subdomain: "db", want: "db"},
+		"tcp without subdomain":      {policy: SubdomainOptional, protocol: "tcp", wantCode: "INVALID_REQUEST"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := newTestHandler(t)
+			if err := h.ConfigurePortAllocator("30000-30010", PortAllocationSequential); err != nil {
+				t.Fatalf("failed to configure port allocator: %v", err)
+			}
+			if err := h.SetSubdomainPolicy(tt.policy); err != nil {
+				t.Fatalf("SetSubdomainPolicy(%q) failed: %v", tt.policy, err)
+			}
+			payload := map[string]interface{}{"protocol": tt.protocol, "local_port": float64(3000)}
+			if tt.subdomain != "" {
+				payload["subdomain"] = tt.subdomain
+			}
+
+			tunnel, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), &auth.Identity{ClientID: "client"}, payload)
+			if tt.wantCode != "" {
+				if tunnelErr == nil || tunnelErr.Code != tt.wantCode {
+					t.Fatalf("expected %s, got %+v %+v", tt.wantCode, tunnel, tunnelErr)
+				}
+				return
+			}
+			if tunnelErr != nil {
+				t.Fatalf("expected tunnel to be created, got %+v", tunnelErr)
+			}
+			if tt.want != "" && tunnel.Subdomain != tt.want {
+				t.Fatalf("expected subdomain %q, got %q", tt.want, tunnel.Subdomain)
+			}
+			if tt.want == "" && !randomName.MatchString(tunnel.Subdomain) {
+				t.Fatalf("expected a random subdomain, got %q", tunnel.Subdomain)
+			}
+			if got := h.tunnelResponsePayload(tunnel)["subdomain"]; got != tunnel.Subdomain {
+				t.Fatalf("expected response subdomain %q, got %v", tunnel.Subdomain, got)
+			}
+		})
+	}
+}
+
+func TestPortPolicy(t *testing.T) {
+	tests := map[string]struct {
+		policy   string
+		port     int
+		want     int // 0 expects an allocated port
+		wantCode string
+	}{
+		"request in range":     {policy: PortRequest, port: 30005, want: 30005},
+		"request out of range": {policy: PortRequest, port: 22, wantCode: "PORT_NOT_ALLOWED"},
+		"request below range":  {policy: PortRequest, port: 29999, wantCode: "PORT_NOT_ALLOWED"},
+		"request above range":  {policy: PortRequest, port: 30011, wantCode: "PORT_NOT_ALLOWED"},
+		"request range edge":   {policy: PortRequest, port: 30010, want: 30010},
+		"request allocated":    {policy: PortRequest},
+		"auto allocated":       {policy: PortAuto},
+		"auto with port":       {policy: PortAuto, port: 30005, wantCode: "PORT_NOT_ALLOWED"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := newTestHandler(t)
+			if err := h.ConfigurePortAllocator("30000-30010", PortAllocationSequential); err != nil {
+				t.Fatalf("failed to configure port allocator: %v", err)
+			}
+			if err := h.SetPortPolicy(tt.policy); err != nil {
+				t.Fatalf("SetPortPolicy(%q) failed: %v", tt.policy, err)
+			}
+			payload := map[string]interface{}{"subdomain": "db", "protocol": "tcp", "local_port": float64(5432)}
+			if tt.port != 0 {
+				payload["public_port"] = float64(tt.port)
+			}
+
+			tunnel, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), &auth.Identity{ClientID: "client"}, payload)
+			if tt.wantCode != "" {
+				if tunnelErr == nil || tunnelErr.Code != tt.wantCode {
+					t.Fatalf("expected %s, got %+v %+v", tt.wantCode, tunnel, tunnelErr)
+				}
+				return
+			}
+			if tunnelErr != nil {
+				t.Fatalf("expected tunnel to be created, got %+v", tunnelErr)
+			}
+			if tt.want != 0 && tunnel.PublicPort != tt.want {
+				t.Fatalf("expected public port %d, got %d", tt.want, tunnel.PublicPort)
+			}
+			if tunnel.PublicPort < 30000 || tunnel.PublicPort > 30010 {
+				t.Fatalf("expected a port inside the range, got %d", tunnel.PublicPort)
+			}
+		})
+	}
+}
+
+func TestRequestedPublicPortIsHonouredByDefault(t *testing.T) {
+	h := newTestHandler(t)
+	if err := h.ConfigurePortAllocator("30000-30010", PortAllocationSequential); err != nil {
+		t.Fatalf("failed to configure port allocator: %v", err)
+	}
+
+	payload := map[string]interface{}{"subdomain": "ssh", "protocol": "tcp", "local_port": float64(22), "public_port": float64(22)}
+	tunnel, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), &auth.Identity{ClientID: "client"}, payload)
+	if tunnelErr == nil || tunnelErr.Code != "PORT_NOT_ALLOWED" {
+		t.Fatalf("expected PORT_NOT_ALLOWED for a port outside the range, got %+v %+v", tunnel, tunnelErr)
+	}
+
+	payload = map[string]interface{}{"subdomain": "db", "protocol": "tcp", "local_port": float64(5432), "public_port": float64(30005)}
+	tunnel, tunnelErr = h.createTunnel(context.Background(), newRecordingConn(), &auth.Identity{ClientID: "client"}, payload)
+	if tunnelErr != nil {
+		t.Fatalf("expected the requested port to be honoured, got %+v", tunnelErr)
+	}
+	if tunnel.PublicPort != 30005 {
+		t.Fatalf("expected public port 30005, got %d", tunnel.PublicPort)
+	}
+}
+
+func TestPolicySettersRejectUnknownValues(t *testing.T) {
+	h := newTestHandler(t)
+	if err := h.SetSubdomainPolicy("never"); err == nil {
+		t.Fatal("expected unknown subdomain policy to be rejected")
+	}
+	if err := h.SetPortPolicy("fixed"); err == nil {
+		t.Fatal("expected unknown port policy to be rejected")
+	}
+	if h.subdomainPolicy != SubdomainRequired || h.portPolicy != PortRequest {
+		t.Fatalf("expected defaults to be kept, got %q and %q", h.subdomainPolicy, h.portPolicy)
+	}
+}
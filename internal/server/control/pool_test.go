@@ -0,0 +1,111 @@
+package control
+
+import (
+	"context"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+)
+
+func TestPooledTunnelsShareSubdomain(t *testing.T) {
+	h := newTestHandler(t)
+	identity := &auth.Identity{ClientID: "client"}
+	payload := map[string]interface{}{"subdomain": "app", "protocol": "http", "local_port": float64(3000), "pool": true}
+
+	firstConn := newRecordingConn()
+	first, tunnelErr := h.createTunnel(context.Background(), firstConn, identity, payload)
+	if tunnelErr != nil {
+		t.Fatalf("failed to create tunnel: %v", tunnelErr)
+	}
+	if _, tunnelErr := h.createTunnel(context.Background(), firstConn, identity, payload); tunnelErr == nil || tunnelErr.Code != "SUBDOMAIN_TAKEN" {
+		t.Fatalf("expected a connection not to join its own pool twice, got %v", tunnelErr)
+	}
+
+	secondConn := newRecordingConn()
+	weighted := map[string]interface{}{"subdomain": "app", "protocol": "http", "local_port": float64(3001), "pool": true, "weight": float64(3)}
+	second, tunnelErr := h.createTunnel(context.Background(), secondConn, identity, weighted)
+	if tunnelErr != nil {
+		t.Fatalf("expected a second connection to join the pool, got %v", tunnelErr)
+	}
+	if second.ID != first.ID || second.PublicURL != first.PublicURL || second.Weight != 3 {
+		t.Fatalf("expected the member to share ID and URL with weight 3, got %+v", second)
+	}
+
+	unpooled := map[string]interface{}{"subdomain": "app", "protocol": "http", "local_port": float64(3000)}
+	if _, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), identity, unpooled); tunnelErr == nil || tunnelErr.Code != "SUBDOMAIN_TAKEN" {
+		t.Fatalf("expected a request without pool to be rejected, got %v", tunnelErr)
+	}
+	other := &auth.Identity{ClientID: "other"}
+	if _, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), other, payload); tunnelErr == nil || tunnelErr.Code != "SUBDOMAIN_TAKEN" {
+		t.Fatalf("expected another client not to join the pool, got %v", tunnelErr)
+	}
+
+	// The database row stays active until the last member leaves.
+	h.cleanupClient("client", firstConn)
+	if current, exists := h.registry.GetBySubdomain("app"); !exists || current != second {
+		t.Fatal("expected the remaining member to keep serving the subdomain")
+	}
+	if active, _ := h.repo.GetTunnelBySubdomain("app"); active == nil || active.ID != first.ID {
+		t.Fatalf("expected the pool's tunnel to stay active in the database, got %+v", active)
+	}
+	h.cleanupClient("client", secondConn)
+	if active, _ := h.repo.GetTunnelBySubdomain("app"); active != nil {
+		t.Fatalf("expected the tunnel to be closed after its last member left, got %+v", active)
+	}
+}
+
+func TestForceCloseClosesEveryPoolMember(t *testing.T) {
+	h := newTestHandler(t)
+	identity := &auth.Identity{ClientID: "client"}
+	payload := map[string]interface{}{"subdomain": "app", "protocol": "http", "local_port": float64(3000), "pool": true}
+
+	conns := []*recordingConn{newRecordingConn(), newRecordingConn()}
+	for _, conn := range conns {
+		if _, tunnelErr := h.createTunnel(context.Background(), conn, identity, payload); tunnelErr != nil {
+			t.Fatalf("failed to create tunnel: %v", tunnelErr)
+		}
+	}
+
+	if !h.ForceClose("app") {
+		t.Fatal("expected the pool to be closed")
+	}
+	if _, exists := h.registry.GetBySubdomain("app"); exists {
+		t.Fatal("expected no member to remain registered")
+	}
+	for i, conn := range conns {
+		if conn.find(protocol.MsgTypeTunnelClosed) == nil {
+			t.Fatalf("expected member %d to be told the tunnel was closed", i)
+		}
+	}
+	if active, _ := h.repo.GetTunnelBySubdomain("app"); active != nil {
+		t.Fatalf("expected the tunnel to be closed in the database, got %+v", active)
+	}
+}
+
+func TestParsePoolOptions(t *testing.T) {
+	tests := map[string]struct {
+		payload  map[string]interface{}
+		protocol string
+		pooled   bool
+		weight   int
+		wantErr  bool
+	}{
+		"defaults":          {map[string]interface{}{}, "http", false, 1, false},
+		"weighted member":   {map[string]interface{}{"pool": true, "weight": float64(10)}, "https", true, 10, false},
+		"pool not a bool":   {map[string]interface{}{"pool": "yes"}, "http", false, 0, true},
+		"zero weight":       {map[string]interface{}{"weight": float64(0)}, "http", false, 0, true},
+		"weight too large":  {map[string]interface{}{"weight": float64(101)}, "http", false, 0, true},
+		"fractional weight": {map[string]interface{}{"weight": 1.5}, "http", false, 0, true},
+		"tcp pool":          {map[string]interface{}{"pool": true}, "tcp", false, 0, true},
+	}
+	for name, tt := range tests {
+		pooled, weight, err := parsePoolOptions(tt.payload, tt.protocol)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+		if pooled != tt.pooled || weight != tt.weight {
+			t.Fatalf("%s: expected (%v, %d), got (%v, %d)", name, tt.pooled, tt.weight, pooled, weight)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package control
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+	"github.com/essajiwa/tunnelab/internal/server/quota"
+)
+
+// fixedUsage reports the same monthly byte total for every client.
+type fixedUsage int64
+
+func (f fixedUsage) GetClientUsageContext(ctx context.Context, clientID string, since time.Time) (*database.ClientUsage, error) {
+	return &database.ClientUsage{ClientID: clientID, Since: since, BytesReceived: int64(f)}, nil
+}
+
+func TestCreateTunnelEnforcesQuota(t *testing.T) {
+	payload := func(subdomain string) map[string]interface{} {
+		return map[string]interface{}{"subdomain": subdomain, "protocol": "http", "local_port": float64(3000)}
+	}
+
+	h := newTestHandler(t)
+	h.SetQuotaEnforcer(quota.NewEnforcer(fixedUsage(500), 1000))
+	tunnel, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), &auth.Identity{ClientID: "client"}, payload("under"))
+	if tunnelErr != nil || tunnel == nil {
+		t.Fatalf("expected tunnel under quota to be created, got %+v", tunnelErr)
+	}
+
+	h = newTestHandler(t)
+	h.SetQuotaEnforcer(quota.NewEnforcer(fixedUsage(1500), 1000))
+	tunnel, tunnelErr = h.createTunnel(context.Background(), newRecordingConn(), &auth.Identity{ClientID: "client"}, payload("over"))
+	if tunnel != nil || tunnelErr == nil || tunnelErr.Code != "QUOTA_EXCEEDED" {
+		t.Fatalf("expected QUOTA_EXCEEDED, got %+v %+v", tunnel, tunnelErr)
+	}
+	if _, exists := h.registry.GetBySubdomain("over"); exists {
+		t.Fatal("tunnel must not be registered when the client is over quota")
+	}
+
+	// A larger quota on the client itself lifts the limit.
+	identity := &auth.Identity{ClientID: "client", MonthlyByteQuota: 2000}
+	if _, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), identity, payload("over")); tunnelErr != nil {
+		t.Fatalf("expected per-client quota to allow the tunnel, got %+v", tunnelErr)
+	}
+}
@@ -0,0 +1,15 @@
+package control
+
+import (
+	"net/http"
+
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+)
+
+// HandleSchema serves the JSON Schema of the control protocol so client
+// authors can validate their messages against the running server.
+func (h *Handler) HandleSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(protocol.SchemaJSON())
+}
@@ -0,0 +1,30 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+)
+
+func TestHandleSchema(t *testing.T) {
+	h := newTestHandler(t)
+	rec := httptest.NewRecorder()
+	h.HandleSchema(rec, httptest.NewRequest(http.MethodGet, "/protocol/schema", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/schema+json" {
+		t.Fatalf("unexpected content type %q", got)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &schema); err != nil {
+		t.Fatalf("schema is not valid JSON: %v", err)
+	}
+	if schema["$id"] != protocol.SchemaID {
+		t.Fatalf("unexpected schema id %v", schema["$id"])
+	}
+}
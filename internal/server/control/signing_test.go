@@ -0,0 +1,61 @@
+package control
+
+import (
+	"testing"
+
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+)
+
+func TestRequiredSignatureRejectsUnsignedAuth(t *testing.T) {
+	h := newTestHandler(t)
+	h.SetAuthenticator(staticAuthenticator{token: "secret"})
+	h.RequireSignedMessages()
+	ws := dialControlServer(t, h)
+
+	resp := roundTrip(t, ws, protocol.NewControlMessage(protocol.MsgTypeAuth, "auth", map[string]interface{}{"token": "secret"}))
+	if resp.Type != protocol.MsgTypeError || resp.Payload["code"] != "INVALID_SIGNATURE" {
+		t.Fatalf("expected INVALID_SIGNATURE, got %s %v", resp.Type, resp.Payload)
+	}
+}
+
+func TestSignedSessionVerifiesEveryMessage(t *testing.T) {
+	h := newTestHandler(t)
+	h.SetAuthenticator(staticAuthenticator{token: "secret"})
+	h.RequireSignedMessages()
+	ws := dialControlServer(t, h)
+	key := protocol.DeriveSigningKey("secret")
+
+	signed := func(msg *protocol.ControlMessage) *protocol.ControlMessage {
+		if err := msg.Sign(key); err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+		return msg
+	}
+
+	resp := roundTrip(t, ws, signed(protocol.NewControlMessage(protocol.MsgTypeAuth, "auth", map[string]interface{}{"token": "secret"})))
+	if resp.Type != protocol.MsgTypeAuthResponse {
+		t.Fatalf("expected auth_response, got %s %v", resp.Type, resp.Payload)
+	}
+	if err := resp.Verify(key); err != nil {
+		t.Fatalf("expected a signed auth response: %v", err)
+	}
+
+	unsigned := protocol.NewControlMessage(protocol.MsgTypeHeartbeat, "unsigned", map[string]interface{}{})
+	if resp := roundTrip(t, ws, unsigned); resp.Payload["code"] != "INVALID_SIGNATURE" {
+		t.Fatalf("expected unsigned heartbeat to be rejected, got %s %v", resp.Type, resp.Payload)
+	}
+
+	tampered := signed(protocol.NewControlMessage(protocol.MsgTypeHeartbeat, "tampered", map[string]interface{}{}))
+	tampered.Payload["extra"] = true
+	if resp := roundTrip(t, ws, tampered); resp.Payload["code"] != "INVALID_SIGNATURE" {
+		t.Fatalf("expected tampered heartbeat to be rejected, got %s %v", resp.Type, resp.Payload)
+	}
+
+	resp = roundTrip(t, ws, signed(protocol.NewControlMessage(protocol.MsgTypeHeartbeat, "ok", map[string]interface{}{})))
+	if resp.Type != protocol.MsgTypeHeartbeat || resp.RequestID != "ok" {
+		t.Fatalf("expected heartbeat reply, got %s %v", resp.Type, resp.Payload)
+	}
+	if err := resp.Verify(key); err != nil {
+		t.Fatalf("expected a signed heartbeat reply: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package control
+
+import (
+	"log"
+	"time"
+
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+	"github.com/google/uuid"
+)
+
+// sendStats periodically sends the client's tunnel counters until done is closed.
+func (h *Handler) sendStats(conn *clientConn, clientID string, done <-chan struct{}) {
+	ticker := time.NewTicker(h.statsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			payload := h.buildStatsPayload(clientID, now)
+			msg := protocol.NewControlMessage(protocol.MsgTypeStats, uuid.New().String(), payload)
+			if err := conn.WriteJSON(msg); err != nil {
+				log.Printf("Failed to send stats to client %s: %v", clientID, err)
+				return
+			}
+		}
+	}
+}
+
+// buildStatsPayload snapshots the registry counters of every tunnel owned by the client.
+func (h *Handler) buildStatsPayload(clientID string, now time.Time) map[string]interface{} {
+	tunnels := h.registry.GetByClient(clientID)
+	stats := make([]protocol.TunnelStats, 0, len(tunnels))
+	for _, tunnel := range tunnels {
+		stats = append(stats, protocol.TunnelStats{
+			TunnelID:        tunnel.ID,
+			Subdomain:       tunnel.Subdomain,
+			BytesIn:         tunnel.Stats.BytesIn.Load(),
+			BytesOut:        tunnel.Stats.BytesOut.Load(),
+			Requests:        tunnel.Stats.Requests.Load(),
+			DurationSeconds: int64(now.Sub(tunnel.CreatedAt).Seconds()),
+		})
+	}
+	return map[string]interface{}{
+		"tunnels": stats,
+	}
+}
@@ -0,0 +1,48 @@
+package control
+
+import (
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+)
+
+func TestBuildStatsPayloadFromRegistry(t *testing.T) {
+	reg := registry.NewRegistry()
+	created := time.Now().Add(-90 * time.Second)
+
+	mine := &registry.TunnelInfo{ID: "t1", ClientID: "client", Subdomain: "mine", CreatedAt: created}
+	other := &registry.TunnelInfo{ID: "t2", ClientID: "someone-else", Subdomain: "other"}
+	for _, tunnel := range []*registry.TunnelInfo{mine, other} {
+		if err := reg.Register(tunnel); err != nil {
+			t.Fatalf("register failed: %v", err)
+		}
+	}
+
+	mine.RecordRequest(100, 2000)
+	mine.RecordRequest(50, 500)
+	other.RecordRequest(1, 1)
+
+	h := NewHandler(reg, nil, "example.com")
+	payload := h.buildStatsPayload("client", created.Add(90*time.Second))
+
+	stats, ok := payload["tunnels"].([]protocol.TunnelStats)
+	if !ok {
+		t.Fatalf("unexpected payload shape: %#v", payload)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("expected stats for one tunnel, got %d", len(stats))
+	}
+
+	got := stats[0]
+	if got.TunnelID != "t1" || got.Subdomain != "mine" {
+		t.Fatalf("unexpected tunnel in stats: %+v", got)
+	}
+	if got.BytesIn != 150 || got.BytesOut != 2500 || got.Requests != 2 {
+		t.Fatalf("unexpected counters: %+v", got)
+	}
+	if got.DurationSeconds != 90 {
+		t.Fatalf("expected duration of 90s, got %d", got.DurationSeconds)
+	}
+}
@@ -0,0 +1,84 @@
+package control
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+	"github.com/hashicorp/yamux"
+)
+
+func TestReconnectTakesOverTunnel(t *testing.T) {
+	h := newTestHandler(t)
+	identity := &auth.Identity{ClientID: "client"}
+	payload := map[string]interface{}{"subdomain": "app", "protocol": "http", "local_port": float64(3000)}
+
+	oldConn := newRecordingConn()
+	old, tunnelErr := h.createTunnel(context.Background(), oldConn, identity, payload)
+	if tunnelErr != nil {
+		t.Fatalf("failed to create tunnel: %v", tunnelErr)
+	}
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	session, err := yamux.Server(serverSide, nil)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	if err := h.registry.SetMuxSession("app", session); err != nil {
+		t.Fatalf("failed to set session: %v", err)
+	}
+
+	// The client reconnects before the server noticed the old connection died.
+	newConn := newRecordingConn()
+	replacement, tunnelErr := h.createTunnel(context.Background(), newConn, identity, payload)
+	if tunnelErr != nil {
+		t.Fatalf("expected the reconnect to take over the tunnel, got %v", tunnelErr)
+	}
+
+	current, exists := h.registry.GetBySubdomain("app")
+	if !exists || current != replacement || current.ControlConn != newConn {
+		t.Fatal("expected the new tunnel to replace the old one")
+	}
+	if len(h.registry.GetByClient("client")) != 1 {
+		t.Fatalf("expected a single registration, got %d", len(h.registry.GetByClient("client")))
+	}
+	if !session.IsClosed() {
+		t.Fatal("expected the stale mux session to be closed")
+	}
+	if msg := oldConn.find(protocol.MsgTypeTunnelClosed); msg == nil || msg.Payload["reason"] != "replaced" {
+		t.Fatalf("expected the old connection to be told the tunnel was replaced, got %+v", msg)
+	}
+	if active, _ := h.repo.GetTunnelBySubdomain("app"); active == nil || active.ID != replacement.ID {
+		t.Fatalf("expected only the new tunnel to be active in the database, got %+v", active)
+	}
+
+	// The old connection going away must not remove the new tunnel.
+	h.cleanupClient("client", oldConn)
+	if current, _ := h.registry.GetBySubdomain("app"); current != replacement {
+		t.Fatal("cleanup of the old connection removed the new tunnel")
+	}
+	if old.ID == replacement.ID {
+		t.Fatal("expected the replacement to get a new tunnel ID")
+	}
+}
+
+func TestTakeoverRequiresSameClientAndNewConnection(t *testing.T) {
+	h := newTestHandler(t)
+	conn := newRecordingConn()
+	payload := map[string]interface{}{"subdomain": "app", "protocol": "http", "local_port": float64(3000)}
+
+	if _, tunnelErr := h.createTunnel(context.Background(), conn, &auth.Identity{ClientID: "client"}, payload); tunnelErr != nil {
+		t.Fatalf("failed to create tunnel: %v", tunnelErr)
+	}
+
+	_, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), &auth.Identity{ClientID: "other"}, payload)
+	if tunnelErr == nil || tunnelErr.Code != "SUBDOMAIN_TAKEN" {
+		t.Fatalf("expected SUBDOMAIN_TAKEN for another client, got %v", tunnelErr)
+	}
+	_, tunnelErr = h.createTunnel(context.Background(), conn, &auth.Identity{ClientID: "client"}, payload)
+	if tunnelErr == nil || tunnelErr.Code != "SUBDOMAIN_TAKEN" {
+		t.Fatalf("expected SUBDOMAIN_TAKEN on the same connection, got %v", tunnelErr)
+	}
+}
@@ -0,0 +1,54 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+	"github.com/mattn/go-sqlite3"
+)
+
+// unavailableAuthenticator fails like a repository whose breaker is open.
+type unavailableAuthenticator struct{}
+
+func (unavailableAuthenticator) Authenticate(token string) (*auth.Identity, error) {
+	return nil, fmt.Errorf("%w: circuit open", database.ErrUnavailable)
+}
+
+func TestAuthReportsServiceUnavailable(t *testing.T) {
+	h := newTestHandler(t)
+	h.SetAuthenticator(unavailableAuthenticator{})
+	ws := dialControlServer(t, h)
+
+	resp := roundTrip(t, ws, protocol.NewControlMessage(protocol.MsgTypeAuth, "auth", map[string]interface{}{"token": "secret"}))
+	if resp.Type != protocol.MsgTypeError || resp.Payload["code"] != "SERVICE_UNAVAILABLE" {
+		t.Fatalf("expected SERVICE_UNAVAILABLE, got %s %v", resp.Type, resp.Payload)
+	}
+}
+
+func TestCreateTunnelReportsServiceUnavailable(t *testing.T) {
+	h := newTestHandler(t)
+	breaker := database.NewBreaker(database.BreakerConfig{Retries: -1, FailureThreshold: 1, Cooldown: time.Minute})
+	h.repo.SetBreaker(breaker)
+
+	// A locked database trips the breaker; the next lookup must fail fast.
+	breaker.Do(context.Background(), func(ctx context.Context) error {
+		return sqlite3.Error{Code: sqlite3.ErrLocked}
+	})
+
+	tunnel, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), &auth.Identity{ClientID: "client"}, map[string]interface{}{
+		"subdomain":  "app",
+		"protocol":   "http",
+		"local_port": float64(3000),
+	})
+	if tunnel != nil || tunnelErr == nil || tunnelErr.Code != "SERVICE_UNAVAILABLE" {
+		t.Fatalf("expected SERVICE_UNAVAILABLE, got %+v %+v", tunnel, tunnelErr)
+	}
+	if _, exists := h.registry.GetBySubdomain("app"); exists {
+		t.Fatal("tunnel must not be registered when the database is unavailable")
+	}
+}
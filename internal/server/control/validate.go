@@ -0,0 +1,249 @@
+package control
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// parseLocalPort validates the local_port of a tunnel request.
+//
+// Parameters:
+//   - value: The raw JSON value (a float64 after decoding)
+//
+// Returns:
+//   - int: The port number
+//   - error: Error describing why the port is invalid
+func parseLocalPort(value interface{}) (int, error) {
+	port, ok := value.(float64)
+	if !ok {
+		return 0, fmt.Errorf("local_port must be a number")
+	}
+	if port != math.Trunc(port) {
+		return 0, fmt.Errorf("local_port must be a whole number, got %v", port)
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("local_port must be between 1 and 65535, got %v", port)
+	}
+	return int(port), nil
+}
+
+// validateLocalHost checks that host is an IP address or a valid hostname.
+func validateLocalHost(host string) error {
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")); ip != nil {
+		return nil
+	}
+
+	name := strings.TrimSuffix(host, ".")
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("local_host %q is not a valid hostname or IP address", host)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !isHostnameLabel(label) {
+			return fmt.Errorf("local_host %q is not a valid hostname or IP address", host)
+		}
+	}
+	return nil
+}
+
+// parseLocalScheme validates the local_scheme of a tunnel request, which
+// tells how the client reaches its local app.
+//
+// Returns:
+//   - string: "http" or "https" ("http" when omitted)
+//   - error: Error if the value is not a string or an unknown scheme
+func parseLocalScheme(payload map[string]interface{}) (string, error) {
+	raw, ok := payload["local_scheme"]
+	if !ok {
+		return "http", nil
+	}
+	scheme, ok := raw.(string)
+	if !ok {
+		return "", fmt.Errorf("local_scheme must be a string")
+	}
+	switch scheme = strings.ToLower(scheme); scheme {
+	case "":
+		return "http", nil
+	case "http", "https":
+		return scheme, nil
+	}
+	return "", fmt.Errorf("unsupported local_scheme %q (use http or https)", scheme)
+}
+
+func isHostnameLabel(label string) bool {
+	if len(label) == 0 || len(label) > 63 {
+		return false
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, c := range label {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// grpcCompressions lists the compression algorithms accepted for gRPC tunnels.
+var grpcCompressions = map[string]bool{
+	"identity": true,
+	"gzip":     true,
+}
+
+// parseGRPCOptions validates the max_streams and compression of a gRPC tunnel
+// request. max_streams is clamped to [1, ceiling]; a missing, zero or negative
+// value means the ceiling. A ceiling of zero leaves max_streams unbounded.
+//
+// Returns:
+//   - int: The effective maximum number of concurrent streams (0 means unlimited)
+//   - string: The compression algorithm ("identity" when none was requested)
+//   - error: Error if the values have the wrong type or the compression is unknown
+func parseGRPCOptions(payload map[string]interface{}, ceiling int) (int, string, error) {
+	maxStreams := 0
+	if raw, ok := payload["max_streams"]; ok {
+		value, ok := raw.(float64)
+		if !ok {
+			return 0, "", fmt.Errorf("max_streams must be a number")
+		}
+		if value > 0 {
+			maxStreams = int(math.Min(value, math.MaxInt32))
+		}
+	}
+	if ceiling > 0 && (maxStreams == 0 || maxStreams > ceiling) {
+		maxStreams = ceiling
+	}
+
+	compression := "identity"
+	if raw, ok := payload["compression"]; ok {
+		value, ok := raw.(string)
+		if !ok {
+			return 0, "", fmt.Errorf("compression must be a string")
+		}
+		if value != "" {
+			compression = strings.ToLower(value)
+		}
+	}
+	if !grpcCompressions[compression] {
+		return 0, "", fmt.Errorf("unsupported compression %q (use gzip or identity)", compression)
+	}
+	return maxStreams, compression, nil
+}
+
+// stringList accepts a JSON string or array of strings.
+func stringList(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// parsePoolOptions validates the pool and weight of a tunnel request. Only
+// HTTP tunnels can be pooled; weight defaults to 1.
+//
+// Returns:
+//   - bool: Whether the tunnel serves its subdomain as a pool member
+//   - int: The member's share of the pool's requests
+//   - error: Error if the values have the wrong type or are out of range
+func parsePoolOptions(payload map[string]interface{}, protocolType string) (bool, int, error) {
+	pooled := false
+	if raw, ok := payload["pool"]; ok {
+		if pooled, ok = raw.(bool); !ok {
+			return false, 0, fmt.Errorf("pool must be a boolean")
+		}
+	}
+	weight := 1
+	if raw, ok := payload["weight"]; ok {
+		value, ok := raw.(float64)
+		if !ok || value != math.Trunc(value) {
+			return false, 0, fmt.Errorf("weight must be a whole number")
+		}
+		if value < 1 || value > registry.MaxPoolWeight {
+			return false, 0, fmt.Errorf("weight must be between 1 and %d, got %v", registry.MaxPoolWeight, value)
+		}
+		weight = int(value)
+	}
+	if pooled && protocolType != "http" && protocolType != "https" {
+		return false, 0, fmt.Errorf("only http and https tunnels can be pooled")
+	}
+	return pooled, weight, nil
+}
+
+// maxPathPrefixLength bounds strip_path_prefix and add_path_prefix.
+const maxPathPrefixLength = 256
+
+// parsePathPrefixes validates the strip_path_prefix and add_path_prefix of a
+// tunnel request. Only HTTP tunnels rewrite paths. A trailing slash is
+// dropped, so "/app/" and "/app" are the same prefix and "/" means none.
+//
+// Returns:
+//   - string: The prefix removed from request paths ("" for none)
+//   - string: The prefix added to request paths ("" for none)
+//   - error: Error if a prefix is not a plain absolute path
+func parsePathPrefixes(payload map[string]interface{}, protocolType string) (string, string, error) {
+	var prefixes [2]string
+	for i, name := range []string{"strip_path_prefix", "add_path_prefix"} {
+		raw, ok := payload[name]
+		if !ok {
+			continue
+		}
+		prefix, ok := raw.(string)
+		if !ok {
+			return "", "", fmt.Errorf("%s must be a string", name)
+		}
+		if prefix == "" {
+			continue
+		}
+		if protocolType != "http" && protocolType != "https" {
+			return "", "", fmt.Errorf("%s is only supported for http and https tunnels", name)
+		}
+		if err := validatePathPrefix(prefix); err != nil {
+			return "", "", fmt.Errorf("%s %w", name, err)
+		}
+		prefixes[i] = strings.TrimSuffix(prefix, "/")
+	}
+	return prefixes[0], prefixes[1], nil
+}
+
+// validatePathPrefix checks that prefix is an absolute path of plain
+// segments, without dot segments, empty segments or characters that would
+// need escaping.
+func validatePathPrefix(prefix string) error {
+	if len(prefix) > maxPathPrefixLength {
+		return fmt.Errorf("must not be longer than %d characters", maxPathPrefixLength)
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("must start with /, got %q", prefix)
+	}
+	trimmed := strings.TrimSuffix(prefix[1:], "/")
+	if trimmed == "" {
+		return nil
+	}
+	for _, segment := range strings.Split(trimmed, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("must not contain empty or dot segments, got %q", prefix)
+		}
+		for _, c := range segment {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.ContainsRune("-._~", c):
+			default:
+				return fmt.Errorf("must only contain letters, digits, '-', '.', '_', '~' and '/', got %q", prefix)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package control
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseLocalPort(t *testing.T) {
+	valid := map[float64]int{1: 1, 8080: 8080, 65535: 65535}
+	for value, want := range valid {
+		got, err := parseLocalPort(value)
+		if err != nil || got != want {
+			t.Fatalf("parseLocalPort(%v) = %d, %v; want %d", value, got, err, want)
+		}
+	}
+
+	for _, value := range []interface{}{float64(0), float64(-1), float64(65536), 80.5, "8080", nil} {
+		if _, err := parseLocalPort(value); err == nil {
+			t.Fatalf("expected parseLocalPort(%v) to fail", value)
+		}
+	}
+}
+
+func TestValidateLocalHost(t *testing.T) {
+	for _, host := range []string{"localhost", "127.0.0.1", "::1", "[::1]", "api.internal", "my_service", "db-1.local."} {
+		if err := validateLocalHost(host); err != nil {
+			t.Fatalf("expected %q to be valid: %v", host, err)
+		}
+	}
+
+	for _, host := range []string{"", "bad host", "-leading.example", "trailing-.example", "a..b", "http://localhost", "localhost:8080"} {
+		if err := validateLocalHost(host); err == nil {
+			t.Fatalf("expected %q to be rejected", host)
+		}
+	}
+}
+
+func TestParseLocalScheme(t *testing.T) {
+	valid := map[string]string{"": "http", "http": "http", "HTTPS": "https"}
+	for value, want := range valid {
+		got, err := parseLocalScheme(map[string]interface{}{"local_scheme": value})
+		if err != nil || got != want {
+			t.Fatalf("local_scheme %q: expected %q, got %q (%v)", value, want, got, err)
+		}
+	}
+	if got, err := parseLocalScheme(map[string]interface{}{}); err != nil || got != "http" {
+		t.Fatalf("expected http without local_scheme, got %q (%v)", got, err)
+	}
+	for _, value := range []interface{}{"ftp", "tls", true} {
+		if _, err := parseLocalScheme(map[string]interface{}{"local_scheme": value}); err == nil {
+			t.Fatalf("expected local_scheme %v to be rejected", value)
+		}
+	}
+}
+
+func TestParseGRPCOptionsClampsMaxStreams(t *testing.T) {
+	cases := []struct {
+		value   interface{}
+		ceiling int
+		want    int
+	}{
+		{nil, 100, 100},
+		{float64(10), 100, 10},
+		{float64(1000), 100, 100},
+		{float64(-5), 100, 100},
+		{float64(0), 100, 100},
+		{float64(-5), 0, 0},
+		{float64(1e12), 0, math.MaxInt32},
+	}
+	for _, tc := range cases {
+		payload := map[string]interface{}{}
+		if tc.value != nil {
+			payload["max_streams"] = tc.value
+		}
+		got, compression, err := parseGRPCOptions(payload, tc.ceiling)
+		if err != nil {
+			t.Fatalf("max_streams=%v: unexpected error %v", tc.value, err)
+		}
+		if got != tc.want || compression != "identity" {
+			t.Fatalf("max_streams=%v ceiling=%d: got %d/%q, want %d/identity", tc.value, tc.ceiling, got, compression, tc.want)
+		}
+	}
+}
+
+func TestParseGRPCOptionsCompression(t *testing.T) {
+	for _, value := range []string{"gzip", "GZIP", "identity", ""} {
+		if _, _, err := parseGRPCOptions(map[string]interface{}{"compression": value}, 100); err != nil {
+			t.Fatalf("expected compression %q to be accepted: %v", value, err)
+		}
+	}
+	for _, value := range []interface{}{"deflate", "snappy", "br", float64(1)} {
+		if _, _, err := parseGRPCOptions(map[string]interface{}{"compression": value}, 100); err == nil {
+			t.Fatalf("expected compression %v to be rejected", value)
+		}
+	}
+	if _, _, err := parseGRPCOptions(map[string]interface{}{"max_streams": "10"}, 100); err == nil {
+		t.Fatal("expected non-numeric max_streams to be rejected")
+	}
+}
+
+func TestParsePathPrefixes(t *testing.T) {
+	strip, add, err := parsePathPrefixes(map[string]interface{}{"strip_path_prefix": "/api/", "add_path_prefix": "/app/v1.2"}, "http")
+	if err != nil || strip != "/api" || add != "/app/v1.2" {
+		t.Fatalf("parsePathPrefixes = %q, %q, %v; want /api, /app/v1.2", strip, add, err)
+	}
+	strip, add, err = parsePathPrefixes(map[string]interface{}{"strip_path_prefix": "/", "add_path_prefix": ""}, "https")
+	if err != nil || strip != "" || add != "" {
+		t.Fatalf("expected / and empty prefixes to mean none, got %q, %q, %v", strip, add, err)
+	}
+
+	for _, prefix := range []interface{}{"api", "/a//b", "/a/../b", "/./a", "/a b", "/a?x=1", "/%2e", 5} {
+		if _, _, err := parsePathPrefixes(map[string]interface{}{"add_path_prefix": prefix}, "http"); err == nil {
+			t.Fatalf("expected add_path_prefix %v to be rejected", prefix)
+		}
+	}
+	if _, _, err := parsePathPrefixes(map[string]interface{}{"strip_path_prefix": "/api"}, "tcp"); err == nil {
+		t.Fatal("expected path prefixes on tcp tunnels to be rejected")
+	}
+}
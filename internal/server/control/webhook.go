@@ -0,0 +1,38 @@
+package control
+
+import (
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+	"github.com/essajiwa/tunnelab/internal/server/webhook"
+)
+
+// SetWebhookNotifier sends tunnel lifecycle and authentication failure
+// events to operator webhooks.
+//
+// Parameters:
+//   - notifier: The notifier (nil disables webhooks)
+func (h *Handler) SetWebhookNotifier(notifier *webhook.Notifier) {
+	h.webhooks = notifier
+}
+
+// notifyTunnelEvent queues a webhook event of eventType describing tunnel.
+func (h *Handler) notifyTunnelEvent(eventType string, tunnel *registry.TunnelInfo, reason string) {
+	h.webhooks.Notify(webhook.Event{
+		Type:       eventType,
+		TunnelID:   tunnel.ID,
+		ClientID:   tunnel.ClientID,
+		Subdomain:  tunnel.Subdomain,
+		Protocol:   tunnel.Protocol,
+		PublicURL:  tunnel.PublicURL,
+		PublicPort: tunnel.PublicPort,
+		Reason:     reason,
+	})
+}
+
+// notifyAuthFailed queues a webhook event for a rejected control connection.
+func (h *Handler) notifyAuthFailed(conn *clientConn, reason string) {
+	event := webhook.Event{Type: webhook.EventAuthFailed, Reason: reason}
+	if addr := conn.RemoteAddr(); addr != nil {
+		event.RemoteAddr = addr.String()
+	}
+	h.webhooks.Notify(event)
+}
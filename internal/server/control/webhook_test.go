@@ -0,0 +1,72 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+	"github.com/essajiwa/tunnelab/internal/server/webhook"
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+)
+
+func TestTunnelLifecycleWebhooks(t *testing.T) {
+	events := make(chan webhook.Event, 8)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhook.Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("failed to decode webhook event: %v", err)
+		}
+		events <- event
+	}))
+	defer receiver.Close()
+
+	notifier := webhook.NewNotifier(webhook.Config{URLs: []string{receiver.URL}, Secret: "secret", Timeout: time.Second})
+	defer notifier.Close()
+	h := newTestHandler(t)
+	h.SetWebhookNotifier(notifier)
+	h.SetAuthenticator(staticAuthenticator{token: "secret"})
+
+	next := func(want string) webhook.Event {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.Type != want {
+				t.Fatalf("expected a %s event, got %+v", want, event)
+			}
+			return event
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected a %s event", want)
+			return webhook.Event{}
+		}
+	}
+
+	payload := map[string]interface{}{"subdomain": "demo", "protocol": "http", "local_port": float64(3000)}
+	tunnel, tunnelErr := h.createTunnel(context.Background(), newRecordingConn(), &auth.Identity{ClientID: "client"}, payload)
+	if tunnelErr != nil {
+		t.Fatalf("failed to create tunnel: %+v", tunnelErr)
+	}
+	created := next(webhook.EventTunnelCreated)
+	if created.TunnelID != tunnel.ID || created.Subdomain != "demo" || created.ClientID != "client" || created.PublicURL != tunnel.PublicURL {
+		t.Fatalf("unexpected created event %+v", created)
+	}
+
+	if !h.ForceClose("demo") {
+		t.Fatal("expected the tunnel to be closed")
+	}
+	if closed := next(webhook.EventTunnelClosed); closed.TunnelID != tunnel.ID || closed.Reason != "closed_by_admin" {
+		t.Fatalf("unexpected closed event %+v", closed)
+	}
+
+	ws := dialControlServer(t, h)
+	resp := roundTrip(t, ws, protocol.NewControlMessage(protocol.MsgTypeAuth, "auth", map[string]interface{}{"token": "wrong"}))
+	if resp.Payload["code"] != "AUTH_FAILED" {
+		t.Fatalf("expected AUTH_FAILED, got %v", resp.Payload)
+	}
+	if failed := next(webhook.EventAuthFailed); failed.Reason != "invalid_token" || failed.RemoteAddr == "" {
+		t.Fatalf("unexpected auth failure event %+v", failed)
+	}
+}
@@ -0,0 +1,362 @@
+// Package domains routes custom domains: hostnames outside the server domain,
+// such as app.example.org, that point at a client's tunnel.
+//
+// An operator registers a hostname for a subdomain of a client. The domain
+// stays pending until its owner proves control of it by publishing a DNS TXT
+// record holding the domain's verification token (see Challenge); only then
+// is it routed and allowed a certificate. Verified hostnames are kept in
+// memory, so the proxy and the certificate host policy consult them without a
+// database lookup per request, and reloaded periodically to pick up changes
+// made on other nodes.
+//
+// Usage:
+//
+//	manager := domains.NewManager(repo, "tunnel.example.com")
+//	if err := manager.Load(ctx); err != nil {
+//		return err
+//	}
+//	go manager.Run(time.Minute, done)
+//	clientID, subdomain, ok := manager.ResolveCustomDomain("app.example.org")
+package domains
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+)
+
+var (
+	// ErrInvalidHostname is returned for hostnames that are not valid DNS
+	// names or that lie inside the server domain.
+	ErrInvalidHostname = errors.New("invalid custom domain")
+	// ErrExists is returned when registering a hostname twice.
+	ErrExists = errors.New("custom domain already exists")
+	// ErrNotFound is returned for hostnames that are not registered.
+	ErrNotFound = errors.New("custom domain not found")
+	// ErrNotVerified is returned when the verification TXT record of a
+	// hostname is missing, wrong or cannot be looked up.
+	ErrNotVerified = errors.New("custom domain ownership not verified")
+	// ErrScopeDenied is returned for clients whose scopes do not include
+	// custom domains.
+	ErrScopeDenied = errors.New("client may not use custom domains")
+)
+
+// Store persists pending and verified custom domains, and looks up the
+// scopes of their clients.
+type Store interface {
+	GetClientContext(ctx context.Context, id string) (*database.Client, error)
+	CreateCustomDomainContext(ctx context.Context, domain *database.CustomDomain) error
+	GetCustomDomainContext(ctx context.Context, hostname string) (*database.CustomDomain, error)
+	ListCustomDomainsContext(ctx context.Context) ([]*database.CustomDomain, error)
+	ListPendingCustomDomainsContext(ctx context.Context) ([]*database.CustomDomain, error)
+	VerifyCustomDomainContext(ctx context.Context, hostname string) (bool, error)
+	DeleteCustomDomainContext(ctx context.Context, hostname string) (bool, error)
+}
+
+// route is the tunnel a verified hostname serves.
+type route struct {
+	clientID  string
+	subdomain string
+}
+
+// Manager registers, verifies and resolves custom domains.
+type Manager struct {
+	store    Store
+	domain   string
+	verifier *Verifier
+
+	mu       sync.RWMutex
+	verified map[string]route
+}
+
+// NewManager creates a Manager. Call Load to read the verified domains.
+//
+// Parameters:
+//   - store: Where custom domains are kept, typically the database repository
+//   - domain: The server domain; its subdomains are not custom domains
+//
+// Returns:
+//   - *Manager: A manager that resolves no hostname yet
+func NewManager(store Store, domain string) *Manager {
+	return &Manager{
+		store:    store,
+		domain:   strings.ToLower(domain),
+		verifier: NewVerifier(net.DefaultResolver),
+		verified: make(map[string]route),
+	}
+}
+
+// Normalize lowercases host and strips a port and a trailing dot, as hostnames
+// are stored.
+func Normalize(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// ResolveCustomDomain returns the tunnel a verified custom domain serves.
+//
+// Parameters:
+//   - host: Host header or TLS server name, which may carry a port
+//
+// Returns:
+//   - string: Client that must own the tunnel
+//   - string: Subdomain of the tunnel
+//   - bool: Whether host is a verified custom domain
+func (m *Manager) ResolveCustomDomain(host string) (string, string, bool) {
+	m.mu.RLock()
+	r, ok := m.verified[Normalize(host)]
+	m.mu.RUnlock()
+	return r.clientID, r.subdomain, ok
+}
+
+// AllowsCustomDomain reports whether host is a verified custom domain, and
+// may therefore get a certificate.
+func (m *Manager) AllowsCustomDomain(host string) bool {
+	_, _, ok := m.ResolveCustomDomain(host)
+	return ok
+}
+
+// Add registers a pending custom domain for a subdomain of a client, with a
+// new verification token. Publish Challenge of the result, then call Verify.
+//
+// Parameters:
+//   - ctx: Bounds the database calls
+//   - hostname: The custom hostname, e.g. app.example.org
+//   - clientID: Client whose tunnel the hostname will serve
+//   - subdomain: Subdomain of that tunnel
+//
+// Returns:
+//   - *database.CustomDomain: The registered domain
+//   - error: ErrInvalidHostname, ErrExists, ErrScopeDenied or a database error
+func (m *Manager) Add(ctx context.Context, hostname, clientID, subdomain string) (*database.CustomDomain, error) {
+	hostname = Normalize(hostname)
+	if err := m.validateHostname(hostname); err != nil {
+		return nil, err
+	}
+	if clientID == "" || subdomain == "" {
+		return nil, fmt.Errorf("%w: client_id and subdomain are required", ErrInvalidHostname)
+	}
+	if err := m.checkScope(ctx, clientID); err != nil {
+		return nil, err
+	}
+	existing, err := m.store.GetCustomDomainContext(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, ErrExists
+	}
+	token, err := newVerificationToken()
+	if err != nil {
+		return nil, err
+	}
+	domain := &database.CustomDomain{
+		Hostname:          hostname,
+		ClientID:          clientID,
+		Subdomain:         strings.ToLower(subdomain),
+		VerificationToken: token,
+	}
+	if err := m.store.CreateCustomDomainContext(ctx, domain); err != nil {
+		return nil, err
+	}
+	return m.store.GetCustomDomainContext(ctx, hostname)
+}
+
+// Verify looks up the verification TXT record of a pending custom domain and,
+// once it holds the domain's token, activates the domain: it is routed and
+// may get a certificate from then on. Verifying an active domain again is a
+// no-op. A pending domain whose client has lost the custom-domain scope is
+// not activated.
+//
+// Parameters:
+//   - ctx: Bounds the DNS lookup and the database calls
+//   - hostname: A registered custom hostname
+//
+// Returns:
+//   - *database.CustomDomain: The verified domain
+//   - error: ErrNotFound, ErrNotVerified, ErrScopeDenied or a database error
+func (m *Manager) Verify(ctx context.Context, hostname string) (*database.CustomDomain, error) {
+	domain, err := m.Get(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	if domain.Verified {
+		return domain, nil
+	}
+	if err := m.checkScope(ctx, domain.ClientID); err != nil {
+		return nil, err
+	}
+	if err := m.verifier.Check(ctx, domain); err != nil {
+		return nil, err
+	}
+	if err := m.activate(ctx, domain); err != nil {
+		return nil, err
+	}
+	return m.store.GetCustomDomainContext(ctx, domain.Hostname)
+}
+
+// VerifyPending calls Verify for every pending custom domain, so domains are
+// activated without an operator once their TXT record appears.
+//
+// Returns:
+//   - int: Number of domains activated
+//   - error: Database error if any; DNS failures only leave domains pending
+func (m *Manager) VerifyPending(ctx context.Context) (int, error) {
+	pending, err := m.store.ListPendingCustomDomainsContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list pending custom domains: %w", err)
+	}
+	activated := 0
+	for _, domain := range pending {
+		if m.checkScope(ctx, domain.ClientID) != nil || m.verifier.Check(ctx, domain) != nil {
+			continue
+		}
+		if err := m.activate(ctx, domain); err != nil {
+			return activated, err
+		}
+		log.Printf("Verified custom domain %s for %s of client %s", domain.Hostname, domain.Subdomain, domain.ClientID)
+		activated++
+	}
+	return activated, nil
+}
+
+// checkScope returns ErrScopeDenied if the client exists and its scopes do
+// not include custom domains.
+func (m *Manager) checkScope(ctx context.Context, clientID string) error {
+	client, err := m.store.GetClientContext(ctx, clientID)
+	if err != nil {
+		return fmt.Errorf("failed to look up client %s: %w", clientID, err)
+	}
+	if client != nil && !auth.ScopesAllow(auth.ParseScopes(client.Scopes), auth.ScopeCustomDomain) {
+		return fmt.Errorf("%w: client %s lacks the %s scope", ErrScopeDenied, clientID, auth.ScopeCustomDomain)
+	}
+	return nil
+}
+
+// activate records domain as verified and starts routing it.
+func (m *Manager) activate(ctx context.Context, domain *database.CustomDomain) error {
+	if _, err := m.store.VerifyCustomDomainContext(ctx, domain.Hostname); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.verified[domain.Hostname] = route{clientID: domain.ClientID, subdomain: domain.Subdomain}
+	m.mu.Unlock()
+	return nil
+}
+
+// Remove unregisters a custom domain; it stops being routed at once.
+//
+// Returns:
+//   - error: ErrNotFound or a database error
+func (m *Manager) Remove(ctx context.Context, hostname string) error {
+	hostname = Normalize(hostname)
+	found, err := m.store.DeleteCustomDomainContext(ctx, hostname)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	delete(m.verified, hostname)
+	m.mu.Unlock()
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Get returns a registered custom domain, verified or not.
+//
+// Returns:
+//   - *database.CustomDomain: The domain
+//   - error: ErrNotFound or a database error
+func (m *Manager) Get(ctx context.Context, hostname string) (*database.CustomDomain, error) {
+	domain, err := m.store.GetCustomDomainContext(ctx, Normalize(hostname))
+	if err != nil {
+		return nil, err
+	}
+	if domain == nil {
+		return nil, ErrNotFound
+	}
+	return domain, nil
+}
+
+// List returns every registered custom domain, verified or not.
+func (m *Manager) List(ctx context.Context) ([]*database.CustomDomain, error) {
+	return m.store.ListCustomDomainsContext(ctx)
+}
+
+// Load replaces the verified domains kept in memory with those of the store.
+//
+// Returns:
+//   - error: Database error if any; the previous domains are kept then
+func (m *Manager) Load(ctx context.Context) error {
+	domains, err := m.store.ListCustomDomainsContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load custom domains: %w", err)
+	}
+	verified := make(map[string]route, len(domains))
+	for _, domain := range domains {
+		if domain.Verified {
+			verified[domain.Hostname] = route{clientID: domain.ClientID, subdomain: domain.Subdomain}
+		}
+	}
+	m.mu.Lock()
+	m.verified = verified
+	m.mu.Unlock()
+	return nil
+}
+
+// Run calls VerifyPending and Load every interval until done is closed.
+//
+// Parameters:
+//   - interval: Time between reloads
+//   - done: Closed to stop the loop
+func (m *Manager) Run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, err := m.VerifyPending(context.Background()); err != nil {
+				log.Printf("%v", err)
+			}
+			if err := m.Load(context.Background()); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+}
+
+// validateHostname accepts fully-qualified DNS names outside the server
+// domain.
+func (m *Manager) validateHostname(hostname string) error {
+	if net.ParseIP(hostname) != nil || !strings.Contains(hostname, ".") || len(hostname) > 253 {
+		return fmt.Errorf("%w: %q is not a fully-qualified hostname", ErrInvalidHostname, hostname)
+	}
+	if hostname == m.domain || strings.HasSuffix(hostname, "."+m.domain) {
+		return fmt.Errorf("%w: %q is inside the server domain", ErrInvalidHostname, hostname)
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("%w: %q is not a valid hostname", ErrInvalidHostname, hostname)
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return fmt.Errorf("%w: %q is not a valid hostname", ErrInvalidHostname, hostname)
+			}
+		}
+	}
+	return nil
+}
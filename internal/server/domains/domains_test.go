@@ -0,0 +1,208 @@
+package domains
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+)
+
+// fakeResolver serves the TXT records of its map; other names do not exist.
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	values, ok := f[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return values, nil
+}
+
+func newTestManager(t *testing.T, records fakeResolver) (*Manager, *database.Repository) {
+	t.Helper()
+
+	repo, err := database.NewRepository(filepath.Join(t.TempDir(), "tunnelab.db"))
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	if err := repo.CreateClient(&database.Client{ID: "alice", Name: "Alice", APIToken: "tok-alice", Status: "active"}); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	m := NewManager(repo, "tunnel.example.com")
+	m.verifier = NewVerifier(records)
+	return m, repo
+}
+
+func TestCustomDomainActivatesOnceTXTRecordIsObserved(t *testing.T) {
+	records := fakeResolver{}
+	m, repo := newTestManager(t, records)
+	ctx := context.Background()
+
+	domain, err := m.Add(ctx, "App.Example.org.", "alice", "app")
+	if err != nil {
+		t.Fatalf("failed to add custom domain: %v", err)
+	}
+	if domain.Hostname != "app.example.org" || domain.Verified || len(domain.VerificationToken) != 32 {
+		t.Fatalf("expected a pending domain with a token, got %+v", domain)
+	}
+	challenge := Challenge(domain)
+	if challenge.Name != "_tunnelab-challenge.app.example.org" || challenge.Value != "tunnelab-verification="+domain.VerificationToken {
+		t.Fatalf("unexpected challenge: %+v", challenge)
+	}
+
+	// Pending: no record, then a record with the wrong token.
+	if _, err := m.Verify(ctx, "app.example.org"); !errors.Is(err, ErrNotVerified) {
+		t.Fatalf("expected ErrNotVerified without a TXT record, got %v", err)
+	}
+	records[challenge.Name] = []string{"v=spf1 -all", "tunnelab-verification=someone-else"}
+	if _, err := m.Verify(ctx, "app.example.org"); !errors.Is(err, ErrNotVerified) {
+		t.Fatalf("expected ErrNotVerified for a wrong token, got %v", err)
+	}
+	if _, _, ok := m.ResolveCustomDomain("app.example.org"); ok || m.AllowsCustomDomain("app.example.org") {
+		t.Fatal("expected a pending custom domain not to be routed")
+	}
+	if pending, _ := repo.ListPendingCustomDomains(); len(pending) != 1 {
+		t.Fatalf("expected one pending domain, got %d", len(pending))
+	}
+
+	// Active once the record holds the token.
+	records[challenge.Name] = append(records[challenge.Name], challenge.Value)
+	verified, err := m.Verify(ctx, "app.example.org")
+	if err != nil {
+		t.Fatalf("failed to verify custom domain: %v", err)
+	}
+	if !verified.Verified || verified.VerifiedAt == nil {
+		t.Fatalf("expected the domain to be recorded as verified, got %+v", verified)
+	}
+	clientID, subdomain, ok := m.ResolveCustomDomain("APP.example.org:443")
+	if !ok || clientID != "alice" || subdomain != "app" {
+		t.Fatalf("expected alice/app, got %q/%q (%v)", clientID, subdomain, ok)
+	}
+	if !m.AllowsCustomDomain("app.example.org") {
+		t.Fatal("expected a certificate to be allowed for a verified custom domain")
+	}
+
+	// The record may go once verified.
+	delete(records, challenge.Name)
+	if _, err := m.Verify(ctx, "app.example.org"); err != nil {
+		t.Fatalf("expected verifying an active domain again to succeed, got %v", err)
+	}
+
+	// Another node loads the verified domain from the database.
+	other := NewManager(repo, "tunnel.example.com")
+	if err := other.Load(ctx); err != nil {
+		t.Fatalf("failed to load custom domains: %v", err)
+	}
+	if _, _, ok := other.ResolveCustomDomain("app.example.org"); !ok {
+		t.Fatal("expected the loaded custom domain to resolve")
+	}
+
+	if err := m.Remove(ctx, "app.example.org"); err != nil {
+		t.Fatalf("failed to remove custom domain: %v", err)
+	}
+	if _, _, ok := m.ResolveCustomDomain("app.example.org"); ok {
+		t.Fatal("expected a removed custom domain not to resolve")
+	}
+	if err := m.Remove(ctx, "app.example.org"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := m.Verify(ctx, "app.example.org"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestVerifyPendingActivatesPublishedDomains(t *testing.T) {
+	records := fakeResolver{}
+	m, _ := newTestManager(t, records)
+	ctx := context.Background()
+
+	published, err := m.Add(ctx, "app.example.org", "alice", "app")
+	if err != nil {
+		t.Fatalf("failed to add custom domain: %v", err)
+	}
+	if _, err := m.Add(ctx, "api.example.org", "alice", "api"); err != nil {
+		t.Fatalf("failed to add custom domain: %v", err)
+	}
+	challenge := Challenge(published)
+	records[challenge.Name] = []string{challenge.Value}
+
+	if n, err := m.VerifyPending(ctx); err != nil || n != 1 {
+		t.Fatalf("expected 1 activated domain, got %d (%v)", n, err)
+	}
+	if _, _, ok := m.ResolveCustomDomain("app.example.org"); !ok {
+		t.Fatal("expected the published domain to be routed")
+	}
+	if _, _, ok := m.ResolveCustomDomain("api.example.org"); ok {
+		t.Fatal("expected the unpublished domain to stay pending")
+	}
+	if n, err := m.VerifyPending(ctx); err != nil || n != 0 {
+		t.Fatalf("expected no further activation, got %d (%v)", n, err)
+	}
+}
+
+func TestCustomDomainsRequireScope(t *testing.T) {
+	records := fakeResolver{}
+	m, repo := newTestManager(t, records)
+	ctx := context.Background()
+
+	if err := repo.CreateClient(&database.Client{ID: "bob", Name: "Bob", APIToken: "tok-bob", Status: "active", Scopes: "http,tcp"}); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if _, err := m.Add(ctx, "bob.example.org", "bob", "app"); !errors.Is(err, ErrScopeDenied) {
+		t.Fatalf("expected ErrScopeDenied for a client without the custom-domain scope, got %v", err)
+	}
+
+	scopes := "http,custom-domain"
+	if _, err := repo.UpdateClient("bob", database.ClientUpdate{Scopes: &scopes}); err != nil {
+		t.Fatalf("failed to update client: %v", err)
+	}
+	domain, err := m.Add(ctx, "bob.example.org", "bob", "app")
+	if err != nil {
+		t.Fatalf("expected the custom-domain scope to allow the domain, got %v", err)
+	}
+
+	// A pending domain is not activated once the scope is revoked.
+	scopes = "http"
+	if _, err := repo.UpdateClient("bob", database.ClientUpdate{Scopes: &scopes}); err != nil {
+		t.Fatalf("failed to update client: %v", err)
+	}
+	challenge := Challenge(domain)
+	records[challenge.Name] = []string{challenge.Value}
+	if _, err := m.Verify(ctx, "bob.example.org"); !errors.Is(err, ErrScopeDenied) {
+		t.Fatalf("expected ErrScopeDenied, got %v", err)
+	}
+	if n, err := m.VerifyPending(ctx); err != nil || n != 0 {
+		t.Fatalf("expected no activation, got %d (%v)", n, err)
+	}
+}
+
+func TestAddRejectsInvalidHostnames(t *testing.T) {
+	m, _ := newTestManager(t, nil)
+	ctx := context.Background()
+
+	tests := map[string]error{
+		"app.tunnel.example.com": ErrInvalidHostname,
+		"tunnel.example.com":     ErrInvalidHostname,
+		"localhost":              ErrInvalidHostname,
+		"192.0.2.1":              ErrInvalidHostname,
+		"-app.example.org":       ErrInvalidHostname,
+		"app_1.example.org":      ErrInvalidHostname,
+		"app..example.org":       ErrInvalidHostname,
+	}
+	for hostname, want := range tests {
+		if _, err := m.Add(ctx, hostname, "alice", "app"); !errors.Is(err, want) {
+			t.Fatalf("Add(%q): expected %v, got %v", hostname, want, err)
+		}
+	}
+
+	if _, err := m.Add(ctx, "app.example.org", "alice", "app"); err != nil {
+		t.Fatalf("failed to add custom domain: %v", err)
+	}
+	if _, err := m.Add(ctx, "APP.example.org", "alice", "api"); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package domains
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+)
+
+const (
+	// challengeLabel is prepended to a custom domain to name its TXT record,
+	// so the record does not clash with the domain's own TXT records.
+	challengeLabel = "_tunnelab-challenge"
+	// challengeValuePrefix starts the value of the TXT record.
+	challengeValuePrefix = "tunnelab-verification="
+)
+
+// TXTRecord is the DNS record that proves ownership of a custom domain.
+type TXTRecord struct {
+	Name  string `json:"name"`  // e.g. _tunnelab-challenge.app.example.org
+	Value string `json:"value"` // e.g. tunnelab-verification=<token>
+}
+
+// Challenge returns the TXT record the owner of domain must publish.
+func Challenge(domain *database.CustomDomain) TXTRecord {
+	return TXTRecord{
+		Name:  challengeLabel + "." + domain.Hostname,
+		Value: challengeValuePrefix + domain.VerificationToken,
+	}
+}
+
+// Resolver looks up DNS TXT records; *net.Resolver implements it.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Verifier checks the ownership of custom domains through DNS.
+type Verifier struct {
+	resolver Resolver
+}
+
+// NewVerifier creates a Verifier.
+//
+// Parameters:
+//   - resolver: Looks up TXT records, typically net.DefaultResolver
+//
+// Returns:
+//   - *Verifier: A verifier using resolver
+func NewVerifier(resolver Resolver) *Verifier {
+	return &Verifier{resolver: resolver}
+}
+
+// Check looks up the challenge TXT record of domain.
+//
+// Parameters:
+//   - ctx: Bounds the DNS lookup
+//   - domain: A custom domain with its verification token
+//
+// Returns:
+//   - error: nil if the record holds the expected value, ErrNotVerified otherwise
+func (v *Verifier) Check(ctx context.Context, domain *database.CustomDomain) error {
+	if domain.VerificationToken == "" {
+		return fmt.Errorf("%w: %s has no verification token", ErrNotVerified, domain.Hostname)
+	}
+	record := Challenge(domain)
+	values, err := v.resolver.LookupTXT(ctx, record.Name)
+	if err != nil {
+		return fmt.Errorf("%w: failed to look up the TXT record %s: %v", ErrNotVerified, record.Name, err)
+	}
+	for _, value := range values {
+		if strings.TrimSpace(value) == record.Value {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: TXT record %s does not contain %q", ErrNotVerified, record.Name, record.Value)
+}
+
+// newVerificationToken returns a random hex token for a new custom domain.
+func newVerificationToken() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate verification token: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
@@ -0,0 +1,185 @@
+// Package health serves liveness and readiness probes for the TunneLab server.
+//
+// Liveness (/healthz) only reports that the process is serving requests.
+// Readiness (/readyz) runs every registered check, such as a database ping or
+// whether a listener is bound, and answers 503 while any of them fails so
+// orchestrators like Kubernetes stop routing traffic to the instance.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultCheckTimeout bounds each readiness check.
+const defaultCheckTimeout = 2 * time.Second
+
+// Check reports an error when a dependency is not ready.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// listenerState is the readiness of a listener registered with AddListener.
+type listenerState struct {
+	mu    sync.Mutex
+	bound bool
+	err   error // Why the listener stopped serving, if it did
+}
+
+func (l *listenerState) check(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.err != nil:
+		return fmt.Errorf("stopped: %v", l.err)
+	case !l.bound:
+		return errors.New("not listening")
+	}
+	return nil
+}
+
+// Checker aggregates readiness checks and serves the probe endpoints.
+type Checker struct {
+	mu        sync.RWMutex
+	checks    []namedCheck
+	listeners map[string]*listenerState
+	timeout   time.Duration
+}
+
+// NewChecker creates a Checker with no readiness checks.
+//
+// Returns:
+//   - *Checker: A checker that reports ready until checks are added
+func NewChecker() *Checker {
+	return &Checker{listeners: make(map[string]*listenerState), timeout: defaultCheckTimeout}
+}
+
+// AddCheck registers a readiness check.
+//
+// Parameters:
+//   - name: Name reported in the readiness response, e.g. "database"
+//   - check: Returns an error while the dependency is unavailable
+func (c *Checker) AddCheck(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// AddListener registers a readiness check that fails until the returned
+// function is called, typically once the listener is serving, and again
+// after ListenerDown. Registering a name twice resets its check.
+//
+// Parameters:
+//   - name: Name reported in the readiness response, e.g. "http_listener"
+//
+// Returns:
+//   - func(): Marks the listener as serving
+func (c *Checker) AddListener(name string) func() {
+	c.mu.Lock()
+	state, ok := c.listeners[name]
+	if !ok {
+		state = &listenerState{}
+		c.listeners[name] = state
+		c.checks = append(c.checks, namedCheck{name: name, check: state.check})
+	}
+	c.mu.Unlock()
+
+	state.mu.Lock()
+	state.bound, state.err = false, nil
+	state.mu.Unlock()
+	return func() {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		state.bound, state.err = true, nil
+	}
+}
+
+// ListenerDown fails the readiness check of a listener registered with
+// AddListener, e.g. when its server stopped with an error. Unknown names
+// are ignored.
+//
+// Parameters:
+//   - name: Name the listener was registered with
+//   - err: Why the listener stopped serving
+func (c *Checker) ListenerDown(name string, err error) {
+	c.mu.RLock()
+	state := c.listeners[name]
+	c.mu.RUnlock()
+	if state == nil {
+		return
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.err = err
+}
+
+// HandleLive answers 200 as long as the process can serve requests.
+func (c *Checker) HandleLive(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "alive"})
+}
+
+// HandleReady runs every check and answers 200 when all pass, 503 otherwise.
+func (c *Checker) HandleReady(w http.ResponseWriter, r *http.Request) {
+	results, ready := c.Ready(r.Context())
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not ready", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]interface{}{
+		"status": status,
+		"checks": results,
+	})
+}
+
+// Ready runs every check concurrently.
+//
+// Parameters:
+//   - ctx: Context of the probe request
+//
+// Returns:
+//   - map[string]string: "ok" or the error of each check, by name
+//   - bool: Whether every check passed
+func (c *Checker) Ready(ctx context.Context) (map[string]string, bool) {
+	c.mu.RLock()
+	checks := append([]namedCheck(nil), c.checks...)
+	c.mu.RUnlock()
+
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, nc := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+			errs[i] = nc.check(checkCtx)
+		}()
+	}
+	wg.Wait()
+
+	results := make(map[string]string, len(checks))
+	ready := true
+	for i, nc := range checks {
+		if errs[i] != nil {
+			results[nc.name] = errs[i].Error()
+			ready = false
+			continue
+		}
+		results[nc.name] = "ok"
+	}
+	return results, ready
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
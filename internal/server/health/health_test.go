@@ -0,0 +1,100 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+)
+
+func probe(t *testing.T, handler http.HandlerFunc) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var body map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode probe response: %v", err)
+	}
+	return rec.Code, body
+}
+
+func TestReadinessFlipsWhenDatabasePingFails(t *testing.T) {
+	repo, err := database.NewRepository(filepath.Join(t.TempDir(), "tunnelab.db"))
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	c := NewChecker()
+	c.AddCheck("database", repo.PingContext)
+
+	if code, body := probe(t, c.HandleReady); code != http.StatusOK || body["status"] != "ready" {
+		t.Fatalf("expected ready, got %d %v", code, body)
+	}
+
+	repo.Close()
+	code, body := probe(t, c.HandleReady)
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after the database went away, got %d %v", code, body)
+	}
+	if checks := body["checks"].(map[string]interface{}); checks["database"] == "ok" {
+		t.Fatalf("expected the database check to fail, got %v", checks)
+	}
+
+	// Liveness does not depend on the database.
+	if code, _ := probe(t, c.HandleLive); code != http.StatusOK {
+		t.Fatalf("expected liveness to stay 200, got %d", code)
+	}
+}
+
+func TestReadinessWaitsForListeners(t *testing.T) {
+	c := NewChecker()
+	bound := c.AddListener("http_listener")
+	c.AddCheck("always", func(ctx context.Context) error { return nil })
+
+	if code, _ := probe(t, c.HandleReady); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before the listener is bound, got %d", code)
+	}
+	bound()
+	if code, body := probe(t, c.HandleReady); code != http.StatusOK {
+		t.Fatalf("expected 200 once the listener is bound, got %d %v", code, body)
+	}
+}
+
+func TestReadinessFailsWhenListenerStops(t *testing.T) {
+	c := NewChecker()
+	bound := c.AddListener("http_listener")
+	bound()
+	if code, body := probe(t, c.HandleReady); code != http.StatusOK {
+		t.Fatalf("expected 200 while the listener serves, got %d %v", code, body)
+	}
+
+	c.ListenerDown("http_listener", errors.New("accept failed"))
+	code, body := probe(t, c.HandleReady)
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after the listener stopped, got %d %v", code, body)
+	}
+	if checks := body["checks"].(map[string]interface{}); checks["http_listener"] != "stopped: accept failed" {
+		t.Fatalf("expected the listener check to name the error, got %v", checks)
+	}
+
+	// Registering the listener again, e.g. on restart, reuses its check.
+	c.AddListener("http_listener")()
+	if results, ready := c.Ready(context.Background()); !ready || len(results) != 1 {
+		t.Fatalf("expected one passing listener check, got %v", results)
+	}
+}
+
+func TestReadyReportsEveryCheck(t *testing.T) {
+	c := NewChecker()
+	c.AddCheck("good", func(ctx context.Context) error { return nil })
+	c.AddCheck("bad", func(ctx context.Context) error { return errors.New("down") })
+
+	results, ready := c.Ready(context.Background())
+	if ready || results["good"] != "ok" || results["bad"] != "down" {
+		t.Fatalf("unexpected results: %v %v", results, ready)
+	}
+}
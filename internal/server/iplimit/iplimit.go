@@ -0,0 +1,78 @@
+// Package iplimit caps the simultaneous connections from a single source IP,
+// so one host cannot exhaust the server regardless of how many client
+// tokens it holds.
+//
+// Usage:
+//
+//	limiter := iplimit.NewLimiter(20)
+//	if !limiter.Acquire(ip) {
+//		// reject the connection
+//	}
+//	defer limiter.Release(ip)
+package iplimit
+
+import "sync"
+
+// Limiter counts open connections per source IP. A nil Limiter allows
+// everything.
+type Limiter struct {
+	max int
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewLimiter creates a Limiter.
+//
+// Parameters:
+//   - max: Simultaneous connections allowed per IP (0 or less means no limit)
+//
+// Returns:
+//   - *Limiter: The limiter, or nil if max is not positive
+func NewLimiter(max int) *Limiter {
+	if max <= 0 {
+		return nil
+	}
+	return &Limiter{max: max, counts: make(map[string]int)}
+}
+
+// Acquire reserves a connection slot for ip.
+//
+// Returns:
+//   - bool: false if ip already has the maximum number of connections open
+func (l *Limiter) Acquire(ip string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[ip] >= l.max {
+		return false
+	}
+	l.counts[ip]++
+	return true
+}
+
+// Release frees a slot reserved by Acquire.
+func (l *Limiter) Release(ip string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[ip] <= 1 {
+		delete(l.counts, ip)
+		return
+	}
+	l.counts[ip]--
+}
+
+// Count returns the connections open from ip.
+func (l *Limiter) Count(ip string) int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.counts[ip]
+}
@@ -0,0 +1,42 @@
+package iplimit
+
+import "testing"
+
+func TestLimiterCapsAndReleasesPerIP(t *testing.T) {
+	l := NewLimiter(2)
+	if !l.Acquire("10.0.0.1") || !l.Acquire("10.0.0.1") {
+		t.Fatal("expected two connections to be allowed")
+	}
+	if l.Acquire("10.0.0.1") {
+		t.Fatal("expected the third connection to be rejected")
+	}
+	if !l.Acquire("10.0.0.2") {
+		t.Fatal("expected another IP to have its own limit")
+	}
+
+	l.Release("10.0.0.1")
+	if l.Count("10.0.0.1") != 1 {
+		t.Fatalf("expected one connection left, got %d", l.Count("10.0.0.1"))
+	}
+	if !l.Acquire("10.0.0.1") {
+		t.Fatal("expected a released slot to be reusable")
+	}
+
+	l.Release("10.0.0.2")
+	if _, tracked := l.counts["10.0.0.2"]; tracked {
+		t.Fatal("expected IPs without connections to be forgotten")
+	}
+}
+
+func TestNilLimiterAllowsEverything(t *testing.T) {
+	l := NewLimiter(0)
+	if l != nil {
+		t.Fatal("expected no limiter without a limit")
+	}
+	for i := 0; i < 100; i++ {
+		if !l.Acquire("10.0.0.1") {
+			t.Fatal("expected a nil limiter to allow every connection")
+		}
+	}
+	l.Release("10.0.0.1")
+}
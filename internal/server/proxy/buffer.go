@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+)
+
+// defaultCopyBufferSize is the copy buffer size used when none is configured.
+const defaultCopyBufferSize = 32 * 1024
+
+// bufferPool hands out copy buffers of a fixed size. When pooling is enabled
+// buffers are recycled through a sync.Pool, which keeps GC pressure flat under
+// many concurrent streams; otherwise each copy allocates its own buffer.
+type bufferPool struct {
+	size int
+	pool *sync.Pool
+}
+
+func newBufferPool(size int, pooled bool) *bufferPool {
+	if size <= 0 {
+		size = defaultCopyBufferSize
+	}
+	b := &bufferPool{size: size}
+	if pooled {
+		b.pool = &sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, size)
+				return &buf
+			},
+		}
+	}
+	return b
+}
+
+func (b *bufferPool) get() *[]byte {
+	if b.pool != nil {
+		return b.pool.Get().(*[]byte)
+	}
+	buf := make([]byte, b.size)
+	return &buf
+}
+
+func (b *bufferPool) put(buf *[]byte) {
+	if b.pool != nil {
+		b.pool.Put(buf)
+	}
+}
+
+// copy is io.CopyBuffer with a buffer from the pool.
+func (b *bufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := b.get()
+	defer b.put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+const (
+	// peerStreamPath is where a node accepts streams to its tunnels from other nodes.
+	peerStreamPath = "/_tunnelab/streams/"
+	// peerStreamProtocol is the Upgrade token of the inter-node stream link.
+	peerStreamProtocol = "tunnelab-stream"
+	// clusterSecretHeader carries the shared secret that authenticates nodes to each other.
+	clusterSecretHeader = "X-Tunnelab-Cluster-Secret"
+	// peerHandshakeTimeout bounds dialing a peer and upgrading the connection.
+	peerHandshakeTimeout = 5 * time.Second
+)
+
+// ownerKey carries the owning node of a relayed request in its context.
+type ownerKey struct{}
+
+// EnableClusterForwarding relays requests for tunnels held by another node
+// over a stream link to that node, and accepts such links from peers that
+// present the same secret on the PeerStreamHandler. The registry must share
+// ownership through a Store.
+//
+// Parameters:
+//   - secret: Shared secret of the cluster nodes
+//   - tlsConfig: Mutual TLS configuration of the stream links, as returned
+//     by NewPeerTLSConfig
+func (p *HTTPProxy) EnableClusterForwarding(secret string, tlsConfig *tls.Config) {
+	p.clusterSecret = secret
+	p.peerTLS = tlsConfig
+}
+
+// NewPeerTLSConfig loads the mutual TLS configuration of the stream links.
+// Every node presents its own certificate and accepts, as server and as
+// client, only peers whose certificate is signed by the cluster CA.
+//
+// Parameters:
+//   - certPath: PEM certificate of this node
+//   - keyPath: PEM private key of this node
+//   - caPath: PEM bundle of the CA that signs the node certificates
+//
+// Returns:
+//   - *tls.Config: Configuration for both the peer listener and peer dials
+//   - error: Error if a file cannot be read or parsed
+func NewPeerTLSConfig(certPath, keyPath, caPath string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cluster certificate: %w", err)
+	}
+	caPEM, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in cluster CA %s", caPath)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// PeerStreamHandler returns the handler of the peer listener, which serves
+// stream links to the tunnels of this node. It must only be served over TLS
+// with the configuration given to EnableClusterForwarding, never on the
+// public proxy ports.
+func (p *HTTPProxy) PeerStreamHandler() http.Handler {
+	return http.HandlerFunc(p.handlePeerStream)
+}
+
+// newPeerProxy builds the ReverseProxy for tunnels held by another node. It
+// proxies the request like a local one, but each request travels over a
+// stream link to the owning node, which bridges it to the tunnel's mux session.
+func (p *HTTPProxy) newPeerProxy() *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: p.rewriteRequest,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				owner, _ := ctx.Value(ownerKey{}).(*registry.Owner)
+				if owner == nil {
+					return nil, fmt.Errorf("no owning node for %s", addr)
+				}
+				return dialPeerStream(ctx, owner, p.clusterSecret, p.peerTLS)
+			},
+			DisableKeepAlives:     true,
+			DisableCompression:    true,
+			ExpectContinueTimeout: expectContinueTimeout,
+		},
+		BufferPool:     reverseProxyBuffers{p.buffers},
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Failed to relay request for %s to its owning node: %v", r.Host, err)
+			http.Error(w, "Failed to reach tunnel", http.StatusBadGateway)
+		},
+	}
+}
+
+// remoteTunnel looks up a tunnel held by another node. The returned
+// TunnelInfo only carries the identity of the tunnel; its live state stays
+// on the owning node.
+func (p *HTTPProxy) remoteTunnel(subdomain string) (*registry.TunnelInfo, *registry.Owner, bool) {
+	if p.clusterSecret == "" {
+		return nil, nil, false
+	}
+	owner, remote := p.registry.RemoteOwner(subdomain)
+	if !remote {
+		return nil, nil, false
+	}
+	tunnel := &registry.TunnelInfo{
+		ID:         owner.TunnelID,
+		ClientID:   owner.ClientID,
+		Subdomain:  owner.Subdomain,
+		Protocol:   "http",
+		PublicPort: owner.Port,
+	}
+	return tunnel, owner, true
+}
+
+// dialPeerStream opens a stream to the tunnel of owner through the owning
+// node's peer listener. The node's certificate must be valid for the host
+// of its advertised address.
+func dialPeerStream(ctx context.Context, owner *registry.Owner, secret string, tlsConfig *tls.Config) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(owner.Node)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address of node %s: %w", owner.Node, err)
+	}
+	config := tlsConfig.Clone()
+	config.ServerName = host
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: peerHandshakeTimeout}, Config: config}
+	conn, err := dialer.DialContext(ctx, "tcp", owner.Node)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node %s: %w", owner.Node, err)
+	}
+	conn.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Scheme: "https", Host: owner.Node, Path: peerStreamPath + owner.Subdomain},
+		Host:   owner.Node,
+		Header: http.Header{
+			"Connection":        {"Upgrade"},
+			"Upgrade":           {peerStreamProtocol},
+			clusterSecretHeader: {secret},
+		},
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to request stream from node %s: %w", owner.Node, err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read stream response from node %s: %w", owner.Node, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("node %s refused stream for %s: %s", owner.Node, owner.Subdomain, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		return &peekedConn{Conn: conn, reader: io.MultiReader(reader, conn)}, nil
+	}
+	return conn, nil
+}
+
+// handlePeerStream serves the stream link: it upgrades the connection of an
+// authenticated peer and bridges it to a new stream of the local tunnel.
+// Only tunnels held by this node are served, so links are never chained.
+func (p *HTTPProxy) handlePeerStream(w http.ResponseWriter, r *http.Request) {
+	if p.clusterSecret == "" || !strings.HasPrefix(r.URL.Path, peerStreamPath) {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), peerStreamProtocol) {
+		http.Error(w, "Expected Upgrade: "+peerStreamProtocol, http.StatusUpgradeRequired)
+		return
+	}
+	secret := r.Header.Get(clusterSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(p.clusterSecret)) != 1 {
+		http.Error(w, "Invalid cluster secret", http.StatusForbidden)
+		log.Printf("Stream link rejected for %s: invalid cluster secret", p.clientIP(r))
+		return
+	}
+	subdomain := strings.TrimPrefix(r.URL.Path, peerStreamPath)
+	tunnel, exists := p.registry.Pick(subdomain)
+	if !exists {
+		http.Error(w, "Tunnel not found", http.StatusNotFound)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Stream links are not supported on this connection", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Stream link: failed to hijack connection: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+
+	response := "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + peerStreamProtocol + "\r\n\r\n"
+	if _, err := io.WriteString(conn, response); err != nil {
+		log.Printf("Stream link: failed to write response: %v", err)
+		return
+	}
+
+	var peer net.Conn = conn
+	if rw.Reader.Buffered() > 0 {
+		peer = &peekedConn{Conn: conn, reader: io.MultiReader(rw.Reader, conn)}
+	}
+	bridge(p.registry, p.buffers, peer, tunnel)
+}
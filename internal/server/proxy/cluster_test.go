@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// writePEM writes one PEM block to a new file in dir and returns its path.
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// newTestPeerTLS issues a cluster CA and a node certificate for 127.0.0.1
+// and loads them with NewPeerTLSConfig.
+func newTestPeerTLS(t *testing.T) *tls.Config {
+	t.Helper()
+	dir := t.TempDir()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tunnelab cluster CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	nodeKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	nodeTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	nodeDER, err := x509.CreateCertificate(rand.Reader, nodeTemplate, ca, &nodeKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create node certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(nodeKey)
+
+	config, err := NewPeerTLSConfig(
+		writePEM(t, dir, "node.pem", "CERTIFICATE", nodeDER),
+		writePEM(t, dir, "node-key.pem", "EC PRIVATE KEY", keyDER),
+		writePEM(t, dir, "ca.pem", "CERTIFICATE", caDER),
+	)
+	if err != nil {
+		t.Fatalf("failed to load peer TLS: %v", err)
+	}
+	return config
+}
+
+// testNode is a server instance of a test cluster: its public proxy and
+// its peer listener.
+type testNode struct {
+	registry *registry.Registry
+	public   *httptest.Server
+	peer     *httptest.Server
+}
+
+// newTestNode starts a server instance whose registry shares ownership
+// through store, advertising its TLS peer listener to the other nodes.
+func newTestNode(t *testing.T, store registry.Store, peerTLS *tls.Config) *testNode {
+	t.Helper()
+	reg := registry.NewRegistry()
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	p.EnableClusterForwarding("cluster-secret", peerTLS)
+	public := httptest.NewServer(p)
+	t.Cleanup(public.Close)
+	peer := httptest.NewUnstartedServer(p.PeerStreamHandler())
+	peer.TLS = peerTLS
+	peer.StartTLS()
+	t.Cleanup(peer.Close)
+	reg.SetStore(store, strings.TrimPrefix(peer.URL, "https://"), time.Minute)
+	return &testNode{registry: reg, public: public, peer: peer}
+}
+
+// TestHTTPProxyRelaysToOwningNode runs two server instances sharing one
+// store and checks that the instance without the tunnel relays requests to
+// the other over a stream link.
+func TestHTTPProxyRelaysToOwningNode(t *testing.T) {
+	store := registry.NewMemoryStore()
+	peerTLS := newTestPeerTLS(t)
+	nodeA := newTestNode(t, store, peerTLS)
+	nodeB := newTestNode(t, store, peerTLS)
+
+	tunnel := newTestTunnel(t, nodeA.registry, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Seen-Host", r.Host)
+		io.WriteString(w, "node A got "+string(body))
+	}))
+
+	req, _ := http.NewRequest(http.MethodPost, nodeB.public.URL+"/path", strings.NewReader("ping"))
+	req.Host = "app.tunnel.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "node A got ping" {
+		t.Fatalf("expected the request to be relayed to node A, got %d %q", resp.StatusCode, body)
+	}
+	if host := resp.Header.Get("X-Seen-Host"); host != "app.tunnel.example.com" {
+		t.Fatalf("expected the original Host to be preserved, got %q", host)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for tunnel.Stats.Requests.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tunnel.Stats.Requests.Load() != 1 {
+		t.Fatalf("expected the owning node to count the relayed request, got %d", tunnel.Stats.Requests.Load())
+	}
+}
+
+func TestHTTPProxyPeerStreamRequiresSecret(t *testing.T) {
+	store := registry.NewMemoryStore()
+	peerTLS := newTestPeerTLS(t)
+	nodeA := newTestNode(t, store, peerTLS)
+	newTestTunnel(t, nodeA.registry, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: peerTLS}}
+
+	cases := map[string]struct {
+		secret string
+		path   string
+		want   int
+	}{
+		"missing secret": {"", peerStreamPath + "app", http.StatusForbidden},
+		"wrong secret":   {"guess", peerStreamPath + "app", http.StatusForbidden},
+		"unknown tunnel": {"cluster-secret", peerStreamPath + "other", http.StatusNotFound},
+		"other path":     {"cluster-secret", "/app", http.StatusNotFound},
+	}
+	for name, tc := range cases {
+		req, _ := http.NewRequest(http.MethodGet, nodeA.peer.URL+tc.path, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", peerStreamProtocol)
+		if tc.secret != "" {
+			req.Header.Set(clusterSecretHeader, tc.secret)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: expected %d, got %d", name, tc.want, resp.StatusCode)
+		}
+	}
+}
+
+func TestHTTPProxyPeerStreamRequiresClientCertificate(t *testing.T) {
+	store := registry.NewMemoryStore()
+	peerTLS := newTestPeerTLS(t)
+	nodeA := newTestNode(t, store, peerTLS)
+	newTestTunnel(t, nodeA.registry, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// Trusts the node, but presents no certificate of its own.
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: peerTLS.RootCAs}}}
+	req, _ := http.NewRequest(http.MethodGet, nodeA.peer.URL+peerStreamPath+"app", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", peerStreamProtocol)
+	req.Header.Set(clusterSecretHeader, "cluster-secret")
+	if resp, err := client.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected the handshake without a client certificate to fail, got %d", resp.StatusCode)
+	}
+}
+
+// TestHTTPProxyPublicPortDoesNotServePeerStreams checks that a stream link
+// request on the public port is an ordinary request for the tunnel.
+func TestHTTPProxyPublicPortDoesNotServePeerStreams(t *testing.T) {
+	store := registry.NewMemoryStore()
+	nodeA := newTestNode(t, store, newTestPeerTLS(t))
+	newTestTunnel(t, nodeA.registry, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunnel got "+r.URL.Path)
+	}))
+
+	req, _ := http.NewRequest(http.MethodGet, nodeA.public.URL+peerStreamPath+"app", nil)
+	req.Host = "app.tunnel.example.com"
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", peerStreamProtocol)
+	req.Header.Set(clusterSecretHeader, "cluster-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "tunnel got "+peerStreamPath+"app" {
+		t.Fatalf("expected the request to reach the tunnel, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestHTTPProxyWithoutClusterForwarding(t *testing.T) {
+	store := registry.NewMemoryStore()
+	nodeA := newTestNode(t, store, newTestPeerTLS(t))
+	newTestTunnel(t, nodeA.registry, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	regB := registry.NewRegistry()
+	regB.SetStore(store, "10.0.0.2:80", time.Minute)
+	p := NewHTTPProxy(regB, "tunnel.example.com")
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/", nil)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without cluster forwarding, got %d", rec.Code)
+	}
+}
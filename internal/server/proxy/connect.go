@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// handleConnect serves "CONNECT host:port" by bridging the hijacked client
+// connection to a TCP tunnel. This lets clients behind firewalls reach TCP
+// tunnels through the HTTP(S) port instead of the public port range.
+//
+// The target must be either a TCP tunnel's subdomain ("db.tunnel.example.com:443")
+// or the apex domain with the tunnel's public port ("tunnel.example.com:30001").
+func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+	ip := p.clientIP(r)
+	if !p.ipLimits.Acquire(ip) {
+		p.rejectIP(w, ip)
+		return
+	}
+	defer p.ipLimits.Release(ip)
+
+	tunnel, ok := p.connectTarget(r.Host)
+	if !ok {
+		http.Error(w, "CONNECT target is not an allowed tunnel", http.StatusForbidden)
+		log.Printf("CONNECT rejected for %s from %s", r.Host, p.clientIP(r))
+		return
+	}
+	if p.quotas != nil && p.quotas.Exceeded(tunnel.ClientID) {
+		log.Printf("CONNECT: rejected session to tunnel %s: client %s is over its byte quota", tunnel.Subdomain, tunnel.ClientID)
+		http.Error(w, "Bandwidth quota exceeded", statusBandwidthLimitExceeded)
+		return
+	}
+	if !tunnel.AcquireConn() {
+		log.Printf("CONNECT: tunnel %s reached its limit of %d concurrent connections", tunnel.Subdomain, tunnel.MaxStreams)
+		http.Error(w, "Tunnel has too many open connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer tunnel.ReleaseConn()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT is not supported on this connection", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("CONNECT: failed to hijack connection: %v", err)
+		return
+	}
+	defer conn.Close()
+	// The tunnel outlives the request, so the server's read and write
+	// timeouts must not apply to it.
+	conn.SetDeadline(time.Time{})
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		log.Printf("CONNECT: failed to write response: %v", err)
+		return
+	}
+
+	// Bytes the client sent right after the CONNECT request may already be
+	// sitting in the server's read buffer.
+	var client net.Conn = conn
+	if rw.Reader.Buffered() > 0 {
+		client = &peekedConn{Conn: conn, reader: io.MultiReader(rw.Reader, conn)}
+	}
+
+	log.Printf("CONNECT: forwarding %s to tunnel %s", p.clientIP(r), tunnel.Subdomain)
+	start := time.Now()
+	if bytesIn, bytesOut, ok := bridge(p.registry, p.buffers, client, tunnel); ok {
+		fireConnectionHook(p.ConnectionHook, tunnel, p.clientIP(r), localPort(conn), bytesIn, bytesOut, start)
+	}
+}
+
+// connectTarget resolves a CONNECT authority to a registered TCP tunnel.
+func (p *HTTPProxy) connectTarget(authority string) (*registry.TunnelInfo, bool) {
+	host, portStr, err := net.SplitHostPort(authority)
+	if err != nil {
+		host = authority
+	}
+
+	var tunnel *registry.TunnelInfo
+	var exists bool
+	if host == p.domain {
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, false
+		}
+		tunnel, exists = p.registry.GetByPort(port)
+	} else if subdomain := p.extractSubdomain(host); subdomain != "" {
+		tunnel, exists = p.registry.GetBySubdomain(subdomain)
+	}
+	if !exists || tunnel.Protocol != "tcp" {
+		return nil, false
+	}
+	return tunnel, true
+}
+
+// WithConnect routes CONNECT requests to the proxy before they reach next.
+// http.ServeMux does not match CONNECT requests against path patterns, so the
+// public listener's mux must be wrapped for CONNECT tunneling to work.
+func (p *HTTPProxy) WithConnect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			p.handleConnect(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
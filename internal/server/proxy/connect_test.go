@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+func dialConnect(t *testing.T, serverURL, target string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(serverURL, "http://"))
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("failed to read CONNECT response: %v", err)
+	}
+	return conn, reader, resp
+}
+
+func TestConnectBridgesToTCPTunnel(t *testing.T) {
+	reg := registry.NewRegistry()
+	tunnel := newTestTCPTunnel(t, reg, "db", 30001)
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+
+	mux := http.NewServeMux()
+	mux.Handle("/", p)
+	server := httptest.NewServer(p.WithConnect(mux))
+	defer server.Close()
+
+	for _, target := range []string{"db.tunnel.example.com:443", "tunnel.example.com:30001"} {
+		conn, reader, resp := dialConnect(t, server.URL, target)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT %s: expected 200, got %d", target, resp.StatusCode)
+		}
+
+		if _, err := io.WriteString(conn, "ping"); err != nil {
+			t.Fatalf("failed to write through tunnel: %v", err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			t.Fatalf("failed to read echo: %v", err)
+		}
+		if string(buf) != "ping" {
+			t.Fatalf("expected echo %q, got %q", "ping", buf)
+		}
+		conn.Close()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for tunnel.Stats.BytesIn.Load() < 8 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := tunnel.Stats.BytesIn.Load(); got != 8 {
+		t.Fatalf("expected 8 bytes in, got %d", got)
+	}
+}
+
+func TestConnectRejectsDisallowedTargets(t *testing.T) {
+	reg := registry.NewRegistry()
+	newTestTunnel(t, reg, "web", http.NotFoundHandler())
+	newTestTCPTunnel(t, reg, "db", 30001)
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	for _, target := range []string{
+		"web.tunnel.example.com:443", // HTTP tunnel
+		"missing.tunnel.example.com:443",
+		"tunnel.example.com:30002",
+		"example.org:22",
+	} {
+		_, _, resp := dialConnect(t, server.URL, target)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("CONNECT %s: expected 403, got %d", target, resp.StatusCode)
+		}
+	}
+}
+
+func TestConnectHonorsTunnelConnectionLimit(t *testing.T) {
+	reg := registry.NewRegistry()
+	tunnel := newTestTCPTunnel(t, reg, "db", 30001)
+	tunnel.MaxStreams = 1
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	server := httptest.NewServer(p.WithConnect(http.NotFoundHandler()))
+	defer server.Close()
+
+	first, _, resp := dialConnect(t, server.URL, "db.tunnel.example.com:443")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the first CONNECT to be accepted, got %d", resp.StatusCode)
+	}
+	if _, _, resp := dialConnect(t, server.URL, "db.tunnel.example.com:443"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 beyond the connection limit, got %d", resp.StatusCode)
+	}
+
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, _, resp := dialConnect(t, server.URL, "db.tunnel.example.com:443")
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the slot to be released once the first session closed, got %d", resp.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
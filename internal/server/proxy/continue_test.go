@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// sendExpectContinue writes a request with "Expect: 100-continue" and returns
+// the first response the proxy sends back, before any body is written.
+func sendExpectContinue(t *testing.T, server *httptest.Server) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "PUT /upload HTTP/1.1\r\n"+
+		"Host: app.tunnel.example.com\r\n"+
+		"Content-Length: 5\r\n"+
+		"Expect: 100-continue\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return conn, reader, resp
+}
+
+func TestExpectContinueRelaysInterimResponse(t *testing.T) {
+	reg := registry.NewRegistry()
+	newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Expect") != "100-continue" {
+			t.Errorf("expected Expect header at the origin, got %q", r.Header.Get("Expect"))
+		}
+		body, _ := io.ReadAll(r.Body) // triggers the origin's 100 Continue
+		io.WriteString(w, "got "+string(body))
+	}))
+	server := httptest.NewServer(NewHTTPProxy(reg, "tunnel.example.com"))
+	defer server.Close()
+
+	conn, reader, interim := sendExpectContinue(t, server)
+	if interim.StatusCode != http.StatusContinue {
+		t.Fatalf("expected 100 Continue before the body, got %d", interim.StatusCode)
+	}
+
+	io.WriteString(conn, "hello")
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("failed to read final response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "got hello" {
+		t.Fatalf("unexpected final response: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestExpectContinueOriginRejectsUpload(t *testing.T) {
+	reg := registry.NewRegistry()
+	newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+	}))
+	server := httptest.NewServer(NewHTTPProxy(reg, "tunnel.example.com"))
+	defer server.Close()
+
+	conn, _, resp := sendExpectContinue(t, server)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected the origin's rejection without sending a body, got %d", resp.StatusCode)
+	}
+	// The client gives up on the upload; the body is never sent.
+	conn.Close()
+}
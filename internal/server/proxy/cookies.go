@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// rewriteCookies adapts the Set-Cookie headers of a tunnel response to the
+// public host, for tunnels that asked for it: a Domain naming the local app
+// (localhost, a loopback address or local_host) becomes the public host, and
+// over HTTPS cookies get Secure, plus SameSite=Lax if they set no SameSite.
+// Every Set-Cookie header is rewritten on its own; other attributes are
+// kept as sent.
+func rewriteCookies(resp *http.Response, tunnel *registry.TunnelInfo) {
+	if !tunnel.RewriteCookies {
+		return
+	}
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	publicHost := resp.Request.Host
+	if host, _, err := net.SplitHostPort(publicHost); err == nil {
+		publicHost = host
+	}
+	secure := forwardedScheme(resp.Request) == "https"
+
+	rewritten := make([]string, len(cookies))
+	for i, cookie := range cookies {
+		rewritten[i] = rewriteSetCookie(cookie, publicHost, tunnel.LocalHost, secure)
+	}
+	resp.Header["Set-Cookie"] = rewritten
+}
+
+// rewriteSetCookie rewrites the attributes of one Set-Cookie value.
+func rewriteSetCookie(cookie, publicHost, localHost string, secure bool) string {
+	parts := strings.Split(cookie, ";")
+	hasSecure, hasSameSite := false, false
+	for i := 1; i < len(parts); i++ {
+		name, value, _ := strings.Cut(strings.TrimSpace(parts[i]), "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "domain":
+			if isLocalCookieDomain(strings.TrimSpace(value), localHost) {
+				parts[i] = " Domain=" + publicHost
+			}
+		case "secure":
+			hasSecure = true
+		case "samesite":
+			hasSameSite = true
+		}
+	}
+	if secure && !hasSecure {
+		parts = append(parts, " Secure")
+	}
+	if secure && !hasSameSite {
+		parts = append(parts, " SameSite=Lax")
+	}
+	return strings.Join(parts, ";")
+}
+
+// isLocalCookieDomain reports whether a cookie Domain names the local app.
+func isLocalCookieDomain(domain, localHost string) bool {
+	domain = strings.TrimPrefix(domain, ".")
+	if strings.EqualFold(domain, "localhost") || (localHost != "" && strings.EqualFold(domain, strings.Trim(localHost, "[]"))) {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(domain, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
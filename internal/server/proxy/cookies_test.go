@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+func TestRewriteSetCookie(t *testing.T) {
+	tests := map[string]struct {
+		cookie string
+		secure bool
+		want   string
+	}{
+		"localhost domain":      {cookie: "sid=1; Domain=localhost; Path=/", want: "sid=1; Domain=app.tunnel.example.com; Path=/"},
+		"dotted local host":     {cookie: "sid=1; domain=.api.internal", want: "sid=1; Domain=app.tunnel.example.com"},
+		"loopback domain":       {cookie: "sid=1; Domain=127.0.0.1", want: "sid=1; Domain=app.tunnel.example.com"},
+		"foreign domain kept":   {cookie: "sid=1; Domain=example.org", want: "sid=1; Domain=example.org"},
+		"secure over https":     {cookie: "sid=1; Path=/", secure: true, want: "sid=1; Path=/; Secure; SameSite=Lax"},
+		"existing attributes":   {cookie: "sid=1; secure; SameSite=Strict", secure: true, want: "sid=1; secure; SameSite=Strict"},
+		"samesite none secured": {cookie: "sid=1; SameSite=None", secure: true, want: "sid=1; SameSite=None; Secure"},
+		"plain http unchanged":  {cookie: "sid=1; HttpOnly", want: "sid=1; HttpOnly"},
+		"value with equals":     {cookie: "data=a=b; Domain=localhost", want: "data=a=b; Domain=app.tunnel.example.com"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := rewriteSetCookie(tt.cookie, "app.tunnel.example.com", "api.internal", tt.secure); got != tt.want {
+				t.Fatalf("rewriteSetCookie(%q) = %q, want %q", tt.cookie, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetCookieHeadersAreRewrittenOverTLS(t *testing.T) {
+	reg := registry.NewRegistry()
+	tunnel := newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "sid=1; Domain=localhost; Path=/; HttpOnly")
+		w.Header().Add("Set-Cookie", "theme=dark; SameSite=Strict")
+		w.Header().Add("Set-Cookie", "Expires=Wed, 21 Oct 2026 07:28:00 GMT; Max-Age=60")
+	}))
+	tunnel.LocalHost = "localhost"
+	server := httptest.NewTLSServer(NewHTTPProxy(reg, "tunnel.example.com"))
+	t.Cleanup(server.Close)
+
+	resp := getThroughProxy(t, server, "/")
+	if got := resp.Header.Values("Set-Cookie"); len(got) != 3 || got[0] != "sid=1; Domain=localhost; Path=/; HttpOnly" {
+		t.Fatalf("expected cookies to be forwarded unchanged by default, got %q", got)
+	}
+
+	tunnel.RewriteCookies = true
+	resp = getThroughProxy(t, server, "/")
+	want := []string{
+		"sid=1; Domain=app.tunnel.example.com; Path=/; HttpOnly; Secure; SameSite=Lax",
+		"theme=dark; SameSite=Strict; Secure",
+		"Expires=Wed, 21 Oct 2026 07:28:00 GMT; Max-Age=60; Secure; SameSite=Lax",
+	}
+	if got := resp.Header.Values("Set-Cookie"); !slices.Equal(got, want) {
+		t.Fatalf("expected Set-Cookie headers %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,34 @@
+package proxy
+
+// CustomDomainResolver maps custom domains, hostnames outside the server
+// domain, to the tunnels they serve.
+type CustomDomainResolver interface {
+	ResolveCustomDomain(host string) (clientID, subdomain string, ok bool)
+}
+
+// SetCustomDomains routes requests for verified custom domains to the tunnel
+// of their client. A custom domain only reaches a tunnel held by the client it
+// was registered for, so a subdomain taken over by another client is not
+// served under someone else's hostname.
+//
+// Parameters:
+//   - resolver: Resolves custom domains, typically a domains.Manager (nil disables them)
+func (p *HTTPProxy) SetCustomDomains(resolver CustomDomainResolver) {
+	p.customDomains = resolver
+}
+
+// resolveHost returns the tunnel subdomain named by a Host header or TLS
+// server name. For a custom domain it also returns the client that must own
+// the tunnel; for a subdomain of the server domain clientID is "".
+func (p *HTTPProxy) resolveHost(host string) (subdomain, clientID string) {
+	if subdomain := p.extractSubdomain(host); subdomain != "" {
+		return subdomain, ""
+	}
+	if p.customDomains == nil {
+		return "", ""
+	}
+	if clientID, subdomain, ok := p.customDomains.ResolveCustomDomain(host); ok {
+		return subdomain, clientID
+	}
+	return "", ""
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// staticCustomDomains resolves the hostnames of its map to "client/subdomain".
+type staticCustomDomains map[string]string
+
+func (s staticCustomDomains) ResolveCustomDomain(host string) (string, string, bool) {
+	target, ok := s[strings.ToLower(strings.Split(host, ":")[0])]
+	if !ok {
+		return "", "", false
+	}
+	clientID, subdomain, _ := strings.Cut(target, "/")
+	return clientID, subdomain, true
+}
+
+func TestProxyRoutesCustomDomains(t *testing.T) {
+	reg := registry.NewRegistry()
+	newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.Host)
+	}))
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	p.SetCustomDomains(staticCustomDomains{
+		"app.example.org":    "client/app",
+		"stolen.example.org": "other-client/app",
+	})
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+
+	tests := map[string]struct {
+		host       string
+		wantStatus int
+		wantBody   string
+	}{
+		"custom domain":           {host: "app.example.org", wantStatus: http.StatusOK, wantBody: "hello app.example.org"},
+		"custom domain with port": {host: "App.Example.org:8080", wantStatus: http.StatusOK, wantBody: "hello App.Example.org:8080"},
+		"subdomain still routed":  {host: "app.tunnel.example.com", wantStatus: http.StatusOK, wantBody: "hello app.tunnel.example.com"},
+		"other client's tunnel":   {host: "stolen.example.org", wantStatus: http.StatusNotFound},
+		"unknown hostname":        {host: "unknown.example.org", wantStatus: http.StatusBadRequest},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+			if err != nil {
+				t.Fatalf("failed to build request: %v", err)
+			}
+			req.Host = tt.host
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("expected %d, got %d %q", tt.wantStatus, resp.StatusCode, body)
+			}
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Fatalf("expected %q, got %q", tt.wantBody, body)
+			}
+		})
+	}
+}
+
+func TestAllowsServerNameAcceptsCustomDomains(t *testing.T) {
+	reg := registry.NewRegistry()
+	newTestTunnel(t, reg, "app", http.NotFoundHandler())
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	p.SetCustomDomains(staticCustomDomains{
+		"app.example.org":  "client/app",
+		"idle.example.org": "client/idle",
+	})
+
+	tests := map[string]bool{
+		"app.example.org":     true,
+		"idle.example.org":    false, // No tunnel for its subdomain
+		"unknown.example.org": false,
+	}
+	for serverName, want := range tests {
+		if got := p.AllowsServerName(serverName); got != want {
+			t.Fatalf("AllowsServerName(%q): expected %v, got %v", serverName, want, got)
+		}
+	}
+}
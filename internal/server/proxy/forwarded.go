@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// SetTrustedProxies configures the load balancers/CDNs in front of the proxy.
+// Requests arriving from a trusted address have their X-Forwarded-For chain
+// honored; hops in the chain that are themselves trusted are skipped.
+//
+// Parameters:
+//   - entries: IP addresses or CIDR ranges (e.g. "10.0.0.0/8")
+//
+// Returns:
+//   - error: Error if an entry is neither an IP nor a CIDR
+func (p *HTTPProxy) SetTrustedProxies(entries []string) error {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	p.trustedProxies = nets
+	return nil
+}
+
+func (p *HTTPProxy) isTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range p.trustedProxies {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the real client. The X-Forwarded-For chain
+// is only consulted when the direct peer is trusted, and is walked from the
+// right, skipping trusted hops, so a client cannot spoof its address.
+func (p *HTTPProxy) clientIP(r *http.Request) string {
+	remote := remoteIP(r.RemoteAddr)
+	if !p.isTrusted(remote) {
+		return remote
+	}
+
+	hops := forwardedHops(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			break
+		}
+		if !p.isTrusted(hops[i]) {
+			return hops[i]
+		}
+		remote = hops[i]
+	}
+	return remote
+}
+
+// setForwardedHeaders sets X-Forwarded-For and X-Real-IP on a request about
+// to be forwarded to the tunnel. An untrusted peer's chain is discarded.
+func (p *HTTPProxy) setForwardedHeaders(r *http.Request) {
+	remote := remoteIP(r.RemoteAddr)
+	chain := remote
+	if p.isTrusted(remote) {
+		if hops := forwardedHops(r.Header); len(hops) > 0 {
+			chain = strings.Join(hops, ", ") + ", " + remote
+		}
+	}
+	r.Header.Set("X-Forwarded-For", chain)
+	r.Header.Set("X-Real-IP", p.clientIP(r))
+}
+
+func forwardedHops(header http.Header) []string {
+	var hops []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+func TestClientIPWithTrustedProxies(t *testing.T) {
+	p := NewHTTPProxy(registry.NewRegistry(), "tunnel.example.com")
+	if err := p.SetTrustedProxies([]string{"10.0.0.0/8", "192.0.2.10"}); err != nil {
+		t.Fatalf("SetTrustedProxies failed: %v", err)
+	}
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"untrusted peer ignores spoofed chain", "203.0.113.5:1234", "1.2.3.4", "203.0.113.5"},
+		{"trusted peer uses last hop", "10.1.2.3:1234", "198.51.100.7", "198.51.100.7"},
+		{"trusted hops are skipped", "10.1.2.3:1234", "198.51.100.7, 192.0.2.10, 10.9.9.9", "198.51.100.7"},
+		{"spoofed left entries are not trusted", "10.1.2.3:1234", "6.6.6.6, 198.51.100.7", "198.51.100.7"},
+		{"all trusted falls back to leftmost", "10.1.2.3:1234", "10.5.5.5, 192.0.2.10", "10.5.5.5"},
+		{"garbage stops the walk", "10.1.2.3:1234", "198.51.100.7, not-an-ip", "10.1.2.3"},
+		{"trusted peer without header", "192.0.2.10:80", "", "192.0.2.10"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://app.tunnel.example.com/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			if tc.xff != "" {
+				r.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			if got := p.clientIP(r); got != tc.want {
+				t.Fatalf("clientIP() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientIPWithoutTrustedProxies(t *testing.T) {
+	p := NewHTTPProxy(registry.NewRegistry(), "tunnel.example.com")
+	r := httptest.NewRequest("GET", "http://app.tunnel.example.com/", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+	if got := p.clientIP(r); got != "10.1.2.3" {
+		t.Fatalf("expected X-Forwarded-For to be ignored, got %q", got)
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	p := NewHTTPProxy(registry.NewRegistry(), "tunnel.example.com")
+	if err := p.SetTrustedProxies([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatalf("SetTrustedProxies failed: %v", err)
+	}
+
+	trusted := httptest.NewRequest("GET", "http://app.tunnel.example.com/", nil)
+	trusted.RemoteAddr = "10.1.2.3:1234"
+	trusted.Header.Set("X-Forwarded-For", "198.51.100.7")
+	p.setForwardedHeaders(trusted)
+	if got := trusted.Header.Get("X-Forwarded-For"); got != "198.51.100.7, 10.1.2.3" {
+		t.Fatalf("unexpected forwarded chain %q", got)
+	}
+	if got := trusted.Header.Get("X-Real-IP"); got != "198.51.100.7" {
+		t.Fatalf("unexpected X-Real-IP %q", got)
+	}
+
+	untrusted := httptest.NewRequest("GET", "http://app.tunnel.example.com/", nil)
+	untrusted.RemoteAddr = "203.0.113.5:1234"
+	untrusted.Header.Set("X-Forwarded-For", "1.2.3.4")
+	p.setForwardedHeaders(untrusted)
+	if got := untrusted.Header.Get("X-Forwarded-For"); got != "203.0.113.5" {
+		t.Fatalf("expected spoofed chain to be replaced, got %q", got)
+	}
+}
+
+func TestSetTrustedProxiesRejectsInvalidEntries(t *testing.T) {
+	p := NewHTTPProxy(registry.NewRegistry(), "tunnel.example.com")
+	if err := p.SetTrustedProxies([]string{"not-a-cidr"}); err == nil {
+		t.Fatal("expected invalid entry to be rejected")
+	}
+}
@@ -0,0 +1,294 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// gRPC-Web content types. The -text variants carry base64 encoded frames.
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+)
+
+// grpcWebTrailerFlag marks the frame that carries the trailers at the end of
+// a gRPC-Web response body.
+const grpcWebTrailerFlag = 0x80
+
+// maxGRPCWebTextBody bounds base64 request bodies, which are decoded in memory.
+// gRPC-Web has no client streaming, so a request body is a single message.
+const maxGRPCWebTextBody = 8 << 20
+
+// gRPC status codes sent by the translation layer itself.
+const (
+	grpcStatusUnknown           = "2"
+	grpcStatusResourceExhausted = "8"
+	grpcStatusUnimplemented     = "12"
+	grpcStatusUnavailable       = "14"
+)
+
+// grpcWebRequestHeaders are the request headers specific to gRPC-Web that are
+// not forwarded to the native gRPC server.
+var grpcWebRequestHeaders = []string{"X-Grpc-Web", "X-User-Agent", "Content-Length", "Accept", "Origin", "Referer"}
+
+// newGRPCTransport returns a transport speaking HTTP/2 without TLS (prior
+// knowledge, as gRPC servers expect) over a new stream to the tunnel in the
+// request context, one stream per request.
+func newGRPCTransport(reg *registry.Registry) *http.Transport {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			tunnel, _ := ctx.Value(tunnelKey{}).(*registry.TunnelInfo)
+			if tunnel == nil {
+				return nil, fmt.Errorf("no tunnel for %s", addr)
+			}
+			return openTunnelStream(ctx, reg, tunnel)
+		},
+		Protocols:          &protocols,
+		DisableKeepAlives:  true,
+		DisableCompression: true,
+	}
+}
+
+// isGRPCWebRequest reports whether r is a gRPC-Web call.
+func isGRPCWebRequest(r *http.Request) bool {
+	contentType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	return strings.HasPrefix(contentType, grpcWebContentType)
+}
+
+// serveGRPCWeb translates a gRPC-Web call from a browser into a native gRPC
+// call to the tunnel's local server and translates the response back: the
+// message frames are passed through, base64 encoded for -text calls, and the
+// HTTP/2 trailers become a trailer frame at the end of the body. CORS
+// preflight requests are answered directly.
+func (p *HTTPProxy) serveGRPCWeb(w http.ResponseWriter, r *http.Request, tunnel *registry.TunnelInfo) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		setGRPCWebCORSHeaders(w.Header(), origin)
+	}
+	if r.Method == http.MethodOptions {
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost || !isGRPCWebRequest(r) {
+		http.Error(w, "This tunnel only accepts gRPC-Web requests", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	contentType := strings.ToLower(r.Header.Get("Content-Type"))
+	text := strings.HasPrefix(contentType, grpcWebTextContentType)
+	responseType := grpcWebContentType + strings.TrimPrefix(strings.TrimPrefix(contentType, grpcWebTextContentType), grpcWebContentType)
+	if text {
+		responseType = grpcWebTextContentType + strings.TrimPrefix(contentType, grpcWebTextContentType)
+	}
+
+	if !tunnel.AcquireConn() {
+		writeGRPCWebStatus(w, responseType, grpcStatusResourceExhausted, "Too many concurrent streams")
+		return
+	}
+	defer tunnel.ReleaseConn()
+
+	if encoding := r.Header.Get("Grpc-Encoding"); !allowsGRPCEncoding(tunnel, encoding) {
+		writeGRPCWebStatus(w, responseType, grpcStatusUnimplemented, fmt.Sprintf("Compression %q is not enabled for this tunnel", encoding))
+		return
+	}
+	out, err := newGRPCRequest(r, text, tunnel.Compression)
+	if err != nil {
+		writeGRPCWebStatus(w, responseType, grpcStatusUnknown, err.Error())
+		return
+	}
+	resp, err := p.grpcTransport.RoundTrip(out.WithContext(context.WithValue(r.Context(), tunnelKey{}, tunnel)))
+	if err != nil {
+		log.Printf("Failed to forward gRPC-Web call for %s: %v", r.Host, err)
+		writeGRPCWebStatus(w, responseType, grpcStatusUnavailable, "Failed to connect to tunnel")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		writeGRPCWebStatus(w, responseType, grpcStatusUnknown, fmt.Sprintf("gRPC server answered HTTP %d", resp.StatusCode))
+		return
+	}
+
+	for name, values := range resp.Header {
+		if name == "Content-Type" || name == "Content-Length" || name == "Trailer" {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Type", responseType)
+	w.WriteHeader(http.StatusOK)
+
+	body := io.Writer(w)
+	var encoder io.WriteCloser
+	if text {
+		encoder = base64.NewEncoder(base64.StdEncoding, w)
+		body = encoder
+	}
+	flusher, _ := w.(http.Flusher)
+	buf := p.buffers.get()
+	defer p.buffers.put(buf)
+	for {
+		n, readErr := resp.Body.Read(*buf)
+		if n > 0 {
+			if _, err := body.Write((*buf)[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if readErr != nil {
+			if !errors.Is(readErr, io.EOF) {
+				log.Printf("gRPC-Web response from %s ended early: %v", r.Host, readErr)
+			}
+			break
+		}
+	}
+	// HTTP/2 trailers are only known once the body has been read.
+	trailers := encodeGRPCWebTrailers(resp.Trailer)
+	if text {
+		// The frames so far and the trailer frame are padded separately,
+		// as gRPC-Web clients decode base64 in 4-byte groups.
+		encoder.Close()
+		encoder = base64.NewEncoder(base64.StdEncoding, w)
+		encoder.Write(trailers)
+		encoder.Close()
+	} else {
+		w.Write(trailers)
+	}
+}
+
+// allowsGRPCEncoding reports whether a call compressed with encoding may be
+// sent to the tunnel: uncompressed calls always may, compressed calls only
+// with the compression negotiated for the tunnel.
+func allowsGRPCEncoding(tunnel *registry.TunnelInfo, encoding string) bool {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	return encoding == "" || encoding == "identity" || encoding == tunnel.Compression
+}
+
+// newGRPCRequest builds the native gRPC request for a gRPC-Web call. The
+// local server is only offered the compression negotiated for the tunnel.
+func newGRPCRequest(r *http.Request, text bool, compression string) (*http.Request, error) {
+	var body io.Reader = r.Body
+	contentLength := r.ContentLength
+	if text {
+		encoded, err := io.ReadAll(io.LimitReader(r.Body, maxGRPCWebTextBody+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request: %w", err)
+		}
+		if len(encoded) > maxGRPCWebTextBody {
+			return nil, fmt.Errorf("request exceeds %d bytes", maxGRPCWebTextBody)
+		}
+		decoded, err := decodeGRPCWebText(encoded)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(decoded)
+		contentLength = int64(len(decoded))
+	}
+
+	out, err := http.NewRequest(http.MethodPost, "http://"+r.Host+r.URL.RequestURI(), body)
+	if err != nil {
+		return nil, err
+	}
+	out.ContentLength = contentLength
+	out.Header = r.Header.Clone()
+	for _, name := range grpcWebRequestHeaders {
+		out.Header.Del(name)
+	}
+	for name := range out.Header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			out.Header.Del(name)
+		}
+	}
+	contentType := strings.ToLower(r.Header.Get("Content-Type"))
+	subtype := strings.TrimPrefix(strings.TrimPrefix(contentType, grpcWebTextContentType), grpcWebContentType)
+	out.Header.Set("Content-Type", "application/grpc"+subtype)
+	out.Header.Set("Te", "trailers")
+	if compression != "" {
+		out.Header.Set("Grpc-Accept-Encoding", compression)
+	}
+	return out, nil
+}
+
+// decodeGRPCWebText decodes a base64 gRPC-Web body. Clients may send several
+// separately padded base64 chunks, so each 4-byte group is decoded on its own.
+func decodeGRPCWebText(encoded []byte) ([]byte, error) {
+	clean := bytes.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, encoded)
+	if len(clean)%4 != 0 {
+		return nil, fmt.Errorf("invalid base64 request body")
+	}
+	decoded := make([]byte, 0, len(clean)/4*3)
+	var group [3]byte
+	for i := 0; i < len(clean); i += 4 {
+		n, err := base64.StdEncoding.Decode(group[:], clean[i:i+4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 request body: %w", err)
+		}
+		decoded = append(decoded, group[:n]...)
+	}
+	return decoded, nil
+}
+
+// encodeGRPCWebTrailers encodes trailers as a gRPC-Web trailer frame: the
+// 0x80 flag, the 4-byte big-endian length and "name: value\r\n" lines with
+// lowercase names.
+func encodeGRPCWebTrailers(trailers http.Header) []byte {
+	names := make([]string, 0, len(trailers))
+	for name := range trailers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var block bytes.Buffer
+	for _, name := range names {
+		for _, value := range trailers[name] {
+			fmt.Fprintf(&block, "%s: %s\r\n", strings.ToLower(name), value)
+		}
+	}
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	return append(frame, block.Bytes()...)
+}
+
+// writeGRPCWebStatus answers a gRPC-Web call with a status and no messages
+// (a trailers-only response), so clients see a gRPC error rather than an
+// HTTP one.
+func writeGRPCWebStatus(w http.ResponseWriter, contentType, code, message string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Grpc-Status", code)
+	w.Header().Set("Grpc-Message", message)
+	w.WriteHeader(http.StatusOK)
+}
+
+// setGRPCWebCORSHeaders lets browser pages of any origin call the tunnel and
+// read the gRPC status headers.
+func setGRPCWebCORSHeaders(header http.Header, origin string) {
+	header.Set("Access-Control-Allow-Origin", origin)
+	header.Add("Vary", "Origin")
+	header.Set("Access-Control-Expose-Headers", "Grpc-Status, Grpc-Message, Grpc-Status-Details-Bin")
+}
@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+func TestEncodeGRPCWebTrailers(t *testing.T) {
+	trailers := http.Header{}
+	trailers.Set("Grpc-Status", "0")
+	trailers.Set("Grpc-Message", "ok")
+
+	frame := encodeGRPCWebTrailers(trailers)
+	block := "grpc-message: ok\r\ngrpc-status: 0\r\n"
+	want := append([]byte{0x80, 0, 0, 0, byte(len(block))}, block...)
+	if !bytes.Equal(frame, want) {
+		t.Fatalf("expected trailer frame %q, got %q", want, frame)
+	}
+}
+
+func TestDecodeGRPCWebText(t *testing.T) {
+	tests := map[string]struct {
+		body    string
+		want    string
+		wantErr bool
+	}{
+		"single chunk":  {body: base64.StdEncoding.EncodeToString([]byte("hello")), want: "hello"},
+		"padded chunks": {body: base64.StdEncoding.EncodeToString([]byte("ab")) + base64.StdEncoding.EncodeToString([]byte("cde")), want: "abcde"},
+		"line breaks":   {body: "aGVs\r\nbG8=", want: "hello"},
+		"empty":         {body: "", want: ""},
+		"truncated":     {body: "aGVsbG8", wantErr: true},
+		"not base64":    {body: "a*b?", wantErr: true},
+		"bad padding":   {body: "a===", wantErr: true},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := decodeGRPCWebText([]byte(tt.body))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error for %q, got %q", tt.body, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// grpcFrame returns a gRPC length-prefixed message frame.
+func grpcFrame(message string) []byte {
+	return append([]byte{0, 0, 0, 0, byte(len(message))}, message...)
+}
+
+// newTestGRPCTunnel registers a gRPC-Web tunnel whose local server speaks
+// native gRPC over HTTP/2 without TLS and echoes the request frame back.
+func newTestGRPCTunnel(t *testing.T, reg *registry.Registry, subdomain string) *registry.TunnelInfo {
+	t.Helper()
+
+	serverSession, clientSession := newTestSessions(t)
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	local := &http.Server{
+		Protocols: &protocols,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc+proto" || r.Header.Get("Te") != "trailers" {
+				t.Errorf("expected a native gRPC request, got %s with %v", r.Proto, r.Header)
+			}
+			if r.Header.Get("X-Grpc-Web") != "" {
+				t.Errorf("expected the X-Grpc-Web header to be dropped")
+			}
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "application/grpc+proto")
+			w.Header().Set("Trailer", "Grpc-Status, Grpc-Message, X-Request-Id")
+			w.Write(body)
+			w.Header().Set("Grpc-Status", "0")
+			w.Header().Set("Grpc-Message", "")
+			w.Header().Set("X-Request-Id", "42")
+		}),
+	}
+	go local.Serve(clientSession)
+
+	tunnel := &registry.TunnelInfo{
+		ID:         "tunnel-" + subdomain,
+		ClientID:   "client",
+		Subdomain:  subdomain,
+		Protocol:   "grpc",
+		MuxSession: serverSession,
+		GRPCWeb:    true,
+	}
+	if err := reg.Register(tunnel); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+	return tunnel
+}
+
+func TestGRPCWebCallsAreTranslated(t *testing.T) {
+	wantTrailers := "grpc-message: \r\ngrpc-status: 0\r\nx-request-id: 42\r\n"
+	wantFrame := append([]byte{0x80, 0, 0, 0, byte(len(wantTrailers))}, wantTrailers...)
+	message := grpcFrame("ping")
+
+	tests := map[string]struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		"binary": {
+			contentType: "application/grpc-web+proto",
+			body:        string(message),
+			want:        string(message) + string(wantFrame),
+		},
+		"text": {
+			contentType: "application/grpc-web-text+proto",
+			body:        base64.StdEncoding.EncodeToString(message),
+			want:        base64.StdEncoding.EncodeToString(message) + base64.StdEncoding.EncodeToString(wantFrame),
+		},
+	}
+
+	reg := registry.NewRegistry()
+	newTestGRPCTunnel(t, reg, "grpc")
+	server := httptest.NewServer(NewHTTPProxy(reg, "tunnel.example.com"))
+	t.Cleanup(server.Close)
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, server.URL+"/echo.Echo/Ping", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("failed to build request: %v", err)
+			}
+			req.Host = "grpc.tunnel.example.com"
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("X-Grpc-Web", "1")
+			req.Header.Set("Origin", "https://app.example.com")
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.StatusCode, body)
+			}
+			if got := resp.Header.Get("Content-Type"); got != tt.contentType {
+				t.Fatalf("expected content type %s, got %s", tt.contentType, got)
+			}
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+				t.Fatalf("expected the origin to be allowed, got %q", got)
+			}
+			if string(body) != tt.want {
+				t.Fatalf("expected body %q, got %q", tt.want, body)
+			}
+		})
+	}
+}
+
+func TestGRPCWebAnswersPreflightAndRejectsOtherRequests(t *testing.T) {
+	reg := registry.NewRegistry()
+	newTestGRPCTunnel(t, reg, "grpc")
+	server := httptest.NewServer(NewHTTPProxy(reg, "tunnel.example.com"))
+	t.Cleanup(server.Close)
+
+	req, err := http.NewRequest(http.MethodOptions, server.URL+"/echo.Echo/Ping", nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Host = "grpc.tunnel.example.com"
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Headers") != "content-type,x-grpc-web" {
+		t.Fatalf("expected the preflight to be answered, got %d with %v", resp.StatusCode, resp.Header)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, server.URL+"/", nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Host = "grpc.tunnel.example.com"
+	resp, err = server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415 for a plain request, got %d", resp.StatusCode)
+	}
+}
+
+func TestGRPCWebReportsUnavailableTunnelAsGRPCStatus(t *testing.T) {
+	reg := registry.NewRegistry()
+	tunnel := newTestGRPCTunnel(t, reg, "grpc")
+	tunnel.MuxSession.Close()
+	server := httptest.NewServer(NewHTTPProxy(reg, "tunnel.example.com"))
+	t.Cleanup(server.Close)
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/echo.Echo/Ping", bytes.NewReader(grpcFrame("ping")))
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Host = "grpc.tunnel.example.com"
+	req.Header.Set("Content-Type", "application/grpc-web")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Grpc-Status") != grpcStatusUnavailable {
+		t.Fatalf("expected grpc-status %s, got %d with %v", grpcStatusUnavailable, resp.StatusCode, resp.Header)
+	}
+}
+
+func TestGRPCWebEnforcesMaxStreamsAndCompression(t *testing.T) {
+	reg := registry.NewRegistry()
+	tunnel := newTestGRPCTunnel(t, reg, "grpc")
+	tunnel.MaxStreams = 1
+	tunnel.Compression = "identity"
+	server := httptest.NewServer(NewHTTPProxy(reg, "tunnel.example.com"))
+	t.Cleanup(server.Close)
+
+	call := func(encoding string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/echo.Echo/Ping", bytes.NewReader(grpcFrame("ping")))
+		if err != nil {
+			t.Fatalf("failed to build request: %v", err)
+		}
+		req.Host = "grpc.tunnel.example.com"
+		req.Header.Set("Content-Type", "application/grpc-web+proto")
+		if encoding != "" {
+			req.Header.Set("Grpc-Encoding", encoding)
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := call("gzip"); resp.Header.Get("Grpc-Status") != grpcStatusUnimplemented {
+		t.Fatalf("expected grpc-status %s for a gzip call, got %v", grpcStatusUnimplemented, resp.Header)
+	}
+	if resp := call("identity"); resp.Header.Get("Grpc-Status") != "" {
+		t.Fatalf("expected an identity call to be forwarded, got %v", resp.Header)
+	}
+
+	if !tunnel.AcquireConn() {
+		t.Fatal("expected the only stream slot to be free")
+	}
+	defer tunnel.ReleaseConn()
+	if resp := call(""); resp.Header.Get("Grpc-Status") != grpcStatusResourceExhausted {
+		t.Fatalf("expected grpc-status %s beyond max_streams, got %v", grpcStatusResourceExhausted, resp.Header)
+	}
+}
+
+func TestNewGRPCRequestOffersTunnelCompression(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "http://grpc.tunnel.example.com/echo.Echo/Ping", bytes.NewReader(grpcFrame("ping")))
+	r.Header.Set("Content-Type", "application/grpc-web+proto")
+	r.Header.Set("Grpc-Accept-Encoding", "gzip,deflate,snappy")
+
+	out, err := newGRPCRequest(r, false, "gzip")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := out.Header.Get("Grpc-Accept-Encoding"); got != "gzip" {
+		t.Fatalf("expected only gzip to be offered, got %q", got)
+	}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// SetResponseHeaders configures how origin responses are rewritten before
+// they reach visitors.
+//
+// Parameters:
+//   - strip: Response headers removed from every tunnel response, e.g.
+//     "Server" and "X-Powered-By", which reveal the origin's software
+//   - via: Pseudonym added to a Via header identifying the proxy ("" adds none)
+func (p *HTTPProxy) SetResponseHeaders(strip []string, via string) {
+	p.stripHeaders = make([]string, len(strip))
+	for i, name := range strip {
+		p.stripHeaders[i] = http.CanonicalHeaderKey(name)
+	}
+	p.via = via
+}
+
+// SetIdentityHeaders makes the proxy identify itself and the tunnel in every
+// tunnel response, for debugging and abuse reports. Both are off by default
+// so deployments do not reveal their version or tunnel IDs unless asked to.
+//
+// Parameters:
+//   - servedBy: Value of an X-Served-By header, e.g. "tunnelab/1.4.0" ("" adds none)
+//   - tunnelID: Whether to add an X-Tunnel-Id header with the serving tunnel's ID
+func (p *HTTPProxy) SetIdentityHeaders(servedBy string, tunnelID bool) {
+	p.servedBy = servedBy
+	p.tunnelIDHeader = tunnelID
+}
+
+// securityHeader is a header added to tunnel responses served over HTTPS.
+type securityHeader struct {
+	name  string // Canonical header name
+	value string
+}
+
+// SetSecurityHeaders adds security headers such as Strict-Transport-Security
+// to tunnel responses served over HTTPS. Responses served over plain HTTP are
+// left alone, as HSTS must only be sent over a secure connection.
+//
+// Parameters:
+//   - headers: Header names and values to add (nil or empty adds none)
+//   - force: Replace headers the local app already set instead of keeping them
+func (p *HTTPProxy) SetSecurityHeaders(headers map[string]string, force bool) {
+	p.securityHeaders = make([]securityHeader, 0, len(headers))
+	for name, value := range headers {
+		p.securityHeaders = append(p.securityHeaders, securityHeader{name: http.CanonicalHeaderKey(name), value: value})
+	}
+	sort.Slice(p.securityHeaders, func(i, j int) bool { return p.securityHeaders[i].name < p.securityHeaders[j].name })
+	p.forceSecurityHeaders = force
+}
+
+// SetMaxHeaderBytes limits the total size of the headers of a proxied
+// request. Larger requests are answered with 431 Request Header Fields Too
+// Large instead of being forwarded.
+//
+// Parameters:
+//   - limit: Maximum bytes of all header lines, including Host (0 means no limit)
+func (p *HTTPProxy) SetMaxHeaderBytes(limit int) {
+	p.maxHeaderBytes = limit
+}
+
+// headerBytes returns the size of the headers of r as sent on the wire by
+// HTTP/1.1: a "Name: value\r\n" line per value, plus the Host line.
+func headerBytes(r *http.Request) int {
+	size := len("Host: \r\n") + len(r.Host)
+	for name, values := range r.Header {
+		for _, value := range values {
+			size += len(name) + len(value) + len(": \r\n")
+		}
+	}
+	return size
+}
+
+// rewriteResponseHeaders strips the configured headers from resp and its
+// trailers, appends this proxy to its Via header (RFC 9110, section 7.6.3)
+// and adds the identity and security headers.
+func (p *HTTPProxy) rewriteResponseHeaders(resp *http.Response) {
+	for _, name := range p.stripHeaders {
+		resp.Header.Del(name)
+		resp.Trailer.Del(name)
+	}
+	// Only chunked bodies carry trailers, which are read with their end.
+	if len(p.stripHeaders) > 0 && len(resp.TransferEncoding) > 0 && resp.StatusCode != http.StatusSwitchingProtocols && resp.Body != nil && resp.Body != http.NoBody {
+		resp.Body = &trailerStripper{ReadCloser: resp.Body, resp: resp, names: p.stripHeaders}
+	}
+	if p.via != "" {
+		resp.Header.Add("Via", fmt.Sprintf("%d.%d %s", resp.ProtoMajor, resp.ProtoMinor, p.via))
+	}
+	if p.servedBy != "" {
+		resp.Header.Set("X-Served-By", p.servedBy)
+	}
+	// Responses relayed from the owning node already carry its tunnel ID.
+	if p.tunnelIDHeader && resp.Request != nil {
+		if tunnel, _ := resp.Request.Context().Value(tunnelKey{}).(*registry.TunnelInfo); tunnel != nil {
+			resp.Header.Set("X-Tunnel-Id", tunnel.ID)
+		}
+	}
+	if len(p.securityHeaders) > 0 && resp.Request != nil && forwardedScheme(resp.Request) == "https" {
+		for _, h := range p.securityHeaders {
+			if _, set := resp.Header[h.name]; !set || p.forceSecurityHeaders {
+				resp.Header.Set(h.name, h.value)
+			}
+		}
+	}
+}
+
+// trailerStripper removes stripped headers from the trailers of a response
+// once its body is read, so an origin cannot send them as trailers instead.
+// ReverseProxy copies the trailers after the body.
+type trailerStripper struct {
+	io.ReadCloser
+	resp  *http.Response
+	names []string
+}
+
+func (b *trailerStripper) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		for _, name := range b.names {
+			b.resp.Trailer.Del(name)
+		}
+	}
+	return n, err
+}
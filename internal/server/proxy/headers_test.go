@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+func TestStrippedResponseHeadersDoNotReachClient(t *testing.T) {
+	reg := registry.NewRegistry()
+	newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "Apache/2.4.1")
+		w.Header().Set("X-Powered-By", "PHP/8.1")
+		w.Header().Set("X-Request-Id", "abc")
+		io.WriteString(w, "ok")
+	}))
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	p.SetResponseHeaders([]string{"server", "X-Powered-By"}, "tunnelab")
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+
+	resp := getThroughProxy(t, server, "/")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	for _, name := range []string{"Server", "X-Powered-By"} {
+		if value := resp.Header.Get(name); value != "" {
+			t.Fatalf("expected %s to be stripped, got %q", name, value)
+		}
+	}
+	if resp.Header.Get("X-Request-Id") != "abc" {
+		t.Fatal("expected headers not in the list to be forwarded")
+	}
+	if via := resp.Header.Get("Via"); via != "1.1 tunnelab" {
+		t.Fatalf("expected Via to identify the proxy, got %q", via)
+	}
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	reg := registry.NewRegistry()
+	newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+
+	resp := getThroughProxy(t, server, "/")
+	if resp.Header.Get("X-Served-By") != "" || resp.Header.Get("X-Tunnel-Id") != "" {
+		t.Fatalf("expected no identity headers by default, got %v", resp.Header)
+	}
+
+	p.SetIdentityHeaders("tunnelab/1.2.3", true)
+	resp = getThroughProxy(t, server, "/")
+	if got := resp.Header.Get("X-Served-By"); got != "tunnelab/1.2.3" {
+		t.Fatalf("expected X-Served-By to carry the version, got %q", got)
+	}
+	if got := resp.Header.Get("X-Tunnel-Id"); got != "tunnel-app" {
+		t.Fatalf("expected X-Tunnel-Id to name the tunnel, got %q", got)
+	}
+}
+
+func TestOversizedRequestHeadersAreRejected(t *testing.T) {
+	reg := registry.NewRegistry()
+	var forwarded atomic.Int64
+	newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		io.WriteString(w, "ok")
+	}))
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	p.SetMaxHeaderBytes(1024)
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/", nil)
+	req.Header.Set("X-Small", "value")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected small headers to be forwarded, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/", nil)
+	for i := 0; i < 4; i++ {
+		req.Header.Add("Cookie", strings.Repeat("a", 300))
+	}
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("expected 431 for oversized headers, got %d", rec.Code)
+	}
+	if forwarded.Load() != 1 {
+		t.Fatalf("expected the oversized request not to be forwarded, got %d requests", forwarded.Load())
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	reg := registry.NewRegistry()
+	newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "DENY")
+		io.WriteString(w, "ok")
+	}))
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	headers := map[string]string{
+		"strict-transport-security": "max-age=31536000",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "SAMEORIGIN",
+	}
+	get := func(scheme string) http.Header {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, scheme+"://app.tunnel.example.com/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		return rec.Header()
+	}
+
+	if h := get("https"); h.Get("Strict-Transport-Security") != "" {
+		t.Fatalf("expected no security headers by default, got %v", h)
+	}
+
+	p.SetSecurityHeaders(headers, false)
+	h := get("https")
+	if h.Get("Strict-Transport-Security") != "max-age=31536000" || h.Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("expected the security headers over HTTPS, got %v", h)
+	}
+	if got := h.Values("X-Frame-Options"); len(got) != 1 || got[0] != "DENY" {
+		t.Fatalf("expected the origin's X-Frame-Options to be kept, got %v", got)
+	}
+	if h := get("http"); h.Get("Strict-Transport-Security") != "" || h.Get("X-Content-Type-Options") != "" {
+		t.Fatalf("expected no security headers over plain HTTP, got %v", h)
+	}
+
+	p.SetSecurityHeaders(headers, true)
+	if got := get("https").Values("X-Frame-Options"); len(got) != 1 || got[0] != "SAMEORIGIN" {
+		t.Fatalf("expected forced headers to replace the origin's, got %v", got)
+	}
+}
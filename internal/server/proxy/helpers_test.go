@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+	"github.com/hashicorp/yamux"
+)
+
+// newTestTunnel registers a tunnel whose mux session is served in-process by
+// handler, standing in for a connected client and its local server.
+func newTestTunnel(t *testing.T, reg *registry.Registry, subdomain string, handler http.Handler) *registry.TunnelInfo {
+	t.Helper()
+
+	serverSession, clientSession := newTestSessions(t)
+	go http.Serve(clientSession, handler)
+
+	tunnel := &registry.TunnelInfo{
+		ID:         "tunnel-" + subdomain,
+		ClientID:   "client",
+		Subdomain:  subdomain,
+		Protocol:   "http",
+		MuxSession: serverSession,
+	}
+	if err := reg.Register(tunnel); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+	return tunnel
+}
+
+// newTestTCPTunnel registers a TCP tunnel on port whose client echoes every
+// stream back to the sender.
+func newTestTCPTunnel(t *testing.T, reg *registry.Registry, subdomain string, port int) *registry.TunnelInfo {
+	t.Helper()
+
+	serverSession, clientSession := newTestSessions(t)
+	go func() {
+		for {
+			stream, err := clientSession.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	tunnel := &registry.TunnelInfo{
+		ID:         "tunnel-" + subdomain,
+		ClientID:   "client",
+		Subdomain:  subdomain,
+		Protocol:   "tcp",
+		PublicPort: port,
+		MuxSession: serverSession,
+	}
+	if err := reg.Register(tunnel); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+	return tunnel
+}
+
+func newTestSessions(t *testing.T) (*yamux.Session, *yamux.Session) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	serverSession, err := yamux.Server(serverConn, nil)
+	if err != nil {
+		t.Fatalf("failed to create server session: %v", err)
+	}
+	clientSession, err := yamux.Client(clientConn, nil)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	t.Cleanup(func() {
+		clientSession.Close()
+		serverSession.Close()
+	})
+	return serverSession, clientSession
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// RequestInfo describes a request served through an HTTP tunnel.
+type RequestInfo struct {
+	TunnelID  string        // ID of the tunnel that served the request
+	Subdomain string        // Subdomain of the tunnel
+	Method    string        // HTTP method
+	Path      string        // Request path
+	Status    int           // Response status code sent to the client
+	BytesIn   int64         // Request body bytes received from the client
+	BytesOut  int64         // Response body bytes sent to the client
+	Duration  time.Duration // Total time spent serving the request
+	ClientIP  string        // Address of the public client
+	StartedAt time.Time     // When the request was received
+}
+
+// ConnectionInfo describes a connection served through a TCP tunnel.
+type ConnectionInfo struct {
+	TunnelID  string        // ID of the tunnel that served the connection
+	Subdomain string        // Subdomain of the tunnel
+	Port      int           // Public port the connection arrived on
+	BytesIn   int64         // Bytes received from the client
+	BytesOut  int64         // Bytes sent to the client
+	Duration  time.Duration // How long the connection was open
+	ClientIP  string        // Address of the public client
+	StartedAt time.Time     // When the connection was bridged to the tunnel
+}
+
+// responseRecorder captures the status and body size written to a client.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	written     int64
+	wroteHeader bool
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader && status >= 200 {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// fireRequestHook reports a finished request to RequestHook without blocking the response.
+func (p *HTTPProxy) fireRequestHook(r *http.Request, tunnel *registry.TunnelInfo, rec *responseRecorder, body *countingReader, start time.Time) {
+	if p.RequestHook == nil {
+		return
+	}
+	info := &RequestInfo{
+		TunnelID:  tunnel.ID,
+		Subdomain: tunnel.Subdomain,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    rec.status,
+		BytesIn:   body.n.Load(),
+		BytesOut:  rec.written,
+		Duration:  time.Since(start),
+		ClientIP:  p.clientIP(r),
+		StartedAt: start,
+	}
+	go p.RequestHook(info)
+}
+
+// fireConnectionHook reports a closed TCP connection or CONNECT session to
+// hook, if it is set.
+func fireConnectionHook(hook func(*ConnectionInfo), tunnel *registry.TunnelInfo, clientIP string, port int, bytesIn, bytesOut int64, start time.Time) {
+	if hook == nil {
+		return
+	}
+	info := &ConnectionInfo{
+		TunnelID:  tunnel.ID,
+		Subdomain: tunnel.Subdomain,
+		Port:      port,
+		BytesIn:   bytesIn,
+		BytesOut:  bytesOut,
+		Duration:  time.Since(start),
+		ClientIP:  clientIP,
+		StartedAt: start,
+	}
+	go hook(info)
+}
+
+// localPort returns the port conn was accepted on, or 0 if it is unknown.
+func localPort(conn net.Conn) int {
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
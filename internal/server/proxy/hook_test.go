@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+func TestRequestHookReceivesRequestInfo(t *testing.T) {
+	reg := registry.NewRegistry()
+	tunnel := newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "created!")
+	}))
+
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	hooked := make(chan *RequestInfo, 1)
+	p.RequestHook = func(info *RequestInfo) { hooked <- info }
+
+	req := httptest.NewRequest(http.MethodPost, "http://app.tunnel.example.com/items", strings.NewReader("hello"))
+	req.RemoteAddr = "198.51.100.7:51234"
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	select {
+	case info := <-hooked:
+		if info.TunnelID != tunnel.ID || info.Subdomain != "app" {
+			t.Fatalf("unexpected tunnel in hook: %+v", info)
+		}
+		if info.Method != http.MethodPost || info.Path != "/items" {
+			t.Fatalf("unexpected request in hook: %+v", info)
+		}
+		if info.Status != http.StatusCreated {
+			t.Fatalf("unexpected status in hook: %d", info.Status)
+		}
+		if info.BytesIn != 5 || info.BytesOut != int64(len("created!")) {
+			t.Fatalf("unexpected byte counts in hook: in=%d out=%d", info.BytesIn, info.BytesOut)
+		}
+		if info.ClientIP != "198.51.100.7" {
+			t.Fatalf("unexpected client IP %q", info.ClientIP)
+		}
+		if info.Duration <= 0 {
+			t.Fatalf("expected a positive duration, got %v", info.Duration)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("request hook was not called")
+	}
+}
+
+func TestRequestHookNil(t *testing.T) {
+	reg := registry.NewRegistry()
+	newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestConnectionHookReceivesConnectionInfo(t *testing.T) {
+	reg := registry.NewRegistry()
+	tunnel := newTestTCPTunnel(t, reg, "db", 30001)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	p := NewTCPProxy(reg)
+	hooked := make(chan *ConnectionInfo, 1)
+	p.ConnectionHook = func(info *ConnectionInfo) { hooked <- info }
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		p.handleConnection(conn, 30001)
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.WriteString(client, "hello"); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("failed to read the echo: %v", err)
+	}
+	client.Close()
+
+	select {
+	case info := <-hooked:
+		if info.TunnelID != tunnel.ID || info.Subdomain != "db" || info.Port != 30001 {
+			t.Fatalf("unexpected tunnel in hook: %+v", info)
+		}
+		if info.BytesIn != 5 || info.BytesOut != 5 {
+			t.Fatalf("unexpected byte counts in hook: in=%d out=%d", info.BytesIn, info.BytesOut)
+		}
+		if info.ClientIP != "127.0.0.1" {
+			t.Fatalf("unexpected client IP %q", info.ClientIP)
+		}
+		if info.Duration <= 0 || info.StartedAt.IsZero() {
+			t.Fatalf("expected a start time and positive duration, got %+v", info)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection hook was not called")
+	}
+}
+
+func TestConnectionHookReceivesConnectSessions(t *testing.T) {
+	reg := registry.NewRegistry()
+	tunnel := newTestTCPTunnel(t, reg, "db", 30001)
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	hooked := make(chan *ConnectionInfo, 1)
+	p.ConnectionHook = func(info *ConnectionInfo) { hooked <- info }
+	server := httptest.NewServer(p.WithConnect(http.NotFoundHandler()))
+	defer server.Close()
+
+	conn, reader, resp := dialConnect(t, server.URL, "db.tunnel.example.com:443")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected CONNECT to be accepted, got %d", resp.StatusCode)
+	}
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if _, err := io.ReadFull(reader, make([]byte, 5)); err != nil {
+		t.Fatalf("failed to read the echo: %v", err)
+	}
+	conn.Close()
+
+	select {
+	case info := <-hooked:
+		if info.TunnelID != tunnel.ID || info.Subdomain != "db" {
+			t.Fatalf("unexpected tunnel in hook: %+v", info)
+		}
+		if info.Port != server.Listener.Addr().(*net.TCPAddr).Port {
+			t.Fatalf("expected the port of the HTTP listener, got %d", info.Port)
+		}
+		if info.BytesIn != 5 || info.BytesOut != 5 {
+			t.Fatalf("unexpected byte counts in hook: in=%d out=%d", info.BytesIn, info.BytesOut)
+		}
+		if info.ClientIP != "127.0.0.1" || info.Duration <= 0 || info.StartedAt.IsZero() {
+			t.Fatalf("unexpected client or timing in hook: %+v", info)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection hook was not called for the CONNECT session")
+	}
+}
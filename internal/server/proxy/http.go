@@ -1,150 +1,277 @@
 package proxy
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/essajiwa/tunnelab/internal/server/iplimit"
 	"github.com/essajiwa/tunnelab/internal/server/registry"
 )
 
+// statusBandwidthLimitExceeded is the non-standard 509 status sent for tunnels
+// of clients over their byte quota.
+const statusBandwidthLimitExceeded = 509
+
+// QuotaChecker reports clients that have used up their byte quota.
+type QuotaChecker interface {
+	Exceeded(clientID string) bool
+}
+
 type HTTPProxy struct {
-	registry *registry.Registry
-	domain   string
+	registry             *registry.Registry
+	domain               string
+	sniRouting           bool
+	trustedProxies       []*net.IPNet
+	buffers              *bufferPool
+	reverseProxy         *httputil.ReverseProxy
+	retry                *poolRetryTransport
+	grpcTransport        http.RoundTripper // Speaks native gRPC to tunnels serving gRPC-Web
+	peerProxy            *httputil.ReverseProxy
+	clusterSecret        string
+	peerTLS              *tls.Config // Mutual TLS of stream links between nodes
+	quotas               QuotaChecker
+	stripHeaders         []string             // Canonical names of response headers to remove
+	via                  string               // Pseudonym added to the Via response header
+	servedBy             string               // X-Served-By response header value ("" adds none)
+	tunnelIDHeader       bool                 // Whether responses carry an X-Tunnel-Id header
+	securityHeaders      []securityHeader     // Added to responses served over HTTPS, sorted by name
+	forceSecurityHeaders bool                 // Whether securityHeaders replace those the origin set
+	maxHeaderBytes       int                  // Largest request header size forwarded (0 means no limit)
+	landing              http.HandlerFunc     // Serves the apex domain; nil answers 400
+	maintenance          maintenance          // Tunnels answering 503 instead of being forwarded
+	ipLimits             *iplimit.Limiter     // Caps requests in flight per client IP (nil disables it)
+	customDomains        CustomDomainResolver // Routes hostnames outside the domain (nil serves none)
+
+	// RequestHook, when set, is called after each proxied request. It runs on
+	// its own goroutine so slow hooks never delay responses.
+	RequestHook func(*RequestInfo)
+	// ConnectionHook, when set, is called on its own goroutine after each
+	// CONNECT session bridged to a TCP tunnel closes.
+	ConnectionHook func(*ConnectionInfo)
 }
 
 func NewHTTPProxy(registry *registry.Registry, domain string) *HTTPProxy {
-	return &HTTPProxy{
+	p := &HTTPProxy{
 		registry: registry,
 		domain:   domain,
+		buffers:  newBufferPool(defaultCopyBufferSize, false),
 	}
+	p.retry = newPoolRetryTransport(newTunnelTransport(registry), registry)
+	p.reverseProxy = p.newReverseProxy()
+	p.grpcTransport = newGRPCTransport(registry)
+	p.peerProxy = p.newPeerProxy()
+	return p
+}
+
+// SetCopyBuffer configures the buffer used to copy response bodies and
+// CONNECT tunnels.
+//
+// Parameters:
+//   - size: Buffer size in bytes (0 uses the 32KB default)
+//   - pooled: Whether to recycle buffers through a sync.Pool
+func (p *HTTPProxy) SetCopyBuffer(size int, pooled bool) {
+	p.buffers = newBufferPool(size, pooled)
+	p.reverseProxy.BufferPool = reverseProxyBuffers{p.buffers}
+	p.peerProxy.BufferPool = reverseProxyBuffers{p.buffers}
+}
+
+// SetPoolRetry configures how requests to pooled tunnels are retried on
+// another member when the stream to the chosen member fails before a
+// response arrives. Requests with a body are never retried.
+//
+// Parameters:
+//   - retries: Attempts on other members after the first (0 disables retries)
+//   - timeout: Budget for all attempts of a request (0 means none)
+//   - methods: Methods that may be retried (empty means GET, HEAD and OPTIONS)
+func (p *HTTPProxy) SetPoolRetry(retries int, timeout time.Duration, methods []string) {
+	p.retry.configure(retries, timeout, methods)
+}
+
+// SetIPLimiter caps the requests and CONNECT tunnels in flight from one
+// client IP, as found by SetTrustedProxies. Requests past the limit are
+// answered with 429 Too Many Requests.
+//
+// Parameters:
+//   - limiter: Counts connections per IP, typically shared with the TCP proxy (nil disables the limit)
+func (p *HTTPProxy) SetIPLimiter(limiter *iplimit.Limiter) {
+	p.ipLimits = limiter
+}
+
+// rejectIP answers a request from ip, which has too many connections open.
+func (p *HTTPProxy) rejectIP(w http.ResponseWriter, ip string) {
+	log.Printf("Rejected request from %s: too many connections from this address", ip)
+	http.Error(w, "Too many connections from your address", http.StatusTooManyRequests)
+}
+
+// SetQuotaChecker makes the proxy answer 509 Bandwidth Limit Exceeded for
+// tunnels of clients that are over quota.
+//
+// Parameters:
+//   - checker: Reports whether a client is over quota, typically a quota.Enforcer
+func (p *HTTPProxy) SetQuotaChecker(checker QuotaChecker) {
+	p.quotas = checker
+}
+
+// EnableSNIRouting routes HTTPS requests by the TLS server name instead of the
+// Host header. Requests whose Host does not match the SNI are rejected.
+func (p *HTTPProxy) EnableSNIRouting() {
+	p.sniRouting = true
+}
+
+// AllowsServerName reports whether a TLS handshake for serverName should be
+// accepted: the apex domain, or a subdomain or verified custom domain with a
+// tunnel on any node.
+func (p *HTTPProxy) AllowsServerName(serverName string) bool {
+	if strings.EqualFold(strings.TrimSuffix(serverName, "."), p.domain) {
+		return true
+	}
+	subdomain, _ := p.resolveHost(serverName)
+	if subdomain == "" {
+		return false
+	}
+	if _, exists := p.registry.GetBySubdomain(subdomain); exists {
+		return true
+	}
+	_, _, remote := p.remoteTunnel(subdomain)
+	return remote
 }
 
 func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
-	subdomain := p.extractSubdomain(r.Host)
-	if subdomain == "" {
-		http.Error(w, "Invalid subdomain", http.StatusBadRequest)
+	if r.Method == http.MethodConnect {
+		p.handleConnect(w, r)
 		return
 	}
-
-	if !p.handleTunnelLookup(w, subdomain) {
+	ip := p.clientIP(r)
+	if !p.ipLimits.Acquire(ip) {
+		p.rejectIP(w, ip)
 		return
 	}
+	defer p.ipLimits.Release(ip)
 
-	stream, err := p.registry.OpenStream(subdomain)
-	if err != nil {
-		http.Error(w, "Failed to connect to tunnel", http.StatusBadGateway)
-		log.Printf("Failed to open stream for %s: %v", subdomain, err)
+	if p.maxHeaderBytes > 0 && headerBytes(r) > p.maxHeaderBytes {
+		log.Printf("Rejected request for %s from %s: headers exceed %d bytes", r.Host, p.clientIP(r), p.maxHeaderBytes)
+		http.Error(w, "Request header fields too large", http.StatusRequestHeaderFieldsTooLarge)
 		return
 	}
-	defer stream.Close()
 
-	if !p.handleRequestForwarding(w, r, stream) {
+	subdomain, clientID := p.resolveHost(r.Host)
+	if p.sniRouting && r.TLS != nil && r.TLS.ServerName != "" {
+		sniSubdomain, _ := p.resolveHost(r.TLS.ServerName)
+		if sniSubdomain != subdomain {
+			http.Error(w, "Host does not match TLS server name", http.StatusMisdirectedRequest)
+			return
+		}
+	}
+	if p.servesLanding(r.Host, subdomain) {
+		p.landing(w, r)
 		return
 	}
-
-	resp, err := http.ReadResponse(bufio.NewReader(stream), r)
-	if err != nil {
-		http.Error(w, "Failed to read response", http.StatusBadGateway)
-		log.Printf("Failed to read response from stream: %v", err)
+	if subdomain == "" {
+		http.Error(w, "Invalid subdomain", http.StatusBadRequest)
+		return
+	}
+	if p.serveMaintenance(w, subdomain) {
 		return
 	}
-	defer resp.Body.Close()
-
-	p.copyResponse(w, resp, subdomain, r, start)
-}
 
-func (p *HTTPProxy) handleTunnelLookup(w http.ResponseWriter, subdomain string) bool {
-	_, exists := p.registry.GetBySubdomain(subdomain)
-	if !exists {
+	tunnel, owner, ok := p.handleTunnelLookup(w, subdomain)
+	if !ok {
+		return
+	}
+	if clientID != "" && tunnel.ClientID != clientID {
 		http.Error(w, "Tunnel not found", http.StatusNotFound)
-		log.Printf("Tunnel not found for subdomain: %s", subdomain)
-		return false
+		log.Printf("Custom domain %s points at %s, which client %s does not own", r.Host, subdomain, clientID)
+		return
+	}
+	if p.quotas != nil && p.quotas.Exceeded(tunnel.ClientID) {
+		http.Error(w, "Bandwidth quota exceeded", statusBandwidthLimitExceeded)
+		return
 	}
-	return true
-}
 
-func (p *HTTPProxy) handleRequestForwarding(w http.ResponseWriter, r *http.Request, stream net.Conn) bool {
-	if err := r.Write(stream); err != nil {
-		http.Error(w, "Failed to forward request", http.StatusBadGateway)
-		log.Printf("Failed to write request to stream: %v", err)
-		return false
+	// Keep streaming the request body to the tunnel once the response has
+	// started, as gRPC calls need: otherwise the HTTP/1.1 server discards
+	// the unread body when the headers are written, cutting the stream off.
+	// HTTP/2 requests are always full duplex.
+	http.NewResponseController(w).EnableFullDuplex()
+	body := &countingReader{ReadCloser: r.Body}
+	if r.Body != nil {
+		r.Body = body
 	}
-	return true
-}
+	rec := newResponseRecorder(w)
+	defer p.fireRequestHook(r, tunnel, rec, body, start)
+	w = rec
 
-func (p *HTTPProxy) copyResponse(w http.ResponseWriter, resp *http.Response, subdomain string, r *http.Request, start time.Time) {
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
+	p.setForwardedHeaders(r)
+	switch {
+	case owner != nil:
+		p.peerProxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ownerKey{}, owner)))
+	case tunnel.GRPCWeb:
+		p.serveGRPCWeb(w, r, tunnel)
+	default:
+		// In-flight requests are counted for least-connections pool balancing.
+		if tunnel.AcquireConn() {
+			defer tunnel.ReleaseConn()
 		}
+		p.reverseProxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tunnelKey{}, tunnel)))
 	}
-	w.WriteHeader(resp.StatusCode)
-
-	flusher, canFlush := w.(http.Flusher)
-	isStreaming := p.isStreamingResponse(resp)
 
-	var written int64
-	if isStreaming && canFlush {
-		written = p.copyStreamingResponse(w, resp.Body, flusher)
-	} else {
-		written, _ = io.Copy(w, resp.Body)
+	log.Printf("[%s] %s %s %s -> %d (%d bytes, %v)",
+		subdomain, p.clientIP(r), r.Method, r.URL.Path, rec.status, rec.written, time.Since(start))
+	// The owning node counts relayed requests when it bridges the stream.
+	if owner == nil {
+		tunnel.RecordRequest(body.n.Load(), rec.written)
 	}
+}
 
-	duration := time.Since(start)
-	log.Printf("[%s] %s %s -> %d (%d bytes, %v)",
-		subdomain, r.Method, r.URL.Path, resp.StatusCode, written, duration)
+// handleTunnelLookup finds the tunnel for subdomain on this node (the pool
+// member chosen for the request, for a pool) or, with cluster forwarding
+// enabled, on another node, whose owner is then returned too.
+func (p *HTTPProxy) handleTunnelLookup(w http.ResponseWriter, subdomain string) (*registry.TunnelInfo, *registry.Owner, bool) {
+	if tunnel, exists := p.registry.Pick(subdomain); exists {
+		return tunnel, nil, true
+	}
+	if tunnel, owner, remote := p.remoteTunnel(subdomain); remote {
+		return tunnel, owner, true
+	}
+	http.Error(w, "Tunnel not found", http.StatusNotFound)
+	log.Printf("Tunnel not found for subdomain: %s", subdomain)
+	return nil, nil, false
 }
 
-func (p *HTTPProxy) isStreamingResponse(resp *http.Response) bool {
-	return resp.Header.Get("Content-Type") == "text/event-stream" ||
-		resp.Header.Get("Transfer-Encoding") == "chunked" ||
-		resp.Header.Get("X-Accel-Buffering") == "no"
+// countingReader counts the bytes read from a request body. The transport
+// may still be reading the body after a failed round trip, so the count is
+// atomic.
+type countingReader struct {
+	io.ReadCloser
+	n atomic.Int64
 }
 
-func (p *HTTPProxy) copyStreamingResponse(w http.ResponseWriter, body io.ReadCloser, flusher http.Flusher) int64 {
-	buf := make([]byte, 32*1024) // 32KB buffer
-	var written int64
-	for {
-		n, err := body.Read(buf)
-		if n > 0 {
-			nw, ew := w.Write(buf[:n])
-			written += int64(nw)
-			if ew != nil {
-				log.Printf("Error writing streaming response: %v", ew)
-				break
-			}
-			flusher.Flush()
-		}
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error reading streaming response: %v", err)
-			}
-			break
-		}
-	}
-	return written
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.n.Add(int64(n))
+	return n, err
 }
 
+// extractSubdomain returns the tunnel subdomain named by a Host header, which
+// may carry a port. Host names match case-insensitively and may end in a dot,
+// as TLS server names do. IP literals, including bracketed IPv6 addresses,
+// and hosts outside the domain yield "".
 func (p *HTTPProxy) extractSubdomain(host string) string {
-	host = strings.Split(host, ":")[0]
-
-	if !strings.HasSuffix(host, "."+p.domain) {
-		if host == p.domain {
-			return ""
-		}
-		return ""
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
 	}
-
-	subdomain := strings.TrimSuffix(host, "."+p.domain)
-	return subdomain
+	return subdomainForServerName(host, p.domain)
 }
 
 func (p *HTTPProxy) HandleHealthCheck(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+func newTestProxyServer(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+
+	reg := registry.NewRegistry()
+	newTestTunnel(t, reg, "app", handler)
+	server := httptest.NewServer(NewHTTPProxy(reg, "tunnel.example.com"))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func getThroughProxy(t *testing.T, server *httptest.Server, path string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Host = "app.tunnel.example.com"
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestProxyNormalResponse(t *testing.T) {
+	server := newTestProxyServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		io.WriteString(w, "hello "+r.URL.RequestURI())
+	}))
+
+	resp := getThroughProxy(t, server, "/path?q=1")
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK || string(body) != "hello /path?q=1" {
+		t.Fatalf("unexpected response: %d %q", resp.StatusCode, body)
+	}
+	if resp.ContentLength != int64(len(body)) {
+		t.Fatalf("expected Content-Length %d, got %d", len(body), resp.ContentLength)
+	}
+	if cookies := resp.Header.Values("Set-Cookie"); len(cookies) != 2 {
+		t.Fatalf("expected both cookies, got %v", cookies)
+	}
+}
+
+func TestProxyChunkedResponse(t *testing.T) {
+	server := newTestProxyServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "chunk%d;", i)
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("X-Checksum", "abc")
+	}))
+
+	resp := getThroughProxy(t, server, "/")
+	body, _ := io.ReadAll(resp.Body)
+
+	if string(body) != "chunk0;chunk1;chunk2;" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("expected a chunked response, got %v", resp.TransferEncoding)
+	}
+	if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+		t.Fatalf("expected trailer to be forwarded, got %q", got)
+	}
+}
+
+func TestProxyStreamsServerSentEvents(t *testing.T) {
+	release := make(chan struct{})
+	server := newTestProxyServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "data: second\n\n")
+	}))
+	defer close(release)
+
+	resp := getThroughProxy(t, server, "/events")
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		lines <- line
+	}()
+
+	select {
+	case line := <-lines:
+		if line != "data: first\n" {
+			t.Fatalf("unexpected first event %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first event was not flushed before the stream ended")
+	}
+}
+
+func TestProxyFlushesWhenBufferingDisabled(t *testing.T) {
+	release := make(chan struct{})
+	server := newTestProxyServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.Header().Set("Content-Length", "10")
+		io.WriteString(w, "12345")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "67890")
+	}))
+	defer close(release)
+
+	resp := getThroughProxy(t, server, "/")
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(resp.Body, buf)
+		got <- string(buf)
+	}()
+
+	select {
+	case first := <-got:
+		if first != "12345" {
+			t.Fatalf("unexpected first bytes %q", first)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("response was buffered despite X-Accel-Buffering: no")
+	}
+}
+
+func TestProxyErrors(t *testing.T) {
+	reg := registry.NewRegistry()
+	tunnel := newTestTunnel(t, reg, "app", http.NotFoundHandler())
+	tunnel.MuxSession.Close()
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+
+	cases := []struct {
+		host string
+		want int
+	}{
+		{"tunnel.example.com", http.StatusBadRequest},
+		{"missing.tunnel.example.com", http.StatusNotFound},
+		{"app.tunnel.example.com", http.StatusBadGateway},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://"+tc.host+"/", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Fatalf("%s: expected %d, got %d (%s)", tc.host, tc.want, rec.Code, strings.TrimSpace(rec.Body.String()))
+		}
+	}
+}
+
+func TestExtractSubdomain(t *testing.T) {
+	p := NewHTTPProxy(registry.NewRegistry(), "tunnel.example.com")
+	tests := map[string]string{
+		"app.tunnel.example.com":        "app",
+		"app.tunnel.example.com:8080":   "app",
+		"tunnel.example.com":            "",
+		"tunnel.example.com:443":        "",
+		"other.example.com":             "",
+		"[::1]:8080":                    "",
+		"[::1]":                         "",
+		"[2001:db8::1]:443":             "",
+		"127.0.0.1:8080":                "",
+		"[app.tunnel.example.com]:8080": "app",
+		"App.Tunnel.Example.com:8080":   "app",
+		"app.tunnel.example.com.":       "app",
+		"app.tunnel.example.com.:443":   "app",
+		"api.v2.tunnel.example.com":     "api.v2",
+		"app.tunnel.example.com:":       "app",
+		"apptunnel.example.com":         "",
+	}
+	for host, want := range tests {
+		if got := p.extractSubdomain(host); got != want {
+			t.Fatalf("extractSubdomain(%q): expected %q, got %q", host, want, got)
+		}
+	}
+}
+
+func TestProxyIPv6HostIsNotRouted(t *testing.T) {
+	server := newTestProxyServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request for an IP literal reached the tunnel")
+	}))
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Host = "[::1]:8080"
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bracketed IPv6 host, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/iplimit"
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+func TestProxyLimitsRequestsPerIP(t *testing.T) {
+	reg := registry.NewRegistry()
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-unblock
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	limiter := iplimit.NewLimiter(1)
+	p.SetIPLimiter(limiter)
+
+	request := func(path, remote string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com"+path, nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	done := make(chan int, 1)
+	go func() { done <- request("/slow", "192.0.2.1:1000") }()
+	<-entered
+
+	if code := request("/", "192.0.2.1:1001"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 past the per-IP limit, got %d", code)
+	}
+	if code := request("/", "192.0.2.2:1000"); code != http.StatusOK {
+		t.Fatalf("expected another IP to be served, got %d", code)
+	}
+
+	close(unblock)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("expected the slow request to succeed, got %d", code)
+	}
+	if code := request("/", "192.0.2.1:1002"); code != http.StatusOK {
+		t.Fatalf("expected the slot to be released after the request, got %d", code)
+	}
+	if limiter.Count("192.0.2.1") != 0 {
+		t.Fatalf("expected no connections left, got %d", limiter.Count("192.0.2.1"))
+	}
+}
+
+func TestTCPProxyLimitsConnectionsPerIP(t *testing.T) {
+	reg := registry.NewRegistry()
+	p := NewTCPProxy(reg)
+	p.SetIPLimiter(iplimit.NewLimiter(1))
+
+	release, ok := p.acquireIP(&fakeAddrConn{addr: "192.0.2.1:1000"})
+	if !ok {
+		t.Fatal("expected the first connection to be allowed")
+	}
+	if _, ok := p.acquireIP(&fakeAddrConn{addr: "192.0.2.1:1001"}); ok {
+		t.Fatal("expected the second connection from the IP to be rejected")
+	}
+	release()
+	if _, ok := p.acquireIP(&fakeAddrConn{addr: "192.0.2.1:1002"}); !ok {
+		t.Fatal("expected a connection to be allowed after the first closed")
+	}
+}
+
+// fakeAddrConn is a net.Conn with a fixed remote address.
+type fakeAddrConn struct {
+	net.Conn
+	addr string
+}
+
+func (c *fakeAddrConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// landingStatus is the JSON served on the apex domain when no landing page
+// is configured.
+type landingStatus struct {
+	Service string `json:"service"`
+	Version string `json:"version"`
+	Tunnels int    `json:"tunnels"`
+}
+
+// SetLanding serves a landing page on the apex domain and on "www" (unless
+// a tunnel uses that subdomain) instead of answering 400 Invalid subdomain.
+//
+// Parameters:
+//   - page: HTML served for every path, or nil to serve a JSON status with
+//     the version and the number of active tunnels
+//   - version: Server version reported by the JSON status
+func (p *HTTPProxy) SetLanding(page []byte, version string) {
+	p.landing = func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if page != nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(page)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(landingStatus{Service: "tunnelab", Version: version, Tunnels: p.registry.Count()})
+	}
+}
+
+// servesLanding reports whether a request for host, whose tunnel subdomain
+// is subdomain, gets the landing page.
+func (p *HTTPProxy) servesLanding(host, subdomain string) bool {
+	if p.landing == nil {
+		return false
+	}
+	if subdomain == "" {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.EqualFold(strings.TrimSuffix(host, "."), p.domain)
+	}
+	if subdomain != "www" {
+		return false
+	}
+	if _, exists := p.registry.GetBySubdomain(subdomain); exists {
+		return false
+	}
+	_, _, remote := p.remoteTunnel(subdomain)
+	return !remote
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+func TestApexServesLanding(t *testing.T) {
+	reg := registry.NewRegistry()
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://tunnel.example.com/", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for the apex without a landing page, got %d", rec.Code)
+	}
+
+	p.SetLanding(nil, "1.2.3")
+	newTestTunnel(t, reg, "app", http.NotFoundHandler())
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://tunnel.example.com:8080/", nil))
+	var status landingStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("expected a JSON status, got %d %q", rec.Code, rec.Body.String())
+	}
+	if status.Version != "1.2.3" || status.Tunnels != 1 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	p.SetLanding([]byte("<h1>Welcome</h1>"), "1.2.3")
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://www.tunnel.example.com/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "<h1>Welcome</h1>" {
+		t.Fatalf("expected www to serve the landing page, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// A tunnel named www takes precedence over the landing page.
+	newTestTunnel(t, reg, "www", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tunnel"))
+	}))
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://www.tunnel.example.com/", nil))
+	if rec.Body.String() != "tunnel" {
+		t.Fatalf("expected the www tunnel to be served, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://[::1]/", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for hosts other than the apex, got %d", rec.Code)
+	}
+}
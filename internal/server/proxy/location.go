@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// locationHeaders are the response headers that carry URLs of the local app.
+var locationHeaders = []string{"Location", "Content-Location"}
+
+// publicSchemeKey carries the scheme the visitor used ("http" or "https") in
+// the context of the request forwarded to the tunnel.
+type publicSchemeKey struct{}
+
+// publicScheme returns the scheme of an incoming request. Behind a trusted
+// load balancer that terminates TLS, its X-Forwarded-Proto is honored.
+func (p *HTTPProxy) publicScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if p.isTrusted(remoteIP(r.RemoteAddr)) {
+		if proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+	return "http"
+}
+
+// forwardedScheme returns the visitor's scheme recorded by rewriteRequest in
+// the context of a request forwarded to a tunnel.
+func forwardedScheme(r *http.Request) string {
+	if scheme, _ := r.Context().Value(publicSchemeKey{}).(string); scheme != "" {
+		return scheme
+	}
+	return "http"
+}
+
+// rewriteLocations maps the Location and Content-Location headers of a
+// tunnel response to the public URL: URLs pointing at the local app's own
+// host and port (e.g. http://localhost:3000/foo) get the public scheme and
+// host, unless the tunnel opted out, and path prefixes are undone.
+func rewriteLocations(resp *http.Response, tunnel *registry.TunnelInfo) {
+	publicHost := resp.Request.Host
+	for _, name := range locationHeaders {
+		value := resp.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil {
+			continue
+		}
+		changed := false
+		if !tunnel.PreserveLocation && isLocalURL(u, tunnel) {
+			u.Scheme = forwardedScheme(resp.Request)
+			u.Host = publicHost
+			changed = true
+		}
+		if unmapPath(u, publicHost, tunnel) {
+			changed = true
+		}
+		if changed {
+			resp.Header.Set(name, u.String())
+		}
+	}
+}
+
+// isLocalURL reports whether u is an absolute URL of the tunnel's local app:
+// its port is the local port and its host the local host or a loopback name.
+func isLocalURL(u *url.URL, tunnel *registry.TunnelInfo) bool {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if port != strconv.Itoa(tunnel.LocalPort) {
+		return false
+	}
+	host := u.Hostname()
+	if strings.EqualFold(host, strings.Trim(tunnel.LocalHost, "[]")) || strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+func TestLocalRedirectsAreRewrittenToPublicURL(t *testing.T) {
+	tests := map[string]struct {
+		location string
+		header   string // Response header carrying location (default Location)
+		preserve bool
+		add      string
+		want     string
+	}{
+		"localhost":              {location: "http://localhost:3000/foo?x=1", want: "http://app.tunnel.example.com/foo?x=1"},
+		"loopback ip":            {location: "http://127.0.0.1:3000/foo", want: "http://app.tunnel.example.com/foo"},
+		"content location":       {location: "http://localhost:3000/doc/1", header: "Content-Location", want: "http://app.tunnel.example.com/doc/1"},
+		"other port unchanged":   {location: "http://localhost:8080/foo", want: "http://localhost:8080/foo"},
+		"other host unchanged":   {location: "https://auth.example.com/login", want: "https://auth.example.com/login"},
+		"opted out":              {location: "http://localhost:3000/foo", preserve: true, want: "http://localhost:3000/foo"},
+		"with added path prefix": {location: "http://localhost:3000/app/foo", add: "/app", want: "http://app.tunnel.example.com/foo"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			header := tt.header
+			if header == "" {
+				header = "Location"
+			}
+			reg := registry.NewRegistry()
+			tunnel := newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(header, tt.location)
+				w.WriteHeader(http.StatusFound)
+			}))
+			tunnel.LocalHost = "localhost"
+			tunnel.LocalPort = 3000
+			tunnel.PreserveLocation = tt.preserve
+			tunnel.AddPathPrefix = tt.add
+			server := httptest.NewServer(NewHTTPProxy(reg, "tunnel.example.com"))
+			t.Cleanup(server.Close)
+			client := server.Client()
+			client.CheckRedirect = func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }
+
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+			if err != nil {
+				t.Fatalf("failed to build request: %v", err)
+			}
+			req.Host = "app.tunnel.example.com"
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get(header); got != tt.want {
+				t.Fatalf("expected %s %s, got %s", header, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPublicSchemeHonorsTrustedProxies(t *testing.T) {
+	p := NewHTTPProxy(registry.NewRegistry(), "tunnel.example.com")
+	if err := p.SetTrustedProxies([]string{"10.0.0.1"}); err != nil {
+		t.Fatalf("failed to set trusted proxies: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	if got := p.publicScheme(req); got != "https" {
+		t.Fatalf("expected a trusted proxy's X-Forwarded-Proto to be honored, got %s", got)
+	}
+	req.RemoteAddr = "203.0.113.9:1234"
+	if got := p.publicScheme(req); got != "http" {
+		t.Fatalf("expected an untrusted X-Forwarded-Proto to be ignored, got %s", got)
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaintenancePage is served during maintenance when no page is configured.
+const defaultMaintenancePage = "Service under maintenance, please try again later\n"
+
+// maintenance tracks which tunnels answer 503 instead of being forwarded.
+// Tunnels stay connected; only their public traffic is held back.
+type maintenance struct {
+	mu         sync.RWMutex
+	global     bool            // Every tunnel is in maintenance
+	subdomains map[string]bool // Subdomains in maintenance on their own
+	page       []byte          // HTML served instead of the default text (nil serves the text)
+	retryAfter time.Duration   // Retry-After sent with the page (0 sends none)
+}
+
+// MaintenanceStatus is the maintenance state of the proxy.
+type MaintenanceStatus struct {
+	Global  bool     `json:"global"`  // Every tunnel is in maintenance
+	Tunnels []string `json:"tunnels"` // Subdomains in maintenance on their own, sorted
+}
+
+// SetMaintenancePage configures the response served during maintenance.
+//
+// Parameters:
+//   - page: HTML served with status 503, or nil to serve a short text
+//   - retryAfter: Value of the Retry-After header, rounded up to whole seconds (0 sends none)
+func (p *HTTPProxy) SetMaintenancePage(page []byte, retryAfter time.Duration) {
+	p.maintenance.mu.Lock()
+	defer p.maintenance.mu.Unlock()
+	p.maintenance.page = page
+	p.maintenance.retryAfter = retryAfter
+}
+
+// SetGlobalMaintenance puts every tunnel in or out of maintenance. Tunnels
+// put in maintenance on their own with SetTunnelMaintenance stay in it when
+// global maintenance ends.
+//
+// Parameters:
+//   - enabled: Whether requests to every tunnel get the maintenance page
+func (p *HTTPProxy) SetGlobalMaintenance(enabled bool) {
+	p.maintenance.mu.Lock()
+	defer p.maintenance.mu.Unlock()
+	p.maintenance.global = enabled
+}
+
+// SetTunnelMaintenance puts the tunnel of subdomain in or out of
+// maintenance. The flag belongs to the subdomain, so it survives the tunnel
+// reconnecting and may be set before the tunnel exists.
+//
+// Parameters:
+//   - subdomain: Subdomain of the tunnel
+//   - enabled: Whether requests to the tunnel get the maintenance page
+func (p *HTTPProxy) SetTunnelMaintenance(subdomain string, enabled bool) {
+	subdomain = strings.ToLower(subdomain)
+	p.maintenance.mu.Lock()
+	defer p.maintenance.mu.Unlock()
+	if !enabled {
+		delete(p.maintenance.subdomains, subdomain)
+		return
+	}
+	if p.maintenance.subdomains == nil {
+		p.maintenance.subdomains = make(map[string]bool)
+	}
+	p.maintenance.subdomains[subdomain] = true
+}
+
+// Maintenance returns the current maintenance state.
+//
+// Returns:
+//   - MaintenanceStatus: Whether global maintenance is on and which tunnels are in maintenance on their own
+func (p *HTTPProxy) Maintenance() MaintenanceStatus {
+	p.maintenance.mu.RLock()
+	defer p.maintenance.mu.RUnlock()
+	status := MaintenanceStatus{Global: p.maintenance.global, Tunnels: make([]string, 0, len(p.maintenance.subdomains))}
+	for subdomain := range p.maintenance.subdomains {
+		status.Tunnels = append(status.Tunnels, subdomain)
+	}
+	sort.Strings(status.Tunnels)
+	return status
+}
+
+// serveMaintenance answers the request with the maintenance page if the
+// tunnel of subdomain is in maintenance, and reports whether it did.
+func (p *HTTPProxy) serveMaintenance(w http.ResponseWriter, subdomain string) bool {
+	p.maintenance.mu.RLock()
+	active := p.maintenance.global || p.maintenance.subdomains[subdomain]
+	page, retryAfter := p.maintenance.page, p.maintenance.retryAfter
+	p.maintenance.mu.RUnlock()
+	if !active {
+		return false
+	}
+
+	if retryAfter > 0 {
+		seconds := (retryAfter + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.Itoa(int(seconds)))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if page == nil {
+		http.Error(w, strings.TrimSuffix(defaultMaintenancePage, "\n"), http.StatusServiceUnavailable)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(page)
+	return true
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+func TestMaintenanceShortCircuitsForwarding(t *testing.T) {
+	reg := registry.NewRegistry()
+	var forwarded atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		w.Write([]byte("origin"))
+	})
+	newTestTunnel(t, reg, "app", handler)
+	newTestTunnel(t, reg, "api", handler)
+
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	hooked := make(chan *RequestInfo, 4)
+	p.RequestHook = func(info *RequestInfo) { hooked <- info }
+	p.SetMaintenancePage([]byte("<h1>Back soon</h1>"), 90*time.Second)
+
+	get := func(host string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		return rec
+	}
+
+	p.SetTunnelMaintenance("App", true)
+	rec := get("app.tunnel.example.com")
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "<h1>Back soon</h1>" {
+		t.Fatalf("expected the maintenance page, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Retry-After") != "90" || rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("unexpected maintenance headers: %v", rec.Header())
+	}
+	if forwarded.Load() != 0 {
+		t.Fatal("expected a tunnel in maintenance not to be forwarded to")
+	}
+	if rec := get("api.tunnel.example.com"); rec.Code != http.StatusOK || forwarded.Load() != 1 {
+		t.Fatalf("expected other tunnels to be forwarded to, got %d", rec.Code)
+	}
+
+	p.SetGlobalMaintenance(true)
+	if rec := get("api.tunnel.example.com"); rec.Code != http.StatusServiceUnavailable || forwarded.Load() != 1 {
+		t.Fatalf("expected global maintenance to hold every tunnel, got %d", rec.Code)
+	}
+	if rec := get("missing.tunnel.example.com"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected global maintenance to cover unknown subdomains, got %d", rec.Code)
+	}
+	if status := p.Maintenance(); !status.Global || len(status.Tunnels) != 1 || status.Tunnels[0] != "app" {
+		t.Fatalf("unexpected maintenance status: %+v", status)
+	}
+
+	p.SetGlobalMaintenance(false)
+	if rec := get("app.tunnel.example.com"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected app to stay in maintenance after global maintenance ends, got %d", rec.Code)
+	}
+	p.SetTunnelMaintenance("app", false)
+	if rec := get("app.tunnel.example.com"); rec.Code != http.StatusOK || forwarded.Load() != 2 {
+		t.Fatalf("expected app to be forwarded to after maintenance, got %d", rec.Code)
+	}
+	if _, exists := reg.GetBySubdomain("app"); !exists {
+		t.Fatal("expected maintenance to leave the tunnel registered")
+	}
+}
+
+func TestMaintenanceDefaultResponse(t *testing.T) {
+	p := NewHTTPProxy(registry.NewRegistry(), "tunnel.example.com")
+	p.SetGlobalMaintenance(true)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != defaultMaintenancePage {
+		t.Fatalf("expected the default maintenance text, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Retry-After") != "" {
+		t.Fatalf("expected no Retry-After without one configured, got %q", rec.Header().Get("Retry-After"))
+	}
+}
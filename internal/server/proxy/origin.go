@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/yamux"
+)
+
+// originError says why no valid response could be read from a tunnel.
+type originError struct {
+	protocol bool   // The local server answered, but not with valid HTTP/1.x
+	refused  bool   // The stream closed before any byte: the local server is unreachable
+	reason   string // What was wrong, for the error page and the log
+}
+
+// originMalformations maps fragments of the errors net/http returns for
+// invalid responses, which have no exported types, to their reasons.
+var originMalformations = []struct {
+	match  string
+	reason string
+}{
+	{"malformed HTTP response", "missing or malformed status line"},
+	{"malformed HTTP status code", "malformed status code"},
+	{"malformed HTTP version", "malformed HTTP version"},
+	{"malformed MIME header", "malformed header line"},
+	{"Content-Length", "invalid Content-Length"},
+	{"transfer encoding", "unsupported Transfer-Encoding"},
+	{"chunk", "bad chunk framing"},
+	{"response headers exceeded", "response headers too large"},
+}
+
+// classifyOriginError tells a malformed or truncated response of the local
+// server apart from a failure to reach it. A stream closed before any byte
+// of a response is a connection failure: the client closes streams it
+// cannot connect to its local server. Depending on timing the transport
+// reports the closed stream while writing the request, or as a closed idle
+// connection, instead of when reading the response.
+func classifyOriginError(err error) originError {
+	msg := err.Error()
+	for _, m := range originMalformations {
+		if strings.Contains(msg, m.match) {
+			return originError{protocol: true, reason: m.reason}
+		}
+	}
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return originError{protocol: true, reason: "response truncated"}
+	case errors.Is(err, io.EOF), errors.Is(err, yamux.ErrStreamClosed), strings.Contains(msg, "server closed idle connection"):
+		return originError{refused: true, reason: "stream closed before a response was sent"}
+	}
+	return originError{reason: "connection failed"}
+}
+
+// writeOriginError answers a request whose tunnel response could not be
+// read with 502, naming the malformation when the local server answered
+// with invalid HTTP and telling a refused local connection apart from a
+// broken tunnel.
+func writeOriginError(w http.ResponseWriter, r *http.Request, err error) {
+	oe := classifyOriginError(err)
+	if oe.refused {
+		log.Printf("Local server of %s refused the connection (%s): %v", r.Host, oe.reason, err)
+		http.Error(w, "Origin refused connection: the tunnel client could not reach its local server", http.StatusBadGateway)
+		return
+	}
+	if !oe.protocol {
+		log.Printf("Failed to proxy request for %s (%s): %v", r.Host, oe.reason, err)
+		http.Error(w, "Failed to connect to tunnel", http.StatusBadGateway)
+		return
+	}
+	log.Printf("Local server of %s sent an invalid response (%s): %v", r.Host, oe.reason, err)
+	http.Error(w, "Local server sent an invalid HTTP response: "+oe.reason, http.StatusBadGateway)
+}
+
+// originBody logs the first error reading a response body from a tunnel
+// with its classification. The status has been sent by then, so the client
+// connection is simply cut off.
+type originBody struct {
+	io.ReadCloser
+	host   string
+	logged bool
+}
+
+func (b *originBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && !b.logged {
+		b.logged = true
+		if oe := classifyOriginError(err); oe.protocol {
+			log.Printf("Local server of %s sent an invalid response body (%s): %v", b.host, oe.reason, err)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+	"github.com/hashicorp/yamux"
+)
+
+// newRawTestTunnel registers a tunnel whose local server answers every
+// request with the raw bytes of response and closes the stream.
+func newRawTestTunnel(t *testing.T, reg *registry.Registry, subdomain, response string) {
+	t.Helper()
+
+	serverSession, clientSession := newTestSessions(t)
+	go func() {
+		for {
+			stream, err := clientSession.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				http.ReadRequest(bufio.NewReader(stream))
+				io.WriteString(stream, response)
+			}()
+		}
+	}()
+
+	tunnel := &registry.TunnelInfo{
+		ID:         "tunnel-" + subdomain,
+		ClientID:   "client",
+		Subdomain:  subdomain,
+		Protocol:   "http",
+		MuxSession: serverSession,
+	}
+	if err := reg.Register(tunnel); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+}
+
+func TestMalformedOriginResponsesAreClassified(t *testing.T) {
+	tests := map[string]struct {
+		response string
+		want     string
+	}{
+		"missing status line":    {response: "garbage\r\n\r\n", want: "invalid HTTP response: missing or malformed status line"},
+		"bad status code":        {response: "HTTP/1.1 2xx OK\r\n\r\n", want: "invalid HTTP response: malformed status code"},
+		"bad version":            {response: "HTTX/1.1 200 OK\r\n\r\n", want: "invalid HTTP response: malformed HTTP version"},
+		"bad header line":        {response: "HTTP/1.1 200 OK\r\nno colon here\r\n\r\n", want: "invalid HTTP response: malformed header line"},
+		"bad content length":     {response: "HTTP/1.1 200 OK\r\nContent-Length: ten\r\n\r\n", want: "invalid HTTP response: invalid Content-Length"},
+		"unsupported encoding":   {response: "HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip\r\n\r\n", want: "invalid HTTP response: unsupported Transfer-Encoding"},
+		"truncated headers":      {response: "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n", want: "invalid HTTP response: response truncated"},
+		"no response (not HTTP)": {response: "", want: "Origin refused connection"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			reg := registry.NewRegistry()
+			newRawTestTunnel(t, reg, "app", tt.response)
+			p := NewHTTPProxy(reg, "tunnel.example.com")
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/", nil))
+			if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Fatalf("expected 502 %q, got %d %q", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestStreamClosedBeforeResponseIsRefusedOrigin(t *testing.T) {
+	reg := registry.NewRegistry()
+	serverSession, clientSession := newTestSessions(t)
+	// The client closes each stream at once, as it does when its local
+	// server cannot be dialed.
+	go func() {
+		for {
+			stream, err := clientSession.Accept()
+			if err != nil {
+				return
+			}
+			stream.Close()
+		}
+	}()
+	tunnel := &registry.TunnelInfo{
+		ID:         "tunnel-app",
+		ClientID:   "client",
+		Subdomain:  "app",
+		Protocol:   "http",
+		MuxSession: serverSession,
+	}
+	if err := reg.Register(tunnel); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(method, "http://app.tunnel.example.com/", strings.NewReader("payload")))
+		if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "Origin refused connection") {
+			t.Fatalf("%s: expected 502 naming the refused origin, got %d %q", method, rec.Code, rec.Body.String())
+		}
+	}
+
+	if oe := classifyOriginError(io.EOF); !oe.refused || oe.protocol {
+		t.Fatalf("expected EOF before a response to be a refused origin, got %+v", oe)
+	}
+	if oe := classifyOriginError(yamux.ErrStreamClosed); !oe.refused || oe.protocol {
+		t.Fatalf("expected a stream closed while writing the request to be a refused origin, got %+v", oe)
+	}
+	if oe := classifyOriginError(io.ErrUnexpectedEOF); oe.refused {
+		t.Fatalf("expected a truncated response not to be a refused origin, got %+v", oe)
+	}
+}
+
+func TestClassifyOriginBodyErrors(t *testing.T) {
+	tests := map[string]struct {
+		response string
+		reason   string
+	}{
+		"bad chunk length":  {response: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n", reason: "bad chunk framing"},
+		"missing chunk end": {response: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhelloXX", reason: "bad chunk framing"},
+		"short body":        {response: "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nabc", reason: "response truncated"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(tt.response)), nil)
+			if err != nil {
+				t.Fatalf("expected the headers to parse: %v", err)
+			}
+			_, err = io.ReadAll(&originBody{ReadCloser: resp.Body, host: "app.tunnel.example.com"})
+			if err == nil {
+				t.Fatal("expected reading the body to fail")
+			}
+			if oe := classifyOriginError(err); !oe.protocol || oe.reason != tt.reason {
+				t.Fatalf("expected protocol error %q for %v, got %+v", tt.reason, err, oe)
+			}
+		})
+	}
+
+	if oe := classifyOriginError(errors.New("dial tcp: connection refused")); oe.protocol {
+		t.Fatalf("expected a connection failure not to be a protocol error, got %+v", oe)
+	}
+}
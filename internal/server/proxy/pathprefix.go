@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// rewritePath maps the public path of a request to the path of the local
+// app: StripPathPrefix is removed first, then AddPathPrefix is prepended.
+// Paths outside StripPathPrefix are forwarded unchanged.
+func rewritePath(u *url.URL, tunnel *registry.TunnelInfo) {
+	if tunnel.StripPathPrefix == "" && tunnel.AddPathPrefix == "" {
+		return
+	}
+	escaped := u.EscapedPath()
+	if tunnel.StripPathPrefix != "" {
+		rest, ok := cutPathPrefix(escaped, tunnel.StripPathPrefix)
+		if !ok {
+			return
+		}
+		escaped = rest
+	}
+	if escaped == "" {
+		escaped = "/"
+	}
+	if tunnel.AddPathPrefix != "" {
+		escaped = tunnel.AddPathPrefix + escaped
+	}
+	setEscapedPath(u, escaped)
+}
+
+// unmapPath maps the path of a URL the local app sent in a response header
+// back to the public path, the inverse of rewritePath. Only URLs on
+// publicHost, or without a host, whose path is absolute and under
+// AddPathPrefix (if set) are changed; relative paths such as "next" already
+// resolve against the public URL.
+//
+// Returns:
+//   - bool: Whether u was changed
+func unmapPath(u *url.URL, publicHost string, tunnel *registry.TunnelInfo) bool {
+	if tunnel.StripPathPrefix == "" && tunnel.AddPathPrefix == "" {
+		return false
+	}
+	if u.Opaque != "" || !strings.HasPrefix(u.EscapedPath(), "/") {
+		return false
+	}
+	if u.Host != "" && !strings.EqualFold(u.Host, publicHost) {
+		return false
+	}
+
+	escaped := u.EscapedPath()
+	if tunnel.AddPathPrefix != "" {
+		rest, ok := cutPathPrefix(escaped, tunnel.AddPathPrefix)
+		if !ok {
+			return false
+		}
+		escaped = rest
+	}
+	if tunnel.StripPathPrefix != "" {
+		if escaped == "" || escaped == "/" {
+			// The root of the local app is the bare prefix publicly.
+			escaped = tunnel.StripPathPrefix + "/"
+		} else {
+			escaped = tunnel.StripPathPrefix + escaped
+		}
+	}
+	if escaped == "" {
+		escaped = "/"
+	}
+	setEscapedPath(u, escaped)
+	return true
+}
+
+// cutPathPrefix removes prefix from path if path is prefix itself or a path
+// below it ("/api" matches "/api" and "/api/users", not "/apiary").
+//
+// Returns:
+//   - string: The rest of path, starting with "/" or empty
+//   - bool: Whether path is under prefix
+func cutPathPrefix(path, prefix string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return path, false
+	}
+	return rest, true
+}
+
+// setEscapedPath sets the path of u from its escaped form.
+func setEscapedPath(u *url.URL, escaped string) {
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return
+	}
+	u.Path = path
+	u.RawPath = escaped
+}
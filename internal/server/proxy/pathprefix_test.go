@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// newPrefixTestServer serves a tunnel with the given path prefixes whose
+// local app answers with the path it received, or redirects to the
+// Location given in its "redirect" query parameter.
+func newPrefixTestServer(t *testing.T, strip, add string) *httptest.Server {
+	t.Helper()
+	reg := registry.NewRegistry()
+	tunnel := newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if location := r.URL.Query().Get("redirect"); location != "" {
+			w.Header().Set("Location", location)
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		io.WriteString(w, r.URL.RequestURI())
+	}))
+	tunnel.StripPathPrefix = strip
+	tunnel.AddPathPrefix = add
+	server := httptest.NewServer(NewHTTPProxy(reg, "tunnel.example.com"))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPathPrefixRewriting(t *testing.T) {
+	tests := map[string]struct {
+		strip, add string
+		path       string
+		want       string
+	}{
+		"strip":                  {strip: "/api", path: "/api/users?id=1", want: "/users?id=1"},
+		"strip bare prefix":      {strip: "/api", path: "/api", want: "/"},
+		"strip outside prefix":   {strip: "/api", path: "/apiary/x", want: "/apiary/x"},
+		"add":                    {add: "/app", path: "/users", want: "/app/users"},
+		"add to root":            {add: "/app", path: "/", want: "/app/"},
+		"strip and add":          {strip: "/api", add: "/v2", path: "/api/users", want: "/v2/users"},
+		"escaped path preserved": {add: "/app", path: "/a%2Fb", want: "/app/a%2Fb"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := newPrefixTestServer(t, tt.strip, tt.add)
+			resp := getThroughProxy(t, server, tt.path)
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.want {
+				t.Fatalf("expected the local app to get %s, got %s", tt.want, body)
+			}
+		})
+	}
+}
+
+func TestPathPrefixRewritesRedirects(t *testing.T) {
+	tests := map[string]struct {
+		strip, add string
+		location   string
+		want       string
+	}{
+		"added prefix removed":    {add: "/app", location: "/app/login", want: "/login"},
+		"added prefix root":       {add: "/app", location: "/app", want: "/"},
+		"stripped prefix added":   {strip: "/api", location: "/login", want: "/api/login"},
+		"stripped prefix root":    {strip: "/api", location: "/", want: "/api/"},
+		"strip and add":           {strip: "/api", add: "/v2", location: "/v2/login?next=1", want: "/api/login?next=1"},
+		"same host absolute":      {add: "/app", location: "http://app.tunnel.example.com/app/login", want: "http://app.tunnel.example.com/login"},
+		"other host unchanged":    {add: "/app", location: "https://auth.example.com/app/login", want: "https://auth.example.com/app/login"},
+		"outside added prefix":    {add: "/app", location: "/static/x", want: "/static/x"},
+		"relative path unchanged": {add: "/app", location: "next", want: "next"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := newPrefixTestServer(t, tt.strip, tt.add)
+			client := server.Client()
+			client.CheckRedirect = func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }
+
+			publicPath := "/"
+			if tt.strip != "" {
+				publicPath = tt.strip + "/"
+			}
+			req, err := http.NewRequest(http.MethodGet, server.URL+publicPath+"?redirect="+url.QueryEscape(tt.location), nil)
+			if err != nil {
+				t.Fatalf("failed to build request: %v", err)
+			}
+			req.Host = "app.tunnel.example.com"
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusFound {
+				t.Fatalf("expected 302, got %d", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Location"); got != tt.want {
+				t.Fatalf("expected Location %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
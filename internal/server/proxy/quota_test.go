@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+type overQuota map[string]bool
+
+func (q overQuota) Exceeded(clientID string) bool { return q[clientID] }
+
+func TestProxyRejectsClientsOverQuota(t *testing.T) {
+	reg := registry.NewRegistry()
+	newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	quotas := overQuota{}
+	p.SetQuotaChecker(quotas)
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+
+	if resp := getThroughProxy(t, server, "/"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 under quota, got %d", resp.StatusCode)
+	}
+
+	quotas["client"] = true
+	if resp := getThroughProxy(t, server, "/"); resp.StatusCode != statusBandwidthLimitExceeded {
+		t.Fatalf("expected 509 over quota, got %d", resp.StatusCode)
+	}
+}
+
+func TestTCPProxyRejectsClientsOverQuota(t *testing.T) {
+	reg := registry.NewRegistry()
+	newTestTCPTunnel(t, reg, "db", 31500)
+	p := NewTCPProxy(reg)
+	quotas := overQuota{}
+	p.SetQuotaChecker(quotas)
+
+	echo := func() error {
+		public, conn := net.Pipe()
+		defer public.Close()
+		go p.handleConnection(conn, 31500)
+		public.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := public.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(public, make([]byte, 4))
+		return err
+	}
+
+	if err := echo(); err != nil {
+		t.Fatalf("expected echo under quota, got %v", err)
+	}
+	quotas["client"] = true
+	if err := echo(); err == nil {
+		t.Fatal("expected the connection to be closed over quota")
+	}
+}
+
+func TestConnectRejectsClientsOverQuota(t *testing.T) {
+	reg := registry.NewRegistry()
+	newTestTCPTunnel(t, reg, "db", 30001)
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	quotas := overQuota{}
+	p.SetQuotaChecker(quotas)
+	server := httptest.NewServer(p.WithConnect(http.NotFoundHandler()))
+	t.Cleanup(server.Close)
+
+	if _, _, resp := dialConnect(t, server.URL, "db.tunnel.example.com:443"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected CONNECT to be accepted under quota, got %d", resp.StatusCode)
+	}
+	quotas["client"] = true
+	if _, _, resp := dialConnect(t, server.URL, "db.tunnel.example.com:443"); resp.StatusCode != statusBandwidthLimitExceeded {
+		t.Fatalf("expected 509 for CONNECT over quota, got %d", resp.StatusCode)
+	}
+}
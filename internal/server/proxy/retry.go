@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// errPoolTimeout reports that a request to a pool ran out of its timeout
+// budget, answered with 504 Gateway Timeout.
+var errPoolTimeout = errors.New("pool request timeout exceeded")
+
+// defaultRetryMethods are the safe methods retried on another pool member
+// unless configured otherwise.
+var defaultRetryMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+// poolRetryTransport sends requests for pooled tunnels again to another
+// member of the pool when the stream to the chosen one fails before a
+// response arrives. Only requests without a body whose method is in methods
+// are retried.
+type poolRetryTransport struct {
+	next     http.RoundTripper
+	registry *registry.Registry
+
+	mu      sync.RWMutex
+	retries int           // Attempts on other members after the first
+	timeout time.Duration // Budget for all attempts of a request (0 means none)
+	methods []string
+}
+
+func newPoolRetryTransport(next http.RoundTripper, reg *registry.Registry) *poolRetryTransport {
+	return &poolRetryTransport{
+		next:     next,
+		registry: reg,
+		methods:  defaultRetryMethods,
+	}
+}
+
+// configure sets the retry policy; see HTTPProxy.SetPoolRetry.
+func (t *poolRetryTransport) configure(retries int, timeout time.Duration, methods []string) {
+	if len(methods) == 0 {
+		methods = defaultRetryMethods
+	}
+	upper := make([]string, len(methods))
+	for i, method := range methods {
+		upper[i] = strings.ToUpper(method)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.retries = max(retries, 0)
+	t.timeout = timeout
+	t.methods = upper
+}
+
+func (t *poolRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tunnel, _ := req.Context().Value(tunnelKey{}).(*registry.TunnelInfo)
+	if tunnel == nil || !tunnel.Pooled {
+		return t.next.RoundTrip(req)
+	}
+	t.mu.RLock()
+	retries, timeout := t.retries, t.timeout
+	retryable := slices.Contains(t.methods, req.Method) && (req.Body == nil || req.Body == http.NoBody)
+	t.mu.RUnlock()
+	if !retryable {
+		retries = 0
+	}
+
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	var budget *time.Timer
+	if timeout > 0 {
+		ctx, cancel = context.WithCancel(ctx)
+		budget = time.AfterFunc(timeout, cancel)
+	}
+
+	tried := []*registry.TunnelInfo{tunnel}
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req.WithContext(context.WithValue(ctx, tunnelKey{}, tunnel)))
+		if err == nil {
+			// The budget covers the attempts, not the response body.
+			if budget == nil || budget.Stop() {
+				resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+				return resp, nil
+			}
+			resp.Body.Close()
+			err = ctx.Err()
+		}
+		if budget != nil && ctx.Err() != nil && req.Context().Err() == nil {
+			return nil, fmt.Errorf("%w after %v: %v", errPoolTimeout, timeout, err)
+		}
+		if attempt >= retries || ctx.Err() != nil {
+			cancel()
+			return nil, err
+		}
+		next, ok := t.registry.PickOther(tunnel.Subdomain, tried)
+		if !ok {
+			cancel()
+			return nil, err
+		}
+		log.Printf("Retrying %s %s for %s on another pool member: %v", req.Method, req.URL.Path, tunnel.Subdomain, err)
+		tunnel = next
+		tried = append(tried, next)
+	}
+}
+
+// cancelOnClose releases the context of a request once its response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// newTestPool registers a pool for app whose first member handles each
+// stream with first and whose second member serves HTTP with second.
+func newTestPool(t *testing.T, reg *registry.Registry, first func(io.ReadWriteCloser), second http.Handler) {
+	t.Helper()
+
+	firstServer, firstClient := newTestSessions(t)
+	go func() {
+		for {
+			stream, err := firstClient.Accept()
+			if err != nil {
+				return
+			}
+			go first(stream)
+		}
+	}()
+	secondServer, secondClient := newTestSessions(t)
+	go http.Serve(secondClient, second)
+
+	for i, member := range []*registry.TunnelInfo{
+		{MuxSession: firstServer},
+		{MuxSession: secondServer},
+	} {
+		member.ID = "tunnel-app"
+		member.ClientID = "client"
+		member.Subdomain = "app"
+		member.Protocol = "http"
+		member.Pooled = true
+		register := reg.Register
+		if i > 0 {
+			register = reg.JoinPool
+		}
+		if err := register(member); err != nil {
+			t.Fatalf("failed to register member %d: %v", i, err)
+		}
+	}
+}
+
+func TestPoolRequestIsRetriedOnAnotherMember(t *testing.T) {
+	reg := registry.NewRegistry()
+	var failed atomic.Int64
+	// The first member's local service is down: its client closes every
+	// stream without a response.
+	newTestPool(t, reg, func(stream io.ReadWriteCloser) {
+		failed.Add(1)
+		stream.Close()
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "second "+r.Method)
+	}))
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	p.SetPoolRetry(1, 0, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/", nil)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "second GET" {
+		t.Fatalf("expected the retry on the second member to succeed, got %d %q", rec.Code, rec.Body.String())
+	}
+	if failed.Load() != 1 {
+		t.Fatalf("expected one attempt on the failing member, got %d", failed.Load())
+	}
+
+	// Requests with unsafe methods or a body are not retried, so of two
+	// POSTs the one sent to the failing member fails.
+	codes := make(map[int]int)
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://app.tunnel.example.com/", strings.NewReader("data")))
+		codes[rec.Code]++
+	}
+	if codes[http.StatusOK] != 1 || codes[http.StatusBadGateway] != 1 {
+		t.Fatalf("expected one POST to succeed and one to fail, got %v", codes)
+	}
+	if failed.Load() != 2 {
+		t.Fatalf("expected a single POST attempt on the failing member, got %d attempts in total", failed.Load())
+	}
+}
+
+func TestPoolRequestTimeoutBudget(t *testing.T) {
+	reg := registry.NewRegistry()
+	hang := func(stream io.ReadWriteCloser) {
+		io.Copy(io.Discard, stream)
+	}
+	newTestPool(t, reg, hang, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	p.SetPoolRetry(3, 100*time.Millisecond, nil)
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504 once the budget is spent, got %d", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected the budget to bound the request, took %v", elapsed)
+	}
+}
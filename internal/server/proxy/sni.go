@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// errHelloCaptured aborts the handshake once the ClientHello has been read.
+var errHelloCaptured = errors.New("client hello captured")
+
+// peekClientHello reads a TLS ClientHello from reader without consuming it.
+//
+// Returns:
+//   - *tls.ClientHelloInfo: The parsed ClientHello (ServerName holds the SNI)
+//   - io.Reader: A reader that replays the peeked bytes followed by the rest of the stream
+//   - error: Error if the data is not a valid ClientHello
+func peekClientHello(reader io.Reader) (*tls.ClientHelloInfo, io.Reader, error) {
+	peeked := new(bytes.Buffer)
+	hello, err := readClientHello(io.TeeReader(reader, peeked))
+	if err != nil {
+		return nil, nil, err
+	}
+	return hello, io.MultiReader(peeked, reader), nil
+}
+
+func readClientHello(reader io.Reader) (*tls.ClientHelloInfo, error) {
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{reader: reader}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = new(tls.ClientHelloInfo)
+			*hello = *info
+			return nil, errHelloCaptured
+		},
+	}).Handshake()
+	if hello == nil {
+		return nil, err
+	}
+	return hello, nil
+}
+
+// subdomainForServerName maps a TLS server name to a tunnel subdomain of domain.
+// It returns "" when the name is not a subdomain of domain.
+func subdomainForServerName(serverName, domain string) string {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+	suffix := "." + strings.ToLower(domain)
+	if !strings.HasSuffix(name, suffix) {
+		return ""
+	}
+	return strings.TrimSuffix(name, suffix)
+}
+
+// readOnlyConn feeds a reader to crypto/tls; writes are rejected.
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// peekedConn is a net.Conn whose reads start with previously peeked bytes.
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+func TestPeekClientHelloExtractsSNI(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+
+	go func() {
+		tls.Client(clientSide, &tls.Config{
+			ServerName:         "app.tunnel.example.com",
+			InsecureSkipVerify: true,
+		}).Handshake()
+	}()
+
+	hello, reader, err := peekClientHello(serverSide)
+	if err != nil {
+		t.Fatalf("peekClientHello failed: %v", err)
+	}
+	if hello.ServerName != "app.tunnel.example.com" {
+		t.Fatalf("unexpected server name %q", hello.ServerName)
+	}
+
+	// The replay reader must start with the TLS handshake record we peeked.
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatalf("failed to read replayed bytes: %v", err)
+	}
+	if header[0] != 0x16 {
+		t.Fatalf("expected replay to start with a handshake record, got %#x", header[0])
+	}
+}
+
+func TestPeekClientHelloRejectsNonTLS(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer serverSide.Close()
+
+	go func() {
+		clientSide.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		clientSide.Close()
+	}()
+
+	if _, _, err := peekClientHello(serverSide); err == nil {
+		t.Fatal("expected plain HTTP to be rejected")
+	}
+}
+
+func TestSubdomainForServerName(t *testing.T) {
+	cases := map[string]string{
+		"app.tunnel.example.com":  "app",
+		"APP.Tunnel.Example.com.": "app",
+		"tunnel.example.com":      "",
+		"app.other.com":           "",
+	}
+	for serverName, want := range cases {
+		if got := subdomainForServerName(serverName, "tunnel.example.com"); got != want {
+			t.Errorf("subdomainForServerName(%q) = %q, want %q", serverName, got, want)
+		}
+	}
+}
+
+func TestHTTPProxyAllowsServerNameMapsSNIToSubdomain(t *testing.T) {
+	reg := registry.NewRegistry()
+	if err := reg.Register(&registry.TunnelInfo{ID: "t1", ClientID: "client", Subdomain: "app", Protocol: "http"}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+
+	cases := map[string]bool{
+		"app.tunnel.example.com":     true,
+		"APP.tunnel.example.com":     true,
+		"tunnel.example.com":         true,
+		"unknown.tunnel.example.com": false,
+		"app.other.com":              false,
+		"":                           false,
+	}
+	for serverName, want := range cases {
+		if got := p.AllowsServerName(serverName); got != want {
+			t.Errorf("AllowsServerName(%q) = %v, want %v", serverName, got, want)
+		}
+	}
+}
@@ -1,25 +1,90 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/essajiwa/tunnelab/internal/server/iplimit"
 	"github.com/essajiwa/tunnelab/internal/server/registry"
 )
 
 // TCPProxy forwards raw TCP connections to registered tunnels via yamux streams.
 type TCPProxy struct {
 	registry *registry.Registry
+	buffers  *bufferPool
+	ipLimits *iplimit.Limiter // Caps connections per source IP (nil disables it)
+	quotas   QuotaChecker     // Refuses connections to clients over quota (nil disables it)
+
+	// ConnectionHook, when set, is called on its own goroutine after each
+	// connection bridged to a tunnel closes.
+	ConnectionHook func(*ConnectionInfo)
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	closed    bool
 }
 
 // NewTCPProxy creates a new TCP proxy.
 func NewTCPProxy(reg *registry.Registry) *TCPProxy {
-	return &TCPProxy{registry: reg}
+	return &TCPProxy{
+		registry: reg,
+		buffers:  newBufferPool(defaultCopyBufferSize, false),
+	}
+}
+
+// SetIPLimiter caps the simultaneous TCP and SNI connections from one source
+// IP. Connections past the limit are closed right away.
+//
+// Parameters:
+//   - limiter: Counts connections per IP, typically shared with the HTTP proxy (nil disables the limit)
+func (p *TCPProxy) SetIPLimiter(limiter *iplimit.Limiter) {
+	p.ipLimits = limiter
+}
+
+// SetQuotaChecker makes the proxy close new TCP and SNI connections to
+// tunnels of clients that are over quota. Connections already open are not
+// interrupted.
+//
+// Parameters:
+//   - checker: Reports whether a client is over quota, typically a quota.Enforcer
+func (p *TCPProxy) SetQuotaChecker(checker QuotaChecker) {
+	p.quotas = checker
+}
+
+// overQuota reports whether the client of tunnel has used up its quota.
+func (p *TCPProxy) overQuota(tunnel *registry.TunnelInfo) bool {
+	if p.quotas == nil || !p.quotas.Exceeded(tunnel.ClientID) {
+		return false
+	}
+	log.Printf("TCP proxy: rejected connection to tunnel %s: client %s is over its byte quota", tunnel.Subdomain, tunnel.ClientID)
+	return true
+}
+
+// acquireIP reserves a slot for the source IP of conn and returns a function
+// releasing it, or false if the IP has too many connections open.
+func (p *TCPProxy) acquireIP(conn net.Conn) (func(), bool) {
+	ip := remoteIP(conn.RemoteAddr().String())
+	if !p.ipLimits.Acquire(ip) {
+		log.Printf("TCP proxy: rejected connection from %s: too many connections from this address", ip)
+		return nil, false
+	}
+	return func() { p.ipLimits.Release(ip) }, true
+}
+
+// SetCopyBuffer configures the buffer used to copy connection data.
+//
+// Parameters:
+//   - size: Buffer size in bytes (0 uses the 32KB default)
+//   - pooled: Whether to recycle buffers through a sync.Pool
+func (p *TCPProxy) SetCopyBuffer(size int, pooled bool) {
+	p.buffers = newBufferPool(size, pooled)
 }
 
 // StartTCPServer starts listeners for the provided port range in the format "start-end".
@@ -36,16 +101,22 @@ func (p *TCPProxy) StartTCPServer(portRange string) error {
 }
 
 func (p *TCPProxy) listenOnPort(port int) {
-	addr := fmt.Sprintf(":%d", port)
+	addr := net.JoinHostPort("", strconv.Itoa(port))
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		log.Printf("TCP proxy: failed to listen on %s: %v", addr, err)
 		return
 	}
+	if !p.track(listener) {
+		return
+	}
 	defer listener.Close()
 
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Printf("TCP proxy: accept error on %s: %v", addr, err)
 			continue
@@ -56,37 +127,156 @@ func (p *TCPProxy) listenOnPort(port int) {
 
 func (p *TCPProxy) handleConnection(conn net.Conn, port int) {
 	defer conn.Close()
+	release, ok := p.acquireIP(conn)
+	if !ok {
+		return
+	}
+	defer release()
 
 	tunnel, exists := p.registry.GetByPort(port)
 	if !exists {
 		log.Printf("TCP proxy: no tunnel registered on port %d", port)
 		return
 	}
+	if p.overQuota(tunnel) {
+		return
+	}
+
+	if !tunnel.AcquireConn() {
+		log.Printf("TCP proxy: tunnel %s reached its limit of %d concurrent connections", tunnel.Subdomain, tunnel.MaxStreams)
+		return
+	}
+	defer tunnel.ReleaseConn()
 
-	stream, err := p.registry.OpenStream(tunnel.Subdomain)
+	log.Printf("TCP proxy: forwarding connection on port %d to tunnel %s", port, tunnel.Subdomain)
+	start := time.Now()
+	if bytesIn, bytesOut, ok := bridge(p.registry, p.buffers, conn, tunnel); ok {
+		fireConnectionHook(p.ConnectionHook, tunnel, remoteIP(conn.RemoteAddr().String()), port, bytesIn, bytesOut, start)
+	}
+}
+
+// StartSNIServer starts a shared TLS listener on port that routes each
+// connection to an SNI-routed tunnel by the ClientHello server name. The TLS
+// session itself is passed through untouched to the client's local server.
+func (p *TCPProxy) StartSNIServer(port int, domain string) error {
+	addr := net.JoinHostPort("", strconv.Itoa(port))
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Printf("TCP proxy: failed to open stream for %s: %v", tunnel.Subdomain, err)
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	if !p.track(listener) {
+		return fmt.Errorf("TCP proxy is closed")
+	}
+
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Printf("SNI proxy: accept error on %s: %v", addr, err)
+				continue
+			}
+			go p.handleSNIConnection(conn, domain)
+		}
+	}()
+	return nil
+}
+
+// track records listener so Close can stop it. It closes the listener and
+// returns false if the proxy is already closed.
+func (p *TCPProxy) track(listener net.Listener) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		listener.Close()
+		return false
+	}
+	p.listeners = append(p.listeners, listener)
+	return true
+}
+
+// Close stops every TCP and SNI listener. Connections already being proxied
+// are not interrupted.
+func (p *TCPProxy) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, listener := range p.listeners {
+		listener.Close()
+	}
+	p.listeners = nil
+	return nil
+}
+
+func (p *TCPProxy) handleSNIConnection(conn net.Conn, domain string) {
+	defer conn.Close()
+	release, ok := p.acquireIP(conn)
+	if !ok {
+		return
+	}
+	defer release()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	hello, reader, err := peekClientHello(conn)
+	if err != nil {
+		log.Printf("SNI proxy: failed to read ClientHello from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	subdomain := subdomainForServerName(hello.ServerName, domain)
+	tunnel, exists := p.registry.GetBySubdomain(subdomain)
+	if subdomain == "" || !exists || !tunnel.SNIRouting {
+		log.Printf("SNI proxy: no tunnel for server name %q", hello.ServerName)
+		return
+	}
+	if p.overQuota(tunnel) {
 		return
 	}
+
+	log.Printf("SNI proxy: forwarding %s to tunnel %s", hello.ServerName, tunnel.Subdomain)
+	start := time.Now()
+	if bytesIn, bytesOut, ok := bridge(p.registry, p.buffers, &peekedConn{Conn: conn, reader: reader}, tunnel); ok {
+		fireConnectionHook(p.ConnectionHook, tunnel, remoteIP(conn.RemoteAddr().String()), localPort(conn), bytesIn, bytesOut, start)
+	}
+}
+
+// bridge copies data between a public connection and a new stream to the
+// tunnel until both directions close.
+//
+// Returns:
+//   - bytesIn: Bytes copied from conn to the tunnel
+//   - bytesOut: Bytes copied from the tunnel to conn
+//   - ok: False if no stream to the tunnel could be opened
+func bridge(reg *registry.Registry, buffers *bufferPool, conn net.Conn, tunnel *registry.TunnelInfo) (bytesIn, bytesOut int64, ok bool) {
+	stream, err := openTunnelStream(context.Background(), reg, tunnel)
+	if err != nil {
+		log.Printf("TCP proxy: failed to open stream for %s: %v", tunnel.Subdomain, err)
+		return 0, 0, false
+	}
 	defer stream.Close()
 
-	log.Printf("TCP proxy: forwarding connection on port %d to tunnel %s", port, tunnel.Subdomain)
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
-		io.Copy(stream, conn)
+		bytesIn, _ = buffers.copy(stream, conn)
 		stream.Close()
 	}()
 
 	go func() {
 		defer wg.Done()
-		io.Copy(conn, stream)
+		bytesOut, _ = buffers.copy(conn, stream)
 		conn.Close()
 	}()
 
 	wg.Wait()
+	tunnel.RecordRequest(bytesIn, bytesOut)
+	return bytesIn, bytesOut, true
 }
 
 func parsePortRange(r string) (int, int, error) {
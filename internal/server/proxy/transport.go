@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+// expectContinueTimeout is how long to wait for the origin's interim
+// "100 Continue" before sending a request body anyway (e.g. to HTTP/1.0
+// origins that never send one).
+const expectContinueTimeout = time.Second
+
+// muxConnectWait is how long a stream to a tunnel whose client has not
+// connected its mux session yet is retried before giving up, and
+// muxConnectRetry the pause between attempts. A variable so tests can shorten it.
+var muxConnectWait = 2 * time.Second
+
+const muxConnectRetry = 50 * time.Millisecond
+
+// connectingRetryAfter is the Retry-After (in seconds) sent with the 503 for a
+// tunnel that is still connecting.
+const connectingRetryAfter = "2"
+
+// tunnelKey carries the local tunnel chosen for a request in its context.
+type tunnelKey struct{}
+
+// openTunnelStream opens a stream to tunnel. A tunnel that was just
+// registered gets a short grace period to connect its mux session, so the
+// first requests of a new tunnel do not fail.
+//
+// Returns:
+//   - net.Conn: The stream
+//   - error: Wraps registry.ErrMuxNotReady if the tunnel is still connecting
+func openTunnelStream(ctx context.Context, reg *registry.Registry, tunnel *registry.TunnelInfo) (net.Conn, error) {
+	deadline := time.Now().Add(muxConnectWait)
+	for {
+		stream, err := reg.OpenTunnelStream(tunnel)
+		if !errors.Is(err, registry.ErrMuxNotReady) || time.Now().After(deadline) {
+			return stream, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(muxConnectRetry):
+		}
+	}
+}
+
+// newTunnelTransport returns a transport that sends each request over a new
+// yamux stream to the tunnel chosen for the request, or else the tunnel whose
+// subdomain is the request URL host. Streams are not reused, matching the
+// one-stream-per-request model of the proxy.
+func newTunnelTransport(reg *registry.Registry) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			tunnel, _ := ctx.Value(tunnelKey{}).(*registry.TunnelInfo)
+			if tunnel == nil {
+				subdomain, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					subdomain = addr
+				}
+				var exists bool
+				if tunnel, exists = reg.Pick(subdomain); !exists {
+					return nil, fmt.Errorf("tunnel not found: %s", subdomain)
+				}
+			}
+			return openTunnelStream(ctx, reg, tunnel)
+		},
+		DisableKeepAlives:     true,
+		DisableCompression:    true,
+		ExpectContinueTimeout: expectContinueTimeout,
+	}
+}
+
+// newReverseProxy builds the ReverseProxy that forwards public requests to
+// tunnels. Requests of any protocol version (including HTTP/2) are translated
+// to HTTP/1.1 for the client's local server. Streaming responses (SSE, chunked
+// or unknown length) are flushed to the client as they arrive, and interim 1xx
+// responses such as "100 Continue" are relayed before the request body is
+// streamed.
+func (p *HTTPProxy) newReverseProxy() *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite:        p.rewriteRequest,
+		Transport:      p.retry,
+		BufferPool:     reverseProxyBuffers{p.buffers},
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, errPoolTimeout) {
+				log.Printf("Request for %s exceeded the pool timeout: %v", r.Host, err)
+				http.Error(w, "Tunnel did not respond in time", http.StatusGatewayTimeout)
+				return
+			}
+			if errors.Is(err, registry.ErrMuxNotReady) {
+				log.Printf("Tunnel for %s is still connecting", r.Host)
+				w.Header().Set("Retry-After", connectingRetryAfter)
+				http.Error(w, "Tunnel is connecting, retry shortly", http.StatusServiceUnavailable)
+				return
+			}
+			writeOriginError(w, r, err)
+		},
+	}
+}
+
+// rewriteRequest targets the tunnel for the incoming Host, applies its path
+// prefixes, records the visitor's scheme for rewriteLocations and keeps the
+// forwarding headers computed by setForwardedHeaders, which Rewrite strips.
+func (p *HTTPProxy) rewriteRequest(pr *httputil.ProxyRequest) {
+	pr.Out.URL.Scheme = "http"
+	pr.Out.URL.Host, _ = p.resolveHost(pr.In.Host)
+	pr.Out.Host = pr.In.Host
+	if tunnel, _ := pr.In.Context().Value(tunnelKey{}).(*registry.TunnelInfo); tunnel != nil {
+		rewritePath(pr.Out.URL, tunnel)
+	}
+	pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), publicSchemeKey{}, p.publicScheme(pr.In)))
+	if xff := pr.In.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		pr.Out.Header["X-Forwarded-For"] = xff
+	}
+	// HTTP/1.0 clients cannot receive interim responses, so their Expect
+	// header is not passed on (RFC 9110, section 10.1.1).
+	if !pr.In.ProtoAtLeast(1, 1) {
+		pr.Out.Header.Del("Expect")
+	}
+}
+
+// modifyResponse adjusts tunnel responses before they are copied to the client.
+func (p *HTTPProxy) modifyResponse(resp *http.Response) error {
+	// ReverseProxy only flushes immediately for SSE and unknown-length
+	// bodies; treat "X-Accel-Buffering: no" the same way. The Content-Length
+	// header itself is still sent to the client.
+	if resp.Header.Get("X-Accel-Buffering") == "no" {
+		resp.ContentLength = -1
+	}
+	// Upgraded connections are copied both ways as the raw body, which must stay
+	// an io.ReadWriteCloser.
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.Body != nil && resp.Body != http.NoBody {
+		resp.Body = &originBody{ReadCloser: resp.Body, host: resp.Request.Host}
+	}
+	if tunnel, _ := resp.Request.Context().Value(tunnelKey{}).(*registry.TunnelInfo); tunnel != nil {
+		rewriteLocations(resp, tunnel)
+		rewriteCookies(resp, tunnel)
+	}
+	p.rewriteResponseHeaders(resp)
+	return nil
+}
+
+// reverseProxyBuffers adapts bufferPool to httputil.BufferPool.
+type reverseProxyBuffers struct {
+	buffers *bufferPool
+}
+
+func (b reverseProxyBuffers) Get() []byte {
+	return *b.buffers.get()
+}
+
+func (b reverseProxyBuffers) Put(buf []byte) {
+	b.buffers.put(&buf)
+}
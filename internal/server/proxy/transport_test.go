@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+)
+
+func TestHTTP2RequestIsServed(t *testing.T) {
+	reg := registry.NewRegistry()
+	tunnel := newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 1 {
+			t.Errorf("expected HTTP/1.x at the origin, got %s", r.Proto)
+		}
+		if r.Host != "app.tunnel.example.com" {
+			t.Errorf("expected original Host, got %q", r.Host)
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Origin", "local")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " + string(body)))
+	}))
+
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	server := httptest.NewUnstartedServer(p)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	req, err := http.NewRequest("POST", server.URL+"/items?x=1", io.NopCloser(strings.NewReader("hello")))
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Host = "app.tunnel.example.com"
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected an HTTP/2 response, got %s", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("X-Origin") != "local" {
+		t.Fatalf("unexpected response: %d %v", resp.StatusCode, resp.Header)
+	}
+	if string(body) != "POST /items?x=1 hello" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if got := tunnel.Stats.Requests.Load(); got != 1 {
+		t.Fatalf("expected 1 recorded request, got %d", got)
+	}
+}
+
+func TestConnectingTunnelReturns503(t *testing.T) {
+	defer func(wait time.Duration) { muxConnectWait = wait }(muxConnectWait)
+	muxConnectWait = 100 * time.Millisecond
+
+	reg := registry.NewRegistry()
+	if err := reg.Register(&registry.TunnelInfo{ID: "tunnel-app", ClientID: "client", Subdomain: "app", Protocol: "http"}); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/", nil)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for a connecting tunnel, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != connectingRetryAfter {
+		t.Fatalf("expected Retry-After %s, got %q", connectingRetryAfter, rec.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(rec.Body.String(), "connecting") {
+		t.Fatalf("expected a connecting message, got %q", rec.Body.String())
+	}
+}
+
+func TestRequestWaitsForMuxSession(t *testing.T) {
+	reg := registry.NewRegistry()
+	if err := reg.Register(&registry.TunnelInfo{ID: "tunnel-app", ClientID: "client", Subdomain: "app", Protocol: "http"}); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+	serverSession, clientSession := newTestSessions(t)
+	go http.Serve(clientSession, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("connected"))
+	}))
+	time.AfterFunc(100*time.Millisecond, func() { reg.SetMuxSession("app", serverSession) })
+
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	req := httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/", nil)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "connected" {
+		t.Fatalf("expected the request to reach the tunnel once connected, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestProxyForwardsTrailers(t *testing.T) {
+	reg := registry.NewRegistry()
+	newTestTunnel(t, reg, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A gRPC server announces its status trailers before the body.
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message, Server")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "\x00\x00\x00\x00\x00")
+		w.(http.Flusher).Flush()
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "")
+		w.Header().Set("Server", "origin/1.0")
+		// Trailers not announced in the header.
+		w.Header().Set(http.TrailerPrefix+"X-Checksum", "abc")
+	}))
+	p := NewHTTPProxy(reg, "tunnel.example.com")
+	p.SetResponseHeaders([]string{"Server"}, "")
+	// The hook wraps the response writer, which must keep trailer support.
+	p.RequestHook = func(info *RequestInfo) {}
+
+	tests := map[string]bool{"HTTP/1.1": false, "HTTP/2": true}
+	for name, http2 := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewUnstartedServer(p)
+			server.EnableHTTP2 = http2
+			server.StartTLS()
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodPost, server.URL+"/pkg.Service/Method", strings.NewReader("\x00\x00\x00\x00\x00"))
+			if err != nil {
+				t.Fatalf("failed to build request: %v", err)
+			}
+			req.Host = "app.tunnel.example.com"
+			req.Header.Set("Content-Type", "application/grpc")
+			req.Header.Set("TE", "trailers")
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			if _, err := io.ReadAll(resp.Body); err != nil {
+				t.Fatalf("failed to read body: %v", err)
+			}
+
+			if (resp.ProtoMajor == 2) != http2 {
+				t.Fatalf("unexpected protocol %s", resp.Proto)
+			}
+			if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+				t.Fatalf("expected Grpc-Status trailer 0, got %q (%v)", got, resp.Trailer)
+			}
+			if _, ok := resp.Trailer["Grpc-Message"]; !ok {
+				t.Fatalf("expected an empty Grpc-Message trailer, got %v", resp.Trailer)
+			}
+			if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+				t.Fatalf("expected undeclared trailer X-Checksum, got %q (%v)", got, resp.Trailer)
+			}
+			if got := resp.Trailer.Get("Server"); got != "" {
+				t.Fatalf("expected the stripped Server trailer to be removed, got %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+// Package quota enforces monthly per-client byte quotas.
+//
+// Usage is the sum of bytes sent and received in the connection logs since
+// the start of the current calendar month (UTC), so quotas reset on the 1st.
+// An Enforcer evaluates a client when it creates a tunnel and then
+// periodically, and remembers which clients are over quota so the proxy can
+// refuse their traffic without a database lookup per request.
+package quota
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+)
+
+// UsageSource aggregates per-client usage from the connection logs.
+type UsageSource interface {
+	GetClientUsageContext(ctx context.Context, clientID string, since time.Time) (*database.ClientUsage, error)
+}
+
+// Enforcer tracks which clients have exceeded their monthly byte quota.
+type Enforcer struct {
+	source       UsageSource
+	defaultQuota int64
+
+	mu      sync.RWMutex
+	clients map[string]*clientState
+	now     func() time.Time
+}
+
+// clientState is the last evaluation of a client's quota.
+type clientState struct {
+	limit    int64 // Effective quota in bytes
+	exceeded bool  // Whether this month's usage had reached the limit
+}
+
+// NewEnforcer creates a quota Enforcer.
+//
+// Parameters:
+//   - source: Source of aggregated usage, typically the database repository
+//   - defaultQuota: Monthly quota in bytes for clients without their own (0 means unlimited)
+//
+// Returns:
+//   - *Enforcer: An enforcer that is not tracking any client yet
+func NewEnforcer(source UsageSource, defaultQuota int64) *Enforcer {
+	return &Enforcer{
+		source:       source,
+		defaultQuota: defaultQuota,
+		clients:      make(map[string]*clientState),
+		now:          time.Now,
+	}
+}
+
+// Check evaluates a client's usage for the current month and starts tracking it.
+//
+// Parameters:
+//   - ctx: Context bounding the usage query
+//   - clientID: The client to evaluate
+//   - quota: The client's own quota (0 means the default, negative means unlimited)
+//
+// Returns:
+//   - bool: Whether the client has used up its quota
+//   - error: Error if usage could not be determined
+func (e *Enforcer) Check(ctx context.Context, clientID string, quota int64) (bool, error) {
+	limit := quota
+	if limit == 0 {
+		limit = e.defaultQuota
+	}
+	if limit <= 0 {
+		e.mu.Lock()
+		delete(e.clients, clientID)
+		e.mu.Unlock()
+		return false, nil
+	}
+	return e.evaluate(ctx, clientID, limit)
+}
+
+// Exceeded reports whether a client was over quota at its last evaluation.
+func (e *Enforcer) Exceeded(clientID string) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	state, ok := e.clients[clientID]
+	return ok && state.exceeded
+}
+
+// Refresh re-evaluates every tracked client. A client whose usage cannot be
+// read keeps its previous state.
+//
+// Parameters:
+//   - ctx: Context bounding the usage queries
+func (e *Enforcer) Refresh(ctx context.Context) {
+	e.mu.RLock()
+	limits := make(map[string]int64, len(e.clients))
+	for clientID, state := range e.clients {
+		limits[clientID] = state.limit
+	}
+	e.mu.RUnlock()
+
+	for clientID, limit := range limits {
+		if _, err := e.evaluate(ctx, clientID, limit); err != nil {
+			log.Printf("Failed to evaluate quota of client %s: %v", clientID, err)
+		}
+	}
+}
+
+// Run calls Refresh every interval until done is closed.
+//
+// Parameters:
+//   - interval: Time between evaluations
+//   - done: Closed to stop the loop
+func (e *Enforcer) Run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			e.Refresh(context.Background())
+		}
+	}
+}
+
+func (e *Enforcer) evaluate(ctx context.Context, clientID string, limit int64) (bool, error) {
+	usage, err := e.source.GetClientUsageContext(ctx, clientID, monthStart(e.now()))
+	if err != nil {
+		return false, err
+	}
+	used := usage.BytesSent + usage.BytesReceived
+	exceeded := used >= limit
+
+	e.mu.Lock()
+	previous := e.clients[clientID]
+	e.clients[clientID] = &clientState{limit: limit, exceeded: exceeded}
+	e.mu.Unlock()
+
+	if exceeded && (previous == nil || !previous.exceeded) {
+		log.Printf("Client %s exceeded its monthly quota (%d of %d bytes)", clientID, used, limit)
+	}
+	return exceeded, nil
+}
+
+// monthStart returns the start of the calendar month containing t, in UTC.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
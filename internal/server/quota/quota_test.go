@@ -0,0 +1,95 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+)
+
+// fakeUsage returns fixed per-client byte totals and records the window asked for.
+type fakeUsage struct {
+	bytes map[string]int64
+	since time.Time
+	err   error
+}
+
+func (f *fakeUsage) GetClientUsageContext(ctx context.Context, clientID string, since time.Time) (*database.ClientUsage, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.since = since
+	return &database.ClientUsage{ClientID: clientID, Since: since, BytesSent: f.bytes[clientID]}, nil
+}
+
+func TestCheckUnderAndOverQuota(t *testing.T) {
+	source := &fakeUsage{bytes: map[string]int64{"light": 100, "heavy": 5000}}
+	e := NewEnforcer(source, 1000)
+	e.now = func() time.Time { return time.Date(2026, 3, 17, 8, 30, 0, 0, time.UTC) }
+
+	exceeded, err := e.Check(context.Background(), "light", 0)
+	if err != nil || exceeded {
+		t.Fatalf("expected light client to be under quota, got %v %v", exceeded, err)
+	}
+	if want := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC); !source.since.Equal(want) {
+		t.Fatalf("expected usage since %v, got %v", want, source.since)
+	}
+
+	exceeded, err = e.Check(context.Background(), "heavy", 0)
+	if err != nil || !exceeded {
+		t.Fatalf("expected heavy client to be over quota, got %v %v", exceeded, err)
+	}
+	if !e.Exceeded("heavy") || e.Exceeded("light") || e.Exceeded("unknown") {
+		t.Fatal("Exceeded does not match the last evaluation")
+	}
+
+	// A client's own quota overrides the default; a negative one is unlimited.
+	if exceeded, _ := e.Check(context.Background(), "heavy", 10000); exceeded {
+		t.Fatal("expected per-client quota to override the default")
+	}
+	if exceeded, _ := e.Check(context.Background(), "light", 50); !exceeded {
+		t.Fatal("expected a small per-client quota to be exceeded")
+	}
+	if exceeded, _ := e.Check(context.Background(), "light", -1); exceeded || e.Exceeded("light") {
+		t.Fatal("expected a negative quota to be unlimited")
+	}
+}
+
+func TestCheckWithoutQuotaIsUnlimited(t *testing.T) {
+	e := NewEnforcer(&fakeUsage{bytes: map[string]int64{"client": 1 << 40}}, 0)
+	if exceeded, err := e.Check(context.Background(), "client", 0); err != nil || exceeded {
+		t.Fatalf("expected no quota to mean unlimited, got %v %v", exceeded, err)
+	}
+}
+
+func TestRefreshReevaluatesTrackedClients(t *testing.T) {
+	source := &fakeUsage{bytes: map[string]int64{"client": 100}}
+	e := NewEnforcer(source, 1000)
+
+	if exceeded, _ := e.Check(context.Background(), "client", 0); exceeded {
+		t.Fatal("expected client to start under quota")
+	}
+
+	source.bytes["client"] = 2000
+	e.Refresh(context.Background())
+	if !e.Exceeded("client") {
+		t.Fatal("expected refresh to mark the client over quota")
+	}
+
+	// A failed evaluation keeps the previous state.
+	source.err = errors.New("database is locked")
+	e.Refresh(context.Background())
+	if !e.Exceeded("client") {
+		t.Fatal("expected a failed refresh to keep the client over quota")
+	}
+
+	// Usage of the new month is below the quota again.
+	source.err = nil
+	source.bytes["client"] = 0
+	e.Refresh(context.Background())
+	if e.Exceeded("client") {
+		t.Fatal("expected the quota to reset with the month's usage")
+	}
+}
@@ -0,0 +1,51 @@
+package registry
+
+import "sort"
+
+// ClientActivity describes what a client has open right now.
+type ClientActivity struct {
+	ClientID   string   `json:"client_id"`
+	Tunnels    int      `json:"tunnels"`    // Tunnels registered on this node, pool members included
+	Connected  int      `json:"connected"`  // Tunnels whose mux session is attached
+	Streams    int      `json:"streams"`    // Streams open across the mux sessions of its tunnels
+	Subdomains []string `json:"subdomains"` // Subdomains of its tunnels, sorted
+}
+
+// ClientActivity aggregates the tunnels and open streams of every client with
+// a tunnel on this node.
+//
+// Returns:
+//   - []ClientActivity: One entry per client, sorted by client ID
+func (r *Registry) ClientActivity() []ClientActivity {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	activity := make([]ClientActivity, 0, len(r.clients))
+	for clientID, tunnels := range r.clients {
+		if len(tunnels) == 0 {
+			continue
+		}
+		activity = append(activity, clientActivityLocked(clientID, tunnels))
+	}
+	sort.Slice(activity, func(i, j int) bool { return activity[i].ClientID < activity[j].ClientID })
+	return activity
+}
+
+// clientActivityLocked aggregates tunnels of clientID. Callers hold r.mu.
+func clientActivityLocked(clientID string, tunnels []*TunnelInfo) ClientActivity {
+	a := ClientActivity{ClientID: clientID, Tunnels: len(tunnels), Subdomains: []string{}}
+	seen := make(map[string]bool, len(tunnels))
+	for _, tunnel := range tunnels {
+		if tunnel.MuxSession != nil {
+			a.Connected++
+			a.Streams += tunnel.MuxSession.NumStreams()
+		}
+		// Pool members share their subdomain.
+		if !seen[tunnel.Subdomain] {
+			seen[tunnel.Subdomain] = true
+			a.Subdomains = append(a.Subdomains, tunnel.Subdomain)
+		}
+	}
+	sort.Strings(a.Subdomains)
+	return a
+}
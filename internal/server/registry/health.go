@@ -0,0 +1,207 @@
+package registry
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// PoolHealthCheck configures the active health checks of pool members.
+type PoolHealthCheck struct {
+	Interval           time.Duration // How often each member is probed (0 disables checks)
+	Timeout            time.Duration // Deadline of a single probe (0 means defaultProbeTimeout)
+	Path               string        // Path requested by the probe
+	UnhealthyThreshold int           // Consecutive failed probes before a member leaves rotation
+}
+
+// defaultProbeTimeout bounds a probe when PoolHealthCheck.Timeout is unset.
+const defaultProbeTimeout = 5 * time.Second
+
+// memberHealth is the health check state of a pool member, guarded by the
+// registry mutex.
+type memberHealth struct {
+	failures  int
+	unhealthy bool
+	lastCheck time.Time
+	lastError string
+}
+
+// MemberHealth describes a pool member for operators.
+type MemberHealth struct {
+	LocalHost    string    `json:"local_host"`
+	LocalPort    int       `json:"local_port"`
+	Weight       int       `json:"weight"`
+	Connected    bool      `json:"connected"`  // Whether the mux session is attached
+	Healthy      bool      `json:"healthy"`    // Whether the member is in rotation
+	Failures     int       `json:"failures"`   // Consecutive failed probes
+	Active       int64     `json:"active"`     // Connections in flight
+	LastCheck    time.Time `json:"last_check"` // Zero before the first probe
+	LastError    string    `json:"last_error,omitempty"`
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+// SetPoolHealthCheck configures the probes RunPoolHealthChecks sends.
+//
+// Parameters:
+//   - check: Probe settings; an Interval of zero disables the checks
+func (r *Registry) SetPoolHealthCheck(check PoolHealthCheck) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.healthCheck = check
+}
+
+// PoolHealth returns the health of every tunnel serving subdomain.
+//
+// Parameters:
+//   - subdomain: The subdomain to look up
+//
+// Returns:
+//   - []MemberHealth: One entry per member, or nil if no tunnel is registered
+func (r *Registry) PoolHealth(subdomain string) []MemberHealth {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	members := r.membersLocked(subdomain)
+	if members == nil {
+		return nil
+	}
+	health := make([]MemberHealth, 0, len(members))
+	for _, member := range members {
+		health = append(health, MemberHealth{
+			LocalHost:    member.LocalHost,
+			LocalPort:    member.LocalPort,
+			Weight:       member.weight(),
+			Connected:    member.MuxSession != nil,
+			Healthy:      !member.health.unhealthy,
+			Failures:     member.health.failures,
+			Active:       member.active.Load(),
+			LastCheck:    member.health.lastCheck,
+			LastError:    member.health.lastError,
+			RegisteredAt: member.CreatedAt,
+		})
+	}
+	return health
+}
+
+// RunPoolHealthChecks probes the members of every pool until done is closed.
+// A member whose probes fail UnhealthyThreshold times in a row is left out
+// of rotation until a probe succeeds again. Nothing runs if the checks are
+// disabled.
+//
+// Parameters:
+//   - done: Closed to stop probing
+func (r *Registry) RunPoolHealthChecks(done <-chan struct{}) {
+	r.mu.RLock()
+	interval := r.healthCheck.Interval
+	r.mu.RUnlock()
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			r.CheckPoolHealth()
+		}
+	}
+}
+
+// CheckPoolHealth probes every pool member with a mux session once and
+// updates its health. Members are probed concurrently.
+func (r *Registry) CheckPoolHealth() {
+	r.mu.RLock()
+	check := r.healthCheck
+	var members []*TunnelInfo
+	for _, pool := range r.pools {
+		for _, member := range pool.members {
+			if member.MuxSession != nil {
+				members = append(members, member)
+			}
+		}
+	}
+	r.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, member := range members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.recordProbe(member, check, r.probe(member, check))
+		}()
+	}
+	wg.Wait()
+}
+
+// probe sends an HTTP GET for the check path over a new stream to tunnel.
+// Any response below 500 counts as healthy.
+func (r *Registry) probe(tunnel *TunnelInfo, check PoolHealthCheck) error {
+	stream, err := r.OpenTunnelStream(tunnel)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	timeout := check.Timeout
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	stream.SetDeadline(time.Now().Add(timeout))
+
+	path := check.Path
+	if path == "" {
+		path = "/"
+	}
+	req, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return fmt.Errorf("invalid health check path %q: %w", path, err)
+	}
+	req.Host = tunnel.Subdomain
+	if u, err := url.Parse(tunnel.PublicURL); err == nil && u.Host != "" {
+		req.Host = u.Host
+	}
+	req.Header.Set("User-Agent", "tunnelab-health-check")
+	req.Close = true
+	if err := req.Write(stream); err != nil {
+		return fmt.Errorf("failed to send probe: %w", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+	if err != nil {
+		return fmt.Errorf("failed to read probe response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("probe returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// recordProbe updates the health of tunnel with the result of a probe.
+func (r *Registry) recordProbe(tunnel *TunnelInfo, check PoolHealthCheck, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	health := &tunnel.health
+	health.lastCheck = time.Now()
+	if err == nil {
+		if health.unhealthy {
+			log.Printf("Pool member of %s (%s:%d) is healthy again", tunnel.Subdomain, tunnel.LocalHost, tunnel.LocalPort)
+		}
+		*health = memberHealth{lastCheck: health.lastCheck}
+		return
+	}
+
+	health.failures++
+	health.lastError = err.Error()
+	if !health.unhealthy && health.failures >= max(check.UnhealthyThreshold, 1) {
+		health.unhealthy = true
+		log.Printf("Pool member of %s (%s:%d) removed from rotation: %v", tunnel.Subdomain, tunnel.LocalHost, tunnel.LocalPort, err)
+	}
+}
@@ -0,0 +1,107 @@
+package registry
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hashicorp/yamux"
+)
+
+// attachHTTPSession attaches a mux session to tunnel whose client side serves
+// HTTP, answering 503 while failing is set.
+func attachHTTPSession(t *testing.T, reg *Registry, tunnel *TunnelInfo) *atomic.Bool {
+	t.Helper()
+	serverSide, clientSide := net.Pipe()
+	server, err := yamux.Server(serverSide, nil)
+	if err != nil {
+		t.Fatalf("failed to create server session: %v", err)
+	}
+	client, err := yamux.Client(clientSide, nil)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	var failing atomic.Bool
+	go http.Serve(client, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Host != "app.tunnel.example.com" {
+			http.Error(w, "unexpected probe", http.StatusBadRequest)
+			return
+		}
+		if failing.Load() {
+			http.Error(w, "local service down", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	if err := reg.AttachMuxSession(tunnel, server); err != nil {
+		t.Fatalf("failed to attach session: %v", err)
+	}
+	return &failing
+}
+
+func TestUnhealthyPoolMemberIsEvictedAndRecovers(t *testing.T) {
+	reg := NewRegistry()
+	reg.SetPoolHealthCheck(PoolHealthCheck{Path: "/healthz", UnhealthyThreshold: 2})
+	primary := poolMember(1)
+	member := poolMember(1)
+	for _, tunnel := range []*TunnelInfo{primary, member} {
+		tunnel.PublicURL = "https://app.tunnel.example.com"
+	}
+	if err := reg.Register(primary); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if err := reg.JoinPool(member); err != nil {
+		t.Fatalf("join failed: %v", err)
+	}
+	primaryFailing := attachHTTPSession(t, reg, primary)
+	memberFailing := attachHTTPSession(t, reg, member)
+
+	picks := func() map[*TunnelInfo]int {
+		counts := make(map[*TunnelInfo]int)
+		for i := 0; i < 4; i++ {
+			picked, _ := reg.Pick("app")
+			counts[picked]++
+		}
+		return counts
+	}
+
+	memberFailing.Store(true)
+	reg.CheckPoolHealth()
+	if counts := picks(); counts[member] != 2 {
+		t.Fatalf("expected a single failure to keep the member in rotation, got %d of 4 picks", counts[member])
+	}
+
+	reg.CheckPoolHealth()
+	if counts := picks(); counts[primary] != 4 {
+		t.Fatalf("expected the failing member to be evicted, got %d of 4 picks on the healthy one", counts[primary])
+	}
+	health := reg.PoolHealth("app")
+	if len(health) != 2 || !health[0].Healthy || health[1].Healthy || health[1].Failures != 2 || !strings.Contains(health[1].LastError, "503") {
+		t.Fatalf("expected the member to be reported unhealthy after 2 failures, got %+v", health)
+	}
+
+	// With no healthy member left, requests still go to the pool.
+	primaryFailing.Store(true)
+	reg.CheckPoolHealth()
+	reg.CheckPoolHealth()
+	if counts := picks(); counts[member] != 2 {
+		t.Fatalf("expected unhealthy members to share requests when none is healthy, got %d of 4 picks", counts[member])
+	}
+
+	primaryFailing.Store(false)
+	memberFailing.Store(false)
+	reg.CheckPoolHealth()
+	if counts := picks(); counts[member] != 2 {
+		t.Fatalf("expected the recovered member back in rotation, got %d of 4 picks", counts[member])
+	}
+	if health := reg.PoolHealth("app"); !health[1].Healthy || health[1].Failures != 0 || health[1].LastError != "" || health[1].LastCheck.IsZero() {
+		t.Fatalf("expected the member to be reported healthy, got %+v", health[1])
+	}
+}
@@ -0,0 +1,342 @@
+package registry
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+	"github.com/hashicorp/yamux"
+)
+
+// Balancing strategies of a pool, set with SetPoolBalancing.
+const (
+	// BalanceRoundRobin spreads requests over the members in proportion to
+	// their weights (smooth weighted round-robin).
+	BalanceRoundRobin = "round-robin"
+	// BalanceLeastConnections sends each request to the member with the
+	// fewest connections in flight relative to its weight.
+	BalanceLeastConnections = "least-connections"
+)
+
+// MaxPoolWeight caps the weight of a pool member.
+const MaxPoolWeight = 100
+
+// tunnelPool holds the tunnels serving one pooled subdomain. Every member is
+// a TunnelInfo of its own with its own control connection and mux session;
+// they share the subdomain, ID and client.
+type tunnelPool struct {
+	members []*TunnelInfo
+	current []int // Smooth weighted round-robin state, one entry per member
+}
+
+// weight returns the share of pool requests of the tunnel (at least 1).
+func (t *TunnelInfo) weight() int {
+	return min(max(t.Weight, 1), MaxPoolWeight)
+}
+
+// SetPoolBalancing chooses how requests are spread over the members of a
+// pool. Unknown strategies fall back to BalanceRoundRobin.
+//
+// Parameters:
+//   - strategy: BalanceRoundRobin or BalanceLeastConnections
+func (r *Registry) SetPoolBalancing(strategy string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.poolBalancing = strategy
+}
+
+// JoinPool adds a pooled tunnel to the pool of its subdomain. The subdomain
+// must be held by a pooled tunnel of the same client and protocol, and tunnel
+// must not be registered yet. The store claim of the subdomain is shared by
+// all members.
+//
+// Parameters:
+//   - tunnel: The tunnel to add, with the ID of the tunnel it joins
+//
+// Returns:
+//   - error: Error if there is no pool the tunnel may join, or wrapping
+//     ErrTunnelLimit if the client has ClientLimit tunnels
+func (r *Registry) JoinPool(tunnel *TunnelInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.checkClientLimitLocked(tunnel); err != nil {
+		return err
+	}
+
+	if !r.joinPoolLocked(tunnel) {
+		return fmt.Errorf("no pool to join for subdomain %s", tunnel.Subdomain)
+	}
+	return nil
+}
+
+// joinPoolLocked adds a pooled tunnel to the pool of its subdomain if the
+// subdomain is already held by a pooled tunnel of the same client and
+// protocol.
+//
+// Returns:
+//   - bool: Whether the tunnel joined a pool
+func (r *Registry) joinPoolLocked(tunnel *TunnelInfo) bool {
+	current, exists := r.tunnels[tunnel.Subdomain]
+	if !exists || !tunnel.Pooled || !current.Pooled ||
+		current.ClientID != tunnel.ClientID || current.Protocol != tunnel.Protocol ||
+		tunnel.PublicPort > 0 || r.isRegisteredLocked(tunnel) {
+		return false
+	}
+	pool := r.pools[tunnel.Subdomain]
+	if pool == nil {
+		pool = &tunnelPool{members: []*TunnelInfo{current}, current: []int{0}}
+		r.pools[tunnel.Subdomain] = pool
+	}
+	pool.members = append(pool.members, tunnel)
+	pool.current = append(pool.current, 0)
+
+	if tunnel.CreatedAt.IsZero() {
+		tunnel.CreatedAt = time.Now()
+	}
+	r.clients[tunnel.ClientID] = append(r.clients[tunnel.ClientID], tunnel)
+	return true
+}
+
+// removeFromPoolLocked removes tunnel from the pool of its subdomain and
+// promotes the next member if tunnel was the one returned by GetBySubdomain.
+//
+// Returns:
+//   - bool: Whether other members still serve the subdomain
+func (r *Registry) removeFromPoolLocked(tunnel *TunnelInfo) bool {
+	pool := r.pools[tunnel.Subdomain]
+	if pool == nil {
+		return false
+	}
+	for i, member := range pool.members {
+		if member == tunnel {
+			pool.members = append(pool.members[:i], pool.members[i+1:]...)
+			pool.current = append(pool.current[:i], pool.current[i+1:]...)
+			break
+		}
+	}
+	if len(pool.members) == 0 {
+		delete(r.pools, tunnel.Subdomain)
+		return false
+	}
+	if r.tunnels[tunnel.Subdomain] == tunnel {
+		r.tunnels[tunnel.Subdomain] = pool.members[0]
+	}
+	return true
+}
+
+// isRegisteredLocked reports whether tunnel itself, not just its subdomain,
+// is registered.
+func (r *Registry) isRegisteredLocked(tunnel *TunnelInfo) bool {
+	if r.tunnels[tunnel.Subdomain] == tunnel {
+		return true
+	}
+	if pool := r.pools[tunnel.Subdomain]; pool != nil {
+		for _, member := range pool.members {
+			if member == tunnel {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// membersLocked returns every tunnel registered for subdomain.
+func (r *Registry) membersLocked(subdomain string) []*TunnelInfo {
+	if pool := r.pools[subdomain]; pool != nil {
+		members := make([]*TunnelInfo, len(pool.members))
+		copy(members, pool.members)
+		return members
+	}
+	if tunnel, exists := r.tunnels[subdomain]; exists {
+		return []*TunnelInfo{tunnel}
+	}
+	return nil
+}
+
+// PoolMembers returns the tunnels serving subdomain: every member of its
+// pool, or the tunnel alone if it is not pooled.
+//
+// Parameters:
+//   - subdomain: The subdomain to look up
+//
+// Returns:
+//   - []*TunnelInfo: The tunnels, or nil if none is registered
+func (r *Registry) PoolMembers(subdomain string) []*TunnelInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.membersLocked(subdomain)
+}
+
+// Pick returns the tunnel that should serve the next request for subdomain.
+// For a pool, a member with a mux session is chosen by the balancing
+// strategy, skipping members that failed their health checks unless none
+// is healthy; otherwise it is the tunnel GetBySubdomain returns.
+//
+// Parameters:
+//   - subdomain: The subdomain of the request
+//
+// Returns:
+//   - *TunnelInfo: The chosen tunnel, or nil if not found
+//   - bool: Whether a tunnel was found
+func (r *Registry) Pick(subdomain string) (*TunnelInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tunnel, exists := r.tunnels[subdomain]
+	pool := r.pools[subdomain]
+	if !exists || pool == nil {
+		return tunnel, exists
+	}
+	if picked := pool.pick(r.poolBalancing, true, nil); picked != nil {
+		return picked, true
+	}
+	if picked := pool.pick(r.poolBalancing, false, nil); picked != nil {
+		return picked, true
+	}
+	return tunnel, true
+}
+
+// PickOther returns another member of the pool of subdomain to retry a
+// request on, chosen like Pick among the members not in tried.
+//
+// Parameters:
+//   - subdomain: The subdomain of the request
+//   - tried: Members the request already failed on
+//
+// Returns:
+//   - *TunnelInfo: The chosen member, or nil if not found
+//   - bool: Whether a member that was not tried has a mux session
+func (r *Registry) PickOther(subdomain string, tried []*TunnelInfo) (*TunnelInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pool := r.pools[subdomain]
+	if pool == nil {
+		return nil, false
+	}
+	if picked := pool.pick(r.poolBalancing, true, tried); picked != nil {
+		return picked, true
+	}
+	if picked := pool.pick(r.poolBalancing, false, tried); picked != nil {
+		return picked, true
+	}
+	return nil, false
+}
+
+// pick chooses among the members that have a mux session, are not in
+// exclude, and are healthy if healthyOnly is set, or returns nil if there is
+// no such member.
+func (p *tunnelPool) pick(strategy string, healthyOnly bool, exclude []*TunnelInfo) *TunnelInfo {
+	eligible := func(member *TunnelInfo) bool {
+		return member.MuxSession != nil && !(healthyOnly && member.health.unhealthy) && !slices.Contains(exclude, member)
+	}
+	best := -1
+	if strategy == BalanceLeastConnections {
+		for i, member := range p.members {
+			if !eligible(member) {
+				continue
+			}
+			// active/weight < best.active/best.weight, without division.
+			if best < 0 || member.active.Load()*int64(p.members[best].weight()) < p.members[best].active.Load()*int64(member.weight()) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return nil
+		}
+		return p.members[best]
+	}
+
+	total := 0
+	for i, member := range p.members {
+		if !eligible(member) {
+			continue
+		}
+		p.current[i] += member.weight()
+		total += member.weight()
+		if best < 0 || p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	p.current[best] -= total
+	return p.members[best]
+}
+
+// AttachMuxSession sets the mux session of tunnel, which may be any member
+// of a pool.
+//
+// Parameters:
+//   - tunnel: The registered tunnel
+//   - session: Its mux session
+//
+// Returns:
+//   - error: If tunnel is no longer registered
+func (r *Registry) AttachMuxSession(tunnel *TunnelInfo, session *yamux.Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.isRegisteredLocked(tunnel) {
+		return fmt.Errorf("tunnel not found: %s", tunnel.Subdomain)
+	}
+	tunnel.MuxSession = session
+	return nil
+}
+
+// DetachMuxSession clears the mux session of tunnel after it closed, so
+// requests are answered as for a tunnel that is still connecting until a new
+// session is attached.
+//
+// Parameters:
+//   - tunnel: The registered tunnel
+//   - session: The session that closed
+//
+// Returns:
+//   - bool: false if tunnel is no longer registered or has another session
+func (r *Registry) DetachMuxSession(tunnel *TunnelInfo, session *yamux.Session) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.isRegisteredLocked(tunnel) || tunnel.MuxSession != session {
+		return false
+	}
+	tunnel.MuxSession = nil
+	return true
+}
+
+// OpenTunnelStream opens a stream to tunnel, which may be any member of a pool.
+//
+// Parameters:
+//   - tunnel: The registered tunnel
+//
+// Returns:
+//   - net.Conn: The stream
+//   - error: Wraps ErrMuxNotReady if the client has not connected its mux session yet
+func (r *Registry) OpenTunnelStream(tunnel *TunnelInfo) (net.Conn, error) {
+	r.mu.RLock()
+	registered := r.isRegisteredLocked(tunnel)
+	var session *yamux.Session
+	if registered {
+		// AttachMuxSession may attach the session concurrently.
+		session = tunnel.MuxSession
+	}
+	r.mu.RUnlock()
+
+	if !registered {
+		return nil, fmt.Errorf("tunnel not found: %s", tunnel.Subdomain)
+	}
+	if session == nil {
+		return nil, fmt.Errorf("%w: %s", ErrMuxNotReady, tunnel.Subdomain)
+	}
+
+	stream, err := session.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	return protocol.WrapStream(stream, tunnel.StreamCompression), nil
+}
@@ -0,0 +1,245 @@
+package registry
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// poolMember returns a pooled HTTP tunnel of client for app with the given
+// weight. Members of a pool share the tunnel ID.
+func poolMember(weight int) *TunnelInfo {
+	return &TunnelInfo{ID: "pool", ClientID: "client", Subdomain: "app", Protocol: "http", LocalPort: 3000, Pooled: true, Weight: weight}
+}
+
+// attachCountingSession attaches a mux session to tunnel whose client side
+// accepts streams and counts them.
+func attachCountingSession(t *testing.T, reg *Registry, tunnel *TunnelInfo) *atomic.Int64 {
+	t.Helper()
+	serverSide, clientSide := net.Pipe()
+	server, err := yamux.Server(serverSide, nil)
+	if err != nil {
+		t.Fatalf("failed to create server session: %v", err)
+	}
+	client, err := yamux.Client(clientSide, nil)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	var accepted atomic.Int64
+	go func() {
+		for {
+			stream, err := client.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			stream.Close()
+		}
+	}()
+	if err := reg.AttachMuxSession(tunnel, server); err != nil {
+		t.Fatalf("failed to attach session: %v", err)
+	}
+	return &accepted
+}
+
+func TestPoolRegistration(t *testing.T) {
+	reg := NewRegistry()
+	primary := poolMember(1)
+	if err := reg.Register(primary); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	member := poolMember(1)
+	if err := reg.JoinPool(member); err != nil {
+		t.Fatalf("expected a second connection of the client to join the pool: %v", err)
+	}
+	if err := reg.JoinPool(member); err == nil {
+		t.Fatal("expected a registered member not to join twice")
+	}
+
+	other := poolMember(1)
+	other.ClientID = "other"
+	if err := reg.JoinPool(other); err == nil {
+		t.Fatal("expected another client not to join the pool")
+	}
+	unpooled := poolMember(1)
+	unpooled.Pooled = false
+	if err := reg.JoinPool(unpooled); err == nil {
+		t.Fatal("expected a tunnel that did not ask for a pool not to join it")
+	}
+	if err := reg.Register(poolMember(1)); err == nil {
+		t.Fatal("expected Register to keep rejecting a taken subdomain")
+	}
+
+	if members := reg.PoolMembers("app"); len(members) != 2 || members[0] != primary || members[1] != member {
+		t.Fatalf("expected the primary and the member in the pool, got %v", members)
+	}
+	if got := len(reg.GetByClient("client")); got != 2 {
+		t.Fatalf("expected both members to count as tunnels of the client, got %d", got)
+	}
+	if current, _ := reg.GetBySubdomain("app"); current != primary {
+		t.Fatal("expected GetBySubdomain to keep returning the primary")
+	}
+
+	lone := &TunnelInfo{ID: "lone", ClientID: "client", Subdomain: "lone", Protocol: "http", LocalPort: 3000}
+	if err := reg.Register(lone); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if err := reg.JoinPool(&TunnelInfo{ID: "lone", ClientID: "client", Subdomain: "lone", Protocol: "http", Pooled: true}); err == nil {
+		t.Fatal("expected a tunnel that is not pooled not to accept members")
+	}
+}
+
+func TestPoolDistributesStreamsByWeight(t *testing.T) {
+	reg := NewRegistry()
+	heavy := poolMember(3)
+	light := poolMember(1)
+	connecting := poolMember(5)
+	if err := reg.Register(heavy); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	for _, member := range []*TunnelInfo{light, connecting} {
+		if err := reg.JoinPool(member); err != nil {
+			t.Fatalf("join failed: %v", err)
+		}
+	}
+	heavyStreams := attachCountingSession(t, reg, heavy)
+	lightStreams := attachCountingSession(t, reg, light)
+
+	// The member without a mux session yet gets no streams.
+	for i := 0; i < 8; i++ {
+		stream, err := reg.OpenStream("app")
+		if err != nil {
+			t.Fatalf("failed to open stream %d: %v", i, err)
+		}
+		stream.Close()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for heavyStreams.Load()+lightStreams.Load() < 8 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if heavyStreams.Load() != 6 || lightStreams.Load() != 2 {
+		t.Fatalf("expected streams split 6/2 by weight, got %d/%d", heavyStreams.Load(), lightStreams.Load())
+	}
+}
+
+func TestPoolLeastConnections(t *testing.T) {
+	reg := NewRegistry()
+	reg.SetPoolBalancing(BalanceLeastConnections)
+	first := poolMember(1)
+	second := poolMember(2)
+	if err := reg.Register(first); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if err := reg.JoinPool(second); err != nil {
+		t.Fatalf("join failed: %v", err)
+	}
+	attachCountingSession(t, reg, first)
+	attachCountingSession(t, reg, second)
+
+	// second may hold twice as many connections as first before first is
+	// preferred.
+	var picks []*TunnelInfo
+	for i := 0; i < 3; i++ {
+		picked, _ := reg.Pick("app")
+		picked.AcquireConn()
+		picks = append(picks, picked)
+	}
+	if picks[0] != first || picks[1] != second || picks[2] != second {
+		t.Fatalf("expected weights 1, 2, 2 to be picked, got %d, %d, %d", picks[0].Weight, picks[1].Weight, picks[2].Weight)
+	}
+
+	first.ReleaseConn()
+	if picked, _ := reg.Pick("app"); picked != first {
+		t.Fatal("expected the member whose connection ended to be picked")
+	}
+}
+
+func TestCloseMuxSessionsClosesEveryMember(t *testing.T) {
+	reg := NewRegistry()
+	primary := poolMember(1)
+	member := poolMember(1)
+	if err := reg.Register(primary); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if err := reg.JoinPool(member); err != nil {
+		t.Fatalf("join failed: %v", err)
+	}
+	attachCountingSession(t, reg, primary)
+	attachCountingSession(t, reg, member)
+
+	reg.CloseMuxSessions()
+	for _, tunnel := range []*TunnelInfo{primary, member} {
+		if !tunnel.MuxSession.IsClosed() {
+			t.Fatalf("expected the mux session of %s to be closed", tunnel.ID)
+		}
+	}
+}
+
+func TestPoolMemberRemoval(t *testing.T) {
+	reg := NewRegistry()
+	store := NewMemoryStore()
+	reg.SetStore(store, "10.0.0.1:80", time.Minute)
+	var unregistered []*TunnelInfo
+	reg.UnregisterHook = func(tunnel *TunnelInfo) { unregistered = append(unregistered, tunnel) }
+
+	primary := poolMember(1)
+	member := poolMember(1)
+	if err := reg.Register(primary); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if err := reg.JoinPool(member); err != nil {
+		t.Fatalf("join failed: %v", err)
+	}
+	primaryStreams := attachCountingSession(t, reg, primary)
+	memberStreams := attachCountingSession(t, reg, member)
+
+	if !reg.UnregisterTunnel(primary) {
+		t.Fatal("expected the primary to be unregistered")
+	}
+	if reg.UnregisterTunnel(primary) {
+		t.Fatal("expected a removed member not to be unregistered twice")
+	}
+	if current, exists := reg.GetBySubdomain("app"); !exists || current != member {
+		t.Fatal("expected the remaining member to serve the subdomain")
+	}
+	if owner, err := store.Lookup(context.Background(), "app"); err != nil || owner == nil {
+		t.Fatalf("expected the claim to be kept while a member remains, got %v, %v", owner, err)
+	}
+	if len(unregistered) != 1 || unregistered[0] != primary {
+		t.Fatalf("expected the hook to run for the removed member only, got %v", unregistered)
+	}
+
+	stream, err := reg.OpenStream("app")
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	stream.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for memberStreams.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if memberStreams.Load() != 1 || primaryStreams.Load() != 0 {
+		t.Fatalf("expected the stream on the remaining member, got %d/%d", primaryStreams.Load(), memberStreams.Load())
+	}
+
+	if !reg.UnregisterTunnel(member) {
+		t.Fatal("expected the last member to be unregistered")
+	}
+	if _, exists := reg.GetBySubdomain("app"); exists {
+		t.Fatal("expected the subdomain to be free after its last member left")
+	}
+	if owner, _ := store.Lookup(context.Background(), "app"); owner != nil {
+		t.Fatalf("expected the claim to be released with the last member, got %+v", owner)
+	}
+}
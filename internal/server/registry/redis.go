@@ -0,0 +1,292 @@
+package registry
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// claimScript sets every key to the owner unless one of them is held with a
+// different value of the field named by ARGV[4] ("node" for claims, or
+// "client_id" for takeovers).
+const claimScript = `
+for _, key in ipairs(KEYS) do
+	local current = redis.call('GET', key)
+	if current then
+		local ok, claim = pcall(cjson.decode, current)
+		if not ok or claim[ARGV[4]] ~= ARGV[2] then
+			return 0
+		end
+	end
+end
+for _, key in ipairs(KEYS) do
+	redis.call('SET', key, ARGV[1], 'PX', ARGV[3])
+end
+return 1`
+
+// releaseScript deletes the keys still held by the node.
+const releaseScript = `
+for _, key in ipairs(KEYS) do
+	local current = redis.call('GET', key)
+	if current then
+		local ok, claim = pcall(cjson.decode, current)
+		if ok and claim.node == ARGV[1] then
+			redis.call('DEL', key)
+		end
+	end
+end
+return 1`
+
+// RedisConfig configures a RedisStore.
+type RedisConfig struct {
+	Addr     string        // host:port of the Redis server
+	Password string        // Password for AUTH (empty skips it)
+	DB       int           // Database selected after connecting
+	Prefix   string        // Key prefix (default "tunnelab:")
+	Timeout  time.Duration // Deadline for a command without a context deadline (default 2s)
+}
+
+// RedisStore is a Store backed by Redis, shared by every server instance.
+// It speaks the Redis protocol over a single connection that is re-dialed
+// after a failure.
+type RedisStore struct {
+	cfg RedisConfig
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisError is an error reply from Redis.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// NewRedisStore creates a RedisStore. The connection is opened lazily.
+//
+// Parameters:
+//   - cfg: Redis address, credentials and key prefix
+//
+// Returns:
+//   - *RedisStore: The store
+func NewRedisStore(cfg RedisConfig) *RedisStore {
+	if cfg.Prefix == "" {
+		cfg.Prefix = "tunnelab:"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	return &RedisStore{cfg: cfg}
+}
+
+func (s *RedisStore) Claim(ctx context.Context, owner Owner, ttl time.Duration) error {
+	return s.claim(ctx, owner, ttl, "node", owner.Node)
+}
+
+func (s *RedisStore) Takeover(ctx context.Context, owner Owner, ttl time.Duration) error {
+	return s.claim(ctx, owner, ttl, "client_id", owner.ClientID)
+}
+
+// claim runs claimScript, replacing only claims whose field equals value.
+func (s *RedisStore) claim(ctx context.Context, owner Owner, ttl time.Duration, field, value string) error {
+	record, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	keys := s.keys(owner)
+	args := []string{"EVAL", claimScript, strconv.Itoa(len(keys))}
+	args = append(args, keys...)
+	args = append(args, string(record), value, strconv.FormatInt(ttl.Milliseconds(), 10), field)
+
+	reply, err := s.do(ctx, args...)
+	if err != nil {
+		return err
+	}
+	if reply != int64(1) {
+		return ErrClaimed
+	}
+	return nil
+}
+
+func (s *RedisStore) Release(ctx context.Context, owner Owner) error {
+	keys := s.keys(owner)
+	args := []string{"EVAL", releaseScript, strconv.Itoa(len(keys))}
+	args = append(args, keys...)
+	args = append(args, owner.Node)
+	_, err := s.do(ctx, args...)
+	return err
+}
+
+func (s *RedisStore) Lookup(ctx context.Context, subdomain string) (*Owner, error) {
+	return s.get(ctx, s.cfg.Prefix+"subdomain:"+subdomain)
+}
+
+func (s *RedisStore) LookupPort(ctx context.Context, port int) (*Owner, error) {
+	return s.get(ctx, s.cfg.Prefix+"port:"+strconv.Itoa(port))
+}
+
+// Close closes the connection to Redis.
+func (s *RedisStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *RedisStore) keys(owner Owner) []string {
+	keys := []string{s.cfg.Prefix + "subdomain:" + owner.Subdomain}
+	if owner.Port > 0 {
+		keys = append(keys, s.cfg.Prefix+"port:"+strconv.Itoa(owner.Port))
+	}
+	return keys
+}
+
+func (s *RedisStore) get(ctx context.Context, key string) (*Owner, error) {
+	reply, err := s.do(ctx, "GET", key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected GET reply %v", reply)
+	}
+	var owner Owner
+	if err := json.Unmarshal([]byte(value), &owner); err != nil {
+		return nil, fmt.Errorf("invalid owner record for %s: %w", key, err)
+	}
+	return &owner, nil
+}
+
+// do sends a command and reads its reply, reconnecting first if needed.
+func (s *RedisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := s.roundTrip(ctx, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection may be out of sync with the protocol; start over.
+		s.conn.Close()
+		s.conn = nil
+	}
+	return reply, err
+}
+
+func (s *RedisStore) connect(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: s.cfg.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+
+	if s.cfg.Password != "" {
+		if _, err := s.roundTrip(ctx, "AUTH", s.cfg.Password); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return fmt.Errorf("redis authentication failed: %w", err)
+		}
+	}
+	if s.cfg.DB != 0 {
+		if _, err := s.roundTrip(ctx, "SELECT", strconv.Itoa(s.cfg.DB)); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return fmt.Errorf("failed to select redis database: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *RedisStore) roundTrip(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(s.cfg.Timeout)
+	}
+	s.conn.SetDeadline(deadline)
+
+	if _, err := s.conn.Write(encodeCommand(args)); err != nil {
+		return nil, err
+	}
+	return readReply(s.reader)
+}
+
+// encodeCommand encodes a command as a RESP array of bulk strings.
+func encodeCommand(args []string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return []byte(b.String())
+}
+
+// readReply reads one RESP reply: a string for simple and bulk strings, nil
+// for a null bulk string or array, int64 for integers, []interface{} for
+// arrays and redisError for errors.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
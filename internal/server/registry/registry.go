@@ -3,6 +3,11 @@
 // This package manages active tunnels, their connections, and multiplexed sessions.
 // It provides thread-safe operations for registering, unregistering, and accessing tunnels.
 //
+// Live tunnels always stay in the memory of the node that holds their control
+// connection. With a Store set, the registry also records which node owns
+// each tunnel, so several server instances can run behind a load balancer
+// and forward requests for tunnels they do not hold to the owning node.
+//
 // Usage:
 //
 //	reg := NewRegistry()
@@ -18,36 +23,141 @@
 package registry
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/hashicorp/yamux"
 )
 
+// recentTunnelWindow is how long an unregistered subdomain is still reported by HasTunnel.
+const recentTunnelWindow = time.Hour
+
+// storeTimeout bounds each call to the shared ownership store.
+const storeTimeout = 2 * time.Second
+
+// ErrMuxNotReady is returned by OpenStream for a registered tunnel whose
+// client has not connected its mux session yet.
+var ErrMuxNotReady = errors.New("mux session not established for tunnel")
+
+// ErrTunnelLimit is returned when registering a tunnel would exceed the
+// ClientLimit of its client.
+var ErrTunnelLimit = errors.New("client tunnel limit reached")
+
 // Registry manages active tunnels and their connections.
 type Registry struct {
 	mu      sync.RWMutex             // Mutex for thread-safe operations
 	tunnels map[string]*TunnelInfo   // Map of subdomain to tunnel info
 	clients map[string][]*TunnelInfo // Map of client ID to tunnel info
 	ports   map[int]*TunnelInfo      // Map of public port to tunnel info
+	recent  map[string]time.Time     // Map of recently unregistered subdomain to removal time
+	pools   map[string]*tunnelPool   // Map of pooled subdomain to its members
+
+	poolBalancing string          // How requests are spread over pool members
+	healthCheck   PoolHealthCheck // Probes of pool members
+
+	// store shares tunnel ownership with other nodes (nil when running alone).
+	store        Store
+	node         string        // Address peers use to reach this node
+	ownershipTTL time.Duration // Lifetime of an ownership claim unless renewed
+
+	// UnregisterHook, when set, is called after a tunnel has been unregistered
+	// or replaced by Takeover. Set it before registering tunnels.
+	UnregisterHook func(*TunnelInfo)
+}
+
+// ControlConn is the client control connection used to send messages to the
+// owner of a tunnel. Implementations must be safe for concurrent use.
+type ControlConn interface {
+	WriteJSON(v interface{}) error
 }
 
 // TunnelInfo contains information about an active tunnel.
 type TunnelInfo struct {
-	ID           string          // Unique tunnel identifier
-	ClientID     string          // ID of the owning client
-	Subdomain    string          // Subdomain for public access
-	Protocol     string          // Protocol type (http, tcp, etc.)
-	LocalPort    int             // Local port to forward traffic to
-	LocalHost    string          // Local host for tunneling
-	PublicURL    string          // Public URL for the tunnel
-	PublicPort   int             // Public port for the tunnel
-	GRPCServices []string        // Allowed gRPC services
-	MaxStreams   int             // Max concurrent gRPC streams
-	ControlConn  *websocket.Conn // WebSocket connection
-	MuxSession   *yamux.Session  // Yamux multiplexed session
+	ID           string         // Unique tunnel identifier
+	ClientID     string         // ID of the owning client
+	Subdomain    string         // Subdomain for public access
+	Protocol     string         // Protocol type (http, tcp, etc.)
+	LocalPort    int            // Local port to forward traffic to
+	LocalHost    string         // Local host for tunneling
+	LocalScheme  string         // How the client reaches the local app ("http" or "https")
+	PublicURL    string         // Public URL for the tunnel
+	PublicPort   int            // Public port for the tunnel
+	GRPCServices []string       // Allowed gRPC services
+	MaxStreams   int            // Max concurrent gRPC connections (0 means unlimited)
+	Compression  string         // Negotiated gRPC compression ("identity" or "gzip")
+	SNIRouting   bool           // Routed by TLS server name on the shared SNI port
+	ControlConn  ControlConn    // Control connection of the owning client
+	MuxSession   *yamux.Session // Yamux multiplexed session
+	CreatedAt    time.Time      // Registration timestamp
+	ExpiresAt    time.Time      // When the tunnel is closed automatically (zero means never)
+	ClientLimit  int            // Maximum tunnels of the client, checked on registration (0 means unlimited)
+	Stats        TunnelStats    // Live traffic counters
+
+	// StreamCompression is the negotiated data stream compression ("" means none).
+	StreamCompression string
+	// Pooled lets other connections of the same client join the tunnel's
+	// subdomain, sharing its requests in a pool.
+	Pooled bool
+	// Weight is the tunnel's share of the requests of its pool (0 means 1).
+	Weight int
+	// StripPathPrefix is removed from, and AddPathPrefix then prepended to,
+	// the path of HTTP requests before they are forwarded (e.g. "/api").
+	StripPathPrefix string
+	AddPathPrefix   string
+	// PreserveLocation forwards Location headers that point at the local
+	// app unchanged instead of rewriting them to the public URL.
+	PreserveLocation bool
+	// RewriteCookies points the Set-Cookie Domain of the local app at the
+	// public host and marks cookies Secure when served over HTTPS.
+	RewriteCookies bool
+	// GRPCWeb serves a gRPC tunnel on its subdomain to gRPC-Web clients,
+	// translating their calls to native gRPC for the local server.
+	GRPCWeb bool
+
+	active atomic.Int64 // Connections currently being proxied
+	health memberHealth // Pool health check state, guarded by the registry mutex
+}
+
+// TunnelStats holds live traffic counters for a tunnel.
+type TunnelStats struct {
+	BytesIn  atomic.Int64 // Bytes received from public clients
+	BytesOut atomic.Int64 // Bytes sent to public clients
+	Requests atomic.Int64 // HTTP requests or TCP connections served
+}
+
+// RecordRequest adds a served request or connection to the tunnel counters.
+//
+// Parameters:
+//   - bytesIn: Bytes received from the public client
+//   - bytesOut: Bytes sent to the public client
+func (t *TunnelInfo) RecordRequest(bytesIn, bytesOut int64) {
+	t.Stats.Requests.Add(1)
+	t.Stats.BytesIn.Add(bytesIn)
+	t.Stats.BytesOut.Add(bytesOut)
+}
+
+// AcquireConn reserves a slot for a new proxied connection, honoring
+// MaxStreams. Every successful call must be paired with ReleaseConn.
+//
+// Returns:
+//   - bool: Whether the connection may proceed
+func (t *TunnelInfo) AcquireConn() bool {
+	if t.active.Add(1) > int64(t.MaxStreams) && t.MaxStreams > 0 {
+		t.active.Add(-1)
+		return false
+	}
+	return true
+}
+
+// ReleaseConn frees a slot reserved by AcquireConn.
+func (t *TunnelInfo) ReleaseConn() {
+	t.active.Add(-1)
 }
 
 // NewRegistry creates a new Registry instance.
@@ -59,20 +169,154 @@ func NewRegistry() *Registry {
 		tunnels: make(map[string]*TunnelInfo),
 		clients: make(map[string][]*TunnelInfo),
 		ports:   make(map[int]*TunnelInfo),
+		recent:  make(map[string]time.Time),
+		pools:   make(map[string]*tunnelPool),
 	}
 }
 
+// SetStore shares tunnel ownership with other server instances. Call it
+// before registering tunnels, and run RunOwnershipRefresh to keep claims alive.
+//
+// Parameters:
+//   - store: The shared ownership store
+//   - node: Address where peers reach this node's HTTP proxy, e.g. "10.0.0.5:80"
+//   - ttl: Lifetime of a claim; claims of a node that stops renewing them expire
+func (r *Registry) SetStore(store Store, node string, ttl time.Duration) {
+	r.store = store
+	r.node = node
+	r.ownershipTTL = ttl
+}
+
 // Register registers a new tunnel in the registry.
 //
 // Parameters:
 //   - tunnel: The tunnel information to register
 //
 // Returns:
-//   - error: Error if the subdomain is already in use
+//   - error: Error if the subdomain is already in use, wrapping ErrClaimed if
+//     another node owns it, or wrapping ErrTunnelLimit if the client has
+//     ClientLimit tunnels
 func (r *Registry) Register(tunnel *TunnelInfo) error {
+	if err := r.checkAvailable(tunnel); err != nil {
+		return err
+	}
+	if r.store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		err := r.store.Claim(ctx, r.ownerOf(tunnel), r.ownershipTTL)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to claim subdomain %s: %w", tunnel.Subdomain, err)
+		}
+	}
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if err := r.checkAvailableLocked(tunnel); err != nil {
+		return err
+	}
+	if tunnel.PublicPort > 0 {
+		r.ports[tunnel.PublicPort] = tunnel
+	}
+
+	if tunnel.CreatedAt.IsZero() {
+		tunnel.CreatedAt = time.Now()
+	}
+	r.tunnels[tunnel.Subdomain] = tunnel
+	r.clients[tunnel.ClientID] = append(r.clients[tunnel.ClientID], tunnel)
+
+	return nil
+}
+
+// Takeover registers tunnel in place of an existing tunnel of the same client
+// with the same subdomain, on this node or, with a Store, on another node.
+// It is used when a client reconnects before its old control connection has
+// gone away. The replaced local tunnel's mux session is closed and the
+// UnregisterHook runs for it.
+//
+// Parameters:
+//   - tunnel: The tunnel information to register
+//
+// Returns:
+//   - *TunnelInfo: The replaced local tunnel, or nil if there was none
+//   - error: Error if another client holds the subdomain or port, wrapping
+//     ErrClaimed if it is held on another node, or wrapping ErrTunnelLimit if
+//     nothing is replaced and the client has ClientLimit tunnels
+func (r *Registry) Takeover(tunnel *TunnelInfo) (*TunnelInfo, error) {
+	r.mu.RLock()
+	err := r.checkTakeoverLocked(tunnel)
+	r.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if r.store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		err := r.store.Takeover(ctx, r.ownerOf(tunnel), r.ownershipTTL)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to take over subdomain %s: %w", tunnel.Subdomain, err)
+		}
+	}
+
+	r.mu.Lock()
+	if err := r.checkTakeoverLocked(tunnel); err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+	old, exists := r.tunnels[tunnel.Subdomain]
+	if exists {
+		r.removeLocked(old)
+	}
+	if tunnel.PublicPort > 0 {
+		r.ports[tunnel.PublicPort] = tunnel
+	}
+	if tunnel.CreatedAt.IsZero() {
+		tunnel.CreatedAt = time.Now()
+	}
+	r.tunnels[tunnel.Subdomain] = tunnel
+	r.clients[tunnel.ClientID] = append(r.clients[tunnel.ClientID], tunnel)
+	r.mu.Unlock()
+
+	if !exists {
+		return nil, nil
+	}
+	if old.MuxSession != nil {
+		old.MuxSession.Close()
+	}
+	if r.UnregisterHook != nil {
+		r.UnregisterHook(old)
+	}
+	return old, nil
+}
+
+// checkTakeoverLocked reports whether tunnel may replace the tunnels holding
+// its subdomain and port, which must belong to the same client.
+func (r *Registry) checkTakeoverLocked(tunnel *TunnelInfo) error {
+	if current, exists := r.tunnels[tunnel.Subdomain]; exists && current.ClientID != tunnel.ClientID {
+		return fmt.Errorf("subdomain %s is already in use", tunnel.Subdomain)
+	}
+	if current, exists := r.tunnels[tunnel.Subdomain]; exists && current.Pooled {
+		return fmt.Errorf("subdomain %s is served by a pool", tunnel.Subdomain)
+	}
+	if tunnel.PublicPort > 0 {
+		if current, exists := r.ports[tunnel.PublicPort]; exists && (current.ClientID != tunnel.ClientID || current.Subdomain != tunnel.Subdomain) {
+			return fmt.Errorf("port %d is already in use", tunnel.PublicPort)
+		}
+	}
+	if _, exists := r.tunnels[tunnel.Subdomain]; !exists {
+		return r.checkClientLimitLocked(tunnel)
+	}
+	return nil
+}
+
+// checkAvailable reports whether the tunnel's subdomain and port are free on this node.
+func (r *Registry) checkAvailable(tunnel *TunnelInfo) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.checkAvailableLocked(tunnel)
+}
+
+func (r *Registry) checkAvailableLocked(tunnel *TunnelInfo) error {
 	if _, exists := r.tunnels[tunnel.Subdomain]; exists {
 		return fmt.Errorf("subdomain %s is already in use", tunnel.Subdomain)
 	}
@@ -80,39 +324,193 @@ func (r *Registry) Register(tunnel *TunnelInfo) error {
 		if _, exists := r.ports[tunnel.PublicPort]; exists {
 			return fmt.Errorf("port %d is already in use", tunnel.PublicPort)
 		}
-		r.ports[tunnel.PublicPort] = tunnel
 	}
+	return r.checkClientLimitLocked(tunnel)
+}
 
-	r.tunnels[tunnel.Subdomain] = tunnel
-	r.clients[tunnel.ClientID] = append(r.clients[tunnel.ClientID], tunnel)
-
+// checkClientLimitLocked reports whether the client of tunnel may register
+// another tunnel. It runs under the write lock of the registration, so
+// concurrent requests cannot both take the last slot.
+func (r *Registry) checkClientLimitLocked(tunnel *TunnelInfo) error {
+	if tunnel.ClientLimit > 0 && len(r.clients[tunnel.ClientID]) >= tunnel.ClientLimit {
+		return fmt.Errorf("client %s has %d tunnels: %w", tunnel.ClientID, tunnel.ClientLimit, ErrTunnelLimit)
+	}
 	return nil
 }
 
-// Unregister removes a tunnel from the registry by subdomain.
+// ownerOf describes this node's ownership of tunnel for the store.
+func (r *Registry) ownerOf(tunnel *TunnelInfo) Owner {
+	return Owner{
+		Subdomain: tunnel.Subdomain,
+		TunnelID:  tunnel.ID,
+		ClientID:  tunnel.ClientID,
+		Port:      tunnel.PublicPort,
+		Node:      r.node,
+	}
+}
+
+// Unregister removes a tunnel from the registry by subdomain, or every
+// member of its pool.
 //
 // Parameters:
 //   - subdomain: The subdomain of the tunnel to remove
 func (r *Registry) Unregister(subdomain string) {
+	r.unregister(subdomain, nil)
+}
+
+// UnregisterTunnel removes tunnel only if it is still registered, so a stale
+// reference cannot remove a newer tunnel that reused the subdomain. Other
+// members of its pool keep serving the subdomain.
+//
+// Parameters:
+//   - tunnel: The tunnel to remove
+//
+// Returns:
+//   - bool: Whether the tunnel was registered and has been removed
+func (r *Registry) UnregisterTunnel(tunnel *TunnelInfo) bool {
+	return r.unregister(tunnel.Subdomain, tunnel)
+}
+
+func (r *Registry) unregister(subdomain string, match *TunnelInfo) bool {
 	r.mu.Lock()
-	tunnel, exists := r.tunnels[subdomain]
-	if exists {
-		delete(r.tunnels, subdomain)
-		if tunnel.PublicPort > 0 {
-			delete(r.ports, tunnel.PublicPort)
-		}
-		clientTunnels := r.clients[tunnel.ClientID]
-		for i, t := range clientTunnels {
-			if t.Subdomain == subdomain {
-				r.clients[tunnel.ClientID] = append(clientTunnels[:i], clientTunnels[i+1:]...)
-				break
+	var removed []*TunnelInfo
+	if match == nil {
+		removed = r.membersLocked(subdomain)
+	} else if r.isRegisteredLocked(match) {
+		removed = []*TunnelInfo{match}
+	}
+	for _, tunnel := range removed {
+		r.removeLocked(tunnel)
+	}
+	_, served := r.tunnels[subdomain]
+	if len(removed) > 0 && !served {
+		now := time.Now()
+		for name, removedAt := range r.recent {
+			if now.Sub(removedAt) > recentTunnelWindow {
+				delete(r.recent, name)
 			}
 		}
+		r.recent[subdomain] = now
 	}
 	r.mu.Unlock()
 
-	if exists && tunnel.MuxSession != nil {
-		tunnel.MuxSession.Close()
+	for _, tunnel := range removed {
+		if tunnel.MuxSession != nil {
+			tunnel.MuxSession.Close()
+		}
+	}
+	if len(removed) > 0 && !served && r.store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		if err := r.store.Release(ctx, r.ownerOf(removed[0])); err != nil {
+			log.Printf("Failed to release ownership of %s: %v", subdomain, err)
+		}
+		cancel()
+	}
+	if r.UnregisterHook != nil {
+		for _, tunnel := range removed {
+			r.UnregisterHook(tunnel)
+		}
+	}
+	return len(removed) > 0
+}
+
+// removeLocked deletes tunnel from the subdomain, pool, port and client indexes.
+func (r *Registry) removeLocked(tunnel *TunnelInfo) {
+	if !r.removeFromPoolLocked(tunnel) {
+		delete(r.tunnels, tunnel.Subdomain)
+	}
+	if tunnel.PublicPort > 0 && r.ports[tunnel.PublicPort] == tunnel {
+		delete(r.ports, tunnel.PublicPort)
+	}
+	clientTunnels := r.clients[tunnel.ClientID]
+	for i, t := range clientTunnels {
+		if t == tunnel {
+			r.clients[tunnel.ClientID] = append(clientTunnels[:i], clientTunnels[i+1:]...)
+			break
+		}
+	}
+}
+
+// RemoteOwner returns the node that owns subdomain when the tunnel is held
+// by another node.
+//
+// Parameters:
+//   - subdomain: The subdomain to look up
+//
+// Returns:
+//   - *Owner: The owner of the tunnel, or nil
+//   - bool: Whether another node owns the tunnel
+func (r *Registry) RemoteOwner(subdomain string) (*Owner, bool) {
+	if r.store == nil {
+		return nil, false
+	}
+	if _, local := r.GetBySubdomain(subdomain); local {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	owner, err := r.store.Lookup(ctx, subdomain)
+	if err != nil {
+		log.Printf("Failed to look up owner of %s: %v", subdomain, err)
+		return nil, false
+	}
+	if owner == nil || owner.Node == r.node {
+		return nil, false
+	}
+	return owner, true
+}
+
+// RefreshOwnership renews the store claims of every local tunnel. Tunnels
+// whose client has since taken them over on another node are unregistered.
+//
+// Parameters:
+//   - ctx: Context bounding the store calls
+func (r *Registry) RefreshOwnership(ctx context.Context) {
+	if r.store == nil {
+		return
+	}
+	r.mu.RLock()
+	tunnels := make([]*TunnelInfo, 0, len(r.tunnels))
+	for _, tunnel := range r.tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+	r.mu.RUnlock()
+
+	for _, tunnel := range tunnels {
+		err := r.store.Claim(ctx, r.ownerOf(tunnel), r.ownershipTTL)
+		if errors.Is(err, ErrClaimed) {
+			log.Printf("Tunnel %s was taken over by another node; closing the stale session", tunnel.Subdomain)
+			r.UnregisterTunnel(tunnel)
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to renew ownership of %s: %v", tunnel.Subdomain, err)
+		}
+	}
+}
+
+// RunOwnershipRefresh renews ownership claims three times per TTL until done
+// is closed.
+//
+// Parameters:
+//   - done: Closed to stop renewing
+func (r *Registry) RunOwnershipRefresh(done <-chan struct{}) {
+	if r.store == nil {
+		return
+	}
+	ticker := time.NewTicker(r.ownershipTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+			r.RefreshOwnership(ctx)
+			cancel()
+		}
 	}
 }
 
@@ -132,11 +530,29 @@ func (r *Registry) GetBySubdomain(subdomain string) (*TunnelInfo, bool) {
 	return tunnel, exists
 }
 
+// HasTunnel reports whether the subdomain has an active tunnel, on this or
+// another node, or had one here within the last hour (so certificates for
+// reconnecting clients stay valid).
+func (r *Registry) HasTunnel(subdomain string) bool {
+	r.mu.RLock()
+	_, exists := r.tunnels[subdomain]
+	removedAt, recent := r.recent[subdomain]
+	r.mu.RUnlock()
+
+	if exists || (recent && time.Since(removedAt) <= recentTunnelWindow) {
+		return true
+	}
+	_, remote := r.RemoteOwner(subdomain)
+	return remote
+}
+
 func (r *Registry) GetByClient(clientID string) []*TunnelInfo {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	return r.clients[clientID]
+	tunnels := make([]*TunnelInfo, len(r.clients[clientID]))
+	copy(tunnels, r.clients[clientID])
+	return tunnels
 }
 
 func (r *Registry) Count() int {
@@ -159,25 +575,55 @@ func (r *Registry) SetMuxSession(subdomain string, session *yamux.Session) error
 	return nil
 }
 
-func (r *Registry) OpenStream(subdomain string) (net.Conn, error) {
+// CloseMuxSessions closes the mux session of every tunnel, ending their
+// streams. The server calls it on shutdown, since the mux connections and the
+// proxied connections bridged to their streams are not tracked by the HTTP
+// servers.
+func (r *Registry) CloseMuxSessions() {
 	r.mu.RLock()
-	tunnel, exists := r.tunnels[subdomain]
+	var sessions []*yamux.Session
+	for _, tunnels := range r.clients {
+		for _, tunnel := range tunnels {
+			if tunnel.MuxSession != nil {
+				sessions = append(sessions, tunnel.MuxSession)
+			}
+		}
+	}
 	r.mu.RUnlock()
 
-	if !exists {
-		return nil, fmt.Errorf("tunnel not found: %s", subdomain)
+	for _, session := range sessions {
+		session.Close()
 	}
+}
 
-	if tunnel.MuxSession == nil {
-		return nil, fmt.Errorf("mux session not established for tunnel: %s", subdomain)
-	}
+// IsConnected reports whether the mux session of tunnel is attached.
+//
+// Parameters:
+//   - tunnel: The tunnel to check
+//
+// Returns:
+//   - bool: Whether the client has connected the tunnel's data session
+func (r *Registry) IsConnected(tunnel *TunnelInfo) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return tunnel.MuxSession != nil
+}
 
-	stream, err := tunnel.MuxSession.Open()
-	if err != nil {
-		return nil, fmt.Errorf("failed to open stream: %w", err)
+// OpenStream opens a stream to the tunnel for subdomain, or to the member of
+// its pool that Pick chooses.
+//
+// Parameters:
+//   - subdomain: The subdomain of the tunnel
+//
+// Returns:
+//   - net.Conn: The stream
+//   - error: Wraps ErrMuxNotReady if the client has not connected its mux session yet
+func (r *Registry) OpenStream(subdomain string) (net.Conn, error) {
+	tunnel, exists := r.Pick(subdomain)
+	if !exists {
+		return nil, fmt.Errorf("tunnel not found: %s", subdomain)
 	}
-
-	return stream, nil
+	return r.OpenTunnelStream(tunnel)
 }
 
 // GetByPort retrieves tunnel info by public port.
@@ -1,6 +1,17 @@
 package registry
 
-import "testing"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+	"github.com/hashicorp/yamux"
+)
 
 func TestRegistryGetByPortLifecycle(t *testing.T) {
 	reg := NewRegistry()
@@ -45,3 +56,238 @@ func TestRegistryRejectsDuplicatePorts(t *testing.T) {
 		t.Fatal("expected duplicate port registration to fail")
 	}
 }
+
+func TestRegistryTakeoverRunsUnregisterHook(t *testing.T) {
+	reg := NewRegistry()
+	var unregistered []*TunnelInfo
+	reg.UnregisterHook = func(tunnel *TunnelInfo) { unregistered = append(unregistered, tunnel) }
+
+	old := &TunnelInfo{ID: "old", ClientID: "client", Subdomain: "demo", Protocol: "tcp", PublicPort: 31001}
+	if err := reg.Register(old); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	replacement := &TunnelInfo{ID: "new", ClientID: "client", Subdomain: "demo", Protocol: "tcp", PublicPort: 31002}
+	replaced, err := reg.Takeover(replacement)
+	if err != nil || replaced != old {
+		t.Fatalf("expected the old tunnel to be replaced, got %v, %v", replaced, err)
+	}
+	if len(unregistered) != 1 || unregistered[0] != old {
+		t.Fatalf("expected the hook to run for the replaced tunnel, got %v", unregistered)
+	}
+	if _, ok := reg.GetByPort(31001); ok {
+		t.Fatal("expected the port of the replaced tunnel to be free")
+	}
+
+	if _, err := reg.Takeover(&TunnelInfo{ID: "first", ClientID: "client", Subdomain: "fresh"}); err != nil {
+		t.Fatalf("takeover of a free subdomain failed: %v", err)
+	}
+	if len(unregistered) != 1 {
+		t.Fatalf("expected no hook call when nothing is replaced, got %d", len(unregistered))
+	}
+}
+
+func TestRegistryEnforcesClientLimitAtomically(t *testing.T) {
+	reg := NewRegistry()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	registered, limited := 0, 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := reg.Register(&TunnelInfo{ID: fmt.Sprint(i), ClientID: "client", Subdomain: fmt.Sprintf("app%d", i), ClientLimit: 3})
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				registered++
+			case errors.Is(err, ErrTunnelLimit):
+				limited++
+			default:
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if registered != 3 || limited != 7 {
+		t.Fatalf("expected 3 registered and 7 limited, got %d and %d", registered, limited)
+	}
+
+	// Replacing a tunnel of the client does not count against the limit.
+	if _, err := reg.Takeover(&TunnelInfo{ID: "new", ClientID: "client", Subdomain: reg.GetByClient("client")[0].Subdomain, ClientLimit: 3}); err != nil {
+		t.Fatalf("expected takeover within the limit, got %v", err)
+	}
+	if _, err := reg.Takeover(&TunnelInfo{ID: "extra", ClientID: "client", Subdomain: "extra", ClientLimit: 3}); !errors.Is(err, ErrTunnelLimit) {
+		t.Fatalf("expected ErrTunnelLimit for a new subdomain, got %v", err)
+	}
+	if err := reg.Register(&TunnelInfo{ID: "other", ClientID: "other", Subdomain: "other", ClientLimit: 3}); err != nil {
+		t.Fatalf("expected another client to register, got %v", err)
+	}
+}
+
+func TestRegistryHasTunnelRemembersRecentSubdomains(t *testing.T) {
+	reg := NewRegistry()
+
+	if reg.HasTunnel("demo") {
+		t.Fatal("expected unknown subdomain to be reported as absent")
+	}
+
+	if err := reg.Register(&TunnelInfo{ID: "abc", ClientID: "client", Subdomain: "demo"}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if !reg.HasTunnel("demo") {
+		t.Fatal("expected active subdomain to be reported")
+	}
+
+	reg.Unregister("demo")
+	if !reg.HasTunnel("demo") {
+		t.Fatal("expected recently closed subdomain to still be reported")
+	}
+}
+
+func TestTunnelInfoAcquireConnHonorsMaxStreams(t *testing.T) {
+	tunnel := &TunnelInfo{MaxStreams: 2}
+	if !tunnel.AcquireConn() || !tunnel.AcquireConn() {
+		t.Fatal("expected the first two connections to be allowed")
+	}
+	if tunnel.AcquireConn() {
+		t.Fatal("expected the third connection to be rejected")
+	}
+	tunnel.ReleaseConn()
+	if !tunnel.AcquireConn() {
+		t.Fatal("expected a released slot to be reusable")
+	}
+
+	unlimited := &TunnelInfo{}
+	for i := 0; i < 10; i++ {
+		if !unlimited.AcquireConn() {
+			t.Fatal("expected no limit when MaxStreams is zero")
+		}
+	}
+}
+
+func TestOpenStreamAppliesStreamCompression(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	serverSession, err := yamux.Server(serverConn, nil)
+	if err != nil {
+		t.Fatalf("failed to create server session: %v", err)
+	}
+	defer serverSession.Close()
+	clientSession, err := yamux.Client(clientConn, nil)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	defer clientSession.Close()
+
+	reg := NewRegistry()
+	if err := reg.Register(&TunnelInfo{
+		ID:                "t-deflate",
+		ClientID:          "client",
+		Subdomain:         "deflate",
+		MuxSession:        serverSession,
+		StreamCompression: protocol.StreamCompressionDeflate,
+	}); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+
+	go func() {
+		stream, err := clientSession.AcceptStream()
+		if err != nil {
+			return
+		}
+		conn := protocol.WrapStream(stream, protocol.StreamCompressionDeflate)
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	stream, err := reg.OpenStream("deflate")
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	defer stream.Close()
+
+	want := strings.Repeat("compressed payload ", 64)
+	if _, err := io.WriteString(stream, want); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	if string(got) != want {
+		t.Fatalf("echo mismatch: got %q", got)
+	}
+}
+
+// newTestSession returns the server side of a yamux session whose client
+// side accepts streams without serving them.
+func newTestSession(t *testing.T) *yamux.Session {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	serverSession, err := yamux.Server(serverConn, nil)
+	if err != nil {
+		t.Fatalf("failed to create server session: %v", err)
+	}
+	clientSession, err := yamux.Client(clientConn, nil)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	t.Cleanup(func() {
+		clientSession.Close()
+		serverSession.Close()
+	})
+	go func() {
+		for {
+			if _, err := clientSession.AcceptStream(); err != nil {
+				return
+			}
+		}
+	}()
+	return serverSession
+}
+
+func TestClientActivityAggregatesTunnelsAndStreams(t *testing.T) {
+	reg := NewRegistry()
+	web, api := newTestSession(t), newTestSession(t)
+	for _, tunnel := range []*TunnelInfo{
+		{ID: "alice-web", ClientID: "alice", Subdomain: "web", Protocol: "http", Pooled: true, MuxSession: web},
+		{ID: "alice-api", ClientID: "alice", Subdomain: "api", MuxSession: api},
+		{ID: "alice-db", ClientID: "alice", Subdomain: "db", Protocol: "tcp", PublicPort: 30001},
+		{ID: "bob-app", ClientID: "bob", Subdomain: "app"},
+	} {
+		if err := reg.Register(tunnel); err != nil {
+			t.Fatalf("failed to register %s: %v", tunnel.ID, err)
+		}
+	}
+	if err := reg.JoinPool(&TunnelInfo{ID: "alice-web-2", ClientID: "alice", Subdomain: "web", Protocol: "http", Pooled: true}); err != nil {
+		t.Fatalf("failed to join pool: %v", err)
+	}
+	for _, session := range []*yamux.Session{web, web, api} {
+		stream, err := session.OpenStream()
+		if err != nil {
+			t.Fatalf("failed to open stream: %v", err)
+		}
+		defer stream.Close()
+	}
+
+	activity := reg.ClientActivity()
+	if len(activity) != 2 || activity[0].ClientID != "alice" || activity[1].ClientID != "bob" {
+		t.Fatalf("expected alice and bob, got %+v", activity)
+	}
+	alice := activity[0]
+	if alice.Tunnels != 4 || alice.Connected != 2 || alice.Streams != 3 {
+		t.Fatalf("unexpected aggregate for alice: %+v", alice)
+	}
+	if strings.Join(alice.Subdomains, ",") != "api,db,web" {
+		t.Fatalf("unexpected subdomains for alice: %v", alice.Subdomains)
+	}
+	if bob := activity[1]; bob.Tunnels != 1 || bob.Connected != 0 || bob.Streams != 0 {
+		t.Fatalf("unexpected aggregate for bob: %+v", bob)
+	}
+
+	reg.Unregister("app")
+	if activity := reg.ClientActivity(); len(activity) != 1 || activity[0].ClientID != "alice" {
+		t.Fatalf("expected clients without tunnels to be left out, got %+v", activity)
+	}
+}
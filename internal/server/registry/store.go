@@ -0,0 +1,135 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrClaimed is returned when a subdomain or port is owned by another node.
+var ErrClaimed = errors.New("tunnel is owned by another node")
+
+// Owner records which server node holds the control connection of a tunnel.
+type Owner struct {
+	Subdomain string `json:"subdomain"`      // Subdomain of the tunnel
+	TunnelID  string `json:"tunnel_id"`      // Unique tunnel identifier
+	ClientID  string `json:"client_id"`      // ID of the owning client
+	Port      int    `json:"port,omitempty"` // Public port of a port-based tunnel
+	Node      string `json:"node"`           // Address where the owning node's HTTP proxy is reachable by peers
+}
+
+// Store shares tunnel ownership between server instances, so a request that
+// reaches a node without the tunnel can be forwarded to the node that has it.
+//
+// Claims expire after their TTL unless renewed, so tunnels of a node that
+// crashed are released automatically.
+type Store interface {
+	// Claim records owner for its subdomain and port, or renews the claim if
+	// the same node already holds it. It fails with ErrClaimed if another
+	// node owns the subdomain or port.
+	Claim(ctx context.Context, owner Owner, ttl time.Duration) error
+	// Takeover records owner like Claim, but also replaces claims of other
+	// nodes held by the same client, as when a client reconnects to another
+	// node. It fails with ErrClaimed if another client owns the subdomain or port.
+	Takeover(ctx context.Context, owner Owner, ttl time.Duration) error
+	// Release removes the claims of owner if its node still holds them.
+	Release(ctx context.Context, owner Owner) error
+	// Lookup returns the owner of a subdomain, or nil if it is unclaimed.
+	Lookup(ctx context.Context, subdomain string) (*Owner, error)
+	// LookupPort returns the owner of a public port, or nil if it is unclaimed.
+	LookupPort(ctx context.Context, port int) (*Owner, error)
+}
+
+// MemoryStore is a Store kept in process memory. It suits a single server,
+// or several registries in one process as in tests.
+type MemoryStore struct {
+	mu         sync.Mutex
+	subdomains map[string]memoryClaim
+	ports      map[int]memoryClaim
+	now        func() time.Time
+}
+
+type memoryClaim struct {
+	owner     Owner
+	expiresAt time.Time
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+//
+// Returns:
+//   - *MemoryStore: A store without claims
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		subdomains: make(map[string]memoryClaim),
+		ports:      make(map[int]memoryClaim),
+		now:        time.Now,
+	}
+}
+
+func (s *MemoryStore) Claim(ctx context.Context, owner Owner, ttl time.Duration) error {
+	return s.claim(owner, ttl, func(claim Owner) bool { return claim.Node == owner.Node })
+}
+
+func (s *MemoryStore) Takeover(ctx context.Context, owner Owner, ttl time.Duration) error {
+	return s.claim(owner, ttl, func(claim Owner) bool { return claim.ClientID == owner.ClientID })
+}
+
+// claim records owner unless a live claim exists that replaceable rejects.
+func (s *MemoryStore) claim(owner Owner, ttl time.Duration, replaceable func(Owner) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if claim, ok := s.subdomains[owner.Subdomain]; ok && now.Before(claim.expiresAt) && !replaceable(claim.owner) {
+		return ErrClaimed
+	}
+	if owner.Port > 0 {
+		if claim, ok := s.ports[owner.Port]; ok && now.Before(claim.expiresAt) && !replaceable(claim.owner) {
+			return ErrClaimed
+		}
+	}
+
+	claim := memoryClaim{owner: owner, expiresAt: now.Add(ttl)}
+	s.subdomains[owner.Subdomain] = claim
+	if owner.Port > 0 {
+		s.ports[owner.Port] = claim
+	}
+	return nil
+}
+
+func (s *MemoryStore) Release(ctx context.Context, owner Owner) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if claim, ok := s.subdomains[owner.Subdomain]; ok && claim.owner.Node == owner.Node {
+		delete(s.subdomains, owner.Subdomain)
+	}
+	if owner.Port > 0 {
+		if claim, ok := s.ports[owner.Port]; ok && claim.owner.Node == owner.Node {
+			delete(s.ports, owner.Port)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Lookup(ctx context.Context, subdomain string) (*Owner, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.live(s.subdomains[subdomain]), nil
+}
+
+func (s *MemoryStore) LookupPort(ctx context.Context, port int) (*Owner, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.live(s.ports[port]), nil
+}
+
+// live returns the owner of an unexpired claim.
+func (s *MemoryStore) live(claim memoryClaim) *Owner {
+	if claim.owner.Subdomain == "" || !s.now().Before(claim.expiresAt) {
+		return nil
+	}
+	owner := claim.owner
+	return &owner
+}
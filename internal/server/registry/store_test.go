@@ -0,0 +1,282 @@
+package registry
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore checks the behavior every Store implementation must share.
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+	ctx := context.Background()
+	nodeA := Owner{Subdomain: "app", TunnelID: "t1", ClientID: "alice", Port: 31001, Node: "10.0.0.1:80"}
+	nodeB := Owner{Subdomain: "app", TunnelID: "t2", ClientID: "bob", Port: 31002, Node: "10.0.0.2:80"}
+
+	if owner, err := store.Lookup(ctx, "app"); err != nil || owner != nil {
+		t.Fatalf("expected no owner before claiming, got %+v %v", owner, err)
+	}
+	if err := store.Claim(ctx, nodeA, time.Minute); err != nil {
+		t.Fatalf("claim failed: %v", err)
+	}
+	if owner, err := store.Lookup(ctx, "app"); err != nil || owner == nil || *owner != nodeA {
+		t.Fatalf("expected node A to own app, got %+v %v", owner, err)
+	}
+	if owner, err := store.LookupPort(ctx, 31001); err != nil || owner == nil || owner.Node != nodeA.Node {
+		t.Fatalf("expected node A to own port 31001, got %+v %v", owner, err)
+	}
+
+	if err := store.Claim(ctx, nodeB, time.Minute); !errors.Is(err, ErrClaimed) {
+		t.Fatalf("expected ErrClaimed for another node, got %v", err)
+	}
+	portClash := Owner{Subdomain: "other", Port: 31001, Node: nodeB.Node}
+	if err := store.Claim(ctx, portClash, time.Minute); !errors.Is(err, ErrClaimed) {
+		t.Fatalf("expected ErrClaimed for a port owned by another node, got %v", err)
+	}
+	if owner, _ := store.Lookup(ctx, "other"); owner != nil {
+		t.Fatalf("a failed claim must not claim anything, got %+v", owner)
+	}
+	if err := store.Claim(ctx, nodeA, time.Minute); err != nil {
+		t.Fatalf("expected the owning node to renew its claim: %v", err)
+	}
+
+	// Only the owning node can release a claim.
+	if err := store.Release(ctx, nodeB); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	if owner, _ := store.Lookup(ctx, "app"); owner == nil {
+		t.Fatal("another node must not release the claim")
+	}
+	if err := store.Release(ctx, nodeA); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	if owner, _ := store.Lookup(ctx, "app"); owner != nil {
+		t.Fatalf("expected app to be unclaimed after release, got %+v", owner)
+	}
+	if owner, _ := store.LookupPort(ctx, 31001); owner != nil {
+		t.Fatalf("expected port 31001 to be unclaimed after release, got %+v", owner)
+	}
+
+	// Claims of a node that stops renewing them expire.
+	if err := store.Claim(ctx, nodeA, 100*time.Millisecond); err != nil {
+		t.Fatalf("claim failed: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := store.Claim(ctx, nodeB, time.Minute); err != nil {
+		t.Fatalf("expected an expired claim to be taken over: %v", err)
+	}
+	store.Release(ctx, nodeB)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+// TestRedisStore runs against a real Redis server when TUNNELAB_TEST_REDIS
+// holds its address, e.g. "127.0.0.1:6379".
+func TestRedisStore(t *testing.T) {
+	addr := os.Getenv("TUNNELAB_TEST_REDIS")
+	if addr == "" {
+		t.Skip("TUNNELAB_TEST_REDIS is not set")
+	}
+	store := NewRedisStore(RedisConfig{Addr: addr, Prefix: "tunnelab-test:" + time.Now().Format("150405.000") + ":"})
+	defer store.Close()
+	testStore(t, store)
+}
+
+func TestRedisProtocol(t *testing.T) {
+	if got := string(encodeCommand([]string{"GET", "key"})); got != "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n" {
+		t.Fatalf("unexpected encoding %q", got)
+	}
+
+	replies := "+OK\r\n:1\r\n$5\r\nhello\r\n$-1\r\n*2\r\n:1\r\n$1\r\nx\r\n-ERR wrong\r\n"
+	r := bufio.NewReader(strings.NewReader(replies))
+	for _, want := range []interface{}{"OK", int64(1), "hello", nil} {
+		got, err := readReply(r)
+		if err != nil || got != want {
+			t.Fatalf("expected %v, got %v %v", want, got, err)
+		}
+	}
+	if got, err := readReply(r); err != nil || len(got.([]interface{})) != 2 {
+		t.Fatalf("expected a two element array, got %v %v", got, err)
+	}
+	var replyErr redisError
+	if _, err := readReply(r); !errors.As(err, &replyErr) || string(replyErr) != "ERR wrong" {
+		t.Fatalf("expected an error reply, got %v", err)
+	}
+}
+
+// TestRedisStoreCommands checks the commands sent by RedisStore against a
+// scripted server.
+func TestRedisStoreCommands(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	commands := make(chan []string, 8)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		record := `{"subdomain":"app","tunnel_id":"t1","client_id":"c","node":"n1"}`
+		bulk := "$" + strconv.Itoa(len(record)) + "\r\n" + record + "\r\n"
+		for _, reply := range []string{"+OK\r\n", ":0\r\n", bulk} {
+			cmd, err := readReply(reader)
+			if err != nil {
+				return
+			}
+			args := make([]string, 0)
+			for _, arg := range cmd.([]interface{}) {
+				args = append(args, arg.(string))
+			}
+			commands <- args
+			conn.Write([]byte(reply))
+		}
+	}()
+
+	store := NewRedisStore(RedisConfig{Addr: listener.Addr().String(), Password: "secret"})
+	defer store.Close()
+
+	err = store.Claim(context.Background(), Owner{Subdomain: "app", Port: 31001, Node: "n2"}, time.Second)
+	if !errors.Is(err, ErrClaimed) {
+		t.Fatalf("expected ErrClaimed when the script returns 0, got %v", err)
+	}
+	owner, err := store.Lookup(context.Background(), "app")
+	if err != nil || owner == nil || owner.Node != "n1" {
+		t.Fatalf("expected owner n1, got %+v %v", owner, err)
+	}
+
+	if auth := <-commands; strings.Join(auth, " ") != "AUTH secret" {
+		t.Fatalf("expected AUTH first, got %v", auth)
+	}
+	claim := <-commands
+	if claim[0] != "EVAL" || claim[2] != "2" || claim[3] != "tunnelab:subdomain:app" || claim[4] != "tunnelab:port:31001" || claim[7] != "1000" {
+		t.Fatalf("unexpected claim command %v", claim)
+	}
+	if get := <-commands; strings.Join(get, " ") != "GET tunnelab:subdomain:app" {
+		t.Fatalf("unexpected lookup command %v", get)
+	}
+}
+
+func TestRegistriesShareOwnership(t *testing.T) {
+	store := NewMemoryStore()
+	nodeA, nodeB := NewRegistry(), NewRegistry()
+	nodeA.SetStore(store, "10.0.0.1:80", time.Minute)
+	nodeB.SetStore(store, "10.0.0.2:80", time.Minute)
+
+	if err := nodeA.Register(&TunnelInfo{ID: "t1", ClientID: "alice", Subdomain: "app"}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if err := nodeB.Register(&TunnelInfo{ID: "t2", ClientID: "bob", Subdomain: "app"}); !errors.Is(err, ErrClaimed) {
+		t.Fatalf("expected ErrClaimed on the second node, got %v", err)
+	}
+
+	owner, remote := nodeB.RemoteOwner("app")
+	if !remote || owner.Node != "10.0.0.1:80" || owner.TunnelID != "t1" {
+		t.Fatalf("expected node B to see node A as owner, got %+v %v", owner, remote)
+	}
+	if _, remote := nodeA.RemoteOwner("app"); remote {
+		t.Fatal("a local tunnel must not be reported as remote")
+	}
+	if !nodeB.HasTunnel("app") {
+		t.Fatal("expected HasTunnel to include tunnels of other nodes")
+	}
+
+	nodeA.Unregister("app")
+	if _, remote := nodeB.RemoteOwner("app"); remote {
+		t.Fatal("expected the claim to be released with the tunnel")
+	}
+	if err := nodeB.Register(&TunnelInfo{ID: "t2", ClientID: "bob", Subdomain: "app"}); err != nil {
+		t.Fatalf("expected the subdomain to be free again: %v", err)
+	}
+}
+
+func TestStoreTakeover(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	old := Owner{Subdomain: "app", ClientID: "alice", Port: 31001, Node: "10.0.0.1:80"}
+	if err := store.Claim(ctx, old, time.Minute); err != nil {
+		t.Fatalf("claim failed: %v", err)
+	}
+
+	other := Owner{Subdomain: "app", ClientID: "bob", Node: "10.0.0.2:80"}
+	if err := store.Takeover(ctx, other, time.Minute); !errors.Is(err, ErrClaimed) {
+		t.Fatalf("expected ErrClaimed for another client, got %v", err)
+	}
+	moved := Owner{Subdomain: "app", ClientID: "alice", Port: 31001, Node: "10.0.0.2:80"}
+	if err := store.Takeover(ctx, moved, time.Minute); err != nil {
+		t.Fatalf("expected the same client to take over: %v", err)
+	}
+	if owner, _ := store.Lookup(ctx, "app"); owner == nil || owner.Node != moved.Node {
+		t.Fatalf("expected the new node to own app, got %+v", owner)
+	}
+	if err := store.Claim(ctx, old, time.Minute); !errors.Is(err, ErrClaimed) {
+		t.Fatalf("expected the old node to lose its claim, got %v", err)
+	}
+}
+
+func TestRegistryTakeover(t *testing.T) {
+	reg := NewRegistry()
+	old := &TunnelInfo{ID: "t1", ClientID: "alice", Subdomain: "app", PublicPort: 31001}
+	if err := reg.Register(old); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	if _, err := reg.Takeover(&TunnelInfo{ID: "t2", ClientID: "bob", Subdomain: "app"}); err == nil {
+		t.Fatal("expected another client not to take over the tunnel")
+	}
+
+	replacement := &TunnelInfo{ID: "t3", ClientID: "alice", Subdomain: "app", PublicPort: 31002}
+	replaced, err := reg.Takeover(replacement)
+	if err != nil || replaced != old {
+		t.Fatalf("expected the old tunnel to be replaced, got %v %v", replaced, err)
+	}
+	if current, _ := reg.GetBySubdomain("app"); current != replacement {
+		t.Fatal("expected the replacement to be registered")
+	}
+	if _, exists := reg.GetByPort(31001); exists {
+		t.Fatal("expected the old port to be freed")
+	}
+	if current, _ := reg.GetByPort(31002); current != replacement {
+		t.Fatal("expected the new port to be registered")
+	}
+	if tunnels := reg.GetByClient("alice"); len(tunnels) != 1 || tunnels[0] != replacement {
+		t.Fatalf("expected one tunnel for the client, got %v", tunnels)
+	}
+	if reg.UnregisterTunnel(old) {
+		t.Fatal("the replaced tunnel must not unregister its replacement")
+	}
+}
+
+func TestRefreshDropsTunnelsTakenOverElsewhere(t *testing.T) {
+	store := NewMemoryStore()
+	nodeA, nodeB := NewRegistry(), NewRegistry()
+	nodeA.SetStore(store, "10.0.0.1:80", time.Minute)
+	nodeB.SetStore(store, "10.0.0.2:80", time.Minute)
+
+	if err := nodeA.Register(&TunnelInfo{ID: "t1", ClientID: "alice", Subdomain: "app"}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if _, err := nodeB.Takeover(&TunnelInfo{ID: "t2", ClientID: "alice", Subdomain: "app"}); err != nil {
+		t.Fatalf("expected the client to take over on node B: %v", err)
+	}
+
+	nodeA.RefreshOwnership(context.Background())
+	if _, exists := nodeA.GetBySubdomain("app"); exists {
+		t.Fatal("expected node A to drop the tunnel taken over by node B")
+	}
+	if owner, _ := store.Lookup(context.Background(), "app"); owner == nil || owner.Node != "10.0.0.2:80" {
+		t.Fatalf("node A must not release node B's claim, got %+v", owner)
+	}
+}
@@ -9,6 +9,7 @@
 //   - Certificate caching and renewal
 //   - Manual certificate support
 //   - Secure TLS configuration with modern ciphers
+//   - Optional OCSP stapling
 //
 // Usage:
 //
@@ -32,34 +33,86 @@ package tls
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
+// letsEncryptStagingURL is the directory of Let's Encrypt's staging environment.
+const letsEncryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
 // CertManager manages TLS certificates using Let's Encrypt.
 type CertManager struct {
-	manager *autocert.Manager // Let's Encrypt manager
-	config  *tls.Config       // TLS configuration
+	manager    *autocert.Manager // Let's Encrypt manager
+	config     *tls.Config       // TLS configuration
+	hostFilter HostFilter        // Optional filter applied before certificate lookup
+	rejected   *negativeCache    // Recently rejected hosts
+	limiter    *issuanceLimiter  // Per-source limit on issuance attempts
+	stapler    *ocspStapler      // OCSP staple cache (nil when stapling is disabled)
+	issuedMu   sync.Mutex
+	issued     map[string]bool // Hosts that already have a certificate
 }
 
+// HostFilter reports whether a TLS server name should be served.
+type HostFilter func(serverName string) bool
+
 // Config contains certificate manager configuration.
 type Config struct {
-	Domain   string // Domain for certificates (e.g., "example.com")
-	Email    string // Email for Let's Encrypt notifications
-	CacheDir string // Directory to cache certificates
-	Staging  bool   // Use Let's Encrypt staging environment
+	Domain   string       // Domain for certificates (e.g., "example.com")
+	Email    string       // Email for Let's Encrypt notifications
+	CacheDir string       // Directory to cache certificates
+	Staging  bool         // Use Let's Encrypt staging environment
+	Tunnels  TunnelLookup // Decides which subdomains may get certificates
+
+	// CustomDomains decides which hostnames outside Domain may get
+	// certificates. Nil allows none.
+	CustomDomains CustomDomainLookup
+
+	Options Options // TLS hardening settings
+
+	// DirectoryURL is the ACME directory of another CA (e.g. ZeroSSL or an
+	// internal smallstep CA). Empty means Let's Encrypt, honoring Staging.
+	DirectoryURL string
+	// EABKeyID and EABHMACKey are external account binding credentials, required
+	// by CAs such as ZeroSSL. The HMAC key is base64url-encoded, as CAs issue it.
+	EABKeyID   string
+	EABHMACKey string
+
+	NegativeCacheTTL time.Duration // How long rejected hosts are refused without a lookup
+	IssuanceLimit    int           // Max issuance attempts per source per window (0 disables)
+	IssuanceWindow   time.Duration // Window for IssuanceLimit
+}
+
+// TunnelLookup reports whether a subdomain has (or recently had) an active
+// tunnel, and therefore deserves a certificate.
+type TunnelLookup interface {
+	HasTunnel(subdomain string) bool
+}
+
+// CustomDomainLookup reports whether a hostname outside the server domain is
+// a verified custom domain, and therefore deserves a certificate.
+type CustomDomainLookup interface {
+	AllowsCustomDomain(host string) bool
 }
 
 // NewCertManager creates a new certificate manager with Let's Encrypt support.
 //
 // It sets up automatic certificate generation, caching, and renewal.
-// The host policy allows the main domain and all subdomains.
+// The host policy allows the main domain, its control subdomain, and tunnel
+// subdomains accepted by cfg.Tunnels, and custom domains accepted by
+// cfg.CustomDomains. Without a lookup no other host is allowed, so arbitrary
+// hostnames cannot exhaust the CA's rate limits.
 //
 // Parameters:
 //   - cfg: Configuration for the certificate manager
@@ -76,67 +129,215 @@ func NewCertManager(cfg *Config) (*CertManager, error) {
 		return nil, fmt.Errorf("failed to create cert cache directory: %w", err)
 	}
 
-	// Allow the main domain and all subdomains
-	hostPolicy := func(ctx context.Context, host string) error {
-		// Allow exact domain match
-		if host == cfg.Domain {
-			return nil
-		}
-		// Allow control subdomain
-		if host == "control."+cfg.Domain {
-			return nil
-		}
-		// Allow any subdomain of the main domain
-		if strings.HasSuffix(host, "."+cfg.Domain) {
-			return nil
-		}
-		return fmt.Errorf("host %q not configured", host)
+	rejected := newNegativeCache(cfg.NegativeCacheTTL)
+	hostPolicy := newHostPolicy(cfg.Domain, cfg.Tunnels, cfg.CustomDomains, rejected)
+
+	tlsConfig, err := newServerConfig(cfg.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	directoryURL, err := acmeDirectoryURL(cfg)
+	if err != nil {
+		return nil, err
+	}
+	eab, err := externalAccountBinding(cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	manager := &autocert.Manager{
+		Client:     &acme.Client{DirectoryURL: directoryURL},
 		Prompt:     autocert.AcceptTOS,
 		HostPolicy: hostPolicy,
 		Cache:      autocert.DirCache(cfg.CacheDir),
 		Email:      cfg.Email,
+		ForceRSA:   cfg.Options.CertKeyType == "rsa",
+
+		ExternalAccountBinding: eab,
 	}
 
 	if cfg.Staging {
 		log.Println("Using Let's Encrypt STAGING environment")
 	}
+	log.Printf("Using ACME directory %s", directoryURL)
+
+	cm := &CertManager{
+		manager:  manager,
+		rejected: rejected,
+		limiter:  newIssuanceLimiter(cfg.IssuanceLimit, cfg.IssuanceWindow),
+		issued:   make(map[string]bool),
+	}
+	if cfg.Options.OCSPStapling {
+		cm.stapler = newOCSPStapler()
+	}
+
+	tlsConfig.GetCertificate = cm.getCertificate
+	cm.config = tlsConfig
+	return cm, nil
+}
+
+// acmeDirectoryURL returns the ACME directory to request certificates from.
+//
+// Parameters:
+//   - cfg: Configuration with DirectoryURL and Staging
+//
+// Returns:
+//   - string: cfg.DirectoryURL, or the Let's Encrypt production or staging directory
+//   - error: Error if DirectoryURL is not an absolute HTTP(S) URL or is combined with Staging
+func acmeDirectoryURL(cfg *Config) (string, error) {
+	if cfg.DirectoryURL == "" {
+		if cfg.Staging {
+			return letsEncryptStagingURL, nil
+		}
+		return acme.LetsEncryptURL, nil
+	}
+	if cfg.Staging {
+		return "", fmt.Errorf("staging cannot be combined with a custom ACME directory URL")
+	}
+
+	u, err := url.Parse(cfg.DirectoryURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid ACME directory URL: %w", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", fmt.Errorf("invalid ACME directory URL %q: must be an absolute http(s) URL", cfg.DirectoryURL)
+	}
+	return u.String(), nil
+}
+
+// externalAccountBinding decodes the EAB credentials from cfg.
+//
+// Parameters:
+//   - cfg: Configuration with EABKeyID and EABHMACKey
+//
+// Returns:
+//   - *acme.ExternalAccountBinding: The binding, or nil when none is configured
+//   - error: Error if only one credential is set or the HMAC key is not base64url
+func externalAccountBinding(cfg *Config) (*acme.ExternalAccountBinding, error) {
+	if cfg.EABKeyID == "" && cfg.EABHMACKey == "" {
+		return nil, nil
+	}
+	if cfg.EABKeyID == "" || cfg.EABHMACKey == "" {
+		return nil, fmt.Errorf("external account binding needs both a key ID and an HMAC key")
+	}
 
-	tlsConfig := &tls.Config{
-		GetCertificate: manager.GetCertificate,
-		MinVersion:     tls.VersionTLS12,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-		},
-		PreferServerCipherSuites: true,
-		CurvePreferences: []tls.CurveID{
-			tls.CurveP256,
-			tls.X25519,
-		},
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(cfg.EABHMACKey, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid EAB HMAC key: %w", err)
 	}
+	return &acme.ExternalAccountBinding{KID: cfg.EABKeyID, Key: key}, nil
+}
 
-	return &CertManager{
-		manager: manager,
-		config:  tlsConfig,
-	}, nil
+// newHostPolicy builds the autocert host policy for domain. Rejected hosts
+// are remembered in rejected so bursts for the same host skip the lookup.
+// Custom domains are checked first, as that lookup is in memory, so a domain
+// verified after being rejected is not refused until its entry expires.
+func newHostPolicy(domain string, tunnels TunnelLookup, customDomains CustomDomainLookup, rejected *negativeCache) autocert.HostPolicy {
+	return func(ctx context.Context, host string) error {
+		host = strings.ToLower(host)
+		if host == domain || host == "control."+domain {
+			return nil
+		}
+		if customDomains != nil && !strings.HasSuffix(host, "."+domain) && customDomains.AllowsCustomDomain(host) {
+			return nil
+		}
+		if rejected.contains(host) {
+			return fmt.Errorf("host %q not configured", host)
+		}
+		if strings.HasSuffix(host, "."+domain) && tunnels != nil {
+			subdomain := strings.TrimSuffix(host, "."+domain)
+			if tunnels.HasTunnel(subdomain) {
+				return nil
+			}
+		}
+		rejected.add(host)
+		return fmt.Errorf("host %q not configured", host)
+	}
 }
 
 func (cm *CertManager) TLSConfig() *tls.Config {
 	return cm.config
 }
 
+// SetHostFilter rejects handshakes for server names the filter does not allow,
+// before autocert is asked for (and possibly issues) a certificate.
+func (cm *CertManager) SetHostFilter(filter HostFilter) {
+	cm.hostFilter = filter
+}
+
+func (cm *CertManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(hello.ServerName)
+	if cm.hostFilter != nil && !cm.hostFilter(host) {
+		return nil, fmt.Errorf("unknown server name %q", host)
+	}
+
+	cm.issuedMu.Lock()
+	issued := cm.issued[host]
+	cm.issuedMu.Unlock()
+
+	if !issued {
+		if cm.rejected.contains(host) {
+			return nil, fmt.Errorf("host %q not configured", host)
+		}
+		if source := sourceAddr(hello); !cm.limiter.allow(source) {
+			log.Printf("Certificate issuance rate limit exceeded for %s (host %q)", source, host)
+			return nil, fmt.Errorf("too many certificate requests")
+		}
+	}
+
+	cert, err := cm.manager.GetCertificate(hello)
+	if err != nil {
+		return nil, err
+	}
+	if !issued {
+		cm.issuedMu.Lock()
+		cm.issued[host] = true
+		cm.issuedMu.Unlock()
+	}
+	if cm.stapler != nil {
+		cert = cm.stapler.staple(cert)
+	}
+	return cert, nil
+}
+
+func sourceAddr(hello *tls.ClientHelloInfo) string {
+	if hello.Conn == nil {
+		return ""
+	}
+	addr := hello.Conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// RestrictServerNames returns a copy of cfg that aborts the handshake for
+// server names the filter does not allow.
+//
+// Parameters:
+//   - cfg: The TLS configuration to restrict
+//   - filter: Decides which SNI server names are served
+//
+// Returns:
+//   - *tls.Config: A restricted clone of cfg
+func RestrictServerNames(cfg *tls.Config, filter HostFilter) *tls.Config {
+	restricted := cfg.Clone()
+	restricted.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if !filter(hello.ServerName) {
+			return nil, fmt.Errorf("unknown server name %q", hello.ServerName)
+		}
+		return nil, nil
+	}
+	return restricted
+}
+
 func (cm *CertManager) HTTPHandler() http.Handler {
 	return cm.manager.HTTPHandler(nil)
 }
 
-func LoadManualCerts(certPath, keyPath string) (*tls.Config, error) {
+// LoadManualCerts loads a certificate/key pair and applies the hardening options.
+func LoadManualCerts(certPath, keyPath string, opts Options) (*tls.Config, error) {
 	if certPath == "" || keyPath == "" {
 		return nil, fmt.Errorf("cert_path and key_path are required for manual TLS mode")
 	}
@@ -154,10 +355,18 @@ func LoadManualCerts(certPath, keyPath string) (*tls.Config, error) {
 		return nil, fmt.Errorf("failed to load certificate: %w", err)
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12,
-	}, nil
+	tlsConfig, err := newServerConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	if opts.OCSPStapling {
+		stapler := newOCSPStapler()
+		tlsConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return stapler.staple(&cert), nil
+		}
+	}
+	return tlsConfig, nil
 }
 
 func GetCertCachePath(domain string) string {
@@ -0,0 +1,155 @@
+package tls
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+type fakeTunnels map[string]bool
+
+func (f fakeTunnels) HasTunnel(subdomain string) bool {
+	return f[subdomain]
+}
+
+func TestHostPolicyAllowsOnlyKnownTunnels(t *testing.T) {
+	policy := newHostPolicy("tunnel.example.com", fakeTunnels{"app": true}, nil, nil)
+
+	allowed := []string{
+		"tunnel.example.com",
+		"control.tunnel.example.com",
+		"app.tunnel.example.com",
+	}
+	for _, host := range allowed {
+		if err := policy(context.Background(), host); err != nil {
+			t.Errorf("expected %q to be allowed, got %v", host, err)
+		}
+	}
+
+	denied := []string{
+		"random123.tunnel.example.com",
+		"a.app.tunnel.example.com",
+		"app.other.com",
+	}
+	for _, host := range denied {
+		if err := policy(context.Background(), host); err == nil {
+			t.Errorf("expected %q to be denied", host)
+		}
+	}
+}
+
+type fakeCustomDomains map[string]bool
+
+func (f fakeCustomDomains) AllowsCustomDomain(host string) bool {
+	return f[host]
+}
+
+func TestHostPolicyAllowsVerifiedCustomDomains(t *testing.T) {
+	customDomains := fakeCustomDomains{"app.example.org": true, "random123.tunnel.example.com": true}
+	policy := newHostPolicy("tunnel.example.com", fakeTunnels{}, customDomains, newNegativeCache(time.Minute))
+
+	if err := policy(context.Background(), "App.Example.org"); err != nil {
+		t.Fatalf("expected a verified custom domain to be allowed, got %v", err)
+	}
+	if err := policy(context.Background(), "unverified.example.org"); err == nil {
+		t.Fatal("expected an unverified custom domain to be denied")
+	}
+	// Subdomains of the server domain need a tunnel, whatever the lookup says.
+	if err := policy(context.Background(), "random123.tunnel.example.com"); err == nil {
+		t.Fatal("expected a subdomain without a tunnel to be denied")
+	}
+
+	// A domain verified after being rejected is allowed at once.
+	customDomains["unverified.example.org"] = true
+	if err := policy(context.Background(), "unverified.example.org"); err != nil {
+		t.Fatalf("expected a newly verified custom domain to be allowed, got %v", err)
+	}
+}
+
+func TestHostPolicyWithoutLookupDeniesSubdomains(t *testing.T) {
+	policy := newHostPolicy("tunnel.example.com", nil, nil, nil)
+
+	if err := policy(context.Background(), "tunnel.example.com"); err != nil {
+		t.Fatalf("expected apex domain to be allowed, got %v", err)
+	}
+	if err := policy(context.Background(), "app.tunnel.example.com"); err == nil {
+		t.Fatal("expected subdomain to be denied without a tunnel lookup")
+	}
+}
+
+func TestNewCertManagerDirectoryURL(t *testing.T) {
+	cases := []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{}, acme.LetsEncryptURL},
+		{Config{Staging: true}, letsEncryptStagingURL},
+		{Config{DirectoryURL: "https://ca.internal:9000/acme/acme/directory"}, "https://ca.internal:9000/acme/acme/directory"},
+	}
+	for _, tc := range cases {
+		cfg := tc.cfg
+		cfg.Domain = "tunnel.example.com"
+		cfg.CacheDir = t.TempDir()
+		cm, err := NewCertManager(&cfg)
+		if err != nil {
+			t.Fatalf("NewCertManager(%+v) failed: %v", tc.cfg, err)
+		}
+		if got := cm.manager.Client.DirectoryURL; got != tc.want {
+			t.Fatalf("expected directory %q, got %q", tc.want, got)
+		}
+	}
+
+	invalid := []Config{
+		{DirectoryURL: "ca.internal/directory"},
+		{DirectoryURL: "ftp://ca.internal/directory"},
+		{DirectoryURL: "https://"},
+		{DirectoryURL: "https://acme.zerossl.com/v2/DV90", Staging: true},
+	}
+	for _, cfg := range invalid {
+		cfg.Domain = "tunnel.example.com"
+		cfg.CacheDir = t.TempDir()
+		if _, err := NewCertManager(&cfg); err == nil {
+			t.Fatalf("expected directory URL %q (staging=%v) to be rejected", cfg.DirectoryURL, cfg.Staging)
+		}
+	}
+}
+
+func TestNewCertManagerExternalAccountBinding(t *testing.T) {
+	cm, err := NewCertManager(&Config{
+		Domain:       "tunnel.example.com",
+		CacheDir:     t.TempDir(),
+		DirectoryURL: "https://acme.zerossl.com/v2/DV90",
+		EABKeyID:     "kid-123",
+		EABHMACKey:   "c2VjcmV0LWhtYWMta2V5",
+	})
+	if err != nil {
+		t.Fatalf("NewCertManager failed: %v", err)
+	}
+	eab := cm.manager.ExternalAccountBinding
+	if eab == nil || eab.KID != "kid-123" || string(eab.Key) != "secret-hmac-key" {
+		t.Fatalf("unexpected external account binding %+v", eab)
+	}
+
+	cm, err = NewCertManager(&Config{Domain: "tunnel.example.com", CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewCertManager failed: %v", err)
+	}
+	if cm.manager.ExternalAccountBinding != nil {
+		t.Fatal("expected no external account binding by default")
+	}
+
+	invalid := []Config{
+		{EABKeyID: "kid-123"},
+		{EABHMACKey: "c2VjcmV0LWhtYWMta2V5"},
+		{EABKeyID: "kid-123", EABHMACKey: "not base64!"},
+	}
+	for _, cfg := range invalid {
+		cfg.Domain = "tunnel.example.com"
+		cfg.CacheDir = t.TempDir()
+		if _, err := NewCertManager(&cfg); err == nil {
+			t.Fatalf("expected EAB %q/%q to be rejected", cfg.EABKeyID, cfg.EABHMACKey)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package tls
+
+import (
+	"sync"
+	"time"
+)
+
+// negativeCache remembers hosts rejected by the host policy for a short time,
+// so repeated ACME attempts for the same bogus host are refused without
+// consulting the tunnel lookup again.
+type negativeCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]time.Time // Map of host to expiry time
+	now     func() time.Time
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{
+		ttl:     ttl,
+		entries: make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+// contains reports whether host was rejected within the TTL.
+func (c *negativeCache) contains(host string) bool {
+	if c == nil || c.ttl <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiry, ok := c.entries[host]
+	if !ok {
+		return false
+	}
+	if !c.now().Before(expiry) {
+		delete(c.entries, host)
+		return false
+	}
+	return true
+}
+
+// add records a rejected host.
+func (c *negativeCache) add(host string) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for name, expiry := range c.entries {
+		if !now.Before(expiry) {
+			delete(c.entries, name)
+		}
+	}
+	c.entries[host] = now.Add(c.ttl)
+}
+
+// issuanceLimiter limits certificate issuance attempts per source address
+// using a fixed window counter.
+type issuanceLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	windows map[string]*issuanceWindow // Map of source to its current window
+	now     func() time.Time
+}
+
+type issuanceWindow struct {
+	start time.Time
+	count int
+}
+
+func newIssuanceLimiter(limit int, window time.Duration) *issuanceLimiter {
+	return &issuanceLimiter{
+		limit:   limit,
+		window:  window,
+		windows: make(map[string]*issuanceWindow),
+		now:     time.Now,
+	}
+}
+
+// allow records an attempt from source and reports whether it is within the limit.
+func (l *issuanceLimiter) allow(source string) bool {
+	if l == nil || l.limit <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	w, ok := l.windows[source]
+	if !ok || now.Sub(w.start) >= l.window {
+		for name, existing := range l.windows {
+			if now.Sub(existing.start) >= l.window {
+				delete(l.windows, name)
+			}
+		}
+		w = &issuanceWindow{start: now}
+		l.windows[source] = w
+	}
+	if w.count >= l.limit {
+		return false
+	}
+	w.count++
+	return true
+}
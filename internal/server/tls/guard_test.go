@@ -0,0 +1,81 @@
+package tls
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type countingTunnels struct {
+	lookups int
+}
+
+func (c *countingTunnels) HasTunnel(subdomain string) bool {
+	c.lookups++
+	return false
+}
+
+func TestNegativeCacheExpiresAfterTTL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cache := newNegativeCache(time.Minute)
+	cache.now = func() time.Time { return now }
+
+	cache.add("bogus.tunnel.example.com")
+	if !cache.contains("bogus.tunnel.example.com") {
+		t.Fatal("expected host to be cached right after rejection")
+	}
+
+	now = now.Add(59 * time.Second)
+	if !cache.contains("bogus.tunnel.example.com") {
+		t.Fatal("expected host to stay cached within the TTL")
+	}
+
+	now = now.Add(time.Second)
+	if cache.contains("bogus.tunnel.example.com") {
+		t.Fatal("expected host to expire once the TTL has passed")
+	}
+}
+
+func TestHostPolicyUsesNegativeCache(t *testing.T) {
+	tunnels := &countingTunnels{}
+	policy := newHostPolicy("tunnel.example.com", tunnels, nil, newNegativeCache(time.Minute))
+
+	for i := 0; i < 5; i++ {
+		if err := policy(context.Background(), "bogus.tunnel.example.com"); err == nil {
+			t.Fatal("expected bogus host to be rejected")
+		}
+	}
+	if tunnels.lookups != 1 {
+		t.Fatalf("expected a single tunnel lookup, got %d", tunnels.lookups)
+	}
+}
+
+func TestIssuanceLimiterPerSource(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := newIssuanceLimiter(2, time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	if !limiter.allow("203.0.113.1") || !limiter.allow("203.0.113.1") {
+		t.Fatal("expected attempts within the limit to be allowed")
+	}
+	if limiter.allow("203.0.113.1") {
+		t.Fatal("expected third attempt in the window to be denied")
+	}
+	if !limiter.allow("203.0.113.2") {
+		t.Fatal("expected a different source to have its own budget")
+	}
+
+	now = now.Add(time.Minute)
+	if !limiter.allow("203.0.113.1") {
+		t.Fatal("expected the budget to reset in the next window")
+	}
+}
+
+func TestIssuanceLimiterDisabled(t *testing.T) {
+	limiter := newIssuanceLimiter(-1, time.Minute)
+	for i := 0; i < 100; i++ {
+		if !limiter.allow("203.0.113.1") {
+			t.Fatal("expected disabled limiter to allow every attempt")
+		}
+	}
+}
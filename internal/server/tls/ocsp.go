@@ -0,0 +1,157 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspRetryInterval is how long to wait before retrying a failed OCSP fetch.
+	ocspRetryInterval = 5 * time.Minute
+	// ocspMinRefresh bounds how often a staple is refreshed.
+	ocspMinRefresh = time.Minute
+	// ocspDefaultRefresh is used when a response carries no NextUpdate.
+	ocspDefaultRefresh = time.Hour
+)
+
+// ocspStapler fetches, caches and refreshes OCSP responses for served
+// certificates. Fetches run in the background so handshakes never wait on
+// the OCSP responder; a certificate is served without a staple until the
+// first response arrives.
+type ocspStapler struct {
+	mu      sync.Mutex
+	entries map[[32]byte]*stapleEntry // Map of leaf certificate hash to staple state
+	client  *http.Client
+	now     func() time.Time
+}
+
+type stapleEntry struct {
+	staple     []byte    // DER-encoded OCSP response
+	validUntil time.Time // NextUpdate of the staple (zero means no expiry)
+	refreshAt  time.Time // When the next fetch is due
+	fetching   bool      // Whether a fetch is in flight
+}
+
+func newOCSPStapler() *ocspStapler {
+	return &ocspStapler{
+		entries: make(map[[32]byte]*stapleEntry),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		now:     time.Now,
+	}
+}
+
+// staple returns cert with the cached OCSP staple attached, scheduling a
+// background refresh when one is due. The input certificate is not modified.
+func (s *ocspStapler) staple(cert *tls.Certificate) *tls.Certificate {
+	if cert == nil || len(cert.Certificate) < 2 {
+		return cert
+	}
+	key := sha256.Sum256(cert.Certificate[0])
+	now := s.now()
+
+	s.mu.Lock()
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &stapleEntry{}
+		s.entries[key] = entry
+	}
+	if !entry.fetching && !now.Before(entry.refreshAt) {
+		entry.fetching = true
+		go s.refresh(key, cert)
+	}
+	staple := entry.staple
+	if staple != nil && !entry.validUntil.IsZero() && !now.Before(entry.validUntil) {
+		staple = nil
+	}
+	s.mu.Unlock()
+
+	if staple == nil {
+		return cert
+	}
+	stapled := *cert
+	stapled.OCSPStaple = staple
+	return &stapled
+}
+
+// refresh fetches a new OCSP response for cert and reschedules the next fetch.
+func (s *ocspStapler) refresh(key [32]byte, cert *tls.Certificate) {
+	resp, raw, err := s.fetch(cert)
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := s.entries[key]
+	entry.fetching = false
+	if err != nil {
+		log.Printf("OCSP stapling: %v", err)
+		entry.refreshAt = now.Add(ocspRetryInterval)
+		return
+	}
+	entry.staple = raw
+	entry.validUntil = resp.NextUpdate
+	entry.refreshAt = nextOCSPRefresh(resp, now)
+}
+
+func (s *ocspStapler) fetch(cert *tls.Certificate) (*ocsp.Response, []byte, error) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse leaf certificate: %w", err)
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse issuer certificate: %w", err)
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, fmt.Errorf("certificate for %v has no OCSP responder", leaf.DNSNames)
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create OCSP request: %w", err)
+	}
+	httpResp, err := s.client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, fmt.Errorf("OCSP request failed: %w", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder returned status %d", httpResp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read OCSP response: %w", err)
+	}
+
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid OCSP response: %w", err)
+	}
+	if resp.Status != ocsp.Good {
+		return nil, nil, fmt.Errorf("OCSP status for %v is not good (%d)", leaf.DNSNames, resp.Status)
+	}
+	return resp, raw, nil
+}
+
+// nextOCSPRefresh schedules the next fetch halfway through the response's
+// validity window, but never sooner than ocspMinRefresh from now.
+func nextOCSPRefresh(resp *ocsp.Response, now time.Time) time.Time {
+	next := now.Add(ocspDefaultRefresh)
+	if !resp.NextUpdate.IsZero() {
+		next = resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	}
+	if earliest := now.Add(ocspMinRefresh); next.Before(earliest) {
+		next = earliest
+	}
+	return next
+}
@@ -0,0 +1,161 @@
+package tls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestNextOCSPRefreshScheduling(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	halfway := nextOCSPRefresh(&ocsp.Response{ThisUpdate: now, NextUpdate: now.Add(96 * time.Hour)}, now)
+	if !halfway.Equal(now.Add(48 * time.Hour)) {
+		t.Fatalf("expected refresh halfway through validity, got %v", halfway)
+	}
+
+	noNext := nextOCSPRefresh(&ocsp.Response{ThisUpdate: now}, now)
+	if !noNext.Equal(now.Add(ocspDefaultRefresh)) {
+		t.Fatalf("expected default refresh without NextUpdate, got %v", noNext)
+	}
+
+	stale := nextOCSPRefresh(&ocsp.Response{ThisUpdate: now.Add(-48 * time.Hour), NextUpdate: now.Add(time.Second)}, now)
+	if !stale.Equal(now.Add(ocspMinRefresh)) {
+		t.Fatalf("expected refresh to be bounded by the minimum interval, got %v", stale)
+	}
+}
+
+// newOCSPTestChain creates a CA, a leaf pointing at a fake OCSP responder,
+// and the responder itself. The returned counter tracks responder hits.
+func newOCSPTestChain(t *testing.T, thisUpdate time.Time) (*tls.Certificate, *atomic.Int32) {
+	t.Helper()
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             thisUpdate.Add(-time.Hour),
+		NotAfter:              thisUpdate.Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	hits := new(atomic.Int32)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   thisUpdate,
+			NextUpdate:   thisUpdate.Add(96 * time.Hour),
+		}, caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(resp)
+	}))
+	t.Cleanup(responder.Close)
+
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "app.tunnel.example.com"},
+		DNSNames:     []string{"app.tunnel.example.com"},
+		NotBefore:    thisUpdate.Add(-time.Hour),
+		NotAfter:     thisUpdate.Add(90 * 24 * time.Hour),
+		OCSPServer:   []string{responder.URL},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create leaf: %v", err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{leafDER, caDER},
+		PrivateKey:  crypto.Signer(leafKey),
+	}, hits
+}
+
+func waitForStaple(t *testing.T, s *ocspStapler, cert *tls.Certificate) *tls.Certificate {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if stapled := s.staple(cert); stapled.OCSPStaple != nil {
+			return stapled
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for OCSP staple")
+	return nil
+}
+
+func TestOCSPStaplerFetchesAndRefreshes(t *testing.T) {
+	thisUpdate := time.Now().Truncate(time.Second)
+	cert, hits := newOCSPTestChain(t, thisUpdate)
+
+	now := thisUpdate
+	s := newOCSPStapler()
+	s.now = func() time.Time { return now }
+
+	if first := s.staple(cert); first.OCSPStaple != nil {
+		t.Fatal("expected the first handshake to be served without waiting for a staple")
+	}
+
+	stapled := waitForStaple(t, s, cert)
+	if cert.OCSPStaple != nil {
+		t.Fatal("expected the original certificate to be left untouched")
+	}
+	if _, err := ocsp.ParseResponse(stapled.OCSPStaple, nil); err != nil {
+		t.Fatalf("staple is not a valid OCSP response: %v", err)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Fatalf("expected a single fetch, got %d", got)
+	}
+
+	// Before the refresh point the cached staple is reused without fetching.
+	now = thisUpdate.Add(47 * time.Hour)
+	s.staple(cert)
+	time.Sleep(50 * time.Millisecond)
+	if got := hits.Load(); got != 1 {
+		t.Fatalf("expected no refresh before the scheduled time, got %d fetches", got)
+	}
+
+	// Past the halfway point a background refresh is triggered.
+	now = thisUpdate.Add(49 * time.Hour)
+	if again := s.staple(cert); again.OCSPStaple == nil {
+		t.Fatal("expected the still-valid staple to be served while refreshing")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for hits.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := hits.Load(); got != 2 {
+		t.Fatalf("expected a refresh after the scheduled time, got %d fetches", got)
+	}
+}
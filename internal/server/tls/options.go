@@ -0,0 +1,90 @@
+package tls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// Options contains TLS hardening settings applied to both autocert and
+// manual certificate configurations.
+type Options struct {
+	MinVersion   string   // Minimum protocol version: "1.2" (default) or "1.3"
+	Curves       []string // Preferred curves in order: "X25519", "P256", "P384", "P521"
+	CertKeyType  string   // Key type requested from the ACME CA: "ecdsa" (default) or "rsa"
+	OCSPStapling bool     // Staple OCSP responses to served certificates
+	// GoDefaults uses Go's default cipher suites and curve preferences instead
+	// of the hardcoded lists. MinVersion still applies.
+	GoDefaults bool
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var curveIDs = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// defaultCurves is used when Options.Curves is empty.
+var defaultCurves = []tls.CurveID{tls.CurveP256, tls.X25519}
+
+// newServerConfig builds the base server tls.Config for opts.
+//
+// Returns:
+//   - *tls.Config: Configuration without certificates
+//   - error: Error if opts contains an unknown version, curve or key type
+func newServerConfig(opts Options) (*tls.Config, error) {
+	minVersion := uint16(tls.VersionTLS12)
+	if opts.MinVersion != "" {
+		v, ok := tlsVersions[opts.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS min version %q (use 1.2 or 1.3)", opts.MinVersion)
+		}
+		minVersion = v
+	}
+
+	curves := defaultCurves
+	if len(opts.Curves) > 0 {
+		curves = make([]tls.CurveID, 0, len(opts.Curves))
+		for _, name := range opts.Curves {
+			id, ok := curveIDs[strings.ToUpper(name)]
+			if !ok {
+				return nil, fmt.Errorf("unsupported TLS curve %q", name)
+			}
+			curves = append(curves, id)
+		}
+	}
+
+	switch opts.CertKeyType {
+	case "", "ecdsa", "rsa":
+	default:
+		return nil, fmt.Errorf("unsupported certificate key type %q (use ecdsa or rsa)", opts.CertKeyType)
+	}
+
+	if opts.GoDefaults {
+		cfg := &tls.Config{MinVersion: minVersion}
+		if len(opts.Curves) > 0 {
+			cfg.CurvePreferences = curves
+		}
+		return cfg, nil
+	}
+
+	return &tls.Config{
+		MinVersion: minVersion,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		},
+		PreferServerCipherSuites: true,
+		CurvePreferences:         curves,
+	}, nil
+}
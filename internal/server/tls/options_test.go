@@ -0,0 +1,151 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewServerConfigAppliesOptions(t *testing.T) {
+	cfg, err := newServerConfig(Options{
+		MinVersion: "1.3",
+		Curves:     []string{"x25519", "P384"},
+	})
+	if err != nil {
+		t.Fatalf("newServerConfig failed: %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("expected TLS 1.3 minimum, got %#x", cfg.MinVersion)
+	}
+	want := []tls.CurveID{tls.X25519, tls.CurveP384}
+	if !reflect.DeepEqual(cfg.CurvePreferences, want) {
+		t.Fatalf("unexpected curve preferences: %v", cfg.CurvePreferences)
+	}
+}
+
+func TestNewServerConfigDefaults(t *testing.T) {
+	cfg, err := newServerConfig(Options{})
+	if err != nil {
+		t.Fatalf("newServerConfig failed: %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("expected TLS 1.2 minimum, got %#x", cfg.MinVersion)
+	}
+	if !reflect.DeepEqual(cfg.CurvePreferences, defaultCurves) {
+		t.Fatalf("unexpected default curves: %v", cfg.CurvePreferences)
+	}
+}
+
+func TestNewServerConfigRejectsUnknownValues(t *testing.T) {
+	cases := []Options{
+		{MinVersion: "1.1"},
+		{Curves: []string{"P192"}},
+		{CertKeyType: "ed25519"},
+	}
+	for _, opts := range cases {
+		if _, err := newServerConfig(opts); err == nil {
+			t.Errorf("expected options %+v to be rejected", opts)
+		}
+	}
+}
+
+func TestNewCertManagerCertKeyType(t *testing.T) {
+	cm, err := NewCertManager(&Config{
+		Domain:   "tunnel.example.com",
+		CacheDir: t.TempDir(),
+		Options:  Options{MinVersion: "1.3", CertKeyType: "rsa"},
+	})
+	if err != nil {
+		t.Fatalf("NewCertManager failed: %v", err)
+	}
+	if !cm.manager.ForceRSA {
+		t.Fatal("expected RSA certificates to be requested")
+	}
+	if cm.TLSConfig().MinVersion != tls.VersionTLS13 {
+		t.Fatal("expected autocert config to use the configured minimum version")
+	}
+}
+
+func TestNewServerConfigGoDefaults(t *testing.T) {
+	cfg, err := newServerConfig(Options{GoDefaults: true, MinVersion: "1.3"})
+	if err != nil {
+		t.Fatalf("newServerConfig failed: %v", err)
+	}
+	if cfg.CipherSuites != nil {
+		t.Fatalf("expected no custom cipher list, got %v", cfg.CipherSuites)
+	}
+	if cfg.PreferServerCipherSuites {
+		t.Fatal("expected PreferServerCipherSuites to be left unset")
+	}
+	if cfg.CurvePreferences != nil {
+		t.Fatalf("expected Go's default curves, got %v", cfg.CurvePreferences)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("expected min version to still apply, got %#x", cfg.MinVersion)
+	}
+
+	cfg, err = newServerConfig(Options{GoDefaults: true, Curves: []string{"P384"}})
+	if err != nil {
+		t.Fatalf("newServerConfig failed: %v", err)
+	}
+	if !reflect.DeepEqual(cfg.CurvePreferences, []tls.CurveID{tls.CurveP384}) {
+		t.Fatalf("expected explicit curves to apply, got %v", cfg.CurvePreferences)
+	}
+}
+
+func TestLoadManualCertsGoDefaults(t *testing.T) {
+	certPath, keyPath := writeTestCertificate(t)
+	cfg, err := LoadManualCerts(certPath, keyPath, Options{GoDefaults: true})
+	if err != nil {
+		t.Fatalf("LoadManualCerts failed: %v", err)
+	}
+	if cfg.CipherSuites != nil {
+		t.Fatalf("expected no custom cipher list, got %v", cfg.CipherSuites)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate and key as PEM files.
+func writeTestCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tunnel.example.com"},
+		DNSNames:     []string{"tunnel.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certPath, keyPath
+}
@@ -0,0 +1,221 @@
+// Package webhook notifies external systems of tunnel lifecycle events.
+//
+// Events are POSTed as JSON to every configured URL from a background
+// goroutine, so the control plane never waits for a receiver. Each body is
+// signed with an HMAC-SHA256 of a shared secret, sent in the
+// X-Tunnelab-Signature header as "sha256=<hex>", and deliveries that fail or
+// get a non-2xx answer are retried with exponential backoff.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event types sent to webhook receivers.
+const (
+	// EventTunnelCreated is sent when a tunnel is registered.
+	EventTunnelCreated = "tunnel.created"
+	// EventTunnelClosed is sent when a tunnel is unregistered, with a reason.
+	EventTunnelClosed = "tunnel.closed"
+	// EventAuthFailed is sent when a control connection presents an invalid token.
+	EventAuthFailed = "auth.failed"
+)
+
+// Headers set on every webhook request.
+const (
+	EventHeader     = "X-Tunnelab-Event"
+	SignatureHeader = "X-Tunnelab-Signature"
+)
+
+// queueSize bounds the events waiting for delivery; newer events are dropped
+// while the queue is full so a slow receiver cannot grow memory unbounded.
+const queueSize = 1024
+
+// Event is the JSON body of a webhook request.
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	TunnelID   string    `json:"tunnel_id,omitempty"`
+	ClientID   string    `json:"client_id,omitempty"`
+	Subdomain  string    `json:"subdomain,omitempty"`
+	Protocol   string    `json:"protocol,omitempty"`
+	PublicURL  string    `json:"public_url,omitempty"`
+	PublicPort int       `json:"public_port,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+}
+
+// Config configures a Notifier.
+type Config struct {
+	URLs    []string      // Receivers every event is POSTed to
+	Secret  string        // Key of the HMAC signature ("" sends no signature)
+	Events  []string      // Event types to send (empty sends all)
+	Retries int           // Further attempts after a failed delivery
+	Timeout time.Duration // Bound of each delivery attempt
+}
+
+// Notifier delivers events to webhook receivers in the background.
+type Notifier struct {
+	urls    []string
+	secret  []byte
+	events  map[string]bool
+	retries int
+	client  *http.Client
+	backoff time.Duration // Wait before the first retry, doubled for each further one
+
+	queue     chan Event
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewNotifier creates a Notifier and starts its delivery goroutine.
+//
+// Parameters:
+//   - cfg: Receivers, secret, event filter and retry settings
+//
+// Returns:
+//   - *Notifier: The notifier, or nil if no URLs are configured
+func NewNotifier(cfg Config) *Notifier {
+	if len(cfg.URLs) == 0 {
+		return nil
+	}
+	n := &Notifier{
+		urls:    cfg.URLs,
+		secret:  []byte(cfg.Secret),
+		retries: cfg.Retries,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		backoff: time.Second,
+		queue:   make(chan Event, queueSize),
+		done:    make(chan struct{}),
+	}
+	if len(cfg.Events) > 0 {
+		n.events = make(map[string]bool, len(cfg.Events))
+		for _, event := range cfg.Events {
+			n.events[event] = true
+		}
+	}
+	n.wg.Add(1)
+	go n.run()
+	return n
+}
+
+// Notify queues event for delivery without blocking. Events of types that
+// are filtered out, and events sent while the queue is full, are dropped.
+// A nil Notifier ignores every event.
+//
+// Parameters:
+//   - event: The event; a zero Time is set to the current time
+func (n *Notifier) Notify(event Event) {
+	if n == nil || (n.events != nil && !n.events[event.Type]) {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	select {
+	case <-n.done:
+	case n.queue <- event:
+	default:
+		log.Printf("Webhook queue full, dropping %s event", event.Type)
+	}
+}
+
+// Close stops delivering events and waits for the delivery in progress.
+// Queued events that were not sent yet are dropped.
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	n.closeOnce.Do(func() { close(n.done) })
+	n.wg.Wait()
+}
+
+// run delivers queued events until the notifier is closed.
+func (n *Notifier) run() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.done:
+			return
+		case event := <-n.queue:
+			body, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Failed to encode %s webhook event: %v", event.Type, err)
+				continue
+			}
+			for _, url := range n.urls {
+				n.deliver(url, event.Type, body)
+			}
+		}
+	}
+}
+
+// deliver POSTs body to url, retrying failed attempts with exponential
+// backoff until the retries are used up or the notifier is closed.
+func (n *Notifier) deliver(url, eventType string, body []byte) {
+	wait := n.backoff
+	for attempt := 0; ; attempt++ {
+		err := n.post(url, eventType, body)
+		if err == nil {
+			return
+		}
+		if attempt >= n.retries {
+			log.Printf("Failed to deliver %s webhook to %s after %d attempts: %v", eventType, url, attempt+1, err)
+			return
+		}
+		select {
+		case <-n.done:
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// post makes one delivery attempt.
+func (n *Notifier) post(url, eventType string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, eventType)
+	if len(n.secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(n.secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the X-Tunnelab-Signature value of a webhook body, so
+// receivers can verify it with the shared secret.
+//
+// Parameters:
+//   - secret: The shared webhook secret
+//   - body: The raw request body
+//
+// Returns:
+//   - string: "sha256=" followed by the hex HMAC-SHA256 of body
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
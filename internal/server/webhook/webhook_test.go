@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNotifierDeliversSignedEventWithRetry(t *testing.T) {
+	received := make(chan Event, 1)
+	var attempts atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if attempts.Add(1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		if got, want := r.Header.Get(SignatureHeader), Sign([]byte("secret"), body); got != want {
+			t.Errorf("expected signature %s, got %s", want, got)
+		}
+		if r.Header.Get(EventHeader) != EventTunnelCreated {
+			t.Errorf("expected event header %s, got %s", EventTunnelCreated, r.Header.Get(EventHeader))
+		}
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("failed to decode event: %v", err)
+		}
+		received <- event
+	}))
+	defer receiver.Close()
+
+	n := NewNotifier(Config{URLs: []string{receiver.URL}, Secret: "secret", Retries: 2, Timeout: time.Second})
+	n.backoff = 10 * time.Millisecond
+	defer n.Close()
+
+	n.Notify(Event{Type: EventTunnelCreated, TunnelID: "tunnel-1", Subdomain: "demo", ClientID: "client"})
+
+	select {
+	case event := <-received:
+		if event.TunnelID != "tunnel-1" || event.Subdomain != "demo" || event.Time.IsZero() {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the event to be delivered after a retry")
+	}
+	if attempts.Load() != 2 {
+		t.Fatalf("expected two attempts, got %d", attempts.Load())
+	}
+}
+
+func TestNotifierFiltersEvents(t *testing.T) {
+	received := make(chan string, 2)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(EventHeader)
+	}))
+	defer receiver.Close()
+
+	n := NewNotifier(Config{URLs: []string{receiver.URL}, Events: []string{EventAuthFailed}, Timeout: time.Second})
+	defer n.Close()
+	n.Notify(Event{Type: EventTunnelCreated})
+	n.Notify(Event{Type: EventAuthFailed})
+
+	select {
+	case got := <-received:
+		if got != EventAuthFailed {
+			t.Fatalf("expected only %s to be delivered, got %s", EventAuthFailed, got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the auth failure to be delivered")
+	}
+}
+
+func TestNilNotifierIgnoresEvents(t *testing.T) {
+	n := NewNotifier(Config{})
+	if n != nil {
+		t.Fatal("expected no notifier without URLs")
+	}
+	n.Notify(Event{Type: EventTunnelClosed})
+	n.Close()
+}
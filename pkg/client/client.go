@@ -0,0 +1,394 @@
+// Package client is a Go SDK for TunneLab servers.
+//
+// It implements the client side of the control protocol in pkg/protocol:
+// authenticating on the WebSocket control connection, requesting tunnels and
+// accepting the yamux session each tunnel's traffic arrives on. Every public
+// connection to a tunnel reaches the client as one stream, which is passed to
+// a StreamHandler, typically to be copied to a local server. When the mux
+// session of a tunnel drops, the server asks for a new one, which the client
+// connects and Serve carries on with.
+//
+// Usage:
+//
+//	c := client.New(client.Config{ServerURL: "ws://localhost:4443/tunnel", Token: token})
+//	if err := c.Connect(ctx); err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//
+//	tunnel, err := c.CreateTunnel(ctx, client.TunnelRequest{Subdomain: "demo", LocalPort: 8000})
+//	if err != nil {
+//		return err
+//	}
+//	log.Printf("Tunnel ready at %s", tunnel.PublicURL)
+//	return tunnel.Serve(func(stream net.Conn) {
+//		// Copy stream to and from the local server, then close it.
+//	})
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+)
+
+// ErrNotConnected is returned by requests made before Connect succeeded,
+// after Close, or after the control connection was lost or given up by a
+// request whose context ended.
+var ErrNotConnected = errors.New("client is not connected")
+
+// Config configures a Client.
+type Config struct {
+	ServerURL string // WebSocket URL of the control server, e.g. ws://localhost:4443/tunnel
+	Token     string // Authentication token
+	Sign      bool   // Sign control messages with an HMAC derived from Token
+
+	// Dialer opens the control connection (nil uses websocket.DefaultDialer).
+	Dialer *websocket.Dialer
+	// OnMessage, when set, receives server messages that are not the
+	// answer to a request, such as stats, tunnel_closed or heartbeat
+	// replies. It is called on the goroutine reading the control
+	// connection, so it must not block or make requests.
+	OnMessage func(*protocol.ControlMessage)
+	// MaxConcurrentStreams caps the streams handled at once across all
+	// tunnels of the client (0 means no limit). Past it, Serve stops
+	// accepting: new streams wait in the session's accept backlog, and the
+	// server's attempts to open more fail once the backlog is full.
+	MaxConcurrentStreams int
+}
+
+// Client is a connection to a TunneLab server. Requests are answered in the
+// order they are sent, so a Client makes one at a time; Heartbeat may be
+// called concurrently with them. A request whose context ends before its
+// answer arrives closes the control connection, since the server may still
+// act on it; call Connect again to go on.
+type Client struct {
+	cfg        Config
+	signingKey []byte
+	streams    chan struct{} // Semaphore of MaxConcurrentStreams (nil means no limit)
+
+	reqMu   sync.Mutex // Serializes request/response exchanges
+	writeMu sync.Mutex // Serializes writes to conn and guards it
+	conn    *controlConn
+}
+
+// controlConn is one control connection. Its read loop hands answers to the
+// waiting request, reconnects the mux sessions of its tunnels and passes
+// other messages to OnMessage.
+type controlConn struct {
+	ws   *websocket.Conn
+	done chan struct{} // Closed when the read loop ends
+	err  error         // Why the read loop ended, set before done is closed
+
+	mu      sync.Mutex
+	waiter  *waiter            // The request waiting for its answer (nil if none)
+	tunnels map[string]*Tunnel // Tunnels created over the connection, by ID
+}
+
+// waiter receives the messages its match function accepts for a request.
+// match runs on the read loop, under the connection's mu.
+type waiter struct {
+	match func(*protocol.ControlMessage) bool
+	msgs  chan *protocol.ControlMessage
+}
+
+// New creates a Client. It does not connect; call Connect.
+//
+// Parameters:
+//   - cfg: Server URL, token and options
+//
+// Returns:
+//   - *Client: The client
+func New(cfg Config) *Client {
+	c := &Client{cfg: cfg}
+	if cfg.Sign {
+		c.signingKey = protocol.DeriveSigningKey(cfg.Token)
+	}
+	if cfg.MaxConcurrentStreams > 0 {
+		c.streams = make(chan struct{}, cfg.MaxConcurrentStreams)
+	}
+	return c
+}
+
+// Connect opens the control connection and authenticates with the token. A
+// previous connection of the client is closed first, so a failed Connect
+// may simply be called again.
+//
+// Parameters:
+//   - ctx: Bounds the dial and the authentication
+//
+// Returns:
+//   - error: Error if the server is unreachable or rejects the token; a
+//     rejection is a *ServerError
+func (c *Client) Connect(ctx context.Context) error {
+	c.reqMu.Lock()
+	defer c.reqMu.Unlock()
+	c.Close()
+
+	dialer := c.cfg.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	ws, _, err := dialer.DialContext(ctx, c.cfg.ServerURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", c.cfg.ServerURL, err)
+	}
+	conn := &controlConn{ws: ws, done: make(chan struct{}), tunnels: make(map[string]*Tunnel)}
+	c.writeMu.Lock()
+	c.conn = conn
+	c.writeMu.Unlock()
+	go c.readLoop(conn)
+
+	resp, err := c.exchange(ctx, protocol.MsgTypeAuth, map[string]interface{}{"token": c.cfg.Token}, protocol.MsgTypeAuthResponse)
+	if err == nil {
+		if success, _ := resp.Payload["success"].(bool); !success {
+			message, _ := resp.Payload["message"].(string)
+			err = &ServerError{Code: "AUTH_FAILED", Message: message}
+		}
+	}
+	if err != nil {
+		c.Close()
+		return fmt.Errorf("authentication failed: %w", err)
+	}
+	return nil
+}
+
+// Heartbeat sends a keep-alive message. The server's reply is passed to
+// OnMessage.
+//
+// Returns:
+//   - error: Error if the message cannot be sent
+func (c *Client) Heartbeat() error {
+	msg := protocol.NewControlMessage(protocol.MsgTypeHeartbeat, uuid.New().String(), map[string]interface{}{})
+	return c.write(msg)
+}
+
+// Close closes the control connection. The server then closes every tunnel
+// of the connection, and Serve returns for each.
+//
+// Returns:
+//   - error: Error from closing the connection
+func (c *Client) Close() error {
+	c.writeMu.Lock()
+	conn := c.conn
+	c.writeMu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return c.drop(conn)
+}
+
+// drop closes conn and, if it is still the client's connection, forgets it,
+// so later requests fail with ErrNotConnected.
+func (c *Client) drop(conn *controlConn) error {
+	c.writeMu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	c.writeMu.Unlock()
+	return conn.ws.Close()
+}
+
+// write signs msg when signing is enabled and sends it.
+func (c *Client) write(msg *protocol.ControlMessage) error {
+	if c.signingKey != nil {
+		if err := msg.Sign(c.signingKey); err != nil {
+			return err
+		}
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	return c.conn.ws.WriteJSON(msg)
+}
+
+// exchange sends a request and waits for its answer of type want, or an
+// error message. Callers hold reqMu.
+func (c *Client) exchange(ctx context.Context, msgType protocol.MessageType, payload map[string]interface{}, want protocol.MessageType) (*protocol.ControlMessage, error) {
+	requestID := uuid.New().String()
+	conn, w, err := c.send(msgType, requestID, payload, 1, answerTo(requestID, want))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.clearWaiter(w)
+	return c.wait(ctx, conn, w)
+}
+
+// answerTo matches the answer of type want to the request requestID, or an
+// error message about it.
+func answerTo(requestID string, want protocol.MessageType) func(*protocol.ControlMessage) bool {
+	return func(msg *protocol.ControlMessage) bool {
+		if msg.Type == protocol.MsgTypeError {
+			// Errors about a request carry its ID; older servers sent none.
+			return msg.RequestID == requestID || msg.RequestID == ""
+		}
+		return msg.Type == want
+	}
+}
+
+// send registers a waiter for up to n messages accepted by match, then sends
+// the request, so its answer cannot arrive unseen. Callers hold reqMu and
+// clear the waiter when done.
+func (c *Client) send(msgType protocol.MessageType, requestID string, payload map[string]interface{}, n int, match func(*protocol.ControlMessage) bool) (*controlConn, *waiter, error) {
+	c.writeMu.Lock()
+	conn := c.conn
+	c.writeMu.Unlock()
+	if conn == nil {
+		return nil, nil, fmt.Errorf("failed to send %s: %w", msgType, ErrNotConnected)
+	}
+	w := &waiter{match: match, msgs: make(chan *protocol.ControlMessage, n)}
+	conn.mu.Lock()
+	conn.waiter = w
+	conn.mu.Unlock()
+	if err := c.write(protocol.NewControlMessage(msgType, requestID, payload)); err != nil {
+		conn.clearWaiter(w)
+		return nil, nil, fmt.Errorf("failed to send %s: %w", msgType, err)
+	}
+	return conn, w, nil
+}
+
+// wait returns the next message w accepted; an error message is returned as
+// a *ServerError. If ctx ends first, the connection is closed: the server may
+// still answer or act on the request, and the answer could be taken for that
+// of a later request.
+func (c *Client) wait(ctx context.Context, conn *controlConn, w *waiter) (*protocol.ControlMessage, error) {
+	var msg *protocol.ControlMessage
+	select {
+	case msg = <-w.msgs:
+	case <-conn.done:
+		select {
+		case msg = <-w.msgs:
+		default:
+			return nil, fmt.Errorf("failed to read from server: %w", conn.err)
+		}
+	case <-ctx.Done():
+		c.drop(conn)
+		return nil, ctx.Err()
+	}
+	if msg.Type == protocol.MsgTypeError {
+		return nil, ParseServerError(msg)
+	}
+	return msg, nil
+}
+
+// readLoop reads the messages of conn until it fails. Messages the waiting
+// request accepts go to it, establish_mux messages for an existing tunnel
+// reconnect its mux session, and the rest go to OnMessage. The tunnels of
+// the connection end with it.
+func (c *Client) readLoop(conn *controlConn) {
+	for {
+		var msg protocol.ControlMessage
+		if err := conn.ws.ReadJSON(&msg); err != nil {
+			conn.err = err
+			close(conn.done)
+			c.drop(conn)
+			conn.mu.Lock()
+			tunnels := conn.tunnels
+			conn.tunnels = nil
+			conn.mu.Unlock()
+			for _, tunnel := range tunnels {
+				tunnel.end(fmt.Errorf("control connection lost: %w", err))
+			}
+			return
+		}
+		if conn.deliver(&msg) {
+			continue
+		}
+
+		id, _ := msg.Payload["tunnel_id"].(string)
+		switch msg.Type {
+		case protocol.MsgTypeNewConn:
+			action, _ := msg.Payload["action"].(string)
+			if tunnel := conn.tunnel(id); tunnel != nil && action == "establish_mux" {
+				// The previous session closed; the server waits for a new one.
+				go tunnel.reconnect(&msg)
+				continue
+			}
+		case protocol.MsgTypeTunnelClosed:
+			if tunnel := conn.removeTunnel(id); tunnel != nil {
+				reason, _ := msg.Payload["reason"].(string)
+				tunnel.end(fmt.Errorf("closed by the server: %s", reason))
+			}
+		}
+		if c.cfg.OnMessage != nil {
+			c.cfg.OnMessage(&msg)
+		}
+	}
+}
+
+// deliver hands msg to the waiting request if it accepts it.
+func (conn *controlConn) deliver(msg *protocol.ControlMessage) bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.waiter == nil || !conn.waiter.match(msg) {
+		return false
+	}
+	select {
+	case conn.waiter.msgs <- msg:
+	default:
+	}
+	return true
+}
+
+// clearWaiter removes w once its request is done.
+func (conn *controlConn) clearWaiter(w *waiter) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.waiter == w {
+		conn.waiter = nil
+	}
+}
+
+// addTunnel records a tunnel created over the connection. It reports false
+// if the connection is already gone.
+func (conn *controlConn) addTunnel(tunnel *Tunnel) bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.tunnels == nil {
+		return false
+	}
+	conn.tunnels[tunnel.ID] = tunnel
+	return true
+}
+
+func (conn *controlConn) tunnel(id string) *Tunnel {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.tunnels[id]
+}
+
+func (conn *controlConn) removeTunnel(id string) *Tunnel {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	tunnel := conn.tunnels[id]
+	delete(conn.tunnels, id)
+	return tunnel
+}
+
+// dialMux connects the yamux session announced by a new_connection message.
+func dialMux(ctx context.Context, msg *protocol.ControlMessage) (*yamux.Session, error) {
+	muxAddr, _ := msg.Payload["mux_addr"].(string)
+	if muxAddr == "" {
+		return nil, fmt.Errorf("server sent no mux address")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", muxAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to mux %s: %w", muxAddr, err)
+	}
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create yamux session: %w", err)
+	}
+	return session, nil
+}
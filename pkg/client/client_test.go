@@ -0,0 +1,452 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+)
+
+// fakeServer runs script on the control connection of each client that
+// connects to it.
+func fakeServer(t *testing.T, script func(conn *websocket.Conn)) string {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+		script(conn)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// expectMessage reads the next client message and checks its type.
+func expectMessage(t *testing.T, conn *websocket.Conn, want protocol.MessageType) *protocol.ControlMessage {
+	t.Helper()
+	var msg protocol.ControlMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Errorf("failed to read %s: %v", want, err)
+		return nil
+	}
+	if msg.Type != want {
+		t.Errorf("expected %s, got %s", want, msg.Type)
+		return nil
+	}
+	return &msg
+}
+
+// acceptAuth answers the client's auth message with success.
+func acceptAuth(t *testing.T, conn *websocket.Conn) bool {
+	t.Helper()
+	auth := expectMessage(t, conn, protocol.MsgTypeAuth)
+	if auth == nil {
+		return false
+	}
+	if auth.Payload["token"] != "token" {
+		t.Errorf("expected the configured token, got %v", auth.Payload["token"])
+	}
+	conn.WriteJSON(protocol.NewControlMessage(protocol.MsgTypeAuthResponse, auth.RequestID, map[string]interface{}{"success": true}))
+	return true
+}
+
+func TestClientCreatesTunnelAndServesStreams(t *testing.T) {
+	muxListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer muxListener.Close()
+
+	url := fakeServer(t, func(conn *websocket.Conn) {
+		if !acceptAuth(t, conn) {
+			return
+		}
+		req := expectMessage(t, conn, protocol.MsgTypeTCPReq)
+		if req == nil {
+			return
+		}
+		if req.Payload["subdomain"] != "db" || req.Payload["local_port"] != float64(5432) || req.Payload["ttl_seconds"] != float64(60) ||
+			req.Payload["local_scheme"] != "https" {
+			t.Errorf("unexpected tunnel request payload %v", req.Payload)
+		}
+		// Unrelated messages may arrive before the answer.
+		conn.WriteJSON(protocol.NewControlMessage(protocol.MsgTypeStats, "", map[string]interface{}{"tunnels": []interface{}{}}))
+		conn.WriteJSON(protocol.NewControlMessage(protocol.MsgTypeTCPResp, req.RequestID, map[string]interface{}{
+			"tunnel_id": "tunnel-1", "subdomain": "db", "status": "active",
+			"public_port": 30000, "public_endpoint": "tunnel.example.com:30000",
+		}))
+		conn.WriteJSON(protocol.NewControlMessage(protocol.MsgTypeNewConn, "", map[string]interface{}{
+			"action": "establish_mux", "tunnel_id": "tunnel-1", "mux_addr": muxListener.Addr().String(),
+		}))
+		// Keep the control connection open until the client closes it.
+		var msg protocol.ControlMessage
+		for conn.ReadJSON(&msg) == nil {
+		}
+	})
+
+	var skipped []protocol.MessageType
+	c := New(Config{ServerURL: url, Token: "token", OnMessage: func(msg *protocol.ControlMessage) {
+		skipped = append(skipped, msg.Type)
+	}})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	tunnel, err := c.CreateTunnel(ctx, TunnelRequest{
+		Subdomain: "db",
+		Protocol:  "tcp",
+		LocalPort: 5432,
+		Options:   map[string]interface{}{"ttl_seconds": 60},
+
+		LocalScheme: "https",
+	})
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	defer tunnel.Close()
+	if tunnel.ID != "tunnel-1" || tunnel.PublicPort != 30000 || tunnel.PublicEndpoint != "tunnel.example.com:30000" {
+		t.Fatalf("unexpected tunnel %+v", tunnel)
+	}
+	if len(skipped) != 1 || skipped[0] != protocol.MsgTypeStats {
+		t.Fatalf("expected the stats message to be passed to OnMessage, got %v", skipped)
+	}
+
+	// Stand in for the server's side of the mux session.
+	muxConn, err := muxListener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept the mux connection: %v", err)
+	}
+	serverSession, err := yamux.Server(muxConn, nil)
+	if err != nil {
+		t.Fatalf("failed to create server session: %v", err)
+	}
+	defer serverSession.Close()
+	go tunnel.Serve(func(stream net.Conn) {
+		defer stream.Close()
+		io.Copy(stream, stream)
+	})
+
+	stream, err := serverSession.OpenStream()
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatalf("failed to write to stream: %v", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(stream, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("expected the handler to echo %q, got %q (%v)", "ping", reply, err)
+	}
+}
+
+func TestClientReturnsServerErrors(t *testing.T) {
+	tests := map[string]struct {
+		script     func(t *testing.T, conn *websocket.Conn)
+		code       string
+		retryAfter time.Duration
+	}{
+		"auth rejected": {
+			script: func(t *testing.T, conn *websocket.Conn) {
+				if auth := expectMessage(t, conn, protocol.MsgTypeAuth); auth != nil {
+					conn.WriteJSON(protocol.NewErrorMessage(auth.RequestID, "INVALID_TOKEN", "Invalid token"))
+				}
+			},
+			code: "INVALID_TOKEN",
+		},
+		"tunnel rate limited": {
+			script: func(t *testing.T, conn *websocket.Conn) {
+				if !acceptAuth(t, conn) {
+					return
+				}
+				if req := expectMessage(t, conn, protocol.MsgTypeTunnelReq); req != nil {
+					conn.WriteJSON(protocol.NewErrorMessageWithDetails(req.RequestID, "RATE_LIMITED", "Too many requests",
+						map[string]interface{}{protocol.DetailRetryAfter: 3}))
+				}
+			},
+			code:       "RATE_LIMITED",
+			retryAfter: 3 * time.Second,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			url := fakeServer(t, func(conn *websocket.Conn) { tt.script(t, conn) })
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			c := New(Config{ServerURL: url, Token: "token"})
+			defer c.Close()
+			err := c.Connect(ctx)
+			if err == nil {
+				_, err = c.CreateTunnel(ctx, TunnelRequest{Subdomain: "app", LocalPort: 3000})
+			}
+			var serverErr *ServerError
+			if !errors.As(err, &serverErr) {
+				t.Fatalf("expected a server error, got %v", err)
+			}
+			if serverErr.Code != tt.code || serverErr.RetryAfter != tt.retryAfter {
+				t.Fatalf("expected %s with retry hint %v, got %+v", tt.code, tt.retryAfter, serverErr)
+			}
+		})
+	}
+}
+
+func TestClientSignsMessages(t *testing.T) {
+	key := protocol.DeriveSigningKey("token")
+	url := fakeServer(t, func(conn *websocket.Conn) {
+		auth := expectMessage(t, conn, protocol.MsgTypeAuth)
+		if auth == nil {
+			return
+		}
+		if err := auth.Verify(key); err != nil {
+			t.Errorf("expected a signed auth message: %v", err)
+		}
+		conn.WriteJSON(protocol.NewControlMessage(protocol.MsgTypeAuthResponse, auth.RequestID, map[string]interface{}{"success": true}))
+	})
+
+	c := New(Config{ServerURL: url, Token: "token", Sign: true})
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+}
+
+func TestClientRequestHonorsContext(t *testing.T) {
+	url := fakeServer(t, func(conn *websocket.Conn) {
+		if !acceptAuth(t, conn) {
+			return
+		}
+		// Never answer the tunnel request.
+		var msg protocol.ControlMessage
+		for conn.ReadJSON(&msg) == nil {
+		}
+	})
+
+	c := New(Config{ServerURL: url, Token: "token"})
+	defer c.Close()
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.CreateTunnel(ctx, TunnelRequest{Subdomain: "app", LocalPort: 3000}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the request to end with its context, got %v", err)
+	}
+	// The server may still answer, so the connection is given up.
+	if _, err := c.CreateTunnel(context.Background(), TunnelRequest{Subdomain: "app", LocalPort: 3000}); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected later requests to fail with ErrNotConnected, got %v", err)
+	}
+	if err := c.Heartbeat(); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected heartbeats to fail with ErrNotConnected, got %v", err)
+	}
+}
+
+// expectEcho opens a stream on session and checks that it is echoed.
+func expectEcho(t *testing.T, session *yamux.Session) {
+	t.Helper()
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatalf("failed to write to stream: %v", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(stream, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("expected the handler to echo %q, got %q (%v)", "ping", reply, err)
+	}
+}
+
+func TestTunnelReconnectsMuxSession(t *testing.T) {
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer ln.Close()
+		listeners = append(listeners, ln)
+	}
+
+	sessions := make(chan *yamux.Session)
+	url := fakeServer(t, func(conn *websocket.Conn) {
+		if !acceptAuth(t, conn) {
+			return
+		}
+		req := expectMessage(t, conn, protocol.MsgTypeTunnelReq)
+		if req == nil {
+			return
+		}
+		conn.WriteJSON(protocol.NewControlMessage(protocol.MsgTypeTunnelResp, req.RequestID, map[string]interface{}{
+			"tunnel_id": "tunnel-1", "subdomain": "app", "public_url": "https://app.tunnel.example.com",
+		}))
+		// Ask for a new mux session each time the previous one closes.
+		for _, ln := range listeners {
+			conn.WriteJSON(protocol.NewControlMessage(protocol.MsgTypeNewConn, "", map[string]interface{}{
+				"action": "establish_mux", "tunnel_id": "tunnel-1", "mux_addr": ln.Addr().String(),
+			}))
+			muxConn, err := ln.Accept()
+			if err != nil {
+				t.Errorf("failed to accept the mux connection: %v", err)
+				return
+			}
+			session, err := yamux.Server(muxConn, nil)
+			if err != nil {
+				t.Errorf("failed to create server session: %v", err)
+				return
+			}
+			sessions <- session
+			<-session.CloseChan()
+		}
+		conn.WriteJSON(protocol.NewControlMessage(protocol.MsgTypeTunnelClosed, "tunnel-1", map[string]interface{}{
+			"tunnel_id": "tunnel-1", "reason": "mux_session_closed",
+		}))
+		var msg protocol.ControlMessage
+		for conn.ReadJSON(&msg) == nil {
+		}
+	})
+
+	c := New(Config{ServerURL: url, Token: "token"})
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	tunnel, err := c.CreateTunnel(ctx, TunnelRequest{Subdomain: "app", LocalPort: 3000})
+	if err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- tunnel.Serve(func(stream net.Conn) {
+			defer stream.Close()
+			io.Copy(stream, stream)
+		})
+	}()
+
+	first := <-sessions
+	expectEcho(t, first)
+	first.Close()
+
+	var second *yamux.Session
+	select {
+	case second = <-sessions:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the client to connect the new mux session")
+	}
+	expectEcho(t, second)
+	select {
+	case err := <-served:
+		t.Fatalf("expected Serve to go on with the new session, got %v", err)
+	default:
+	}
+
+	second.Close()
+	select {
+	case err := <-served:
+		if err == nil || !strings.Contains(err.Error(), "mux_session_closed") {
+			t.Fatalf("expected Serve to end with the tunnel_closed reason, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected Serve to end once the server closed the tunnel")
+	}
+}
+
+func TestCreateTunnelRejectsUnknownProtocol(t *testing.T) {
+	c := New(Config{})
+	if _, err := c.CreateTunnel(context.Background(), TunnelRequest{Protocol: "udp", LocalPort: 53}); err == nil || !strings.Contains(err.Error(), "unsupported protocol") {
+		t.Fatalf("expected an unsupported protocol error, got %v", err)
+	}
+}
+
+func TestServeBoundsConcurrentHandlers(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	serverSession, err := yamux.Server(serverConn, nil)
+	if err != nil {
+		t.Fatalf("failed to create server session: %v", err)
+	}
+	defer serverSession.Close()
+	clientSession, err := yamux.Client(clientConn, nil)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	defer clientSession.Close()
+
+	const limit, streams = 2, 6
+	c := New(Config{MaxConcurrentStreams: limit})
+	tunnel := &Tunnel{session: clientSession, streams: c.streams}
+
+	var running, peak atomic.Int32
+	started := make(chan struct{}, streams)
+	unblock := make(chan struct{})
+	go tunnel.Serve(func(stream net.Conn) {
+		defer stream.Close()
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		started <- struct{}{}
+		<-unblock
+		running.Add(-1)
+	})
+
+	for i := 0; i < streams; i++ {
+		stream, err := serverSession.OpenStream()
+		if err != nil {
+			t.Fatalf("failed to open stream: %v", err)
+		}
+		defer stream.Close()
+	}
+
+	for i := 0; i < limit; i++ {
+		select {
+		case <-started:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %d handlers to start, got %d", limit, i)
+		}
+	}
+	select {
+	case <-started:
+		t.Fatalf("expected at most %d handlers to run at once", limit)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(unblock)
+	for i := limit; i < streams; i++ {
+		select {
+		case <-started:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected queued streams to be handled once slots free up, got %d of %d", i, streams)
+		}
+	}
+	if p := peak.Load(); p > limit {
+		t.Fatalf("expected at most %d concurrent handlers, saw %d", limit, p)
+	}
+}
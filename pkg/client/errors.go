@@ -0,0 +1,37 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+)
+
+// ServerError is an error message returned by the server, such as
+// RATE_LIMITED or SUBDOMAIN_TAKEN.
+type ServerError struct {
+	Code       string
+	Message    string
+	RetryAfter time.Duration // Retry hint from the error details (zero if none)
+}
+
+func (e *ServerError) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// ParseServerError converts an error message from the server.
+//
+// Parameters:
+//   - msg: A message of type error
+//
+// Returns:
+//   - *ServerError: Its code, message and retry hint
+func ParseServerError(msg *protocol.ControlMessage) *ServerError {
+	code, _ := msg.Payload["code"].(string)
+	message, _ := msg.Payload["message"].(string)
+	retryAfter, _ := msg.RetryAfter()
+	return &ServerError{Code: code, Message: message, RetryAfter: retryAfter}
+}
@@ -0,0 +1,315 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/essajiwa/tunnelab/pkg/protocol"
+	"github.com/google/uuid"
+	"github.com/hashicorp/yamux"
+)
+
+// muxDialTimeout bounds connecting a replacement mux session.
+const muxDialTimeout = 10 * time.Second
+
+// errTunnelClosed ends Serve after Tunnel.Close.
+var errTunnelClosed = errors.New("tunnel closed")
+
+// TunnelRequest describes a tunnel to create.
+type TunnelRequest struct {
+	Subdomain string // Desired subdomain; may be empty when the server assigns one
+	Protocol  string // "http" (default), "tcp" or "grpc"
+	LocalHost string // Host of the local service, reported to the server (default localhost)
+	LocalPort int    // Port of the local service
+	SNI       bool   // Route a TCP tunnel by TLS server name on the shared SNI port
+	// LocalScheme is "https" when the handler reaches the local service over
+	// TLS, reported to the server. Empty means "http".
+	LocalScheme string
+
+	// StreamCompression lists the data stream compressions the client
+	// accepts, in order of preference (e.g. protocol.StreamCompressionDeflate).
+	StreamCompression []string
+	// Options holds further request fields, such as "ttl_seconds", "pool"
+	// or "max_streams", sent as they are.
+	Options map[string]interface{}
+}
+
+// Tunnel is a tunnel created by CreateTunnel.
+type Tunnel struct {
+	ID             string
+	Subdomain      string
+	Protocol       string
+	PublicURL      string // Public URL of an HTTP(S) or SNI-routed tunnel
+	PublicPort     int    // Public port of a TCP or gRPC tunnel
+	PublicEndpoint string // host:port to connect to for a TCP or gRPC tunnel
+
+	// StreamCompression is the negotiated data stream compression ("" means none).
+	StreamCompression string
+	// Payload is the complete tunnel response, for fields not covered above.
+	Payload map[string]interface{}
+
+	streams chan struct{} // Shared semaphore of the client (nil means no limit)
+
+	mu      sync.Mutex
+	session *yamux.Session
+	changed chan struct{} // Closed when session is replaced or the tunnel ends (nil if no one waits)
+	err     error         // Why the tunnel ended (nil while it is served)
+}
+
+// StreamHandler handles one public connection to a tunnel. The stream is
+// already decompressed; the handler owns it and must close it.
+type StreamHandler func(stream net.Conn)
+
+// requestTypes maps tunnel protocols to their request and response types.
+var requestTypes = map[string][2]protocol.MessageType{
+	"http":  {protocol.MsgTypeTunnelReq, protocol.MsgTypeTunnelResp},
+	"https": {protocol.MsgTypeTunnelReq, protocol.MsgTypeTunnelResp},
+	"tcp":   {protocol.MsgTypeTCPReq, protocol.MsgTypeTCPResp},
+	"grpc":  {protocol.MsgTypeGRPCReq, protocol.MsgTypeGRPCResp},
+}
+
+// CreateTunnel requests a tunnel and connects the mux session its traffic
+// arrives on. Call Serve on the returned tunnel to handle its connections.
+//
+// Parameters:
+//   - ctx: Bounds the request and the mux connection
+//   - req: The tunnel to create
+//
+// Returns:
+//   - *Tunnel: The created tunnel
+//   - error: Error if the request fails; a rejection by the server is a
+//     *ServerError, which may carry a retry hint
+func (c *Client) CreateTunnel(ctx context.Context, req TunnelRequest) (*Tunnel, error) {
+	proto := strings.ToLower(req.Protocol)
+	if proto == "" {
+		proto = "http"
+	}
+	types, ok := requestTypes[proto]
+	if !ok {
+		return nil, fmt.Errorf("unsupported protocol %q (use http, tcp or grpc)", req.Protocol)
+	}
+
+	payload := make(map[string]interface{}, len(req.Options)+6)
+	for key, value := range req.Options {
+		payload[key] = value
+	}
+	payload["protocol"] = proto
+	payload["local_port"] = req.LocalPort
+	if req.Subdomain != "" {
+		payload["subdomain"] = req.Subdomain
+	}
+	if req.LocalHost != "" {
+		payload["local_host"] = req.LocalHost
+	}
+	if req.LocalScheme != "" {
+		payload["local_scheme"] = req.LocalScheme
+	}
+	if req.SNI {
+		payload["routing"] = "sni"
+	}
+	if len(req.StreamCompression) > 0 {
+		payload["stream_compression"] = req.StreamCompression
+	}
+
+	c.reqMu.Lock()
+	defer c.reqMu.Unlock()
+	// The server announces the mux session right after the response, so the
+	// request waits for both.
+	requestID := uuid.New().String()
+	isAnswer := answerTo(requestID, types[1])
+	var answered, announced bool
+	var tunnelID string
+	conn, w, err := c.send(types[0], requestID, payload, 2, func(msg *protocol.ControlMessage) bool {
+		if !answered {
+			if !isAnswer(msg) {
+				return false
+			}
+			answered = true
+			tunnelID, _ = msg.Payload["tunnel_id"].(string)
+			return true
+		}
+		id, _ := msg.Payload["tunnel_id"].(string)
+		if announced || msg.Type != protocol.MsgTypeNewConn || id != tunnelID {
+			return false
+		}
+		announced = true
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.clearWaiter(w)
+
+	resp, err := c.wait(ctx, conn, w)
+	if err != nil {
+		return nil, err
+	}
+	tunnel := newTunnel(proto, resp.Payload)
+	tunnel.streams = c.streams
+
+	muxMsg, err := c.wait(ctx, conn, w)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive the mux address of tunnel %s: %w", tunnel.ID, err)
+	}
+	if tunnel.session, err = dialMux(ctx, muxMsg); err != nil {
+		return nil, err
+	}
+	if !conn.addTunnel(tunnel) {
+		tunnel.session.Close()
+		return nil, fmt.Errorf("failed to create tunnel %s: %w", tunnel.ID, ErrNotConnected)
+	}
+	return tunnel, nil
+}
+
+// newTunnel reads a tunnel response payload.
+func newTunnel(proto string, payload map[string]interface{}) *Tunnel {
+	t := &Tunnel{Protocol: proto, Payload: payload}
+	t.ID, _ = payload["tunnel_id"].(string)
+	t.Subdomain, _ = payload["subdomain"].(string)
+	t.PublicURL, _ = payload["public_url"].(string)
+	t.PublicEndpoint, _ = payload["public_endpoint"].(string)
+	t.StreamCompression, _ = payload["stream_compression"].(string)
+	if port, ok := payload["public_port"].(float64); ok {
+		t.PublicPort = int(port)
+	}
+	return t
+}
+
+// Serve accepts the streams of the tunnel and calls handler for each on its
+// own goroutine, until the tunnel ends. When the mux session closes, Serve
+// waits for the session the server asks the client to reconnect, and goes
+// on with it. With MaxConcurrentStreams set, no stream is accepted while
+// that many handlers are running.
+//
+// Parameters:
+//   - handler: Handles each stream
+//
+// Returns:
+//   - error: Why the tunnel ended: Close, its closing by the server or the
+//     loss of the control connection
+func (t *Tunnel) Serve(handler StreamHandler) error {
+	t.mu.Lock()
+	session := t.session
+	t.mu.Unlock()
+	for {
+		t.acquire()
+		stream, err := session.AcceptStream()
+		if err != nil {
+			t.release()
+			if !session.IsClosed() {
+				continue
+			}
+			if session, err = t.nextSession(session); err != nil {
+				return fmt.Errorf("tunnel session closed: %w", err)
+			}
+			continue
+		}
+		go func() {
+			defer t.release()
+			handler(protocol.WrapStream(stream, t.StreamCompression))
+		}()
+	}
+}
+
+// acquire waits for a free handler slot when the client limits concurrent streams.
+func (t *Tunnel) acquire() {
+	if t.streams != nil {
+		t.streams <- struct{}{}
+	}
+}
+
+// release frees a slot taken by acquire.
+func (t *Tunnel) release() {
+	if t.streams != nil {
+		<-t.streams
+	}
+}
+
+// nextSession waits until the session replacing the closed session old is
+// connected and returns it, or returns why the tunnel ended.
+func (t *Tunnel) nextSession(old *yamux.Session) (*yamux.Session, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.session == old && t.err == nil {
+		if t.changed == nil {
+			t.changed = make(chan struct{})
+		}
+		changed := t.changed
+		t.mu.Unlock()
+		<-changed
+		t.mu.Lock()
+	}
+	if t.err != nil {
+		return nil, t.err
+	}
+	return t.session, nil
+}
+
+// notifyLocked wakes nextSession. t.mu must be held.
+func (t *Tunnel) notifyLocked() {
+	if t.changed != nil {
+		close(t.changed)
+		t.changed = nil
+	}
+}
+
+// reconnect connects the mux session the server announced in msg after the
+// previous one closed, and hands it to Serve. If it cannot be connected,
+// the server closes the tunnel once its mux reconnect timeout passes.
+func (t *Tunnel) reconnect(msg *protocol.ControlMessage) {
+	t.mu.Lock()
+	ended := t.err != nil
+	t.mu.Unlock()
+	if ended {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), muxDialTimeout)
+	defer cancel()
+	session, err := dialMux(ctx, msg)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	if t.err != nil {
+		t.mu.Unlock()
+		session.Close()
+		return
+	}
+	old := t.session
+	t.session = session
+	t.notifyLocked()
+	t.mu.Unlock()
+	old.Close()
+}
+
+// end ends the tunnel with err, closing its session and ending Serve.
+func (t *Tunnel) end(err error) error {
+	t.mu.Lock()
+	if t.err == nil {
+		t.err = err
+		t.notifyLocked()
+	}
+	session := t.session
+	t.mu.Unlock()
+	if session == nil {
+		return nil
+	}
+	return session.Close()
+}
+
+// Close closes the mux session of the tunnel, ending Serve. The session is
+// not reconnected; the server keeps the tunnel until its mux reconnect
+// timeout passes or the control connection closes.
+//
+// Returns:
+//   - error: Error from closing the session
+func (t *Tunnel) Close() error {
+	return t.end(errTunnelClosed)
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// StreamCompressionDeflate compresses each tunneled data stream with DEFLATE.
+//
+// A client asks for stream compression with "stream_compression" in the
+// tunnel request payload (a name or a list of names in order of preference).
+// The server answers with the algorithm it picked in the tunnel response;
+// when the response has no "stream_compression", streams are uncompressed.
+// Both ends then wrap every yamux stream of the tunnel with WrapStream.
+const StreamCompressionDeflate = "deflate"
+
+var supportedStreamCompressions = []string{StreamCompressionDeflate}
+
+// NegotiateStreamCompression picks the first requested algorithm that is supported.
+//
+// Parameters:
+//   - requested: Algorithm names in the client's order of preference
+//
+// Returns:
+//   - string: The chosen algorithm, or "" for no compression
+func NegotiateStreamCompression(requested []string) string {
+	for _, name := range requested {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for _, supported := range supportedStreamCompressions {
+			if name == supported {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// WrapStream wraps a tunnel data stream with the negotiated compression.
+// Writes are flushed immediately so interactive traffic is not delayed.
+// Unknown or empty algorithms return conn unchanged.
+func WrapStream(conn net.Conn, algorithm string) net.Conn {
+	if algorithm != StreamCompressionDeflate {
+		return conn
+	}
+	writer, _ := flate.NewWriter(conn, flate.DefaultCompression)
+	return &compressedConn{
+		Conn:   conn,
+		reader: flate.NewReader(conn),
+		writer: writer,
+	}
+}
+
+// compressedConn compresses writes to and decompresses reads from a stream.
+type compressedConn struct {
+	net.Conn
+	reader  io.Reader
+	writeMu sync.Mutex
+	writer  *flate.Writer
+	closed  bool
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	n, err := c.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.writer.Flush()
+}
+
+// Close terminates the compressed stream so the peer reads a clean EOF,
+// then closes the underlying stream.
+func (c *compressedConn) Close() error {
+	c.writeMu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.writer.Close()
+	}
+	c.writeMu.Unlock()
+	return c.Conn.Close()
+}
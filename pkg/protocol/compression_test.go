@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestNegotiateStreamCompression(t *testing.T) {
+	if got := NegotiateStreamCompression([]string{"zstd", "DEFLATE"}); got != StreamCompressionDeflate {
+		t.Fatalf("expected deflate, got %q", got)
+	}
+	if got := NegotiateStreamCompression([]string{"zstd"}); got != "" {
+		t.Fatalf("expected no compression, got %q", got)
+	}
+	if got := NegotiateStreamCompression(nil); got != "" {
+		t.Fatalf("expected no compression, got %q", got)
+	}
+}
+
+func TestWrapStreamRoundTrip(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	server := WrapStream(serverSide, StreamCompressionDeflate)
+	client := WrapStream(clientSide, StreamCompressionDeflate)
+
+	request := bytes.Repeat([]byte("GET / HTTP/1.1\r\nHost: app.tunnel.example.com\r\n\r\n"), 50)
+	response := bytes.Repeat([]byte("hello world "), 1000)
+
+	go func() {
+		server.Write(request)
+		server.Close()
+	}()
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	if !bytes.Equal(got, request) {
+		t.Fatalf("request corrupted: got %d bytes, want %d", len(got), len(request))
+	}
+
+	serverSide, clientSide = net.Pipe()
+	server = WrapStream(serverSide, StreamCompressionDeflate)
+	client = WrapStream(clientSide, StreamCompressionDeflate)
+	go func() {
+		client.Write(response)
+		client.Close()
+	}()
+	got, err = io.ReadAll(server)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if !bytes.Equal(got, response) {
+		t.Fatalf("response corrupted: got %d bytes, want %d", len(got), len(response))
+	}
+}
+
+func TestWrapStreamCompressesOnTheWire(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	server := WrapStream(serverSide, StreamCompressionDeflate)
+	payload := bytes.Repeat([]byte("a"), 64*1024)
+
+	go func() {
+		server.Write(payload)
+		server.Close()
+	}()
+	wire, _ := io.ReadAll(clientSide)
+	if len(wire) >= len(payload)/10 {
+		t.Fatalf("expected compressed wire size, got %d bytes for %d", len(wire), len(payload))
+	}
+}
+
+func TestWrapStreamWithoutCompression(t *testing.T) {
+	conn, _ := net.Pipe()
+	if WrapStream(conn, "") != conn {
+		t.Fatal("expected uncompressed streams to be returned as-is")
+	}
+}
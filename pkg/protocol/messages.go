@@ -11,6 +11,8 @@
 //   - tunnel_response: Tunnel creation response
 //   - new_conn: New multiplexed connection notification
 //   - heartbeat: Keep-alive messages
+//   - stats: Periodic per-tunnel traffic statistics (server to client)
+//   - tunnel_closed: A tunnel was closed by the server (e.g. its TTL expired)
 //   - error: Error messages
 //
 // Usage:
@@ -22,6 +24,8 @@
 //
 //	// Send over WebSocket
 //	conn.WriteJSON(msg)
+//
+// Schema returns a JSON Schema of every message type and payload shape.
 package protocol
 
 import (
@@ -53,14 +57,23 @@ const (
 	MsgTypeGRPCReq MessageType = "grpc_request"
 	// MsgTypeGRPCResp is the message type for gRPC tunnel creation response.
 	MsgTypeGRPCResp MessageType = "grpc_response"
+	// MsgTypeStats is the message type for periodic tunnel traffic statistics.
+	MsgTypeStats MessageType = "stats"
+	// MsgTypeTunnelClosed is the message type sent when the server closes a tunnel.
+	MsgTypeTunnelClosed MessageType = "tunnel_closed"
+	// MsgTypeListTunnels is the message type a client sends to list its active tunnels.
+	MsgTypeListTunnels MessageType = "list_tunnels"
+	// MsgTypeTunnelList is the message type of the server's reply to list_tunnels.
+	MsgTypeTunnelList MessageType = "tunnel_list"
 )
 
 // ControlMessage represents a protocol message sent between server and client.
 type ControlMessage struct {
-	Type      MessageType            `json:"type"`       // Message type (auth, tunnel_request, etc.)
-	RequestID string                 `json:"request_id"` // Unique request identifier
-	Payload   map[string]interface{} `json:"payload"`    // Message payload data
-	Timestamp int64                  `json:"timestamp"`  // Unix timestamp
+	Type      MessageType            `json:"type"`                // Message type (auth, tunnel_request, etc.)
+	RequestID string                 `json:"request_id"`          // Unique request identifier
+	Payload   map[string]interface{} `json:"payload"`             // Message payload data
+	Timestamp int64                  `json:"timestamp"`           // Unix timestamp
+	Signature string                 `json:"signature,omitempty"` // HMAC of the message, see Sign
 }
 
 // TunnelConfig contains tunnel configuration parameters.
@@ -69,6 +82,21 @@ type TunnelConfig struct {
 	Protocol  string `json:"protocol"`   // Protocol type (http, tcp, etc.)
 	LocalPort int    `json:"local_port"` // Local port to forward traffic to
 	LocalHost string `json:"local_host,omitempty"`
+	Routing   string `json:"routing,omitempty"` // TCP only: "port" (default) or "sni" for TLS passthrough on the shared SNI port
+	// LocalScheme is how the client reaches the local app: "http" (default,
+	// plain TCP) or "https" (TLS, for apps that only speak HTTPS).
+	LocalScheme string `json:"local_scheme,omitempty"`
+
+	// StripPathPrefix and AddPathPrefix rewrite HTTP request paths before
+	// they reach the local app, e.g. AddPathPrefix "/app" maps / to /app/.
+	StripPathPrefix string `json:"strip_path_prefix,omitempty"`
+	AddPathPrefix   string `json:"add_path_prefix,omitempty"`
+	// RewriteLocation, when false, forwards redirects to the local app's own
+	// host and port unchanged instead of pointing them at the public URL.
+	RewriteLocation *bool `json:"rewrite_location,omitempty"`
+	// RewriteCookies points Set-Cookie Domain attributes naming the local
+	// app at the public host and adds Secure and SameSite over HTTPS.
+	RewriteCookies bool `json:"rewrite_cookies,omitempty"`
 }
 
 // GRPCTunnelConfig contains gRPC tunnel parameters.
@@ -80,14 +108,24 @@ type GRPCTunnelConfig struct {
 	RequireTLS  bool     `json:"require_tls"`
 	MaxStreams  int      `json:"max_streams,omitempty"`
 	Compression string   `json:"compression,omitempty"`
+
+	// GRPCWeb also serves the tunnel on its subdomain over HTTPS to
+	// gRPC-Web clients such as browsers, translated to native gRPC.
+	GRPCWeb bool `json:"grpc_web,omitempty"`
 }
 
 type TunnelResponse struct {
 	TunnelID   string `json:"tunnel_id"`  // Unique tunnel identifier
+	Subdomain  string `json:"subdomain"`  // Subdomain of the tunnel, as requested or assigned
 	PublicURL  string `json:"public_url"` // Public URL for accessing the tunnel
 	PublicPort int    `json:"public_port,omitempty"`
 	Status     string `json:"status"` // Tunnel status (active, error, etc.)
 	Message    string `json:"message,omitempty"`
+
+	// PublicEndpoint is the host:port to connect to for TCP and gRPC tunnels.
+	PublicEndpoint string `json:"public_endpoint,omitempty"`
+	// GRPCWebURL is where gRPC-Web clients reach a gRPC tunnel with grpc_web.
+	GRPCWebURL string `json:"grpc_web_url,omitempty"`
 }
 
 // GRPCTunnelResponse extends TunnelResponse with gRPC metadata.
@@ -99,6 +137,26 @@ type GRPCTunnelResponse struct {
 	Services []string `json:"services,omitempty"`
 }
 
+// TunnelStats carries traffic counters for a single tunnel in a stats message.
+type TunnelStats struct {
+	TunnelID        string `json:"tunnel_id"`        // Unique tunnel identifier
+	Subdomain       string `json:"subdomain"`        // Subdomain of the tunnel
+	BytesIn         int64  `json:"bytes_in"`         // Bytes received from public clients
+	BytesOut        int64  `json:"bytes_out"`        // Bytes sent to public clients
+	Requests        int64  `json:"requests"`         // Requests or connections served
+	DurationSeconds int64  `json:"duration_seconds"` // Time since the tunnel was created
+}
+
+// TunnelSummary describes an active tunnel of the client in a tunnel_list message.
+type TunnelSummary struct {
+	TunnelID   string `json:"tunnel_id"`             // Unique tunnel identifier
+	Subdomain  string `json:"subdomain"`             // Subdomain of the tunnel
+	Protocol   string `json:"protocol"`              // Protocol type (http, https, tcp, grpc)
+	PublicURL  string `json:"public_url,omitempty"`  // Public URL of an HTTP(S) or SNI-routed tunnel
+	PublicPort int    `json:"public_port,omitempty"` // Public port of a port-based TCP or gRPC tunnel
+	Status     string `json:"status"`                // "active", or "connecting" until the mux session is attached
+}
+
 type AuthRequest struct {
 	Token string `json:"token"` // Authentication token
 }
@@ -154,3 +212,51 @@ func NewErrorMessage(requestID, code, message string) *ControlMessage {
 		Timestamp: time.Now().Unix(),
 	}
 }
+
+// DetailRetryAfter is the error detail holding how many seconds a client
+// should wait before retrying a rejected request, e.g. after RATE_LIMITED.
+const DetailRetryAfter = "retry_after"
+
+// NewErrorMessageWithDetails creates an error message carrying structured
+// details, such as DetailRetryAfter.
+//
+// Parameters:
+//   - requestID: Unique identifier for the request that caused the error
+//   - code: Error code string
+//   - message: Human-readable error message
+//   - details: Extra machine-readable information about the error
+//
+// Returns:
+//   - *ControlMessage: An error message ready to be sent
+func NewErrorMessageWithDetails(requestID, code, message string, details map[string]interface{}) *ControlMessage {
+	msg := NewErrorMessage(requestID, code, message)
+	msg.Payload["details"] = details
+	return msg
+}
+
+// RetryAfter returns the retry hint of an error message.
+//
+// Returns:
+//   - time.Duration: How long to wait before retrying
+//   - bool: Whether the message carries a positive retry_after detail
+func (m *ControlMessage) RetryAfter() (time.Duration, bool) {
+	details, ok := m.Payload["details"].(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	var seconds float64
+	switch v := details[DetailRetryAfter].(type) {
+	case float64:
+		seconds = v
+	case int:
+		seconds = float64(v)
+	case int64:
+		seconds = float64(v)
+	default:
+		return 0, false
+	}
+	if seconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
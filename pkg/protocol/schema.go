@@ -0,0 +1,271 @@
+package protocol
+
+import "encoding/json"
+
+// SchemaID identifies the control protocol schema document.
+const SchemaID = "https://github.com/essajiwa/tunnelab/pkg/protocol/control-message.schema.json"
+
+// Schema returns a JSON Schema (draft 2020-12) describing every control message
+// and the payload shape of each message type.
+//
+// Client authors can use it to validate messages or generate bindings; the
+// control server also serves it at /protocol/schema. Each call returns a fresh
+// document, so callers may modify it.
+//
+// Returns:
+//   - map[string]interface{}: The schema document, ready to be encoded as JSON
+func Schema() map[string]interface{} {
+	variants := make([]interface{}, 0, len(messageSchemas))
+	types := make([]interface{}, 0, len(messageSchemas))
+	for _, message := range messageSchemas {
+		types = append(types, string(message.msgType))
+		variants = append(variants, object(message.description, nil, map[string]interface{}{
+			"type":    map[string]interface{}{"const": string(message.msgType)},
+			"payload": message.payload(),
+		}))
+	}
+
+	return map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"$id":         SchemaID,
+		"title":       "TunneLab control message",
+		"description": "JSON message exchanged over the WebSocket control channel.",
+		"type":        "object",
+		"required":    []interface{}{"type", "request_id", "payload", "timestamp"},
+		"properties": map[string]interface{}{
+			"type":       map[string]interface{}{"type": "string", "enum": types},
+			"request_id": stringField("Identifier echoed in the reply to a request"),
+			"payload":    map[string]interface{}{"type": []interface{}{"object", "null"}},
+			"timestamp":  integerField("Unix time the message was created"),
+			"signature":  stringField("Optional HMAC-SHA256 of the message, see ControlMessage.Sign"),
+		},
+		"oneOf": variants,
+	}
+}
+
+// SchemaJSON returns Schema encoded as indented JSON.
+//
+// Returns:
+//   - []byte: The encoded schema document
+func SchemaJSON() []byte {
+	data, _ := json.MarshalIndent(Schema(), "", "  ")
+	return data
+}
+
+// messageSchema describes the payload of one message type.
+type messageSchema struct {
+	msgType     MessageType
+	description string
+	payload     func() map[string]interface{}
+}
+
+var messageSchemas = []messageSchema{
+	{MsgTypeAuth, "Client authentication (client to server)", func() map[string]interface{} {
+		return object("", []interface{}{"token"}, map[string]interface{}{
+			"token": stringField("API token or JWT"),
+		})
+	}},
+	{MsgTypeAuthResponse, "Authentication result (server to client)", func() map[string]interface{} {
+		return object("", []interface{}{"success"}, map[string]interface{}{
+			"success":    map[string]interface{}{"type": "boolean"},
+			"client_id":  stringField("Authenticated client identifier"),
+			"message":    stringField("Reason for a failed authentication"),
+			"expires_at": integerField("Unix time the credential expires"),
+		})
+	}},
+	{MsgTypeTunnelReq, "Create an HTTP(S) tunnel, or several tunnels with \"tunnels\" (client to server)", tunnelRequestSchema},
+	{MsgTypeTCPReq, "Create a TCP tunnel (client to server)", tunnelRequestSchema},
+	{MsgTypeGRPCReq, "Create a gRPC tunnel (client to server)", tunnelRequestSchema},
+	{MsgTypeTunnelResp, "HTTP(S) tunnel created (server to client)", tunnelResponseSchema},
+	{MsgTypeTCPResp, "TCP tunnel created (server to client)", tunnelResponseSchema},
+	{MsgTypeGRPCResp, "gRPC tunnel created (server to client)", tunnelResponseSchema},
+	{MsgTypeNewConn, "Dial the mux port to open the yamux data session (server to client)", func() map[string]interface{} {
+		return object("", []interface{}{"action", "tunnel_id", "mux_port"}, map[string]interface{}{
+			"action":    map[string]interface{}{"const": "establish_mux"},
+			"tunnel_id": stringField("Tunnel the session belongs to"),
+			"mux_port":  portField("Port accepting the yamux session"),
+			"mux_addr":  stringField("Listen address of the mux port"),
+		})
+	}},
+	{MsgTypeCloseConn, "Reserved", func() map[string]interface{} {
+		return object("", nil, map[string]interface{}{})
+	}},
+	{MsgTypeHeartbeat, "Keep-alive; the server echoes it with its own timestamp", func() map[string]interface{} {
+		return object("", nil, map[string]interface{}{
+			"timestamp": integerField("Unix time on the server"),
+		})
+	}},
+	{MsgTypeStats, "Periodic traffic counters (server to client)", func() map[string]interface{} {
+		return object("", []interface{}{"tunnels"}, map[string]interface{}{
+			"tunnels": map[string]interface{}{
+				"type": "array",
+				"items": object("", []interface{}{"tunnel_id", "subdomain", "bytes_in", "bytes_out", "requests", "duration_seconds"}, map[string]interface{}{
+					"tunnel_id":        stringField("Unique tunnel identifier"),
+					"subdomain":        stringField("Subdomain of the tunnel"),
+					"bytes_in":         integerField("Bytes received from public clients"),
+					"bytes_out":        integerField("Bytes sent to public clients"),
+					"requests":         integerField("Requests or connections served"),
+					"duration_seconds": integerField("Time since the tunnel was created"),
+				}),
+			},
+		})
+	}},
+	{MsgTypeTunnelClosed, "The server closed a tunnel (server to client)", func() map[string]interface{} {
+		return object("", []interface{}{"tunnel_id", "subdomain", "reason"}, map[string]interface{}{
+			"tunnel_id": stringField("Unique tunnel identifier"),
+			"subdomain": stringField("Subdomain of the tunnel"),
+			"reason":    stringField("Why the tunnel was closed: expired, closed_by_admin or replaced (the client reconnected)"),
+		})
+	}},
+	{MsgTypeListTunnels, "List the client's active tunnels (client to server)", func() map[string]interface{} {
+		return object("", nil, map[string]interface{}{})
+	}},
+	{MsgTypeTunnelList, "Active tunnels of the client, in reply to list_tunnels (server to client)", func() map[string]interface{} {
+		return object("", []interface{}{"tunnels"}, map[string]interface{}{
+			"tunnels": map[string]interface{}{
+				"type": "array",
+				"items": object("", []interface{}{"tunnel_id", "subdomain", "protocol", "status"}, map[string]interface{}{
+					"tunnel_id":   stringField("Unique tunnel identifier"),
+					"subdomain":   stringField("Subdomain of the tunnel"),
+					"protocol":    protocolField(),
+					"public_url":  stringField("Public URL of an HTTP(S) or SNI-routed tunnel"),
+					"public_port": portField("Public port of a TCP or gRPC tunnel"),
+					"status":      map[string]interface{}{"type": "string", "enum": []interface{}{"active", "connecting"}},
+				}),
+			},
+		})
+	}},
+	{MsgTypeError, "Request failed (server to client)", func() map[string]interface{} {
+		return object("", []interface{}{"code", "message"}, map[string]interface{}{
+			"code":    stringField("Machine-readable error code"),
+			"message": stringField("Human-readable error message"),
+			"details": object("", nil, map[string]interface{}{
+				DetailRetryAfter: map[string]interface{}{
+					"type":        "number",
+					"minimum":     0,
+					"description": "Seconds to wait before retrying the request",
+				},
+			}),
+		})
+	}},
+}
+
+// tunnelRequestSchema accepts either a single tunnel or a batch in "tunnels".
+func tunnelRequestSchema() map[string]interface{} {
+	single := tunnelConfigSchema([]interface{}{"protocol", "local_port"})
+	batch := object("", []interface{}{"tunnels"}, map[string]interface{}{
+		"protocol": protocolField(),
+		"tunnels": map[string]interface{}{
+			"type":     "array",
+			"minItems": 1,
+			"maxItems": 100,
+			"items":    tunnelConfigSchema([]interface{}{"local_port"}),
+		},
+	})
+	return map[string]interface{}{"anyOf": []interface{}{single, batch}}
+}
+
+func tunnelConfigSchema(required []interface{}) map[string]interface{} {
+	return object("", required, map[string]interface{}{
+		"subdomain":   stringField("Desired subdomain; may be omitted for HTTP(S) tunnels when the server assigns random subdomains"),
+		"protocol":    protocolField(),
+		"local_port":  portField("Port of the local service"),
+		"local_host":  stringField("Host of the local service (defaults to localhost)"),
+		"routing":     map[string]interface{}{"type": "string", "enum": []interface{}{"port", "sni"}},
+		"public_port": portField("Requested public port for TCP tunnels, if the server allows it"),
+		"ttl_seconds": map[string]interface{}{"type": "integer", "minimum": 0},
+		"stream_compression": map[string]interface{}{
+			"description": "Preferred data stream compression, or a list in order of preference",
+			"type":        []interface{}{"string", "array"},
+			"items":       map[string]interface{}{"type": "string"},
+		},
+		"local_scheme": map[string]interface{}{
+			"description": "How the client reaches the local service: http (plain TCP, the default) or https (TLS)",
+			"type":        "string",
+			"enum":        []interface{}{"http", "https"},
+		},
+		"services":    map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		"require_tls": map[string]interface{}{"type": "boolean"},
+		"max_streams": map[string]interface{}{"type": "integer"},
+		"compression": map[string]interface{}{"type": "string", "enum": []interface{}{"identity", "gzip"}},
+		"pool":        map[string]interface{}{"type": "boolean"},
+		"grpc_web": map[string]interface{}{
+			"description": "gRPC only: also serve gRPC-Web clients on the tunnel subdomain",
+			"type":        "boolean",
+		},
+		"strip_path_prefix": stringField("HTTP only: path prefix removed from request paths, e.g. \"/api\""),
+		"add_path_prefix":   stringField("HTTP only: path prefix added to request paths, e.g. \"/app\""),
+		"rewrite_cookies": map[string]interface{}{
+			"description": "HTTP only: adapt Set-Cookie Domain, Secure and SameSite to the public host",
+			"type":        "boolean",
+		},
+		"rewrite_location": map[string]interface{}{
+			"description": "HTTP only: rewrite Location headers pointing at the local app to the public URL (default true)",
+			"type":        "boolean",
+		},
+		"weight": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 100},
+	})
+}
+
+// tunnelResponseSchema accepts a single tunnel response or batch "results".
+func tunnelResponseSchema() map[string]interface{} {
+	single := object("", []interface{}{"tunnel_id", "status"}, map[string]interface{}{
+		"tunnel_id":          stringField("Unique tunnel identifier"),
+		"subdomain":          stringField("Subdomain of the tunnel, as requested or assigned"),
+		"status":             stringField("Tunnel status"),
+		"public_url":         stringField("Public URL of an HTTP(S) tunnel"),
+		"public_port":        portField("Public port of a TCP or gRPC tunnel"),
+		"public_endpoint":    stringField("host:port to connect to for a TCP or gRPC tunnel"),
+		"routing":            map[string]interface{}{"type": "string", "enum": []interface{}{"port", "sni"}},
+		"expires_at":         integerField("Unix time the tunnel is closed automatically"),
+		"stream_compression": stringField("Negotiated data stream compression"),
+		"max_streams":        map[string]interface{}{"type": "integer"},
+		"compression":        map[string]interface{}{"type": "string", "enum": []interface{}{"identity", "gzip"}},
+		"grpc_web_url":       stringField("URL gRPC-Web clients use for a gRPC tunnel with grpc_web"),
+	})
+	batch := object("", []interface{}{"results"}, map[string]interface{}{
+		"results": map[string]interface{}{
+			"type": "array",
+			"items": object("", []interface{}{"subdomain", "success"}, map[string]interface{}{
+				"subdomain": stringField("Subdomain of the batch entry"),
+				"success":   map[string]interface{}{"type": "boolean"},
+				"tunnel_id": stringField("Unique tunnel identifier"),
+				"error": object("", []interface{}{"code", "message"}, map[string]interface{}{
+					"code":    stringField("Machine-readable error code"),
+					"message": stringField("Human-readable error message"),
+				}),
+			}),
+		},
+	})
+	return map[string]interface{}{"anyOf": []interface{}{single, batch}}
+}
+
+func object(description string, required []interface{}, properties map[string]interface{}) map[string]interface{} {
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if description != "" {
+		schema["description"] = description
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func stringField(description string) map[string]interface{} {
+	return map[string]interface{}{"type": "string", "description": description}
+}
+
+func integerField(description string) map[string]interface{} {
+	return map[string]interface{}{"type": "integer", "description": description}
+}
+
+func portField(description string) map[string]interface{} {
+	return map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 65535, "description": description}
+}
+
+func protocolField() map[string]interface{} {
+	return map[string]interface{}{"type": "string", "enum": []interface{}{"http", "https", "tcp", "grpc"}}
+}
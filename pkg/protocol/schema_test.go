@@ -0,0 +1,222 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestSchemaValidatesSampleMessages(t *testing.T) {
+	schema := decodeJSON(t, SchemaJSON())
+
+	valid := []*ControlMessage{
+		NewControlMessage(MsgTypeAuth, "req-1", map[string]interface{}{"token": "secret"}),
+		NewControlMessage(MsgTypeTunnelReq, "req-2", map[string]interface{}{
+			"subdomain":          "app",
+			"protocol":           "http",
+			"local_port":         3000,
+			"ttl_seconds":        600,
+			"stream_compression": []string{StreamCompressionDeflate},
+		}),
+		NewControlMessage(MsgTypeTunnelReq, "req-3", map[string]interface{}{
+			"protocol": "http",
+			"tunnels": []map[string]interface{}{
+				{"subdomain": "api", "local_port": 3000},
+				{"subdomain": "db", "protocol": "tcp", "local_port": 5432},
+			},
+		}),
+		NewControlMessage(MsgTypeTCPResp, "req-4", map[string]interface{}{
+			"tunnel_id":   "tunnel-1",
+			"status":      "active",
+			"public_port": 30001,
+		}),
+		NewControlMessage(MsgTypeStats, "req-5", map[string]interface{}{
+			"tunnels": []TunnelStats{{TunnelID: "tunnel-1", Subdomain: "app", BytesIn: 10}},
+		}),
+		NewErrorMessage("req-6", "INVALID_REQUEST", "Missing required fields"),
+	}
+	for _, msg := range valid {
+		if err := validateSchema(schema, encodeAndDecode(t, msg)); err != nil {
+			t.Fatalf("%s: expected message to be valid: %v", msg.Type, err)
+		}
+	}
+
+	invalid := []*ControlMessage{
+		NewControlMessage("unknown", "req-7", map[string]interface{}{}),
+		NewControlMessage(MsgTypeTunnelReq, "req-8", map[string]interface{}{"subdomain": "app", "protocol": "http"}),
+		NewControlMessage(MsgTypeTunnelReq, "req-9", map[string]interface{}{
+			"subdomain": "app", "protocol": "ftp", "local_port": 21,
+		}),
+		NewControlMessage(MsgTypeTCPReq, "req-10", map[string]interface{}{
+			"subdomain": "db", "protocol": "tcp", "local_port": 70000,
+		}),
+		NewControlMessage(MsgTypeAuth, "req-11", map[string]interface{}{"token": 42}),
+	}
+	for _, msg := range invalid {
+		if err := validateSchema(schema, encodeAndDecode(t, msg)); err == nil {
+			t.Fatalf("%s: expected message to be rejected: %v", msg.Type, msg.Payload)
+		}
+	}
+}
+
+func TestSchemaCoversEveryMessageType(t *testing.T) {
+	schema := Schema()
+	enum := schema["properties"].(map[string]interface{})["type"].(map[string]interface{})["enum"].([]interface{})
+	covered := make(map[string]bool, len(enum))
+	for _, name := range enum {
+		covered[name.(string)] = true
+	}
+
+	all := []MessageType{
+		MsgTypeAuth, MsgTypeAuthResponse, MsgTypeTunnelReq, MsgTypeTunnelResp,
+		MsgTypeTCPReq, MsgTypeTCPResp, MsgTypeGRPCReq, MsgTypeGRPCResp,
+		MsgTypeHeartbeat, MsgTypeNewConn, MsgTypeCloseConn, MsgTypeStats,
+		MsgTypeTunnelClosed, MsgTypeListTunnels, MsgTypeTunnelList, MsgTypeError,
+	}
+	for _, msgType := range all {
+		if !covered[string(msgType)] {
+			t.Fatalf("schema does not describe %s", msgType)
+		}
+	}
+}
+
+func encodeAndDecode(t *testing.T, msg *ControlMessage) interface{} {
+	t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("failed to encode message: %v", err)
+	}
+	return decodeJSON(t, data)
+}
+
+func decodeJSON(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		t.Fatalf("failed to decode JSON: %v", err)
+	}
+	return value
+}
+
+// validateSchema checks value against the subset of JSON Schema used by Schema.
+func validateSchema(schema, value interface{}) error {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("malformed schema %v", schema)
+	}
+
+	if types, ok := s["type"]; ok && !matchesType(types, value) {
+		return fmt.Errorf("%v is not of type %v", value, types)
+	}
+	if want, ok := s["const"]; ok && want != value {
+		return fmt.Errorf("%v is not %v", value, want)
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			found = found || option == value
+		}
+		if !found {
+			return fmt.Errorf("%v is not one of %v", value, enum)
+		}
+	}
+	if number, ok := value.(float64); ok {
+		if min, ok := s["minimum"].(float64); ok && number < min {
+			return fmt.Errorf("%v is below %v", number, min)
+		}
+		if max, ok := s["maximum"].(float64); ok && number > max {
+			return fmt.Errorf("%v is above %v", number, max)
+		}
+	}
+	if object, ok := value.(map[string]interface{}); ok {
+		if required, ok := s["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, present := object[name.(string)]; !present {
+					return fmt.Errorf("missing required property %v", name)
+				}
+			}
+		}
+		if properties, ok := s["properties"].(map[string]interface{}); ok {
+			for name, propertySchema := range properties {
+				if property, present := object[name]; present {
+					if err := validateSchema(propertySchema, property); err != nil {
+						return fmt.Errorf("%s: %w", name, err)
+					}
+				}
+			}
+		}
+	}
+	if array, ok := value.([]interface{}); ok {
+		if min, ok := s["minItems"].(float64); ok && float64(len(array)) < min {
+			return fmt.Errorf("fewer than %v items", min)
+		}
+		if max, ok := s["maxItems"].(float64); ok && float64(len(array)) > max {
+			return fmt.Errorf("more than %v items", max)
+		}
+		if items, ok := s["items"]; ok {
+			for i, item := range array {
+				if err := validateSchema(items, item); err != nil {
+					return fmt.Errorf("item %d: %w", i, err)
+				}
+			}
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]interface{}); ok && countValid(anyOf, value) == 0 {
+		return fmt.Errorf("%v matches none of the alternatives", value)
+	}
+	if oneOf, ok := s["oneOf"].([]interface{}); ok && countValid(oneOf, value) != 1 {
+		return fmt.Errorf("%v does not match exactly one alternative", value)
+	}
+	return nil
+}
+
+func countValid(schemas []interface{}, value interface{}) int {
+	count := 0
+	for _, schema := range schemas {
+		if validateSchema(schema, value) == nil {
+			count++
+		}
+	}
+	return count
+}
+
+func matchesType(types, value interface{}) bool {
+	list, ok := types.([]interface{})
+	if !ok {
+		list = []interface{}{types}
+	}
+	for _, name := range list {
+		switch name {
+		case "object":
+			if _, ok := value.(map[string]interface{}); ok {
+				return true
+			}
+		case "array":
+			if _, ok := value.([]interface{}); ok {
+				return true
+			}
+		case "string":
+			if _, ok := value.(string); ok {
+				return true
+			}
+		case "boolean":
+			if _, ok := value.(bool); ok {
+				return true
+			}
+		case "integer":
+			if number, ok := value.(float64); ok && number == math.Trunc(number) {
+				return true
+			}
+		case "number":
+			if _, ok := value.(float64); ok {
+				return true
+			}
+		case "null":
+			if value == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
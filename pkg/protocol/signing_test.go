@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	key := DeriveSigningKey("client-token")
+	msg := NewControlMessage(MsgTypeStats, "req-1", map[string]interface{}{
+		"tunnels": []TunnelStats{{TunnelID: "tunnel-1", Subdomain: "app", BytesIn: 42}},
+	})
+	if err := msg.Sign(key); err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	if err := msg.Verify(key); err != nil {
+		t.Fatalf("expected signature to verify: %v", err)
+	}
+
+	// The receiver decodes the payload into generic values; the signature
+	// must still match.
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	var received ControlMessage
+	if err := json.Unmarshal(data, &received); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if err := received.Verify(key); err != nil {
+		t.Fatalf("expected signature to survive a JSON round trip: %v", err)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	key := DeriveSigningKey("client-token")
+	sign := func() *ControlMessage {
+		msg := NewControlMessage(MsgTypeTunnelReq, "req-1", map[string]interface{}{
+			"subdomain":  "app",
+			"protocol":   "http",
+			"local_port": float64(3000),
+		})
+		if err := msg.Sign(key); err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+		return msg
+	}
+
+	tampers := map[string]func(*ControlMessage){
+		"payload":    func(m *ControlMessage) { m.Payload["local_port"] = float64(22) },
+		"type":       func(m *ControlMessage) { m.Type = MsgTypeTCPReq },
+		"request_id": func(m *ControlMessage) { m.RequestID = "req-2" },
+		"timestamp":  func(m *ControlMessage) { m.Timestamp++ },
+		"signature":  func(m *ControlMessage) { m.Signature = m.Signature[1:] + "A" },
+	}
+	for name, tamper := range tampers {
+		msg := sign()
+		tamper(msg)
+		if err := msg.Verify(key); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("%s: expected ErrInvalidSignature, got %v", name, err)
+		}
+	}
+
+	if err := sign().Verify(DeriveSigningKey("other-token")); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected a different key to be rejected, got %v", err)
+	}
+	unsigned := NewControlMessage(MsgTypeHeartbeat, "req-3", map[string]interface{}{})
+	if err := unsigned.Verify(key); !errors.Is(err, ErrMissingSignature) {
+		t.Fatalf("expected ErrMissingSignature, got %v", err)
+	}
+}
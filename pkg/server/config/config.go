@@ -0,0 +1,896 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Server   ServerConfig   `yaml:"server"`
+	TLS      TLSConfig      `yaml:"tls"`
+	Database DatabaseConfig `yaml:"database"`
+	Auth     AuthConfig     `yaml:"auth"`
+	Logging  LoggingConfig  `yaml:"logging"`
+	Tunnels  TunnelsConfig  `yaml:"tunnels"`
+	Admin    AdminConfig    `yaml:"admin"`
+	Quota    QuotaConfig    `yaml:"quota"`
+	Cluster  ClusterConfig  `yaml:"cluster"`
+	Webhooks WebhooksConfig `yaml:"webhooks"`
+
+	CustomDomains CustomDomainsConfig `yaml:"custom_domains"`
+}
+
+// CustomDomainsConfig configures custom domains: hostnames outside
+// server.domain that point at a tunnel with a CNAME record.
+type CustomDomainsConfig struct {
+	Enabled         bool          `yaml:"enabled"`          // Route verified custom domains and allow their certificates
+	RefreshInterval time.Duration `yaml:"refresh_interval"` // How often verified domains are reloaded from the database (default 1m)
+}
+
+// WebhooksConfig configures outbound webhooks for tunnel lifecycle events.
+type WebhooksConfig struct {
+	URLs    []string      `yaml:"urls"`    // Receivers of every event; empty disables webhooks
+	Secret  string        `yaml:"secret"`  // Key of the X-Tunnelab-Signature HMAC ("" sends no signature)
+	Events  []string      `yaml:"events"`  // Event types to send (empty sends all)
+	Retries int           `yaml:"retries"` // Further attempts after a failed delivery (default 3, -1 disables retries)
+	Timeout time.Duration `yaml:"timeout"` // Bound of each delivery attempt (default 5s)
+}
+
+// ClusterConfig shares tunnel ownership between server instances behind a load balancer.
+type ClusterConfig struct {
+	Store         string        `yaml:"store"`          // "" (single node) or "redis"
+	NodeAddress   string        `yaml:"node_address"`   // host:port where peers reach this node's peer listener
+	RedisAddr     string        `yaml:"redis_addr"`     // host:port of the Redis server
+	RedisPassword string        `yaml:"redis_password"` // Optional Redis AUTH password
+	RedisDB       int           `yaml:"redis_db"`       // Redis database number
+	OwnershipTTL  time.Duration `yaml:"ownership_ttl"`  // Lifetime of an ownership claim unless renewed (default 30s)
+	Secret        string        `yaml:"secret"`         // Shared secret authenticating stream links between nodes
+	// PeerPort is the dedicated listener for stream links from other nodes,
+	// kept off the public proxy ports.
+	PeerPort int `yaml:"peer_port"`
+	// Stream links use mutual TLS: each node presents TLSCert and TLSKey and
+	// accepts only peers whose certificate is signed by the CA in TLSCA.
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+	TLSCA   string `yaml:"tls_ca"`
+}
+
+type ServerConfig struct {
+	Domain      string `yaml:"domain"`
+	ControlPort int    `yaml:"control_port"`
+	HTTPPort    int    `yaml:"http_port"`
+	HTTPSPort   int    `yaml:"https_port"`
+	// ControlPath is the path clients open the control WebSocket on. "/"
+	// (the default) accepts it on any path not taken by another endpoint.
+	ControlPath string `yaml:"control_path"`
+	// TrustedProxies lists IPs/CIDRs of load balancers whose X-Forwarded-For is honored.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// MaxControlMessageSize caps the size in bytes of a control-channel message.
+	MaxControlMessageSize int64 `yaml:"max_control_message_size"`
+	// RequireSignedMessages rejects control messages without a valid HMAC signature.
+	RequireSignedMessages bool `yaml:"require_signed_messages"`
+	// AuthTimeout is how long a new control connection has to authenticate.
+	AuthTimeout time.Duration `yaml:"auth_timeout"`
+	// MuxTimeout is how long a client has to connect the mux session of a new tunnel.
+	MuxTimeout time.Duration `yaml:"mux_timeout"`
+	// MuxBindAddress is the IP the ephemeral mux listeners bind to (default 127.0.0.1).
+	MuxBindAddress string `yaml:"mux_bind_address"`
+	// StripResponseHeaders lists origin response headers that never reach
+	// visitors (unset uses DefaultStripResponseHeaders, [] strips none).
+	StripResponseHeaders []string `yaml:"strip_response_headers"`
+	// Via is the pseudonym added to a Via response header identifying the proxy ("" adds none).
+	Via string `yaml:"via"`
+	// SecurityHeaders adds security response headers such as HSTS to tunnel
+	// responses served over HTTPS.
+	SecurityHeaders SecurityHeadersConfig `yaml:"security_headers"`
+	// ServedByHeader adds "X-Served-By: tunnelab/<version>" to tunnel responses.
+	ServedByHeader bool `yaml:"served_by_header"`
+	// TunnelIDHeader adds an X-Tunnel-Id header with the serving tunnel's ID to tunnel responses.
+	TunnelIDHeader bool `yaml:"tunnel_id_header"`
+	// MaxHeaderBytes caps the total size of the headers of a proxied request.
+	MaxHeaderBytes int `yaml:"max_header_bytes"`
+	// Landing serves a page on the apex domain instead of 400 Invalid subdomain.
+	Landing LandingConfig `yaml:"landing"`
+	// Maintenance answers requests to tunnels with a 503 page instead of forwarding them.
+	Maintenance MaintenanceConfig `yaml:"maintenance"`
+	// HTTPTimeouts bound the connections of the control, HTTP and HTTPS servers.
+	HTTPTimeouts HTTPTimeoutsConfig `yaml:"http_timeouts"`
+	// MaxControlConnsPerIP caps simultaneous control connections from one source IP (0 means no limit).
+	MaxControlConnsPerIP int `yaml:"max_control_connections_per_ip"`
+	// MaxProxyConnsPerIP caps simultaneous proxied requests and TCP connections from one source IP (0 means no limit).
+	MaxProxyConnsPerIP int `yaml:"max_proxy_connections_per_ip"`
+}
+
+// HTTPTimeoutsConfig configures the timeouts of the control, HTTP and HTTPS
+// servers. Read and write timeouts also cut off long uploads, streaming
+// responses and WebSocket upgrades proxied to tunnels, so they are off by default.
+type HTTPTimeoutsConfig struct {
+	ReadHeader time.Duration `yaml:"read_header"` // Time to read request headers (default 10s)
+	Read       time.Duration `yaml:"read"`        // Time to read a whole request, body included (0 means none)
+	Write      time.Duration `yaml:"write"`       // Time to write a response (0 means none)
+	Idle       time.Duration `yaml:"idle"`        // How long keep-alive connections wait for the next request (default 2m)
+}
+
+func (c *HTTPTimeoutsConfig) validate() error {
+	if c.ReadHeader == 0 {
+		c.ReadHeader = 10 * time.Second
+	}
+	if c.Idle == 0 {
+		c.Idle = 2 * time.Minute
+	}
+	if c.ReadHeader < 0 || c.Read < 0 || c.Write < 0 || c.Idle < 0 {
+		return fmt.Errorf("server.http_timeouts must not be negative")
+	}
+	if c.Read > 0 && c.Read < c.ReadHeader {
+		return fmt.Errorf("server.http_timeouts.read must not be shorter than read_header")
+	}
+	return nil
+}
+
+// LandingConfig configures the page served on the apex domain and "www".
+type LandingConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Page    string `yaml:"page"` // HTML file to serve (empty serves a JSON status)
+}
+
+// MaintenanceConfig configures maintenance mode, in which HTTP requests to
+// tunnels get a 503 page while the tunnels stay connected. The admin API
+// can turn it on and off at runtime.
+type MaintenanceConfig struct {
+	Enabled    bool          `yaml:"enabled"`     // Start with every tunnel in maintenance
+	Tunnels    []string      `yaml:"tunnels"`     // Subdomains to start in maintenance
+	Page       string        `yaml:"page"`        // HTML file served with the 503 (empty serves a short text)
+	RetryAfter time.Duration `yaml:"retry_after"` // Retry-After sent with the page (0 sends none)
+}
+
+func (c *MaintenanceConfig) validate() error {
+	if c.RetryAfter < 0 {
+		return fmt.Errorf("server.maintenance.retry_after must not be negative")
+	}
+	for _, subdomain := range c.Tunnels {
+		if strings.TrimSpace(subdomain) == "" || strings.Contains(subdomain, ".") {
+			return fmt.Errorf("server.maintenance.tunnels: invalid subdomain %q", subdomain)
+		}
+	}
+	return nil
+}
+
+// SecurityHeadersConfig configures the security headers added to tunnel
+// responses served over HTTPS.
+type SecurityHeadersConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Force replaces headers the local app already set (default keeps them).
+	Force bool `yaml:"force"`
+	// Headers maps header names to values (unset uses DefaultSecurityHeaders).
+	Headers map[string]string `yaml:"headers"`
+}
+
+func (c *SecurityHeadersConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Headers == nil {
+		c.Headers = DefaultSecurityHeaders
+	}
+	for name, value := range c.Headers {
+		if !isToken(name) {
+			return fmt.Errorf("server.security_headers.headers: %q is not a valid header name", name)
+		}
+		if value == "" || strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("server.security_headers.headers: %s must have a single-line value", name)
+		}
+	}
+	return nil
+}
+
+// DefaultSecurityHeaders are the security headers added when
+// server.security_headers is enabled without headers of its own.
+var DefaultSecurityHeaders = map[string]string{
+	"Strict-Transport-Security": "max-age=31536000",
+	"X-Content-Type-Options":    "nosniff",
+	"X-Frame-Options":           "SAMEORIGIN",
+	"Referrer-Policy":           "strict-origin-when-cross-origin",
+}
+
+// DefaultStripResponseHeaders are the origin response headers stripped when
+// server.strip_response_headers is unset. They reveal the origin's software.
+var DefaultStripResponseHeaders = []string{"Server", "X-Powered-By", "X-AspNet-Version", "X-AspNetMvc-Version"}
+
+type TLSConfig struct {
+	Mode     string `yaml:"mode"`      // "auto", "manual", or "disabled"
+	Email    string `yaml:"email"`     // For Let's Encrypt notifications
+	CertPath string `yaml:"cert_path"` // For manual mode
+	KeyPath  string `yaml:"key_path"`  // For manual mode
+	CacheDir string `yaml:"cache_dir"` // Cache directory for autocert
+	Staging  bool   `yaml:"staging"`   // Use Let's Encrypt staging for testing
+	// DirectoryURL is the ACME directory of a CA other than Let's Encrypt.
+	DirectoryURL string `yaml:"directory_url"`
+	// EABKeyID and EABHMACKey are ACME external account binding credentials.
+	EABKeyID   string `yaml:"eab_kid"`
+	EABHMACKey string `yaml:"eab_hmac_key"`
+	// SNIRouting routes HTTPS by TLS server name and rejects handshakes for unknown subdomains.
+	SNIRouting bool `yaml:"sni_routing"`
+
+	MinVersion   string   `yaml:"min_version"`   // "1.2" or "1.3"
+	Curves       []string `yaml:"curves"`        // Preferred curves: X25519, P256, P384, P521
+	CertKeyType  string   `yaml:"cert_key_type"` // "ecdsa" or "rsa" certificates from the ACME CA
+	OCSPStapling bool     `yaml:"ocsp_stapling"` // Staple OCSP responses to served certificates
+	GoDefaults   bool     `yaml:"go_defaults"`   // Use Go's default cipher suites instead of the hardcoded list
+
+	NegativeCacheTTL time.Duration `yaml:"negative_cache_ttl"` // How long rejected hosts are refused without a lookup
+	IssuanceLimit    int           `yaml:"issuance_limit"`     // Certificate issuance attempts per source per window (-1 disables)
+	IssuanceWindow   time.Duration `yaml:"issuance_window"`    // Window for issuance_limit
+}
+
+type DatabaseConfig struct {
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+
+	QueryTimeout     time.Duration `yaml:"query_timeout"`     // Deadline for a single query on the control path
+	Retries          int           `yaml:"retries"`           // Extra attempts when the database is busy or slow (-1 disables)
+	BreakerThreshold int           `yaml:"breaker_threshold"` // Consecutive failures before failing fast
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`  // How long to fail fast before trying again
+
+	// SQLite pragmas applied to every connection.
+	JournalMode string        `yaml:"journal_mode"` // "wal" by default
+	BusyTimeout time.Duration `yaml:"busy_timeout"` // How long to wait on a lock (default 5s)
+	ForeignKeys *bool         `yaml:"foreign_keys"` // Defaults to true, or false in JWT auth mode
+	Synchronous string        `yaml:"synchronous"`  // "normal" by default
+
+	// Connection pool limits. SQLite defaults to a single connection.
+	MaxOpenConns    int           `yaml:"max_open_conns"`    // 0 means 1, -1 means no limit
+	MaxIdleConns    int           `yaml:"max_idle_conns"`    // 0 means max_open_conns, -1 means none
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"` // 0 keeps connections open
+}
+
+func (c *DatabaseConfig) validate() error {
+	if c.MaxOpenConns < -1 {
+		return fmt.Errorf("database.max_open_conns must be -1 (no limit) or more, got %d", c.MaxOpenConns)
+	}
+	if c.MaxIdleConns < -1 {
+		return fmt.Errorf("database.max_idle_conns must be -1 (none) or more, got %d", c.MaxIdleConns)
+	}
+	if c.ConnMaxLifetime < 0 {
+		return fmt.Errorf("database.conn_max_lifetime must not be negative, got %v", c.ConnMaxLifetime)
+	}
+	return nil
+}
+
+func (c *CustomDomainsConfig) validate() error {
+	if c.RefreshInterval < 0 {
+		return fmt.Errorf("custom_domains.refresh_interval must not be negative, got %v", c.RefreshInterval)
+	}
+	return nil
+}
+
+type AuthConfig struct {
+	Required    bool          `yaml:"required"`
+	TokenLength int           `yaml:"token_length"`
+	Mode        string        `yaml:"mode"` // "token" (database) or "jwt"
+	JWT         JWTAuthConfig `yaml:"jwt"`
+}
+
+type JWTAuthConfig struct {
+	Secret   string `yaml:"secret"`   // Shared secret for HS256/384/512 tokens
+	JWKS     string `yaml:"jwks"`     // Path or URL of a JWKS document for RS*/ES* tokens
+	Issuer   string `yaml:"issuer"`   // Expected "iss" claim
+	Audience string `yaml:"audience"` // Expected "aud" claim
+}
+
+// AdminConfig configures the operator API served on the control port.
+type AdminConfig struct {
+	Token string `yaml:"token"` // Bearer token for /api/ endpoints; empty disables the API
+	// Port serves the API on its own listener instead of the control port (0 keeps it on the control port).
+	Port int `yaml:"port"`
+	// BindAddress is the IP the admin listener binds to (default 127.0.0.1).
+	BindAddress string `yaml:"bind_address"`
+}
+
+func (c *AdminConfig) validate() error {
+	if c.Port == 0 {
+		return nil
+	}
+	if c.Token == "" {
+		return fmt.Errorf("admin.port requires admin.token")
+	}
+	if c.BindAddress == "" {
+		c.BindAddress = "127.0.0.1"
+	}
+	if net.ParseIP(c.BindAddress) == nil {
+		return fmt.Errorf("admin.bind_address must be an IP address, got %q", c.BindAddress)
+	}
+	return nil
+}
+
+// QuotaConfig configures monthly per-client byte quotas.
+type QuotaConfig struct {
+	Enabled       bool          `yaml:"enabled"`        // Enforce quotas (also records connection logs)
+	MonthlyBytes  int64         `yaml:"monthly_bytes"`  // Default quota for clients without their own (0 means unlimited)
+	CheckInterval time.Duration `yaml:"check_interval"` // How often usage is re-evaluated (default 1m)
+}
+
+type LoggingConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+	Output string `yaml:"output"`
+	// ConnectionLogs records every proxied HTTP request in the database for usage reporting.
+	ConnectionLogs bool `yaml:"connection_logs"`
+	// ConnectionLogSampleRate is the fraction of requests (0.0-1.0) written to
+	// the connection logs; server errors are always written. Defaults to 1.
+	ConnectionLogSampleRate *float64 `yaml:"connection_log_sample_rate"`
+}
+
+type TunnelsConfig struct {
+	SubdomainFormat string `yaml:"subdomain_format"`
+	TCPPortRange    string `yaml:"tcp_port_range"`
+	PortAllocation  string `yaml:"port_allocation"` // How ports are picked from the range: "sequential", "round-robin" or "random"
+	PoolBalancing   string `yaml:"pool_balancing"`  // How requests are spread over a pool: "round-robin" or "least-connections"
+	// SubdomainPolicy decides whether HTTP(S) tunnels must request a subdomain:
+	// "required", "optional" (generated when omitted) or "random" (always generated).
+	SubdomainPolicy string `yaml:"http_subdomain_policy"`
+	// PortPolicy decides whether TCP tunnels may request a public port:
+	// "request" (honoured when inside tcp_port_range, the default) or "auto" (always allocated).
+	PortPolicy              string `yaml:"tcp_port_policy"`
+	TCPPublicHost           string `yaml:"tcp_public_host"` // Host advertised in public_endpoint (defaults to server.domain)
+	EnableGRPC              bool   `yaml:"enable_grpc"`
+	GRPCMaxStreams          int    `yaml:"grpc_max_streams"` // Ceiling for max_streams requested by gRPC tunnels
+	MaxTunnelsPerClient     int    `yaml:"max_tunnels_per_client"`
+	MaxConnectionsPerTunnel int    `yaml:"max_connections_per_tunnel"`
+	// EnforceMaxTunnels rejects tunnels beyond the max_tunnels of a client
+	// (off by default, so clients keep the tunnels they already open).
+	EnforceMaxTunnels bool `yaml:"enforce_max_tunnels"`
+	// SNIPort is the shared TLS passthrough port for SNI-routed TCP tunnels (0 disables it).
+	SNIPort int `yaml:"sni_port"`
+	// StatsInterval controls how often clients receive traffic stats messages (0 disables them).
+	StatsInterval time.Duration `yaml:"stats_interval"`
+	// CopyBufferSize is the buffer size in bytes for streaming and TCP copies.
+	CopyBufferSize int `yaml:"copy_buffer_size"`
+	// BufferPool recycles copy buffers through a sync.Pool.
+	BufferPool bool `yaml:"buffer_pool"`
+	// StreamCompression lets clients negotiate compressed tunnel data streams.
+	StreamCompression bool `yaml:"stream_compression"`
+	// MaxTTL caps the ttl_seconds a client may request for a tunnel (0 means no cap).
+	MaxTTL time.Duration `yaml:"max_ttl"`
+	// PoolHealthCheck probes pool members and takes failing ones out of rotation.
+	PoolHealthCheck PoolHealthCheckConfig `yaml:"pool_health_check"`
+	// PoolRetry retries failed requests to a pool on another member.
+	PoolRetry PoolRetryConfig `yaml:"pool_retry"`
+}
+
+// PoolRetryConfig configures retries of pool requests whose stream failed
+// before a response arrived.
+type PoolRetryConfig struct {
+	Retries int           `yaml:"retries"` // Attempts on other members after a failure (default 1, -1 disables)
+	Timeout time.Duration `yaml:"timeout"` // Budget for all attempts of one request (0 means none)
+	Methods []string      `yaml:"methods"` // Methods that may be retried (default GET, HEAD, OPTIONS)
+}
+
+// PoolHealthCheckConfig configures active health checks of pool members.
+type PoolHealthCheckConfig struct {
+	Interval           time.Duration `yaml:"interval"`            // How often members are probed (0 disables checks)
+	Timeout            time.Duration `yaml:"timeout"`             // Deadline of a single probe (default 5s)
+	Path               string        `yaml:"path"`                // Path the probe requests (default "/")
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"` // Consecutive failures before a member leaves rotation (default 3)
+}
+
+func (c *PoolHealthCheckConfig) validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("tunnels.pool_health_check.interval must not be negative")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Second
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("tunnels.pool_health_check.timeout must not be negative")
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("tunnels.pool_health_check.path must start with /, got %q", c.Path)
+	}
+	if c.UnhealthyThreshold == 0 {
+		c.UnhealthyThreshold = 3
+	}
+	if c.UnhealthyThreshold < 0 {
+		return fmt.Errorf("tunnels.pool_health_check.unhealthy_threshold must be positive")
+	}
+	return nil
+}
+
+func (c *PoolRetryConfig) validate() error {
+	if c.Retries == 0 {
+		c.Retries = 1
+	}
+	if c.Retries < -1 {
+		return fmt.Errorf("tunnels.pool_retry.retries must be -1 or more, got %d", c.Retries)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("tunnels.pool_retry.timeout must not be negative")
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = []string{"GET", "HEAD", "OPTIONS"}
+	}
+	for i, method := range c.Methods {
+		if method == "" || strings.ContainsAny(method, " \t") {
+			return fmt.Errorf("tunnels.pool_retry.methods contains an invalid method %q", method)
+		}
+		c.Methods[i] = strings.ToUpper(method)
+	}
+	return nil
+}
+
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return &config, nil
+}
+
+func (c *Config) validate() error {
+	if c.Server.Domain == "" {
+		return fmt.Errorf("server.domain is required")
+	}
+	if c.Server.ControlPort == 0 {
+		c.Server.ControlPort = 4443
+	}
+	if c.Server.HTTPPort == 0 {
+		c.Server.HTTPPort = 80
+	}
+	if c.Server.ControlPath == "" {
+		c.Server.ControlPath = "/"
+	}
+	if err := validateControlPath(c.Server.ControlPath); err != nil {
+		return err
+	}
+	if c.Server.HTTPSPort == 0 {
+		c.Server.HTTPSPort = 443
+	}
+	if c.Database.Type == "" {
+		c.Database.Type = "sqlite"
+	}
+	if c.Database.Path == "" {
+		c.Database.Path = "./tunnelab.db"
+	}
+	if c.Database.QueryTimeout == 0 {
+		c.Database.QueryTimeout = 2 * time.Second
+	}
+	if c.Database.Retries == 0 {
+		c.Database.Retries = 2
+	}
+	if c.Database.BreakerThreshold == 0 {
+		c.Database.BreakerThreshold = 5
+	}
+	if c.Database.BreakerCooldown == 0 {
+		c.Database.BreakerCooldown = 10 * time.Second
+	}
+	if c.Database.JournalMode == "" {
+		c.Database.JournalMode = "wal"
+	}
+	if c.Database.BusyTimeout == 0 {
+		c.Database.BusyTimeout = 5 * time.Second
+	}
+	if c.Database.ForeignKeys == nil {
+		// JWT clients have no row in the clients table, so their tunnels
+		// would violate the tunnels.client_id foreign key.
+		foreignKeys := c.Auth.Mode != "jwt"
+		c.Database.ForeignKeys = &foreignKeys
+	}
+	if c.Database.Synchronous == "" {
+		c.Database.Synchronous = "normal"
+	}
+	if c.Quota.CheckInterval == 0 {
+		c.Quota.CheckInterval = time.Minute
+	}
+	if c.CustomDomains.RefreshInterval == 0 {
+		c.CustomDomains.RefreshInterval = time.Minute
+	}
+	if c.Logging.Level == "" {
+		c.Logging.Level = "info"
+	}
+	if c.Logging.Format == "" {
+		c.Logging.Format = "text"
+	}
+	if c.Logging.ConnectionLogSampleRate == nil {
+		rate := 1.0
+		c.Logging.ConnectionLogSampleRate = &rate
+	}
+	if c.Tunnels.TCPPortRange == "" {
+		c.Tunnels.TCPPortRange = "30000-31000"
+	}
+	if c.Tunnels.PortAllocation == "" {
+		c.Tunnels.PortAllocation = "round-robin"
+	}
+	switch c.Tunnels.PortAllocation {
+	case "sequential", "round-robin", "random":
+	default:
+		return fmt.Errorf("tunnels.port_allocation must be \"sequential\", \"round-robin\" or \"random\", got %q", c.Tunnels.PortAllocation)
+	}
+	if c.Tunnels.SubdomainPolicy == "" {
+		c.Tunnels.SubdomainPolicy = "required"
+	}
+	switch c.Tunnels.SubdomainPolicy {
+	case "required", "optional", "random":
+	default:
+		return fmt.Errorf("tunnels.http_subdomain_policy must be \"required\", \"optional\" or \"random\", got %q", c.Tunnels.SubdomainPolicy)
+	}
+	if c.Tunnels.PortPolicy == "" {
+		c.Tunnels.PortPolicy = "request"
+	}
+	switch c.Tunnels.PortPolicy {
+	case "request", "auto":
+	default:
+		return fmt.Errorf("tunnels.tcp_port_policy must be \"request\" or \"auto\", got %q", c.Tunnels.PortPolicy)
+	}
+	if c.Tunnels.PoolBalancing == "" {
+		c.Tunnels.PoolBalancing = "round-robin"
+	}
+	switch c.Tunnels.PoolBalancing {
+	case "round-robin", "least-connections":
+	default:
+		return fmt.Errorf("tunnels.pool_balancing must be \"round-robin\" or \"least-connections\", got %q", c.Tunnels.PoolBalancing)
+	}
+	if err := c.Tunnels.PoolHealthCheck.validate(); err != nil {
+		return err
+	}
+	if err := c.Tunnels.PoolRetry.validate(); err != nil {
+		return err
+	}
+	if c.Tunnels.MaxTunnelsPerClient == 0 {
+		c.Tunnels.MaxTunnelsPerClient = 5
+	}
+	if c.TLS.Mode == "" {
+		c.TLS.Mode = "disabled"
+	}
+	if c.TLS.CacheDir == "" {
+		c.TLS.CacheDir = "./certs"
+	}
+	if c.TLS.MinVersion == "" {
+		c.TLS.MinVersion = "1.2"
+	}
+	if c.TLS.MinVersion != "1.2" && c.TLS.MinVersion != "1.3" {
+		return fmt.Errorf("tls.min_version must be \"1.2\" or \"1.3\", got %q", c.TLS.MinVersion)
+	}
+	for _, curve := range c.TLS.Curves {
+		switch strings.ToUpper(curve) {
+		case "X25519", "P256", "P384", "P521":
+		default:
+			return fmt.Errorf("tls.curves: unsupported curve %q", curve)
+		}
+	}
+	if c.TLS.CertKeyType == "" {
+		c.TLS.CertKeyType = "ecdsa"
+	}
+	if c.TLS.CertKeyType != "ecdsa" && c.TLS.CertKeyType != "rsa" {
+		return fmt.Errorf("tls.cert_key_type must be \"ecdsa\" or \"rsa\", got %q", c.TLS.CertKeyType)
+	}
+	if c.TLS.NegativeCacheTTL == 0 {
+		c.TLS.NegativeCacheTTL = time.Minute
+	}
+	if c.TLS.IssuanceLimit == 0 {
+		c.TLS.IssuanceLimit = 10
+	}
+	if c.TLS.IssuanceWindow == 0 {
+		c.TLS.IssuanceWindow = time.Minute
+	}
+	if c.Server.MaxControlMessageSize == 0 {
+		c.Server.MaxControlMessageSize = 1 << 20
+	}
+	if c.Server.MaxControlMessageSize < 1024 {
+		return fmt.Errorf("server.max_control_message_size must be at least 1024 bytes")
+	}
+	if c.Server.AuthTimeout == 0 {
+		c.Server.AuthTimeout = 30 * time.Second
+	}
+	if c.Server.AuthTimeout < time.Second || c.Server.AuthTimeout > 10*time.Minute {
+		return fmt.Errorf("server.auth_timeout must be between 1s and 10m")
+	}
+	if c.Server.MuxTimeout == 0 {
+		c.Server.MuxTimeout = 30 * time.Second
+	}
+	if c.Server.MuxTimeout < time.Second || c.Server.MuxTimeout > 10*time.Minute {
+		return fmt.Errorf("server.mux_timeout must be between 1s and 10m")
+	}
+	if c.Server.MuxBindAddress == "" {
+		c.Server.MuxBindAddress = "127.0.0.1"
+	}
+	if net.ParseIP(c.Server.MuxBindAddress) == nil {
+		return fmt.Errorf("server.mux_bind_address must be an IP address, got %q", c.Server.MuxBindAddress)
+	}
+	if c.Server.MaxControlConnsPerIP < 0 {
+		return fmt.Errorf("server.max_control_connections_per_ip must not be negative")
+	}
+	if c.Server.MaxProxyConnsPerIP < 0 {
+		return fmt.Errorf("server.max_proxy_connections_per_ip must not be negative")
+	}
+	if err := c.Server.HTTPTimeouts.validate(); err != nil {
+		return err
+	}
+	if err := c.Server.Maintenance.validate(); err != nil {
+		return err
+	}
+	if c.Server.MaxHeaderBytes == 0 {
+		c.Server.MaxHeaderBytes = 64 << 10
+	}
+	if c.Server.MaxHeaderBytes < 1024 || c.Server.MaxHeaderBytes > 1<<20 {
+		return fmt.Errorf("server.max_header_bytes must be between 1024 and 1048576")
+	}
+	if c.Server.StripResponseHeaders == nil {
+		c.Server.StripResponseHeaders = DefaultStripResponseHeaders
+	}
+	for _, name := range c.Server.StripResponseHeaders {
+		if !isToken(name) {
+			return fmt.Errorf("server.strip_response_headers: %q is not a valid header name", name)
+		}
+	}
+	if c.Server.Via != "" && !isToken(c.Server.Via) {
+		return fmt.Errorf("server.via must be a single token without spaces, got %q", c.Server.Via)
+	}
+	if err := c.Server.SecurityHeaders.validate(); err != nil {
+		return err
+	}
+	if c.Tunnels.SNIPort < 0 || c.Tunnels.SNIPort > 65535 {
+		return fmt.Errorf("tunnels.sni_port must be between 0 and 65535")
+	}
+	if c.Tunnels.StatsInterval < 0 {
+		return fmt.Errorf("tunnels.stats_interval must not be negative")
+	}
+	if c.Tunnels.GRPCMaxStreams == 0 {
+		c.Tunnels.GRPCMaxStreams = 100
+	}
+	if c.Tunnels.GRPCMaxStreams < 0 {
+		return fmt.Errorf("tunnels.grpc_max_streams must not be negative")
+	}
+	if c.Tunnels.MaxTTL < 0 {
+		return fmt.Errorf("tunnels.max_ttl must not be negative")
+	}
+	if c.Tunnels.CopyBufferSize == 0 {
+		c.Tunnels.CopyBufferSize = 32 * 1024
+	}
+	if c.Tunnels.CopyBufferSize < 1024 {
+		return fmt.Errorf("tunnels.copy_buffer_size must be at least 1024 bytes")
+	}
+	if c.Auth.Mode == "" {
+		c.Auth.Mode = "token"
+	}
+	switch c.Auth.Mode {
+	case "token":
+	case "jwt":
+		if c.Auth.JWT.Secret == "" && c.Auth.JWT.JWKS == "" {
+			return fmt.Errorf("auth.jwt.secret or auth.jwt.jwks is required when auth.mode is jwt")
+		}
+	default:
+		return fmt.Errorf("auth.mode must be \"token\" or \"jwt\", got %q", c.Auth.Mode)
+	}
+	if c.Cluster.OwnershipTTL == 0 {
+		c.Cluster.OwnershipTTL = 30 * time.Second
+	}
+	switch c.Cluster.Store {
+	case "":
+	case "redis":
+		if c.Cluster.RedisAddr == "" || c.Cluster.NodeAddress == "" || c.Cluster.Secret == "" {
+			return fmt.Errorf("cluster.redis_addr, cluster.node_address and cluster.secret are required when cluster.store is redis")
+		}
+		if c.Cluster.PeerPort <= 0 || c.Cluster.PeerPort > 65535 {
+			return fmt.Errorf("cluster.peer_port must be between 1 and 65535 when cluster.store is redis")
+		}
+		if c.Cluster.TLSCert == "" || c.Cluster.TLSKey == "" || c.Cluster.TLSCA == "" {
+			return fmt.Errorf("cluster.tls_cert, cluster.tls_key and cluster.tls_ca are required when cluster.store is redis")
+		}
+		if c.Cluster.OwnershipTTL < 3*time.Second {
+			return fmt.Errorf("cluster.ownership_ttl must be at least 3s")
+		}
+	default:
+		return fmt.Errorf("cluster.store must be empty or \"redis\", got %q", c.Cluster.Store)
+	}
+	if c.Quota.MonthlyBytes < 0 {
+		return fmt.Errorf("quota.monthly_bytes must not be negative")
+	}
+	if c.Quota.CheckInterval < 0 {
+		return fmt.Errorf("quota.check_interval must not be negative")
+	}
+	if rate := *c.Logging.ConnectionLogSampleRate; rate < 0 || rate > 1 {
+		return fmt.Errorf("logging.connection_log_sample_rate must be between 0 and 1, got %v", rate)
+	}
+	if c.Quota.Enabled && *c.Logging.ConnectionLogSampleRate < 1 {
+		// Quota usage is summed from the connection logs.
+		return fmt.Errorf("logging.connection_log_sample_rate must be 1 when quota.enabled is set")
+	}
+	if err := c.Webhooks.validate(); err != nil {
+		return err
+	}
+	if err := c.Admin.validate(); err != nil {
+		return err
+	}
+	if err := c.Database.validate(); err != nil {
+		return err
+	}
+	if err := c.CustomDomains.validate(); err != nil {
+		return err
+	}
+	if err := c.validateTLS(); err != nil {
+		return err
+	}
+	return c.validatePorts()
+}
+
+// validate fills in webhook defaults and checks the receivers and event types.
+func (c *WebhooksConfig) validate() error {
+	for _, raw := range c.URLs {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhooks.urls must be http or https URLs, got %q", raw)
+		}
+	}
+	for _, event := range c.Events {
+		switch event {
+		case "tunnel.created", "tunnel.closed", "auth.failed":
+		default:
+			return fmt.Errorf("webhooks.events must be \"tunnel.created\", \"tunnel.closed\" or \"auth.failed\", got %q", event)
+		}
+	}
+	if c.Retries == 0 {
+		c.Retries = 3
+	}
+	if c.Retries < -1 || c.Retries > 10 {
+		return fmt.Errorf("webhooks.retries must be between -1 and 10, got %d", c.Retries)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Second
+	}
+	if c.Timeout < 0 || c.Timeout > time.Minute {
+		return fmt.Errorf("webhooks.timeout must be between 0 and 1m")
+	}
+	return nil
+}
+
+// reservedControlPaths are served by other endpoints of the control port,
+// so the control WebSocket cannot be mounted on or under them.
+var reservedControlPaths = []string{"/api", "/protocol", "/healthz", "/readyz"}
+
+// validateControlPath checks that path is a clean absolute path that does
+// not shadow the admin API, the protocol schema or the health probes.
+func validateControlPath(p string) error {
+	if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, "?# {}") || path.Clean(p) != p {
+		return fmt.Errorf("server.control_path must be a clean absolute path such as /tunnel, got %q", p)
+	}
+	for _, reserved := range reservedControlPaths {
+		if p == reserved || strings.HasPrefix(p, reserved+"/") {
+			return fmt.Errorf("server.control_path %q is reserved for another endpoint", p)
+		}
+	}
+	return nil
+}
+
+// validateTLS checks the settings each TLS mode depends on.
+func (c *Config) validateTLS() error {
+	switch c.TLS.Mode {
+	case "disabled":
+	case "auto":
+		if c.TLS.Email == "" {
+			return fmt.Errorf("tls.email is required when tls.mode is auto (the ACME account contact)")
+		}
+	case "manual":
+		if c.TLS.CertPath == "" {
+			return fmt.Errorf("tls.cert_path is required when tls.mode is manual")
+		}
+		if c.TLS.KeyPath == "" {
+			return fmt.Errorf("tls.key_path is required when tls.mode is manual")
+		}
+	default:
+		return fmt.Errorf("tls.mode must be \"auto\", \"manual\" or \"disabled\", got %q", c.TLS.Mode)
+	}
+	if (c.TLS.EABKeyID == "") != (c.TLS.EABHMACKey == "") {
+		return fmt.Errorf("tls.eab_kid and tls.eab_hmac_key must be set together")
+	}
+	if c.TLS.SNIRouting && c.TLS.Mode == "disabled" {
+		return fmt.Errorf("tls.sni_routing requires tls.mode auto or manual")
+	}
+	return nil
+}
+
+// namedPort is a listening port and the config key that sets it.
+type namedPort struct {
+	name string
+	port int
+}
+
+// validatePorts checks that every listening port is valid and that no two
+// listeners, including the TCP tunnel port range, share a port. A range with
+// privileged ports is rejected when the process could not bind them.
+func (c *Config) validatePorts() error {
+	ports := []namedPort{
+		{"server.control_port", c.Server.ControlPort},
+		{"server.http_port", c.Server.HTTPPort},
+	}
+	if c.TLS.Mode != "disabled" {
+		ports = append(ports, namedPort{"server.https_port", c.Server.HTTPSPort})
+	}
+	if c.Tunnels.SNIPort > 0 {
+		ports = append(ports, namedPort{"tunnels.sni_port", c.Tunnels.SNIPort})
+	}
+	if c.Admin.Port != 0 {
+		ports = append(ports, namedPort{"admin.port", c.Admin.Port})
+	}
+
+	start, end, err := c.Tunnels.PortRange()
+	if err != nil {
+		return err
+	}
+	if limit := unprivilegedPortStart(); start < limit {
+		return fmt.Errorf("tunnels.tcp_port_range %s includes privileged ports below %d, which this process cannot bind; "+
+			"run as root, grant CAP_NET_BIND_SERVICE or start the range at %d or above", c.Tunnels.TCPPortRange, limit, limit)
+	}
+	seen := make(map[int]string)
+	for _, p := range ports {
+		if p.port < 1 || p.port > 65535 {
+			return fmt.Errorf("%s must be between 1 and 65535, got %d", p.name, p.port)
+		}
+		if other, dup := seen[p.port]; dup {
+			return fmt.Errorf("%s and %s both use port %d", other, p.name, p.port)
+		}
+		seen[p.port] = p.name
+		if p.port >= start && p.port <= end {
+			return fmt.Errorf("%s (%d) is inside tunnels.tcp_port_range %s", p.name, p.port, c.Tunnels.TCPPortRange)
+		}
+	}
+	return nil
+}
+
+// PortRange parses tcp_port_range.
+//
+// Returns:
+//   - int: First port of the range
+//   - int: Last port of the range
+//   - error: Error if the range is malformed or outside 1-65535
+func (t TunnelsConfig) PortRange() (int, int, error) {
+	parts := strings.Split(t.TCPPortRange, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid tunnels.tcp_port_range %q: expected start-end", t.TCPPortRange)
+	}
+	start, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	end, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("invalid tunnels.tcp_port_range %q: ports must be numbers", t.TCPPortRange)
+	}
+	if start < 1 || end > 65535 || end < start {
+		return 0, 0, fmt.Errorf("invalid tunnels.tcp_port_range %q: expected 1 <= start <= end <= 65535", t.TCPPortRange)
+	}
+	return start, end, nil
+}
+
+// isToken reports whether s is an HTTP token (RFC 9110, section 5.6.2), the
+// syntax of header names and Via pseudonyms.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
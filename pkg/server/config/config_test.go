@@ -0,0 +1,368 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadYAML writes content to a temporary file and loads it.
+func loadYAML(t *testing.T, content string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return Load(path)
+}
+
+func TestExampleConfigIsValid(t *testing.T) {
+	if _, err := Load(filepath.Join("..", "..", "..", "configs", "server.example.yaml")); err != nil {
+		t.Fatalf("expected the example config to be valid: %v", err)
+	}
+}
+
+func TestValidateAppliesDefaults(t *testing.T) {
+	cfg, err := loadYAML(t, "server:\n  domain: tunnel.example.com\n")
+	if err != nil {
+		t.Fatalf("expected a minimal config to be valid: %v", err)
+	}
+	if cfg.Server.ControlPort != 4443 || cfg.TLS.Mode != "disabled" || cfg.Tunnels.TCPPortRange != "30000-31000" {
+		t.Fatalf("unexpected defaults: %+v", cfg)
+	}
+}
+
+func TestStripResponseHeadersDefaults(t *testing.T) {
+	cfg, err := loadYAML(t, "server:\n  domain: tunnel.example.com\n")
+	if err != nil {
+		t.Fatalf("expected a minimal config to be valid: %v", err)
+	}
+	if len(cfg.Server.StripResponseHeaders) != len(DefaultStripResponseHeaders) {
+		t.Fatalf("expected the default headers to be stripped, got %v", cfg.Server.StripResponseHeaders)
+	}
+	cfg, err = loadYAML(t, "server:\n  domain: tunnel.example.com\n  strip_response_headers: []\n")
+	if err != nil {
+		t.Fatalf("expected an empty list to be valid: %v", err)
+	}
+	if len(cfg.Server.StripResponseHeaders) != 0 {
+		t.Fatalf("expected an empty list to strip nothing, got %v", cfg.Server.StripResponseHeaders)
+	}
+}
+
+func TestValidateAcceptsTLSModes(t *testing.T) {
+	for name, tls := range map[string]string{
+		"disabled": "tls:\n  mode: disabled\n",
+		"auto":     "tls:\n  mode: auto\n  email: ops@example.com\n",
+		"manual":   "tls:\n  mode: manual\n  cert_path: cert.pem\n  key_path: key.pem\n",
+	} {
+		if _, err := loadYAML(t, "server:\n  domain: tunnel.example.com\n"+tls); err != nil {
+			t.Errorf("%s: expected a valid config, got %v", name, err)
+		}
+	}
+}
+
+// allowPorts makes validation assume the process may bind ports from start on.
+func allowPorts(t *testing.T, start int) {
+	t.Helper()
+	saved := unprivilegedPortStart
+	unprivilegedPortStart = func() int { return start }
+	t.Cleanup(func() { unprivilegedPortStart = saved })
+}
+
+func TestValidateRejectsInvalidConfigs(t *testing.T) {
+	allowPorts(t, 0)
+	cases := map[string]struct {
+		yaml string
+		want string
+	}{
+		"missing domain": {
+			"server:\n  http_port: 8080\n",
+			"server.domain is required",
+		},
+		"manual tls without cert": {
+			"tls:\n  mode: manual\n  key_path: /etc/tunnelab/key.pem\n",
+			"tls.cert_path is required when tls.mode is manual",
+		},
+		"manual tls without key": {
+			"tls:\n  mode: manual\n  cert_path: /etc/tunnelab/cert.pem\n",
+			"tls.key_path is required when tls.mode is manual",
+		},
+		"manual tls without either": {
+			"tls:\n  mode: manual\n",
+			"tls.cert_path is required when tls.mode is manual",
+		},
+		"auto tls without email": {
+			"tls:\n  mode: auto\n",
+			"tls.email is required when tls.mode is auto",
+		},
+		"mux timeout too short": {
+			"server:\n  domain: tunnel.example.com\n  mux_timeout: 100ms\n",
+			"server.mux_timeout must be between 1s and 10m",
+		},
+		"auth timeout too long": {
+			"server:\n  domain: tunnel.example.com\n  auth_timeout: 1h\n",
+			"server.auth_timeout must be between 1s and 10m",
+		},
+		"mux bind address is a hostname": {
+			"server:\n  domain: tunnel.example.com\n  mux_bind_address: localhost\n",
+			"server.mux_bind_address must be an IP address",
+		},
+		"webhook url without scheme": {
+			"webhooks:\n  urls: [\"hooks.example.com/tunnels\"]\n",
+			"webhooks.urls must be http or https URLs",
+		},
+		"unknown webhook event": {
+			"webhooks:\n  urls: [\"https://hooks.example.com\"]\n  events: [\"tunnel.opened\"]\n",
+			"webhooks.events must be",
+		},
+		"too many webhook retries": {
+			"webhooks:\n  retries: 50\n",
+			"webhooks.retries must be between -1 and 10",
+		},
+		"negative database pool size": {
+			"database:\n  max_open_conns: -2\n",
+			"database.max_open_conns must be -1",
+		},
+		"negative connection lifetime": {
+			"database:\n  conn_max_lifetime: -1s\n",
+			"database.conn_max_lifetime must not be negative",
+		},
+		"negative custom domain refresh": {
+			"custom_domains:\n  refresh_interval: -1m\n",
+			"custom_domains.refresh_interval must not be negative",
+		},
+		"admin port without token": {
+			"admin:\n  port: 9090\n",
+			"admin.port requires admin.token",
+		},
+		"admin bind address is a hostname": {
+			"admin:\n  token: secret\n  port: 9090\n  bind_address: localhost\n",
+			"admin.bind_address must be an IP address",
+		},
+		"unknown port allocation": {
+			"tunnels:\n  port_allocation: lowest\n",
+			"tunnels.port_allocation must be",
+		},
+		"unknown subdomain policy": {
+			"tunnels:\n  http_subdomain_policy: never\n",
+			"tunnels.http_subdomain_policy must be",
+		},
+		"unknown port policy": {
+			"tunnels:\n  tcp_port_policy: fixed\n",
+			"tunnels.tcp_port_policy must be",
+		},
+		"relative health check path": {
+			"tunnels:\n  pool_health_check:\n    path: healthz\n",
+			"tunnels.pool_health_check.path must start with /",
+		},
+		"negative pool retries": {
+			"tunnels:\n  pool_retry:\n    retries: -2\n",
+			"tunnels.pool_retry.retries must be -1 or more",
+		},
+		"unknown pool balancing": {
+			"tunnels:\n  pool_balancing: fastest\n",
+			"tunnels.pool_balancing must be",
+		},
+		"mode with different case": {
+			"tls:\n  mode: Manual\n",
+			"tls.mode must be",
+		},
+		"unknown tls mode": {
+			"tls:\n  mode: letsencrypt\n",
+			"tls.mode must be",
+		},
+		"half of eab credentials": {
+			"tls:\n  mode: auto\n  email: ops@example.com\n  eab_kid: kid\n",
+			"tls.eab_kid and tls.eab_hmac_key must be set together",
+		},
+		"sni routing without tls": {
+			"tls:\n  sni_routing: true\n",
+			"tls.sni_routing requires",
+		},
+		"port out of range": {
+			"server:\n  domain: tunnel.example.com\n  http_port: 70000\n",
+			"server.http_port must be between 1 and 65535",
+		},
+		"duplicate ports": {
+			"server:\n  domain: tunnel.example.com\n  control_port: 8080\n  http_port: 8080\n",
+			"server.control_port and server.http_port both use port 8080",
+		},
+		"reversed port range": {
+			"tunnels:\n  tcp_port_range: 31000-30000\n",
+			"invalid tunnels.tcp_port_range",
+		},
+		"malformed port range": {
+			"tunnels:\n  tcp_port_range: \"30000\"\n",
+			"expected start-end",
+		},
+		"port range above 65535": {
+			"tunnels:\n  tcp_port_range: 65000-70000\n",
+			"expected 1 <= start <= end <= 65535",
+		},
+		"listener inside port range": {
+			"tunnels:\n  tcp_port_range: 1-1000\n",
+			"server.http_port (80) is inside tunnels.tcp_port_range",
+		},
+		"sni port inside port range": {
+			"tunnels:\n  sni_port: 30500\n",
+			"tunnels.sni_port (30500) is inside tunnels.tcp_port_range",
+		},
+		"sample rate above one": {
+			"logging:\n  connection_log_sample_rate: 1.5\n",
+			"logging.connection_log_sample_rate must be between 0 and 1",
+		},
+		"sampled quota usage": {
+			"logging:\n  connection_log_sample_rate: 0.5\nquota:\n  enabled: true\n",
+			"logging.connection_log_sample_rate must be 1 when quota.enabled is set",
+		},
+		"negative quota": {
+			"quota:\n  enabled: true\n  monthly_bytes: -1\n",
+			"quota.monthly_bytes must not be negative",
+		},
+		"invalid stripped header": {
+			"server:\n  domain: tunnel.example.com\n  strip_response_headers: [\"X Powered By\"]\n",
+			"server.strip_response_headers",
+		},
+		"tiny header limit": {
+			"server:\n  domain: tunnel.example.com\n  max_header_bytes: 100\n",
+			"server.max_header_bytes must be between 1024 and 1048576",
+		},
+		"negative http timeout": {
+			"server:\n  domain: tunnel.example.com\n  http_timeouts:\n    idle: -1s\n",
+			"server.http_timeouts must not be negative",
+		},
+		"read timeout shorter than headers": {
+			"server:\n  domain: tunnel.example.com\n  http_timeouts:\n    read_header: 10s\n    read: 5s\n",
+			"server.http_timeouts.read must not be shorter than read_header",
+		},
+		"relative control path": {
+			"server:\n  domain: tunnel.example.com\n  control_path: tunnel\n",
+			"server.control_path must be a clean absolute path",
+		},
+		"reserved control path": {
+			"server:\n  domain: tunnel.example.com\n  control_path: /api/tunnel\n",
+			"server.control_path \"/api/tunnel\" is reserved for another endpoint",
+		},
+		"control path on a health probe": {
+			"server:\n  domain: tunnel.example.com\n  control_path: /readyz\n",
+			"server.control_path \"/readyz\" is reserved for another endpoint",
+		},
+		"invalid security header name": {
+			"server:\n  domain: tunnel.example.com\n  security_headers:\n    enabled: true\n    headers:\n      \"Bad Name\": x\n",
+			"server.security_headers.headers: \"Bad Name\" is not a valid header name",
+		},
+		"empty security header value": {
+			"server:\n  domain: tunnel.example.com\n  security_headers:\n    enabled: true\n    headers:\n      X-Frame-Options: \"\"\n",
+			"server.security_headers.headers: X-Frame-Options must have a single-line value",
+		},
+		"negative maintenance retry after": {
+			"server:\n  domain: tunnel.example.com\n  maintenance:\n    retry_after: -1s\n",
+			"server.maintenance.retry_after must not be negative",
+		},
+		"maintenance tunnel with domain": {
+			"server:\n  domain: tunnel.example.com\n  maintenance:\n    tunnels: [app.tunnel.example.com]\n",
+			"server.maintenance.tunnels: invalid subdomain",
+		},
+		"negative control connections per ip": {
+			"server:\n  domain: tunnel.example.com\n  max_control_connections_per_ip: -1\n",
+			"server.max_control_connections_per_ip must not be negative",
+		},
+		"negative proxy connections per ip": {
+			"server:\n  domain: tunnel.example.com\n  max_proxy_connections_per_ip: -1\n",
+			"server.max_proxy_connections_per_ip must not be negative",
+		},
+		"via with spaces": {
+			"server:\n  domain: tunnel.example.com\n  via: \"my proxy\"\n",
+			"server.via must be a single token",
+		},
+		"redis cluster without secret": {
+			"cluster:\n  store: redis\n  redis_addr: 127.0.0.1:6379\n  node_address: 10.0.0.5:80\n",
+			"cluster.secret are required",
+		},
+		"redis cluster without peer tls": {
+			"cluster:\n  store: redis\n  redis_addr: 127.0.0.1:6379\n  node_address: 10.0.0.5:7443\n  secret: s\n  peer_port: 7443\n",
+			"cluster.tls_ca are required",
+		},
+	}
+
+	for name, tc := range cases {
+		content := tc.yaml
+		if !strings.Contains(content, "domain:") && name != "missing domain" {
+			content = "server:\n  domain: tunnel.example.com\n" + content
+		}
+		_, err := loadYAML(t, content)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected error containing %q, got %v", name, tc.want, err)
+		}
+	}
+}
+
+func TestValidatePortRangeOverlap(t *testing.T) {
+	allowPorts(t, 0)
+	cases := map[string]struct {
+		yaml string
+		want string // empty for a valid config
+	}{
+		"control port inside range": {
+			"server:\n  domain: tunnel.example.com\n  control_port: 30010\n",
+			"server.control_port (30010) is inside tunnels.tcp_port_range",
+		},
+		"https port inside range": {
+			"server:\n  domain: tunnel.example.com\n  https_port: 30000\ntls:\n  mode: auto\n  email: ops@example.com\n",
+			"server.https_port (30000) is inside tunnels.tcp_port_range",
+		},
+		"https port ignored without tls": {
+			"server:\n  domain: tunnel.example.com\n  https_port: 30000\n",
+			"",
+		},
+		"range next to server ports": {
+			"server:\n  domain: tunnel.example.com\n  control_port: 4443\ntunnels:\n  tcp_port_range: 4444-5000\n",
+			"",
+		},
+	}
+	for name, tc := range cases {
+		_, err := loadYAML(t, tc.yaml)
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("%s: expected a valid config, got %v", name, err)
+		case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+			t.Errorf("%s: expected error containing %q, got %v", name, tc.want, err)
+		}
+	}
+}
+
+func TestValidatePrivilegedPortRange(t *testing.T) {
+	config := "server:\n  domain: tunnel.example.com\n  http_port: 8080\n  control_port: 8443\ntunnels:\n  tcp_port_range: 500-600\n"
+
+	allowPorts(t, 1024)
+	if _, err := loadYAML(t, config); err == nil || !strings.Contains(err.Error(), "privileged ports below 1024") {
+		t.Fatalf("expected privileged ports to be rejected, got %v", err)
+	}
+
+	allowPorts(t, 0)
+	if _, err := loadYAML(t, config); err != nil {
+		t.Fatalf("expected privileged ports to be allowed for root, got %v", err)
+	}
+}
+
+func TestHasCapability(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status")
+	status := "Name:\ttunnelab\nCapInh:\t0000000000000000\nCapEff:\t0000000000000400\n"
+	if err := os.WriteFile(path, []byte(status), 0o600); err != nil {
+		t.Fatalf("failed to write status: %v", err)
+	}
+	if !hasCapability(path, capNetBindService) {
+		t.Fatal("expected CAP_NET_BIND_SERVICE to be detected")
+	}
+	if hasCapability(path, 12) {
+		t.Fatal("expected other capabilities to be absent")
+	}
+	if hasCapability(filepath.Join(t.TempDir(), "missing"), capNetBindService) {
+		t.Fatal("expected a missing status file to report no capability")
+	}
+}
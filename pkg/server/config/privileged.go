@@ -0,0 +1,51 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// capNetBindService is the Linux capability bit that allows binding ports
+// below ip_unprivileged_port_start.
+const capNetBindService = 10
+
+// unprivilegedPortStart returns the lowest port this process may bind, or 0
+// if it may bind any port. It is a best-effort check: root, and on Linux the
+// CAP_NET_BIND_SERVICE capability and the ip_unprivileged_port_start sysctl,
+// are taken into account. Tests replace it.
+var unprivilegedPortStart = func() int {
+	uid := os.Geteuid()
+	if uid == 0 || uid == -1 {
+		// Root, or a platform without user IDs such as Windows.
+		return 0
+	}
+	if hasCapability("/proc/self/status", capNetBindService) {
+		return 0
+	}
+	start := 1024
+	if data, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			start = n
+		}
+	}
+	return start
+}
+
+// hasCapability reports whether the effective capability set in a
+// /proc/<pid>/status file includes bit.
+func hasCapability(statusPath string, bit uint) bool {
+	data, err := os.ReadFile(statusPath)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		value, ok := strings.CutPrefix(line, "CapEff:")
+		if !ok {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		return err == nil && caps&(1<<bit) != 0
+	}
+	return false
+}
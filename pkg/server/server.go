@@ -0,0 +1,753 @@
+// Package server assembles a complete TunneLab server from its configuration:
+// the control endpoint, the HTTP(S) proxy, the TCP and SNI proxies and the
+// background jobs. cmd/server is a thin wrapper around it, other modules can
+// embed it, and tests use it to run a real server on ephemeral ports.
+//
+// Usage:
+//
+//	srv, err := server.New(cfg)
+//	if err != nil {
+//		return err
+//	}
+//	if err := srv.Start(); err != nil {
+//		return err
+//	}
+//	defer srv.Shutdown(context.Background())
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+	"github.com/essajiwa/tunnelab/internal/server/admin"
+	"github.com/essajiwa/tunnelab/internal/server/auth"
+	"github.com/essajiwa/tunnelab/internal/server/control"
+	"github.com/essajiwa/tunnelab/internal/server/domains"
+	"github.com/essajiwa/tunnelab/internal/server/health"
+	"github.com/essajiwa/tunnelab/internal/server/iplimit"
+	"github.com/essajiwa/tunnelab/internal/server/proxy"
+	"github.com/essajiwa/tunnelab/internal/server/quota"
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+	tlsmanager "github.com/essajiwa/tunnelab/internal/server/tls"
+	"github.com/essajiwa/tunnelab/internal/server/webhook"
+	"github.com/essajiwa/tunnelab/pkg/server/config"
+)
+
+// Version is the server build version, reported in X-Served-By headers.
+// cmd/server sets it from its build variable.
+var Version = "dev"
+
+// Server is a TunneLab server built from a configuration.
+type Server struct {
+	cfg       *config.Config
+	repo      *database.Repository
+	registry  *registry.Registry
+	store     *registry.RedisStore // nil unless cluster.store is redis
+	control   *control.Handler
+	httpProxy *proxy.HTTPProxy
+	tcpProxy  *proxy.TCPProxy
+	enforcer  *quota.Enforcer   // nil unless quotas are enabled
+	domains   *domains.Manager  // nil unless custom domains are enabled
+	webhooks  *webhook.Notifier // nil unless webhooks.urls is set
+	logRate   float64           // Fraction of requests written to the connection logs
+	checker   *health.Checker
+
+	controlServer *http.Server
+	httpServer    *http.Server
+	httpsServer   *http.Server // nil when TLS is disabled
+	adminServer   *http.Server // nil unless admin.port is set
+	peerServer    *http.Server // nil unless cluster.store is set
+	httpsMode     string       // Description of the certificate source, for logs
+
+	done         chan struct{} // Closed by Shutdown to stop background jobs
+	shutdownOnce sync.Once
+
+	mu          sync.Mutex
+	started     bool
+	controlAddr net.Addr
+	httpAddr    net.Addr
+	httpsAddr   net.Addr
+	adminAddr   net.Addr
+	peerAddr    net.Addr
+}
+
+// OpenRepository opens the database of cfg with its configured pragmas and
+// pool limits, running pending migrations. Foreign keys are enforced unless
+// database.foreign_keys is false.
+//
+// Parameters:
+//   - cfg: A validated configuration
+//
+// Returns:
+//   - *database.Repository: The opened database
+//   - error: Error if the database cannot be opened or migrated
+func OpenRepository(cfg *config.Config) (*database.Repository, error) {
+	foreignKeys := true
+	if cfg.Database.ForeignKeys != nil {
+		foreignKeys = *cfg.Database.ForeignKeys
+	}
+	return database.NewRepositoryWithOptions(cfg.Database.Path, database.Options{
+		JournalMode: cfg.Database.JournalMode,
+		BusyTimeout: cfg.Database.BusyTimeout,
+		ForeignKeys: foreignKeys,
+		Synchronous: cfg.Database.Synchronous,
+
+		MaxOpenConns:    cfg.Database.MaxOpenConns,
+		MaxIdleConns:    cfg.Database.MaxIdleConns,
+		ConnMaxLifetime: cfg.Database.ConnMaxLifetime,
+	})
+}
+
+// New builds a server from cfg. It opens the database and prepares every
+// handler, but binds no port until Start is called.
+//
+// Parameters:
+//   - cfg: A validated configuration, as returned by config.Load. Port 0
+//     listens on an ephemeral port.
+//
+// Returns:
+//   - *Server: The server, ready to start
+//   - error: Error if the database or a component cannot be set up
+func New(cfg *config.Config) (*Server, error) {
+	repo, err := OpenRepository(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+	repo.SetBreaker(database.NewBreaker(database.BreakerConfig{
+		Timeout:          cfg.Database.QueryTimeout,
+		Retries:          cfg.Database.Retries,
+		FailureThreshold: cfg.Database.BreakerThreshold,
+		Cooldown:         cfg.Database.BreakerCooldown,
+	}))
+
+	s := &Server{
+		cfg:      cfg,
+		repo:     repo,
+		registry: registry.NewRegistry(),
+		checker:  health.NewChecker(),
+		done:     make(chan struct{}),
+	}
+	if err := s.setup(); err != nil {
+		s.closeResources()
+		return nil, err
+	}
+	return s, nil
+}
+
+// setup creates the handlers, proxies and HTTP servers.
+func (s *Server) setup() error {
+	cfg := s.cfg
+
+	if cfg.Cluster.Store == "redis" {
+		s.store = registry.NewRedisStore(registry.RedisConfig{
+			Addr:     cfg.Cluster.RedisAddr,
+			Password: cfg.Cluster.RedisPassword,
+			DB:       cfg.Cluster.RedisDB,
+		})
+		s.registry.SetStore(s.store, cfg.Cluster.NodeAddress, cfg.Cluster.OwnershipTTL)
+		log.Printf("Cluster mode enabled: node %s, tunnel ownership in redis %s", cfg.Cluster.NodeAddress, cfg.Cluster.RedisAddr)
+	}
+
+	s.registry.SetPoolBalancing(cfg.Tunnels.PoolBalancing)
+	s.registry.SetPoolHealthCheck(registry.PoolHealthCheck{
+		Interval:           cfg.Tunnels.PoolHealthCheck.Interval,
+		Timeout:            cfg.Tunnels.PoolHealthCheck.Timeout,
+		Path:               cfg.Tunnels.PoolHealthCheck.Path,
+		UnhealthyThreshold: cfg.Tunnels.PoolHealthCheck.UnhealthyThreshold,
+	})
+	s.control = control.NewHandler(s.registry, s.repo, cfg.Server.Domain)
+	if err := s.control.SetSubdomainPolicy(cfg.Tunnels.SubdomainPolicy); err != nil {
+		return fmt.Errorf("invalid HTTP subdomain policy: %w", err)
+	}
+	if err := s.control.SetPortPolicy(cfg.Tunnels.PortPolicy); err != nil {
+		return fmt.Errorf("invalid TCP port policy: %w", err)
+	}
+	if cfg.Tunnels.TCPPortRange != "" {
+		if err := s.control.ConfigurePortAllocator(cfg.Tunnels.TCPPortRange, cfg.Tunnels.PortAllocation); err != nil {
+			return fmt.Errorf("invalid TCP port range %q: %w", cfg.Tunnels.TCPPortRange, err)
+		}
+		s.registry.UnregisterHook = s.control.ReleasePort
+		if reserved, err := s.control.RestorePortAssignments(context.Background()); err != nil {
+			log.Printf("Failed to restore public port assignments: %v", err)
+		} else if reserved > 0 {
+			log.Printf("Reserved %d public ports for tunnels active before the restart", reserved)
+		}
+	}
+	s.control.SetStatsInterval(cfg.Tunnels.StatsInterval)
+	s.control.SetSNIPort(cfg.Tunnels.SNIPort)
+	s.control.SetMaxTTL(cfg.Tunnels.MaxTTL)
+	s.control.SetMaxMessageSize(cfg.Server.MaxControlMessageSize)
+	s.control.SetAuthTimeout(cfg.Server.AuthTimeout)
+	s.control.SetMuxTimeout(cfg.Server.MuxTimeout)
+	s.control.SetMuxBindHost(cfg.Server.MuxBindAddress)
+	s.control.SetGRPCMaxStreams(cfg.Tunnels.GRPCMaxStreams)
+	if cfg.Tunnels.EnforceMaxTunnels {
+		s.control.EnforceMaxTunnels()
+	}
+	s.control.SetPublicHost(cfg.Tunnels.TCPPublicHost)
+	s.control.SetIPLimiter(iplimit.NewLimiter(cfg.Server.MaxControlConnsPerIP))
+	if cfg.Server.RequireSignedMessages {
+		s.control.RequireSignedMessages()
+	}
+	if cfg.Tunnels.StreamCompression {
+		s.control.EnableStreamCompression()
+	}
+
+	if cfg.Auth.Mode == "jwt" {
+		jwtAuth, err := auth.NewJWTAuthenticator(auth.JWTConfig{
+			Secret:   cfg.Auth.JWT.Secret,
+			JWKS:     cfg.Auth.JWT.JWKS,
+			Issuer:   cfg.Auth.JWT.Issuer,
+			Audience: cfg.Auth.JWT.Audience,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to configure JWT authentication: %w", err)
+		}
+		s.control.SetAuthenticator(jwtAuth)
+		log.Printf("JWT authentication enabled")
+	}
+
+	// One limit covers the HTTP(S), TCP and SNI connections of an IP.
+	proxyLimits := iplimit.NewLimiter(cfg.Server.MaxProxyConnsPerIP)
+	if cfg.Tunnels.TCPPortRange != "" || cfg.Tunnels.SNIPort > 0 {
+		s.tcpProxy = proxy.NewTCPProxy(s.registry)
+		s.tcpProxy.SetCopyBuffer(cfg.Tunnels.CopyBufferSize, cfg.Tunnels.BufferPool)
+		s.tcpProxy.SetIPLimiter(proxyLimits)
+	}
+
+	s.httpProxy = proxy.NewHTTPProxy(s.registry, cfg.Server.Domain)
+	s.httpProxy.SetCopyBuffer(cfg.Tunnels.CopyBufferSize, cfg.Tunnels.BufferPool)
+	s.httpProxy.SetPoolRetry(max(cfg.Tunnels.PoolRetry.Retries, 0), cfg.Tunnels.PoolRetry.Timeout, cfg.Tunnels.PoolRetry.Methods)
+	if cfg.Cluster.Store != "" {
+		peerTLS, err := proxy.NewPeerTLSConfig(cfg.Cluster.TLSCert, cfg.Cluster.TLSKey, cfg.Cluster.TLSCA)
+		if err != nil {
+			return err
+		}
+		s.httpProxy.EnableClusterForwarding(cfg.Cluster.Secret, peerTLS)
+		// Stream links get their own listener, so no tunnel host on the
+		// public ports can reach them.
+		s.peerServer = s.newHTTPServer(s.httpProxy.PeerStreamHandler())
+		s.peerServer.TLSConfig = peerTLS
+	}
+	if cfg.TLS.SNIRouting {
+		s.httpProxy.EnableSNIRouting()
+	}
+	s.httpProxy.SetResponseHeaders(cfg.Server.StripResponseHeaders, cfg.Server.Via)
+	if cfg.Server.SecurityHeaders.Enabled {
+		s.httpProxy.SetSecurityHeaders(cfg.Server.SecurityHeaders.Headers, cfg.Server.SecurityHeaders.Force)
+	}
+	s.httpProxy.SetMaxHeaderBytes(cfg.Server.MaxHeaderBytes)
+	s.httpProxy.SetIPLimiter(proxyLimits)
+	if cfg.Server.Landing.Enabled {
+		var page []byte
+		if cfg.Server.Landing.Page != "" {
+			var err error
+			if page, err = os.ReadFile(cfg.Server.Landing.Page); err != nil {
+				return fmt.Errorf("failed to read landing page: %w", err)
+			}
+		}
+		s.httpProxy.SetLanding(page, Version)
+	}
+	if maint := cfg.Server.Maintenance; maint.Page != "" || maint.RetryAfter > 0 {
+		var page []byte
+		if maint.Page != "" {
+			var err error
+			if page, err = os.ReadFile(maint.Page); err != nil {
+				return fmt.Errorf("failed to read maintenance page: %w", err)
+			}
+		}
+		s.httpProxy.SetMaintenancePage(page, maint.RetryAfter)
+	}
+	s.httpProxy.SetGlobalMaintenance(cfg.Server.Maintenance.Enabled)
+	for _, subdomain := range cfg.Server.Maintenance.Tunnels {
+		s.httpProxy.SetTunnelMaintenance(subdomain, true)
+	}
+	if cfg.Server.ServedByHeader || cfg.Server.TunnelIDHeader {
+		servedBy := ""
+		if cfg.Server.ServedByHeader {
+			servedBy = "tunnelab/" + Version
+		}
+		s.httpProxy.SetIdentityHeaders(servedBy, cfg.Server.TunnelIDHeader)
+	}
+	if err := s.httpProxy.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	if cfg.Logging.ConnectionLogs || cfg.Quota.Enabled {
+		s.logRate = 1
+		if cfg.Logging.ConnectionLogSampleRate != nil {
+			s.logRate = *cfg.Logging.ConnectionLogSampleRate
+		}
+		s.httpProxy.RequestHook = s.logConnection
+		s.httpProxy.ConnectionHook = s.logTCPConnection
+		if s.tcpProxy != nil {
+			s.tcpProxy.ConnectionHook = s.logTCPConnection
+		}
+	}
+
+	if cfg.Quota.Enabled {
+		s.enforcer = quota.NewEnforcer(s.repo, cfg.Quota.MonthlyBytes)
+		s.control.SetQuotaEnforcer(s.enforcer)
+		s.httpProxy.SetQuotaChecker(s.enforcer)
+		if s.tcpProxy != nil {
+			s.tcpProxy.SetQuotaChecker(s.enforcer)
+		}
+		log.Printf("Monthly byte quotas enabled (default %d bytes)", cfg.Quota.MonthlyBytes)
+	}
+
+	if cfg.CustomDomains.Enabled {
+		s.domains = domains.NewManager(s.repo, cfg.Server.Domain)
+		if err := s.domains.Load(context.Background()); err != nil {
+			return err
+		}
+		s.httpProxy.SetCustomDomains(s.domains)
+		log.Printf("Custom domains enabled")
+	}
+
+	s.webhooks = webhook.NewNotifier(webhook.Config{
+		URLs:    cfg.Webhooks.URLs,
+		Secret:  cfg.Webhooks.Secret,
+		Events:  cfg.Webhooks.Events,
+		Retries: max(cfg.Webhooks.Retries, 0),
+		Timeout: cfg.Webhooks.Timeout,
+	})
+	s.control.SetWebhookNotifier(s.webhooks)
+
+	s.checker.AddCheck("database", s.repo.PingContext)
+
+	controlMux := http.NewServeMux()
+	controlMux.HandleFunc(cfg.Server.ControlPath, s.control.HandleWebSocket)
+	controlMux.HandleFunc("GET /protocol/schema", s.control.HandleSchema)
+	// The probes stay off the HTTP port, where every path of every host
+	// belongs to the tunnels.
+	controlMux.HandleFunc("/healthz", s.checker.HandleLive)
+	controlMux.HandleFunc("/readyz", s.checker.HandleReady)
+	if cfg.Admin.Token != "" {
+		adminHandler := admin.NewHandler(s.control, cfg.Admin.Token)
+		adminHandler.SetUsageSource(s.repo)
+		adminHandler.SetClientUpdater(s.repo)
+		adminHandler.SetPoolHealthSource(s.registry)
+		adminHandler.SetClientActivitySource(s.registry)
+		adminHandler.SetMaintenanceController(s.httpProxy)
+		if s.domains != nil {
+			adminHandler.SetCustomDomainController(s.domains)
+		}
+		if cfg.Admin.Port != 0 {
+			adminMux := http.NewServeMux()
+			adminMux.Handle("/api/", adminHandler)
+			adminMux.HandleFunc("/healthz", s.checker.HandleLive)
+			adminMux.HandleFunc("/readyz", s.checker.HandleReady)
+			s.adminServer = s.newHTTPServer(adminMux)
+		} else {
+			controlMux.Handle("/api/", adminHandler)
+			log.Printf("Admin API enabled on control port")
+		}
+	}
+	s.controlServer = s.newHTTPServer(controlMux)
+
+	proxyMux := http.NewServeMux()
+	proxyMux.Handle("/", s.httpProxy)
+	proxyMux.HandleFunc("/health", s.httpProxy.HandleHealthCheck)
+	proxyHandler := s.httpProxy.WithConnect(proxyMux)
+	// The servers reject oversized HTTP/1 headers while reading them; the
+	// proxy checks the total again for HTTP/2 requests.
+	s.httpServer = s.newHTTPServer(proxyHandler)
+	s.httpServer.MaxHeaderBytes = cfg.Server.MaxHeaderBytes
+
+	tlsConfig, err := s.setupTLS(proxyMux)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		s.httpsServer = s.newHTTPServer(proxyHandler)
+		s.httpsServer.TLSConfig = tlsConfig
+		s.httpsServer.MaxHeaderBytes = cfg.Server.MaxHeaderBytes
+	}
+	return nil
+}
+
+// newHTTPServer creates an HTTP server for handler with the configured
+// timeouts, so slow clients cannot hold connections open indefinitely.
+func (s *Server) newHTTPServer(handler http.Handler) *http.Server {
+	timeouts := s.cfg.Server.HTTPTimeouts
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: timeouts.ReadHeader,
+		ReadTimeout:       timeouts.Read,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+	}
+}
+
+// setupTLS prepares the certificates for the HTTPS proxy.
+//
+// Returns:
+//   - *tls.Config: The HTTPS server configuration, or nil when TLS is disabled
+//   - error: Error if the certificates cannot be set up
+func (s *Server) setupTLS(proxyMux *http.ServeMux) (*tls.Config, error) {
+	cfg := s.cfg
+	tlsOptions := tlsmanager.Options{
+		MinVersion:   cfg.TLS.MinVersion,
+		Curves:       cfg.TLS.Curves,
+		CertKeyType:  cfg.TLS.CertKeyType,
+		OCSPStapling: cfg.TLS.OCSPStapling,
+		GoDefaults:   cfg.TLS.GoDefaults,
+	}
+
+	switch cfg.TLS.Mode {
+	case "auto":
+		var customDomains tlsmanager.CustomDomainLookup
+		if s.domains != nil {
+			customDomains = s.domains
+		}
+		certManager, err := tlsmanager.NewCertManager(&tlsmanager.Config{
+			Domain:   cfg.Server.Domain,
+			Email:    cfg.TLS.Email,
+			CacheDir: cfg.TLS.CacheDir,
+			Staging:  cfg.TLS.Staging,
+			Tunnels:  s.registry,
+			Options:  tlsOptions,
+
+			CustomDomains: customDomains,
+
+			DirectoryURL: cfg.TLS.DirectoryURL,
+			EABKeyID:     cfg.TLS.EABKeyID,
+			EABHMACKey:   cfg.TLS.EABHMACKey,
+
+			NegativeCacheTTL: cfg.TLS.NegativeCacheTTL,
+			IssuanceLimit:    cfg.TLS.IssuanceLimit,
+			IssuanceWindow:   cfg.TLS.IssuanceWindow,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create certificate manager: %w", err)
+		}
+		log.Printf("ACME autocert enabled for domain: %s", cfg.Server.Domain)
+		if cfg.TLS.Staging {
+			log.Printf("WARNING: Using Let's Encrypt STAGING environment")
+		}
+
+		proxyMux.Handle("/.well-known/acme-challenge/", certManager.HTTPHandler())
+		if cfg.TLS.SNIRouting {
+			certManager.SetHostFilter(s.httpProxy.AllowsServerName)
+		}
+		s.httpsMode = "Let's Encrypt"
+		return certManager.TLSConfig(), nil
+	case "manual":
+		tlsConfig, err := tlsmanager.LoadManualCerts(cfg.TLS.CertPath, cfg.TLS.KeyPath, tlsOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load manual certificates: %w", err)
+		}
+		if cfg.TLS.SNIRouting {
+			tlsConfig = tlsmanager.RestrictServerNames(tlsConfig, s.httpProxy.AllowsServerName)
+		}
+		s.httpsMode = "manual certs"
+		return tlsConfig, nil
+	default:
+		return nil, nil
+	}
+}
+
+// logConnection records a proxied request in the connection logs, if it is
+// sampled.
+func (s *Server) logConnection(info *proxy.RequestInfo) {
+	if !sampleConnection(info.Status, s.logRate) {
+		return
+	}
+	err := s.repo.LogConnection(&database.ConnectionLog{
+		TunnelID:       info.TunnelID,
+		ClientIP:       info.ClientIP,
+		RequestMethod:  info.Method,
+		RequestPath:    info.Path,
+		ResponseStatus: info.Status,
+		BytesSent:      info.BytesOut,
+		BytesReceived:  info.BytesIn,
+		DurationMs:     int(info.Duration.Milliseconds()),
+		CreatedAt:      info.StartedAt,
+	})
+	if err != nil {
+		log.Printf("Failed to log connection for tunnel %s: %v", info.TunnelID, err)
+	}
+}
+
+// logTCPConnection records a connection to a TCP tunnel, or a CONNECT session
+// bridged to one, in the connection logs, if it is sampled.
+func (s *Server) logTCPConnection(info *proxy.ConnectionInfo) {
+	if !sampleConnection(0, s.logRate) {
+		return
+	}
+	if err := s.repo.LogConnection(tcpConnectionLog(info)); err != nil {
+		log.Printf("Failed to log connection for tunnel %s: %v", info.TunnelID, err)
+	}
+}
+
+// tcpConnectionLog builds the connection log entry of a TCP connection. TCP
+// connections have no method, path or status, so those are left empty.
+func tcpConnectionLog(info *proxy.ConnectionInfo) *database.ConnectionLog {
+	return &database.ConnectionLog{
+		TunnelID:      info.TunnelID,
+		ClientIP:      info.ClientIP,
+		PublicPort:    info.Port,
+		BytesSent:     info.BytesOut,
+		BytesReceived: info.BytesIn,
+		DurationMs:    int(info.Duration.Milliseconds()),
+		CreatedAt:     info.StartedAt,
+	}
+}
+
+// sampleConnection reports whether a request with status is written to the
+// connection logs: server errors always are, other requests with probability
+// rate.
+func sampleConnection(status int, rate float64) bool {
+	if status >= http.StatusInternalServerError || rate >= 1 {
+		return true
+	}
+	return rand.Float64() < rate
+}
+
+// Start binds every listener and starts serving in the background. If a
+// listener cannot be bound, the ones already bound are closed again.
+//
+// Returns:
+//   - error: Error if the server was already started or a port cannot be bound
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return errors.New("server already started")
+	}
+
+	controlListener, err := listen("control server", s.cfg.Server.ControlPort)
+	if err != nil {
+		return err
+	}
+	httpListener, err := listen("HTTP proxy", s.cfg.Server.HTTPPort)
+	if err != nil {
+		controlListener.Close()
+		return err
+	}
+	var httpsListener net.Listener
+	if s.httpsServer != nil {
+		httpsListener, err = listen("HTTPS proxy", s.cfg.Server.HTTPSPort)
+		if err != nil {
+			controlListener.Close()
+			httpListener.Close()
+			return err
+		}
+	}
+	var adminListener net.Listener
+	if s.adminServer != nil {
+		adminListener, err = listenOn("admin API", s.cfg.Admin.BindAddress, s.cfg.Admin.Port)
+		if err != nil {
+			s.closeListeners(controlListener, httpListener, httpsListener)
+			return err
+		}
+	}
+	var peerListener net.Listener
+	if s.peerServer != nil {
+		peerListener, err = listen("peer listener", s.cfg.Cluster.PeerPort)
+		if err != nil {
+			s.closeListeners(controlListener, httpListener, httpsListener, adminListener)
+			return err
+		}
+	}
+
+	if s.tcpProxy != nil {
+		if s.cfg.Tunnels.TCPPortRange != "" {
+			if err := s.tcpProxy.StartTCPServer(s.cfg.Tunnels.TCPPortRange); err != nil {
+				s.closeListeners(controlListener, httpListener, httpsListener, adminListener, peerListener)
+				return fmt.Errorf("failed to start TCP proxy: %w", err)
+			}
+			log.Printf("TCP tunneling enabled on ports %s", s.cfg.Tunnels.TCPPortRange)
+		}
+		if s.cfg.Tunnels.SNIPort > 0 {
+			if err := s.tcpProxy.StartSNIServer(s.cfg.Tunnels.SNIPort, s.cfg.Server.Domain); err != nil {
+				s.closeListeners(controlListener, httpListener, httpsListener, adminListener, peerListener)
+				return fmt.Errorf("failed to start SNI proxy: %w", err)
+			}
+			log.Printf("SNI-routed TLS passthrough enabled on port %d", s.cfg.Tunnels.SNIPort)
+		}
+	}
+
+	s.started = true
+	s.controlAddr = controlListener.Addr()
+	s.httpAddr = httpListener.Addr()
+
+	log.Printf("Starting control server on %s", s.controlAddr)
+	s.serve("Control server", "control_listener", func() error { return s.controlServer.Serve(controlListener) })
+	log.Printf("Starting HTTP proxy on %s", s.httpAddr)
+	s.serve("HTTP proxy", "http_listener", func() error { return s.httpServer.Serve(httpListener) })
+	if httpsListener != nil {
+		s.httpsAddr = httpsListener.Addr()
+		log.Printf("Starting HTTPS proxy on %s (%s)", s.httpsAddr, s.httpsMode)
+		s.serve("HTTPS proxy", "https_listener", func() error { return s.httpsServer.ServeTLS(httpsListener, "", "") })
+	}
+	if adminListener != nil {
+		s.adminAddr = adminListener.Addr()
+		log.Printf("Starting admin API on %s", s.adminAddr)
+		s.serve("Admin API", "", func() error { return s.adminServer.Serve(adminListener) })
+	}
+	if peerListener != nil {
+		s.peerAddr = peerListener.Addr()
+		log.Printf("Starting peer listener on %s", s.peerAddr)
+		s.serve("Peer listener", "", func() error { return s.peerServer.ServeTLS(peerListener, "", "") })
+	}
+
+	if s.store != nil {
+		go s.registry.RunOwnershipRefresh(s.done)
+	}
+	if s.enforcer != nil {
+		go s.enforcer.Run(s.cfg.Quota.CheckInterval, s.done)
+	}
+	if s.domains != nil {
+		go s.domains.Run(s.cfg.CustomDomains.RefreshInterval, s.done)
+	}
+	go s.registry.RunPoolHealthChecks(s.done)
+	return nil
+}
+
+// listen binds a TCP port on all IPv4 and IPv6 interfaces (0 picks an
+// ephemeral port).
+func listen(name string, port int) (net.Listener, error) {
+	return listenOn(name, "", port)
+}
+
+// listenOn binds a TCP port on the interface of host ("" means all).
+func listenOn(name, host string, port int) (net.Listener, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to listen: %w", name, err)
+	}
+	return ln, nil
+}
+
+// serve runs an HTTP server loop in the background and logs how it ended.
+// With a readiness check name, /readyz reports the listener once the loop
+// runs and fails it again if the loop stops with an error.
+func (s *Server) serve(name, check string, run func() error) {
+	bound := func() {}
+	if check != "" {
+		bound = s.checker.AddListener(check)
+	}
+	go func() {
+		bound()
+		if err := run(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("%s failed: %v", name, err)
+			if check != "" {
+				s.checker.ListenerDown(check, err)
+			}
+		}
+	}()
+}
+
+func (s *Server) closeListeners(listeners ...net.Listener) {
+	for _, ln := range listeners {
+		if ln != nil {
+			ln.Close()
+		}
+	}
+	if s.tcpProxy != nil {
+		s.tcpProxy.Close()
+	}
+}
+
+// Shutdown stops accepting connections, waits for in-flight HTTP requests
+// until ctx is done, closes the control connections and mux sessions, stops
+// the background jobs and closes the database.
+//
+// Parameters:
+//   - ctx: Bounds how long in-flight requests may take to finish
+//
+// Returns:
+//   - error: Errors from stopping the servers or closing resources
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []error
+	s.shutdownOnce.Do(func() {
+		close(s.done)
+		for _, srv := range []*http.Server{s.controlServer, s.httpServer, s.httpsServer, s.adminServer, s.peerServer} {
+			if srv == nil {
+				continue
+			}
+			if err := srv.Shutdown(ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		// The control WebSockets are hijacked, so the HTTP servers neither
+		// wait for nor close them.
+		s.control.CloseConnections()
+		s.registry.CloseMuxSessions()
+		if s.tcpProxy != nil {
+			s.tcpProxy.Close()
+		}
+		s.webhooks.Close()
+		if err := s.closeResources(); err != nil {
+			errs = append(errs, err)
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// closeResources closes the Redis store and the database.
+func (s *Server) closeResources() error {
+	var errs []error
+	if s.store != nil {
+		if err := s.store.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := s.repo.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// ControlAddr returns the address of the control listener, or nil before Start.
+func (s *Server) ControlAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.controlAddr
+}
+
+// HTTPAddr returns the address of the HTTP proxy listener, or nil before Start.
+func (s *Server) HTTPAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.httpAddr
+}
+
+// HTTPSAddr returns the address of the HTTPS proxy listener, or nil before
+// Start or when TLS is disabled.
+func (s *Server) HTTPSAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.httpsAddr
+}
+
+// AdminAddr returns the address of the admin API listener, or nil before
+// Start or when the admin API is served on the control port.
+func (s *Server) AdminAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.adminAddr
+}
+
+// PeerAddr returns the address of the listener for stream links from other
+// nodes, or nil before Start or outside cluster mode.
+func (s *Server) PeerAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerAddr
+}
+
+// Registry returns the registry of active tunnels.
+func (s *Server) Registry() *registry.Registry {
+	return s.registry
+}
@@ -0,0 +1,454 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/essajiwa/tunnelab/internal/database"
+	"github.com/essajiwa/tunnelab/internal/server/proxy"
+	"github.com/essajiwa/tunnelab/internal/server/registry"
+	"github.com/essajiwa/tunnelab/pkg/server/config"
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+)
+
+// newTestConfig returns a valid configuration that listens on ephemeral
+// ports, without TLS or TCP tunnels.
+func newTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.yaml")
+	content := fmt.Sprintf("server:\n  domain: tunnel.example.com\ndatabase:\n  path: %s\n", filepath.Join(dir, "tunnelab.db"))
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	cfg.Server.ControlPort = 0
+	cfg.Server.HTTPPort = 0
+	cfg.Tunnels.TCPPortRange = ""
+	return cfg
+}
+
+// localURL builds a URL for a listener bound on all interfaces.
+func localURL(addr net.Addr, path string) string {
+	return fmt.Sprintf("http://127.0.0.1:%d%s", addr.(*net.TCPAddr).Port, path)
+}
+
+func TestServerStartAndShutdown(t *testing.T) {
+	srv, err := New(newTestConfig(t))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if srv.HTTPAddr() != nil {
+		t.Fatal("expected no listener before Start")
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	if err := srv.Start(); err == nil {
+		t.Fatal("expected a second Start to fail")
+	}
+
+	for _, url := range []string{
+		localURL(srv.ControlAddr(), "/readyz"),
+		localURL(srv.HTTPAddr(), "/health"),
+		localURL(srv.ControlAddr(), "/protocol/schema"),
+	} {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", url, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d", url, resp.StatusCode)
+		}
+	}
+
+	// The HTTP port leaves the probe paths to the tunnels.
+	resp, err := http.Get(localURL(srv.HTTPAddr(), "/readyz"))
+	if err != nil {
+		t.Fatalf("GET /readyz on the HTTP port failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("expected /readyz on the HTTP port to be left to the proxy")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("expected a second Shutdown to be a no-op, got %v", err)
+	}
+
+	if conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", srv.HTTPAddr().(*net.TCPAddr).Port), time.Second); err == nil {
+		conn.Close()
+		t.Fatal("expected the HTTP listener to be closed after Shutdown")
+	}
+}
+
+func TestReadinessFailsWhenListenerStops(t *testing.T) {
+	srv, err := New(newTestConfig(t))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+
+	readyz := func() int {
+		t.Helper()
+		resp, err := http.Get(localURL(srv.ControlAddr(), "/readyz"))
+		if err != nil {
+			t.Fatalf("GET /readyz failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := readyz(); code != http.StatusOK {
+		t.Fatalf("expected /readyz to be 200 while every listener serves, got %d", code)
+	}
+
+	// The HTTP proxy loop stops with an error, as it does when Accept fails.
+	srv.serve("HTTP proxy", "http_listener", func() error { return errors.New("accept failed") })
+	deadline := time.Now().Add(2 * time.Second)
+	for readyz() != http.StatusServiceUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("expected /readyz to be 503 after the HTTP listener stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerShutdownClosesControlConnections(t *testing.T) {
+	srv, err := New(newTestConfig(t))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/", srv.ControlAddr().(*net.TCPAddr).Port), nil)
+	if err != nil {
+		t.Fatalf("failed to open control connection: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected the control connection to be closed as going away, got %v", err)
+	}
+}
+
+func TestServerStartFailsOnBusyPort(t *testing.T) {
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to occupy a port: %v", err)
+	}
+	defer busy.Close()
+
+	cfg := newTestConfig(t)
+	cfg.Server.HTTPPort = busy.Addr().(*net.TCPAddr).Port
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	if err := srv.Start(); err == nil {
+		t.Fatal("expected Start to fail when the HTTP port is taken")
+	}
+	if srv.ControlAddr() != nil {
+		t.Fatal("expected no listener to stay bound after a failed Start")
+	}
+}
+
+func TestServerAppliesHTTPTimeouts(t *testing.T) {
+	cfg := newTestConfig(t)
+	if cfg.Server.HTTPTimeouts.ReadHeader != 10*time.Second || cfg.Server.HTTPTimeouts.Idle != 2*time.Minute {
+		t.Fatalf("unexpected default timeouts: %+v", cfg.Server.HTTPTimeouts)
+	}
+	cfg.Server.HTTPTimeouts.Read = time.Minute
+	cfg.Server.HTTPTimeouts.Write = 2 * time.Minute
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	for name, hs := range map[string]*http.Server{"control": srv.controlServer, "http": srv.httpServer} {
+		if hs.ReadHeaderTimeout != 10*time.Second || hs.ReadTimeout != time.Minute || hs.WriteTimeout != 2*time.Minute || hs.IdleTimeout != 2*time.Minute {
+			t.Fatalf("%s server: unexpected timeouts read_header=%v read=%v write=%v idle=%v",
+				name, hs.ReadHeaderTimeout, hs.ReadTimeout, hs.WriteTimeout, hs.IdleTimeout)
+		}
+	}
+}
+
+func TestControlServerTimesOutStalledHandshake(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Server.HTTPTimeouts.ReadHeader = 200 * time.Millisecond
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", srv.ControlAddr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	// Start an upgrade request but never finish its headers.
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: tunnel.example.com\r\nUpgrade: websocket\r\n")); err != nil {
+		t.Fatalf("failed to write partial handshake: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the stalled handshake to be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("expected the server to close the stalled handshake before the client gave up")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected the handshake to be timed out quickly, took %v", elapsed)
+	}
+}
+
+func TestSampleConnectionHonorsRateAndKeepsErrors(t *testing.T) {
+	const requests = 10000
+	tests := map[string]struct {
+		rate     float64
+		min, max int
+	}{
+		"all":     {rate: 1, min: requests, max: requests},
+		"quarter": {rate: 0.25, min: 2200, max: 2800},
+		"none":    {rate: 0, min: 0, max: 0},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			logged := 0
+			for i := 0; i < requests; i++ {
+				if sampleConnection(http.StatusOK, tt.rate) {
+					logged++
+				}
+				if !sampleConnection(http.StatusBadGateway, tt.rate) {
+					t.Fatalf("expected a server error to always be logged at rate %v", tt.rate)
+				}
+			}
+			if logged < tt.min || logged > tt.max {
+				t.Fatalf("expected %d-%d of %d requests to be logged at rate %v, got %d", tt.min, tt.max, requests, tt.rate, logged)
+			}
+		})
+	}
+}
+
+func TestTCPConnectionLogRecord(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	entry := tcpConnectionLog(&proxy.ConnectionInfo{
+		TunnelID:  "tunnel-db",
+		Subdomain: "db",
+		Port:      30001,
+		BytesIn:   120,
+		BytesOut:  4096,
+		Duration:  1500 * time.Millisecond,
+		ClientIP:  "198.51.100.7",
+		StartedAt: start,
+	})
+
+	want := database.ConnectionLog{
+		TunnelID:      "tunnel-db",
+		ClientIP:      "198.51.100.7",
+		PublicPort:    30001,
+		BytesSent:     4096,
+		BytesReceived: 120,
+		DurationMs:    1500,
+		CreatedAt:     start,
+	}
+	if *entry != want {
+		t.Fatalf("expected %+v, got %+v", want, *entry)
+	}
+}
+
+func TestConnectSessionsAreLogged(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Logging.ConnectionLogs = true
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+
+	if err := srv.repo.CreateClient(&database.Client{ID: "client", Name: "demo", APIToken: "token", Status: "active"}); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if err := srv.repo.CreateTunnel(&database.Tunnel{ID: "tunnel-db", ClientID: "client", Subdomain: "db", Protocol: "tcp", LocalPort: 5432, PublicPort: 30001, Status: "active"}); err != nil {
+		t.Fatalf("failed to create tunnel: %v", err)
+	}
+	serverConn, clientConn := net.Pipe()
+	serverSession, _ := yamux.Server(serverConn, nil)
+	clientSession, _ := yamux.Client(clientConn, nil)
+	t.Cleanup(func() { clientSession.Close(); serverSession.Close() })
+	go func() {
+		for {
+			stream, err := clientSession.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(stream, stream); stream.Close() }()
+		}
+	}()
+	if err := srv.registry.Register(&registry.TunnelInfo{ID: "tunnel-db", ClientID: "client", Subdomain: "db", Protocol: "tcp", PublicPort: 30001, MuxSession: serverSession}); err != nil {
+		t.Fatalf("failed to register tunnel: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", srv.HTTPAddr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatalf("failed to dial the HTTP port: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT db.tunnel.example.com:443 HTTP/1.1\r\nHost: db.tunnel.example.com:443\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected CONNECT to be accepted, got %v %v", resp, err)
+	}
+	io.WriteString(conn, "ping")
+	if _, err := io.ReadFull(reader, make([]byte, 4)); err != nil {
+		t.Fatalf("failed to read the echo: %v", err)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		usage, err := srv.repo.GetClientUsage("client", time.Time{})
+		if err != nil {
+			t.Fatalf("failed to read usage: %v", err)
+		}
+		if usage.Requests == 1 && usage.BytesReceived == 4 && usage.BytesSent == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the CONNECT session to be logged with 4 bytes each way, got %+v", usage)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestControlHandlerOnlyUpgradesOnConfiguredPath(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Server.ControlPath = "/tunnel"
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	base := fmt.Sprintf("ws://127.0.0.1:%d", srv.ControlAddr().(*net.TCPAddr).Port)
+	conn, _, err := websocket.DefaultDialer.Dial(base+"/tunnel", nil)
+	if err != nil {
+		t.Fatalf("expected the control path to upgrade: %v", err)
+	}
+	conn.Close()
+
+	for _, path := range []string{"/", "/other", "/tunnel/extra"} {
+		conn, resp, err := websocket.DefaultDialer.Dial(base+path, nil)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("expected %s not to upgrade", path)
+		}
+		if resp == nil || resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected 404 for %s, got %v (%v)", path, resp, err)
+		}
+	}
+}
+
+func TestAdminPortRequiresToken(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to pick a port: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	cfg := newTestConfig(t)
+	cfg.Admin.Token = "secret"
+	cfg.Admin.Port = port
+	cfg.Admin.BindAddress = "127.0.0.1"
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	get := func(url, token string) int {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to request %s: %v", url, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	adminURL := localURL(srv.AdminAddr(), "/api/clients")
+	tests := map[string]struct {
+		token string
+		want  int
+	}{
+		"no token":    {token: "", want: http.StatusUnauthorized},
+		"wrong token": {token: "guess", want: http.StatusUnauthorized},
+		"admin token": {token: "secret", want: http.StatusOK},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := get(adminURL, tt.token); got != tt.want {
+				t.Fatalf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+
+	if got := get(localURL(srv.ControlAddr(), "/api/clients"), "secret"); got == http.StatusOK {
+		t.Fatal("expected the control port not to serve the admin API")
+	}
+}